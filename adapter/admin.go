@@ -0,0 +1,106 @@
+package adapter
+
+import (
+	"net"
+	"net/rpc"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+const adminSocketName = "hardwarestore-admin.sock"
+
+// AdminSocket is only accessible to the user running the daemon and serves
+// operator commands
+var AdminSocket = SocketPath + "/" + adminSocketName
+
+// AdminServer serves the RPCs of the admin socket
+type AdminServer struct {
+	peer *peerCred
+}
+
+type ListApprovalsReq struct {
+}
+
+type ListApprovalsRes struct {
+	Pending []PendingApproval
+}
+
+type DecideApprovalReq struct {
+	ID      string
+	Approve bool
+}
+
+type DecideApprovalRes struct {
+}
+
+// ListApprovals returns the sign requests waiting for approval
+func (s *AdminServer) ListApprovals(req ListApprovalsReq, res *ListApprovalsRes) error {
+	res.Pending = approvals.list()
+	sort.Slice(res.Pending, func(i, j int) bool {
+		return res.Pending[i].Submitted.Before(res.Pending[j].Submitted)
+	})
+	return nil
+}
+
+// DecideApproval approves or denies a pending sign request
+func (s *AdminServer) DecideApproval(req DecideApprovalReq, res *DecideApprovalRes) error {
+	a, err := approvals.decide(req.ID, req.Approve)
+	event := "sign_approved"
+	if !req.Approve {
+		event = "sign_rejected"
+	}
+	audit(event, s.peer, logrus.Fields{"request_id": req.ID, "key_id": a.KeyID, "role": a.Role, "requester": a.Peer}, err)
+	return rpcError(err)
+}
+
+// umaskLock serializes the umask changes of listenPrivate
+var umaskLock sync.Mutex
+
+// listenPrivate creates a unix socket at path which only the user running
+// the daemon may connect to. It is created under a umask which keeps others
+// out from the start, the chmod afterwards is a second line of defence
+func listenPrivate(path string) (net.Listener, error) {
+	os.Remove(path)
+	umaskLock.Lock()
+	umask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	umaskLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// listenAdmin creates the admin socket and serves it until the listener is closed
+func listenAdmin() (net.Listener, error) {
+	listener, err := listenPrivate(AdminSocket)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				logrus.Debugf("Stopped accepting admin connections: %v", err)
+				return
+			}
+			go func() {
+				peer := peerCredentials(conn)
+				logrus.Infof("Accepted admin connection from %s", peer)
+				server := rpc.NewServer()
+				server.RegisterName("Admin", &AdminServer{peer: peer})
+				server.ServeCodec(newServerCodec(conn, peer))
+			}()
+		}
+	}()
+	return listener, nil
+}
@@ -0,0 +1,29 @@
+package adapter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenPrivate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sockets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	umask := syscall.Umask(0)
+	defer syscall.Umask(umask)
+
+	path := filepath.Join(dir, "private.sock")
+	listener, err := listenPrivate(path)
+	require.NoError(t, err)
+	defer listener.Close()
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	// the umask of the daemon is left alone
+	require.Equal(t, 0, syscall.Umask(0))
+}
@@ -0,0 +1,100 @@
+package adapter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+// PendingApproval is a sign request waiting for an operator decision
+type PendingApproval struct {
+	ID        string
+	KeyID     string
+	Role      string
+	Peer      string
+	Digest    string
+	Submitted time.Time
+}
+
+type approval struct {
+	PendingApproval
+	decision chan bool
+}
+
+// approvalQueue holds the sign requests waiting for approval in approval mode
+type approvalQueue struct {
+	mu      sync.Mutex
+	nextID  int
+	pending map[string]*approval
+}
+
+var (
+	approvalMode    bool
+	approvalTimeout time.Duration
+	approvals       = &approvalQueue{pending: make(map[string]*approval)}
+)
+
+// wait queues a sign request and blocks until an operator approved or
+// denied it, or until the timeout passed
+func (q *approvalQueue) wait(peer *peerCred, keyID string, role string, payload []byte, timeout time.Duration) error {
+	digest := sha256.Sum256(payload)
+	q.mu.Lock()
+	q.nextID++
+	a := &approval{
+		PendingApproval: PendingApproval{
+			ID:        strconv.Itoa(q.nextID),
+			KeyID:     keyID,
+			Role:      role,
+			Peer:      peer.String(),
+			Digest:    hex.EncodeToString(digest[:]),
+			Submitted: time.Now(),
+		},
+		decision: make(chan bool, 1),
+	}
+	q.pending[a.ID] = a
+	q.mu.Unlock()
+
+	defer func() {
+		q.mu.Lock()
+		delete(q.pending, a.ID)
+		q.mu.Unlock()
+	}()
+
+	select {
+	case approved := <-a.decision:
+		if !approved {
+			return yubikey.NewError(yubikey.ErrCodePolicyDenied, "sign request %s was denied by the operator", a.ID)
+		}
+		return nil
+	case <-time.After(timeout):
+		return yubikey.NewError(yubikey.ErrCodePolicyDenied, "sign request %s was not approved within %s", a.ID, timeout)
+	}
+}
+
+// list returns all pending requests
+func (q *approvalQueue) list() []PendingApproval {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	list := make([]PendingApproval, 0, len(q.pending))
+	for _, a := range q.pending {
+		list = append(list, a.PendingApproval)
+	}
+	return list
+}
+
+// decide approves or denies the pending request with the given ID
+func (q *approvalQueue) decide(id string, approve bool) (PendingApproval, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	a, ok := q.pending[id]
+	if !ok {
+		return PendingApproval{}, yubikey.NewError(yubikey.ErrCodeInvalidRequest, "no pending sign request with ID %s", id)
+	}
+	delete(q.pending, id)
+	a.decision <- approve
+	return a.PendingApproval, nil
+}
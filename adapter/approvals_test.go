@@ -0,0 +1,41 @@
+package adapter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApprovalQueue(t *testing.T) {
+	q := &approvalQueue{pending: make(map[string]*approval)}
+
+	result := make(chan error)
+	go func() { result <- q.wait(nil, "abc", "root", []byte("payload"), time.Minute) }()
+	waitForPending(t, q)
+
+	pending := q.list()[0]
+	require.Equal(t, "abc", pending.KeyID)
+	_, err := q.decide(pending.ID, true)
+	require.NoError(t, err)
+	require.NoError(t, <-result)
+	require.Empty(t, q.list())
+
+	go func() { result <- q.wait(nil, "abc", "root", []byte("payload"), time.Minute) }()
+	waitForPending(t, q)
+	_, err = q.decide(q.list()[0].ID, false)
+	require.NoError(t, err)
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(<-result))
+
+	require.Error(t, q.wait(nil, "abc", "root", nil, time.Millisecond))
+	_, err = q.decide("unknown", true)
+	require.Error(t, err)
+}
+
+func waitForPending(t *testing.T, q *approvalQueue) {
+	for i := 0; i < 1000 && len(q.list()) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	require.Len(t, q.list(), 1)
+}
@@ -0,0 +1,396 @@
+package adapter
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/rpc"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+const (
+	attestationReportUsage = "attestation report -key <key-id> [-pin-file <file>] [-out <file>]"
+	attestationVerifyUsage = "attestation verify [-ca <file>] <report-file>"
+	attestationUsage       = attestationReportUsage + "\n       " + attestationVerifyUsage
+	// attestationReportVersion is raised on incompatible changes of the report
+	attestationReportVersion = 1
+)
+
+// AttestationReport is the evidence of the signing setup handed to auditors.
+// A yubikey's attestation key only signs attestations, so the report is
+// signed by a key of the token whose attestation, issued by the attestation
+// key, is part of the report. The device certificate in turn is issued by
+// the vendor, which gives a chain from the vendor CA to the signature
+type AttestationReport struct {
+	Version int        `json:"version"`
+	Created time.Time  `json:"created"`
+	Token   *tokenJSON `json:"token"`
+	// DeviceCertificate is the DER encoded certificate of the attestation key
+	DeviceCertificate []byte       `json:"device_certificate"`
+	Slots             []ReportSlot `json:"slots"`
+	// SignerKeyID is the key the report is signed with
+	SignerKeyID string `json:"signer_key_id"`
+}
+
+// ReportSlot is an occupied slot of the token, either holding a notary key
+// or a key notary does not use, which has a Subject instead
+type ReportSlot struct {
+	Slot            string `json:"slot"`
+	KeyID           string `json:"key_id,omitempty"`
+	Role            string `json:"role,omitempty"`
+	Subject         string `json:"subject,omitempty"`
+	PublicKeySHA256 string `json:"public_key_sha256"`
+	// Attestation is the DER encoded attestation certificate of the key,
+	// keys which were imported have none
+	Attestation []byte `json:"attestation,omitempty"`
+}
+
+// SignedAttestationReport is a report together with its signature
+type SignedAttestationReport struct {
+	// Report is the JSON encoded AttestationReport, the signature is over these bytes
+	Report          []byte `json:"report"`
+	DigestAlgorithm string `json:"digest_algorithm"`
+	// Signature is the DER encoded ECDSA signature
+	Signature []byte `json:"signature"`
+}
+
+// AttestationReportReq asks for a report signed with the key KeyID
+type AttestationReportReq struct {
+	RequestMeta
+	wire.Version
+	Session uint
+	KeyID   string
+	// Pass is the PIN, it is needed to sign the report
+	Pass yubikey.Secret
+}
+
+type AttestationReportRes struct {
+	wire.Version
+	Report SignedAttestationReport
+}
+
+// reportDigests are the digests the report is signed with, by curve size
+var reportDigests = map[int]string{256: "sha256", 384: "sha384", 521: "sha512"}
+
+var reportHashes = map[string]crypto.Hash{"sha256": crypto.SHA256, "sha384": crypto.SHA384, "sha512": crypto.SHA512}
+
+// assembleAttestationReport adds the attestations in att to the slots
+// holding the attested keys. The signer must be among the attested keys,
+// otherwise nothing links the signature to the device
+func assembleAttestationReport(token *tokenJSON, slots []ReportSlot, att backend.Attestation, signerKeyID string, now time.Time) (AttestationReport, error) {
+	report := AttestationReport{
+		Version:           attestationReportVersion,
+		Created:           now.UTC(),
+		Token:             token,
+		DeviceCertificate: att.Device,
+		Slots:             slots,
+		SignerKeyID:       signerKeyID,
+	}
+	attested := make(map[string][]byte)
+	for _, der := range att.Keys {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return report, yubikey.WrapError(yubikey.ErrCodeDevice, err)
+		}
+		pub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+		if err != nil {
+			continue
+		}
+		attested[publicKeySHA256(pub)] = der
+	}
+	signed := false
+	for i := range report.Slots {
+		report.Slots[i].Attestation = attested[report.Slots[i].PublicKeySHA256]
+		if report.Slots[i].KeyID == signerKeyID && report.Slots[i].Attestation != nil {
+			signed = true
+		}
+	}
+	if !signed {
+		return report, yubikey.NewError(yubikey.ErrCodeInvalidRequest, "key %s was not generated on the token, it can not sign the report", signerKeyID)
+	}
+	sort.Slice(report.Slots, func(i, j int) bool { return report.Slots[i].Slot < report.Slots[j].Slot })
+	return report, nil
+}
+
+// buildAttestationReport collects the token info, the slots and their
+// attestations. It returns the slot of the signer as well
+func buildAttestationReport(session pkcs11.SessionHandle, signerKeyID string, now time.Time) (AttestationReport, common.HardwareSlot, error) {
+	provider, ok := ks.(backend.AttestationProvider)
+	if !ok {
+		return AttestationReport{}, common.HardwareSlot{}, yubikey.NewError(yubikey.ErrCodeInvalidRequest, "backend %s does not support attestation", ks.Name())
+	}
+	keys, err := ks.HardwareListKeys(session)
+	if err != nil {
+		return AttestationReport{}, common.HardwareSlot{}, err
+	}
+	signer, ok := keys[signerKeyID]
+	if !ok {
+		return AttestationReport{}, signer, yubikey.NewError(yubikey.ErrCodeKeyNotFound, "no key with ID %s on the token", signerKeyID)
+	}
+	var token *tokenJSON
+	if inspector, ok := ks.(backend.TokenInspector); ok {
+		ti, err := inspector.TokenInfo(session)
+		if err != nil {
+			return AttestationReport{}, signer, err
+		}
+		token = newTokenJSON(&ti, deviceAlias(ti.Serial))
+	}
+	var slots []ReportSlot
+	for keyID, slot := range keys {
+		pubKey, role, err := ks.GetECDSAKey(session, slot, "")
+		if err != nil {
+			return AttestationReport{}, signer, err
+		}
+		if keyID == signerKeyID {
+			signer.Role = role
+		}
+		slots = append(slots, ReportSlot{Slot: yubikey.SlotName(slot.SlotID), KeyID: keyID, Role: string(role), PublicKeySHA256: publicKeySHA256(pubKey.Public())})
+	}
+	if lister, ok := ks.(backend.ForeignKeyLister); ok {
+		foreign, err := lister.ForeignKeys(session)
+		if err != nil {
+			return AttestationReport{}, signer, err
+		}
+		for _, key := range foreign {
+			pub, err := x509.MarshalPKIXPublicKey(key.PublicKey)
+			if err != nil {
+				continue
+			}
+			slots = append(slots, ReportSlot{Slot: yubikey.SlotName(key.SlotID), Subject: key.Subject, PublicKeySHA256: publicKeySHA256(pub)})
+		}
+	}
+	att, err := provider.Attestation(session)
+	if err != nil {
+		return AttestationReport{}, signer, err
+	}
+	report, err := assembleAttestationReport(token, slots, att, signerKeyID, now)
+	return report, signer, err
+}
+
+// AttestationReport creates a report of the token and signs it with the key
+// KeyID, which has to pass the same checks as for any other signature
+func (s *ESServer) AttestationReport(req AttestationReportReq, res *AttestationReportRes) error {
+	defer sessionQueues.acquire(req.Session)()
+	session := pkcs11.SessionHandle(req.Session)
+	report, slot, err := buildAttestationReport(session, req.KeyID, time.Now())
+	if err != nil {
+		return rpcError(err)
+	}
+	cert, err := x509.ParseCertificate(attestationOf(report, req.KeyID))
+	if err != nil {
+		return rpcError(yubikey.WrapError(yubikey.ErrCodeDevice, err))
+	}
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return rpcError(yubikey.NewError(yubikey.ErrCodeInvalidRequest, "key %s is no ECDSA key", req.KeyID))
+	}
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return rpcError(err)
+	}
+
+	fields := req.logFields(logrus.Fields{"key_id": req.KeyID, "role": slot.Role, "slot": slot.SlotID})
+	pass, err := config.Secrets.secret(SecretUserPin, req.Pass)
+	if err != nil {
+		return rpcError(yubikey.WrapError(yubikey.ErrCodeWrongPin, err))
+	}
+	unreserve, err := s.authorizeSign(req.KeyID, string(slot.Role), payload, pass)
+	if err != nil {
+		audit("sign_denied", s.peer, fields, err)
+		signMetrics.recordSign(req.KeyID, string(slot.Role), err)
+		return rpcError(err)
+	}
+	digest := reportDigests[pub.Curve.Params().BitSize]
+	sig, err := signOnDevices(session, slot, pass.Reveal(), payload, backend.SignOptions{DigestAlgorithm: digest, Encoding: yubikey.EncodingDER})
+	audit("attestation_report", s.peer, fields, err)
+	signMetrics.recordSign(req.KeyID, string(slot.Role), err)
+	if err != nil {
+		unreserve()
+		return rpcError(err)
+	}
+	res.Report = SignedAttestationReport{Report: payload, DigestAlgorithm: digest, Signature: sig}
+	return nil
+}
+
+// attestationOf returns the attestation of the key keyID in report
+func attestationOf(report AttestationReport, keyID string) []byte {
+	for _, slot := range report.Slots {
+		if slot.KeyID == keyID {
+			return slot.Attestation
+		}
+	}
+	return nil
+}
+
+// verifyAttestationReport checks that the report is signed by its signer,
+// that the attestations were issued by the device certificate and that the
+// device certificate chains up to roots
+func verifyAttestationReport(signed SignedAttestationReport, roots *x509.CertPool) (*AttestationReport, error) {
+	if roots == nil {
+		return nil, errors.New("no CA to verify the device certificate")
+	}
+	report := new(AttestationReport)
+	if err := json.Unmarshal(signed.Report, report); err != nil {
+		return nil, fmt.Errorf("invalid report: %v", err)
+	}
+	if report.Version != attestationReportVersion {
+		return nil, fmt.Errorf("unsupported report version %d", report.Version)
+	}
+	device, err := x509.ParseCertificate(report.DeviceCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device certificate: %v", err)
+	}
+	if _, err := device.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		return nil, fmt.Errorf("device certificate: %v", err)
+	}
+	for _, slot := range report.Slots {
+		if slot.Attestation == nil {
+			continue
+		}
+		cert, err := x509.ParseCertificate(slot.Attestation)
+		if err != nil {
+			return nil, fmt.Errorf("attestation of slot %s: %v", slot.Slot, err)
+		}
+		if err := yubikey.VerifyAttestation(device, cert, roots); err != nil {
+			return nil, fmt.Errorf("attestation of slot %s is not issued by the device: %v", slot.Slot, err)
+		}
+		pub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+		if err != nil || publicKeySHA256(pub) != slot.PublicKeySHA256 {
+			return nil, fmt.Errorf("attestation of slot %s is for another key", slot.Slot)
+		}
+	}
+
+	attestation := attestationOf(*report, report.SignerKeyID)
+	if attestation == nil {
+		return nil, fmt.Errorf("the signer %s has no attestation", report.SignerKeyID)
+	}
+	cert, _ := x509.ParseCertificate(attestation)
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("the signer %s is no ECDSA key", report.SignerKeyID)
+	}
+	hash, ok := reportHashes[signed.DigestAlgorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest algorithm %q", signed.DigestAlgorithm)
+	}
+	var sig struct{ R, S *big.Int }
+	if rest, err := asn1.Unmarshal(signed.Signature, &sig); err != nil || len(rest) > 0 {
+		return nil, errors.New("invalid signature encoding")
+	}
+	h := hash.New()
+	h.Write(signed.Report)
+	if !ecdsa.Verify(pub, h.Sum(nil), sig.R, sig.S) {
+		return nil, errors.New("the signature does not verify")
+	}
+	return report, nil
+}
+
+func attestationCommand(args []string) error {
+	if len(args) < 1 {
+		return usageError(attestationUsage)
+	}
+	switch args[0] {
+	case "report":
+		return attestationReport(args[1:])
+	case "verify":
+		return attestationVerify(args[1:])
+	default:
+		return usageError(attestationUsage)
+	}
+}
+
+func attestationReport(args []string) error {
+	fs := flag.NewFlagSet("attestation report", flag.ExitOnError)
+	keyID := fs.String("key", "", "ID of the key signing the report, it must have been generated on the token")
+	pinFile := fs.String("pin-file", "", "File holding the PIN, default: the daemon's secret source")
+	out := fs.String("out", "", "Write the report to this file instead of stdout")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *keyID == "" {
+		return usageError(attestationReportUsage)
+	}
+	req := AttestationReportReq{KeyID: *keyID}
+	var err error
+	if req.Pass, err = readSecretFlag(*pinFile); err != nil {
+		return err
+	}
+	return withStoreSession(func(client *rpc.Client, session uint) error {
+		req.Session = session
+		res := new(AttestationReportRes)
+		if err := client.Call("ESServer.AttestationReport", req, res); err != nil {
+			return err
+		}
+		encoded, err := json.MarshalIndent(res.Report, "", "  ")
+		if err != nil {
+			return err
+		}
+		encoded = append(encoded, '\n')
+		if *out == "" {
+			_, err = os.Stdout.Write(encoded)
+			return err
+		}
+		return ioutil.WriteFile(*out, encoded, 0644)
+	})
+}
+
+func attestationVerify(args []string) error {
+	fs := flag.NewFlagSet("attestation verify", flag.ExitOnError)
+	caFile := fs.String("ca", "", "PEM file with the CA certificates the device certificate has to chain up to, instead of the Yubico CAs")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return usageError(attestationVerifyUsage)
+	}
+	roots := yubikey.YubicoRoots()
+	if *caFile != "" {
+		var err error
+		if roots, err = yubikey.LoadAttestationRoots(*caFile); err != nil {
+			return err
+		}
+	}
+	encoded, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var signed SignedAttestationReport
+	if err := json.Unmarshal(encoded, &signed); err != nil {
+		return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "%s is no attestation report: %v", fs.Arg(0), err)
+	}
+	report, err := verifyAttestationReport(signed, roots)
+	if err != nil {
+		return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "the report does not verify: %v", err)
+	}
+	if jsonOutput() {
+		return printJSON(report)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Created:\t%s\n", report.Created.Format(time.RFC3339))
+	if report.Token != nil {
+		fmt.Fprintf(w, "Token:\t%s serial %s, firmware %s\n", report.Token.Model, report.Token.Serial, report.Token.Firmware)
+	}
+	fmt.Fprintf(w, "Signed by:\t%s\n", report.SignerKeyID)
+	fmt.Fprintln(w, "\nSLOT\tKEY ID\tROLE\tATTESTED")
+	for _, slot := range report.Slots {
+		id, role := slot.KeyID, slot.Role
+		if id == "" {
+			id, role = "-", slot.Subject
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\n", slot.Slot, id, role, slot.Attestation != nil)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,98 @@
+package adapter
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCert(t *testing.T, cn string, pub, signer *ecdsa.PrivateKey, issuer *x509.Certificate) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  issuer == nil,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtraExtensions:       []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 3}, Value: []byte{5, 2, 7}}},
+	}
+	if issuer == nil {
+		issuer = tmpl
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &pub.PublicKey, signer)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestAttestationReport(t *testing.T) {
+	deviceKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	signerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	device := newTestCert(t, "Yubico PIV Attestation", deviceKey, deviceKey, nil)
+	attestation := newTestCert(t, "YubiKey PIV Attestation 9c", signerKey, deviceKey, device)
+	signerPub, err := x509.MarshalPKIXPublicKey(&signerKey.PublicKey)
+	require.NoError(t, err)
+
+	slots := []ReportSlot{
+		{Slot: "9c", KeyID: "signer", Role: "root", PublicKeySHA256: publicKeySHA256(signerPub)},
+		{Slot: "9a", Subject: "ssh", PublicKeySHA256: publicKeySHA256([]byte("imported"))},
+	}
+	att := backend.Attestation{Device: device.Raw, Keys: [][]byte{attestation.Raw}}
+	_, err = assembleAttestationReport(nil, slots, att, "ssh", time.Now())
+	require.Error(t, err)
+	report, err := assembleAttestationReport(&tokenJSON{Serial: "123"}, slots, att, "signer", time.Now())
+	require.NoError(t, err)
+	require.Equal(t, "9a", report.Slots[0].Slot)
+	require.Nil(t, report.Slots[0].Attestation)
+	require.Equal(t, attestation.Raw, report.Slots[1].Attestation)
+
+	payload, err := json.Marshal(report)
+	require.NoError(t, err)
+	digest := sha256.Sum256(payload)
+	r, s, err := ecdsa.Sign(rand.Reader, signerKey, digest[:])
+	require.NoError(t, err)
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	require.NoError(t, err)
+	signed := SignedAttestationReport{Report: payload, DigestAlgorithm: "sha256", Signature: sig}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(device)
+	verified, err := verifyAttestationReport(signed, roots)
+	require.NoError(t, err)
+	require.Equal(t, "123", verified.Token.Serial)
+	require.Equal(t, "signer", verified.SignerKeyID)
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	other := x509.NewCertPool()
+	other.AddCert(newTestCert(t, "Other CA", otherKey, otherKey, nil))
+	_, err = verifyAttestationReport(signed, other)
+	require.Error(t, err)
+
+	report.Slots = report.Slots[1:]
+	tampered := signed
+	tampered.Report, err = json.Marshal(report)
+	require.NoError(t, err)
+	_, err = verifyAttestationReport(tampered, roots)
+	require.EqualError(t, err, "the signature does not verify")
+	_, err = verifyAttestationReport(signed, nil)
+	require.Error(t, err)
+	_, err = verifyAttestationReport(signed, yubikey.YubicoRoots())
+	require.Error(t, err)
+}
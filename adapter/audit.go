@@ -0,0 +1,68 @@
+package adapter
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// auditLog records every privileged operation as one JSON object per line
+var auditLog = logrus.New()
+
+func openAuditLog(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	auditLog.Out = f
+	auditLog.Formatter = &logrus.JSONFormatter{}
+	auditLog.Level = logrus.InfoLevel
+	return nil
+}
+
+// exportAudit sends every audit event to syslog or auditd as well, in the
+// same JSON schema as the audit log
+func exportAudit(target string) error {
+	var hook logrus.Hook
+	var err error
+	switch target {
+	case "syslog":
+		hook, err = newSyslogHook()
+	case "auditd":
+		hook, err = newAuditdHook()
+	default:
+		return fmt.Errorf("unknown audit export '%s'", target)
+	}
+	if err != nil {
+		return err
+	}
+	auditLog.AddHook(hook)
+	return nil
+}
+
+// audit writes an event to the audit log, queues it for the webhooks and
+// counts authentication failures. Denied requests and failures are logged
+// at warning level
+func audit(event string, peer *peerCred, fields logrus.Fields, err error) {
+	notifyWebhooks(event, peer, fields, err)
+	checkAuthFailures(event, peer, fields, err)
+	entry := auditLog.WithFields(fields).WithField("event", event)
+	if keyID, ok := fields["key_id"].(string); ok && keyID != "" {
+		fp := newKeyFingerprint(keyID, publicKeyHashes.get(keyID))
+		entry = entry.WithField("short_id", fp.ShortID)
+		if fp.PublicKeySHA256 != "" {
+			entry = entry.WithField("public_key_sha256", fp.PublicKeySHA256)
+		}
+	}
+	if peer.local() {
+		entry = entry.WithFields(logrus.Fields{"uid": peer.UID, "gid": peer.GID, "pid": peer.PID, "exe": peer.Exe})
+	} else if peer != nil {
+		entry = entry.WithField("client", peer.Client)
+	}
+	if err != nil {
+		entry.WithError(err).WithField("outcome", "failure").Warn(event)
+		return
+	}
+	entry.WithField("outcome", "success").Info(event)
+}
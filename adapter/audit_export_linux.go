@@ -0,0 +1,65 @@
+// +build linux
+
+package adapter
+
+import (
+	"log/syslog"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	lSyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+const (
+	netlinkAudit = 9
+	// AUDIT_USER_MSG, see linux/audit.h
+	auditUserMsg = 1112
+)
+
+// newSyslogHook sends audit events as JSON to the local syslog daemon
+func newSyslogHook() (logrus.Hook, error) {
+	return lSyslog.NewSyslogHook("", "", syslog.LOG_INFO|syslog.LOG_AUTHPRIV, appName)
+}
+
+// auditdHook sends audit events as JSON in user messages to the kernel audit
+// subsystem, from where auditd picks them up. Sending needs CAP_AUDIT_WRITE
+type auditdHook struct {
+	fd  int
+	seq uint32
+}
+
+func newAuditdHook() (logrus.Hook, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, netlinkAudit)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &auditdHook{fd: fd}, nil
+}
+
+func (h *auditdHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *auditdHook) Fire(entry *logrus.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		return err
+	}
+	payload := []byte(appName + ": " + line)
+	hdr := syscall.NlMsghdr{
+		Len:   uint32(syscall.NLMSG_HDRLEN + len(payload)),
+		Type:  auditUserMsg,
+		Flags: syscall.NLM_F_REQUEST,
+		Seq:   atomic.AddUint32(&h.seq, 1),
+	}
+	msg := make([]byte, syscall.NLMSG_HDRLEN, int(hdr.Len))
+	*(*syscall.NlMsghdr)(unsafe.Pointer(&msg[0])) = hdr
+	msg = append(msg, payload...)
+	return syscall.Sendto(h.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+}
@@ -0,0 +1,19 @@
+// +build !linux
+
+package adapter
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newSyslogHook is only implemented on linux
+func newSyslogHook() (logrus.Hook, error) {
+	return nil, fmt.Errorf("audit export to syslog is only supported on linux")
+}
+
+// newAuditdHook is only implemented on linux
+func newAuditdHook() (logrus.Hook, error) {
+	return nil, fmt.Errorf("audit export to auditd is only supported on linux")
+}
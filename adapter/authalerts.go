@@ -0,0 +1,191 @@
+package adapter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/sirupsen/logrus"
+)
+
+// The reasons of an auth alert
+const (
+	alertPinFailures   = "pin_failures"
+	alertPinLocked     = "pin_locked"
+	alertPolicyDenials = "policy_denials"
+)
+
+// AuthAlertsConfig raises an alert once PINs or management keys were
+// rejected, or requests were denied by the policy, several times in a row.
+// A yubikey locks its PIN after three wrong attempts, so a few failures in
+// a row mean the token is about to be locked or is being attacked. Alerts
+// are logged at error level, counted in the metrics, posted to the webhooks
+// subscribed to auth_alert and passed to Command
+type AuthAlertsConfig struct {
+	// PinFailures is the number of rejected PINs in a row which raises an
+	// alert, default 2, -1 disables the alert. A locked PIN always raises one
+	PinFailures int `json:"pin_failures"`
+	// PolicyDenials is the number of denied requests in a row which raises
+	// an alert, default 10, -1 disables the alert
+	PolicyDenials int `json:"policy_denials"`
+	// Command is run for every alert with the JSON encoded alert on stdin
+	// and NOTARY_YK_ALERT_REASON and NOTARY_YK_ALERT_COUNT set
+	Command []string `json:"command"`
+}
+
+const (
+	defaultPinFailureAlert   = 2
+	defaultPolicyDenialAlert = 10
+	alertDisabled            = -1
+	alertCommandTimeout      = 30 * time.Second
+	// alertOutputLimit is how much output of a failed alert command is logged
+	alertOutputLimit = 4096
+)
+
+func (cfg AuthAlertsConfig) validate() error {
+	if cfg.PinFailures < alertDisabled || cfg.PolicyDenials < alertDisabled {
+		return fmt.Errorf("auth_alerts: thresholds must be positive, or -1 to disable the alert")
+	}
+	if len(cfg.Command) > 0 && !filepath.IsAbs(cfg.Command[0]) {
+		return fmt.Errorf("auth_alerts: the command %q must be an absolute path", cfg.Command[0])
+	}
+	return nil
+}
+
+// thresholds returns the thresholds with the defaults applied, 0 disables an alert
+func (cfg AuthAlertsConfig) thresholds() (pin, denials int) {
+	pin, denials = cfg.PinFailures, cfg.PolicyDenials
+	if pin == 0 {
+		pin = defaultPinFailureAlert
+	}
+	if denials == 0 {
+		denials = defaultPolicyDenialAlert
+	}
+	if pin == alertDisabled {
+		pin = 0
+	}
+	if denials == alertDisabled {
+		denials = 0
+	}
+	return pin, denials
+}
+
+// authFailures counts the consecutive authentication failures
+type authFailures struct {
+	sync.Mutex
+	pin, denials int
+	alerts       map[string]uint64
+}
+
+var authAlerts = &authFailures{alerts: make(map[string]uint64)}
+
+// successEvents are the audit events whose success proves the credentials
+// and the policy work again
+var successEvents = map[string]bool{"sign": true, "add_key": true, "generate_key": true, "remove_key": true, "adopt_key": true, "renew_cert": true}
+
+// crossed tells whether count reached the threshold, or another multiple of it
+func crossed(count, threshold int) bool {
+	return threshold > 0 && count > 0 && count%threshold == 0
+}
+
+// record counts an audit event and returns the reason of the alert it
+// raises, if any, and the number of failures in a row
+func (a *authFailures) record(event string, err error, pinThreshold, denialThreshold int) (string, int) {
+	a.Lock()
+	defer a.Unlock()
+	reason, count := "", 0
+	switch yubikey.ErrorCodeOf(err) {
+	case "":
+		if successEvents[event] {
+			a.pin, a.denials = 0, 0
+		}
+	case yubikey.ErrCodeWrongPin:
+		a.pin++
+		if crossed(a.pin, pinThreshold) {
+			reason, count = alertPinFailures, a.pin
+		}
+	case yubikey.ErrCodePinLocked:
+		a.pin++
+		reason, count = alertPinLocked, a.pin
+	case yubikey.ErrCodePolicyDenied:
+		a.denials++
+		if crossed(a.denials, denialThreshold) {
+			reason, count = alertPolicyDenials, a.denials
+		}
+	}
+	if reason != "" {
+		a.alerts[reason]++
+	}
+	return reason, count
+}
+
+// checkAuthFailures counts an audit event and raises an alert if it crossed
+// a threshold
+func checkAuthFailures(event string, peer *peerCred, fields logrus.Fields, err error) {
+	pinThreshold, denialThreshold := config.AuthAlerts.thresholds()
+	reason, count := authAlerts.record(event, err, pinThreshold, denialThreshold)
+	if reason == "" {
+		return
+	}
+	alert := newWebhookPayload(webhookAuthAlert, peer, fields, err, time.Now())
+	alert.Reason, alert.Count = reason, count
+	logrus.WithFields(logrus.Fields{"reason": reason, "count": count, "key_id": alert.KeyID}).Errorf("Authentication alert: %d failures in a row, last one by %s: %v", count, peer, err)
+	queueWebhooks(alert)
+	if len(config.AuthAlerts.Command) > 0 {
+		go runAlertCommand(config.AuthAlerts.Command, alert)
+	}
+}
+
+// runAlertCommand runs the alert command of the config for alert
+func runAlertCommand(command []string, alert WebhookPayload) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		logrus.Errorf("Failed to encode the alert: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), alertCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(), "NOTARY_YK_ALERT_REASON="+alert.Reason, "NOTARY_YK_ALERT_COUNT="+strconv.Itoa(alert.Count))
+	out := new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Run(); err != nil {
+		output := out.String()
+		if len(output) > alertOutputLimit {
+			output = output[:alertOutputLimit]
+		}
+		logrus.Errorf("Alert command %s failed: %v: %s", command[0], err, output)
+	}
+}
+
+// writeAuthAlertMetrics writes the failure counters in the Prometheus text format
+func writeAuthAlertMetrics(w io.Writer, a *authFailures) {
+	a.Lock()
+	defer a.Unlock()
+	gauge := func(name, help string, value int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+	}
+	gauge("notary_yubikey_consecutive_pin_failures", "PINs or management keys rejected since the last success.", a.pin)
+	gauge("notary_yubikey_consecutive_policy_denials", "Requests denied by the policy since the last success.", a.denials)
+	name := "notary_yubikey_auth_alerts_total"
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, "Authentication alerts raised, by reason.", name)
+	reasons := make([]string, 0, len(a.alerts))
+	for reason := range a.alerts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "%s{reason=\"%s\"} %d\n", name, reason, a.alerts[reason])
+	}
+}
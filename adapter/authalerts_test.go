@@ -0,0 +1,61 @@
+package adapter
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthFailures(t *testing.T) {
+	a := &authFailures{alerts: make(map[string]uint64)}
+	wrongPin := yubikey.NewError(yubikey.ErrCodeWrongPin, "wrong PIN")
+	denied := yubikey.NewError(yubikey.ErrCodePolicyDenied, "denied")
+
+	reason, _ := a.record("sign", wrongPin, 2, 3)
+	require.Empty(t, reason)
+	reason, count := a.record("sign", wrongPin, 2, 3)
+	require.Equal(t, alertPinFailures, reason)
+	require.Equal(t, 2, count)
+
+	// failures of the device say nothing about the credentials
+	reason, _ = a.record("sign", errors.New("device removed"), 2, 3)
+	require.Empty(t, reason)
+	reason, count = a.record("sign", yubikey.NewError(yubikey.ErrCodePinLocked, "locked"), 2, 3)
+	require.Equal(t, alertPinLocked, reason)
+	require.Equal(t, 3, count)
+
+	for i := 1; i <= 6; i++ {
+		reason, count = a.record("sign_denied", denied, 2, 3)
+		if i%3 == 0 {
+			require.Equal(t, alertPolicyDenials, reason)
+			require.Equal(t, i, count)
+		} else {
+			require.Empty(t, reason)
+		}
+	}
+
+	a.record("set_log_level", nil, 2, 3)
+	require.Equal(t, 3, a.pin)
+	a.record("sign", nil, 2, 3)
+	require.Equal(t, 0, a.pin)
+	require.Equal(t, 0, a.denials)
+	require.Equal(t, uint64(2), a.alerts[alertPolicyDenials])
+
+	reason, _ = a.record("sign", wrongPin, 0, 0)
+	require.Empty(t, reason)
+}
+
+func TestAuthAlertsConfig(t *testing.T) {
+	pin, denials := AuthAlertsConfig{}.thresholds()
+	require.Equal(t, defaultPinFailureAlert, pin)
+	require.Equal(t, defaultPolicyDenialAlert, denials)
+	pin, denials = AuthAlertsConfig{PinFailures: -1, PolicyDenials: 4}.thresholds()
+	require.Equal(t, 0, pin)
+	require.Equal(t, 4, denials)
+
+	require.NoError(t, AuthAlertsConfig{Command: []string{"/usr/local/bin/page", "oncall"}}.validate())
+	require.Error(t, AuthAlertsConfig{Command: []string{"page"}}.validate())
+	require.Error(t, AuthAlertsConfig{PinFailures: -2}.validate())
+}
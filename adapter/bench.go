@@ -0,0 +1,106 @@
+package adapter
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+const benchUsage = "bench [-library <path> -pin-file <file> -management-key-file <file>] [-parallel <n>]"
+
+// errBenchFailed makes the bench command exit with a failure
+var errBenchFailed = errors.New("a benchmark failed")
+
+type benchJSON struct {
+	Name        string `json:"name"`
+	OK          bool   `json:"ok"`
+	Error       string `json:"error,omitempty"`
+	Iterations  int    `json:"iterations"`
+	NsPerOp     int64  `json:"ns_per_op"`
+	BytesPerOp  int64  `json:"bytes_per_op"`
+	AllocsPerOp int64  `json:"allocs_per_op"`
+}
+
+// benchReportJSON is the stable schema of bench --json
+type benchReportJSON struct {
+	SchemaVersion int         `json:"schema_version"`
+	Token         string      `json:"token"`
+	Benchmarks    []benchJSON `json:"benchmarks"`
+}
+
+// benchCommand measures the hot paths of the key store in this process,
+// against a mock yubikey unless a pkcs11 library is given, so the numbers
+// can be compared across versions without touching the token of a daemon
+func benchCommand(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	library := fs.String("library", "", "pkcs11 library to benchmark, e.g. SoftHSM, default: a mock yubikey")
+	pinFile := fs.String("pin-file", "", "File holding the user PIN of the token of -library")
+	keyFile := fs.String("management-key-file", "", "File holding the management key of the token of -library, the user PIN unless it is a yubikey")
+	parallel := fs.Int("parallel", 4, "Sessions signing at once in SignParallel")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *parallel < 1 || (*library != "" && (*pinFile == "" || *keyFile == "")) {
+		return usageError(benchUsage)
+	}
+
+	opts := yubikey.BenchOptions{Library: *library, Parallelism: *parallel}
+	token := "mock"
+	if opts.Library != "" {
+		token = opts.Library
+		var err error
+		if opts.PIN, err = readSecretFile(*pinFile); err != nil {
+			return err
+		}
+		if opts.ManagementKey, err = readSecretFile(*keyFile); err != nil {
+			return err
+		}
+	}
+	results, err := yubikey.RunBenchmarks(opts)
+	if err != nil {
+		return err
+	}
+
+	ok := true
+	report := benchReportJSON{SchemaVersion: statusSchemaVersion, Token: token}
+	for _, r := range results {
+		b := benchJSON{Name: r.Name, OK: r.Err == nil}
+		if r.Err != nil {
+			ok = false
+			b.Error = r.Err.Error()
+		} else {
+			b.Iterations, b.NsPerOp, b.BytesPerOp, b.AllocsPerOp = r.N, r.NsPerOp(), r.AllocedBytesPerOp(), r.AllocsPerOp()
+		}
+		report.Benchmarks = append(report.Benchmarks, b)
+	}
+
+	if jsonOutput() {
+		err = printJSON(report)
+	} else {
+		err = printBenchmarks(report)
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errBenchFailed
+	}
+	return nil
+}
+
+// printBenchmarks prints the results of bench as a table
+func printBenchmarks(report benchReportJSON) error {
+	fmt.Printf("Token: %s\n", report.Token)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BENCHMARK\tITERATIONS\tNS/OP\tB/OP\tALLOCS/OP")
+	for _, b := range report.Benchmarks {
+		if !b.OK {
+			fmt.Fprintf(w, "%s\tFAILED\t%s\t\t\n", b.Name, b.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", b.Name, b.Iterations, b.NsPerOp, b.BytesPerOp, b.AllocsPerOp)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,132 @@
+package adapter
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/sirupsen/logrus"
+)
+
+// The features a client can negotiate. gob drops the fields a receiver does
+// not know, so a client setting e.g. Prehashed towards a daemon that predates
+// it would silently get the digest signed as payload. Clients which depend on
+// such a field require its feature instead. Daemons which predate
+// negotiation answer Negotiate with "rpc: can't find method", clients treat
+// that as no features.
+const (
+	// FeatureRequestMeta: requests carry RequestMeta, errors the request ID
+	FeatureRequestMeta = "request-meta"
+	// FeatureErrorCodes: error messages start with "[CODE] "
+	FeatureErrorCodes = "error-codes"
+	// FeatureSignOptions: SignReq.DigestAlgorithm, SignatureEncoding and LowS
+	FeatureSignOptions = "sign-options"
+	// FeaturePrehashed: SignReq.Prehashed
+	FeaturePrehashed = "prehashed"
+	// FeaturePKCS11URI: SignReq.URI
+	FeaturePKCS11URI = "pkcs11-uri"
+	// FeaturePIVSlot: AddECDSAKeyReq.PIVSlot and Overwrite
+	FeaturePIVSlot = "piv-slot"
+	// FeatureRemoveKey: the RemoveKey RPC
+	FeatureRemoveKey = "remove-key"
+	// FeatureGetPublicKey: the GetPublicKey RPC
+	FeatureGetPublicKey = "get-public-key"
+	// FeatureRenewCert: the RenewCert RPC, if the backend renews certificates
+	FeatureRenewCert = "renew-cert"
+	// FeatureAdoptKey: the AdoptKey RPC, if the backend adopts keys
+	FeatureAdoptKey = "adopt-key"
+	// FeatureAttestation: HardwareListKeysReq.Attestation, if the backend attests keys
+	FeatureAttestation = "attestation"
+	// FeatureKeyExpiry: HardwareListKeysRes.NotAfter, if the backend stores certificates
+	FeatureKeyExpiry = "key-expiry"
+	// FeatureMultiDevice: HardwareListKeysRes.Devices, if the backend serves several devices
+	FeatureMultiDevice = "multi-device"
+)
+
+// NegotiateReq announces the client and the features it understands
+type NegotiateReq struct {
+	RequestMeta
+	wire.Version
+	// Client names the client and its version, e.g. "notary 0.6.1", it is
+	// only logged
+	Client string
+	// Features the client understands, if empty all features of the
+	// daemon are returned
+	Features []string
+	// Required features make the negotiation fail if the daemon lacks one
+	Required []string
+}
+
+// NegotiateRes holds the features both the daemon and the client support
+type NegotiateRes struct {
+	wire.Version
+	Backend  string
+	Features []string
+}
+
+// supportedFeatures returns the sorted features of the daemon, some depend
+// on the backend selected with -backend
+func supportedFeatures() []string {
+	features := []string{
+		FeatureRequestMeta,
+		FeatureErrorCodes,
+		FeatureSignOptions,
+		FeaturePrehashed,
+		FeaturePKCS11URI,
+		FeaturePIVSlot,
+		FeatureRemoveKey,
+		FeatureGetPublicKey,
+	}
+	if _, ok := ks.(backend.CertRenewer); ok {
+		features = append(features, FeatureRenewCert)
+	}
+	if _, ok := ks.(backend.KeyAdopter); ok {
+		features = append(features, FeatureAdoptKey)
+	}
+	if _, ok := ks.(backend.Attester); ok {
+		features = append(features, FeatureAttestation)
+	}
+	if _, ok := ks.(backend.CertExpirer); ok {
+		features = append(features, FeatureKeyExpiry)
+	}
+	if _, ok := ks.(backend.MultiToken); ok {
+		features = append(features, FeatureMultiDevice)
+	}
+	sort.Strings(features)
+	return features
+}
+
+// Negotiate returns the features the client can rely on
+func (s *ESServer) Negotiate(req NegotiateReq, res *NegotiateRes) error {
+	supported := make(map[string]bool)
+	for _, f := range supportedFeatures() {
+		supported[f] = true
+	}
+	var missing []string
+	for _, f := range req.Required {
+		if !supported[f] {
+			missing = append(missing, f)
+		}
+	}
+	if len(missing) > 0 {
+		logrus.WithFields(req.logFields(nil)).Warnf("Client %q of %s requires unsupported features %s", req.Client, s.peer, strings.Join(missing, ", "))
+		return rpcError(yubikey.NewError(yubikey.ErrCodeInvalidRequest, "the daemon does not support %s", strings.Join(missing, ", ")))
+	}
+	res.Backend = ks.Name()
+	if len(req.Features) == 0 {
+		res.Features = supportedFeatures()
+	} else {
+		for _, f := range req.Features {
+			if supported[f] {
+				res.Features = append(res.Features, f)
+				// a feature listed twice is returned once
+				delete(supported, f)
+			}
+		}
+		sort.Strings(res.Features)
+	}
+	logrus.WithFields(req.logFields(nil)).Infof("Client %q of %s negotiated features %s", req.Client, s.peer, strings.Join(res.Features, ", "))
+	return nil
+}
@@ -0,0 +1,60 @@
+package adapter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+// attestingBackend is a backend which attests keys but renews no certificates
+type attestingBackend struct {
+	backend.Backend
+}
+
+func (b attestingBackend) Name() string {
+	return "fake"
+}
+
+func (b attestingBackend) AttestKeys(session pkcs11.SessionHandle, keyIDs []string) (map[string]bool, error) {
+	return nil, nil
+}
+
+func TestNegotiate(t *testing.T) {
+	defer func(old backend.Backend) { ks = old }(ks)
+	ks = attestingBackend{}
+	features := supportedFeatures()
+	require.Contains(t, features, FeatureAttestation)
+	require.NotContains(t, features, FeatureRenewCert)
+
+	serverConn, clientConn := net.Pipe()
+	go ServeConn(serverConn)
+	client := wire.NewClient(clientConn)
+	defer client.Close()
+
+	res := new(NegotiateRes)
+	require.NoError(t, client.Call("ESServer.Negotiate", NegotiateReq{Client: "test"}, res))
+	require.Equal(t, "fake", res.Backend)
+	require.Equal(t, uint(wire.ProtocolVersion), res.Protocol())
+	require.Equal(t, features, res.Features)
+
+	res = new(NegotiateRes)
+	req := NegotiateReq{Features: []string{FeaturePrehashed, "future", FeatureAttestation, FeaturePrehashed}, Required: []string{FeaturePrehashed}}
+	require.NoError(t, client.Call("ESServer.Negotiate", req, res))
+	require.Equal(t, []string{FeatureAttestation, FeaturePrehashed}, res.Features)
+
+	req = NegotiateReq{Required: []string{FeatureRenewCert, "future"}}
+	err := client.Call("ESServer.Negotiate", req, new(NegotiateRes))
+	require.Error(t, err)
+	require.Equal(t, yubikey.ErrCodeInvalidRequest, yubikey.ErrorCodeOf(err))
+	require.Contains(t, err.Error(), "does not support renew-cert, future")
+
+	// clients which do not negotiate are served as before
+	name := new(wire.ESNameRes)
+	require.NoError(t, client.Call("ESServer.Name", wire.ESNameReq{}, name))
+	require.Equal(t, "fake", name.Name)
+}
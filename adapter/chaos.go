@@ -0,0 +1,398 @@
+package adapter
+
+import (
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+// chaosSpec is the value of the hidden -chaos flag, e.g.
+// "ckr=0.05,touch=0.1,removal=0.01,removed-for=10s,seed=42"
+var chaosSpec string
+
+// chaos is the parsed chaosSpec
+var chaos chaosConfig
+
+// chaosCKRs are the return values injected by chaos mode, the ones a
+// yubikey reports when its USB connection or its applet misbehaves
+var chaosCKRs = []uint{
+	pkcs11.CKR_DEVICE_ERROR,
+	pkcs11.CKR_FUNCTION_FAILED,
+	pkcs11.CKR_GENERAL_ERROR,
+	pkcs11.CKR_SESSION_HANDLE_INVALID,
+	pkcs11.CKR_DEVICE_MEMORY,
+}
+
+// chaosConfig are the probabilities of the faults chaos mode injects into
+// every token operation
+type chaosConfig struct {
+	// CKR fails the operation with one of chaosCKRs
+	CKR float64
+	// Touch fails a signature with TOUCH_TIMEOUT
+	Touch float64
+	// Removal unplugs the token, every operation fails with NO_TOKEN until
+	// it is back after RemovedFor
+	Removal    float64
+	RemovedFor time.Duration
+	// Seed makes the faults reproducible, 0 seeds with the time
+	Seed int64
+}
+
+// parseChaos parses the value of -chaos
+func parseChaos(spec string) (chaosConfig, error) {
+	cfg := chaosConfig{RemovedFor: 5 * time.Second}
+	for _, option := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(option), "=", 2)
+		if len(kv) != 2 {
+			return cfg, fmt.Errorf("invalid chaos option %q, expected <name>=<value>", option)
+		}
+		var err error
+		switch kv[0] {
+		case "ckr":
+			cfg.CKR, err = parseProbability(kv[1])
+		case "touch":
+			cfg.Touch, err = parseProbability(kv[1])
+		case "removal":
+			cfg.Removal, err = parseProbability(kv[1])
+		case "removed-for":
+			cfg.RemovedFor, err = time.ParseDuration(kv[1])
+			if err == nil && cfg.RemovedFor <= 0 {
+				err = fmt.Errorf("has to be positive")
+			}
+		case "seed":
+			cfg.Seed, err = strconv.ParseInt(kv[1], 10, 64)
+		default:
+			return cfg, fmt.Errorf("unknown chaos option %q, known: ckr, touch, removal, removed-for, seed", kv[0])
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("invalid chaos option %s: %v", kv[0], err)
+		}
+	}
+	return cfg, nil
+}
+
+func parseProbability(value string) (float64, error) {
+	p, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("%s is no probability between 0 and 1", value)
+	}
+	return p, nil
+}
+
+// chaosBackend injects faults into the token operations of a backend, so
+// clients can test their retry logic without pulling yubikeys. It wraps the
+// operations of backend.Backend, chaosTokenBackend adds the optional
+// interfaces of the yubikey backend
+type chaosBackend struct {
+	backend.Backend
+	cfg chaosConfig
+	now func() time.Time
+	sync.Mutex
+	rng *mathrand.Rand
+	// removedUntil is when the unplugged token is back
+	removedUntil time.Time
+}
+
+func newChaosBackend(b backend.Backend, cfg chaosConfig) *chaosBackend {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	logrus.Warnf("Chaos mode: injecting faults into the token operations of backend %s (ckr=%g touch=%g removal=%g seed=%d)", b.Name(), cfg.CKR, cfg.Touch, cfg.Removal, seed)
+	return &chaosBackend{Backend: b, cfg: cfg, now: time.Now, rng: mathrand.New(mathrand.NewSource(seed))}
+}
+
+// chaosCapable are the optional interfaces chaosTokenBackend forwards, the
+// ones the yubikey backend implements
+type chaosCapable interface {
+	backend.Backend
+	backend.Attester
+	backend.AttestationProvider
+	backend.MultiToken
+	backend.PresenceConfirmer
+	backend.CertExpirer
+	backend.KeyAger
+	backend.CertRenewer
+	backend.KeyAdopter
+	backend.KeyGenerator
+	backend.URIResolver
+	backend.ForeignKeyLister
+	backend.SlotRecoverer
+	backend.Reloader
+	backend.TokenInspector
+	backend.Preflighter
+	backend.Diagnoser
+}
+
+// optionalInterfaces tells whether b implements any of the interfaces a
+// plain chaosBackend would hide
+func optionalInterfaces(b backend.Backend) bool {
+	switch b.(type) {
+	case backend.Attester, backend.AttestationProvider, backend.MultiToken,
+		backend.PresenceConfirmer, backend.CertExpirer, backend.KeyAger,
+		backend.CertRenewer, backend.KeyAdopter, backend.KeyGenerator,
+		backend.URIResolver, backend.ForeignKeyLister, backend.SlotRecoverer,
+		backend.Reloader, backend.TokenInspector, backend.Preflighter,
+		backend.Diagnoser:
+		return true
+	}
+	return false
+}
+
+// chaosMode wraps b for -chaos. A backend whose optional interfaces can not
+// all be forwarded is refused, the daemon would serve less than without
+// chaos mode otherwise
+func chaosMode(b backend.Backend, cfg chaosConfig) (backend.Backend, error) {
+	if full, ok := b.(chaosCapable); ok {
+		return &chaosTokenBackend{chaosBackend: newChaosBackend(b, cfg), full: full}, nil
+	}
+	if optionalInterfaces(b) {
+		return nil, fmt.Errorf("chaos mode does not support backend %s", b.Name())
+	}
+	return newChaosBackend(b, cfg), nil
+}
+
+// fault returns the error op is to fail with, if any. Touch timeouts are
+// only drawn for signatures
+func (c *chaosBackend) fault(op string, signing bool) error {
+	c.Lock()
+	defer c.Unlock()
+	now := c.now()
+	if now.Before(c.removedUntil) {
+		return chaosError(op, pkcs11.CKR_DEVICE_REMOVED)
+	}
+	if c.rng.Float64() < c.cfg.Removal {
+		c.removedUntil = now.Add(c.cfg.RemovedFor)
+		logrus.Warnf("Chaos mode: the token is unplugged for %s", c.cfg.RemovedFor)
+		return chaosError(op, pkcs11.CKR_DEVICE_REMOVED)
+	}
+	if c.rng.Float64() < c.cfg.CKR {
+		return chaosError(op, chaosCKRs[c.rng.Intn(len(chaosCKRs))])
+	}
+	if signing && c.rng.Float64() < c.cfg.Touch {
+		logrus.Debugf("Chaos mode: %s was not touched", op)
+		return yubikey.NewError(yubikey.ErrCodeTouchTimeout, "chaos mode: the yubikey was not touched")
+	}
+	return nil
+}
+
+// chaosError is the error a token operation failing with ckr returns
+func chaosError(op string, ckr uint) error {
+	logrus.Debugf("Chaos mode: failing %s with %s", op, yubikey.CKRName(ckr))
+	err := yubikey.WrapError(yubikey.ErrCodeUnknown, pkcs11.Error(ckr)).(*yubikey.Error)
+	err.Err = fmt.Errorf("chaos mode: %s failed", op)
+	return err
+}
+
+func (c *chaosBackend) AddECDSAKeyWithOptions(session pkcs11.SessionHandle, privKey data.PrivateKey, hwslot common.HardwareSlot, passwd string, role data.RoleName, opts backend.AddKeyOptions) error {
+	if err := c.fault("AddECDSAKey", false); err != nil {
+		return err
+	}
+	return c.Backend.AddECDSAKeyWithOptions(session, privKey, hwslot, passwd, role, opts)
+}
+
+func (c *chaosBackend) GetECDSAKey(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string) (*data.ECDSAPublicKey, data.RoleName, error) {
+	if err := c.fault("GetECDSAKey", false); err != nil {
+		return nil, "", err
+	}
+	return c.Backend.GetECDSAKey(session, hwslot, passwd)
+}
+
+func (c *chaosBackend) SignWithOptions(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string, payload []byte, opts backend.SignOptions) ([]byte, error) {
+	if err := c.fault("Sign", true); err != nil {
+		return nil, err
+	}
+	return c.Backend.SignWithOptions(session, hwslot, passwd, payload, opts)
+}
+
+func (c *chaosBackend) HardwareRemoveKey(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string, keyID string) error {
+	if err := c.fault("HardwareRemoveKey", false); err != nil {
+		return err
+	}
+	return c.Backend.HardwareRemoveKey(session, hwslot, passwd, keyID)
+}
+
+func (c *chaosBackend) HardwareListKeys(session pkcs11.SessionHandle) (map[string]common.HardwareSlot, error) {
+	if err := c.fault("HardwareListKeys", false); err != nil {
+		return nil, err
+	}
+	return c.Backend.HardwareListKeys(session)
+}
+
+func (c *chaosBackend) GetNextEmptySlot(session pkcs11.SessionHandle) ([]byte, error) {
+	if err := c.fault("GetNextEmptySlot", false); err != nil {
+		return nil, err
+	}
+	return c.Backend.GetNextEmptySlot(session)
+}
+
+func (c *chaosBackend) SetupHSMEnv() (pkcs11.SessionHandle, error) {
+	if err := c.fault("SetupHSMEnv", false); err != nil {
+		return 0, err
+	}
+	return c.Backend.SetupHSMEnv()
+}
+
+// chaosTokenBackend is a chaosBackend which also forwards the optional
+// interfaces. The token operations among them fail like the ones of
+// backend.Backend, reloading and describing the backend never fail
+type chaosTokenBackend struct {
+	*chaosBackend
+	full chaosCapable
+}
+
+func (c *chaosTokenBackend) AttestKeys(session pkcs11.SessionHandle, keyIDs []string) (map[string]bool, error) {
+	if err := c.fault("AttestKeys", false); err != nil {
+		return nil, err
+	}
+	return c.full.AttestKeys(session, keyIDs)
+}
+
+func (c *chaosTokenBackend) Attestation(session pkcs11.SessionHandle) (backend.Attestation, error) {
+	if err := c.fault("Attestation", false); err != nil {
+		return backend.Attestation{}, err
+	}
+	return c.full.Attestation(session)
+}
+
+func (c *chaosTokenBackend) ListAllTokenKeys() ([]backend.TokenKey, error) {
+	if err := c.fault("ListAllTokenKeys", false); err != nil {
+		return nil, err
+	}
+	return c.full.ListAllTokenKeys()
+}
+
+func (c *chaosTokenBackend) SignOnToken(serial string, hwslot common.HardwareSlot, passwd string, payload []byte, opts backend.SignOptions) ([]byte, error) {
+	if err := c.fault("SignOnToken", true); err != nil {
+		return nil, err
+	}
+	return c.full.SignOnToken(serial, hwslot, passwd, payload, opts)
+}
+
+func (c *chaosTokenBackend) SessionSerial(session pkcs11.SessionHandle) (string, error) {
+	return c.full.SessionSerial(session)
+}
+
+func (c *chaosTokenBackend) ConfirmPresence(serial string, slotID []byte, passwd string) error {
+	if err := c.fault("ConfirmPresence", true); err != nil {
+		return err
+	}
+	return c.full.ConfirmPresence(serial, slotID, passwd)
+}
+
+func (c *chaosTokenBackend) CertExpiry(session pkcs11.SessionHandle) (map[string]time.Time, error) {
+	if err := c.fault("CertExpiry", false); err != nil {
+		return nil, err
+	}
+	return c.full.CertExpiry(session)
+}
+
+func (c *chaosTokenBackend) KeyCreated(session pkcs11.SessionHandle) (map[string]time.Time, error) {
+	if err := c.fault("KeyCreated", false); err != nil {
+		return nil, err
+	}
+	return c.full.KeyCreated(session)
+}
+
+func (c *chaosTokenBackend) RenewCertificate(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd, managementKey string, validity time.Duration) (time.Time, error) {
+	if err := c.fault("RenewCertificate", true); err != nil {
+		return time.Time{}, err
+	}
+	return c.full.RenewCertificate(session, hwslot, passwd, managementKey, validity)
+}
+
+func (c *chaosTokenBackend) CertificateRequest(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string) ([]byte, error) {
+	if err := c.fault("CertificateRequest", true); err != nil {
+		return nil, err
+	}
+	return c.full.CertificateRequest(session, hwslot, passwd)
+}
+
+func (c *chaosTokenBackend) ReplaceCertificate(session pkcs11.SessionHandle, hwslot common.HardwareSlot, managementKey string, certBytes []byte) error {
+	if err := c.fault("ReplaceCertificate", false); err != nil {
+		return err
+	}
+	return c.full.ReplaceCertificate(session, hwslot, managementKey, certBytes)
+}
+
+func (c *chaosTokenBackend) AdoptKey(session pkcs11.SessionHandle, slotID []byte, role data.RoleName, passwd, managementKey string, validity time.Duration) (string, []byte, error) {
+	if err := c.fault("AdoptKey", true); err != nil {
+		return "", nil, err
+	}
+	return c.full.AdoptKey(session, slotID, role, passwd, managementKey, validity)
+}
+
+func (c *chaosTokenBackend) GenerateECDSAKey(session pkcs11.SessionHandle, hwslot common.HardwareSlot, role data.RoleName, passwd, managementKey string) (*data.ECDSAPublicKey, error) {
+	if err := c.fault("GenerateECDSAKey", false); err != nil {
+		return nil, err
+	}
+	return c.full.GenerateECDSAKey(session, hwslot, role, passwd, managementKey)
+}
+
+func (c *chaosTokenBackend) ResolveURI(session pkcs11.SessionHandle, uri string) ([]backend.TokenKey, error) {
+	if err := c.fault("ResolveURI", false); err != nil {
+		return nil, err
+	}
+	return c.full.ResolveURI(session, uri)
+}
+
+func (c *chaosTokenBackend) ForeignKeys(session pkcs11.SessionHandle) ([]backend.ForeignKey, error) {
+	if err := c.fault("ForeignKeys", false); err != nil {
+		return nil, err
+	}
+	return c.full.ForeignKeys(session)
+}
+
+func (c *chaosTokenBackend) RecoverSlots(session pkcs11.SessionHandle, pin, managementKey string, confirm func(backend.SlotRepair) bool) ([]backend.SlotRepair, error) {
+	if err := c.fault("RecoverSlots", false); err != nil {
+		return nil, err
+	}
+	return c.full.RecoverSlots(session, pin, managementKey, confirm)
+}
+
+func (c *chaosTokenBackend) Reload(config json.RawMessage) error {
+	return c.full.Reload(config)
+}
+
+func (c *chaosTokenBackend) TokenInfo(session pkcs11.SessionHandle) (backend.TokenInfo, error) {
+	if err := c.fault("TokenInfo", false); err != nil {
+		return backend.TokenInfo{}, err
+	}
+	return c.full.TokenInfo(session)
+}
+
+func (c *chaosTokenBackend) LoadLibrary() (string, error) {
+	return c.full.LoadLibrary()
+}
+
+func (c *chaosTokenBackend) CheckUserPin(session pkcs11.SessionHandle, pin string) error {
+	if err := c.fault("CheckUserPin", false); err != nil {
+		return err
+	}
+	return c.full.CheckUserPin(session, pin)
+}
+
+func (c *chaosTokenBackend) CheckManagementKey(session pkcs11.SessionHandle, key string) error {
+	if err := c.fault("CheckManagementKey", false); err != nil {
+		return err
+	}
+	return c.full.CheckManagementKey(session, key)
+}
+
+func (c *chaosTokenBackend) Diagnostics() []string {
+	return c.full.Diagnostics()
+}
@@ -0,0 +1,111 @@
+package adapter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+func TestParseChaos(t *testing.T) {
+	cfg, err := parseChaos("ckr=0.05, touch=1,removal=0,removed-for=10s,seed=42")
+	require.NoError(t, err)
+	require.Equal(t, chaosConfig{CKR: 0.05, Touch: 1, RemovedFor: 10 * time.Second, Seed: 42}, cfg)
+	cfg, err = parseChaos("touch=0.5")
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Second, cfg.RemovedFor)
+
+	for _, spec := range []string{"ckr", "ckr=1.5", "touch=-0.1", "removal=often", "removed-for=0s", "seed=x", "unplug=0.1"} {
+		_, err := parseChaos(spec)
+		require.Error(t, err, spec)
+	}
+}
+
+// healthyBackend succeeds at every operation
+type healthyBackend struct {
+	backend.Backend
+}
+
+func (healthyBackend) Name() string { return "healthy" }
+
+func (healthyBackend) SignWithOptions(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string, payload []byte, opts backend.SignOptions) ([]byte, error) {
+	return []byte("signature"), nil
+}
+
+func (healthyBackend) HardwareListKeys(session pkcs11.SessionHandle) (map[string]common.HardwareSlot, error) {
+	return map[string]common.HardwareSlot{}, nil
+}
+
+func TestChaosBackend(t *testing.T) {
+	slot := common.HardwareSlot{SlotID: []byte{2}}
+
+	c := newChaosBackend(healthyBackend{}, chaosConfig{CKR: 1, Seed: 1})
+	_, err := c.HardwareListKeys(1)
+	require.Equal(t, yubikey.ErrCodeDevice, yubikey.ErrorCodeOf(err))
+	ckr, ok := yubikey.CKROf(err)
+	require.True(t, ok)
+	require.Contains(t, chaosCKRs, ckr)
+	require.True(t, yubikey.IsRetriable(err))
+
+	// touch timeouts only hit signatures
+	c = newChaosBackend(healthyBackend{}, chaosConfig{Touch: 1, Seed: 1})
+	_, err = c.HardwareListKeys(1)
+	require.NoError(t, err)
+	_, err = c.SignWithOptions(1, slot, "123456", []byte("payload"), backend.SignOptions{})
+	require.Equal(t, yubikey.ErrCodeTouchTimeout, yubikey.ErrorCodeOf(err))
+
+	// an unplugged token stays away for RemovedFor
+	now := time.Unix(0, 0)
+	c = newChaosBackend(healthyBackend{}, chaosConfig{Removal: 1, RemovedFor: time.Minute, Seed: 1})
+	c.now = func() time.Time { return now }
+	_, err = c.SignWithOptions(1, slot, "123456", []byte("payload"), backend.SignOptions{})
+	require.Equal(t, yubikey.ErrCodeNoToken, yubikey.ErrorCodeOf(err))
+	c.cfg.Removal = 0
+	now = now.Add(59 * time.Second)
+	_, err = c.HardwareListKeys(1)
+	require.Equal(t, yubikey.ErrCodeNoToken, yubikey.ErrorCodeOf(err))
+	now = now.Add(time.Second)
+	sig, err := c.SignWithOptions(1, slot, "123456", []byte("payload"), backend.SignOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []byte("signature"), sig)
+
+	// without faults the backend is passed through
+	c = newChaosBackend(healthyBackend{}, chaosConfig{Seed: 1})
+	for i := 0; i < 100; i++ {
+		_, err = c.SignWithOptions(1, slot, "123456", []byte("payload"), backend.SignOptions{})
+		require.NoError(t, err)
+	}
+	require.Equal(t, "healthy", c.Name())
+}
+
+// diagnosingBackend only implements one of the optional interfaces
+type diagnosingBackend struct {
+	healthyBackend
+}
+
+func (diagnosingBackend) Diagnostics() []string { return nil }
+
+func TestChaosModeInterfaces(t *testing.T) {
+	// the optional interfaces of the yubikey backend are forwarded
+	b, err := chaosMode(&yubikey.KeyStore{}, chaosConfig{Seed: 1})
+	require.NoError(t, err)
+	_, ok := b.(backend.MultiToken)
+	require.True(t, ok)
+	_, ok = b.(backend.KeyGenerator)
+	require.True(t, ok)
+	_, ok = b.(backend.Reloader)
+	require.True(t, ok)
+
+	b, err = chaosMode(healthyBackend{}, chaosConfig{Seed: 1})
+	require.NoError(t, err)
+	_, ok = b.(backend.Diagnoser)
+	require.False(t, ok)
+
+	// hiding an interface would change what the daemon serves
+	_, err = chaosMode(diagnosingBackend{}, chaosConfig{Seed: 1})
+	require.Error(t, err)
+}
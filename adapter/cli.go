@@ -0,0 +1,140 @@
+package adapter
+
+import (
+	"flag"
+	"fmt"
+	"net/rpc"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// command is a subcommand of the adapter, e.g. "approvals list"
+type command struct {
+	usage string
+	run   func(args []string) error
+	// subcommands are offered by the shell completion
+	subcommands []string
+}
+
+const approvalsUsage = "approvals list | approve <id> | deny <id>"
+
+var commands = map[string]command{
+	"approvals":   {approvalsUsage, approvalsCommand, []string{"list", "approve", "deny"}},
+	"attestation": {attestationUsage, attestationCommand, []string{"report", "verify"}},
+	"bench":       {benchUsage, benchCommand, nil},
+	"config":      {configUsage, configCommand, []string{"print"}},
+	"dct":         {dctUsage, dctCommand, []string{"init"}},
+	"doctor":      {doctorUsage, doctorCommand, nil},
+	"faults":      {faultsUsage, faultsCommand, []string{"inject", "list", "clear"}},
+	"healthcheck": {healthcheckUsage, healthcheckCommand, nil},
+	"keymode":     {keymodeUsage, keymodeCommand, []string{"get", "set"}},
+	"keys":        {keysUsage, keysCommand, []string{"import", "remove", "public", "renew-cert", "adopt", "list"}},
+	"loadtest":    {loadtestUsage, loadtestCommand, nil},
+	"loglevel":    {loglevelUsage, loglevelCommand, []string{"get", "set", "reset"}},
+	"logout":      {logoutUsage, logoutCommand, nil},
+	"maintenance": {maintenanceUsage, maintenanceCommand, []string{"get", "on", "off"}},
+	"preflight":   {preflightUsage, preflightCommand, nil},
+	"selftest":    {selftestUsage, selftestCommand, nil},
+	"status":      {statusUsage, statusCommand, nil},
+}
+
+// runCommand executes the subcommand named by args[0]. It returns false if
+// there is no such command and the daemon should be started instead
+func runCommand(args []string) bool {
+	args, isCommand, err := commandArgs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	if !isCommand {
+		return false
+	}
+	// the commands talk to the daemon, which may have been told to put
+	// its sockets elsewhere
+	if dir, ok := os.LookupEnv(envName("socket-dir")); ok {
+		setSocketDir(dir)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n", args[0])
+		commandUsage()
+		os.Exit(exitUsage)
+	}
+	if err := cmd.run(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	return true
+}
+
+// commandArgs strips the global flags from args and reports whether the
+// rest names a command. An invalid global flag is an error even without one,
+// it must not start the daemon
+func commandArgs(args []string) ([]string, bool, error) {
+	args, err := parseGlobalFlags(args)
+	if err != nil {
+		return nil, false, err
+	}
+	return args, len(args) > 0 && !strings.HasPrefix(args[0], "-"), nil
+}
+
+func commandUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "Commands, [--output=text|json] may be given with any of them:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "Exit codes: 1 failure, 2 usage, 3 daemon not running, 4 no token, 5 PIN locked, 6 wrong PIN,\n"+
+		"  7 key not found, 8 policy denied, 9 slot occupied, 10 touch timeout, 11 no free slot, 12 invalid input,\n"+
+		"  13 in maintenance\n")
+}
+
+// adminCall invokes an RPC on the admin socket of the running daemon
+func adminCall(method string, req interface{}, res interface{}) error {
+	client, err := rpc.Dial("unix", AdminSocket)
+	if err != nil {
+		return daemonNotRunning{err}
+	}
+	defer client.Close()
+	return client.Call("Admin."+method, req, res)
+}
+
+func approvalsCommand(args []string) error {
+	fs := flag.NewFlagSet("approvals", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		return usageError(approvalsUsage)
+	}
+
+	switch fs.Arg(0) {
+	case "list":
+		res := new(ListApprovalsRes)
+		if err := adminCall("ListApprovals", ListApprovalsReq{}, res); err != nil {
+			return err
+		}
+		if jsonOutput() {
+			return printJSON(res.Pending)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tKEY ID\tROLE\tPEER\tDIGEST (SHA256)\tWAITING")
+		for _, p := range res.Pending {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", p.ID, p.KeyID, p.Role, p.Peer, p.Digest, time.Since(p.Submitted).Round(time.Second))
+		}
+		return w.Flush()
+	case "approve", "deny":
+		if fs.NArg() != 2 {
+			return usageError(approvalsUsage)
+		}
+		req := DecideApprovalReq{ID: fs.Arg(1), Approve: fs.Arg(0) == "approve"}
+		return adminCall("DecideApproval", req, new(DecideApprovalRes))
+	default:
+		return usageError(approvalsUsage)
+	}
+}
@@ -0,0 +1,109 @@
+package adapter
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"net/rpc"
+
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/sirupsen/logrus"
+)
+
+// gobServerCodec is the codec of net/rpc, which does not export it. Owning
+// the codec gives the daemon a place to observe every request of a connection
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	peer   *peerCred
+	closed bool
+	// idle closes the connection once it served no request for a while
+	idle *idleWatch
+	// seq, method and requestID belong to the request whose body is read next
+	seq       uint64
+	method    string
+	requestID string
+}
+
+func newServerCodec(conn io.ReadWriteCloser, peer *peerCred) *gobServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+		peer:   peer,
+	}
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	c.seq, c.method, c.requestID = r.Seq, r.ServiceMethod, newRequestID()
+	c.idle.begin()
+	return nil
+}
+
+// ReadRequestBody decodes the request and hands the request ID to it. The
+// body is nil if net/rpc only discards the request
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	err := c.dec.Decode(body)
+	correlationID := ""
+	if tagger, ok := body.(requestTagger); ok && err == nil {
+		tagger.setRequestID(c.requestID)
+		correlationID = tagger.correlationID()
+	}
+	fields := requestFields(nil, c.requestID, correlationID)
+	if versioned, ok := body.(wire.Versioned); ok && err == nil {
+		fields["protocol_version"] = versioned.Protocol()
+	}
+	logrus.WithFields(fields).Infof("RPC %s from %s", c.method, c.peer)
+	inflight.start(c, c.seq, c.method, c.requestID, correlationID)
+	if faultInjection && err == nil && body != nil {
+		// net/rpc answers with the error instead of calling the method
+		err = faults.next(c.method)
+	}
+	return err
+}
+
+// WriteResponse sends the response stamped with the protocol version of the
+// daemon, a failure is logged and its message tagged with the request ID
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	defer c.idle.end()
+	served := inflight.finish(c, r.Seq)
+	if r.Error != "" {
+		logrus.WithFields(requestFields(nil, served.requestID, served.correlationID)).Errorf("RPC %s from %s failed: %s", r.ServiceMethod, c.peer, r.Error)
+		r.Error = withRequestID(r.Error, served.requestID)
+	}
+	if versioned, ok := body.(wire.Versioned); ok {
+		versioned.SetProtocol(wire.ProtocolVersion)
+	}
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// gob could not encode the header, close the connection
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// gob could not encode the body, close the connection
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		// only call c.rwc.Close once, the server closes the codec as well
+		return nil
+	}
+	c.closed = true
+	c.idle.stop()
+	return c.rwc.Close()
+}
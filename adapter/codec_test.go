@@ -0,0 +1,66 @@
+package adapter
+
+import (
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/stretchr/testify/require"
+)
+
+type echoServer struct{}
+
+func (echoServer) Echo(req string, res *string) error {
+	*res = req
+	return nil
+}
+
+type TraceReq struct {
+	RequestMeta
+	Fail bool
+}
+
+// Trace returns the request ID the codec assigned
+func (echoServer) Trace(req TraceReq, res *string) error {
+	if req.Fail {
+		return rpcError(yubikey.NewError(yubikey.ErrCodeKeyNotFound, "no key (CKR_KEY_HANDLE_INVALID, 0x60)"))
+	}
+	*res = req.requestID
+	return nil
+}
+
+func TestServerCodec(t *testing.T) {
+	server := rpc.NewServer()
+	require.NoError(t, server.RegisterName("Echo", echoServer{}))
+	serverConn, clientConn := net.Pipe()
+	go server.ServeCodec(newServerCodec(serverConn, &peerCred{UID: 1000, PID: 42}))
+
+	client := rpc.NewClient(clientConn)
+	defer client.Close()
+	var res string
+	require.NoError(t, client.Call("Echo.Echo", "hello", &res))
+	require.Equal(t, "hello", res)
+	require.Error(t, client.Call("Echo.Missing", "hello", &res))
+
+	require.NoError(t, client.Call("Echo.Trace", TraceReq{RequestMeta: RequestMeta{CorrelationID: "publish-1"}}, &res))
+	require.Len(t, res, 16)
+	first := res
+	require.NoError(t, client.Call("Echo.Trace", TraceReq{}, &res))
+	require.NotEqual(t, first, res)
+
+	err := client.Call("Echo.Trace", TraceReq{Fail: true}, &res)
+	require.Error(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "[KEY_NOT_FOUND] request "), err.Error())
+	require.Equal(t, yubikey.ErrCodeKeyNotFound, yubikey.ErrorCodeOf(err))
+	ckr, ok := yubikey.CKROf(err)
+	require.True(t, ok)
+	require.Equal(t, uint(0x60), ckr)
+}
+
+func TestWithRequestID(t *testing.T) {
+	require.Equal(t, "[NO_TOKEN] request ab: unplugged", withRequestID("[NO_TOKEN] unplugged", "ab"))
+	require.Equal(t, "request ab: gob: type mismatch", withRequestID("gob: type mismatch", "ab"))
+	require.Equal(t, "[NO_TOKEN] unplugged", withRequestID("[NO_TOKEN] unplugged", ""))
+}
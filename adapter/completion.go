@@ -0,0 +1,84 @@
+package adapter
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const completionUsage = "completion bash | zsh | fish"
+
+func init() {
+	// registered here, the map itself can not refer to its own contents
+	commands["completion"] = command{completionUsage, completionCommand, []string{"bash", "zsh", "fish"}}
+}
+
+func completionCommand(args []string) error {
+	if len(args) != 1 {
+		return usageError(completionUsage)
+	}
+	prog := filepath.Base(os.Args[0])
+	switch args[0] {
+	case "bash":
+		writeBashCompletion(os.Stdout, prog)
+	case "zsh":
+		fmt.Fprintf(os.Stdout, "#compdef %s\nautoload -U +X bashcompinit && bashcompinit\n", prog)
+		writeBashCompletion(os.Stdout, prog)
+	case "fish":
+		writeFishCompletion(os.Stdout, prog)
+	default:
+		return usageError(completionUsage)
+	}
+	return nil
+}
+
+// commandNames returns the names of all commands, sorted
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// completionFunc turns prog into the name of a shell function
+func completionFunc(prog string) string {
+	return "_" + strings.Map(func(r rune) rune {
+		if r == '-' || r == '.' {
+			return '_'
+		}
+		return r
+	}, prog)
+}
+
+func writeBashCompletion(w io.Writer, prog string) {
+	fn := completionFunc(prog)
+	fmt.Fprintf(w, "%s() {\n", fn)
+	fmt.Fprintf(w, "    local cur=${COMP_WORDS[COMP_CWORD]}\n")
+	fmt.Fprintf(w, "    if [ \"$COMP_CWORD\" -eq 1 ]; then\n")
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(commandNames(), " "))
+	fmt.Fprintf(w, "        return\n    fi\n")
+	fmt.Fprintf(w, "    if [ \"$COMP_CWORD\" -eq 2 ]; then\n        case ${COMP_WORDS[1]} in\n")
+	for _, name := range commandNames() {
+		if subs := commands[name].subcommands; len(subs) > 0 {
+			fmt.Fprintf(w, "        %s) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")) ;;\n", name, strings.Join(subs, " "))
+		}
+	}
+	fmt.Fprintf(w, "        esac\n    fi\n}\n")
+	fmt.Fprintf(w, "complete -o default -F %s %s\n", fn, prog)
+}
+
+func writeFishCompletion(w io.Writer, prog string) {
+	names := commandNames()
+	fmt.Fprintf(w, "complete -c %s -l output -x -a 'text json' -d 'Output format'\n", prog)
+	fmt.Fprintf(w, "complete -c %s -f -n '__fish_use_subcommand' -a '%s'\n", prog, strings.Join(names, " "))
+	for _, name := range names {
+		if subs := commands[name].subcommands; len(subs) > 0 {
+			fmt.Fprintf(w, "complete -c %s -f -n '__fish_seen_subcommand_from %s' -a '%s'\n", prog, name, strings.Join(subs, " "))
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package adapter
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Config is the content of the file given with -config
+type Config struct {
+	// Backend is the name of the backend to serve, it is overridden by -backend
+	Backend string `json:"backend"`
+	// Options set flags of the daemon by name, e.g. "touch-timeout": "30s".
+	// Flags and environment variables take precedence over them
+	Options map[string]string `json:"options"`
+	// Backends holds a configuration section per backend name
+	Backends    map[string]json.RawMessage `json:"backends"`
+	Policy      PolicyConfig               `json:"policy"`
+	DualControl DualControlConfig          `json:"dual_control"`
+	NeedLogin   NeedLoginConfig            `json:"need_login"`
+	Secrets     SecretsConfig              `json:"secrets"`
+	Devices     DevicesConfig              `json:"devices"`
+	// Resign lists the repositories whose snapshot the daemon keeps fresh
+	Resign     ResignConfig     `json:"resign"`
+	Webhooks   WebhooksConfig   `json:"webhooks"`
+	AuthAlerts AuthAlertsConfig `json:"auth_alerts"`
+}
+
+var config Config
+
+// loadConfig reads the JSON config file at path
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	if err := cfg.Policy.validate(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.DualControl.validate(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.NeedLogin.validate(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.Devices.validate(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.Resign.validate(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.Webhooks.validate(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.AuthAlerts.validate(); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Secrets.validate()
+}
@@ -0,0 +1,150 @@
+package adapter
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+const configUsage = "config print [flags of the daemon]"
+
+// setting is the effective value of a flag and where it came from
+type setting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+type configJSON struct {
+	SchemaVersion int         `json:"schema_version"`
+	OK            bool        `json:"ok"`
+	Settings      []setting   `json:"settings"`
+	ConfigFile    string      `json:"config_file,omitempty"`
+	Config        interface{} `json:"config,omitempty"`
+	Problems      []string    `json:"problems,omitempty"`
+}
+
+// effectiveSettings lists the flags of fs with their values and sources
+func effectiveSettings(fs *flag.FlagSet, sources map[string]string) []setting {
+	var settings []setting
+	fs.VisitAll(func(f *flag.Flag) {
+		if actionFlags[f.Name] {
+			return
+		}
+		source, ok := sources[f.Name]
+		if !ok {
+			source = sourceDefault
+		}
+		value := f.Value.String()
+		if isRedactedField(f.Name) {
+			value = "[redacted]"
+		}
+		settings = append(settings, setting{Name: f.Name, Value: value, Source: source})
+	})
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Name < settings[j].Name })
+	return settings
+}
+
+// maskSecrets replaces the values of secret fields in a decoded JSON document
+func maskSecrets(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if _, isString := value.(string); isString && isRedactedField(key) {
+				v[key] = "[redacted]"
+				continue
+			}
+			v[key] = maskSecrets(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = maskSecrets(value)
+		}
+	}
+	return v
+}
+
+// maskedConfig returns the config file with all secrets masked. The file
+// is read as is, so sections of backends keep their own fields
+func maskedConfig(path string) (interface{}, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	return maskSecrets(doc), nil
+}
+
+// configCommand prints the configuration the daemon would run with, given
+// the same flags, environment and config file
+func configCommand(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return usageError(configUsage)
+	}
+	fs := flag.NewFlagSet("config print", flag.ContinueOnError)
+	RegisterFlags(fs)
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 0 {
+		return usageError(configUsage)
+	}
+
+	set, sources := make(map[string]bool), make(map[string]string)
+	if _, err := loadSettings(fs, set, sources); err != nil {
+		return yubikey.WrapError(yubikey.ErrCodeInvalidRequest, err)
+	}
+	var problems []string
+	for _, p := range validateSettings(set) {
+		problems = append(problems, p.Error())
+	}
+	var cfg interface{}
+	if configFile != "" {
+		var err error
+		if cfg, err = maskedConfig(configFile); err != nil {
+			return yubikey.WrapError(yubikey.ErrCodeInvalidRequest, err)
+		}
+	}
+	settings := effectiveSettings(fs, sources)
+
+	if jsonOutput() {
+		out := configJSON{
+			SchemaVersion: statusSchemaVersion,
+			OK:            len(problems) == 0,
+			Settings:      settings,
+			ConfigFile:    configFile,
+			Config:        cfg,
+			Problems:      problems,
+		}
+		if err := printJSON(out); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "FLAG\tVALUE\tSOURCE")
+		for _, s := range settings {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", s.Name, s.Value, s.Source)
+		}
+		w.Flush()
+		if cfg != nil {
+			out, err := json.MarshalIndent(cfg, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Printf("\nConfig file %s:\n%s\n", configFile, out)
+		}
+		for _, p := range problems {
+			fmt.Fprintf(os.Stderr, "Problem: %s\n", p)
+		}
+	}
+	if len(problems) > 0 {
+		return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "the configuration has %d problem(s)", len(problems))
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package adapter
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+// The adapter serves as KMS plugin of sigstore (protocol v1) when it is
+// called through a link named sigstore-kms-<scheme>, e.g.
+//
+//	ln -s $(which notary-yubikey-adapter) /usr/local/bin/sigstore-kms-yubikey
+//	cosign sign --key yubikey://<key-id> <image>
+//
+// cosign runs the plugin with the protocol version and the JSON encoded
+// arguments, the message to sign is passed on stdin. The keys are used
+// through the running daemon, so its policy and audit apply to cosign as well
+const (
+	kmsPluginPrefix   = "sigstore-kms-"
+	kmsPluginProtocol = "v1"
+	kmsAlgorithm      = "ecdsa-p256-sha256"
+)
+
+// kmsPluginArgs are the arguments cosign passes to the plugin
+type kmsPluginArgs struct {
+	MethodName      string          `json:"methodName"`
+	SignMessage     *kmsSignArgs    `json:"signMessage,omitempty"`
+	VerifySignature *kmsVerifyArgs  `json:"verifySignature,omitempty"`
+	InitOptions     *kmsInitOptions `json:"initOptions"`
+}
+
+type kmsInitOptions struct {
+	ProtocolVersion string      `json:"protocolVersion"`
+	KeyResourceID   string      `json:"keyResourceID"`
+	HashFunc        crypto.Hash `json:"hashFunc"`
+}
+
+type kmsMessageOptions struct {
+	// Digest is the digest of the message, stdin is not read then
+	Digest   *[]byte      `json:"digest,omitempty"`
+	HashFunc *crypto.Hash `json:"hashFunc,omitempty"`
+}
+
+// kmsOptions carries the message options of signOptions and verifyOptions
+type kmsOptions struct {
+	MessageOptions *kmsMessageOptions `json:"messageOptions,omitempty"`
+}
+
+type kmsSignArgs struct {
+	SignOptions *kmsOptions `json:"signOptions,omitempty"`
+}
+
+type kmsVerifyArgs struct {
+	Signature     *[]byte     `json:"signature"`
+	VerifyOptions *kmsOptions `json:"verifyOptions,omitempty"`
+}
+
+// kmsPluginResp is written to stdout, ErrorMessage is set if the method failed
+type kmsPluginResp struct {
+	ErrorMessage        string                  `json:"errorMessage,omitempty"`
+	DefaultAlgorithm    *kmsDefaultAlgorithm    `json:"defaultAlgorithm,omitempty"`
+	SupportedAlgorithms *kmsSupportedAlgorithms `json:"supportedAlgorithms,omitempty"`
+	PublicKey           *kmsPublicKeyResp       `json:"publicKey,omitempty"`
+	SignMessage         *kmsSignResp            `json:"signMessage,omitempty"`
+	VerifySignature     *struct{}               `json:"verifySignature,omitempty"`
+}
+
+type kmsDefaultAlgorithm struct {
+	DefaultAlgorithm string `json:"defaultAlgorithm"`
+}
+
+type kmsSupportedAlgorithms struct {
+	SupportedAlgorithms []string `json:"supportedAlgorithms"`
+}
+
+type kmsPublicKeyResp struct {
+	PublicKeyPEM []byte `json:"publicKeyPEM"`
+}
+
+type kmsSignResp struct {
+	Signature []byte `json:"signature"`
+}
+
+// kmsDigests maps the hash functions cosign may ask for onto the digests of the daemon
+var kmsDigests = map[crypto.Hash]string{
+	crypto.SHA256: yubikey.DigestSHA256,
+	crypto.SHA384: yubikey.DigestSHA384,
+	crypto.SHA512: yubikey.DigestSHA512,
+}
+
+var kmsHashes = map[crypto.Hash]func() hash.Hash{
+	crypto.SHA256: sha256.New,
+	crypto.SHA384: sha512.New384,
+	crypto.SHA512: sha512.New,
+}
+
+// isKMSPlugin returns whether the adapter was called as sigstore KMS plugin
+func isKMSPlugin(arg0 string) bool {
+	return strings.HasPrefix(filepath.Base(arg0), kmsPluginPrefix)
+}
+
+// kmsKeyID returns the key ID of a key reference like yubikey://<key-id>
+func kmsKeyID(ref string) (string, error) {
+	i := strings.Index(ref, "://")
+	if i < 0 || ref[i+3:] == "" || strings.Contains(ref[i+3:], "/") {
+		return "", yubikey.NewError(yubikey.ErrCodeInvalidRequest, "%q is no key reference of the form <scheme>://<key-id>", ref)
+	}
+	return ref[i+3:], nil
+}
+
+// kmsDigest returns the digest of the message to sign or verify and the
+// hash function it was computed with
+func kmsDigest(opts *kmsMessageOptions, defaultHash crypto.Hash, message io.Reader) ([]byte, crypto.Hash, error) {
+	hashFunc := defaultHash
+	if opts != nil && opts.HashFunc != nil {
+		hashFunc = *opts.HashFunc
+	}
+	if hashFunc == 0 {
+		hashFunc = crypto.SHA256
+	}
+	newHash, ok := kmsHashes[hashFunc]
+	if !ok {
+		return nil, 0, yubikey.NewError(yubikey.ErrCodeInvalidRequest, "hash function %v is not supported", hashFunc)
+	}
+	if opts != nil && opts.Digest != nil {
+		if len(*opts.Digest) != hashFunc.Size() {
+			return nil, 0, yubikey.NewError(yubikey.ErrCodeInvalidRequest, "the digest has %d bytes, %v needs %d", len(*opts.Digest), hashFunc, hashFunc.Size())
+		}
+		return *opts.Digest, hashFunc, nil
+	}
+	h := newHash()
+	if _, err := io.Copy(h, message); err != nil {
+		return nil, 0, err
+	}
+	return h.Sum(nil), hashFunc, nil
+}
+
+// kmsPublicKey fetches the public key and the slot of keyID from the daemon
+func kmsPublicKey(client *rpc.Client, session uint, keyID string) (*GetPublicKeyRes, error) {
+	res := new(GetPublicKeyRes)
+	if err := client.Call("ESServer.GetPublicKey", GetPublicKeyReq{Session: session, KeyID: keyID}, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// runKMSMethod executes one method of the plugin protocol
+func runKMSMethod(args kmsPluginArgs, message io.Reader) (kmsPluginResp, error) {
+	var resp kmsPluginResp
+	if args.InitOptions == nil {
+		return resp, yubikey.NewError(yubikey.ErrCodeInvalidRequest, "no initOptions")
+	}
+	switch args.MethodName {
+	case "defaultAlgorithm":
+		resp.DefaultAlgorithm = &kmsDefaultAlgorithm{kmsAlgorithm}
+		return resp, nil
+	case "supportedAlgorithms":
+		resp.SupportedAlgorithms = &kmsSupportedAlgorithms{[]string{kmsAlgorithm}}
+		return resp, nil
+	case "createKey":
+		return resp, yubikey.NewError(yubikey.ErrCodeInvalidRequest, "keys are stored on the yubikey with 'keys import' or 'keys adopt'")
+	case "publicKey", "signMessage", "verifySignature":
+	default:
+		return resp, yubikey.NewError(yubikey.ErrCodeInvalidRequest, "method %q is not supported", args.MethodName)
+	}
+
+	keyID, err := kmsKeyID(args.InitOptions.KeyResourceID)
+	if err != nil {
+		return resp, err
+	}
+	err = withStoreSession(func(client *rpc.Client, session uint) error {
+		key, err := kmsPublicKey(client, session, keyID)
+		if err != nil {
+			return err
+		}
+		switch args.MethodName {
+		case "publicKey":
+			resp.PublicKey = &kmsPublicKeyResp{key.PEM}
+			return nil
+
+		case "signMessage":
+			var opts *kmsMessageOptions
+			if args.SignMessage != nil && args.SignMessage.SignOptions != nil {
+				opts = args.SignMessage.SignOptions.MessageOptions
+			}
+			digest, hashFunc, err := kmsDigest(opts, args.InitOptions.HashFunc, message)
+			if err != nil {
+				return err
+			}
+			req := SignReq{
+				Session:           session,
+				Slot:              key.Slot,
+				Payload:           digest,
+				DigestAlgorithm:   kmsDigests[hashFunc],
+				Prehashed:         true,
+				SignatureEncoding: yubikey.EncodingDER,
+			}
+			res := new(wire.ESSignRes)
+			if err := client.Call("ESServer.Sign", req, res); err != nil {
+				return err
+			}
+			resp.SignMessage = &kmsSignResp{res.Result}
+			return nil
+		}
+
+		// verifySignature needs no token, the public key is enough
+		if args.VerifySignature == nil || args.VerifySignature.Signature == nil {
+			return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "no signature to verify")
+		}
+		var opts *kmsMessageOptions
+		if args.VerifySignature.VerifyOptions != nil {
+			opts = args.VerifySignature.VerifyOptions.MessageOptions
+		}
+		digest, _, err := kmsDigest(opts, args.InitOptions.HashFunc, message)
+		if err != nil {
+			return err
+		}
+		if err := verifyPEMSignature(key.PEM, digest, *args.VerifySignature.Signature); err != nil {
+			return err
+		}
+		resp.VerifySignature = &struct{}{}
+		return nil
+	})
+	return resp, err
+}
+
+// verifyPEMSignature verifies a DER encoded ECDSA signature over digest
+func verifyPEMSignature(pemBytes, digest, sig []byte) error {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return fmt.Errorf("no PEM encoded public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("the key is no ECDSA key")
+	}
+	var esig struct{ R, S *big.Int }
+	if rest, err := asn1.Unmarshal(sig, &esig); err != nil || len(rest) != 0 {
+		return fmt.Errorf("the signature is not DER encoded")
+	}
+	if !ecdsa.Verify(ecPub, digest, esig.R, esig.S) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// kmsPlugin runs the plugin protocol on the command line arguments after
+// the program name and returns the exit code
+func kmsPlugin(args []string, stdin io.Reader, stdout io.Writer) int {
+	var resp kmsPluginResp
+	err := func() error {
+		if len(args) != 2 {
+			return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "usage: %s<scheme> <protocol-version> <json-args>", kmsPluginPrefix)
+		}
+		if args[0] != kmsPluginProtocol {
+			return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "protocol version %s is not supported, want %s", args[0], kmsPluginProtocol)
+		}
+		var pluginArgs kmsPluginArgs
+		if err := json.Unmarshal([]byte(args[1]), &pluginArgs); err != nil {
+			return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "decoding the arguments: %v", err)
+		}
+		var err error
+		resp, err = runKMSMethod(pluginArgs, stdin)
+		return err
+	}()
+	if err != nil {
+		resp = kmsPluginResp{ErrorMessage: err.Error()}
+	}
+	if encErr := json.NewEncoder(stdout).Encode(resp); encErr != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", encErr)
+		return exitFailure
+	}
+	if err != nil {
+		return exitCode(err)
+	}
+	return exitOK
+}
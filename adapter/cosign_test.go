@@ -0,0 +1,79 @@
+package adapter
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKMSKeyID(t *testing.T) {
+	require.True(t, isKMSPlugin("/usr/local/bin/sigstore-kms-yubikey"))
+	require.False(t, isKMSPlugin("notary-yubikey-adapter"))
+
+	keyID, err := kmsKeyID("yubikey://abc123")
+	require.NoError(t, err)
+	require.Equal(t, "abc123", keyID)
+	for _, ref := range []string{"abc123", "yubikey://", "yubikey://a/b"} {
+		_, err := kmsKeyID(ref)
+		require.Error(t, err, ref)
+	}
+}
+
+func TestKMSDigest(t *testing.T) {
+	sum := sha256.Sum256([]byte("payload"))
+	digest, hashFunc, err := kmsDigest(nil, 0, strings.NewReader("payload"))
+	require.NoError(t, err)
+	require.Equal(t, crypto.SHA256, hashFunc)
+	require.Equal(t, sum[:], digest)
+
+	// a given digest is used as is, stdin is not read
+	given := sum[:]
+	digest, _, err = kmsDigest(&kmsMessageOptions{Digest: &given}, crypto.SHA256, nil)
+	require.NoError(t, err)
+	require.Equal(t, sum[:], digest)
+
+	sha384 := crypto.SHA384
+	_, _, err = kmsDigest(&kmsMessageOptions{Digest: &given, HashFunc: &sha384}, crypto.SHA256, nil)
+	require.Error(t, err)
+	_, _, err = kmsDigest(nil, crypto.MD5, strings.NewReader("payload"))
+	require.Error(t, err)
+}
+
+func TestKMSPlugin(t *testing.T) {
+	var out bytes.Buffer
+	args := `{"methodName":"defaultAlgorithm","initOptions":{"protocolVersion":"v1","keyResourceID":"yubikey://abc"}}`
+	require.Equal(t, exitOK, kmsPlugin([]string{"v1", args}, nil, &out))
+	var resp kmsPluginResp
+	require.NoError(t, json.Unmarshal(out.Bytes(), &resp))
+	require.Equal(t, kmsAlgorithm, resp.DefaultAlgorithm.DefaultAlgorithm)
+
+	out.Reset()
+	require.Equal(t, exitInvalidInput, kmsPlugin([]string{"v2", args}, nil, &out))
+	require.NoError(t, json.Unmarshal(out.Bytes(), &resp))
+	require.Contains(t, resp.ErrorMessage, "protocol version v2")
+}
+
+func TestVerifyPEMSignature(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	digest := sha256.Sum256([]byte("payload"))
+	sig, err := priv.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	require.NoError(t, verifyPEMSignature(pemBytes, digest[:], sig))
+	digest[0] ^= 1
+	require.Error(t, verifyPEMSignature(pemBytes, digest[:], sig))
+}
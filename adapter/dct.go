@@ -0,0 +1,193 @@
+package adapter
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/wire/upstream"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/theupdateframework/notary/tuf/data"
+	"github.com/theupdateframework/notary/tuf/utils"
+)
+
+const dctUsage = "dct init [-server <url>] [-slot 9a|9c|9d|9e] [-backup <file> -backup-passphrase-file <file>] [-management-key-file <file>] <gun>"
+
+type dctInitJSON struct {
+	SchemaVersion int      `json:"schema_version"`
+	GUN           string   `json:"gun"`
+	KeyID         string   `json:"key_id"`
+	Slot          string   `json:"slot"`
+	Created       bool     `json:"created"`
+	Env           []string `json:"env"`
+	Next          []string `json:"next"`
+}
+
+// validGUN checks that gun looks like the name of a repository, e.g.
+// docker.io/library/alpine
+func validGUN(gun string) error {
+	if gun == "" {
+		return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "the GUN is empty")
+	}
+	if strings.Contains(gun, "://") {
+		return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "%q is a URL, the GUN is the name of the repository without scheme", gun)
+	}
+	if strings.IndexFunc(gun, unicode.IsSpace) >= 0 || strings.Contains(gun, ":") && !strings.Contains(gun, "/") {
+		return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "%q is no valid GUN", gun)
+	}
+	return nil
+}
+
+// dctEnv is the environment docker needs to sign for gun with content trust
+func dctEnv(server string) []string {
+	env := []string{"DOCKER_CONTENT_TRUST=1"}
+	if server != "" {
+		env = append(env, "DOCKER_CONTENT_TRUST_SERVER="+server)
+	}
+	return env
+}
+
+// dctNext are the commands which finish setting up the repository
+func dctNext(gun, server string) []string {
+	notary := "notary"
+	if server != "" {
+		notary += " -s " + server
+	}
+	return []string{
+		fmt.Sprintf("%s init --publish %s", notary, gun),
+		fmt.Sprintf("docker trust sign %s:<tag>", gun),
+	}
+}
+
+// findRootKey returns the ID and slot of a root key on the token, if there is one
+func findRootKey(client *rpc.Client, session uint) (string, []byte, error) {
+	res := new(HardwareListKeysRes)
+	if err := client.Call("ESServer.HardwareListKeys", HardwareListKeysReq{Session: session}, res); err != nil {
+		return "", nil, err
+	}
+	for keyID, slot := range res.Keys {
+		if slot.Role == data.CanonicalRootRole.String() {
+			return keyID, slot.SlotID, nil
+		}
+	}
+	return "", nil, nil
+}
+
+func dctCommand(args []string) error {
+	if len(args) == 0 || args[0] != "init" {
+		return usageError(dctUsage)
+	}
+	fs := flag.NewFlagSet("dct init", flag.ExitOnError)
+	server := fs.String("server", "", "URL of the notary server, default: the one docker uses for the registry")
+	slot := fs.String("slot", "", "PIV slot to store the root key in, default: the next empty slot")
+	backup := fs.String("backup", "", "Write an encrypted backup of the new root key to this file")
+	backupPassphraseFile := fs.String("backup-passphrase-file", "", "File holding the passphrase the backup is encrypted with")
+	managementKeyFile := fs.String("management-key-file", "", "File holding the management key, default: the daemon's secret source")
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 || (*backup == "") != (*backupPassphraseFile == "") {
+		return usageError(dctUsage)
+	}
+	gun := fs.Arg(0)
+	if err := validGUN(gun); err != nil {
+		return err
+	}
+	managementKey, err := readSecretFlag(*managementKeyFile)
+	if err != nil {
+		return err
+	}
+	backupPassphrase, err := readSecretFlag(*backupPassphraseFile)
+	if err != nil {
+		return err
+	}
+
+	out := dctInitJSON{SchemaVersion: statusSchemaVersion, GUN: gun, Env: dctEnv(*server), Next: dctNext(gun, *server)}
+	err = withStoreSession(func(client *rpc.Client, session uint) error {
+		keyID, slotID, err := findRootKey(client, session)
+		if err != nil {
+			return err
+		}
+		if keyID != "" {
+			// notary uses the root key it finds on the token, a second
+			// one would only be ambiguous
+			if *backup != "" {
+				return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "the token already holds root key %s, it can not be backed up", keyID)
+			}
+			out.KeyID, out.Slot = keyID, yubikey.SlotName(slotID)
+			return nil
+		}
+
+		privKey, err := utils.GenerateECDSAKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		if *backup != "" {
+			// write the backup first, a key which only exists on the token
+			// is lost with it
+			pemBytes, err := utils.ConvertPrivateKeyToPKCS8(privKey, data.CanonicalRootRole, "", backupPassphrase.Reveal())
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(*backup, pemBytes, 0600); err != nil {
+				return err
+			}
+		}
+		req := AddECDSAKeyReq{
+			Session:    session,
+			PrivateKey: upstream.NewPrivateKey(privKey),
+			Pass:       managementKey,
+			Role:       data.CanonicalRootRole.String(),
+			PIVSlot:    strings.ToLower(*slot),
+		}
+		req.Slot.Role = req.Role
+		req.Slot.KeyID = privKey.ID()
+		if req.PIVSlot == "" {
+			next := new(wire.ESGetNextEmptySlotRes)
+			if err := client.Call("ESServer.GetNextEmptySlot", wire.ESGetNextEmptySlotReq{Session: session}, next); err != nil {
+				return err
+			}
+			req.Slot.SlotID = next.Slot
+		}
+		if err := client.Call("ESServer.AddECDSAKey", req, new(wire.ESAddECDSAKeyRes)); err != nil {
+			return err
+		}
+		out.KeyID, out.Created = privKey.ID(), true
+		if out.Slot = req.PIVSlot; out.Slot == "" {
+			out.Slot = yubikey.SlotName(req.Slot.SlotID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		return printJSON(out)
+	}
+	if out.Created {
+		fmt.Printf("Created root key %s in slot %s\n", out.KeyID, out.Slot)
+	} else {
+		fmt.Printf("Using root key %s already stored in slot %s\n", out.KeyID, out.Slot)
+	}
+	if *backup != "" {
+		fmt.Printf("Backup written to %s, keep it offline\n", *backup)
+	}
+	fmt.Printf("\nEnvironment for docker trust:\n")
+	for _, e := range out.Env {
+		fmt.Printf("  export %s\n", e)
+	}
+	if Socket != filepath.Join(SocketPath, SocketName) {
+		fmt.Fprintf(os.Stderr, "Warning: notary looks for the store at %s, the daemon listens on %s\n", filepath.Join(SocketPath, SocketName), Socket)
+	}
+	fmt.Printf("\nThen initialize %s and sign:\n", gun)
+	for _, cmd := range out.Next {
+		fmt.Printf("  %s\n", cmd)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package adapter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidGUN(t *testing.T) {
+	require.NoError(t, validGUN("docker.io/library/alpine"))
+	require.NoError(t, validGUN("localhost:5000/app"))
+	require.Error(t, validGUN(""))
+	require.Error(t, validGUN("https://docker.io/library/alpine"))
+	require.Error(t, validGUN("alpine:latest"))
+	require.Error(t, validGUN("my repo"))
+}
+
+func TestDCTEnv(t *testing.T) {
+	require.Equal(t, []string{"DOCKER_CONTENT_TRUST=1"}, dctEnv(""))
+	require.Equal(t, []string{"DOCKER_CONTENT_TRUST=1", "DOCKER_CONTENT_TRUST_SERVER=https://notary.example.com"}, dctEnv("https://notary.example.com"))
+	require.Equal(t, "notary -s https://notary.example.com init --publish example.com/app", dctNext("example.com/app", "https://notary.example.com")[0])
+}
@@ -0,0 +1,298 @@
+package adapter
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// DevicesConfig names devices by their serial number, e.g.
+// {"1234567": "root-key-a"}
+type DevicesConfig map[string]string
+
+func (cfg DevicesConfig) validate() error {
+	seen := make(map[string]string)
+	for serial, alias := range cfg {
+		if serial == "" || alias == "" {
+			return fmt.Errorf("devices: serial and alias must not be empty")
+		}
+		if other, ok := seen[alias]; ok {
+			return fmt.Errorf("devices: alias %q is used for %s and %s", alias, other, serial)
+		}
+		if _, ok := cfg[alias]; ok && alias != serial {
+			return fmt.Errorf("devices: alias %q is the serial of another device", alias)
+		}
+		seen[alias] = serial
+	}
+	return nil
+}
+
+// deviceAlias returns the configured alias of the device, or an empty string
+func deviceAlias(serial string) string {
+	return config.Devices[serial]
+}
+
+// deviceName describes the device in log messages
+func deviceName(serial string) string {
+	if alias := deviceAlias(serial); alias != "" {
+		return fmt.Sprintf("%s (%s)", alias, serial)
+	}
+	return serial
+}
+
+// resolveDevice returns the serial of the device with the alias name, names
+// which are no alias are taken as serial
+func resolveDevice(name string) string {
+	for serial, alias := range config.Devices {
+		if alias == name {
+			return serial
+		}
+	}
+	return name
+}
+
+// deviceAliases returns the aliases of the devices holding the keys
+func deviceAliases(devices map[string][]string) map[string]string {
+	aliases := make(map[string]string)
+	for _, serials := range devices {
+		for _, serial := range serials {
+			if alias := deviceAlias(serial); alias != "" {
+				aliases[serial] = alias
+			}
+		}
+	}
+	return aliases
+}
+
+// tokenKeyCache remembers on which devices the last listing found each key
+type tokenKeyCache struct {
+	sync.Mutex
+	byID map[string][]backend.TokenKey
+}
+
+var tokenKeys = &tokenKeyCache{byID: make(map[string][]backend.TokenKey)}
+
+func (c *tokenKeyCache) set(keys []backend.TokenKey) {
+	byID := make(map[string][]backend.TokenKey)
+	for _, k := range keys {
+		byID[k.KeyID] = append(byID[k.KeyID], k)
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.byID = byID
+}
+
+func (c *tokenKeyCache) lookup(keyID string) []backend.TokenKey {
+	c.Lock()
+	defer c.Unlock()
+	return c.byID[keyID]
+}
+
+// mergeTokenKeys adds the keys of all devices to the keys of the device the
+// session is open on, which take precedence. devices maps every key ID to
+// the serial numbers of the devices holding it
+func mergeTokenKeys(keys map[string]common.HardwareSlot, all []backend.TokenKey) (map[string]common.HardwareSlot, map[string][]string) {
+	merged := make(map[string]common.HardwareSlot, len(keys))
+	for keyID, slot := range keys {
+		merged[keyID] = slot
+	}
+	devices := make(map[string][]string)
+	for _, k := range all {
+		if _, ok := merged[k.KeyID]; !ok {
+			slot := k.Slot
+			slot.KeyID = ""
+			merged[k.KeyID] = slot
+		}
+		devices[k.KeyID] = append(devices[k.KeyID], k.Serial)
+	}
+	for _, serials := range devices {
+		sort.Strings(serials)
+	}
+	return merged, devices
+}
+
+// listsDevice tells whether keys holds any key of the device with serial
+func listsDevice(keys []backend.TokenKey, serial string) bool {
+	for _, k := range keys {
+		if serial != "" && k.Serial == serial {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionDevice returns the serial number of the device of the session, or
+// an empty string if the backend can not tell
+func sessionDevice(session pkcs11.SessionHandle) string {
+	multi, ok := ks.(backend.MultiToken)
+	if !ok {
+		return ""
+	}
+	serial, err := multi.SessionSerial(session)
+	if err != nil {
+		logrus.Debugf("Failed to read the serial number of the device: %v", err)
+		return ""
+	}
+	return serial
+}
+
+// checkSessionDevice refuses to use the device of the session for role, if
+// the role is bound to other devices
+func checkSessionDevice(session pkcs11.SessionHandle, role string) error {
+	if !signPolicy.bindsDevice(role) {
+		return nil
+	}
+	return signPolicy.checkDevice(role, sessionDevice(session))
+}
+
+// failoverCooldown is how long a device which failed is tried after the
+// other devices holding the same key
+const failoverCooldown = time.Minute
+
+// deviceHealth remembers when devices last failed
+type deviceHealth struct {
+	sync.Mutex
+	failed map[string]time.Time
+}
+
+var devicesHealth = &deviceHealth{failed: make(map[string]time.Time)}
+
+func (h *deviceHealth) fail(serial string, now time.Time) {
+	h.Lock()
+	defer h.Unlock()
+	h.failed[serial] = now
+}
+
+func (h *deviceHealth) ok(serial string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.failed, serial)
+}
+
+func (h *deviceHealth) healthy(serial string, now time.Time) bool {
+	h.Lock()
+	defer h.Unlock()
+	failed, ok := h.failed[serial]
+	return !ok || now.Sub(failed) >= failoverCooldown
+}
+
+// signTarget is a device a signature can be created on. session is set for
+// the device of the session of the request
+type signTarget struct {
+	backend.TokenKey
+	session bool
+}
+
+// signTargets lists the devices holding keyID, the device of the session
+// first, followed by the other devices of the last listing. Devices which
+// failed recently are moved to the end
+func signTargets(primary common.HardwareSlot, serial string, others []backend.TokenKey, now time.Time) []signTarget {
+	targets := []signTarget{{TokenKey: backend.TokenKey{KeyID: primary.KeyID, Serial: serial, Slot: primary}, session: true}}
+	for _, tk := range others {
+		if serial == "" || tk.Serial != serial {
+			targets = append(targets, signTarget{TokenKey: tk})
+		}
+	}
+	sortTargets(targets, now)
+	return targets
+}
+
+// sortTargets moves the devices which failed recently to the end
+func sortTargets(targets []signTarget, now time.Time) {
+	sort.SliceStable(targets, func(i, j int) bool {
+		return devicesHealth.healthy(targets[i].Serial, now) && !devicesHealth.healthy(targets[j].Serial, now)
+	})
+}
+
+// uriTargets resolves the pkcs11 URI of a sign request to the key it
+// selects and the devices holding it. The URI must select a single key
+func uriTargets(session pkcs11.SessionHandle, uri string) (common.HardwareSlot, []signTarget, error) {
+	resolver, ok := ks.(backend.URIResolver)
+	if !ok {
+		return common.HardwareSlot{}, nil, yubikey.NewError(yubikey.ErrCodeInvalidRequest, "backend %s does not support pkcs11 URIs", ks.Name())
+	}
+	keys, err := resolver.ResolveURI(session, uri)
+	if err != nil {
+		return common.HardwareSlot{}, nil, err
+	}
+	serial := sessionDevice(session)
+	targets := make([]signTarget, 0, len(keys))
+	for _, tk := range keys {
+		if tk.KeyID != keys[0].KeyID {
+			return common.HardwareSlot{}, nil, yubikey.NewError(yubikey.ErrCodeInvalidRequest, "%s selects more than one key", uri)
+		}
+		targets = append(targets, signTarget{TokenKey: tk, session: tk.Serial == serial})
+	}
+	sortTargets(targets, time.Now())
+	slot := keys[0].Slot
+	slot.KeyID = keys[0].KeyID
+	return slot, targets, nil
+}
+
+// failover tells whether signing should go on with the next device holding
+// the key. Wrong PINs are not tried on other devices, they would lock them
+func failover(err error) bool {
+	switch yubikey.ErrorCodeOf(err) {
+	case yubikey.ErrCodeKeyNotFound, yubikey.ErrCodeNoToken, yubikey.ErrCodeDevice, yubikey.ErrCodePolicyDenied:
+		return true
+	}
+	return false
+}
+
+// signOnDevices signs on the device of the session. If the key is not on
+// that device, may not be used there or the device fails, it fails over to
+// the other attached devices the last listing found the key on
+func signOnDevices(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string, payload []byte, opts backend.SignOptions) ([]byte, error) {
+	var others []backend.TokenKey
+	if _, isMulti := ks.(backend.MultiToken); isMulti {
+		others = tokenKeys.lookup(hwslot.KeyID)
+	}
+	targets := signTargets(hwslot, sessionDevice(session), others, time.Now())
+	return signOnTargets(session, string(hwslot.Role), targets, passwd, payload, opts)
+}
+
+// signOnTargets signs on the first of targets which succeeds, as long as
+// the failures allow to go on with the next one
+func signOnTargets(session pkcs11.SessionHandle, role string, targets []signTarget, passwd string, payload []byte, opts backend.SignOptions) ([]byte, error) {
+	now := time.Now()
+	multi, _ := ks.(backend.MultiToken)
+	opts.Timings = new(backend.SignTimings)
+	defer func() { latencies.observeSign(time.Since(now), opts.Timings.Touch) }()
+
+	var err error
+	for _, target := range targets {
+		var sig []byte
+		serr := signPolicy.checkDevice(role, target.Serial)
+		if serr == nil {
+			if target.session {
+				sig, serr = ks.SignWithOptions(session, target.Slot, passwd, payload, opts)
+			} else {
+				logrus.Infof("Signing with key %s on yubikey %s", target.KeyID, deviceName(target.Serial))
+				sig, serr = multi.SignOnToken(target.Serial, target.Slot, passwd, payload, opts)
+			}
+		}
+		if serr == nil {
+			devicesHealth.ok(target.Serial)
+			return sig, nil
+		}
+		if !failover(serr) {
+			return nil, serr
+		}
+		if code := yubikey.ErrorCodeOf(serr); code == yubikey.ErrCodeNoToken || code == yubikey.ErrCodeDevice {
+			logrus.Warnf("Yubikey %s failed to sign with key %s, trying the next device holding it: %v", deviceName(target.Serial), target.KeyID, serr)
+			devicesHealth.fail(target.Serial, now)
+		}
+		// a missing key is the least helpful reason to report
+		if err == nil || yubikey.ErrorCodeOf(serr) != yubikey.ErrCodeKeyNotFound {
+			err = serr
+		}
+	}
+	return nil, err
+}
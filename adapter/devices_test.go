@@ -0,0 +1,139 @@
+package adapter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+func TestMergeTokenKeys(t *testing.T) {
+	primary := map[string]common.HardwareSlot{
+		"a": {Role: data.CanonicalRootRole, SlotID: []byte{2}},
+	}
+	all := []backend.TokenKey{
+		{KeyID: "a", Serial: "222", Slot: common.HardwareSlot{Role: data.CanonicalRootRole, SlotID: []byte{1}}},
+		{KeyID: "a", Serial: "111", Slot: common.HardwareSlot{Role: data.CanonicalRootRole, SlotID: []byte{2}}},
+		{KeyID: "b", Serial: "222", Slot: common.HardwareSlot{Role: data.CanonicalTargetsRole, SlotID: []byte{3}, KeyID: "b"}},
+	}
+	keys, devices := mergeTokenKeys(primary, all)
+	require.Len(t, keys, 2)
+	require.Equal(t, []byte{2}, keys["a"].SlotID)
+	require.Equal(t, data.CanonicalTargetsRole, keys["b"].Role)
+	require.Equal(t, []string{"111", "222"}, devices["a"])
+	require.Equal(t, []string{"222"}, devices["b"])
+}
+
+func TestDeviceAliases(t *testing.T) {
+	require.NoError(t, DevicesConfig{"1234567": "root-key-a", "7654321": "daily"}.validate())
+	require.Error(t, DevicesConfig{"1234567": "a", "7654321": "a"}.validate())
+	require.Error(t, DevicesConfig{"1234567": "7654321", "7654321": "daily"}.validate())
+	require.Error(t, DevicesConfig{"1234567": ""}.validate())
+
+	defer func(devices DevicesConfig) { config.Devices = devices }(config.Devices)
+	config.Devices = DevicesConfig{"1234567": "root-key-a"}
+	require.Equal(t, "1234567", resolveDevice("root-key-a"))
+	require.Equal(t, "7654321", resolveDevice("7654321"))
+	require.Equal(t, "root-key-a (1234567)", deviceName("1234567"))
+	require.Equal(t, "7654321", deviceName("7654321"))
+	require.Equal(t, map[string]string{"1234567": "root-key-a"}, deviceAliases(map[string][]string{"a": {"1234567", "7654321"}}))
+}
+
+func TestSignTargets(t *testing.T) {
+	defer func(h *deviceHealth) { devicesHealth = h }(devicesHealth)
+	devicesHealth = &deviceHealth{failed: make(map[string]time.Time)}
+	now := time.Date(2019, 6, 18, 12, 0, 0, 0, time.UTC)
+
+	primary := common.HardwareSlot{Role: data.CanonicalRootRole, SlotID: []byte{2}, KeyID: "a"}
+	others := []backend.TokenKey{
+		{KeyID: "a", Serial: "111", Slot: primary},
+		{KeyID: "a", Serial: "222", Slot: common.HardwareSlot{Role: data.CanonicalRootRole, SlotID: []byte{3}, KeyID: "a"}},
+	}
+	serials := func(targets []signTarget) []string {
+		var s []string
+		for _, target := range targets {
+			s = append(s, target.Serial)
+		}
+		return s
+	}
+
+	targets := signTargets(primary, "111", others, now)
+	require.Equal(t, []string{"111", "222"}, serials(targets))
+	require.True(t, targets[0].session)
+	require.False(t, targets[1].session)
+
+	devicesHealth.fail("111", now)
+	require.Equal(t, []string{"222", "111"}, serials(signTargets(primary, "111", others, now)))
+	require.Equal(t, []string{"111", "222"}, serials(signTargets(primary, "111", others, now.Add(failoverCooldown))))
+	devicesHealth.ok("111")
+	require.Equal(t, []string{"111", "222"}, serials(signTargets(primary, "111", others, now)))
+
+	// the device of the session is unknown
+	require.Equal(t, []string{"", "111", "222"}, serials(signTargets(primary, "", others, now)))
+
+	require.True(t, failover(yubikey.NewError(yubikey.ErrCodeDevice, "gone")))
+	require.False(t, failover(yubikey.NewError(yubikey.ErrCodeWrongPin, "wrong")))
+}
+
+// multiTokenBackend serves the session on the device 111, whose listing
+// fails with failure, and lists the keys of all devices from others
+type multiTokenBackend struct {
+	*sessionBackend
+	backend.MultiToken
+	failure error
+	others  []backend.TokenKey
+}
+
+func (b *multiTokenBackend) HardwareListKeys(session pkcs11.SessionHandle) (map[string]common.HardwareSlot, error) {
+	if b.failure != nil {
+		return nil, b.failure
+	}
+	return b.sessionBackend.HardwareListKeys(session)
+}
+
+func (b *multiTokenBackend) ListAllTokenKeys() ([]backend.TokenKey, error) {
+	return b.others, nil
+}
+
+func (b *multiTokenBackend) SessionSerial(session pkcs11.SessionHandle) (string, error) {
+	return "111", nil
+}
+
+func TestListKeysOfFailedSessionDevice(t *testing.T) {
+	multi := &multiTokenBackend{
+		sessionBackend: &sessionBackend{using: make(map[pkcs11.SessionHandle]int)},
+		failure:        yubikey.NewError(yubikey.ErrCodeDevice, "token failed"),
+		others:         []backend.TokenKey{{KeyID: "b", Serial: "222", Slot: common.HardwareSlot{Role: data.CanonicalTargetsRole, SlotID: []byte{3}}}},
+	}
+	defer func(old backend.Backend) { ks = old }(ks)
+	ks = multi
+	defer tokenKeys.set(nil)
+	list := func() (*HardwareListKeysRes, error) {
+		res := new(HardwareListKeysRes)
+		return res, NewServer(nil).HardwareListKeys(HardwareListKeysReq{Session: 1}, res)
+	}
+
+	// the keys of the session's device are missing from the listing
+	_, err := list()
+	require.Equal(t, yubikey.ErrCodeDevice, yubikey.ErrorCodeOf(err))
+
+	// the device has no keys, the ones of the others are all there are
+	multi.failure = yubikey.NewError(yubikey.ErrCodeKeyNotFound, "no keys found in yubikey")
+	res, err := list()
+	require.NoError(t, err)
+	require.Len(t, res.Keys, 1)
+	require.Contains(t, res.Keys, "b")
+
+	// the listing of all devices found the keys of the session's device
+	multi.failure = yubikey.NewError(yubikey.ErrCodeDevice, "token failed")
+	multi.others = append(multi.others, backend.TokenKey{KeyID: "a", Serial: "111", Slot: common.HardwareSlot{Role: data.CanonicalRootRole, SlotID: []byte{2}}})
+	res, err = list()
+	require.NoError(t, err)
+	require.Len(t, res.Keys, 2)
+	require.Equal(t, []string{"111"}, res.Devices["a"])
+}
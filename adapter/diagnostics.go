@@ -0,0 +1,152 @@
+package adapter
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/sirupsen/logrus"
+)
+
+// sessionInfo describes an open session for the diagnostics dump
+type sessionInfo struct {
+	peer   *peerCred
+	opened time.Time
+}
+
+// sessionRegistry keeps track of the sessions handed out by SetupHSMEnv
+type sessionRegistry struct {
+	sync.Mutex
+	sessions map[uint]sessionInfo
+}
+
+var openSessions = &sessionRegistry{sessions: make(map[uint]sessionInfo)}
+
+func (r *sessionRegistry) open(session uint, peer *peerCred) {
+	r.Lock()
+	defer r.Unlock()
+	r.sessions[session] = sessionInfo{peer: peer, opened: time.Now()}
+}
+
+func (r *sessionRegistry) close(session uint) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.sessions, session)
+}
+
+// call is an RPC that is being served
+type call struct {
+	method        string
+	requestID     string
+	correlationID string
+	peer          *peerCred
+	started       time.Time
+}
+
+// callKey identifies a call by its connection and sequence number
+type callKey struct {
+	codec *gobServerCodec
+	seq   uint64
+}
+
+// callRegistry keeps track of the RPCs being served
+type callRegistry struct {
+	sync.Mutex
+	calls map[callKey]call
+}
+
+var inflight = &callRegistry{calls: make(map[callKey]call)}
+
+func (r *callRegistry) start(codec *gobServerCodec, seq uint64, method, requestID, correlationID string) {
+	r.Lock()
+	defer r.Unlock()
+	r.calls[callKey{codec, seq}] = call{method: method, requestID: requestID, correlationID: correlationID, peer: codec.peer, started: time.Now()}
+}
+
+// finish removes a call and returns it
+func (r *callRegistry) finish(codec *gobServerCodec, seq uint64) call {
+	r.Lock()
+	defer r.Unlock()
+	c := r.calls[callKey{codec, seq}]
+	delete(r.calls, callKey{codec, seq})
+	return c
+}
+
+// dumpHandler writes the diagnostics to the log on SIGUSR1. The dump is
+// written regardless of the log level
+func dumpHandler(sig os.Signal) error {
+	dumpDiagnostics(logrus.StandardLogger().Out, time.Now())
+	return nil
+}
+
+// dumpDiagnostics writes the state of the daemon to w, so a stuck signature
+// can be investigated without restarting the daemon
+func dumpDiagnostics(w io.Writer, now time.Time) {
+	fmt.Fprintf(w, "=== diagnostics dump at %s ===\n", now.Format(time.RFC3339))
+	fmt.Fprintf(w, "backend: %s, started: %s\n", backendName, started.Format(time.RFC3339))
+	if d, ok := ks.(backend.Diagnoser); ok {
+		for _, line := range d.Diagnostics() {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+
+	openSessions.Lock()
+	fmt.Fprintf(w, "open sessions: %d\n", len(openSessions.sessions))
+	handles := make([]int, 0, len(openSessions.sessions))
+	for session := range openSessions.sessions {
+		handles = append(handles, int(session))
+	}
+	sort.Ints(handles)
+	for _, session := range handles {
+		info := openSessions.sessions[uint(session)]
+		fmt.Fprintf(w, "  session %d of %s, open for %s", session, info.peer, now.Sub(info.opened).Truncate(time.Millisecond))
+		if n := sessionQueues.queued(uint(session)); n > 0 {
+			fmt.Fprintf(w, ", %d RPCs queued", n)
+		}
+		fmt.Fprintln(w)
+	}
+	openSessions.Unlock()
+
+	inflight.Lock()
+	fmt.Fprintf(w, "in-flight RPCs: %d\n", len(inflight.calls))
+	calls := make([]call, 0, len(inflight.calls))
+	for _, c := range inflight.calls {
+		calls = append(calls, c)
+	}
+	inflight.Unlock()
+	sort.Slice(calls, func(i, j int) bool { return calls[i].started.Before(calls[j].started) })
+	for _, c := range calls {
+		fmt.Fprintf(w, "  %s (request %s) from %s, running for %s\n", c.method, c.requestID, c.peer, now.Sub(c.started).Truncate(time.Millisecond))
+	}
+
+	notAfter := certExpiries.snapshot()
+	fmt.Fprintf(w, "known keys: %d\n", len(notAfter))
+	keyIDs := make([]string, 0, len(notAfter))
+	for keyID := range notAfter {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Strings(keyIDs)
+	for _, keyID := range keyIDs {
+		fmt.Fprintf(w, "  %s certificate expires %s\n", keyID, notAfter[keyID].Format(time.RFC3339))
+	}
+
+	fmt.Fprintf(w, "goroutines: %d\n%s", runtime.NumGoroutine(), goroutineStacks())
+	fmt.Fprintf(w, "=== end of diagnostics dump ===\n")
+}
+
+// goroutineStacks returns the stacks of all goroutines
+func goroutineStacks() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -0,0 +1,27 @@
+package adapter
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpDiagnostics(t *testing.T) {
+	peer := &peerCred{UID: 1000, PID: 42}
+	openSessions.open(7, peer)
+	defer openSessions.close(7)
+	codec := &gobServerCodec{peer: peer}
+	inflight.start(codec, 1, "ESServer.Sign", "0a1b", "")
+	defer inflight.finish(codec, 1)
+
+	var buf bytes.Buffer
+	dumpDiagnostics(&buf, time.Now())
+	out := buf.String()
+	require.Contains(t, out, "open sessions: 1\n")
+	require.Contains(t, out, "  session 7 of "+peer.String())
+	require.Contains(t, out, "in-flight RPCs: 1\n")
+	require.Contains(t, out, "  ESServer.Sign (request 0a1b) from "+peer.String())
+	require.Contains(t, out, "TestDumpDiagnostics")
+}
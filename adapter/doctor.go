@@ -0,0 +1,162 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+const doctorUsage = "doctor"
+
+// errDoctorFoundProblems makes the doctor command exit with a failure
+var errDoctorFoundProblems = errors.New("doctor found problems")
+
+// errNotChecked is returned by checks which are not implemented on the platform
+var errNotChecked = errors.New("not checked on this platform")
+
+// diagnosis is the result of one doctor check, Hint tells how to fix a problem
+type diagnosis struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// doctorJSON is the stable schema of doctor --json
+type doctorJSON struct {
+	SchemaVersion int         `json:"schema_version"`
+	OK            bool        `json:"ok"`
+	Checks        []diagnosis `json:"checks"`
+}
+
+// checkLibrary looks for the ykcs11 library at the known paths
+func checkLibrary(candidates []string) diagnosis {
+	d := diagnosis{Name: "ykcs11"}
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			d.OK, d.Detail = true, "found "+path
+			return d
+		}
+	}
+	d.Detail = "libykcs11 not found in " + strings.Join(candidates, ", ")
+	d.Hint = "install yubico-piv-tool, which ships libykcs11"
+	return d
+}
+
+// checkPcscd checks that the smart card daemon the library talks to is up
+func checkPcscd() diagnosis {
+	d := diagnosis{Name: "pcscd"}
+	running, err := processesRunning("pcscd")
+	switch {
+	case err == errNotChecked:
+		d.OK, d.Detail = true, err.Error()
+	case err != nil:
+		d.Detail = err.Error()
+	case running["pcscd"] || pcscdSocketExists():
+		d.OK, d.Detail = true, "running"
+	default:
+		d.Detail = "not running"
+		d.Hint = "start pcscd, e.g. with 'systemctl enable --now pcscd.socket'"
+	}
+	return d
+}
+
+// checkScdaemon looks for the smart card daemon of GnuPG, which claims the
+// yubikey exclusively unless told to share it
+func checkScdaemon() diagnosis {
+	d := diagnosis{Name: "scdaemon"}
+	running, err := processesRunning("scdaemon", "gpg-agent")
+	switch {
+	case err == errNotChecked:
+		d.OK, d.Detail = true, err.Error()
+	case err != nil:
+		d.Detail = err.Error()
+	case running["scdaemon"]:
+		d.Detail = "scdaemon of GnuPG is running and may hold the yubikey"
+		d.Hint = "run 'gpgconf --kill scdaemon', or add 'pcsc-shared' and 'disable-ccid' to ~/.gnupg/scdaemon.conf"
+	case running["gpg-agent"]:
+		d.OK, d.Detail = true, "gpg-agent is running, but no scdaemon"
+	default:
+		d.OK, d.Detail = true, "not running"
+	}
+	return d
+}
+
+// checkSocket tells whether the daemon listens on path. Sockets nobody
+// listens on are left behind by a daemon which did not shut down cleanly
+func checkSocket(name, path string) diagnosis {
+	d := diagnosis{Name: name}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		d.OK, d.Detail = true, path+" does not exist, the daemon is not running"
+		return d
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	switch {
+	case err == nil:
+		conn.Close()
+		d.OK, d.Detail = true, "the daemon is listening on "+path
+	case errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM):
+		d.Detail = fmt.Sprintf("no permission to connect to %s", path)
+		d.Hint = "run the command as the user of the daemon, or as a member of the group of its socket"
+	case errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOTSOCK):
+		d.Detail = fmt.Sprintf("nobody listens on %s", path)
+		d.Hint = fmt.Sprintf("the socket is stale, remove it with 'rm %s' and start the daemon again", path)
+	default:
+		d.Detail = err.Error()
+	}
+	return d
+}
+
+// runDoctor checks the common causes of failures on the local machine
+func runDoctor() []diagnosis {
+	return []diagnosis{
+		checkLibrary(yubikey.LibraryCandidates()),
+		checkPcscd(),
+		checkScdaemon(),
+		checkSocket("socket", Socket),
+		checkSocket("admin_socket", AdminSocket),
+	}
+}
+
+func doctorCommand(args []string) error {
+	if len(args) != 0 {
+		return usageError(doctorUsage)
+	}
+	checks := runDoctor()
+	ok := true
+	for _, c := range checks {
+		ok = ok && c.OK
+	}
+	if jsonOutput() {
+		if err := printJSON(doctorJSON{SchemaVersion: statusSchemaVersion, OK: ok, Checks: checks}); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "CHECK\tRESULT\tDETAIL")
+		for _, c := range checks {
+			result := "ok"
+			if !c.OK {
+				result = "PROBLEM"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", c.Name, result, c.Detail)
+			if c.Hint != "" {
+				fmt.Fprintf(w, "\t\thint: %s\n", c.Hint)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if !ok {
+		return errDoctorFoundProblems
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+// +build linux
+
+package adapter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pcscdSocket is where pcscd listens, it is present if pcscd is started
+// on demand by systemd
+const pcscdSocket = "/run/pcscd/pcscd.comm"
+
+func pcscdSocketExists() bool {
+	_, err := os.Stat(pcscdSocket)
+	return err == nil
+}
+
+// processesRunning tells which of the named processes are running
+func processesRunning(names ...string) (map[string]bool, error) {
+	return scanProcesses("/proc", names)
+}
+
+// scanProcesses matches the command names in the proc filesystem at root
+func scanProcesses(root string, names []string) (map[string]bool, error) {
+	comms, err := filepath.Glob(filepath.Join(root, "[0-9]*", "comm"))
+	if err != nil {
+		return nil, err
+	}
+	running := make(map[string]bool)
+	for _, comm := range comms {
+		b, err := ioutil.ReadFile(comm)
+		if err != nil {
+			// the process exited meanwhile
+			continue
+		}
+		name := strings.TrimSpace(string(b))
+		if containsString(names, name) {
+			running[name] = true
+		}
+	}
+	return running, nil
+}
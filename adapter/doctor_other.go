@@ -0,0 +1,12 @@
+// +build !linux
+
+package adapter
+
+func pcscdSocketExists() bool {
+	return false
+}
+
+// processesRunning is only implemented on linux
+func processesRunning(names ...string) (map[string]bool, error) {
+	return nil, errNotChecked
+}
@@ -0,0 +1,44 @@
+package adapter
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doctor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hardwarestore.sock")
+
+	d := checkSocket("socket", path)
+	require.True(t, d.OK)
+
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	d = checkSocket("socket", path)
+	require.True(t, d.OK, d.Detail)
+
+	// a socket file nobody listens on
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	d = checkSocket("socket", path)
+	require.False(t, d.OK)
+	require.Contains(t, d.Hint, "stale")
+}
+
+func TestCheckLibrary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doctor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	lib := filepath.Join(dir, "libykcs11.so")
+
+	require.False(t, checkLibrary([]string{lib}).OK)
+	require.NoError(t, ioutil.WriteFile(lib, nil, 0644))
+	require.True(t, checkLibrary([]string{filepath.Join(dir, "missing.so"), lib}).OK)
+}
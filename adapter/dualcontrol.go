@@ -0,0 +1,68 @@
+package adapter
+
+import (
+	"fmt"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/sirupsen/logrus"
+)
+
+// DualControlConfig enforces a two-person rule: before signing for one of
+// Roles, every configured device has to confirm the request
+type DualControlConfig struct {
+	Roles   []string            `json:"roles"`
+	Devices []DualControlDevice `json:"devices"`
+}
+
+// DualControlDevice is a yubikey which confirms sign requests with the key
+// in Slot. The key should require touch and must accept the user PIN of the
+// sign request
+type DualControlDevice struct {
+	Serial string `json:"serial"`
+	Slot   string `json:"slot"`
+}
+
+func (cfg DualControlConfig) validate() error {
+	if len(cfg.Roles) == 0 {
+		return nil
+	}
+	serials := make(map[string]bool)
+	for _, d := range cfg.Devices {
+		if _, err := yubikey.ParseSlot(d.Slot); err != nil {
+			return fmt.Errorf("dual control device %s: %v", d.Serial, err)
+		}
+		serials[d.Serial] = true
+	}
+	if len(serials) < 2 {
+		return fmt.Errorf("dual control needs at least two distinct devices")
+	}
+	return nil
+}
+
+// confirmDualControl collects the confirmation of all configured devices if
+// role is subject to dual control
+func confirmDualControl(peer *peerCred, role string, passwd yubikey.Secret) error {
+	cfg := config.DualControl
+	if !containsString(cfg.Roles, role) {
+		return nil
+	}
+	confirmer, ok := ks.(backend.PresenceConfirmer)
+	if !ok {
+		return yubikey.NewError(yubikey.ErrCodePolicyDenied, "backend %s can not confirm dual control", ks.Name())
+	}
+	for _, d := range cfg.Devices {
+		// validated by DualControlConfig.validate
+		slotID, _ := yubikey.ParseSlot(d.Slot)
+		err := confirmer.ConfirmPresence(d.Serial, slotID, passwd.Reveal())
+		audit("dual_control_confirm", peer, logrus.Fields{"role": role, "device": d.Serial}, err)
+		if e, ok := err.(*yubikey.Error); ok {
+			// a wrong PIN or a touch timeout has to reach the client as such
+			return &yubikey.Error{Code: e.Code, CKR: e.CKR, Err: fmt.Errorf("dual control confirmation of yubikey %s failed: %v", d.Serial, e.Err)}
+		}
+		if err != nil {
+			return yubikey.NewError(yubikey.ErrCodePolicyDenied, "dual control confirmation of yubikey %s failed: %v", d.Serial, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package adapter
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+// confirmingBackend confirms presence on every device but broken with the
+// PIN 123456
+type confirmingBackend struct {
+	*sessionBackend
+	confirmed []string
+}
+
+func (b *confirmingBackend) ConfirmPresence(serial string, slotID []byte, passwd string) error {
+	if serial == "broken" {
+		return errors.New("device gone")
+	}
+	if passwd != "123456" {
+		return yubikey.NewError(yubikey.ErrCodeWrongPin, "wrong PIN")
+	}
+	b.confirmed = append(b.confirmed, serial)
+	return nil
+}
+
+func TestConfirmDualControl(t *testing.T) {
+	confirmer := &confirmingBackend{sessionBackend: &sessionBackend{using: make(map[pkcs11.SessionHandle]int)}}
+	defer func(old backend.Backend) { ks = old }(ks)
+	ks = confirmer
+	defer func(dc DualControlConfig) { config.DualControl = dc }(config.DualControl)
+	config.DualControl = DualControlConfig{
+		Roles:   []string{"root"},
+		Devices: []DualControlDevice{{Serial: "1", Slot: "9c"}, {Serial: "2", Slot: "9c"}},
+	}
+	require.NoError(t, config.DualControl.validate())
+
+	require.NoError(t, confirmDualControl(nil, "targets", yubikey.Secret("")))
+	require.NoError(t, confirmDualControl(nil, "root", yubikey.Secret("123456")))
+	require.Equal(t, []string{"1", "2"}, confirmer.confirmed)
+
+	// the client learns that its PIN was wrong, not that the policy denied it
+	err := confirmDualControl(nil, "root", yubikey.Secret("000000"))
+	require.Equal(t, yubikey.ErrCodeWrongPin, yubikey.ErrorCodeOf(err))
+	require.Contains(t, err.Error(), "yubikey 1")
+
+	config.DualControl.Devices[1].Serial = "broken"
+	err = confirmDualControl(nil, "root", yubikey.Secret("123456"))
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(err))
+}
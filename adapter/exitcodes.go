@@ -0,0 +1,71 @@
+package adapter
+
+import (
+	"fmt"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+// Exit codes of the commands, so scripts can branch on the kind of failure
+const (
+	exitOK           = 0
+	exitFailure      = 1
+	exitUsage        = 2
+	exitNoDaemon     = 3
+	exitNoToken      = 4
+	exitPinLocked    = 5
+	exitWrongPin     = 6
+	exitKeyNotFound  = 7
+	exitPolicyDenied = 8
+	exitSlotOccupied = 9
+	exitTouchTimeout = 10
+	exitNoSlot       = 11
+	exitInvalidInput = 12
+	exitMaintenance  = 13
+)
+
+// exitCodes maps the error codes of the daemon onto exit codes
+var exitCodes = map[yubikey.ErrorCode]int{
+	yubikey.ErrCodeNoToken:        exitNoToken,
+	yubikey.ErrCodePinLocked:      exitPinLocked,
+	yubikey.ErrCodeWrongPin:       exitWrongPin,
+	yubikey.ErrCodeKeyNotFound:    exitKeyNotFound,
+	yubikey.ErrCodePolicyDenied:   exitPolicyDenied,
+	yubikey.ErrCodeSlotOccupied:   exitSlotOccupied,
+	yubikey.ErrCodeTouchTimeout:   exitTouchTimeout,
+	yubikey.ErrCodeNoSlot:         exitNoSlot,
+	yubikey.ErrCodeInvalidRequest: exitInvalidInput,
+	yubikey.ErrCodeMaintenance:    exitMaintenance,
+}
+
+// usageError is returned by commands called with invalid arguments
+type usageError string
+
+func (u usageError) Error() string {
+	return fmt.Sprintf("usage: %s", string(u))
+}
+
+// daemonNotRunning is returned if the socket of the daemon can not be reached
+type daemonNotRunning struct {
+	err error
+}
+
+func (d daemonNotRunning) Error() string {
+	return fmt.Sprintf("could not connect to the daemon: %v", d.err)
+}
+
+// exitCode returns the exit code for the error a command failed with
+func exitCode(err error) int {
+	switch err.(type) {
+	case nil:
+		return exitOK
+	case usageError:
+		return exitUsage
+	case daemonNotRunning:
+		return exitNoDaemon
+	}
+	if code, ok := exitCodes[yubikey.ErrorCodeOf(err)]; ok {
+		return code
+	}
+	return exitFailure
+}
@@ -0,0 +1,24 @@
+package adapter
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExitCode(t *testing.T) {
+	require.Equal(t, exitOK, exitCode(nil))
+	require.Equal(t, exitUsage, exitCode(usageError(statusUsage)))
+	require.Equal(t, exitNoDaemon, exitCode(daemonNotRunning{syscall.ENOENT}))
+	require.Equal(t, exitFailure, exitCode(errors.New("boom")))
+
+	// errors returned by an rpc client only carry the message
+	locked := errors.New(yubikey.NewError(yubikey.ErrCodePinLocked, "PIN blocked").Error())
+	require.Equal(t, exitPinLocked, exitCode(locked))
+	require.Equal(t, exitPolicyDenied, exitCode(yubikey.NewError(yubikey.ErrCodePolicyDenied, "no")))
+	require.Equal(t, exitMaintenance, exitCode(yubikey.NewError(yubikey.ErrCodeMaintenance, "later")))
+	require.Equal(t, exitFailure, exitCode(yubikey.NewError(yubikey.ErrCodeUnknown, "?")))
+}
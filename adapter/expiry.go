@@ -0,0 +1,146 @@
+package adapter
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/sirupsen/logrus"
+)
+
+// certExpiryInterval is how often the daemon checks the certificates on the token
+const certExpiryInterval = 12 * time.Hour
+
+// certExpiryWindow is set with -cert-expiry-warning
+var certExpiryWindow time.Duration
+
+// keyTimes holds a time per key ID, e.g. the NotAfter of the certificates
+// last seen on the token
+type keyTimes struct {
+	sync.Mutex
+	times map[string]time.Time
+}
+
+var (
+	certExpiries = &keyTimes{times: make(map[string]time.Time)}
+	keysCreated  = &keyTimes{times: make(map[string]time.Time)}
+)
+
+// set replaces the known times
+func (k *keyTimes) set(times map[string]time.Time) {
+	k.Lock()
+	defer k.Unlock()
+	k.times = times
+}
+
+// add sets the time of a single key until the times are replaced
+func (k *keyTimes) add(keyID string, t time.Time) {
+	k.Lock()
+	defer k.Unlock()
+	k.times[keyID] = t
+}
+
+// get returns the time of a key, it is zero if the key is unknown
+func (k *keyTimes) get(keyID string) time.Time {
+	k.Lock()
+	defer k.Unlock()
+	return k.times[keyID]
+}
+
+// snapshot returns a copy of the known times
+func (k *keyTimes) snapshot() map[string]time.Time {
+	k.Lock()
+	defer k.Unlock()
+	times := make(map[string]time.Time, len(k.times))
+	for keyID, t := range k.times {
+		times[keyID] = t
+	}
+	return times
+}
+
+// updateCertExpiry replaces the known certificates and warns about the ones
+// which expire within the window
+func updateCertExpiry(notAfter map[string]time.Time) {
+	certExpiries.set(notAfter)
+	now := time.Now()
+	for _, keyID := range expiringKeys(notAfter, now, certExpiryWindow) {
+		if now.After(notAfter[keyID]) {
+			logrus.Warnf("The certificate of key %s expired at %s, its role can no longer be detected", keyID, notAfter[keyID].Format(time.RFC3339))
+			continue
+		}
+		logrus.Warnf("The certificate of key %s expires at %s, renew it before its role can no longer be detected", keyID, notAfter[keyID].Format(time.RFC3339))
+	}
+}
+
+// expiringKeys returns the sorted IDs of the keys whose certificate expires
+// before now+window, including those that already expired
+func expiringKeys(notAfter map[string]time.Time, now time.Time, window time.Duration) []string {
+	var keyIDs []string
+	for keyID, t := range notAfter {
+		if t.Before(now.Add(window)) {
+			keyIDs = append(keyIDs, keyID)
+		}
+	}
+	sort.Strings(keyIDs)
+	return keyIDs
+}
+
+// checkCertExpiry reads the certificate expiry and the creation time of the
+// keys from the token, if the backend knows them
+func checkCertExpiry() {
+	expirer, isExpirer := ks.(backend.CertExpirer)
+	ager, isAger := ks.(backend.KeyAger)
+	if !isExpirer && !isAger {
+		return
+	}
+	session, err := ks.SetupHSMEnv()
+	if err != nil {
+		logrus.Debugf("Could not check certificate expiry: %v", err)
+		return
+	}
+	defer ks.CloseSession(session)
+	if isExpirer {
+		notAfter, err := expirer.CertExpiry(session)
+		if err != nil {
+			logrus.Debugf("Could not check certificate expiry: %v", err)
+		} else {
+			updateCertExpiry(notAfter)
+		}
+	}
+	if isAger {
+		created, err := ager.KeyCreated(session)
+		if err != nil {
+			logrus.Debugf("Could not check the age of the keys: %v", err)
+		} else {
+			keysCreated.set(created)
+		}
+	}
+}
+
+// watchCertExpiry checks the certificates now and then every interval
+func watchCertExpiry(interval time.Duration) {
+	for {
+		checkCertExpiry()
+		time.Sleep(interval)
+	}
+}
+
+// writeExpiryMetrics writes the certificate metrics in the Prometheus text format
+func writeExpiryMetrics(w io.Writer, notAfter map[string]time.Time, now time.Time, window time.Duration) {
+	keyIDs := make([]string, 0, len(notAfter))
+	for keyID := range notAfter {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Strings(keyIDs)
+	name := "notary_yubikey_cert_not_after_timestamp_seconds"
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, "Unix time the certificate of a key expires, by key.", name)
+	for _, keyID := range keyIDs {
+		fmt.Fprintf(w, "%s{key_id=\"%s\"} %d\n", name, labelValue(keyID), notAfter[keyID].Unix())
+	}
+	name = "notary_yubikey_certs_expiring"
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, "Certificates expired or expiring within the -cert-expiry-warning window.", name)
+	fmt.Fprintf(w, "%s %d\n", name, len(expiringKeys(notAfter, now, window)))
+}
@@ -0,0 +1,25 @@
+package adapter
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiringKeys(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := map[string]time.Time{
+		"valid":    now.AddDate(1, 0, 0),
+		"expiring": now.AddDate(0, 0, 10),
+		"expired":  now.AddDate(0, 0, -1),
+	}
+	require.Equal(t, []string{"expired", "expiring"}, expiringKeys(notAfter, now, 30*24*time.Hour))
+	require.Equal(t, []string{"expired"}, expiringKeys(notAfter, now, 0))
+
+	var buf bytes.Buffer
+	writeExpiryMetrics(&buf, notAfter, now, 30*24*time.Hour)
+	require.Contains(t, buf.String(), `notary_yubikey_cert_not_after_timestamp_seconds{key_id="expired"} 1577750400`)
+	require.Contains(t, buf.String(), "notary_yubikey_certs_expiring 2\n")
+}
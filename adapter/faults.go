@@ -0,0 +1,239 @@
+package adapter
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/sirupsen/logrus"
+)
+
+const faultsUsage = "faults inject <code> [count] [method] | list | clear"
+
+// injectableCodes are the error codes faults can be injected with
+var injectableCodes = map[yubikey.ErrorCode]bool{
+	yubikey.ErrCodeUnknown:        true,
+	yubikey.ErrCodeNoToken:        true,
+	yubikey.ErrCodeWrongPin:       true,
+	yubikey.ErrCodePinLocked:      true,
+	yubikey.ErrCodeTouchTimeout:   true,
+	yubikey.ErrCodeKeyNotFound:    true,
+	yubikey.ErrCodeNoSlot:         true,
+	yubikey.ErrCodeSlotOccupied:   true,
+	yubikey.ErrCodeInvalidRequest: true,
+	yubikey.ErrCodeDevice:         true,
+	yubikey.ErrCodePolicyDenied:   true,
+	yubikey.ErrCodeMaintenance:    true,
+}
+
+// PendingFault makes the next Remaining RPCs of ESServer named Method fail
+// with Code, the next ones of any method if Method is empty
+type PendingFault struct {
+	Method    string
+	Code      string
+	Remaining int
+}
+
+// faultInjection is the value of the hidden -fault-injection flag, without it
+// the faults command is refused
+var faultInjection bool
+
+// faultQueue holds the faults operators injected over the admin socket if
+// the daemon was started with -fault-injection. Unlike -chaos they fail
+// exactly the requests they were told to, so integration tests of clients
+// are reproducible
+type faultQueue struct {
+	sync.Mutex
+	pending []PendingFault
+}
+
+var faults = &faultQueue{}
+
+func (q *faultQueue) inject(f PendingFault) {
+	q.Lock()
+	defer q.Unlock()
+	q.pending = append(q.pending, f)
+}
+
+func (q *faultQueue) list() []PendingFault {
+	q.Lock()
+	defer q.Unlock()
+	return append([]PendingFault(nil), q.pending...)
+}
+
+func (q *faultQueue) clear() int {
+	q.Lock()
+	defer q.Unlock()
+	n := len(q.pending)
+	q.pending = nil
+	return n
+}
+
+// next returns the error the RPC serviceMethod is to fail with, if any. The
+// first fault matching the method is used up by one
+func (q *faultQueue) next(serviceMethod string) error {
+	if !strings.HasPrefix(serviceMethod, "ESServer.") {
+		return nil
+	}
+	method := strings.TrimPrefix(serviceMethod, "ESServer.")
+	q.Lock()
+	defer q.Unlock()
+	for i := range q.pending {
+		if q.pending[i].Method != "" && q.pending[i].Method != method {
+			continue
+		}
+		q.pending[i].Remaining--
+		f := q.pending[i]
+		if f.Remaining == 0 {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+		}
+		logrus.Warnf("Failing %s with the injected fault %s, %d more to go", serviceMethod, f.Code, f.Remaining)
+		return yubikey.NewError(yubikey.ErrorCode(f.Code), "injected fault, %d more to go", f.Remaining)
+	}
+	return nil
+}
+
+type InjectFaultReq struct {
+	// Method is the name of an RPC of ESServer, e.g. Sign, or empty for all
+	Method string
+	Code   string
+	Count  int
+}
+
+type InjectFaultRes struct {
+	Pending []PendingFault
+}
+
+type ListFaultsReq struct {
+}
+
+type ListFaultsRes struct {
+	Pending []PendingFault
+}
+
+type ClearFaultsReq struct {
+}
+
+type ClearFaultsRes struct {
+	Cleared int
+}
+
+// InjectFault makes the next RPCs fail with an error code of choice
+func (s *AdminServer) InjectFault(req InjectFaultReq, res *InjectFaultRes) error {
+	f := PendingFault{Method: req.Method, Code: req.Code, Remaining: req.Count}
+	var err error
+	if !faultInjection {
+		err = yubikey.NewError(yubikey.ErrCodeInvalidRequest, "fault injection is disabled, start the daemon with -fault-injection")
+	} else if !injectableCodes[yubikey.ErrorCode(req.Code)] {
+		err = yubikey.NewError(yubikey.ErrCodeInvalidRequest, "unknown error code %q", req.Code)
+	} else if req.Count < 1 {
+		err = yubikey.NewError(yubikey.ErrCodeInvalidRequest, "count has to be positive")
+	} else if req.Method != "" && !esMethods()[req.Method] {
+		err = yubikey.NewError(yubikey.ErrCodeInvalidRequest, "ESServer has no method %q", req.Method)
+	}
+	audit("inject_fault", s.peer, logrus.Fields{"method": req.Method, "code": req.Code, "count": req.Count}, err)
+	if err != nil {
+		return rpcError(err)
+	}
+	faults.inject(f)
+	res.Pending = faults.list()
+	return nil
+}
+
+// ListFaults returns the injected faults which did not fail all their RPCs yet
+func (s *AdminServer) ListFaults(req ListFaultsReq, res *ListFaultsRes) error {
+	res.Pending = faults.list()
+	return nil
+}
+
+// ClearFaults drops all injected faults
+func (s *AdminServer) ClearFaults(req ClearFaultsReq, res *ClearFaultsRes) error {
+	res.Cleared = faults.clear()
+	audit("clear_faults", s.peer, logrus.Fields{"cleared": res.Cleared}, nil)
+	return nil
+}
+
+// esMethods returns the names of the RPCs of ESServer
+func esMethods() map[string]bool {
+	methods := make(map[string]bool)
+	server := reflect.TypeOf(&ESServer{})
+	for i := 0; i < server.NumMethod(); i++ {
+		if method := server.Method(i); method.Type.NumIn() == 3 && method.Type.NumOut() == 1 {
+			methods[method.Name] = true
+		}
+	}
+	return methods
+}
+
+func faultsCommand(args []string) error {
+	if len(args) < 1 {
+		return usageError(faultsUsage)
+	}
+	switch args[0] {
+	case "inject":
+		if len(args) < 2 || len(args) > 4 {
+			return usageError(faultsUsage)
+		}
+		req := InjectFaultReq{Code: strings.ToUpper(args[1]), Count: 1}
+		if len(args) > 2 {
+			count, err := strconv.Atoi(args[2])
+			if err != nil {
+				return usageError(faultsUsage)
+			}
+			req.Count = count
+		}
+		if len(args) > 3 {
+			req.Method = args[3]
+		}
+		res := new(InjectFaultRes)
+		if err := adminCall("InjectFault", req, res); err != nil {
+			return err
+		}
+		return printFaults(res.Pending)
+	case "list":
+		if len(args) != 1 {
+			return usageError(faultsUsage)
+		}
+		res := new(ListFaultsRes)
+		if err := adminCall("ListFaults", ListFaultsReq{}, res); err != nil {
+			return err
+		}
+		return printFaults(res.Pending)
+	case "clear":
+		if len(args) != 1 {
+			return usageError(faultsUsage)
+		}
+		res := new(ClearFaultsRes)
+		if err := adminCall("ClearFaults", ClearFaultsReq{}, res); err != nil {
+			return err
+		}
+		if jsonOutput() {
+			return printJSON(res)
+		}
+		fmt.Printf("cleared %d faults\n", res.Cleared)
+		return nil
+	default:
+		return usageError(faultsUsage)
+	}
+}
+
+func printFaults(pending []PendingFault) error {
+	if jsonOutput() {
+		return printJSON(pending)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "METHOD\tCODE\tREMAINING")
+	for _, f := range pending {
+		method := f.Method
+		if method == "" {
+			method = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\n", method, f.Code, f.Remaining)
+	}
+	return w.Flush()
+}
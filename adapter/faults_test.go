@@ -0,0 +1,87 @@
+package adapter
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultQueue(t *testing.T) {
+	q := &faultQueue{}
+	require.NoError(t, q.next("ESServer.Sign"))
+
+	q.inject(PendingFault{Method: "Sign", Code: string(yubikey.ErrCodeTouchTimeout), Remaining: 2})
+	q.inject(PendingFault{Code: string(yubikey.ErrCodeNoToken), Remaining: 1})
+	// admin RPCs are never failed
+	require.NoError(t, q.next("Admin.Status"))
+
+	err := q.next("ESServer.HardwareListKeys")
+	require.Equal(t, yubikey.ErrCodeNoToken, yubikey.ErrorCodeOf(err))
+	require.NoError(t, q.next("ESServer.HardwareListKeys"))
+	err = q.next("ESServer.Sign")
+	require.Equal(t, yubikey.ErrCodeTouchTimeout, yubikey.ErrorCodeOf(err))
+	require.Contains(t, err.Error(), "1 more to go")
+	require.Equal(t, []PendingFault{{Method: "Sign", Code: string(yubikey.ErrCodeTouchTimeout), Remaining: 1}}, q.list())
+	require.Error(t, q.next("ESServer.Sign"))
+	require.NoError(t, q.next("ESServer.Sign"))
+	require.Empty(t, q.list())
+
+	q.inject(PendingFault{Code: string(yubikey.ErrCodeDevice), Remaining: 5})
+	require.Equal(t, 1, q.clear())
+	require.NoError(t, q.next("ESServer.Sign"))
+}
+
+func TestInjectFault(t *testing.T) {
+	defer faults.clear()
+	s := &AdminServer{}
+	// faults are only injected if the daemon was told to
+	err := s.InjectFault(InjectFaultReq{Code: string(yubikey.ErrCodeWrongPin), Count: 1}, new(InjectFaultRes))
+	require.Equal(t, yubikey.ErrCodeInvalidRequest, yubikey.ErrorCodeOf(err))
+	require.Empty(t, faults.list())
+	faultInjection = true
+	defer func() { faultInjection = false }()
+
+	for _, req := range []InjectFaultReq{
+		{Code: "BROKEN", Count: 1},
+		{Code: string(yubikey.ErrCodeWrongPin), Count: 0},
+		{Method: "Unsign", Code: string(yubikey.ErrCodeWrongPin), Count: 1},
+	} {
+		err := s.InjectFault(req, new(InjectFaultRes))
+		require.Equal(t, yubikey.ErrCodeInvalidRequest, yubikey.ErrorCodeOf(err), "%+v", req)
+	}
+	require.Empty(t, faults.list())
+
+	res := new(InjectFaultRes)
+	require.NoError(t, s.InjectFault(InjectFaultReq{Method: "SetupHSMEnv", Code: string(yubikey.ErrCodeWrongPin), Count: 2}, res))
+	require.Equal(t, []PendingFault{{Method: "SetupHSMEnv", Code: string(yubikey.ErrCodeWrongPin), Remaining: 2}}, res.Pending)
+
+	defer func(old backend.Backend) { ks = old }(ks)
+	ks = &closingBackend{}
+	serverConn, clientConn := net.Pipe()
+	served := make(chan struct{})
+	go func() {
+		ServeConn(serverConn)
+		close(served)
+	}()
+	client := rpc.NewClient(clientConn)
+	// the connection keeps serving after an injected fault
+	setup := new(wire.ESSetupHSMEnvRes)
+	for i := 0; i < 2; i++ {
+		err := client.Call("ESServer.SetupHSMEnv", wire.ESSetupHSMEnvReq{}, setup)
+		require.Equal(t, yubikey.ErrCodeWrongPin, yubikey.ErrorCodeOf(err))
+		require.Contains(t, err.Error(), "injected fault")
+	}
+	require.NoError(t, client.Call("ESServer.SetupHSMEnv", wire.ESSetupHSMEnvReq{}, setup))
+	require.Equal(t, uint(7), setup.Session)
+	client.Close()
+	<-served
+
+	list := new(ListFaultsRes)
+	require.NoError(t, s.ListFaults(ListFaultsReq{}, list))
+	require.Empty(t, list.Pending)
+}
@@ -0,0 +1,122 @@
+package adapter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// shortKeyIDLength is the length of short key IDs, as docker trust prints them
+const shortKeyIDLength = 12
+
+// keyFingerprint identifies a key the same way in all outputs: by its
+// notary key ID, as printed by notary key list, a short form of it and the
+// SHA-256 of the DER encoded public key, which tools outside of notary show
+type keyFingerprint struct {
+	KeyID           string `json:"key_id"`
+	ShortID         string `json:"short_id"`
+	PublicKeySHA256 string `json:"public_key_sha256,omitempty"`
+}
+
+// newKeyFingerprint describes keyID, pubHash is empty if the public key is unknown
+func newKeyFingerprint(keyID, pubHash string) keyFingerprint {
+	return keyFingerprint{KeyID: keyID, ShortID: shortKeyID(keyID), PublicKeySHA256: pubHash}
+}
+
+func (f keyFingerprint) String() string {
+	if f.PublicKeySHA256 == "" {
+		return f.KeyID
+	}
+	return fmt.Sprintf("%s (%s)", f.KeyID, f.PublicKeySHA256)
+}
+
+func shortKeyID(keyID string) string {
+	if len(keyID) <= shortKeyIDLength {
+		return keyID
+	}
+	return keyID[:shortKeyIDLength]
+}
+
+// publicKeySHA256 formats the fingerprint of a DER encoded public key
+func publicKeySHA256(der []byte) string {
+	sum := sha256.Sum256(der)
+	return "SHA256:" + hex.EncodeToString(sum[:])
+}
+
+// describeKey names a key in log and error messages
+func describeKey(keyID string) string {
+	return newKeyFingerprint(keyID, publicKeyHashes.get(keyID)).String()
+}
+
+// keyHashes remembers the public key fingerprints of the keys seen on the
+// tokens, so outputs without access to the token can show them
+type keyHashes struct {
+	sync.Mutex
+	byID map[string]string
+}
+
+var publicKeyHashes = &keyHashes{byID: make(map[string]string)}
+
+func (h *keyHashes) set(keyID, fingerprint string) {
+	h.Lock()
+	defer h.Unlock()
+	h.byID[keyID] = fingerprint
+}
+
+func (h *keyHashes) get(keyID string) string {
+	h.Lock()
+	defer h.Unlock()
+	return h.byID[keyID]
+}
+
+func (h *keyHashes) snapshot() map[string]string {
+	h.Lock()
+	defer h.Unlock()
+	byID := make(map[string]string, len(h.byID))
+	for keyID, fingerprint := range h.byID {
+		byID[keyID] = fingerprint
+	}
+	return byID
+}
+
+// keyFingerprints returns the public key fingerprints of the listed keys.
+// A key ID is derived from the public key, so every fingerprint is only
+// computed once, from the public key the listing of all devices returned or
+// else read from the device of the session if the key is stored there
+func keyFingerprints(session pkcs11.SessionHandle, keys, sessionKeys map[string]common.HardwareSlot, all []backend.TokenKey) map[string]string {
+	listed := make(map[string][]byte)
+	for _, k := range all {
+		if k.PublicKey != nil {
+			listed[k.KeyID] = k.PublicKey
+		}
+	}
+	fingerprints := make(map[string]string, len(keys))
+	for keyID := range keys {
+		if fingerprint := publicKeyHashes.get(keyID); fingerprint != "" {
+			fingerprints[keyID] = fingerprint
+			continue
+		}
+		der, ok := listed[keyID]
+		if slot, onSession := sessionKeys[keyID]; !ok && onSession {
+			pubKey, _, err := ks.GetECDSAKey(session, slot, "")
+			if err != nil {
+				logrus.Warnf("Failed to read the public key of %s for its fingerprint: %v", keyID, err)
+				continue
+			}
+			der, ok = pubKey.Public(), true
+		}
+		if !ok {
+			logrus.Debugf("The public key of %s is unknown, it is listed without fingerprint", keyID)
+			continue
+		}
+		fingerprints[keyID] = publicKeySHA256(der)
+		publicKeyHashes.set(keyID, fingerprints[keyID])
+	}
+	return fingerprints
+}
@@ -0,0 +1,64 @@
+package adapter
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+func TestKeyFingerprint(t *testing.T) {
+	keyID := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	fp := newKeyFingerprint(keyID, publicKeySHA256([]byte("public key")))
+	require.Equal(t, "0123456789ab", fp.ShortID)
+	require.True(t, strings.HasPrefix(fp.PublicKeySHA256, "SHA256:"))
+	require.Len(t, fp.PublicKeySHA256, len("SHA256:")+64)
+	require.Equal(t, keyID+" ("+fp.PublicKeySHA256+")", fp.String())
+
+	out, err := json.Marshal(keyListing{keyFingerprint: newKeyFingerprint("abc", ""), Role: "root", Slot: "9c"})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"key_id": "abc", "short_id": "abc", "role": "root", "slot": "9c"}`, string(out))
+}
+
+// keyReadingBackend counts the public keys read from the device
+type keyReadingBackend struct {
+	*sessionBackend
+	reads int
+}
+
+func (b *keyReadingBackend) GetECDSAKey(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string) (*data.ECDSAPublicKey, data.RoleName, error) {
+	b.reads++
+	return data.NewECDSAPublicKey([]byte("session key")), data.CanonicalRootRole, nil
+}
+
+func TestKeyFingerprints(t *testing.T) {
+	reader := &keyReadingBackend{sessionBackend: &sessionBackend{using: make(map[pkcs11.SessionHandle]int)}}
+	defer func(old backend.Backend) { ks = old }(ks)
+	ks = reader
+	defer func(old *keyHashes) { publicKeyHashes = old }(publicKeyHashes)
+	publicKeyHashes = &keyHashes{byID: make(map[string]string)}
+
+	sessionKeys := map[string]common.HardwareSlot{"a": {Role: data.CanonicalRootRole, SlotID: []byte{2}}}
+	keys := map[string]common.HardwareSlot{
+		"a": sessionKeys["a"],
+		"b": {Role: data.CanonicalTargetsRole, SlotID: []byte{3}},
+		"c": {Role: data.CanonicalSnapshotRole, SlotID: []byte{4}},
+	}
+	all := []backend.TokenKey{
+		{KeyID: "b", Serial: "222", Slot: keys["b"], PublicKey: []byte("other key")},
+		{KeyID: "c", Serial: "222", Slot: keys["c"]},
+	}
+	want := map[string]string{"a": publicKeySHA256([]byte("session key")), "b": publicKeySHA256([]byte("other key"))}
+	require.Equal(t, want, keyFingerprints(1, keys, sessionKeys, all))
+	require.Equal(t, 1, reader.reads)
+
+	// the fingerprints are kept, the next listing reads nothing
+	require.Equal(t, want, keyFingerprints(1, keys, sessionKeys, nil))
+	require.Equal(t, 1, reader.reads)
+	require.Equal(t, want["b"], publicKeyHashes.get("b"))
+}
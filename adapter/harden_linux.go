@@ -0,0 +1,31 @@
+// +build linux
+
+package adapter
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+const prSetDumpable = 4
+
+// harden keeps key material and PINs from being read out of a core file or
+// through /proc by other users. If lockMemory is set all pages of the
+// process are locked into memory, so secrets never reach the swap
+func harden(lockMemory bool) error {
+	if err := syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{}); err != nil {
+		return fmt.Errorf("could not disable core dumps: %v", err)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetDumpable, 0, 0); errno != 0 {
+		return fmt.Errorf("could not clear the dumpable flag: %v", errno)
+	}
+	if lockMemory {
+		if err := syscall.Mlockall(syscall.MCL_CURRENT | syscall.MCL_FUTURE); err != nil {
+			return fmt.Errorf("could not lock memory: %v", err)
+		}
+	}
+	logrus.Debugf("Process hardened, memory locked: %v", lockMemory)
+	return nil
+}
@@ -0,0 +1,18 @@
+// +build !linux
+
+package adapter
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// harden is only implemented on linux
+func harden(lockMemory bool) error {
+	if lockMemory {
+		return fmt.Errorf("locking memory is only supported on linux")
+	}
+	logrus.Warnf("Process hardening is only supported on linux")
+	return nil
+}
@@ -0,0 +1,78 @@
+package adapter
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+)
+
+const healthcheckUsage = "healthcheck [-timeout <duration>]"
+
+type healthcheckJSON struct {
+	SchemaVersion int    `json:"schema_version"`
+	OK            bool   `json:"ok"`
+	Backend       string `json:"backend,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// unhealthy is returned by healthcheck, it always exits with 1 as probes
+// only tell success from failure
+type unhealthy struct {
+	err error
+}
+
+func (u unhealthy) Error() string {
+	return fmt.Sprintf("unhealthy: %v", u.err)
+}
+
+// checkHealth asks the daemon for the name of its backend. The call does
+// not touch the token, so probes never compete with signing for it
+func checkHealth(socket string, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("unix", socket, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	client := wire.NewClient(conn)
+	res := new(wire.ESNameRes)
+	if err := client.Call("ESServer.Name", wire.ESNameReq{}, res); err != nil {
+		return "", err
+	}
+	if res.Name == "" {
+		return "", fmt.Errorf("daemon serves no backend")
+	}
+	return res.Name, nil
+}
+
+// healthcheckCommand is meant for container probes, e.g. Docker HEALTHCHECK
+// or a Kubernetes exec probe. It exits with 0 if the daemon answers and 1
+// otherwise
+func healthcheckCommand(args []string) error {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 5*time.Second, "Time the daemon has to answer")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *timeout <= 0 {
+		return usageError(healthcheckUsage)
+	}
+
+	name, err := checkHealth(Socket, *timeout)
+	if jsonOutput() {
+		out := healthcheckJSON{SchemaVersion: statusSchemaVersion, OK: err == nil, Backend: name}
+		if err != nil {
+			out.Error = err.Error()
+		}
+		if perr := printJSON(out); perr != nil && err == nil {
+			err = perr
+		}
+	} else if err == nil {
+		fmt.Printf("healthy, serving backend %s\n", name)
+	}
+	if err != nil {
+		return unhealthy{err}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package adapter
+
+import (
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/stretchr/testify/require"
+)
+
+type nameServer struct{}
+
+func (nameServer) Name(req wire.ESNameReq, res *wire.ESNameRes) error {
+	res.Name = "yubikey"
+	return nil
+}
+
+func TestCheckHealth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "healthcheck")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, SocketName)
+
+	_, err = checkHealth(socket, time.Second)
+	require.Error(t, err)
+	require.Equal(t, exitFailure, exitCode(unhealthy{err}))
+
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer listener.Close()
+	server := rpc.NewServer()
+	require.NoError(t, server.RegisterName("ESServer", nameServer{}))
+	go server.Accept(listener)
+
+	name, err := checkHealth(socket, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "yubikey", name)
+}
@@ -0,0 +1,76 @@
+package adapter
+
+import (
+	"sync"
+	"time"
+)
+
+// idleTimeout closes client connections which sent no request for this
+// long, 0 keeps them open until the client closes them
+var idleTimeout time.Duration
+
+// idleWatch calls onIdle once a connection served no request for the
+// timeout. Requests in flight keep the connection open, e.g. a signature
+// waiting for an approval
+type idleWatch struct {
+	sync.Mutex
+	timeout time.Duration
+	timer   *time.Timer
+	busy    int
+	stopped bool
+}
+
+// watchIdle starts watching a connection, it returns nil if timeout is not
+// positive. The methods of a nil idleWatch do nothing
+func watchIdle(timeout time.Duration, onIdle func()) *idleWatch {
+	if timeout <= 0 {
+		return nil
+	}
+	w := &idleWatch{timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		w.Lock()
+		idle := w.busy == 0 && !w.stopped
+		w.stopped = w.stopped || idle
+		w.Unlock()
+		if idle {
+			onIdle()
+		}
+	})
+	return w
+}
+
+// begin is called when a request is received
+func (w *idleWatch) begin() {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.busy++
+	w.timer.Stop()
+}
+
+// end is called when a response is sent, the idle time starts with the
+// last one
+func (w *idleWatch) end() {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.busy--
+	if w.busy == 0 && !w.stopped {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+// stop ends watching a connection which was closed
+func (w *idleWatch) stop() {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.stopped = true
+	w.timer.Stop()
+}
@@ -0,0 +1,100 @@
+package adapter
+
+import (
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdleWatch(t *testing.T) {
+	require.Nil(t, watchIdle(0, nil))
+	// a nil watch is a no-op
+	var none *idleWatch
+	none.begin()
+	none.end()
+	none.stop()
+
+	idle := make(chan struct{}, 1)
+	w := watchIdle(20*time.Millisecond, func() { idle <- struct{}{} })
+	w.begin()
+	select {
+	case <-idle:
+		t.Fatal("closed while a request was in flight")
+	case <-time.After(60 * time.Millisecond):
+	}
+	w.end()
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		t.Fatal("not closed after the timeout")
+	}
+
+	w = watchIdle(20*time.Millisecond, func() { idle <- struct{}{} })
+	w.stop()
+	select {
+	case <-idle:
+		t.Fatal("closed after it was stopped")
+	case <-time.After(60 * time.Millisecond):
+	}
+}
+
+// closingBackend hands out sessions and records which ones were closed
+type closingBackend struct {
+	backend.Backend
+	sync.Mutex
+	closed []pkcs11.SessionHandle
+}
+
+func (b *closingBackend) SetupHSMEnv() (pkcs11.SessionHandle, error) {
+	return 7, nil
+}
+
+func (b *closingBackend) CloseSession(session pkcs11.SessionHandle) {
+	b.Lock()
+	defer b.Unlock()
+	b.closed = append(b.closed, session)
+}
+
+func (b *closingBackend) closedSessions() []pkcs11.SessionHandle {
+	b.Lock()
+	defer b.Unlock()
+	return append([]pkcs11.SessionHandle(nil), b.closed...)
+}
+
+func TestIdleConnectionClosesSessions(t *testing.T) {
+	defer func(old backend.Backend, timeout time.Duration) { ks, idleTimeout = old, timeout }(ks, idleTimeout)
+	fake := &closingBackend{}
+	ks = fake
+	idleTimeout = 50 * time.Millisecond
+
+	serverConn, clientConn := net.Pipe()
+	served := make(chan struct{})
+	go func() {
+		ServeConn(serverConn)
+		close(served)
+	}()
+	client := rpc.NewClient(clientConn)
+	defer client.Close()
+	setup := new(wire.ESSetupHSMEnvRes)
+	require.NoError(t, client.Call("ESServer.SetupHSMEnv", wire.ESSetupHSMEnvReq{}, setup))
+	require.Equal(t, uint(7), setup.Session)
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("the idle connection was not closed")
+	}
+	require.Equal(t, []pkcs11.SessionHandle{7}, fake.closedSessions())
+	openSessions.Lock()
+	_, open := openSessions.sessions[7]
+	openSessions.Unlock()
+	require.False(t, open)
+	require.Error(t, client.Call("ESServer.SetupHSMEnv", wire.ESSetupHSMEnvReq{}, setup))
+}
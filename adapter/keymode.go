@@ -0,0 +1,147 @@
+package adapter
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/sirupsen/logrus"
+)
+
+const keymodeUsage = "keymode get | set [-pin none|once|always] [-touch]"
+
+// parseKeymode combines a pin mode and the touch requirement into a yubikey keymode
+func parseKeymode(pin string, touch bool) (int, error) {
+	var mode int
+	switch pin {
+	case "none":
+		mode = yubikey.KEYMODE_NONE
+	case "once":
+		mode = yubikey.KEYMODE_PIN_ONCE
+	case "always":
+		mode = yubikey.KEYMODE_PIN_ALWAYS
+	default:
+		return 0, fmt.Errorf("invalid pin mode '%s'", pin)
+	}
+	if touch {
+		mode = mode | yubikey.KEYMODE_TOUCH
+	}
+	return mode, nil
+}
+
+// formatKeymode is the inverse of parseKeymode
+func formatKeymode(mode int) string {
+	pin := "none"
+	switch {
+	case mode&yubikey.KEYMODE_PIN_ALWAYS != 0:
+		pin = "always"
+	case mode&yubikey.KEYMODE_PIN_ONCE != 0:
+		pin = "once"
+	}
+	return fmt.Sprintf("pin=%s touch=%t", pin, mode&yubikey.KEYMODE_TOUCH != 0)
+}
+
+type GetKeymodeReq struct {
+}
+
+type GetKeymodeRes struct {
+	Keymode int
+}
+
+// SetKeymodeReq changes the pin mode unless Pin is empty, and the touch
+// requirement unless KeepTouch is set. Older clients always send both
+type SetKeymodeReq struct {
+	Pin       string
+	Touch     bool
+	KeepTouch bool
+}
+
+type SetKeymodeRes struct {
+	Keymode int
+}
+
+// GetKeymode returns the keymode used for future key imports
+func (s *AdminServer) GetKeymode(req GetKeymodeReq, res *GetKeymodeRes) error {
+	res.Keymode = yubikey.YubikeyKeyMode()
+	return nil
+}
+
+// keymodeChange serializes the changes of the keymode, each one keeps the
+// bits of the one before which it does not change
+var keymodeChange sync.Mutex
+
+// changeKeymode applies the changes of req to the keymode old, the bits the
+// request does not change are kept
+func changeKeymode(old int, req SetKeymodeReq) (int, error) {
+	mode := old
+	if req.Pin != "" {
+		pinMode, err := parseKeymode(req.Pin, false)
+		if err != nil {
+			return old, err
+		}
+		mode = mode&^(yubikey.KEYMODE_PIN_ONCE|yubikey.KEYMODE_PIN_ALWAYS) | pinMode
+	}
+	if !req.KeepTouch {
+		mode = mode &^ yubikey.KEYMODE_TOUCH
+		if req.Touch {
+			mode = mode | yubikey.KEYMODE_TOUCH
+		}
+	}
+	return mode, nil
+}
+
+// SetKeymode changes the keymode used for future key imports
+func (s *AdminServer) SetKeymode(req SetKeymodeReq, res *SetKeymodeRes) error {
+	keymodeChange.Lock()
+	defer keymodeChange.Unlock()
+	old := yubikey.YubikeyKeyMode()
+	mode, err := changeKeymode(old, req)
+	if err == nil {
+		err = yubikey.SetYubikeyKeyMode(mode)
+	}
+	audit("set_keymode", s.peer, logrus.Fields{"old": formatKeymode(old), "new": formatKeymode(mode)}, err)
+	if err != nil {
+		return rpcError(yubikey.WrapError(yubikey.ErrCodeInvalidRequest, err))
+	}
+	logrus.Infof("Keymode changed from %s to %s", formatKeymode(old), formatKeymode(mode))
+	res.Keymode = mode
+	return nil
+}
+
+func keymodeCommand(args []string) error {
+	if len(args) < 1 {
+		return usageError(keymodeUsage)
+	}
+	switch args[0] {
+	case "get":
+		res := new(GetKeymodeRes)
+		if err := adminCall("GetKeymode", GetKeymodeReq{}, res); err != nil {
+			return err
+		}
+		if jsonOutput() {
+			return printJSON(map[string]string{"keymode": formatKeymode(res.Keymode)})
+		}
+		fmt.Println(formatKeymode(res.Keymode))
+		return nil
+	case "set":
+		fs := flag.NewFlagSet("keymode set", flag.ExitOnError)
+		pin := fs.String("pin", "", "Set the mode for the Pin [none | once | always], unchanged if not given")
+		touch := fs.Bool("touch", false, "Requires to touch the yubikey to sign, unchanged if not given")
+		fs.Parse(args[1:])
+		req := SetKeymodeReq{Pin: *pin, Touch: *touch, KeepTouch: true}
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "touch" {
+				req.KeepTouch = false
+			}
+		})
+		res := new(SetKeymodeRes)
+		if err := adminCall("SetKeymode", req, res); err != nil {
+			return err
+		}
+		fmt.Println(formatKeymode(res.Keymode))
+		return nil
+	default:
+		return usageError(keymodeUsage)
+	}
+}
@@ -0,0 +1,34 @@
+package adapter
+
+import (
+	"testing"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeKeymode(t *testing.T) {
+	old := yubikey.KEYMODE_TOUCH | yubikey.KEYMODE_PIN_ONCE
+
+	// setting the pin mode keeps the touch requirement
+	mode, err := changeKeymode(old, SetKeymodeReq{Pin: "always", KeepTouch: true})
+	require.NoError(t, err)
+	require.Equal(t, yubikey.KEYMODE_TOUCH|yubikey.KEYMODE_PIN_ALWAYS, mode)
+
+	mode, err = changeKeymode(old, SetKeymodeReq{KeepTouch: true})
+	require.NoError(t, err)
+	require.Equal(t, old, mode)
+
+	mode, err = changeKeymode(old, SetKeymodeReq{Touch: false})
+	require.NoError(t, err)
+	require.Equal(t, yubikey.KEYMODE_PIN_ONCE, mode)
+
+	// older clients always send the pin mode and the touch requirement
+	mode, err = changeKeymode(old, SetKeymodeReq{Pin: "none", Touch: false})
+	require.NoError(t, err)
+	require.Equal(t, yubikey.KEYMODE_NONE, mode)
+
+	mode, err = changeKeymode(old, SetKeymodeReq{Pin: "sometimes", KeepTouch: true})
+	require.Error(t, err)
+	require.Equal(t, old, mode)
+}
@@ -0,0 +1,20 @@
+// +build darwin
+
+package adapter
+
+import (
+	"os/exec"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+// keyringLookup reads a generic password from the macOS Keychain. Store it
+// with security add-generic-password -s <service> -a <account> -w
+func keyringLookup(service, account string) (yubikey.SecureBytes, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w").Output()
+	defer yubikey.SecureBytes(out).Wipe()
+	if err != nil {
+		return nil, err
+	}
+	return firstLine(out), nil
+}
@@ -0,0 +1,21 @@
+// +build linux
+
+package adapter
+
+import (
+	"os/exec"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+// keyringLookup reads a secret from the Secret Service (gnome-keyring,
+// KWallet) using secret-tool. Store it with
+// secret-tool store --label=... service <service> account <account>
+func keyringLookup(service, account string) (yubikey.SecureBytes, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", service, "account", account).Output()
+	defer yubikey.SecureBytes(out).Wipe()
+	if err != nil {
+		return nil, err
+	}
+	return firstLine(out), nil
+}
@@ -0,0 +1,14 @@
+// +build !linux,!darwin,!windows
+
+package adapter
+
+import (
+	"fmt"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+// keyringLookup is only implemented on linux, macOS and windows
+func keyringLookup(service, account string) (yubikey.SecureBytes, error) {
+	return nil, fmt.Errorf("no keyring support on this platform")
+}
@@ -0,0 +1,63 @@
+// +build windows
+
+package adapter
+
+import (
+	"syscall"
+	"unicode/utf16"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+var (
+	advapi32     = syscall.NewLazyDLL("advapi32.dll")
+	procCredRead = advapi32.NewProc("CredReadW")
+	procCredFree = advapi32.NewProc("CredFree")
+)
+
+const credTypeGeneric = 1
+
+// credential mirrors CREDENTIALW, only the fields up to the blob are used
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+}
+
+// keyringLookup reads a generic credential named <service>:<account> from
+// the Windows Credential Manager. Store it with
+// cmdkey /generic:<service>:<account> /user:<account> /pass
+func keyringLookup(service, account string) (yubikey.SecureBytes, error) {
+	target, err := syscall.UTF16PtrFromString(service + ":" + account)
+	if err != nil {
+		return nil, err
+	}
+	var cred *credential
+	ret, _, err := procCredRead.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if ret == 0 {
+		return nil, err
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	// cmdkey and the control panel store the password as UTF-16
+	n := cred.CredentialBlobSize / 2
+	if n == 0 {
+		return nil, nil
+	}
+	blob := (*[1 << 20]uint16)(unsafe.Pointer(cred.CredentialBlob))[:n:n]
+	var secret yubikey.SecureBytes
+	buf := make([]byte, utf8.UTFMax)
+	for _, r := range utf16.Decode(blob) {
+		if r == 0 {
+			break
+		}
+		secret = append(secret, buf[:utf8.EncodeRune(buf, r)]...)
+	}
+	yubikey.SecureBytes(buf).Wipe()
+	return secret, nil
+}
@@ -0,0 +1,343 @@
+package adapter
+
+import (
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/rpc"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/wire/upstream"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/theupdateframework/notary/tuf/data"
+	"github.com/theupdateframework/notary/tuf/utils"
+)
+
+const (
+	keysImportUsage = "keys import [-slot 9a|9c|9d|9e] [-overwrite] [-role <role>] [-passphrase-file <file>] [-management-key-file <file>] <key.pem>"
+	keysRemoveUsage = "keys remove [-management-key-file <file>] <key-id>"
+	keysPublicUsage = "keys public [-o <file>] <key-id>"
+	keysRenewUsage  = "keys renew-cert [-validity <duration>] [-csr <file> | -cert <file>] [-pin-file <file>] [-management-key-file <file>] <key-id>"
+	keysAdoptUsage  = "keys adopt -slot 9a|9c|9d|9e -role <role> [-validity <duration>] [-backup <file>] [-pin-file <file>] [-management-key-file <file>]"
+	keysListUsage   = "keys list"
+	keysUsage       = keysListUsage + "\n       " + keysImportUsage + "\n       " + keysRemoveUsage + "\n       " + keysPublicUsage + "\n       " + keysRenewUsage + "\n       " + keysAdoptUsage
+)
+
+// withStoreSession connects to the hardwarestore socket of the running
+// daemon and runs fn with a session, as the notary client does
+func withStoreSession(fn func(client *rpc.Client, session uint) error) error {
+	client, err := wire.Dial("unix", Socket)
+	if err != nil {
+		return daemonNotRunning{err}
+	}
+	defer client.Close()
+	setup := new(wire.ESSetupHSMEnvRes)
+	if err := client.Call("ESServer.SetupHSMEnv", wire.ESSetupHSMEnvReq{}, setup); err != nil {
+		return err
+	}
+	defer client.Call("ESServer.Cleanup", wire.ESCleanupReq{Session: setup.Session}, new(wire.ESCleanupReq))
+	return fn(client, setup.Session)
+}
+
+// readSecretFlag reads a secret from the file named by a flag, if it was given
+func readSecretFlag(path string) (yubikey.Secret, error) {
+	if path == "" {
+		return "", nil
+	}
+	s, err := readSecretFile(path)
+	return yubikey.Secret(s), err
+}
+
+func keysCommand(args []string) error {
+	if len(args) < 1 {
+		return usageError(keysUsage)
+	}
+	switch args[0] {
+	case "import":
+		return keysImport(args[1:])
+	case "remove":
+		return keysRemove(args[1:])
+	case "public":
+		return keysPublic(args[1:])
+	case "renew-cert":
+		return keysRenewCert(args[1:])
+	case "adopt":
+		return keysAdopt(args[1:])
+	case "list":
+		return keysList(args[1:])
+	}
+	return usageError(keysUsage)
+}
+
+func keysImport(args []string) error {
+	fs := flag.NewFlagSet("keys import", flag.ExitOnError)
+	slot := fs.String("slot", "", "PIV slot to import the key into, default: the next empty slot")
+	overwrite := fs.Bool("overwrite", false, "Replace a key already stored in the slot")
+	role := fs.String("role", data.CanonicalRootRole.String(), "Role of the key")
+	passphraseFile := fs.String("passphrase-file", "", "File holding the passphrase of an encrypted key")
+	managementKeyFile := fs.String("management-key-file", "", "File holding the management key, default: the daemon's secret source")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return usageError(keysImportUsage)
+	}
+
+	pemBytes, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer yubikey.SecureBytes(pemBytes).Wipe()
+	passphrase, err := readSecretFlag(*passphraseFile)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return fmt.Errorf("could not read %s: no PEM encoded key found", fs.Arg(0))
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" && passphrase == "" {
+		return fmt.Errorf("%s is an encrypted PKCS#8 key, pass its passphrase with -passphrase-file", fs.Arg(0))
+	}
+	privKey, err := utils.ParsePEMPrivateKey(pemBytes, passphrase.Reveal())
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", fs.Arg(0), err)
+	}
+	// fail before connecting if the daemon would refuse the key anyway
+	ecdsaPrivKey, err := yubikey.ValidateImportKey(privKey)
+	if err != nil {
+		return fmt.Errorf("can not import %s: %v", fs.Arg(0), err)
+	}
+	ecdsaPrivKey.D.SetInt64(0)
+	managementKey, err := readSecretFlag(*managementKeyFile)
+	if err != nil {
+		return err
+	}
+
+	return withStoreSession(func(client *rpc.Client, session uint) error {
+		req := AddECDSAKeyReq{
+			Session:    session,
+			PrivateKey: upstream.NewPrivateKey(privKey),
+			Pass:       managementKey,
+			Role:       *role,
+			PIVSlot:    strings.ToLower(*slot),
+			Overwrite:  *overwrite,
+		}
+		req.Slot.Role = req.Role
+		req.Slot.KeyID = privKey.ID()
+		if req.PIVSlot == "" {
+			next := new(wire.ESGetNextEmptySlotRes)
+			if err := client.Call("ESServer.GetNextEmptySlot", wire.ESGetNextEmptySlotReq{Session: session}, next); err != nil {
+				return err
+			}
+			req.Slot.SlotID = next.Slot
+		}
+		return client.Call("ESServer.AddECDSAKey", req, new(wire.ESAddECDSAKeyRes))
+	})
+}
+
+func keysRemove(args []string) error {
+	fs := flag.NewFlagSet("keys remove", flag.ExitOnError)
+	managementKeyFile := fs.String("management-key-file", "", "File holding the management key, default: the daemon's secret source")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return usageError(keysRemoveUsage)
+	}
+	managementKey, err := readSecretFlag(*managementKeyFile)
+	if err != nil {
+		return err
+	}
+
+	return withStoreSession(func(client *rpc.Client, session uint) error {
+		req := RemoveKeyReq{Session: session, KeyID: fs.Arg(0), Pass: managementKey}
+		res := new(RemoveKeyRes)
+		if err := client.Call("ESServer.RemoveKey", req, res); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s key %s from slot %s\n", res.Slot.Role, req.KeyID, yubikey.SlotName(res.Slot.SlotID))
+		return nil
+	})
+}
+
+func keysPublic(args []string) error {
+	fs := flag.NewFlagSet("keys public", flag.ExitOnError)
+	out := fs.String("o", "", "File to write the PEM encoded public key to, default: stdout")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return usageError(keysPublicUsage)
+	}
+
+	return withStoreSession(func(client *rpc.Client, session uint) error {
+		res := new(GetPublicKeyRes)
+		if err := client.Call("ESServer.GetPublicKey", GetPublicKeyReq{Session: session, KeyID: fs.Arg(0)}, res); err != nil {
+			return err
+		}
+		if *out == "" {
+			_, err := os.Stdout.Write(res.PEM)
+			return err
+		}
+		return ioutil.WriteFile(*out, res.PEM, 0644)
+	})
+}
+
+func keysRenewCert(args []string) error {
+	fs := flag.NewFlagSet("keys renew-cert", flag.ExitOnError)
+	validity := fs.Duration("validity", 10*365*24*time.Hour, "Validity of the new self-signed certificate")
+	csrFile := fs.String("csr", "", "Write a certificate request for the key to this file instead of renewing the certificate")
+	certFile := fs.String("cert", "", "Install this PEM encoded certificate, issued for a request created with -csr")
+	pinFile := fs.String("pin-file", "", "File holding the PIN, default: the daemon's secret source")
+	managementKeyFile := fs.String("management-key-file", "", "File holding the management key, default: the daemon's secret source")
+	fs.Parse(args)
+	if fs.NArg() != 1 || (*csrFile != "" && *certFile != "") {
+		return usageError(keysRenewUsage)
+	}
+
+	req := RenewCertReq{KeyID: fs.Arg(0), Validity: *validity, CSR: *csrFile != ""}
+	var err error
+	if req.Pass, err = readSecretFlag(*pinFile); err != nil {
+		return err
+	}
+	if req.ManagementKey, err = readSecretFlag(*managementKeyFile); err != nil {
+		return err
+	}
+	if *certFile != "" {
+		cert, err := utils.LoadCertFromFile(*certFile)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", *certFile, err)
+		}
+		req.Certificate = cert.Raw
+	}
+
+	return withStoreSession(func(client *rpc.Client, session uint) error {
+		req.Session = session
+		res := new(RenewCertRes)
+		if err := client.Call("ESServer.RenewCert", req, res); err != nil {
+			return err
+		}
+		if req.CSR {
+			return ioutil.WriteFile(*csrFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: res.CSR}), 0644)
+		}
+		fmt.Printf("The certificate of key %s now expires at %s\n", req.KeyID, res.NotAfter.Format(time.RFC3339))
+		return nil
+	})
+}
+
+func keysAdopt(args []string) error {
+	fs := flag.NewFlagSet("keys adopt", flag.ExitOnError)
+	slot := fs.String("slot", "", "PIV slot holding the key")
+	role := fs.String("role", "", "Role the key is used for")
+	validity := fs.Duration("validity", 10*365*24*time.Hour, "Validity of the certificate which replaces the current one")
+	backup := fs.String("backup", "", "Write the current certificate of the slot to this file")
+	pinFile := fs.String("pin-file", "", "File holding the PIN, default: the daemon's secret source")
+	managementKeyFile := fs.String("management-key-file", "", "File holding the management key, default: the daemon's secret source")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *slot == "" || *role == "" {
+		return usageError(keysAdoptUsage)
+	}
+	if !data.ValidRole(data.RoleName(*role)) {
+		return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "%q is no notary role", *role)
+	}
+
+	req := AdoptKeyReq{Slot: *slot, Role: *role, Validity: *validity}
+	var err error
+	if req.Pass, err = readSecretFlag(*pinFile); err != nil {
+		return err
+	}
+	if req.ManagementKey, err = readSecretFlag(*managementKeyFile); err != nil {
+		return err
+	}
+	return withStoreSession(func(client *rpc.Client, session uint) error {
+		req.Session = session
+		res := new(AdoptKeyRes)
+		if err := client.Call("ESServer.AdoptKey", req, res); err != nil {
+			return err
+		}
+		fmt.Printf("Adopted key %s in slot %s for role %s\n", res.KeyID, *slot, *role)
+		if *backup == "" {
+			return nil
+		}
+		old := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: res.OldCertificate})
+		if err := ioutil.WriteFile(*backup, old, 0644); err != nil {
+			// the certificate is gone from the token, do not lose it
+			os.Stderr.Write(old)
+			return err
+		}
+		return nil
+	})
+}
+
+// keyListing is a key as printed by keys list
+type keyListing struct {
+	keyFingerprint
+	Role     string          `json:"role"`
+	Slot     string          `json:"slot"`
+	Devices  []deviceListing `json:"devices,omitempty"`
+	NotAfter *time.Time      `json:"not_after,omitempty"`
+}
+
+// deviceListing is a device holding a key as printed by keys list
+type deviceListing struct {
+	Serial string `json:"serial"`
+	Alias  string `json:"alias,omitempty"`
+}
+
+func keysList(args []string) error {
+	if len(args) != 0 {
+		return usageError(keysListUsage)
+	}
+	var keys []keyListing
+	err := withStoreSession(func(client *rpc.Client, session uint) error {
+		res := new(HardwareListKeysRes)
+		if err := client.Call("ESServer.HardwareListKeys", HardwareListKeysReq{Session: session}, res); err != nil {
+			return err
+		}
+		for keyID, slot := range res.Keys {
+			key := keyListing{keyFingerprint: newKeyFingerprint(keyID, res.PublicKeySHA256[keyID]), Role: slot.Role, Slot: yubikey.SlotName(slot.SlotID)}
+			for _, serial := range res.Devices[keyID] {
+				key.Devices = append(key.Devices, deviceListing{Serial: serial, Alias: res.DeviceAliases[serial]})
+			}
+			if notAfter, ok := res.NotAfter[keyID]; ok {
+				key.NotAfter = &notAfter
+			}
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Slot < keys[j].Slot })
+	if jsonOutput() {
+		return printJSON(keys)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SLOT\tROLE\tKEY ID\tSHORT ID\tPUBLIC KEY SHA256\tDEVICES\tCERTIFICATE EXPIRES")
+	for _, k := range keys {
+		expires := "unknown"
+		if k.NotAfter != nil {
+			expires = k.NotAfter.Format(time.RFC3339)
+		}
+		devices := "-"
+		if len(k.Devices) > 0 {
+			var names []string
+			for _, d := range k.Devices {
+				if d.Alias != "" {
+					names = append(names, d.Alias)
+				} else {
+					names = append(names, d.Serial)
+				}
+			}
+			devices = strings.Join(names, ",")
+		}
+		pubHash := k.PublicKeySHA256
+		if pubHash == "" {
+			pubHash = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", k.Slot, k.Role, k.KeyID, k.ShortID, pubHash, devices, expires)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,156 @@
+package adapter
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The operations whose latency is recorded. A signature is split into the
+// time spent waiting for the yubikey to be touched and the remaining time
+// on the device and the host, most of which is crypto
+const (
+	latencySign        = "sign"
+	latencySignTouch   = "sign_touch_wait"
+	latencySignCrypto  = "sign_crypto"
+	latencyListKeys    = "list_keys"
+	latencySetupHSMEnv = "setup_hsm_env"
+)
+
+var latencyOperations = []string{latencySign, latencySignTouch, latencySignCrypto, latencyListKeys, latencySetupHSMEnv}
+
+// latencyBuckets are the upper bounds of the histogram buckets in seconds,
+// they reach up to the longest touch timeout worth waiting for
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15, 30, 60}
+
+// LatencyStats are the estimated quantiles of the durations of an operation
+type LatencyStats struct {
+	Operation string
+	Count     uint64
+	P50       time.Duration
+	P95       time.Duration
+	P99       time.Duration
+}
+
+// histogram counts durations in latencyBuckets, the last count is the
+// one of the +Inf bucket
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets)+1)
+	}
+	i := 0
+	for i < len(latencyBuckets) && d.Seconds() > latencyBuckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+// quantile estimates the q quantile by interpolating linearly within the
+// bucket it falls into, like Prometheus' histogram_quantile
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	var below uint64
+	for i, n := range h.counts {
+		if n == 0 || float64(below+n) < rank {
+			below += n
+			continue
+		}
+		if i == len(latencyBuckets) {
+			// nothing is known about the +Inf bucket but its lower bound
+			return seconds(latencyBuckets[i-1])
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = latencyBuckets[i-1]
+		}
+		return seconds(lower + (latencyBuckets[i]-lower)*(rank-float64(below))/float64(n))
+	}
+	return seconds(latencyBuckets[len(latencyBuckets)-1])
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// latencyMetrics collects a histogram per operation
+type latencyMetrics struct {
+	sync.Mutex
+	ops map[string]*histogram
+}
+
+var latencies = &latencyMetrics{ops: make(map[string]*histogram)}
+
+// observe records a duration of op
+func (m *latencyMetrics) observe(op string, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	h, ok := m.ops[op]
+	if !ok {
+		h = new(histogram)
+		m.ops[op] = h
+	}
+	h.observe(d)
+}
+
+// since records the time since start for op, for use with defer
+func (m *latencyMetrics) since(op string, start time.Time) {
+	m.observe(op, time.Since(start))
+}
+
+// observeSign records the duration of a signature, touch of which were
+// spent waiting for the yubikey to be touched
+func (m *latencyMetrics) observeSign(total, touch time.Duration) {
+	m.observe(latencySign, total)
+	m.observe(latencySignTouch, touch)
+	m.observe(latencySignCrypto, total-touch)
+}
+
+// stats returns the quantiles of the operations recorded so far
+func (m *latencyMetrics) stats() []LatencyStats {
+	m.Lock()
+	defer m.Unlock()
+	var stats []LatencyStats
+	for _, op := range latencyOperations {
+		h, ok := m.ops[op]
+		if !ok {
+			continue
+		}
+		stats = append(stats, LatencyStats{Operation: op, Count: h.count, P50: h.quantile(0.5), P95: h.quantile(0.95), P99: h.quantile(0.99)})
+	}
+	return stats
+}
+
+// writeLatencyMetrics writes the histograms in the Prometheus text format
+func writeLatencyMetrics(w io.Writer, m *latencyMetrics) {
+	m.Lock()
+	defer m.Unlock()
+	name := "notary_yubikey_operation_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, "Duration of operations on the token, signatures split into touch wait and crypto time.", name)
+	for _, op := range latencyOperations {
+		h, ok := m.ops[op]
+		if !ok {
+			continue
+		}
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{operation=\"%s\",le=\"%s\"} %d\n", name, op, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{operation=\"%s\",le=\"+Inf\"} %d\n", name, op, h.count)
+		fmt.Fprintf(w, "%s_sum{operation=\"%s\"} %g\n", name, op, h.sum.Seconds())
+		fmt.Fprintf(w, "%s_count{operation=\"%s\"} %d\n", name, op, h.count)
+	}
+}
@@ -0,0 +1,45 @@
+package adapter
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyMetrics(t *testing.T) {
+	m := &latencyMetrics{ops: make(map[string]*histogram)}
+	require.Empty(t, m.stats())
+
+	for i := 0; i < 90; i++ {
+		m.observeSign(2*time.Second, 1900*time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		m.observeSign(20*time.Second, 0)
+	}
+	m.observe(latencyListKeys, 120*time.Minute)
+
+	stats := m.stats()
+	require.Len(t, stats, 4)
+	require.Equal(t, latencySign, stats[0].Operation)
+	require.Equal(t, uint64(100), stats[0].Count)
+	// 2s falls into the bucket from 1s to 2.5s
+	require.True(t, stats[0].P50 > time.Second && stats[0].P50 <= 2500*time.Millisecond, "%s", stats[0].P50)
+	require.True(t, stats[0].P99 > 15*time.Second && stats[0].P99 <= 30*time.Second, "%s", stats[0].P99)
+	require.Equal(t, latencySignTouch, stats[1].Operation)
+	require.Equal(t, latencySignCrypto, stats[2].Operation)
+	require.True(t, stats[2].P50 <= 250*time.Millisecond, "%s", stats[2].P50)
+	// beyond the last bucket only its bound is known
+	require.Equal(t, latencyListKeys, stats[3].Operation)
+	require.Equal(t, time.Minute, stats[3].P99)
+
+	var buf bytes.Buffer
+	writeLatencyMetrics(&buf, m)
+	require.Contains(t, buf.String(), "# TYPE notary_yubikey_operation_duration_seconds histogram\n")
+	require.Contains(t, buf.String(), `notary_yubikey_operation_duration_seconds_bucket{operation="sign",le="2.5"} 90`)
+	require.Contains(t, buf.String(), `notary_yubikey_operation_duration_seconds_bucket{operation="sign",le="+Inf"} 100`)
+	require.Contains(t, buf.String(), `notary_yubikey_operation_duration_seconds_sum{operation="sign"} 380`)
+	require.Contains(t, buf.String(), `notary_yubikey_operation_duration_seconds_count{operation="list_keys"} 1`)
+	require.NotContains(t, buf.String(), "setup_hsm_env")
+}
@@ -0,0 +1,368 @@
+package adapter
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	mathrand "math/rand"
+	"net/rpc"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+const loadtestUsage = "loadtest [-connections <n>] [-duration <duration>] [-rate <requests/s>] [-sign-ratio <0..1>] [-key <key-id>] [-pin-file <file>] [-payload-size <bytes>]"
+
+// loadtestOperations are the operations of a load test in the order they
+// are reported
+var loadtestOperations = []string{latencySetupHSMEnv, latencyListKeys, latencySign}
+
+// loadtestOptions shape the traffic of a load test
+type loadtestOptions struct {
+	connections int
+	duration    time.Duration
+	// rate caps the requests per second of all connections together, 0
+	// sends them as fast as the daemon answers
+	rate float64
+	// signRatio is the share of signatures, the rest lists the keys
+	signRatio   float64
+	keyID       string
+	pin         yubikey.Secret
+	payloadSize int
+}
+
+// loadReport collects the outcome of the requests of a load test
+type loadReport struct {
+	sync.Mutex
+	latencies *latencyMetrics
+	requests  map[string]uint64
+	errors    map[string]map[yubikey.ErrorCode]uint64
+	elapsed   time.Duration
+}
+
+func newLoadReport() *loadReport {
+	return &loadReport{
+		latencies: &latencyMetrics{ops: make(map[string]*histogram)},
+		requests:  make(map[string]uint64),
+		errors:    make(map[string]map[yubikey.ErrorCode]uint64),
+	}
+}
+
+// record counts a request of op which took d and failed with err, if not nil
+func (r *loadReport) record(op string, d time.Duration, err error) {
+	r.latencies.observe(op, d)
+	r.Lock()
+	defer r.Unlock()
+	r.requests[op]++
+	if err == nil {
+		return
+	}
+	if r.errors[op] == nil {
+		r.errors[op] = make(map[yubikey.ErrorCode]uint64)
+	}
+	r.errors[op][yubikey.ErrorCodeOf(err)]++
+}
+
+// loadClient calls the RPCs of a load test on a connection of its own
+type loadClient struct {
+	client  *rpc.Client
+	session uint
+	meta    RequestMeta
+	report  *loadReport
+}
+
+// call invokes method and records how long it took
+func (c *loadClient) call(op, method string, req, res interface{}) error {
+	start := time.Now()
+	err := c.client.Call(method, req, res)
+	c.report.record(op, time.Since(start), err)
+	return err
+}
+
+func (c *loadClient) listKeys() (map[string]wire.HardwareSlot, error) {
+	res := new(HardwareListKeysRes)
+	err := c.call(latencyListKeys, "ESServer.HardwareListKeys", HardwareListKeysReq{RequestMeta: c.meta, Session: c.session}, res)
+	return res.Keys, err
+}
+
+func (c *loadClient) sign(slot wire.HardwareSlot, pin yubikey.Secret, payload []byte) error {
+	req := SignReq{RequestMeta: c.meta, Session: c.session, Slot: slot, Pass: pin, Payload: payload}
+	return c.call(latencySign, "ESServer.Sign", req, new(wire.ESSignRes))
+}
+
+// dialLoadClient connects to the daemon and sets up a session, which close
+// cleans up again
+func dialLoadClient(dial func() (*rpc.Client, error), id int, report *loadReport) (*loadClient, error) {
+	client, err := dial()
+	if err != nil {
+		report.record(latencySetupHSMEnv, 0, err)
+		return nil, daemonNotRunning{err}
+	}
+	c := &loadClient{client: client, meta: RequestMeta{CorrelationID: fmt.Sprintf("loadtest-%d", id)}, report: report}
+	setup := new(wire.ESSetupHSMEnvRes)
+	if err := c.call(latencySetupHSMEnv, "ESServer.SetupHSMEnv", wire.ESSetupHSMEnvReq{}, setup); err != nil {
+		client.Close()
+		return nil, err
+	}
+	c.session = setup.Session
+	return c, nil
+}
+
+func (c *loadClient) close() {
+	c.client.Call("ESServer.Cleanup", wire.ESCleanupReq{Session: c.session}, new(wire.ESCleanupReq))
+	c.client.Close()
+}
+
+// signingSlot returns the slot of the key the load test signs with, the
+// one with keyID or else the first one listed
+func signingSlot(keys map[string]wire.HardwareSlot, keyID string) (wire.HardwareSlot, error) {
+	if keyID != "" {
+		slot, ok := keys[keyID]
+		if !ok {
+			return slot, yubikey.NewError(yubikey.ErrCodeKeyNotFound, "no key %s on the token", keyID)
+		}
+		slot.KeyID = keyID
+		return slot, nil
+	}
+	ids := make([]string, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return wire.HardwareSlot{}, yubikey.NewError(yubikey.ErrCodeKeyNotFound, "no key on the token to sign with, pass -sign-ratio 0 to only list keys")
+	}
+	sort.Strings(ids)
+	slot := keys[ids[0]]
+	slot.KeyID = ids[0]
+	return slot, nil
+}
+
+// runLoadtest sends the traffic described by opts over connections opened
+// with dial until the duration is over
+func runLoadtest(opts loadtestOptions, dial func() (*rpc.Client, error)) (*loadReport, error) {
+	report := newLoadReport()
+	var slot wire.HardwareSlot
+	if opts.signRatio > 0 {
+		c, err := dialLoadClient(dial, 0, newLoadReport())
+		if err != nil {
+			return nil, err
+		}
+		keys, err := c.listKeys()
+		c.close()
+		if err != nil {
+			return nil, err
+		}
+		if slot, err = signingSlot(keys, opts.keyID); err != nil {
+			return nil, err
+		}
+	}
+	payload := make([]byte, opts.payloadSize)
+	if _, err := rand.Read(payload); err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	// with a rate, every request waits for a tick. Ticks no connection is
+	// ready for are dropped, so the rate is an upper bound
+	var ticks chan struct{}
+	if opts.rate > 0 {
+		ticks = make(chan struct{}, opts.connections)
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.rate))
+		defer ticker.Stop()
+		go func() {
+			for {
+				select {
+				case <-ticker.C:
+					select {
+					case ticks <- struct{}{}:
+					default:
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 1; i <= opts.connections; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			c, err := dialLoadClient(dial, id, report)
+			if err != nil {
+				return
+			}
+			defer c.close()
+			rng := mathrand.New(mathrand.NewSource(time.Now().UnixNano() + int64(id)))
+			for {
+				if ticks != nil {
+					select {
+					case <-ticks:
+					case <-done:
+						return
+					}
+				} else {
+					select {
+					case <-done:
+						return
+					default:
+					}
+				}
+				if rng.Float64() < opts.signRatio {
+					c.sign(slot, opts.pin, payload)
+				} else {
+					c.listKeys()
+				}
+			}
+		}(i)
+	}
+	time.AfterFunc(opts.duration, func() { close(done) })
+	wg.Wait()
+	report.elapsed = time.Since(start)
+	return report, nil
+}
+
+type loadOperationJSON struct {
+	Operation  string                       `json:"operation"`
+	Requests   uint64                       `json:"requests"`
+	Errors     uint64                       `json:"errors"`
+	ErrorRate  float64                      `json:"error_rate"`
+	ErrorCodes map[yubikey.ErrorCode]uint64 `json:"error_codes,omitempty"`
+	P50Millis  float64                      `json:"p50_ms"`
+	P95Millis  float64                      `json:"p95_ms"`
+	P99Millis  float64                      `json:"p99_ms"`
+}
+
+// loadtestJSON is the stable schema of loadtest --json
+type loadtestJSON struct {
+	SchemaVersion     int                 `json:"schema_version"`
+	Connections       int                 `json:"connections"`
+	DurationSeconds   float64             `json:"duration_seconds"`
+	Requests          uint64              `json:"requests"`
+	RequestsPerSecond float64             `json:"requests_per_second"`
+	Operations        []loadOperationJSON `json:"operations"`
+}
+
+// summary returns the outcome of the load test, sessions set up are not
+// counted as requests
+func (r *loadReport) summary(connections int) loadtestJSON {
+	r.Lock()
+	defer r.Unlock()
+	stats := make(map[string]LatencyStats)
+	for _, s := range r.latencies.stats() {
+		stats[s.Operation] = s
+	}
+	out := loadtestJSON{SchemaVersion: statusSchemaVersion, Connections: connections, DurationSeconds: r.elapsed.Seconds()}
+	for _, op := range loadtestOperations {
+		n := r.requests[op]
+		if n == 0 {
+			continue
+		}
+		o := loadOperationJSON{Operation: op, Requests: n, ErrorCodes: r.errors[op]}
+		for _, count := range r.errors[op] {
+			o.Errors += count
+		}
+		o.ErrorRate = float64(o.Errors) / float64(n)
+		s := stats[op]
+		o.P50Millis, o.P95Millis, o.P99Millis = millis(s.P50), millis(s.P95), millis(s.P99)
+		out.Operations = append(out.Operations, o)
+		if op != latencySetupHSMEnv {
+			out.Requests += n
+		}
+	}
+	if r.elapsed > 0 {
+		out.RequestsPerSecond = float64(out.Requests) / r.elapsed.Seconds()
+	}
+	return out
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// printLoadtest prints the outcome of loadtest as a table
+func printLoadtest(s loadtestJSON) error {
+	fmt.Printf("%d connections, %d requests in %.1fs, %.1f requests/s\n", s.Connections, s.Requests, s.DurationSeconds, s.RequestsPerSecond)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "OPERATION\tREQUESTS\tERRORS\tERROR RATE\tP50\tP95\tP99")
+	for _, o := range s.Operations {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.2f%%\t%.1fms\t%.1fms\t%.1fms\n", o.Operation, o.Requests, o.Errors, 100*o.ErrorRate, o.P50Millis, o.P95Millis, o.P99Millis)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for _, o := range s.Operations {
+		codes := make([]string, 0, len(o.ErrorCodes))
+		for code := range o.ErrorCodes {
+			codes = append(codes, string(code))
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			fmt.Printf("%s failed with %s %d times\n", o.Operation, code, o.ErrorCodes[yubikey.ErrorCode(code)])
+		}
+	}
+	return nil
+}
+
+// errLoadtestFailed makes the loadtest command exit with a failure if no
+// request succeeded
+var errLoadtestFailed = errors.New("all requests failed")
+
+// loadtestCommand puts the running daemon under concurrent List and Sign
+// traffic, so it can be sized before pipelines depend on it
+func loadtestCommand(args []string) error {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	connections := fs.Int("connections", 4, "Concurrent connections, each with a session of its own")
+	duration := fs.Duration("duration", 30*time.Second, "How long to send requests")
+	rate := fs.Float64("rate", 0, "Most requests per second of all connections together, 0 for as many as the daemon answers")
+	signRatio := fs.Float64("sign-ratio", 0.5, "Share of signatures among the requests, the others list the keys")
+	keyID := fs.String("key", "", "ID of the key to sign with, default: the first key listed")
+	pinFile := fs.String("pin-file", "", "File holding the PIN, default: the daemon's secret source")
+	payloadSize := fs.Int("payload-size", 4096, "Size of the payloads signed")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *connections < 1 || *duration <= 0 || *rate < 0 || *signRatio < 0 || *signRatio > 1 || *payloadSize < 1 {
+		return usageError(loadtestUsage)
+	}
+	opts := loadtestOptions{
+		connections: *connections,
+		duration:    *duration,
+		rate:        *rate,
+		signRatio:   *signRatio,
+		keyID:       *keyID,
+		payloadSize: *payloadSize,
+	}
+	var err error
+	if opts.pin, err = readSecretFlag(*pinFile); err != nil {
+		return err
+	}
+
+	report, err := runLoadtest(opts, func() (*rpc.Client, error) { return wire.Dial("unix", Socket) })
+	if err != nil {
+		return err
+	}
+	summary := report.summary(opts.connections)
+	if jsonOutput() {
+		err = printJSON(summary)
+	} else {
+		err = printLoadtest(summary)
+	}
+	if err != nil {
+		return err
+	}
+	ok := false
+	for _, o := range summary.Operations {
+		ok = ok || (o.Operation != latencySetupHSMEnv && o.Errors < o.Requests)
+	}
+	if !ok {
+		return errLoadtestFailed
+	}
+	return nil
+}
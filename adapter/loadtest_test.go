@@ -0,0 +1,90 @@
+package adapter
+
+import (
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+// loadServer answers the RPCs of the load test, every other signature fails
+type loadServer struct {
+	sessions int32
+	signs    int32
+}
+
+func (s *loadServer) SetupHSMEnv(req wire.ESSetupHSMEnvReq, res *wire.ESSetupHSMEnvRes) error {
+	res.Session = uint(atomic.AddInt32(&s.sessions, 1))
+	return nil
+}
+
+func (s *loadServer) Cleanup(req wire.ESCleanupReq, _ *wire.ESCleanupReq) error {
+	atomic.AddInt32(&s.sessions, -1)
+	return nil
+}
+
+func (s *loadServer) HardwareListKeys(req HardwareListKeysReq, res *HardwareListKeysRes) error {
+	res.Keys = map[string]wire.HardwareSlot{"abc": {Role: data.CanonicalRootRole.String(), SlotID: []byte{2}}}
+	return nil
+}
+
+func (s *loadServer) Sign(req SignReq, res *wire.ESSignRes) error {
+	if req.Slot.KeyID != "abc" || len(req.Payload) != 64 {
+		return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "unexpected request")
+	}
+	if atomic.AddInt32(&s.signs, 1)%2 == 0 {
+		return yubikey.NewError(yubikey.ErrCodeTouchTimeout, "not touched")
+	}
+	res.Result = []byte("signature")
+	return nil
+}
+
+func TestLoadtest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loadtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, SocketName)
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer listener.Close()
+	server := rpc.NewServer()
+	srv := &loadServer{}
+	require.NoError(t, server.RegisterName("ESServer", srv))
+	go server.Accept(listener)
+	dial := func() (*rpc.Client, error) { return rpc.Dial("unix", socket) }
+
+	opts := loadtestOptions{connections: 3, duration: 200 * time.Millisecond, signRatio: 1, payloadSize: 64}
+	report, err := runLoadtest(opts, dial)
+	require.NoError(t, err)
+	require.Equal(t, int32(0), atomic.LoadInt32(&srv.sessions))
+	summary := report.summary(3)
+	require.Len(t, summary.Operations, 2)
+	setup, sign := summary.Operations[0], summary.Operations[1]
+	require.Equal(t, latencySetupHSMEnv, setup.Operation)
+	require.Equal(t, uint64(3), setup.Requests)
+	require.Equal(t, latencySign, sign.Operation)
+	require.Equal(t, sign.Requests, summary.Requests)
+	require.True(t, sign.Errors > 0 && sign.Errors < sign.Requests)
+	require.Equal(t, sign.Errors, sign.ErrorCodes[yubikey.ErrCodeTouchTimeout])
+
+	// the rate caps the requests of all connections
+	opts = loadtestOptions{connections: 4, duration: 300 * time.Millisecond, rate: 20, payloadSize: 64}
+	report, err = runLoadtest(opts, dial)
+	require.NoError(t, err)
+	summary = report.summary(4)
+	require.Equal(t, latencyListKeys, summary.Operations[1].Operation)
+	require.True(t, summary.Requests >= 1 && summary.Requests <= 8, "%d requests", summary.Requests)
+	require.Zero(t, summary.Operations[1].Errors)
+
+	_, err = runLoadtest(loadtestOptions{connections: 1, duration: time.Millisecond, signRatio: 0.5, keyID: "def", payloadSize: 64}, dial)
+	require.Equal(t, yubikey.ErrCodeKeyNotFound, yubikey.ErrorCodeOf(err))
+}
@@ -0,0 +1,45 @@
+package adapter
+
+import (
+	"fmt"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/sirupsen/logrus"
+)
+
+const logoutUsage = "logout"
+
+type FlushLoginReq struct {
+}
+
+type FlushLoginRes struct {
+	// WasLoggedIn tells whether the daemon held a cached login
+	WasLoggedIn bool
+}
+
+// FlushLogin drops the cached login of the yubikey, so the next signature
+// has the yubikey check the PIN again
+func (s *AdminServer) FlushLogin(req FlushLoginReq, res *FlushLoginRes) error {
+	res.WasLoggedIn = yubikey.FlushLogin()
+	audit("flush_login", s.peer, logrus.Fields{"was_logged_in": res.WasLoggedIn}, nil)
+	return nil
+}
+
+func logoutCommand(args []string) error {
+	if len(args) != 0 {
+		return usageError(logoutUsage)
+	}
+	res := new(FlushLoginRes)
+	if err := adminCall("FlushLogin", FlushLoginReq{}, res); err != nil {
+		return err
+	}
+	if jsonOutput() {
+		return printJSON(res)
+	}
+	if res.WasLoggedIn {
+		fmt.Println("logged out")
+	} else {
+		fmt.Println("not logged in")
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package adapter
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/sirupsen/logrus"
+)
+
+const loglevelUsage = "loglevel get | set <panic|fatal|error|warn|info|debug|trace> | reset"
+
+// configuredLevel is the level set with -log, SIGUSR2 returns to it
+var configuredLevel = logrus.ErrorLevel
+
+// changeLogLevel sets the level of the daemon log. The change is logged
+// at info level while the more verbose of both levels is active, so it
+// shows up when verbosity is raised and before it is lowered again
+func changeLogLevel(level logrus.Level) {
+	old := logrus.GetLevel()
+	if level > old {
+		logrus.SetLevel(level)
+	}
+	logrus.Infof("Log level changed from %s to %s", old, level)
+	logrus.SetLevel(level)
+}
+
+// nextDebugLevel returns the level SIGUSR2 switches to: from the
+// configured level to debug, then to trace and back again
+func nextDebugLevel(current, configured logrus.Level) logrus.Level {
+	switch {
+	case current < logrus.DebugLevel:
+		return logrus.DebugLevel
+	case current == logrus.DebugLevel:
+		return logrus.TraceLevel
+	}
+	return configured
+}
+
+// debugHandler cycles the log level on SIGUSR2, so a failure can be
+// captured verbosely without restarting the daemon
+func debugHandler(sig os.Signal) error {
+	changeLogLevel(nextDebugLevel(logrus.GetLevel(), configuredLevel))
+	return nil
+}
+
+type GetLogLevelReq struct {
+}
+
+type GetLogLevelRes struct {
+	Level      string
+	Configured string
+}
+
+// SetLogLevelReq changes the log level, an empty Level returns to the level
+// set with -log
+type SetLogLevelReq struct {
+	Level string
+}
+
+type SetLogLevelRes struct {
+	Level string
+}
+
+// GetLogLevel returns the current and the configured log level
+func (s *AdminServer) GetLogLevel(req GetLogLevelReq, res *GetLogLevelRes) error {
+	res.Level = logrus.GetLevel().String()
+	res.Configured = configuredLevel.String()
+	return nil
+}
+
+// SetLogLevel changes the log level at runtime, for deployments where
+// sending SIGUSR2 is awkward
+func (s *AdminServer) SetLogLevel(req SetLogLevelReq, res *SetLogLevelRes) error {
+	level := configuredLevel
+	var err error
+	if req.Level != "" {
+		level, err = logrus.ParseLevel(req.Level)
+	}
+	audit("set_log_level", s.peer, logrus.Fields{"old": logrus.GetLevel().String(), "new": level.String()}, err)
+	if err != nil {
+		return rpcError(yubikey.WrapError(yubikey.ErrCodeInvalidRequest, err))
+	}
+	changeLogLevel(level)
+	res.Level = level.String()
+	return nil
+}
+
+func loglevelCommand(args []string) error {
+	if len(args) < 1 {
+		return usageError(loglevelUsage)
+	}
+	switch args[0] {
+	case "get":
+		res := new(GetLogLevelRes)
+		if err := adminCall("GetLogLevel", GetLogLevelReq{}, res); err != nil {
+			return err
+		}
+		if jsonOutput() {
+			return printJSON(res)
+		}
+		fmt.Printf("%s (configured: %s)\n", res.Level, res.Configured)
+		return nil
+	case "set", "reset":
+		req := SetLogLevelReq{}
+		if args[0] == "set" {
+			if len(args) != 2 {
+				return usageError(loglevelUsage)
+			}
+			req.Level = args[1]
+		}
+		res := new(SetLogLevelRes)
+		if err := adminCall("SetLogLevel", req, res); err != nil {
+			return err
+		}
+		fmt.Println(res.Level)
+		return nil
+	default:
+		return usageError(loglevelUsage)
+	}
+}
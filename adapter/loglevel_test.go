@@ -0,0 +1,21 @@
+package adapter
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextDebugLevel(t *testing.T) {
+	level := logrus.ErrorLevel
+	level = nextDebugLevel(level, logrus.ErrorLevel)
+	require.Equal(t, logrus.DebugLevel, level)
+	level = nextDebugLevel(level, logrus.ErrorLevel)
+	require.Equal(t, logrus.TraceLevel, level)
+	level = nextDebugLevel(level, logrus.ErrorLevel)
+	require.Equal(t, logrus.ErrorLevel, level)
+
+	require.Equal(t, logrus.TraceLevel, nextDebugLevel(logrus.DebugLevel, logrus.DebugLevel))
+	require.Equal(t, logrus.DebugLevel, nextDebugLevel(logrus.TraceLevel, logrus.DebugLevel))
+}
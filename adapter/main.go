@@ -0,0 +1,512 @@
+package adapter
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/sevlyar/go-daemon"
+	"github.com/sirupsen/logrus"
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	// register the openpgp backend
+	_ "github.com/jschintag/notary-yubikey-adapter/openpgp"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+// The default Path of the Socket
+const (
+	SocketPath = "/var/run/notary"
+	SocketName = "hardwarestore.sock"
+)
+
+// Socket is the path of the socket in the directory set by -socket-dir
+var Socket = SocketPath + "/" + SocketName
+
+var (
+	appName      string
+	pidFile      string
+	logFile      string
+	logLevel     string
+	keymode      int
+	keymodePin   string
+	keymodeTouch bool
+	digest       string
+	sigEncoding  string
+	lowS         bool
+	tokenHashing bool
+	configFile   string
+	auditFile    string
+	auditExport  string
+	backendName  string
+	noHarden     bool
+	lockMemory   bool
+	fips         bool
+	readOnly     bool
+	runUser      string
+	runGroup     string
+	sandboxMode  bool
+	metricsAddr  string
+	retries      int
+	retryBackoff time.Duration
+	touchTimeout time.Duration
+	keyCacheFile string
+	sessionPool  int
+	loginTTL     time.Duration
+	pprofEnabled bool
+	socketDir    = SocketPath
+	stateDir     = "."
+	libraryPath  string
+	stopSignal   *bool
+	flagset      = make(map[string]bool)
+	flagSources  = make(map[string]string)
+	stop         = make(chan bool)
+	done         = make(chan bool)
+)
+
+// logLevels are the values accepted by -log
+var logLevels = map[string]logrus.Level{
+	"panic": logrus.PanicLevel,
+	"fatal": logrus.FatalLevel,
+	"error": logrus.ErrorLevel,
+	"warn":  logrus.WarnLevel,
+	"info":  logrus.InfoLevel,
+	"debug": logrus.DebugLevel,
+	"trace": logrus.TraceLevel,
+}
+
+func validLogLevel(level string) bool {
+	_, ok := logLevels[level]
+	return ok
+}
+
+func setLogLevel() {
+	level, ok := logLevels[logLevel]
+	if !ok {
+		invalidFlag("Invalid Log-Level")
+	}
+	logrus.SetLevel(level)
+}
+
+func invalidFlag(msg string) {
+	fmt.Println(msg)
+	flag.Usage()
+	os.Exit(1)
+}
+
+func hasUtilityFlag() bool {
+	return (flagset["stop"])
+}
+
+func checkRequiredFlags() {
+	// no required Flags
+}
+
+// RegisterFlags defines the flags of the daemon on fs
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&logLevel, "log", "error", "Set Log-Level")
+	fs.StringVar(&keymodePin, "pin", "once", "Set the mode for the Pin [none | once | always], default: once")
+	fs.BoolVar(&keymodeTouch, "touch", true, "Requires to touch the yubikey to sign")
+	fs.StringVar(&digest, "digest", yubikey.DigestSHA256, "Set the default digest algorithm for signing [sha256 | sha384 | sha512]")
+	fs.StringVar(&sigEncoding, "signature-encoding", yubikey.EncodingRaw, "Set the default signature encoding [raw | der]")
+	fs.BoolVar(&lowS, "low-s", false, "Normalize all signatures to the low-S form")
+	fs.BoolVar(&tokenHashing, "token-hashing", false, "Let the token hash the payload if it supports a combined hash and sign mechanism")
+	fs.StringVar(&configFile, "config", "", "Path to a JSON config file")
+	fs.StringVar(&backendName, "backend", "yubikey", fmt.Sprintf("Set the backend to serve %v", backend.Names()))
+	fs.StringVar(&auditFile, "audit-log", "", "Path of the audit log, default: <name>.audit.log")
+	fs.StringVar(&auditExport, "audit-export", "", "Send audit events to [syslog | auditd] as well, auditd requires CAP_AUDIT_WRITE")
+	fs.BoolVar(&approvalMode, "approval", false, "Hold every sign request until an operator approves it with 'approvals approve <id>'")
+	fs.DurationVar(&approvalTimeout, "approval-timeout", 5*time.Minute, "Time to wait for the approval of a sign request")
+	fs.BoolVar(&noHarden, "no-harden", false, "Allow core dumps and ptrace of the daemon, e.g. for debugging")
+	fs.BoolVar(&lockMemory, "mlock", false, "Lock all memory of the daemon, so PINs and keys are never swapped out")
+	fs.BoolVar(&fips, "fips", false, "Only allow FIPS approved curves and digests and refuse key import")
+	fs.BoolVar(&readOnly, "read-only", false, "Refuse to add or remove keys and certificates, listing and signing still work")
+	fs.StringVar(&repairSlots, "repair-slots", "", "Comma separated PIV slots, e.g. 9c, in which to destroy the certificate an interrupted import left without a key at startup, using the management key of the secrets config. Other such slots are quarantined")
+	fs.StringVar(&runUser, "user", "", "Switch to this user once the sockets are created")
+	fs.StringVar(&runGroup, "group", "", "Switch to this group once the sockets are created, default: the group of -user")
+	fs.IntVar(&retries, "retries", 3, "How often token operations failing with a transient error are tried")
+	fs.DurationVar(&retryBackoff, "retry-backoff", 100*time.Millisecond, "Delay before the first retry, it doubles with every further attempt")
+	fs.DurationVar(&touchTimeout, "touch-timeout", 15*time.Second, "Fail a signature with TOUCH_TIMEOUT if the yubikey is not touched within this time, 0 waits for the pkcs11 module")
+	fs.IntVar(&sessionPool, "session-pool", 0, "Sign with up to this many sessions of the daemon, which stay logged in with the PIN of the first signature, so signatures with different keys do not wait for each other. 0 signs on the session of the client")
+	fs.DurationVar(&loginTTL, "login-ttl", 0, "Keep the yubikey logged in for pin-once keys until no signature was made for this long, the logout command ends it earlier. 0 logs in for every signature unless -session-pool is set")
+	fs.StringVar(&keyCacheFile, "key-cache", "", "Keep the keys found on the yubikeys in this file, so a restarted daemon can sign without reading every certificate first")
+	fs.StringVar(&metricsAddr, "metrics", "", "Serve Prometheus metrics on this address, e.g. 127.0.0.1:9464")
+	fs.BoolVar(&pprofEnabled, "pprof", false, "Serve net/http/pprof on a socket in the socket directory, only the user running the daemon may connect")
+	fs.DurationVar(&certExpiryWindow, "cert-expiry-warning", 30*24*time.Hour, "Warn when the certificate of a key on the token expires within this time")
+	fs.BoolVar(&sandboxMode, "sandbox", false, "Restrict the syscalls and paths available to the daemon with seccomp and landlock")
+	fs.StringVar(&socketDir, "socket-dir", SocketPath, "Directory the sockets are created in")
+	fs.StringVar(&stateDir, "state-dir", ".", "Directory the daemon keeps its state in, e.g. the snapshot versions of the resigned repositories")
+	fs.StringVar(&libraryPath, "library", "", "Path of the pkcs11 library, default: the first one found at the usual locations")
+	fs.DurationVar(&idleTimeout, "idle-timeout", 0, "Close client connections which sent no request for this long, together with the sessions they left open. 0 keeps them open until the client closes them")
+	fs.StringVar(&signerAddr, "signer-addr", "", "Serve the notary-signer gRPC API on this address as well, e.g. :7899")
+	fs.StringVar(&signerCert, "signer-tls-cert", "", "Certificate of the notary-signer API")
+	fs.StringVar(&signerKey, "signer-tls-key", "", "Private key of the certificate of the notary-signer API")
+	fs.DurationVar(&signerKeepAlive, "signer-keepalive", 0, "Probe the connections of the notary-signer API with TCP keepalives at this interval, so the ones of vanished peers are closed. 0 uses the default of 15s, a negative value disables the probes")
+	fs.StringVar(&signerClientCA, "signer-client-ca", "", "CA the clients of the notary-signer API need a certificate of, required with -signer-addr")
+	fs.StringVar(&sshAgentSocket, "ssh-agent-socket", "", "Serve the keys of the yubikey notary does not use as ssh-agent on this socket, e.g. for SSH_AUTH_SOCK")
+	fs.BoolVar(&faultInjection, "fault-injection", false, "Allow the faults command to make RPCs fail with an error code of choice, for testing clients")
+	fs.StringVar(&chaosSpec, "chaos", "", "Inject faults into the token operations for testing clients, e.g. ckr=0.05,touch=0.1,removal=0.01,removed-for=10s,seed=42")
+	stopSignal = fs.Bool("stop", false, "Stop the daemon")
+}
+
+// hiddenFlags are left out of the usage, they are meant for testing only
+var hiddenFlags = map[string]bool{
+	"chaos":           true,
+	"fault-injection": true,
+}
+
+// printDefaults prints the usage of the flags of fs which are not hidden
+func printDefaults(fs *flag.FlagSet) {
+	visible := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	visible.SetOutput(fs.Output())
+	fs.VisitAll(func(f *flag.Flag) {
+		if hiddenFlags[f.Name] {
+			return
+		}
+		visible.Var(f.Value, f.Name, f.Usage)
+		visible.Lookup(f.Name).DefValue = f.DefValue
+	})
+	visible.PrintDefaults()
+}
+
+func parseFlags() {
+	RegisterFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] | <command>\n", os.Args[0])
+		printDefaults(flag.CommandLine)
+		fmt.Fprintf(flag.CommandLine.Output(), "Every flag but -stop can be set by an environment variable as well, e.g.\n"+
+			"  %s=debug for -log, or in the options of the config file. Flags take\n"+
+			"  precedence over the environment, the environment over the config file\n", envName("log"))
+		commandUsage()
+	}
+
+	flag.Parse()
+	cfg, err := loadSettings(flag.CommandLine, flagset, flagSources)
+	if err != nil {
+		invalidFlag(err.Error())
+	}
+	appName = filepath.Base(os.Args[0])
+	pidFile = appName + ".pid"
+	logFile = appName + ".log"
+	setSocketDir(socketDir)
+
+	if !hasUtilityFlag() {
+		checkRequiredFlags()
+		if problems := validateSettings(flagset); len(problems) > 0 {
+			invalidFlag(joinProblems(problems))
+		}
+	}
+
+	keymode, err = parseKeymode(keymodePin, flagset["touch"] && keymodeTouch)
+	if err != nil {
+		invalidFlag(fmt.Sprintf("Wrong value '%s' for pin", keymodePin))
+	}
+	if err := yubikey.SetDefaultDigest(digest); err != nil {
+		invalidFlag(fmt.Sprintf("Wrong value '%s' for digest", digest))
+	}
+	if err := yubikey.SetDefaultEncoding(sigEncoding); err != nil {
+		invalidFlag(fmt.Sprintf("Wrong value '%s' for signature-encoding", sigEncoding))
+	}
+	yubikey.SetDefaultLowS(lowS)
+	yubikey.SetTokenHashing(tokenHashing)
+	yubikey.SetFIPSMode(fips)
+	if err := yubikey.SetRetryPolicy(retries, retryBackoff); err != nil {
+		invalidFlag(err.Error())
+	}
+	if err := yubikey.SetTouchTimeout(touchTimeout); err != nil {
+		invalidFlag(err.Error())
+	}
+	if err := yubikey.SetSessionPool(sessionPool); err != nil {
+		invalidFlag(err.Error())
+	}
+	if err := yubikey.SetLoginTTL(loginTTL); err != nil {
+		invalidFlag(err.Error())
+	}
+	if idleTimeout < 0 {
+		invalidFlag(fmt.Sprintf("Invalid idle-timeout %s", idleTimeout))
+	}
+	if err := yubikey.SetKeyCache(keyCacheFile); err != nil {
+		invalidFlag(err.Error())
+	}
+	if libraryPath != "" {
+		if err := yubikey.SetLibrary(libraryPath); err != nil {
+			invalidFlag(err.Error())
+		}
+	}
+	if chaosSpec != "" {
+		if chaos, err = parseChaos(chaosSpec); err != nil {
+			invalidFlag(err.Error())
+		}
+	}
+
+	if configFile != "" {
+		config = cfg
+		signPolicy = newPolicy(config.Policy)
+	}
+	if auditFile == "" {
+		auditFile = appName + ".audit.log"
+	}
+
+	setLogLevel()
+	configuredLevel = logrus.GetLevel()
+}
+
+func socketExists() bool {
+	_, err := os.Stat(Socket)
+	return err == nil
+}
+
+func removeSocket() {
+	if socketExists() {
+		if err := os.Remove(Socket); err != nil {
+			logrus.Errorf("Could not remove socket: %v", err)
+		}
+	}
+}
+
+func cleanup(listener net.Listener) {
+	listener.Close()
+	ks.Cleanup()
+	removeSocket()
+	done <- true
+}
+
+func worker() {
+	if !noHarden {
+		if err := harden(lockMemory); err != nil {
+			logrus.Fatalf("Failed to harden the daemon: %v", err)
+		}
+	}
+	err := yubikey.SetYubikeyKeyMode(keymode)
+	if err != nil {
+		logrus.Fatalf("Failed to set Yubikey Keymode: %v", err)
+	}
+	ks, err = backend.New(backendName, config.Backends[backendName])
+	if err != nil {
+		logrus.Fatalf("Failed to set up backend: %v", err)
+	}
+	if chaosSpec != "" {
+		if ks, err = chaosMode(ks, chaos); err != nil {
+			logrus.Fatalf("Failed to set up chaos mode: %v", err)
+		}
+	}
+	if err := config.Secrets.loadVaultSecrets(); err != nil {
+		logrus.Errorf("Failed to load secrets: %v", err)
+	}
+	if err := openAuditLog(auditFile); err != nil {
+		logrus.Fatalf("Failed to open audit log: %v", err)
+	}
+	if auditExport != "" {
+		if err := exportAudit(auditExport); err != nil {
+			logrus.Fatalf("Failed to set up audit export: %v", err)
+		}
+	}
+	startWebhooks(config.Webhooks)
+	audit("startup", nil, logrus.Fields{"backend": backendName, "fips": fips}, nil)
+	_ = os.MkdirAll(socketDir, os.ModeDir)
+	listener, err := net.Listen("unix", Socket)
+	if err != nil {
+		logrus.Fatalf("Failed to create Socket. %v", err)
+	}
+	defer cleanup(listener)
+	adminListener, err := listenAdmin()
+	if err != nil {
+		logrus.Fatalf("Failed to create admin Socket. %v", err)
+	}
+	defer adminListener.Close()
+	if metricsAddr != "" {
+		metricsListener, err := serveMetrics(metricsAddr)
+		if err != nil {
+			logrus.Fatalf("Failed to serve metrics. %v", err)
+		}
+		defer metricsListener.Close()
+	}
+	if signerAddr != "" {
+		signerServer, err := serveSigner(signerAddr)
+		if err != nil {
+			logrus.Fatalf("Failed to serve the notary-signer API. %v", err)
+		}
+		defer signerServer.Stop()
+	}
+	privileged := []string{socketDir, Socket, AdminSocket}
+	if pprofEnabled {
+		pprofListener, err := servePprof(PprofSocket)
+		if err != nil {
+			logrus.Fatalf("Failed to create the pprof socket. %v", err)
+		}
+		defer os.Remove(PprofSocket)
+		defer pprofListener.Close()
+		privileged = append(privileged, PprofSocket)
+	}
+	if sshAgentSocket != "" {
+		sshListener, err := serveSSHAgent(sshAgentSocket)
+		if err != nil {
+			logrus.Fatalf("Failed to create the ssh-agent socket. %v", err)
+		}
+		defer os.Remove(sshAgentSocket)
+		defer sshListener.Close()
+		privileged = append(privileged, sshAgentSocket)
+	}
+	if runUser != "" {
+		if err := dropPrivileges(runUser, runGroup, privileged...); err != nil {
+			logrus.Fatalf("Failed to drop privileges: %v", err)
+		}
+		if !noHarden {
+			// changing the credentials resets the dumpable flag
+			if err := harden(false); err != nil {
+				logrus.Fatalf("Failed to harden the daemon: %v", err)
+			}
+		}
+	}
+	if sandboxMode {
+		// the daemon keeps the working directory it was started from, which
+		// is / under systemd, so only the directories of its files are listed
+		writable := []string{socketDir, stateDir, filepath.Dir(auditFile)}
+		for _, name := range []string{pidFile, logFile} {
+			if path, err := filepath.Abs(name); err == nil {
+				writable = append(writable, filepath.Dir(path))
+			}
+		}
+		if sshAgentSocket != "" {
+			writable = append(writable, filepath.Dir(sshAgentSocket))
+		}
+		if keyCacheFile != "" {
+			writable = append(writable, filepath.Dir(keyCacheFile))
+		}
+		if err := sandbox(writable, config.Secrets.needsExec() || len(config.AuthAlerts.Command) > 0); err != nil {
+			logrus.Fatalf("Failed to enter the sandbox: %v", err)
+		}
+	}
+	recoverSlots()
+	logrus.Infof("Starting Server...")
+	started = time.Now()
+	go watchCertExpiry(certExpiryInterval)
+	startResigning(config.Resign)
+	go Serve(listener)
+
+	// wait for termination
+	<-stop
+}
+
+// Serve accepts connections until the listener is closed. Every connection
+// gets its own rpc server, so the handlers know the peer they are serving
+func Serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logrus.Debugf("Stopped accepting connections: %v", err)
+			return
+		}
+		go ServeConn(conn)
+	}
+}
+
+// ServeConn serves the RPCs of a single connection until it is closed, then
+// closes the sessions the client left open
+func ServeConn(conn net.Conn) {
+	peer := peerCredentials(conn)
+	logrus.Infof("Accepted connection from %s", peer)
+	server := rpc.NewServer()
+	es := NewServer(peer)
+	if err := server.Register(es); err != nil {
+		logrus.Errorf("Failed to register server: %v", err)
+		conn.Close()
+		return
+	}
+	codec := newServerCodec(conn, peer)
+	codec.idle = watchIdle(idleTimeout, func() {
+		logrus.Infof("Closing the connection from %s, it sent no request for %s", peer, idleTimeout)
+		conn.Close()
+	})
+	server.ServeCodec(codec)
+	logrus.Debugf("Connection from %s closed", peer)
+	es.closeSessions()
+}
+
+func termHandler(sig os.Signal) error {
+	logrus.Infof("Terminating daemon")
+	stop <- true
+	if sig == syscall.SIGQUIT {
+		<-done
+	}
+	return daemon.ErrStop
+}
+
+// reloadHandler fetches the secrets kept in Vault again, e.g. after they
+// were rotated, and hands the section of the backend in the config file to
+// the backend again
+func reloadHandler(sig os.Signal) error {
+	logrus.Infof("Reloading secrets")
+	if err := config.Secrets.loadVaultSecrets(); err != nil {
+		logrus.Errorf("Failed to reload secrets: %v", err)
+	}
+	if reloader, ok := ks.(backend.Reloader); ok && configFile != "" {
+		cfg, err := loadConfig(configFile)
+		if err == nil {
+			err = reloader.Reload(cfg.Backends[backendName])
+		}
+		if err != nil {
+			logrus.Errorf("Failed to reload the config of backend %s: %v", backendName, err)
+		}
+	}
+	return nil
+}
+
+// Main runs the commands or, without one, the daemon as configured by the
+// command line, the environment and the config file. It is all the binary
+// in cmd/notary-yubikey-adapter does
+func Main() {
+	if isKMSPlugin(os.Args[0]) {
+		os.Exit(kmsPlugin(os.Args[1:], os.Stdin, os.Stdout))
+	}
+	if runCommand(os.Args[1:]) {
+		return
+	}
+	parseFlags()
+	daemon.AddCommand(daemon.BoolFlag(stopSignal), syscall.SIGTERM, termHandler)
+	daemon.AddCommand(nil, syscall.SIGHUP, reloadHandler)
+	daemon.AddCommand(nil, syscall.SIGUSR1, dumpHandler)
+	daemon.AddCommand(nil, syscall.SIGUSR2, debugHandler)
+
+	cntxt := &daemon.Context{
+		PidFileName: pidFile,
+		PidFilePerm: 0644,
+		LogFileName: logFile,
+		LogFilePerm: 0640,
+		WorkDir:     "./",
+		Umask:       027,
+	}
+
+	if len(daemon.ActiveFlags()) > 0 {
+		d, err := cntxt.Search()
+		if err != nil {
+			logrus.Fatalf("Unable send signal to the daemon: %v", err)
+		}
+		daemon.SendCommands(d)
+		return
+	}
+
+	d, err := cntxt.Reborn()
+	if err != nil {
+		logrus.Fatalf("Error: %v", err)
+	}
+	if d != nil {
+		fmt.Printf("Started Adapter, to stop the daemon use '%s -stop'\n", appName)
+		return
+	}
+	defer cntxt.Release()
+
+	logrus.Infof("daemon started")
+
+	go worker()
+
+	err = daemon.ServeSignals()
+	if err != nil {
+		logrus.Errorf("Error: %v", err)
+	}
+	logrus.Infof("daemon terminated")
+}
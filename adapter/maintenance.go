@@ -0,0 +1,125 @@
+package adapter
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/sirupsen/logrus"
+)
+
+const maintenanceUsage = "maintenance get | on [reason] | off"
+
+// maintenanceMode refuses all sign requests while operators work on the
+// tokens, e.g. swap them or change PINs
+type maintenanceMode struct {
+	sync.Mutex
+	on     bool
+	reason string
+	since  time.Time
+}
+
+var maintenance = &maintenanceMode{}
+
+func (m *maintenanceMode) set(on bool, reason string, now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	m.on, m.reason, m.since = on, reason, now
+	if !on {
+		m.reason, m.since = "", time.Time{}
+	}
+}
+
+func (m *maintenanceMode) get() (bool, string, time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	return m.on, m.reason, m.since
+}
+
+// check fails with MAINTENANCE while the daemon is in maintenance mode
+func (m *maintenanceMode) check() error {
+	on, reason, since := m.get()
+	if !on {
+		return nil
+	}
+	if reason != "" {
+		return yubikey.NewError(yubikey.ErrCodeMaintenance, "signer in maintenance since %s: %s", since.Format(time.RFC3339), reason)
+	}
+	return yubikey.NewError(yubikey.ErrCodeMaintenance, "signer in maintenance since %s", since.Format(time.RFC3339))
+}
+
+type GetMaintenanceReq struct {
+}
+
+type GetMaintenanceRes struct {
+	On     bool
+	Reason string
+	Since  time.Time
+}
+
+type SetMaintenanceReq struct {
+	On     bool
+	Reason string
+}
+
+type SetMaintenanceRes struct {
+}
+
+// GetMaintenance tells whether the daemon is in maintenance mode
+func (s *AdminServer) GetMaintenance(req GetMaintenanceReq, res *GetMaintenanceRes) error {
+	res.On, res.Reason, res.Since = maintenance.get()
+	return nil
+}
+
+// SetMaintenance enters or leaves maintenance mode
+func (s *AdminServer) SetMaintenance(req SetMaintenanceReq, res *SetMaintenanceRes) error {
+	maintenance.set(req.On, req.Reason, time.Now())
+	audit("set_maintenance", s.peer, logrus.Fields{"on": req.On, "reason": req.Reason}, nil)
+	if req.On {
+		logrus.Warnf("Entered maintenance mode, sign requests are refused: %s", req.Reason)
+	} else {
+		logrus.Warnf("Left maintenance mode")
+	}
+	return nil
+}
+
+func maintenanceCommand(args []string) error {
+	if len(args) < 1 {
+		return usageError(maintenanceUsage)
+	}
+	switch args[0] {
+	case "get":
+		if len(args) != 1 {
+			return usageError(maintenanceUsage)
+		}
+		res := new(GetMaintenanceRes)
+		if err := adminCall("GetMaintenance", GetMaintenanceReq{}, res); err != nil {
+			return err
+		}
+		if jsonOutput() {
+			return printJSON(res)
+		}
+		if !res.On {
+			fmt.Println("off")
+			return nil
+		}
+		fmt.Printf("on since %s", res.Since.Format(time.RFC3339))
+		if res.Reason != "" {
+			fmt.Printf(": %s", res.Reason)
+		}
+		fmt.Println()
+		return nil
+	case "on":
+		req := SetMaintenanceReq{On: true, Reason: strings.Join(args[1:], " ")}
+		return adminCall("SetMaintenance", req, new(SetMaintenanceRes))
+	case "off":
+		if len(args) != 1 {
+			return usageError(maintenanceUsage)
+		}
+		return adminCall("SetMaintenance", SetMaintenanceReq{}, new(SetMaintenanceRes))
+	default:
+		return usageError(maintenanceUsage)
+	}
+}
@@ -0,0 +1,27 @@
+package adapter
+
+import (
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	m := &maintenanceMode{}
+	require.NoError(t, m.check())
+
+	since := time.Date(2019, 6, 18, 12, 0, 0, 0, time.UTC)
+	m.set(true, "swapping tokens", since)
+	err := m.check()
+	require.Equal(t, yubikey.ErrCodeMaintenance, yubikey.ErrorCodeOf(rpc.ServerError(err.Error())))
+	require.Contains(t, err.Error(), "swapping tokens")
+
+	m.set(false, "", since)
+	require.NoError(t, m.check())
+	on, reason, _ := m.get()
+	require.False(t, on)
+	require.Empty(t, reason)
+}
@@ -0,0 +1,125 @@
+package adapter
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// KeyStats counts the sign requests of a single key
+type KeyStats struct {
+	KeyID      string
+	Role       string
+	Signatures uint64
+	Failures   uint64
+	// LastSign is the time of the last successful signature
+	LastSign time.Time
+}
+
+// maxMetricKeys caps the keys counted on their own. Key IDs are resolved on
+// the token, but keys come and go, so the series of any further key are
+// counted under otherKeysID
+const maxMetricKeys = 256
+
+// otherKeysID is the key ID the keys beyond maxMetricKeys are counted under
+const otherKeysID = "other"
+
+// keyMetrics collects KeyStats by key ID
+type keyMetrics struct {
+	sync.Mutex
+	keys map[string]*KeyStats
+}
+
+var signMetrics = &keyMetrics{keys: make(map[string]*KeyStats)}
+
+// recordSign counts a sign request, err is the reason it failed or was denied.
+// keyID must be the ID of the key on the token, never one sent by a client
+func (m *keyMetrics) recordSign(keyID, role string, err error) {
+	m.Lock()
+	defer m.Unlock()
+	stats, ok := m.keys[keyID]
+	if !ok && len(m.keys) >= maxMetricKeys {
+		keyID, role = otherKeysID, ""
+		stats, ok = m.keys[keyID]
+	}
+	if !ok {
+		stats = &KeyStats{KeyID: keyID}
+		m.keys[keyID] = stats
+	}
+	stats.Role = role
+	if err != nil {
+		stats.Failures++
+		return
+	}
+	stats.Signatures++
+	stats.LastSign = time.Now()
+}
+
+// snapshot returns a copy of all KeyStats, sorted by key ID
+func (m *keyMetrics) snapshot() []KeyStats {
+	m.Lock()
+	defer m.Unlock()
+	keys := make([]KeyStats, 0, len(m.keys))
+	for _, stats := range m.keys {
+		keys = append(keys, *stats)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].KeyID < keys[j].KeyID })
+	return keys
+}
+
+// writeMetrics writes the metrics in the Prometheus text format
+func writeMetrics(w io.Writer, keys []KeyStats) {
+	metric := func(name, kind, help string, value func(KeyStats) string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s{key_id=\"%s\",role=\"%s\"} %s\n", name, labelValue(k.KeyID), labelValue(k.Role), value(k))
+		}
+	}
+	metric("notary_yubikey_signatures_total", "counter", "Signatures created, by key.", func(k KeyStats) string {
+		return fmt.Sprint(k.Signatures)
+	})
+	metric("notary_yubikey_sign_failures_total", "counter", "Sign requests which failed or were denied, by key.", func(k KeyStats) string {
+		return fmt.Sprint(k.Failures)
+	})
+	metric("notary_yubikey_last_sign_timestamp_seconds", "gauge", "Unix time of the last signature, by key.", func(k KeyStats) string {
+		if k.LastSign.IsZero() {
+			return "0"
+		}
+		return fmt.Sprintf("%.3f", float64(k.LastSign.UnixNano())/1e9)
+	})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// serveMetrics serves the metrics on addr until the listener is closed
+func serveMetrics(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, signMetrics.snapshot())
+		writeExpiryMetrics(w, certExpiries.snapshot(), time.Now(), certExpiryWindow)
+		writeResignMetrics(w, resignStatuses.snapshot())
+		writeAuthAlertMetrics(w, authAlerts)
+		writeLatencyMetrics(w, latencies)
+	})
+	go func() {
+		err := http.Serve(listener, mux)
+		logrus.Debugf("Stopped serving metrics: %v", err)
+	}()
+	return listener, nil
+}
@@ -0,0 +1,51 @@
+package adapter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyMetrics(t *testing.T) {
+	m := &keyMetrics{keys: make(map[string]*KeyStats)}
+	m.recordSign("b", "targets", nil)
+	m.recordSign("a", "root", errors.New("denied"))
+	m.recordSign("b", "targets", nil)
+
+	keys := m.snapshot()
+	require.Len(t, keys, 2)
+	require.Equal(t, "a", keys[0].KeyID)
+	require.Equal(t, uint64(1), keys[0].Failures)
+	require.True(t, keys[0].LastSign.IsZero())
+	require.Equal(t, uint64(2), keys[1].Signatures)
+	require.False(t, keys[1].LastSign.IsZero())
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, keys)
+	require.Contains(t, buf.String(), `notary_yubikey_signatures_total{key_id="b",role="targets"} 2`)
+	require.Contains(t, buf.String(), `notary_yubikey_sign_failures_total{key_id="a",role="root"} 1`)
+	require.Contains(t, buf.String(), `notary_yubikey_last_sign_timestamp_seconds{key_id="a",role="root"} 0`)
+}
+
+func TestKeyMetricsCardinality(t *testing.T) {
+	m := &keyMetrics{keys: make(map[string]*KeyStats)}
+	for i := 0; i < maxMetricKeys+10; i++ {
+		m.recordSign(fmt.Sprintf("key%d", i), "targets", nil)
+	}
+	m.recordSign("key0", "targets", nil)
+
+	keys := m.snapshot()
+	require.Len(t, keys, maxMetricKeys+1)
+	for _, k := range keys {
+		switch k.KeyID {
+		case otherKeysID:
+			require.Equal(t, uint64(10), k.Signatures)
+			require.Empty(t, k.Role)
+		case "key0":
+			require.Equal(t, uint64(2), k.Signatures)
+		}
+	}
+}
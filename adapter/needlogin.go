@@ -0,0 +1,52 @@
+package adapter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/miekg/pkcs11"
+)
+
+// NeedLoginConfig overrides the login type the backend reports for a
+// function. Keys are function names (addecdsakey, getecdsakey, sign,
+// hardwareremovekey), values are none, user or so
+type NeedLoginConfig map[string]string
+
+var (
+	needLoginFunctions = map[string]uint{
+		"addecdsakey":       wire.FunctionAddECDSAKey,
+		"getecdsakey":       wire.FunctionGetECDSAKey,
+		"sign":              wire.FunctionSign,
+		"hardwareremovekey": wire.FunctionHardwareRemoveKey,
+	}
+	loginTypes = map[string]uint{
+		"user": pkcs11.CKU_USER,
+		"so":   pkcs11.CKU_SO,
+	}
+)
+
+func (cfg NeedLoginConfig) validate() error {
+	for function, login := range cfg {
+		if _, ok := needLoginFunctions[strings.ToLower(function)]; !ok {
+			return fmt.Errorf("need_login: unknown function %s", function)
+		}
+		if _, ok := loginTypes[strings.ToLower(login)]; !ok && strings.ToLower(login) != "none" {
+			return fmt.Errorf("need_login: invalid login type %s for %s, expected none, user or so", login, function)
+		}
+	}
+	return nil
+}
+
+// lookup returns the configured login for a function ID, ok is false if
+// the backend decides
+func (cfg NeedLoginConfig) lookup(functionID uint) (needed bool, userFlag uint, ok bool) {
+	for function, login := range cfg {
+		if needLoginFunctions[strings.ToLower(function)] != functionID {
+			continue
+		}
+		userFlag, needed = loginTypes[strings.ToLower(login)]
+		return needed, userFlag, true
+	}
+	return false, 0, false
+}
@@ -0,0 +1,29 @@
+package adapter
+
+import (
+	"testing"
+
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNeedLoginConfig(t *testing.T) {
+	cfg := NeedLoginConfig{"getecdsakey": "user", "HardwareRemoveKey": "none"}
+	require.NoError(t, cfg.validate())
+
+	needed, userFlag, ok := cfg.lookup(wire.FunctionGetECDSAKey)
+	require.True(t, ok)
+	require.True(t, needed)
+	require.Equal(t, uint(pkcs11.CKU_USER), userFlag)
+
+	needed, _, ok = cfg.lookup(wire.FunctionHardwareRemoveKey)
+	require.True(t, ok)
+	require.False(t, needed)
+
+	_, _, ok = cfg.lookup(wire.FunctionSign)
+	require.False(t, ok)
+
+	require.Error(t, NeedLoginConfig{"encrypt": "user"}.validate())
+	require.Error(t, NeedLoginConfig{"sign": "admin"}.validate())
+}
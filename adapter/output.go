@@ -0,0 +1,52 @@
+package adapter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// outputFormat is set with the global -output flag of the commands
+var outputFormat = "text"
+
+// parseGlobalFlags removes the flags shared by all commands from args, they
+// may be given before or after the command name. --json is short for
+// --output=json
+func parseGlobalFlags(args []string) ([]string, error) {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name := strings.TrimLeft(arg, "-")
+		switch {
+		case name == "output" && arg != name:
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("flag %s needs a value", arg)
+			}
+			i++
+			outputFormat = args[i]
+		case strings.HasPrefix(name, "output=") && arg != name:
+			outputFormat = strings.TrimPrefix(name, "output=")
+		case name == "json" && arg != name:
+			outputFormat = "json"
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	if outputFormat != "text" && outputFormat != "json" {
+		return nil, fmt.Errorf("unknown output format %q, expected text or json", outputFormat)
+	}
+	return rest, nil
+}
+
+// jsonOutput returns whether the command output has to be JSON
+func jsonOutput() bool {
+	return outputFormat == "json"
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
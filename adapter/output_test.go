@@ -0,0 +1,59 @@
+package adapter
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGlobalFlags(t *testing.T) {
+	defer func() { outputFormat = "text" }()
+
+	args, err := parseGlobalFlags([]string{"--output=json", "status"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"status"}, args)
+	require.True(t, jsonOutput())
+
+	args, err = parseGlobalFlags([]string{"keys", "list", "-output", "text"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"keys", "list"}, args)
+	require.False(t, jsonOutput())
+
+	args, err = parseGlobalFlags([]string{"selftest", "--json"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"selftest"}, args)
+	require.True(t, jsonOutput())
+
+	_, err = parseGlobalFlags([]string{"status", "--output=yaml"})
+	require.Error(t, err)
+	_, err = parseGlobalFlags([]string{"status", "--output"})
+	require.Error(t, err)
+}
+
+func TestCommandArgs(t *testing.T) {
+	defer func() { outputFormat = "text" }()
+
+	args, isCommand, err := commandArgs([]string{"status", "--json"})
+	require.NoError(t, err)
+	require.True(t, isCommand)
+	require.Equal(t, []string{"status"}, args)
+
+	_, isCommand, err = commandArgs([]string{"-config", "adapter.json"})
+	require.NoError(t, err)
+	require.False(t, isCommand)
+
+	// an invalid output format is a usage error, not a reason to start the
+	// daemon
+	_, _, err = commandArgs([]string{"status", "--output=yaml"})
+	require.Error(t, err)
+	_, _, err = commandArgs([]string{"--output=yaml"})
+	require.Error(t, err)
+}
+
+func TestBashCompletion(t *testing.T) {
+	var buf bytes.Buffer
+	writeBashCompletion(&buf, "notary-yubikey-adapter")
+	require.Contains(t, buf.String(), "complete -o default -F _notary_yubikey_adapter notary-yubikey-adapter\n")
+	require.Contains(t, buf.String(), `keys) COMPREPLY=($(compgen -W "import remove public renew-cert adopt list" -- "$cur")) ;;`)
+}
@@ -0,0 +1,36 @@
+package adapter
+
+import (
+	"fmt"
+)
+
+// peerCred identifies the process which is connected to the socket
+type peerCred struct {
+	UID uint32
+	GID uint32
+	PID int32
+	// Exe is the executable of the process, if it could be determined
+	Exe string
+	// Client is the common name of the certificate a client of the
+	// notary-signer API authenticated with. Such peers have no process
+	Client string
+}
+
+// local tells whether the peer is a process connected to the socket, whose
+// uid can be trusted
+func (p *peerCred) local() bool {
+	return p != nil && p.Client == ""
+}
+
+func (p *peerCred) String() string {
+	if p == nil {
+		return "unknown peer"
+	}
+	if p.Client != "" {
+		return fmt.Sprintf("client=%s", p.Client)
+	}
+	if p.Exe != "" {
+		return fmt.Sprintf("uid=%d gid=%d pid=%d exe=%s", p.UID, p.GID, p.PID, p.Exe)
+	}
+	return fmt.Sprintf("uid=%d gid=%d pid=%d", p.UID, p.GID, p.PID)
+}
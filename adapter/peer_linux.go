@@ -0,0 +1,34 @@
+// +build linux
+
+package adapter
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// peerCredentials returns the credentials of the process on the other end
+// of a unix socket connection, using SO_PEERCRED
+func peerCredentials(conn net.Conn) *peerCred {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return nil
+	}
+	// reading the link of a process of another user needs privileges, the
+	// executable stays unknown then
+	exe, _ := os.Readlink(fmt.Sprintf("/proc/%d/exe", cred.Pid))
+	return &peerCred{UID: cred.Uid, GID: cred.Gid, PID: cred.Pid, Exe: exe}
+}
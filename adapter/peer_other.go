@@ -0,0 +1,12 @@
+// +build !linux
+
+package adapter
+
+import (
+	"net"
+)
+
+// peerCredentials is only implemented on linux
+func peerCredentials(conn net.Conn) *peerCred {
+	return nil
+}
@@ -0,0 +1,300 @@
+package adapter
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/sirupsen/logrus"
+)
+
+// PolicyConfig restricts which signatures the daemon is willing to create.
+// An empty policy allows everything
+type PolicyConfig struct {
+	// Keys maps notary key IDs to their policy
+	Keys map[string]KeyPolicy `json:"keys"`
+	// Roles maps role names to their policy
+	Roles map[string]RolePolicy `json:"roles"`
+	// StrictKeyAge refuses to sign with keys older than the max_key_age of
+	// their role or of unknown age, otherwise old keys are only flagged in
+	// the log
+	StrictKeyAge bool `json:"strict_key_age"`
+	// Manage restricts who may have the daemon obtain the management key
+	// configured in the secrets section. Nobody may if it is empty
+	Manage ManagePolicy `json:"manage"`
+}
+
+// ManagePolicy restricts the management of keys with the management key
+// of the secrets section. Clients sending the management key themselves
+// are not restricted, except for the ones of the notary-signer API
+type ManagePolicy struct {
+	// UIDs of the peers allowed to add, remove, adopt and renew keys
+	UIDs []uint32 `json:"uids"`
+	// Clients are the common names of the client certificates of the
+	// notary-signer API allowed to create and delete keys
+	Clients []string `json:"clients"`
+}
+
+// KeyPolicy restricts the usage of a single key
+type KeyPolicy struct {
+	// Roles the key may sign for, all roles if empty
+	Roles []string `json:"roles"`
+	// MaxSignaturesPerHour limits the signatures in any sliding hour, 0 means unlimited
+	MaxSignaturesPerHour int `json:"max_signatures_per_hour"`
+}
+
+// RolePolicy restricts the signing for a role
+type RolePolicy struct {
+	// UIDs of the peers allowed to sign for the role, everybody if empty
+	UIDs []uint32 `json:"uids"`
+	// TimeWindows in local time in which signing is allowed, e.g. "08:00-18:00".
+	// Always allowed if empty
+	TimeWindows []string `json:"time_windows"`
+	// MaxKeyAge after which keys of the role should be rotated, e.g. "8760h".
+	// Keys may be used indefinitely if empty
+	MaxKeyAge string `json:"max_key_age"`
+	// Devices the keys of the role must be stored on, given by alias or
+	// serial number. Any device may be used if empty
+	Devices []string `json:"devices"`
+}
+
+type timeWindow struct {
+	from, to time.Duration
+}
+
+// policy evaluates a PolicyConfig and keeps track of the signatures made
+type policy struct {
+	cfg     PolicyConfig
+	windows map[string][]timeWindow
+	maxAges map[string]time.Duration
+	now     func() time.Time
+
+	mu    sync.Mutex
+	signs map[string][]time.Time
+}
+
+var signPolicy = newPolicy(PolicyConfig{})
+
+func newPolicy(cfg PolicyConfig) *policy {
+	p := &policy{
+		cfg:     cfg,
+		windows: make(map[string][]timeWindow),
+		maxAges: make(map[string]time.Duration),
+		now:     time.Now,
+		signs:   make(map[string][]time.Time),
+	}
+	for role, rp := range cfg.Roles {
+		for _, w := range rp.TimeWindows {
+			// validated by PolicyConfig.validate
+			tw, _ := parseTimeWindow(w)
+			p.windows[role] = append(p.windows[role], tw)
+		}
+		if rp.MaxKeyAge != "" {
+			// validated by PolicyConfig.validate
+			p.maxAges[role], _ = time.ParseDuration(rp.MaxKeyAge)
+		}
+	}
+	return p
+}
+
+func (cfg PolicyConfig) validate() error {
+	for role, rp := range cfg.Roles {
+		for _, w := range rp.TimeWindows {
+			if _, err := parseTimeWindow(w); err != nil {
+				return fmt.Errorf("policy for role %s: %v", role, err)
+			}
+		}
+		if rp.MaxKeyAge != "" {
+			if age, err := time.ParseDuration(rp.MaxKeyAge); err != nil || age <= 0 {
+				return fmt.Errorf("policy for role %s: invalid max_key_age %q, expected a positive duration like 8760h", role, rp.MaxKeyAge)
+			}
+		}
+		for _, d := range rp.Devices {
+			if d == "" {
+				return fmt.Errorf("policy for role %s: empty device", role)
+			}
+		}
+	}
+	for keyID, kp := range cfg.Keys {
+		if kp.MaxSignaturesPerHour < 0 {
+			return fmt.Errorf("policy for key %s: max_signatures_per_hour must not be negative", keyID)
+		}
+	}
+	return nil
+}
+
+// parseTimeWindow parses "HH:MM-HH:MM". Windows may wrap around midnight
+func parseTimeWindow(w string) (timeWindow, error) {
+	parts := strings.Split(w, "-")
+	if len(parts) != 2 {
+		return timeWindow{}, fmt.Errorf("invalid time window %q, expected HH:MM-HH:MM", w)
+	}
+	var bounds [2]time.Duration
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return timeWindow{}, fmt.Errorf("invalid time window %q, expected HH:MM-HH:MM", w)
+		}
+		bounds[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return timeWindow{from: bounds[0], to: bounds[1]}, nil
+}
+
+func (w timeWindow) contains(t time.Time) bool {
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.from <= w.to {
+		return d >= w.from && d < w.to
+	}
+	return d >= w.from || d < w.to
+}
+
+// authorizeSign decides whether peer may sign with keyID for role. An allowed
+// signature reserves its place in the rate limit of the key right away, so
+// concurrent requests can not exceed it. The returned release gives the place
+// back, it has to be called if the signature is not made after all
+func (p *policy) authorizeSign(peer *peerCred, keyID string, role string) (release func(), err error) {
+	now := p.now()
+
+	if kp, ok := p.cfg.Keys[keyID]; ok && len(kp.Roles) > 0 && !containsString(kp.Roles, role) {
+		return nil, yubikey.NewError(yubikey.ErrCodePolicyDenied, "key %s may not sign for role %s", describeKey(keyID), role)
+	}
+
+	if rp, ok := p.cfg.Roles[role]; ok {
+		if len(rp.UIDs) > 0 && (!peer.local() || !containsUID(rp.UIDs, peer.UID)) {
+			return nil, yubikey.NewError(yubikey.ErrCodePolicyDenied, "%s may not sign for role %s", peer, role)
+		}
+		if windows := p.windows[role]; len(windows) > 0 {
+			inWindow := false
+			for _, w := range windows {
+				inWindow = inWindow || w.contains(now)
+			}
+			if !inWindow {
+				return nil, yubikey.NewError(yubikey.ErrCodePolicyDenied, "signing for role %s is not allowed at this time", role)
+			}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	recent := p.recentSigns(keyID, now)
+	if kp, ok := p.cfg.Keys[keyID]; ok && kp.MaxSignaturesPerHour > 0 && len(recent) >= kp.MaxSignaturesPerHour {
+		return nil, yubikey.NewError(yubikey.ErrCodePolicyDenied, "key %s exceeded %d signatures per hour", describeKey(keyID), kp.MaxSignaturesPerHour)
+	}
+	p.signs[keyID] = append(recent, now)
+	var once sync.Once
+	return func() { once.Do(func() { p.releaseSign(keyID, now) }) }, nil
+}
+
+// releaseSign gives back the place in the rate limit of keyID reserved at
+// reserved
+func (p *policy) releaseSign(keyID string, reserved time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	signs := p.signs[keyID]
+	for i, t := range signs {
+		if t.Equal(reserved) {
+			p.signs[keyID] = append(signs[:i:i], signs[i+1:]...)
+			return
+		}
+	}
+}
+
+// recentSigns drops the signatures of keyID older than an hour and returns
+// the others. p.mu has to be held
+func (p *policy) recentSigns(keyID string, now time.Time) []time.Time {
+	var recent []time.Time
+	for _, t := range p.signs[keyID] {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(p.signs, keyID)
+	} else {
+		p.signs[keyID] = recent
+	}
+	return recent
+}
+
+// authorizeManage decides whether peer may manage keys with the management
+// key the daemon obtains on its own
+func (p *policy) authorizeManage(peer *peerCred) error {
+	if peer.local() && containsUID(p.cfg.Manage.UIDs, peer.UID) {
+		return nil
+	}
+	if peer != nil && peer.Client != "" {
+		if containsString(p.cfg.Manage.Clients, peer.Client) {
+			return nil
+		}
+		return yubikey.NewError(yubikey.ErrCodePolicyDenied, "%s may not manage keys", peer)
+	}
+	return yubikey.NewError(yubikey.ErrCodePolicyDenied, "%s may not manage keys with the configured management key, send it with the request", peer)
+}
+
+// checkKeyAge flags keys which are older than the policy of their role
+// allows and refuses them in strict mode. created is zero if the age of the
+// key is unknown, strict mode refuses such keys as well
+func (p *policy) checkKeyAge(keyID, role string, created time.Time) error {
+	maxAge, ok := p.maxAges[role]
+	if !ok {
+		return nil
+	}
+	if created.IsZero() {
+		if p.cfg.StrictKeyAge {
+			return yubikey.NewError(yubikey.ErrCodePolicyDenied, "the age of key %s is unknown, role %s allows at most %s", describeKey(keyID), role, maxAge)
+		}
+		return nil
+	}
+	age := p.now().Sub(created)
+	if age <= maxAge {
+		return nil
+	}
+	if p.cfg.StrictKeyAge {
+		return yubikey.NewError(yubikey.ErrCodePolicyDenied, "key %s is %s old, role %s allows at most %s, rotate the key", describeKey(keyID), age.Truncate(time.Hour), role, maxAge)
+	}
+	logrus.Warnf("Key %s is %s old, role %s allows at most %s, it should be rotated", describeKey(keyID), age.Truncate(time.Hour), role, maxAge)
+	return nil
+}
+
+// bindsDevice tells whether the keys of role are bound to specific devices
+func (p *policy) bindsDevice(role string) bool {
+	return len(p.cfg.Roles[role].Devices) > 0
+}
+
+// checkDevice refuses keys of role on a device the role is not bound to.
+// serial is empty if the device is unknown, which is refused for bound roles
+func (p *policy) checkDevice(role, serial string) error {
+	devices := p.cfg.Roles[role].Devices
+	if len(devices) == 0 {
+		return nil
+	}
+	for _, d := range devices {
+		if serial != "" && resolveDevice(d) == serial {
+			return nil
+		}
+	}
+	if serial == "" {
+		return yubikey.NewError(yubikey.ErrCodePolicyDenied, "role %s is bound to the devices %s, but the device in use is unknown", role, strings.Join(devices, ", "))
+	}
+	return yubikey.NewError(yubikey.ErrCodePolicyDenied, "role %s is bound to the devices %s, not to %s", role, strings.Join(devices, ", "), deviceName(serial))
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsUID(list []uint32, uid uint32) bool {
+	for _, e := range list {
+		if e == uid {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,254 @@
+package adapter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// authorize runs p.authorizeSign and keeps the place of allowed signatures
+func authorize(p *policy, peer *peerCred, keyID, role string) error {
+	_, err := p.authorizeSign(peer, keyID, role)
+	return err
+}
+
+func TestPolicyKeyRoles(t *testing.T) {
+	p := newPolicy(PolicyConfig{Keys: map[string]KeyPolicy{"abc": {Roles: []string{"root"}}}})
+	require.NoError(t, authorize(p, nil, "abc", "root"))
+	err := authorize(p, nil, "abc", "targets")
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(err))
+	require.NoError(t, authorize(p, nil, "other", "targets"))
+}
+
+func TestPolicyRoleUIDsAndWindows(t *testing.T) {
+	cfg := PolicyConfig{Roles: map[string]RolePolicy{
+		"root": {UIDs: []uint32{1000}, TimeWindows: []string{"22:00-02:00"}},
+	}}
+	require.NoError(t, cfg.validate())
+	p := newPolicy(cfg)
+	p.now = func() time.Time { return time.Date(2019, 6, 18, 23, 30, 0, 0, time.Local) }
+
+	require.NoError(t, authorize(p, &peerCred{UID: 1000}, "abc", "root"))
+	require.Error(t, authorize(p, &peerCred{UID: 0}, "abc", "root"))
+	require.Error(t, authorize(p, nil, "abc", "root"))
+
+	p.now = func() time.Time { return time.Date(2019, 6, 18, 12, 0, 0, 0, time.Local) }
+	require.Error(t, authorize(p, &peerCred{UID: 1000}, "abc", "root"))
+
+	require.Error(t, PolicyConfig{Roles: map[string]RolePolicy{"root": {TimeWindows: []string{"8-18"}}}}.validate())
+}
+
+func TestPolicyRateLimit(t *testing.T) {
+	p := newPolicy(PolicyConfig{Keys: map[string]KeyPolicy{"abc": {MaxSignaturesPerHour: 2}}})
+	now := time.Date(2019, 6, 18, 12, 0, 0, 0, time.Local)
+	p.now = func() time.Time { return now }
+
+	// signatures which were not made give their place back
+	for i := 0; i < 3; i++ {
+		release, err := p.authorizeSign(nil, "abc", "targets")
+		require.NoError(t, err)
+		release()
+		release()
+	}
+	require.NoError(t, authorize(p, nil, "abc", "targets"))
+	require.NoError(t, authorize(p, nil, "abc", "targets"))
+	require.Error(t, authorize(p, nil, "abc", "targets"))
+
+	now = now.Add(time.Hour)
+	require.NoError(t, authorize(p, nil, "abc", "targets"))
+}
+
+// failingSignBackend refuses every PIN but 123456
+type failingSignBackend struct {
+	*sessionBackend
+}
+
+func (b *failingSignBackend) SignWithOptions(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string, payload []byte, opts backend.SignOptions) ([]byte, error) {
+	if passwd != "123456" {
+		return nil, yubikey.NewError(yubikey.ErrCodeWrongPin, "wrong PIN")
+	}
+	return b.sessionBackend.SignWithOptions(session, hwslot, passwd, payload, opts)
+}
+
+func TestFailedSignsKeepRateLimit(t *testing.T) {
+	defer func(old backend.Backend) { ks = old }(ks)
+	ks = &failingSignBackend{&sessionBackend{using: make(map[pkcs11.SessionHandle]int)}}
+	defer func(old *policy) { signPolicy = old }(signPolicy)
+	signPolicy = newPolicy(PolicyConfig{Keys: map[string]KeyPolicy{"def": {MaxSignaturesPerHour: 1}}})
+	s := NewServer(&peerCred{UID: 1000})
+	require.NoError(t, s.SetupHSMEnv(wire.ESSetupHSMEnvReq{}, new(wire.ESSetupHSMEnvRes)))
+	defer s.Cleanup(wire.ESCleanupReq{Session: 1}, nil)
+
+	req := SignReq{Session: 1, Slot: wire.HardwareSlot{SlotID: []byte{3}}, Pass: "000000", Payload: []byte("payload")}
+	for i := 0; i < 3; i++ {
+		err := s.Sign(req, new(wire.ESSignRes))
+		require.Equal(t, yubikey.ErrCodeWrongPin, yubikey.ErrorCodeOf(err))
+	}
+	req.Pass = "123456"
+	require.NoError(t, s.Sign(req, new(wire.ESSignRes)))
+	err := s.Sign(req, new(wire.ESSignRes))
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(err))
+}
+
+func TestPolicyKeyAge(t *testing.T) {
+	cfg := PolicyConfig{Roles: map[string]RolePolicy{"root": {MaxKeyAge: "8760h"}}}
+	require.NoError(t, cfg.validate())
+	now := time.Date(2019, 6, 18, 12, 0, 0, 0, time.Local)
+	p := newPolicy(cfg)
+	p.now = func() time.Time { return now }
+
+	require.NoError(t, p.checkKeyAge("abc", "root", now.AddDate(0, -6, 0)))
+	require.NoError(t, p.checkKeyAge("abc", "root", now.AddDate(-2, 0, 0)))
+	require.NoError(t, p.checkKeyAge("abc", "root", time.Time{}))
+	require.NoError(t, p.checkKeyAge("abc", "targets", now.AddDate(-2, 0, 0)))
+
+	cfg.StrictKeyAge = true
+	p = newPolicy(cfg)
+	p.now = func() time.Time { return now }
+	require.NoError(t, p.checkKeyAge("abc", "root", now.AddDate(0, -6, 0)))
+	err := p.checkKeyAge("abc", "root", now.AddDate(-2, 0, 0))
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(err))
+	err = p.checkKeyAge("abc", "root", time.Time{})
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(err))
+	require.NoError(t, p.checkKeyAge("abc", "targets", time.Time{}))
+
+	require.Error(t, PolicyConfig{Roles: map[string]RolePolicy{"root": {MaxKeyAge: "1y"}}}.validate())
+}
+
+func TestPolicyDevices(t *testing.T) {
+	defer func(devices DevicesConfig) { config.Devices = devices }(config.Devices)
+	config.Devices = DevicesConfig{"1234567": "ceremony"}
+	cfg := PolicyConfig{Roles: map[string]RolePolicy{"root": {Devices: []string{"ceremony"}}, "targets": {Devices: []string{"7654321"}}}}
+	require.NoError(t, cfg.validate())
+	p := newPolicy(cfg)
+
+	require.True(t, p.bindsDevice("root"))
+	require.False(t, p.bindsDevice("snapshot"))
+	require.NoError(t, p.checkDevice("root", "1234567"))
+	require.NoError(t, p.checkDevice("targets", "7654321"))
+	require.NoError(t, p.checkDevice("snapshot", "7654321"))
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(p.checkDevice("root", "7654321")))
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(p.checkDevice("targets", "1234567")))
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(p.checkDevice("root", "")))
+
+	require.Error(t, PolicyConfig{Roles: map[string]RolePolicy{"root": {Devices: []string{""}}}}.validate())
+}
+
+func TestPolicyManage(t *testing.T) {
+	p := newPolicy(PolicyConfig{})
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(p.authorizeManage(&peerCred{UID: 0})))
+
+	p = newPolicy(PolicyConfig{Manage: ManagePolicy{UIDs: []uint32{1000}}})
+	require.NoError(t, p.authorizeManage(&peerCred{UID: 1000}))
+	require.Error(t, p.authorizeManage(&peerCred{UID: 1001}))
+	require.Error(t, p.authorizeManage(nil))
+
+	p = newPolicy(PolicyConfig{Manage: ManagePolicy{UIDs: []uint32{0}, Clients: []string{"notary-server"}}})
+	require.NoError(t, p.authorizeManage(&peerCred{Client: "notary-server"}))
+	require.Error(t, p.authorizeManage(&peerCred{Client: "other"}))
+	// clients of the notary-signer API have no uid
+	require.NoError(t, p.authorizeManage(&peerCred{UID: 0}))
+	p = newPolicy(PolicyConfig{Roles: map[string]RolePolicy{"root": {UIDs: []uint32{0}}}})
+	require.Error(t, authorize(p, &peerCred{Client: "notary-server"}, "abc", "root"))
+}
+
+func TestManagementKeyFromSecrets(t *testing.T) {
+	defer func(secrets SecretsConfig) { config.Secrets = secrets }(config.Secrets)
+	config.Secrets = SecretsConfig{SecretManagementKey: {Askpass: "/bin/echo"}}
+	defer func(old *policy) { signPolicy = old }(signPolicy)
+	signPolicy = newPolicy(PolicyConfig{Manage: ManagePolicy{UIDs: []uint32{1000}}})
+
+	_, err := NewServer(&peerCred{UID: 1001}).managementKey("")
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(err))
+	key, err := NewServer(&peerCred{UID: 1001}).managementKey("sent")
+	require.NoError(t, err)
+	require.Equal(t, yubikey.Secret("sent"), key)
+	key, err = NewServer(&peerCred{UID: 1000}).managementKey("")
+	require.NoError(t, err)
+	require.Equal(t, yubikey.Secret("Enter the management key for the yubikey:"), key)
+}
+
+// renewingBackend counts the certificate requests it signed
+type renewingBackend struct {
+	*sessionBackend
+	backend.CertRenewer
+	requests int
+}
+
+func (b *renewingBackend) CertificateRequest(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string) ([]byte, error) {
+	b.requests++
+	return []byte("csr"), nil
+}
+
+func TestCertificateRequestNeedsManage(t *testing.T) {
+	renewer := &renewingBackend{sessionBackend: &sessionBackend{using: make(map[pkcs11.SessionHandle]int)}}
+	defer func(old backend.Backend) { ks = old }(ks)
+	ks = renewer
+	defer func(old *policy) { signPolicy = old }(signPolicy)
+	signPolicy = newPolicy(PolicyConfig{
+		Manage: ManagePolicy{UIDs: []uint32{1000}},
+		Roles:  map[string]RolePolicy{"root": {UIDs: []uint32{1000}}},
+	})
+	req := RenewCertReq{Session: 1, KeyID: "abc", CSR: true, Pass: "123456"}
+
+	err := NewServer(&peerCred{UID: 1001}).RenewCert(req, new(RenewCertRes))
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(err))
+	require.Zero(t, renewer.requests)
+
+	res := new(RenewCertRes)
+	require.NoError(t, NewServer(&peerCred{UID: 1000}).RenewCert(req, res))
+	require.Equal(t, []byte("csr"), res.CSR)
+	require.Equal(t, 1, renewer.requests)
+}
+
+// gatedSignBackend holds signatures until gate is closed
+type gatedSignBackend struct {
+	*sessionBackend
+	gate chan struct{}
+}
+
+func (b *gatedSignBackend) SignWithOptions(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string, payload []byte, opts backend.SignOptions) ([]byte, error) {
+	<-b.gate
+	return b.sessionBackend.SignWithOptions(session, hwslot, passwd, payload, opts)
+}
+
+func TestConcurrentSignsKeepRateLimit(t *testing.T) {
+	const limit, requests = 3, 10
+	gated := &gatedSignBackend{&sessionBackend{using: make(map[pkcs11.SessionHandle]int)}, make(chan struct{})}
+	defer func(old backend.Backend) { ks = old }(ks)
+	ks = gated
+	defer func(old *policy) { signPolicy = old }(signPolicy)
+	signPolicy = newPolicy(PolicyConfig{Keys: map[string]KeyPolicy{"def": {MaxSignaturesPerHour: limit}}})
+	s := NewServer(&peerCred{UID: 1000})
+	defer s.closeSessions()
+
+	// every request has a session of its own, so they do not queue up
+	// behind the signatures held by the backend
+	results := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		session := new(wire.ESSetupHSMEnvRes)
+		require.NoError(t, s.SetupHSMEnv(wire.ESSetupHSMEnvReq{}, session))
+		req := SignReq{Session: session.Session, Slot: wire.HardwareSlot{SlotID: []byte{3}}, Pass: "123456", Payload: []byte("payload")}
+		go func() { results <- s.Sign(req, new(wire.ESSignRes)) }()
+	}
+	// the requests over the limit are denied while the others are still
+	// waiting for the token
+	for i := 0; i < requests-limit; i++ {
+		select {
+		case err := <-results:
+			require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(err))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d requests over the limit were denied", i, requests-limit)
+		}
+	}
+	close(gated.gate)
+	for i := 0; i < limit; i++ {
+		require.NoError(t, <-results)
+	}
+}
@@ -0,0 +1,36 @@
+package adapter
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/sirupsen/logrus"
+)
+
+const pprofSocketName = "hardwarestore-pprof.sock"
+
+// PprofSocket serves net/http/pprof. Profiles reveal memory contents, so like
+// AdminSocket it is only accessible to the user running the daemon
+var PprofSocket = SocketPath + "/" + pprofSocketName
+
+// servePprof creates the pprof socket at path and serves the net/http/pprof
+// handlers on it until the listener is closed
+func servePprof(path string) (net.Listener, error) {
+	listener, err := listenPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	go func() {
+		err := http.Serve(listener, mux)
+		logrus.Debugf("Stopped serving pprof: %v", err)
+	}()
+	logrus.Warnf("Serving pprof on %s", path)
+	return listener, nil
+}
@@ -0,0 +1,174 @@
+package adapter
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+const preflightUsage = "preflight [-config <file>] [-backend <name>] [-pin-file <file>] [-management-key-file <file>] [-socket-dir <dir>]"
+
+// errPreflightFailed makes the preflight command exit with a failure
+var errPreflightFailed = errors.New("preflight check failed")
+
+// preflightJSON is the stable schema of preflight --json
+type preflightJSON struct {
+	SchemaVersion int         `json:"schema_version"`
+	OK            bool        `json:"ok"`
+	Checks        []checkJSON `json:"checks"`
+}
+
+// checkWritableDir tells whether files can be created in dir, or in its
+// parent if dir does not exist yet
+func checkWritableDir(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		dir = filepath.Dir(dir)
+	}
+	f, err := ioutil.TempFile(dir, ".preflight")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// runPreflight checks everything the daemon needs before it is started,
+// directly on the token. pin and managementKey are not tried if empty
+func runPreflight(store backend.Backend, pin, managementKey yubikey.Secret, socketDir string) []CheckResult {
+	var checks []CheckResult
+	add := func(name string, err error, detail string) {
+		if err != nil {
+			detail = err.Error()
+		}
+		checks = append(checks, CheckResult{Name: name, OK: err == nil, Detail: detail})
+	}
+	skip := func(detail string, names ...string) {
+		for _, name := range names {
+			checks = append(checks, CheckResult{Name: name, Detail: "skipped, " + detail})
+		}
+	}
+
+	add("socket_dir", checkWritableDir(socketDir), socketDir+" is writable")
+
+	preflighter, ok := store.(backend.Preflighter)
+	if !ok {
+		add("library", nil, "not supported by the backend")
+	} else {
+		lib, err := preflighter.LoadLibrary()
+		add("library", err, "loaded "+lib)
+		if err != nil {
+			skip("no library", "token", "user_pin", "management_key")
+			return checks
+		}
+	}
+
+	session, err := store.SetupHSMEnv()
+	detail := fmt.Sprintf("backend %s", store.Name())
+	if inspector, ok := store.(backend.TokenInspector); ok && err == nil {
+		if ti, err := inspector.TokenInfo(session); err == nil {
+			detail = fmt.Sprintf("%s serial %s, firmware %s", ti.Model, deviceName(ti.Serial), ti.Firmware)
+		}
+	}
+	add("token", err, detail)
+	if err != nil {
+		skip("no token", "user_pin", "management_key")
+		return checks
+	}
+	defer store.CloseSession(session)
+
+	credentials := []struct {
+		name   string
+		secret yubikey.Secret
+		check  func() error
+	}{
+		{"user_pin", pin, func() error { return preflighter.CheckUserPin(session, pin.Reveal()) }},
+		{"management_key", managementKey, func() error { return preflighter.CheckManagementKey(session, managementKey.Reveal()) }},
+	}
+	for _, c := range credentials {
+		switch {
+		case preflighter == nil:
+			add(c.name, nil, "not supported by the backend")
+		case c.secret == "":
+			checks = append(checks, CheckResult{Name: c.name, OK: true, Detail: "skipped, none given"})
+		default:
+			add(c.name, c.check(), "accepted")
+		}
+	}
+	return checks
+}
+
+// preflightCommand checks the setup on the token itself, so it is meant to
+// be run before the daemon is started
+func preflightCommand(args []string) error {
+	fs := flag.NewFlagSet("preflight", flag.ExitOnError)
+	cfgFile := fs.String("config", "", "Path to the JSON config file of the daemon")
+	name := fs.String("backend", "", "Backend to check, default: the backend of the config or yubikey")
+	pinFile := fs.String("pin-file", "", "File holding the PIN, default: the secret source of the config")
+	managementKeyFile := fs.String("management-key-file", "", "File holding the management key, default: the secret source of the config")
+	dir := fs.String("socket-dir", socketDir, "Directory the daemon creates its socket in")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return usageError(preflightUsage)
+	}
+
+	if *cfgFile != "" {
+		cfg, err := loadConfig(*cfgFile)
+		if err != nil {
+			return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "invalid config file '%s': %v", *cfgFile, err)
+		}
+		config = cfg
+	}
+	if *name == "" {
+		*name = "yubikey"
+		if config.Backend != "" {
+			*name = config.Backend
+		}
+	}
+	store, err := backend.New(*name, config.Backends[*name])
+	if err != nil {
+		return err
+	}
+	defer store.Cleanup()
+	if err := config.Secrets.loadVaultSecrets(); err != nil {
+		return err
+	}
+
+	pin, err := readSecretFlag(*pinFile)
+	if err == nil {
+		pin, err = config.Secrets.secret(SecretUserPin, pin)
+	}
+	if err != nil {
+		return err
+	}
+	managementKey, err := readSecretFlag(*managementKeyFile)
+	if err == nil {
+		managementKey, err = config.Secrets.secret(SecretManagementKey, managementKey)
+	}
+	if err != nil {
+		return err
+	}
+
+	checks := runPreflight(store, pin, managementKey, *dir)
+	ok := true
+	for _, c := range checks {
+		ok = ok && c.OK
+	}
+	if jsonOutput() {
+		err = printJSON(preflightJSON{SchemaVersion: statusSchemaVersion, OK: ok, Checks: newChecksJSON(checks)})
+	} else {
+		err = printChecks(checks)
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errPreflightFailed
+	}
+	return nil
+}
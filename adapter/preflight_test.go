@@ -0,0 +1,25 @@
+package adapter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckWritableDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preflight")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, checkWritableDir(dir))
+	// the daemon creates the socket directory if it is missing
+	require.NoError(t, checkWritableDir(filepath.Join(dir, "notary")))
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	require.Error(t, checkWritableDir(filepath.Join(dir, "missing", "notary")))
+}
@@ -0,0 +1,57 @@
+// +build linux
+
+package adapter
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dropPrivileges hands the sockets over to the given user and group and
+// switches to them. An empty group selects the primary group of the user.
+// It has to be called after all sockets and files needing root were opened
+func dropPrivileges(userName, groupName string, paths ...string) error {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range paths {
+		if err := os.Chown(path, uid, gid); err != nil {
+			return fmt.Errorf("could not chown %s: %v", path, err)
+		}
+	}
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("could not set groups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("could not set gid: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("could not set uid: %v", err)
+	}
+	logrus.Infof("Dropped privileges to uid %d, gid %d", uid, gid)
+	return nil
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package adapter
+
+import (
+	"fmt"
+)
+
+// dropPrivileges is only implemented on linux
+func dropPrivileges(userName, groupName string, paths ...string) error {
+	return fmt.Errorf("dropping privileges is only supported on linux")
+}
@@ -0,0 +1,319 @@
+package adapter
+
+import (
+	"bytes"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/stretchr/testify/require"
+)
+
+var updateProtocol = flag.Bool("update-protocol", false, "write the encodings of the current protocol version to testdata/protocol and the ones of new admin samples to testdata/admin")
+
+// The field values of the samples. The encodings of version 0 were recorded
+// with the externalstore types holding the same values
+var (
+	sampleSlot       = wire.HardwareSlot{Role: "root", SlotID: []byte{2}, KeyID: "abc"}
+	samplePrivateKey = wire.ESPrivateKey{Public: []byte("public"), Algorithm: "ecdsa", Private: []byte("private")}
+	sampleTime       = time.Date(2019, 4, 1, 12, 0, 0, 0, time.UTC)
+	sampleMeta       = RequestMeta{CorrelationID: "publish-1"}
+	sampleVersion    = wire.Version{ProtocolVersion: wire.ProtocolVersion}
+)
+
+// protocolSamples are the arguments and replies of the RPCs of ESServer. Each
+// maps the protocol versions to the value their encoding decodes to, the
+// versions which predate a type are left out. A new version adds the
+// current values, the ones of older versions must not change
+var protocolSamples = []map[uint]interface{}{
+	{
+		0: wire.ESNameReq{},
+		1: wire.ESNameReq{Version: sampleVersion},
+	},
+	{
+		0: wire.ESNameRes{Name: "yubikey"},
+		1: wire.ESNameRes{Version: sampleVersion, Name: "yubikey"},
+	},
+	{
+		0: AddECDSAKeyReq{Session: 1, PrivateKey: samplePrivateKey, Slot: sampleSlot, Pass: "010203", Role: "root"},
+		1: AddECDSAKeyReq{RequestMeta: sampleMeta, Version: sampleVersion, Session: 1, PrivateKey: samplePrivateKey, Slot: sampleSlot, Pass: "010203", Role: "root", PIVSlot: "9c", Overwrite: true},
+	},
+	{
+		0: wire.ESAddECDSAKeyRes{},
+		1: wire.ESAddECDSAKeyRes{Version: sampleVersion},
+	},
+	{
+		0: wire.ESGetECDSAKeyReq{Session: 1, Slot: sampleSlot, Pass: "123456"},
+		1: wire.ESGetECDSAKeyReq{Version: sampleVersion, Session: 1, Slot: sampleSlot, Pass: "123456"},
+	},
+	{
+		0: wire.ESGetECDSAKeyRes{PublicKey: wire.ESPublicKey{Public: []byte("public"), Algorithm: "ecdsa"}, Role: "root"},
+		1: wire.ESGetECDSAKeyRes{Version: sampleVersion, PublicKey: wire.ESPublicKey{Public: []byte("public"), Algorithm: "ecdsa"}, Role: "root"},
+	},
+	{
+		0: SignReq{Session: 1, Slot: sampleSlot, Pass: "123456", Payload: []byte("payload")},
+		1: SignReq{RequestMeta: sampleMeta, Version: sampleVersion, Session: 1, Slot: sampleSlot, Pass: "123456", Payload: []byte("payload"), DigestAlgorithm: "sha384", Prehashed: true, SignatureEncoding: "der", LowS: true, URI: "pkcs11:id=%02"},
+	},
+	{
+		0: wire.ESSignRes{Result: []byte("signature")},
+		1: wire.ESSignRes{Version: sampleVersion, Result: []byte("signature")},
+	},
+	{
+		0: HardwareRemoveKeyReq{Session: 1, Slot: sampleSlot, Pass: "010203", KeyID: "abc"},
+		1: HardwareRemoveKeyReq{RequestMeta: sampleMeta, Version: sampleVersion, Session: 1, Slot: sampleSlot, Pass: "010203", KeyID: "abc"},
+	},
+	{
+		0: wire.ESHardwareRemoveKeyRes{},
+		1: wire.ESHardwareRemoveKeyRes{Version: sampleVersion},
+	},
+	{
+		0: HardwareListKeysReq{Session: 1},
+		1: HardwareListKeysReq{RequestMeta: sampleMeta, Version: sampleVersion, Session: 1, Attestation: true},
+	},
+	{
+		0: HardwareListKeysRes{Keys: map[string]wire.HardwareSlot{"abc": sampleSlot}},
+		1: HardwareListKeysRes{
+			Version:         sampleVersion,
+			Keys:            map[string]wire.HardwareSlot{"abc": sampleSlot},
+			Attested:        map[string]bool{"abc": true},
+			NotAfter:        map[string]time.Time{"abc": sampleTime},
+			Devices:         map[string][]string{"abc": {"12345678"}},
+			DeviceAliases:   map[string]string{"12345678": "primary"},
+			PublicKeySHA256: map[string]string{"abc": "0123abcd"},
+		},
+	},
+	{
+		0: wire.ESGetNextEmptySlotReq{Session: 1},
+		1: wire.ESGetNextEmptySlotReq{Version: sampleVersion, Session: 1},
+	},
+	{
+		0: wire.ESGetNextEmptySlotRes{Slot: []byte{3}},
+		1: wire.ESGetNextEmptySlotRes{Version: sampleVersion, Slot: []byte{3}},
+	},
+	{
+		0: wire.ESSetupHSMEnvReq{},
+		1: wire.ESSetupHSMEnvReq{Version: sampleVersion},
+	},
+	{
+		0: wire.ESSetupHSMEnvRes{Session: 1},
+		1: wire.ESSetupHSMEnvRes{Version: sampleVersion, Session: 1},
+	},
+	{
+		0: wire.ESCleanupReq{Session: 1},
+		1: wire.ESCleanupReq{Version: sampleVersion, Session: 1},
+	},
+	{
+		0: wire.ESNeedLoginReq{Function_ID: wire.FunctionSign},
+		1: wire.ESNeedLoginReq{Version: sampleVersion, Function_ID: wire.FunctionSign},
+	},
+	{
+		0: wire.ESNeedLoginRes{NeedLogin: true, UserFlag: 1},
+		1: wire.ESNeedLoginRes{Version: sampleVersion, NeedLogin: true, UserFlag: 1},
+	},
+	{1: NegotiateReq{RequestMeta: sampleMeta, Version: sampleVersion, Client: "notary 0.6.1", Features: []string{FeaturePrehashed}, Required: []string{FeaturePrehashed}}},
+	{1: NegotiateRes{Version: sampleVersion, Backend: "yubikey", Features: []string{FeaturePrehashed}}},
+	{1: RemoveKeyReq{RequestMeta: sampleMeta, Version: sampleVersion, Session: 1, KeyID: "abc", Pass: "010203"}},
+	{1: RemoveKeyRes{Version: sampleVersion, Slot: sampleSlot}},
+	{1: GetPublicKeyReq{RequestMeta: sampleMeta, Version: sampleVersion, Session: 1, KeyID: "abc"}},
+	{1: GetPublicKeyRes{Version: sampleVersion, Role: "root", Slot: sampleSlot, PEM: []byte("pem")}},
+	{1: RenewCertReq{RequestMeta: sampleMeta, Version: sampleVersion, Session: 1, KeyID: "abc", Pass: "123456", ManagementKey: "010203", Validity: time.Hour, CSR: true, Certificate: []byte("der")}},
+	{1: RenewCertRes{Version: sampleVersion, NotAfter: sampleTime, CSR: []byte("csr")}},
+	{1: AdoptKeyReq{RequestMeta: sampleMeta, Version: sampleVersion, Session: 1, Slot: "9c", Role: "root", Pass: "123456", ManagementKey: "010203", Validity: time.Hour}},
+	{1: AdoptKeyRes{Version: sampleVersion, KeyID: "abc", OldCertificate: []byte("der")}},
+	{1: ThresholdSignReq{RequestMeta: sampleMeta, Version: sampleVersion, Payload: []byte("payload"), Threshold: 1, Keys: []ThresholdKey{{KeyID: "abc", Pass: "123456"}}, DigestAlgorithm: "sha256", Prehashed: true, SignatureEncoding: "raw", LowS: true}},
+	{1: ThresholdSignRes{Version: sampleVersion, Signatures: map[string][]byte{"abc": []byte("signature")}, Errors: map[string]string{"def": "[TOUCH_TIMEOUT] not touched"}}},
+	{1: AttestationReportReq{RequestMeta: sampleMeta, Version: sampleVersion, Session: 1, KeyID: "abc", Pass: "123456"}},
+	{1: AttestationReportRes{Version: sampleVersion, Report: SignedAttestationReport{Report: []byte("{}"), DigestAlgorithm: "sha256", Signature: []byte("signature")}}},
+}
+
+// sampleName names the encodings of a sample after its current type
+func sampleName(versions map[uint]interface{}) string {
+	return reflect.TypeOf(versions[wire.ProtocolVersion]).Name()
+}
+
+func TestProtocolSamples(t *testing.T) {
+	names := make(map[string]bool)
+	for _, versions := range protocolSamples {
+		current, ok := versions[wire.ProtocolVersion]
+		require.True(t, ok, "%v has no sample of version %d", versions, wire.ProtocolVersion)
+		name := sampleName(versions)
+		require.False(t, names[name], "%s has two samples", name)
+		names[name] = true
+		for version, sample := range versions {
+			require.Equal(t, reflect.TypeOf(current), reflect.TypeOf(sample), "%s version %d", name, version)
+		}
+	}
+	// every RPC of ESServer has samples of its argument and reply
+	server := reflect.TypeOf(&ESServer{})
+	for i := 0; i < server.NumMethod(); i++ {
+		method := server.Method(i).Type
+		if method.NumIn() != 3 || method.NumOut() != 1 {
+			continue
+		}
+		for _, arg := range []reflect.Type{method.In(1), method.In(2).Elem()} {
+			require.True(t, names[arg.Name()], "no sample of %s, the argument or reply of ESServer.%s", arg.Name(), server.Method(i).Name)
+			_, ok := reflect.New(arg).Interface().(wire.Versioned)
+			require.True(t, ok, "%s does not embed wire.Version", arg.Name())
+		}
+	}
+}
+
+func TestProtocolCompatibility(t *testing.T) {
+	if *updateProtocol {
+		dir := filepath.Join("testdata", "protocol", fmt.Sprintf("v%d", wire.ProtocolVersion))
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		for _, versions := range protocolSamples {
+			var buf bytes.Buffer
+			require.NoError(t, gob.NewEncoder(&buf).Encode(versions[wire.ProtocolVersion]))
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, sampleName(versions)+".gob"), buf.Bytes(), 0644))
+		}
+	}
+
+	for version := uint(0); version <= wire.ProtocolVersion; version++ {
+		for _, versions := range protocolSamples {
+			expected, ok := versions[version]
+			if !ok {
+				continue
+			}
+			name := fmt.Sprintf("v%d/%s.gob", version, sampleName(versions))
+			encoded, err := ioutil.ReadFile(filepath.Join("testdata", "protocol", name))
+			require.NoError(t, err, "run go test -run TestProtocolCompatibility -update-protocol to record new samples")
+			decoded := reflect.New(reflect.TypeOf(expected))
+			require.NoError(t, gob.NewDecoder(bytes.NewReader(encoded)).Decode(decoded.Interface()), name)
+			require.Equal(t, expected, decoded.Elem().Interface(), name)
+		}
+	}
+}
+
+// clientTypes are the types of package wire clients send or receive in place
+// of the extended types of the server, by the name of the latter
+var clientTypes = map[string]interface{}{
+	"AddECDSAKeyReq":       wire.ESAddECDSAKeyReq{},
+	"SignReq":              wire.ESSignReq{},
+	"HardwareRemoveKeyReq": wire.ESHardwareRemoveKeyReq{},
+	"HardwareListKeysReq":  wire.ESHardwareListKeysReq{},
+	"HardwareListKeysRes":  wire.ESHardwareListKeysRes{},
+}
+
+// TestClientTypesDecode checks that the recorded encodings of the extended
+// types decode into the client types and keep the fields they share
+func TestClientTypesDecode(t *testing.T) {
+	for version := uint(0); version <= wire.ProtocolVersion; version++ {
+		for _, versions := range protocolSamples {
+			expected, ok := versions[version]
+			client, isClient := clientTypes[sampleName(versions)]
+			if !ok || !isClient {
+				continue
+			}
+			name := fmt.Sprintf("v%d/%s.gob", version, sampleName(versions))
+			encoded, err := ioutil.ReadFile(filepath.Join("testdata", "protocol", name))
+			require.NoError(t, err)
+			decoded := reflect.New(reflect.TypeOf(client)).Elem()
+			require.NoError(t, gob.NewDecoder(bytes.NewReader(encoded)).Decode(decoded.Addr().Interface()), name)
+			for i := 0; i < decoded.NumField(); i++ {
+				field := decoded.Type().Field(i)
+				value := reflect.ValueOf(expected).FieldByName(field.Name)
+				require.True(t, value.IsValid(), "%s has no field %s", name, field.Name)
+				require.Equal(t, value.Convert(field.Type).Interface(), decoded.Field(i).Interface(), "%s field %s", name, field.Name)
+			}
+		}
+	}
+}
+
+// adminSamples are the arguments and replies of the RPCs of AdminServer. The
+// admin socket is not versioned, but the cli of an older release may talk to
+// a newer daemon, so their encodings are recorded once and must keep decoding
+var adminSamples = []interface{}{
+	ListApprovalsReq{},
+	ListApprovalsRes{Pending: []PendingApproval{{ID: "a1b2", KeyID: "abc", Role: "root", Peer: "uid=1000 pid=42", Digest: "0123abcd", Submitted: sampleTime}}},
+	DecideApprovalReq{ID: "a1b2", Approve: true},
+	DecideApprovalRes{},
+	GetKeymodeReq{},
+	GetKeymodeRes{Keymode: 3},
+	SetKeymodeReq{Pin: "always", Touch: true},
+	SetKeymodeRes{Keymode: 3},
+	FlushLoginReq{},
+	FlushLoginRes{WasLoggedIn: true},
+	GetLogLevelReq{},
+	GetLogLevelRes{Level: "debug", Configured: "error"},
+	SetLogLevelReq{Level: "debug"},
+	SetLogLevelRes{Level: "debug"},
+	GetMaintenanceReq{},
+	GetMaintenanceRes{On: true, Reason: "rotating keys", Since: sampleTime},
+	SetMaintenanceReq{On: true, Reason: "rotating keys"},
+	SetMaintenanceRes{},
+	SelfTestReq{},
+	SelfTestRes{Token: &sampleToken, TokenAlias: "primary", Checks: []CheckResult{{Name: "token", OK: true, Detail: "found"}}},
+	InjectFaultReq{Method: "Sign", Code: "TOUCH_TIMEOUT", Count: 2},
+	InjectFaultRes{Pending: []PendingFault{{Method: "Sign", Code: "TOUCH_TIMEOUT", Remaining: 2}}},
+	ListFaultsReq{},
+	ListFaultsRes{Pending: []PendingFault{{Code: "NO_TOKEN", Remaining: 1}}},
+	ClearFaultsReq{},
+	ClearFaultsRes{Cleared: 1},
+	StatusReq{},
+	StatusRes{
+		Backend:          "yubikey",
+		Keymode:          3,
+		FIPS:             true,
+		ReadOnly:         true,
+		Maintenance:      true,
+		ApprovalMode:     true,
+		PendingApprovals: 1,
+		Started:          sampleTime,
+		Keys:             []KeyStats{{KeyID: "abc", Role: "root", Signatures: 2, Failures: 1, LastSign: sampleTime}},
+		Token:            &sampleToken,
+		TokenError:       "not read",
+		TokenAlias:       "primary",
+		PublicKeySHA256:  map[string]string{"abc": "0123abcd"},
+		Latency:          []LatencyStats{{Operation: "sign", Count: 2, P50: time.Millisecond, P95: 2 * time.Millisecond, P99: 3 * time.Millisecond}},
+	},
+}
+
+var sampleToken = backend.TokenInfo{Serial: "12345678", Model: "YubiKey 5", Firmware: "5.4.3", FreeSlots: []string{"9d"}}
+
+func TestAdminSamples(t *testing.T) {
+	names := make(map[string]bool)
+	for _, sample := range adminSamples {
+		name := reflect.TypeOf(sample).Name()
+		require.False(t, names[name], "%s has two samples", name)
+		names[name] = true
+	}
+	server := reflect.TypeOf(&AdminServer{})
+	for i := 0; i < server.NumMethod(); i++ {
+		method := server.Method(i).Type
+		if method.NumIn() != 3 || method.NumOut() != 1 {
+			continue
+		}
+		for _, arg := range []reflect.Type{method.In(1), method.In(2).Elem()} {
+			require.True(t, names[arg.Name()], "no sample of %s, the argument or reply of AdminServer.%s", arg.Name(), server.Method(i).Name)
+		}
+	}
+}
+
+func TestAdminCompatibility(t *testing.T) {
+	dir := filepath.Join("testdata", "admin")
+	for _, sample := range adminSamples {
+		path := filepath.Join(dir, reflect.TypeOf(sample).Name()+".gob")
+		if _, err := os.Stat(path); os.IsNotExist(err) && *updateProtocol {
+			// a recorded encoding is never replaced, a changed one is
+			// what the test is there to catch
+			var buf bytes.Buffer
+			require.NoError(t, os.MkdirAll(dir, 0755))
+			require.NoError(t, gob.NewEncoder(&buf).Encode(sample))
+			require.NoError(t, ioutil.WriteFile(path, buf.Bytes(), 0644))
+		}
+		encoded, err := ioutil.ReadFile(path)
+		require.NoError(t, err, "run go test -run TestAdminCompatibility -update-protocol to record new samples")
+		decoded := reflect.New(reflect.TypeOf(sample))
+		require.NoError(t, gob.NewDecoder(bytes.NewReader(encoded)).Decode(decoded.Interface()), path)
+		require.Equal(t, sample, decoded.Elem().Interface(), path)
+	}
+}
@@ -0,0 +1,81 @@
+package adapter
+
+import (
+	"strings"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/sirupsen/logrus"
+)
+
+// repairSlots is set with -repair-slots, the comma separated PIV slots whose
+// repair the operator confirmed
+var repairSlots string
+
+// confirmedRepairs parses the slots of -repair-slots
+func confirmedRepairs(slots string) (map[string]bool, error) {
+	confirmed := make(map[string]bool)
+	for _, name := range strings.Split(slots, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		slotID, err := yubikey.ParseSlot(name)
+		if err != nil {
+			return nil, err
+		}
+		confirmed[yubikey.SlotName(slotID)] = true
+	}
+	return confirmed, nil
+}
+
+// recoverSlots looks for the slots an interrupted import left half
+// provisioned before the first request lists the keys. The slots named with
+// -repair-slots are cleared using the management key of the secrets config,
+// the others are quarantined
+func recoverSlots() {
+	recoverer, ok := ks.(backend.SlotRecoverer)
+	if !ok {
+		return
+	}
+	confirmed, err := confirmedRepairs(repairSlots)
+	if err != nil {
+		logrus.Warnf("Not repairing slots: %v", err)
+		confirmed = nil
+	}
+	pin, err := config.Secrets.secret(SecretUserPin, "")
+	if err != nil {
+		logrus.Warnf("Could not check the slots for leftovers, the PIN is unavailable: %v", err)
+		return
+	}
+	session, err := ks.SetupHSMEnv()
+	if err != nil {
+		logrus.Debugf("Could not check the slots for leftovers: %v", err)
+		return
+	}
+	defer ks.CloseSession(session)
+
+	var managementKey yubikey.Secret
+	if len(confirmed) > 0 {
+		if err := checkWritable("repairing slots"); err != nil {
+			logrus.Warnf("Not repairing slots: %v", err)
+		} else if managementKey, err = config.Secrets.secret(SecretManagementKey, ""); err != nil {
+			logrus.Warnf("Not repairing slots, the management key is unavailable: %v", err)
+			managementKey = ""
+		}
+	}
+	confirm := func(r backend.SlotRepair) bool {
+		if !confirmed[yubikey.SlotName(r.SlotID)] {
+			logrus.Warnf("Not repairing slot %s, its repair is not confirmed with -repair-slots", yubikey.SlotName(r.SlotID))
+			return false
+		}
+		return true
+	}
+	repairs, err := recoverer.RecoverSlots(session, pin.Reveal(), managementKey.Reveal(), confirm)
+	if err != nil {
+		logrus.Warnf("Could not check the slots for leftovers: %v", err)
+	}
+	for _, r := range repairs {
+		audit("slot_recovery", nil, logrus.Fields{"slot": yubikey.SlotName(r.SlotID), "problem": r.Problem, "repaired": r.Repaired}, nil)
+	}
+}
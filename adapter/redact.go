@@ -0,0 +1,42 @@
+package adapter
+
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// redactedFields are log fields which never hold anything but secrets
+var redactedFields = []string{"pin", "pass", "passwd", "password", "management_key", "secret", "private_key", "token", "secret_id"}
+
+// redactHook replaces the values of redactedFields in every log entry, in
+// case a secret is logged as a plain string
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	for key := range entry.Data {
+		if isRedactedField(key) {
+			entry.Data[key] = "[redacted]"
+		}
+	}
+	return nil
+}
+
+func isRedactedField(key string) bool {
+	key = strings.ToLower(key)
+	for _, f := range redactedFields {
+		if key == f {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	logrus.AddHook(redactHook{})
+	auditLog.AddHook(redactHook{})
+}
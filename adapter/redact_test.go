@@ -0,0 +1,65 @@
+package adapter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// leakPin and leakKey are fixtures which must never show up in any output
+const (
+	leakPin = "271828"
+	leakKey = "\x31\x41\x59\x26\x53\x58\x97\x93"
+)
+
+// captureLogs redirects logger into a buffer until restore is called
+func captureLogs(logger *logrus.Logger, formatter logrus.Formatter) (buf *bytes.Buffer, restore func()) {
+	buf = new(bytes.Buffer)
+	out, level, oldFormatter := logger.Out, logger.Level, logger.Formatter
+	logger.Out, logger.Level, logger.Formatter = buf, logrus.TraceLevel, formatter
+	return buf, func() { logger.Out, logger.Level, logger.Formatter = out, level, oldFormatter }
+}
+
+func requireNoLeak(t *testing.T, out string) {
+	require.NotContains(t, out, leakPin)
+	require.NotContains(t, out, leakKey)
+	require.NotContains(t, out, fmt.Sprintf("%x", leakKey))
+}
+
+func TestSecretsAreRedacted(t *testing.T) {
+	pin := yubikey.Secret(leakPin)
+	key := yubikey.SecureBytes(leakKey)
+	req := SignReq{Slot: wire.HardwareSlot{KeyID: "abc"}, Pass: pin, Payload: []byte("payload")}
+
+	var out bytes.Buffer
+	for _, verb := range []string{"%s", "%v", "%+v", "%#v", "%q", "%x", "%d"} {
+		fmt.Fprintf(&out, verb+" "+verb+" "+verb+"\n", pin, key, req)
+	}
+	out.WriteString(fmt.Errorf("login with %v failed", pin).Error())
+	out.WriteString(yubikey.WrapError(yubikey.ErrCodeWrongPin, fmt.Errorf("pin %s, key %x", pin, key)).Error())
+	requireNoLeak(t, out.String())
+	require.Equal(t, leakPin, pin.Reveal())
+}
+
+func TestLogsAreRedacted(t *testing.T) {
+	for _, formatter := range []logrus.Formatter{&logrus.TextFormatter{DisableColors: true}, &logrus.JSONFormatter{}} {
+		buf, restore := captureLogs(logrus.StandardLogger(), formatter)
+		logrus.WithField("pin", leakPin).WithField("management_key", leakPin).Info("login")
+		logrus.WithField("request", SignReq{Pass: yubikey.Secret(leakPin)}).Info("sign")
+		logrus.WithField("key", yubikey.SecureBytes(leakKey)).Info("import")
+		restore()
+		requireNoLeak(t, buf.String())
+		require.Contains(t, buf.String(), "[redacted]")
+
+		buf, restore = captureLogs(auditLog, formatter)
+		audit("sign", &peerCred{UID: 1}, logrus.Fields{"pass": leakPin}, errors.New("denied"))
+		restore()
+		requireNoLeak(t, buf.String())
+	}
+}
@@ -0,0 +1,78 @@
+package adapter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RequestMeta is embedded into the request types to trace a request through
+// the logs of the daemon. Clients not knowing it simply send none
+type RequestMeta struct {
+	// CorrelationID is chosen by the client, it is logged next to the
+	// request ID, e.g. to find the requests of a single notary publish
+	CorrelationID string
+	// requestID is assigned by the daemon to every RPC
+	requestID string
+}
+
+func (m *RequestMeta) setRequestID(id string) {
+	m.requestID = id
+}
+
+func (m *RequestMeta) correlationID() string {
+	return m.CorrelationID
+}
+
+// requestTagger is implemented by requests embedding RequestMeta
+type requestTagger interface {
+	setRequestID(id string)
+	correlationID() string
+}
+
+// logFields adds the IDs of the request to fields
+func (m RequestMeta) logFields(fields logrus.Fields) logrus.Fields {
+	return requestFields(fields, m.requestID, m.CorrelationID)
+}
+
+// requestFields adds the IDs of a request to fields, the ones that are unset are left out
+func requestFields(fields logrus.Fields, requestID, correlationID string) logrus.Fields {
+	if fields == nil {
+		fields = logrus.Fields{}
+	}
+	if requestID != "" {
+		fields["request_id"] = requestID
+	}
+	if correlationID != "" {
+		fields["correlation_id"] = correlationID
+	}
+	return fields
+}
+
+// newRequestID returns a random ID for an RPC
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		logrus.Warnf("Failed to generate a request ID: %v", err)
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// withRequestID adds the request ID to an error message of an RPC. It goes
+// right after the "[CODE] " prefix, the client parses the pkcs11 return
+// value off the end of the message
+func withRequestID(msg, requestID string) string {
+	if requestID == "" {
+		return msg
+	}
+	tag := "request " + requestID + ": "
+	if strings.HasPrefix(msg, "[") {
+		if i := strings.Index(msg, "] "); i >= 0 {
+			return msg[:i+2] + tag + msg[i+2:]
+		}
+	}
+	return tag + msg
+}
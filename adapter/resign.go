@@ -0,0 +1,712 @@
+package adapter
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/wire/upstream"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary"
+	"github.com/theupdateframework/notary/trustpinning"
+	"github.com/theupdateframework/notary/tuf/data"
+	"github.com/theupdateframework/notary/tuf/signed"
+	"github.com/theupdateframework/notary/tuf/utils"
+)
+
+// ResignRepo is a repository on a notary server whose snapshot the daemon
+// signs again before it expires. notary-server renews the timestamp itself
+// whenever a snapshot is published or the timestamp is fetched after it
+// expired, with the daemon as its signer (-signer-addr) that signature is
+// made on the token as well
+type ResignRepo struct {
+	GUN string `json:"gun"`
+	// Server is the URL of the notary server, e.g. https://notary.docker.io
+	Server string `json:"server"`
+	// CAFile verifies the certificate of the server, default: the system pool
+	CAFile string `json:"ca_file"`
+	// RootFile is a root.json of the repository trusted before, e.g. the
+	// one in the notary trust dir (~/.notary/tuf/<gun>/metadata/root.json).
+	// A root served by the server is only used if the root keys of the
+	// root trusted last signed it
+	RootFile string `json:"root_file"`
+	// Username and PasswordFile log in to the token service of the registry
+	Username     string `json:"username"`
+	PasswordFile string `json:"password_file"`
+	// Interval between two checks, default 1h
+	Interval string `json:"interval"`
+	// Jitter is the largest random delay added to every interval, so
+	// several daemons do not publish at once, default: a tenth of the interval
+	Jitter string `json:"jitter"`
+	// RenewBefore signs the snapshot again once it expires within this
+	// time, default 720h
+	RenewBefore string `json:"renew_before"`
+	// Validity of the new snapshot, default: 3 years like notary clients sign it
+	Validity string `json:"validity"`
+}
+
+// ResignConfig lists the repositories kept fresh by the daemon
+type ResignConfig []ResignRepo
+
+// resignTimes are the parsed durations of a ResignRepo
+type resignTimes struct {
+	interval, jitter, renewBefore, validity time.Duration
+}
+
+const resignTimeout = 30 * time.Second
+
+func (r ResignRepo) times() (resignTimes, error) {
+	t := resignTimes{
+		interval:    time.Hour,
+		renewBefore: 30 * 24 * time.Hour,
+		validity:    3 * notary.Year,
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		to    *time.Duration
+	}{
+		{"interval", r.Interval, &t.interval},
+		{"jitter", r.Jitter, &t.jitter},
+		{"renew_before", r.RenewBefore, &t.renewBefore},
+		{"validity", r.Validity, &t.validity},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v < 0 || v == 0 && d.name != "jitter" {
+			return t, fmt.Errorf("resign %s: invalid %s %q, expected a positive duration like 24h", r.GUN, d.name, d.value)
+		}
+		*d.to = v
+	}
+	if r.Jitter == "" {
+		t.jitter = t.interval / 10
+	}
+	if t.validity <= t.renewBefore {
+		return t, fmt.Errorf("resign %s: the validity must be longer than renew_before, or the snapshot is signed on every check", r.GUN)
+	}
+	return t, nil
+}
+
+func (cfg ResignConfig) validate() error {
+	seen := make(map[string]bool)
+	for _, r := range cfg {
+		if err := validGUN(r.GUN); err != nil {
+			return fmt.Errorf("resign: %v", err)
+		}
+		if seen[r.GUN] {
+			return fmt.Errorf("resign: %s is listed twice", r.GUN)
+		}
+		seen[r.GUN] = true
+		u, err := url.Parse(r.Server)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("resign %s: server %q is no http(s) URL", r.GUN, r.Server)
+		}
+		if r.RootFile == "" {
+			return fmt.Errorf("resign %s: root_file is missing, the root served by the server can not be trusted without it", r.GUN)
+		}
+		if (r.Username == "") != (r.PasswordFile == "") {
+			return fmt.Errorf("resign %s: username and password_file go together", r.GUN)
+		}
+		if _, err := r.times(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resignDue tells whether a snapshot expiring at expires has to be signed again
+func resignDue(expires, now time.Time, renewBefore time.Duration) bool {
+	return expires.Before(now.Add(renewBefore))
+}
+
+// jitterDelay returns a random delay of at most max
+func jitterDelay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
+// ResignStatus is the state of a repository kept fresh by the daemon
+type ResignStatus struct {
+	GUN              string
+	SnapshotExpires  time.Time
+	TimestampExpires time.Time
+	LastResign       time.Time
+	// Failures counts the failed checks, Consecutive the ones since the last success
+	Failures    uint64
+	Consecutive uint64
+}
+
+type resignState struct {
+	sync.Mutex
+	repos map[string]*ResignStatus
+}
+
+var resignStatuses = &resignState{repos: make(map[string]*ResignStatus)}
+
+// update changes the status of gun with fn
+func (s *resignState) update(gun string, fn func(*ResignStatus)) {
+	s.Lock()
+	defer s.Unlock()
+	status, ok := s.repos[gun]
+	if !ok {
+		status = &ResignStatus{GUN: gun}
+		s.repos[gun] = status
+	}
+	fn(status)
+}
+
+// snapshot returns a copy of all statuses, sorted by GUN
+func (s *resignState) snapshot() []ResignStatus {
+	s.Lock()
+	defer s.Unlock()
+	statuses := make([]ResignStatus, 0, len(s.repos))
+	for _, status := range s.repos {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].GUN < statuses[j].GUN })
+	return statuses
+}
+
+// resigner checks a single repository
+type resigner struct {
+	repo   ResignRepo
+	times  resignTimes
+	client *http.Client
+	es     *ESServer
+	// token is the bearer token of the registry, it is fetched again once
+	// the server rejects it
+	token string
+	// versions holds the highest snapshot version seen, an older snapshot
+	// served later is never signed again
+	versions *resignVersions
+	// root is the root trusted last, the one in RootFile at first
+	root *data.SignedRoot
+}
+
+// resignVersionsFile is the file in the state directory holding the
+// highest snapshot version seen per GUN
+const resignVersionsFile = "resign-versions.json"
+
+// resignVersions keeps the highest snapshot version seen per GUN in a file,
+// so a server rolling a snapshot back is noticed across restarts as well
+type resignVersions struct {
+	sync.Mutex
+	path     string
+	versions map[string]int
+}
+
+// loadResignVersions reads the versions kept at path, which may not exist yet
+func loadResignVersions(path string) (*resignVersions, error) {
+	v := &resignVersions{path: path, versions: make(map[string]int)}
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return v, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &v.versions); err != nil {
+		return nil, fmt.Errorf("%s is corrupt: %v", path, err)
+	}
+	return v, nil
+}
+
+// seen returns the highest snapshot version seen of gun, 0 if none was
+func (v *resignVersions) seen(gun string) int {
+	v.Lock()
+	defer v.Unlock()
+	return v.versions[gun]
+}
+
+// raise records version as seen for gun, if it is higher than the one seen
+// before. The file is replaced before the version counts as seen
+func (v *resignVersions) raise(gun string, version int) error {
+	v.Lock()
+	defer v.Unlock()
+	if version <= v.versions[gun] {
+		return nil
+	}
+	versions := make(map[string]int, len(v.versions)+1)
+	for g, seen := range v.versions {
+		versions[g] = seen
+	}
+	versions[gun] = version
+	raw, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(v.path), filepath.Base(v.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(raw)
+	if serr := tmp.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), v.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record snapshot version %d of %s: %v", version, gun, err)
+	}
+	v.versions = versions
+	return nil
+}
+
+// startResigning starts a check loop for every repository
+func startResigning(repos ResignConfig) {
+	if len(repos) == 0 {
+		return
+	}
+	versions, err := loadResignVersions(filepath.Join(stateDir, resignVersionsFile))
+	if err != nil {
+		logrus.Errorf("Not keeping any snapshot fresh, the versions seen are unknown: %v", err)
+		return
+	}
+	for _, r := range repos {
+		t, err := r.times()
+		if err != nil {
+			logrus.Errorf("Not keeping %s fresh: %v", r.GUN, err)
+			continue
+		}
+		client, err := resignClient(r.CAFile)
+		if err != nil {
+			logrus.Errorf("Not keeping %s fresh: %v", r.GUN, err)
+			continue
+		}
+		root, err := loadRoot(r.RootFile)
+		if err != nil {
+			logrus.Errorf("Not keeping %s fresh: %v", r.GUN, err)
+			continue
+		}
+		rs := &resigner{repo: r, times: t, client: client, es: NewServer(nil), versions: versions, root: root}
+		logrus.Infof("Keeping the snapshot of %s on %s fresh, checking every %s", r.GUN, r.Server, t.interval)
+		go rs.run()
+	}
+}
+
+// loadRoot reads the trusted root.json at path
+func loadRoot(path string) (*data.SignedRoot, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := new(data.Signed)
+	if err := json.Unmarshal(raw, s); err != nil || s.Signed == nil {
+		return nil, fmt.Errorf("%s is no root metadata", path)
+	}
+	return data.RootFromSigned(s)
+}
+
+func resignClient(caFile string) (*http.Client, error) {
+	transport := &http.Transport{TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS12}}
+	if caFile != "" {
+		pemCerts, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	return &http.Client{Timeout: resignTimeout, Transport: transport}, nil
+}
+
+func (rs *resigner) run() {
+	for {
+		time.Sleep(jitterDelay(rs.times.jitter))
+		rs.check(time.Now())
+		time.Sleep(rs.times.interval)
+	}
+}
+
+// check signs the snapshot again if it is due and records the outcome.
+// Failures are logged, audited and counted, an error is logged as well if
+// the snapshot expires before the next check
+func (rs *resigner) check(now time.Time) {
+	gun := rs.repo.GUN
+	resigned, snapshotExpires, timestampExpires, err := rs.resignIfDue(now)
+	fields := logrus.Fields{"gun": gun, "server": rs.repo.Server}
+	if err != nil {
+		var (
+			consecutive uint64
+			expires     time.Time
+		)
+		resignStatuses.update(gun, func(s *ResignStatus) {
+			s.Failures++
+			s.Consecutive++
+			if !snapshotExpires.IsZero() {
+				s.SnapshotExpires = snapshotExpires
+			}
+			consecutive, expires = s.Consecutive, s.SnapshotExpires
+		})
+		audit("resign_failed", nil, fields, err)
+		logrus.Errorf("Failed to sign the snapshot of %s again (%d failures in a row): %v", gun, consecutive, err)
+		next := now.Add(rs.times.interval + rs.times.jitter)
+		if !expires.IsZero() && expires.Before(next) {
+			logrus.Errorf("The snapshot of %s expires at %s, before the next attempt, sign it manually", gun, expires.Format(time.RFC3339))
+		}
+		return
+	}
+	resignStatuses.update(gun, func(s *ResignStatus) {
+		s.Consecutive = 0
+		s.SnapshotExpires, s.TimestampExpires = snapshotExpires, timestampExpires
+		if resigned {
+			s.LastResign = now
+		}
+	})
+	if resigned {
+		fields["expires"] = snapshotExpires.Format(time.RFC3339)
+		audit("resign", nil, fields, nil)
+		logrus.Infof("Signed the snapshot of %s again, it expires at %s", gun, snapshotExpires.Format(time.RFC3339))
+	}
+	if timestampExpires.Before(now) {
+		logrus.Warnf("The timestamp of %s expired at %s, the server did not renew it", gun, timestampExpires.Format(time.RFC3339))
+	}
+}
+
+// resignIfDue fetches the metadata of the repository and publishes a new
+// snapshot if the current one expires soon. It returns the expiry of the
+// snapshot and the timestamp served afterwards
+func (rs *resigner) resignIfDue(now time.Time) (bool, time.Time, time.Time, error) {
+	var zero time.Time
+	rootSigned, err := rs.fetch(data.CanonicalRootRole)
+	if err != nil {
+		return false, zero, zero, err
+	}
+	root, err := rs.trustRoot(rootSigned)
+	if err != nil {
+		return false, zero, zero, err
+	}
+	snapshotSigned, err := rs.fetch(data.CanonicalSnapshotRole)
+	if err != nil {
+		return false, zero, zero, err
+	}
+	snapshot, err := data.SnapshotFromSigned(snapshotSigned)
+	if err != nil {
+		return false, zero, zero, err
+	}
+	if seen := rs.versions.seen(rs.repo.GUN); snapshot.Signed.Version < seen {
+		return false, zero, zero, yubikey.NewError(yubikey.ErrCodePolicyDenied, "the server serves snapshot version %d of %s, version %d was seen before", snapshot.Signed.Version, rs.repo.GUN, seen)
+	}
+	if err := rs.versions.raise(rs.repo.GUN, snapshot.Signed.Version); err != nil {
+		return false, zero, zero, err
+	}
+
+	resigned := false
+	if resignDue(snapshot.Signed.Expires, now, rs.times.renewBefore) {
+		next := *snapshot
+		body, err := rs.resign(root, snapshotSigned, &next, now)
+		if err != nil {
+			return false, snapshot.Signed.Expires, zero, err
+		}
+		if err := rs.publish(body); err != nil {
+			return false, snapshot.Signed.Expires, zero, err
+		}
+		resigned, snapshot = true, &next
+		if err := rs.versions.raise(rs.repo.GUN, snapshot.Signed.Version); err != nil {
+			return resigned, snapshot.Signed.Expires, zero, err
+		}
+	}
+
+	// the server generates the timestamp for the new snapshot on request
+	timestampSigned, err := rs.fetch(data.CanonicalTimestampRole)
+	if err != nil {
+		return resigned, snapshot.Signed.Expires, zero, err
+	}
+	timestamp, err := data.TimestampFromSigned(timestampSigned)
+	if err != nil {
+		return resigned, snapshot.Signed.Expires, zero, err
+	}
+	return resigned, snapshot.Signed.Expires, timestamp.Signed.Expires, nil
+}
+
+// trustRoot verifies the root served by the server the way notary clients
+// do: the root keys of the root trusted last and its own root keys must
+// have signed it. A verified root is trusted from then on, so the root keys
+// can be rotated, an older root is refused
+func (rs *resigner) trustRoot(s *data.Signed) (*data.SignedRoot, error) {
+	root, err := trustpinning.ValidateRoot(rs.root, s, data.GUN(rs.repo.GUN), trustpinning.TrustPinConfig{DisableTOFU: true})
+	if err != nil {
+		return nil, yubikey.NewError(yubikey.ErrCodePolicyDenied, "the root of %s served by the server is not trusted: %v", rs.repo.GUN, err)
+	}
+	if root.Signed.Version < rs.root.Signed.Version {
+		return nil, yubikey.NewError(yubikey.ErrCodePolicyDenied, "the server serves root version %d of %s, version %d is trusted", root.Signed.Version, rs.repo.GUN, rs.root.Signed.Version)
+	}
+	rs.root = root
+	return root, nil
+}
+
+// resign signs snapshot with the next version and expiry and returns the
+// JSON to publish. Only a snapshot signed by the key on the token is signed
+// again, so a server can not get anything signed it made up itself
+func (rs *resigner) resign(root *data.SignedRoot, current *data.Signed, snapshot *data.SignedSnapshot, now time.Time) ([]byte, error) {
+	role, err := root.BuildBaseRole(data.CanonicalSnapshotRole)
+	if err != nil {
+		return nil, err
+	}
+	if role.Threshold > 1 {
+		return nil, yubikey.NewError(yubikey.ErrCodeInvalidRequest, "the snapshot of %s needs %d signatures, the daemon can only make one", rs.repo.GUN, role.Threshold)
+	}
+	var body []byte
+	err = withESSession(rs.es, func(session uint) error {
+		keys, err := ks.HardwareListKeys(pkcs11.SessionHandle(session))
+		if err != nil {
+			return err
+		}
+		for rootKeyID, pubKey := range role.Keys {
+			keyID, err := utils.CanonicalKeyID(pubKey)
+			if err != nil {
+				continue
+			}
+			slot, ok := keys[keyID]
+			if !ok {
+				continue
+			}
+			if !signedBy(current, rootKeyID, pubKey) {
+				return yubikey.NewError(yubikey.ErrCodePolicyDenied, "the snapshot of %s is not signed by key %s, refusing to sign it again", rs.repo.GUN, keyID)
+			}
+			snapshot.Signed.Version++
+			snapshot.Signed.Expires = now.Add(rs.times.validity)
+			s, err := snapshot.ToSigned()
+			if err != nil {
+				return err
+			}
+			slot.KeyID = keyID
+			res := new(wire.ESSignRes)
+			err = rs.es.Sign(SignReq{
+				Session:           session,
+				Slot:              upstream.Slot(slot),
+				Payload:           *s.Signed,
+				DigestAlgorithm:   yubikey.DigestSHA256,
+				SignatureEncoding: yubikey.EncodingRaw,
+			}, res)
+			if err != nil {
+				return err
+			}
+			s.Signatures = []data.Signature{{KeyID: rootKeyID, Method: data.ECDSASignature, Signature: res.Result}}
+			body, err = json.Marshal(s)
+			return err
+		}
+		return yubikey.NewError(yubikey.ErrCodeKeyNotFound, "no snapshot key of %s on the token", rs.repo.GUN)
+	})
+	return body, err
+}
+
+// signedBy tells whether s carries a valid signature of the key keyID
+func signedBy(s *data.Signed, keyID string, pubKey data.PublicKey) bool {
+	for _, sig := range s.Signatures {
+		if sig.KeyID == keyID && signed.VerifySignature(*s.Signed, &sig, pubKey) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (rs *resigner) url(path string) string {
+	return strings.TrimRight(rs.repo.Server, "/") + "/v2/" + rs.repo.GUN + "/_trust/tuf/" + path
+}
+
+// fetch downloads the current metadata of role
+func (rs *resigner) fetch(role data.RoleName) (*data.Signed, error) {
+	body, err := rs.do(func() (*http.Request, error) {
+		return http.NewRequest("GET", rs.url(role.String()+".json"), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := new(data.Signed)
+	if err := json.Unmarshal(body, s); err != nil || s.Signed == nil {
+		return nil, fmt.Errorf("invalid %s metadata of %s", role, rs.repo.GUN)
+	}
+	return s, nil
+}
+
+// publish uploads a new snapshot the way notary clients publish
+func (rs *resigner) publish(snapshot []byte) error {
+	_, err := rs.do(func() (*http.Request, error) {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("files", data.CanonicalSnapshotRole.String())
+		if err != nil {
+			return nil, err
+		}
+		part.Write(snapshot)
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", rs.url(""), body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		return req, nil
+	})
+	return err
+}
+
+// do sends the request made by newReq. If the server asks for a bearer
+// token, one is fetched from the token service of the registry and the
+// request is sent again
+func (rs *resigner) do(newReq func() (*http.Request, error)) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		if rs.token != "" {
+			req.Header.Set("Authorization", "Bearer "+rs.token)
+		}
+		resp, err := rs.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, notary.MaxDownloadSize))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 && rs.repo.Username != "" {
+			if rs.token, err = rs.login(resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+		}
+		return body, err
+	}
+}
+
+// login fetches a bearer token as the challenge of the server asks for
+func (rs *resigner) login(challenge string) (string, error) {
+	realm, params, ok := parseBearerChallenge(challenge)
+	if !ok {
+		return "", fmt.Errorf("the server asks for unsupported authentication %q", challenge)
+	}
+	password, err := readSecretFile(rs.repo.PasswordFile)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("GET", realm+"?"+params.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(rs.repo.Username, password)
+	resp, err := rs.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("login at %s: %s", realm, resp.Status)
+	}
+	var res struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", err
+	}
+	if res.Token == "" {
+		res.Token = res.AccessToken
+	}
+	if res.Token == "" {
+		return "", fmt.Errorf("login at %s returned no token", realm)
+	}
+	return res.Token, nil
+}
+
+// parseBearerChallenge parses a WWW-Authenticate header like
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="..."
+// into the realm and the other parameters
+func parseBearerChallenge(challenge string) (string, url.Values, bool) {
+	const scheme = "bearer "
+	if len(challenge) < len(scheme) || !strings.EqualFold(challenge[:len(scheme)], scheme) {
+		return "", nil, false
+	}
+	params := url.Values{}
+	rest := strings.TrimSpace(challenge[len(scheme):])
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			return "", nil, false
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				return "", nil, false
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params.Set(key, value)
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	realm := params.Get("realm")
+	params.Del("realm")
+	return realm, params, realm != ""
+}
+
+// writeResignMetrics writes the state of the repositories kept fresh in the
+// Prometheus text format
+func writeResignMetrics(w io.Writer, statuses []ResignStatus) {
+	metric := func(name, kind, help string, value func(ResignStatus) int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, s := range statuses {
+			fmt.Fprintf(w, "%s{gun=\"%s\"} %d\n", name, labelValue(s.GUN), value(s))
+		}
+	}
+	unix := func(t time.Time) int64 {
+		if t.IsZero() {
+			return 0
+		}
+		return t.Unix()
+	}
+	metric("notary_yubikey_resign_snapshot_expiry_timestamp_seconds", "gauge", "Unix time the published snapshot expires, by repository.", func(s ResignStatus) int64 {
+		return unix(s.SnapshotExpires)
+	})
+	metric("notary_yubikey_resign_timestamp_expiry_timestamp_seconds", "gauge", "Unix time the published timestamp expires, by repository.", func(s ResignStatus) int64 {
+		return unix(s.TimestampExpires)
+	})
+	metric("notary_yubikey_resign_last_success_timestamp_seconds", "gauge", "Unix time the snapshot was last signed again, by repository.", func(s ResignStatus) int64 {
+		return unix(s.LastResign)
+	})
+	metric("notary_yubikey_resign_failures_total", "counter", "Checks which failed, by repository.", func(s ResignStatus) int64 {
+		return int64(s.Failures)
+	})
+	metric("notary_yubikey_resign_consecutive_failures", "gauge", "Checks which failed since the last success, by repository.", func(s ResignStatus) int64 {
+		return int64(s.Consecutive)
+	})
+}
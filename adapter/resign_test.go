@@ -0,0 +1,132 @@
+package adapter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/tuf/data"
+	"github.com/theupdateframework/notary/tuf/testutils"
+)
+
+func TestParseBearerChallenge(t *testing.T) {
+	realm, params, ok := parseBearerChallenge(`Bearer realm="https://auth.docker.io/token",service="notary.docker.io",scope="repository:docker.io/library/alpine:push,pull"`)
+	require.True(t, ok)
+	require.Equal(t, "https://auth.docker.io/token", realm)
+	require.Equal(t, "notary.docker.io", params.Get("service"))
+	require.Equal(t, "repository:docker.io/library/alpine:push,pull", params.Get("scope"))
+	require.Empty(t, params.Get("realm"))
+
+	realm, params, ok = parseBearerChallenge(`bearer realm=https://auth/token, service=notary`)
+	require.True(t, ok)
+	require.Equal(t, "https://auth/token", realm)
+	require.Equal(t, "notary", params.Get("service"))
+
+	for _, invalid := range []string{"", `Basic realm="notary"`, `Bearer service="notary"`, `Bearer realm="open`} {
+		_, _, ok := parseBearerChallenge(invalid)
+		require.False(t, ok, invalid)
+	}
+}
+
+func TestResignConfig(t *testing.T) {
+	repo := ResignRepo{GUN: "docker.io/library/alpine", Server: "https://notary.docker.io", RootFile: "root.json"}
+	require.NoError(t, ResignConfig{repo}.validate())
+	times, err := repo.times()
+	require.NoError(t, err)
+	require.Equal(t, time.Hour, times.interval)
+	require.Equal(t, 6*time.Minute, times.jitter)
+	require.True(t, times.validity > times.renewBefore)
+
+	for _, invalid := range []ResignRepo{
+		{GUN: "https://docker.io/library/alpine", Server: "https://notary.docker.io", RootFile: "root.json"},
+		{GUN: "docker.io/library/alpine", Server: "notary.docker.io", RootFile: "root.json"},
+		{GUN: "docker.io/library/alpine", Server: "https://notary.docker.io"},
+		{GUN: "docker.io/library/alpine", Server: "https://notary.docker.io", RootFile: "root.json", Username: "ci"},
+		{GUN: "docker.io/library/alpine", Server: "https://notary.docker.io", RootFile: "root.json", Interval: "0s"},
+		{GUN: "docker.io/library/alpine", Server: "https://notary.docker.io", RootFile: "root.json", Validity: "24h", RenewBefore: "48h"},
+	} {
+		require.Error(t, ResignConfig{invalid}.validate(), "%+v", invalid)
+	}
+	require.Error(t, ResignConfig{repo, repo}.validate())
+}
+
+func TestResignDue(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.False(t, resignDue(now.Add(31*24*time.Hour), now, 30*24*time.Hour))
+	require.True(t, resignDue(now.Add(29*24*time.Hour), now, 30*24*time.Hour))
+	require.True(t, resignDue(now.Add(-time.Hour), now, 30*24*time.Hour))
+
+	require.Equal(t, time.Duration(0), jitterDelay(0))
+	for i := 0; i < 100; i++ {
+		d := jitterDelay(time.Second)
+		require.True(t, d >= 0 && d <= time.Second)
+	}
+}
+
+func TestResignVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resign-versions")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, resignVersionsFile)
+
+	versions, err := loadResignVersions(path)
+	require.NoError(t, err)
+	require.Equal(t, 0, versions.seen("docker.io/library/alpine"))
+	require.NoError(t, versions.raise("docker.io/library/alpine", 7))
+	require.NoError(t, versions.raise("docker.io/library/alpine", 3))
+	require.NoError(t, versions.raise("docker.io/library/busybox", 2))
+
+	// a restarted daemon still knows the versions seen before
+	versions, err = loadResignVersions(path)
+	require.NoError(t, err)
+	require.Equal(t, 7, versions.seen("docker.io/library/alpine"))
+	require.Equal(t, 2, versions.seen("docker.io/library/busybox"))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	_, err = loadResignVersions(path)
+	require.Error(t, err)
+}
+
+func TestTrustRoot(t *testing.T) {
+	gun := data.GUN("docker.io/library/alpine")
+	repo, _, err := testutils.EmptyRepo(gun)
+	require.NoError(t, err)
+	v1, err := repo.SignRoot(data.DefaultExpires(data.CanonicalRootRole), nil)
+	require.NoError(t, err)
+	v2, err := repo.SignRoot(data.DefaultExpires(data.CanonicalRootRole), nil)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "resign-root")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "root.json")
+	raw, err := json.Marshal(v1)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, raw, 0600))
+	pinned, err := loadRoot(path)
+	require.NoError(t, err)
+	rs := &resigner{repo: ResignRepo{GUN: gun.String()}, root: pinned}
+
+	root, err := rs.trustRoot(v2)
+	require.NoError(t, err)
+	require.Equal(t, 2, root.Signed.Version)
+	require.Equal(t, 2, rs.root.Signed.Version)
+
+	// a root the pinned root keys did not sign is refused
+	forged, _, err := testutils.EmptyRepo(gun)
+	require.NoError(t, err)
+	forgedRoot, err := forged.SignRoot(data.DefaultExpires(data.CanonicalRootRole), nil)
+	require.NoError(t, err)
+	_, err = rs.trustRoot(forgedRoot)
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(err))
+
+	// so is a root older than the one trusted
+	_, err = rs.trustRoot(v1)
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(err))
+	require.Equal(t, 2, rs.root.Signed.Version)
+}
@@ -0,0 +1,299 @@
+// +build linux,amd64 linux,arm64 linux,ppc64le linux,s390x
+
+package adapter
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+)
+
+// seccomp and landlock are not covered by the syscall package
+const (
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000
+
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+	landlockRulePathBeneath  = 1
+
+	landlockAccessExecute  = 1 << 0
+	landlockAccessWrite    = 1 << 1
+	landlockAccessRead     = 1 << 2
+	landlockAccessReadDir  = 1 << 3
+	landlockAccessRemove   = 1<<4 | 1<<5
+	landlockAccessMakeReg  = 1 << 8
+	landlockAccessMakeSock = 1 << 9
+	// all rights of landlock ABI version 1
+	landlockAccessAll = 1<<13 - 1
+
+	landlockReadOnly  = landlockAccessExecute | landlockAccessRead | landlockAccessReadDir
+	landlockReadWrite = landlockReadOnly | landlockAccessWrite | landlockAccessRemove | landlockAccessMakeReg | landlockAccessMakeSock
+)
+
+// seccompArch holds the audit architecture and the number of the seccomp
+// syscall, by GOARCH
+var seccompArch = map[string]struct {
+	audit   uint32
+	seccomp uintptr
+}{
+	"amd64":   {0xc000003e, 317},
+	"arm64":   {0xc00000b7, 277},
+	"ppc64le": {0xc0000015, 358},
+	"s390x":   {0x80000016, 348},
+}
+
+// allowedSyscalls are the syscalls of the go runtime, the pkcs11 library
+// talking to pcscd, the socket servers and the helpers started for secrets,
+// which have the same number on all architectures. archSyscalls adds the
+// others, every syscall on neither list fails with EPERM
+var allowedSyscalls = []uint32{
+	// files
+	syscall.SYS_READ,
+	syscall.SYS_WRITE,
+	syscall.SYS_READV,
+	syscall.SYS_WRITEV,
+	syscall.SYS_PREAD64,
+	syscall.SYS_PWRITE64,
+	syscall.SYS_OPENAT,
+	syscall.SYS_CLOSE,
+	syscall.SYS_FSTAT,
+	syscall.SYS_FSTATFS,
+	syscall.SYS_STATFS,
+	syscall.SYS_LSEEK,
+	syscall.SYS_FCNTL,
+	syscall.SYS_FLOCK,
+	syscall.SYS_DUP,
+	syscall.SYS_DUP3,
+	syscall.SYS_PIPE2,
+	syscall.SYS_IOCTL,
+	syscall.SYS_GETDENTS64,
+	syscall.SYS_READLINKAT,
+	syscall.SYS_FACCESSAT,
+	syscall.SYS_UNLINKAT,
+	syscall.SYS_RENAMEAT,
+	syscall.SYS_MKDIRAT,
+	syscall.SYS_FCHMOD,
+	syscall.SYS_FCHMODAT,
+	syscall.SYS_FCHOWN,
+	syscall.SYS_FCHOWNAT,
+	syscall.SYS_UTIMENSAT,
+	syscall.SYS_FSYNC,
+	syscall.SYS_FDATASYNC,
+	syscall.SYS_FTRUNCATE,
+	syscall.SYS_FADVISE64,
+	syscall.SYS_SENDFILE,
+	syscall.SYS_SPLICE,
+	syscall.SYS_GETCWD,
+	syscall.SYS_CHDIR,
+	syscall.SYS_FCHDIR,
+	syscall.SYS_UMASK,
+	syscall.SYS_INOTIFY_INIT1,
+	syscall.SYS_INOTIFY_ADD_WATCH,
+	syscall.SYS_INOTIFY_RM_WATCH,
+	// memory
+	syscall.SYS_MMAP,
+	syscall.SYS_MUNMAP,
+	syscall.SYS_MPROTECT,
+	syscall.SYS_MREMAP,
+	syscall.SYS_MADVISE,
+	syscall.SYS_BRK,
+	syscall.SYS_MLOCK,
+	syscall.SYS_MUNLOCK,
+	syscall.SYS_MLOCKALL,
+	syscall.SYS_MUNLOCKALL,
+	// threads, signals and time
+	syscall.SYS_CLONE,
+	syscall.SYS_EXIT,
+	syscall.SYS_EXIT_GROUP,
+	syscall.SYS_FUTEX,
+	syscall.SYS_SET_ROBUST_LIST,
+	syscall.SYS_GET_ROBUST_LIST,
+	syscall.SYS_SET_TID_ADDRESS,
+	syscall.SYS_SCHED_YIELD,
+	syscall.SYS_SCHED_GETAFFINITY,
+	syscall.SYS_SCHED_GETPARAM,
+	syscall.SYS_SCHED_GETSCHEDULER,
+	syscall.SYS_RT_SIGACTION,
+	syscall.SYS_RT_SIGPROCMASK,
+	syscall.SYS_RT_SIGRETURN,
+	syscall.SYS_SIGALTSTACK,
+	syscall.SYS_RESTART_SYSCALL,
+	syscall.SYS_TGKILL,
+	syscall.SYS_TKILL,
+	syscall.SYS_KILL,
+	syscall.SYS_WAIT4,
+	syscall.SYS_WAITID,
+	syscall.SYS_NANOSLEEP,
+	syscall.SYS_CLOCK_GETTIME,
+	syscall.SYS_CLOCK_GETRES,
+	syscall.SYS_CLOCK_NANOSLEEP,
+	syscall.SYS_GETTIMEOFDAY,
+	syscall.SYS_TIMERFD_CREATE,
+	syscall.SYS_TIMERFD_SETTIME,
+	syscall.SYS_TIMERFD_GETTIME,
+	syscall.SYS_EPOLL_CREATE1,
+	syscall.SYS_EPOLL_CTL,
+	syscall.SYS_EPOLL_PWAIT,
+	syscall.SYS_EVENTFD2,
+	syscall.SYS_PPOLL,
+	syscall.SYS_PSELECT6,
+	// process
+	syscall.SYS_GETPID,
+	syscall.SYS_GETPPID,
+	syscall.SYS_GETTID,
+	syscall.SYS_GETUID,
+	syscall.SYS_GETEUID,
+	syscall.SYS_GETGID,
+	syscall.SYS_GETEGID,
+	syscall.SYS_GETGROUPS,
+	syscall.SYS_GETRESUID,
+	syscall.SYS_GETRESGID,
+	syscall.SYS_GETPGID,
+	syscall.SYS_SETPGID,
+	syscall.SYS_SETSID,
+	syscall.SYS_GETRLIMIT,
+	syscall.SYS_PRLIMIT64,
+	syscall.SYS_GETRUSAGE,
+	syscall.SYS_GETPRIORITY,
+	syscall.SYS_UNAME,
+	syscall.SYS_SYSINFO,
+	syscall.SYS_TIMES,
+	syscall.SYS_PRCTL,
+	// sockets
+	syscall.SYS_SOCKET,
+	syscall.SYS_SOCKETPAIR,
+	syscall.SYS_BIND,
+	syscall.SYS_LISTEN,
+	syscall.SYS_ACCEPT4,
+	syscall.SYS_CONNECT,
+	syscall.SYS_GETSOCKNAME,
+	syscall.SYS_GETPEERNAME,
+	syscall.SYS_SETSOCKOPT,
+	syscall.SYS_GETSOCKOPT,
+	syscall.SYS_SENDTO,
+	syscall.SYS_RECVFROM,
+	syscall.SYS_SENDMSG,
+	syscall.SYS_RECVMSG,
+	syscall.SYS_RECVMMSG,
+	syscall.SYS_SHUTDOWN,
+}
+
+// sandboxReadOnly are the paths the pkcs11 library and its helpers read from
+var sandboxReadOnly = []string{"/usr", "/lib", "/lib64", "/opt", "/etc", "/proc", "/sys", "/dev"}
+
+// sandbox restricts the daemon to the syscalls and paths it needs. A
+// seccomp filter refuses all syscalls but the ones a signer needs and
+// landlock limits write access to writable, read access is granted to the
+// system directories holding the pkcs11 library. allowExec keeps execve
+// available for askpass and keyring helpers
+func sandbox(writable []string, allowExec bool) error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("could not set no_new_privs: %v", errno)
+	}
+	if err := landlock(writable); err != nil {
+		return err
+	}
+	allowed := append(append([]uint32(nil), allowedSyscalls...), archSyscalls...)
+	if allowExec {
+		allowed = append(allowed, syscall.SYS_EXECVE)
+	}
+	return seccomp(allowed)
+}
+
+// landlock allows read access below sandboxReadOnly and read and write
+// access below writable, everything else becomes inaccessible. Kernels
+// without landlock are only logged about
+func landlock(writable []string) error {
+	attr := struct{ handledAccessFS uint64 }{landlockAccessAll}
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno == syscall.ENOSYS || errno == syscall.EOPNOTSUPP {
+		logrus.Warnf("Landlock is not supported by the kernel, file access is not restricted")
+		return nil
+	}
+	if errno != 0 {
+		return fmt.Errorf("could not create landlock ruleset: %v", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	add := func(path string, access uint64) error {
+		f, err := os.OpenFile(path, oPath|syscall.O_CLOEXEC, 0)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// struct landlock_path_beneath_attr is packed
+		var rule [12]byte
+		*(*uint64)(unsafe.Pointer(&rule[0])) = access
+		*(*int32)(unsafe.Pointer(&rule[8])) = int32(f.Fd())
+		if _, _, errno := syscall.Syscall6(sysLandlockAddRule, fd, landlockRulePathBeneath, uintptr(unsafe.Pointer(&rule[0])), 0, 0, 0); errno != 0 {
+			return fmt.Errorf("could not add landlock rule for %s: %v", path, errno)
+		}
+		return nil
+	}
+	for _, path := range sandboxReadOnly {
+		if err := add(path, landlockReadOnly); err != nil {
+			return err
+		}
+	}
+	for _, path := range writable {
+		if err := add(path, landlockReadWrite); err != nil {
+			return err
+		}
+	}
+	// os/exec connects unused stdio of helpers to /dev/null
+	if err := add(os.DevNull, landlockAccessRead|landlockAccessWrite); err != nil {
+		return err
+	}
+	if _, _, errno := syscall.Syscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("could not enforce landlock ruleset: %v", errno)
+	}
+	return nil
+}
+
+// seccomp installs a filter on all threads which fails every syscall but
+// the allowed ones with EPERM
+func seccomp(allowed []uint32) error {
+	arch, ok := seccompArch[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("seccomp filter is not supported on %s", runtime.GOARCH)
+	}
+	deny := syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetErrno | uint32(syscall.EPERM)}
+	filter := []syscall.SockFilter{
+		// kill the process if a syscall of a foreign architecture is made
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: 4},
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 1, K: arch.audit},
+		{Code: syscall.BPF_RET | syscall.BPF_K, K: 0},
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: 0},
+	}
+	if x32SyscallBit != 0 {
+		// the x32 ABI shares the audit architecture of amd64, its syscalls
+		// are told apart by this bit only
+		filter = append(filter, syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K, Jf: 1, K: x32SyscallBit}, deny)
+	}
+	allow := syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetAllow}
+	for _, nr := range allowed {
+		// the allow return follows each comparison, so no jump gets longer
+		// than the 8 bits of its offset
+		filter = append(filter, syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jf: 1, K: nr}, allow)
+	}
+	filter = append(filter, deny)
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := syscall.Syscall(arch.seccomp, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("could not install seccomp filter: %v", errno)
+	}
+	return nil
+}
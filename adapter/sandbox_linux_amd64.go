@@ -0,0 +1,43 @@
+package adapter
+
+import "syscall"
+
+// x32SyscallBit marks the syscalls of the x32 ABI, which the filter rejects
+const x32SyscallBit = 0x40000000
+
+// archSyscalls are the allowed syscalls with a number of their own on amd64,
+// the numbers are missing from the syscall package for the newer ones
+var archSyscalls = []uint32{
+	syscall.SYS_OPEN,
+	syscall.SYS_STAT,
+	syscall.SYS_LSTAT,
+	syscall.SYS_NEWFSTATAT,
+	syscall.SYS_ACCESS,
+	syscall.SYS_READLINK,
+	syscall.SYS_UNLINK,
+	syscall.SYS_RENAME,
+	syscall.SYS_MKDIR,
+	syscall.SYS_RMDIR,
+	syscall.SYS_PIPE,
+	syscall.SYS_DUP2,
+	syscall.SYS_POLL,
+	syscall.SYS_SELECT,
+	syscall.SYS_EPOLL_CREATE,
+	syscall.SYS_EPOLL_WAIT,
+	syscall.SYS_ACCEPT,
+	syscall.SYS_ARCH_PRCTL,
+	syscall.SYS_VFORK,
+	307, // sendmmsg
+	316, // renameat2
+	318, // getrandom
+	324, // membarrier
+	326, // copy_file_range
+	332, // statx
+	334, // rseq
+	424, // pidfd_send_signal
+	434, // pidfd_open
+	435, // clone3
+	436, // close_range
+	439, // faccessat2
+	441, // epoll_pwait2
+}
@@ -0,0 +1,26 @@
+package adapter
+
+import "syscall"
+
+// x32SyscallBit is only set on amd64
+const x32SyscallBit = 0
+
+// archSyscalls are the allowed syscalls with a number of their own on arm64,
+// the numbers are missing from the syscall package for the newer ones
+var archSyscalls = []uint32{
+	syscall.SYS_FSTATAT,
+	syscall.SYS_ACCEPT,
+	syscall.SYS_SENDMMSG,
+	syscall.SYS_RENAMEAT2,
+	syscall.SYS_GETRANDOM,
+	283, // membarrier
+	285, // copy_file_range
+	291, // statx
+	293, // rseq
+	424, // pidfd_send_signal
+	434, // pidfd_open
+	435, // clone3
+	436, // close_range
+	439, // faccessat2
+	441, // epoll_pwait2
+}
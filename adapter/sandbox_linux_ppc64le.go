@@ -0,0 +1,45 @@
+package adapter
+
+import "syscall"
+
+// x32SyscallBit is only set on amd64
+const x32SyscallBit = 0
+
+// archSyscalls are the allowed syscalls with a number of their own on
+// ppc64le, the numbers are missing from the syscall package for the newer
+// ones
+var archSyscalls = []uint32{
+	syscall.SYS_OPEN,
+	syscall.SYS_STAT,
+	syscall.SYS_LSTAT,
+	syscall.SYS_NEWFSTATAT,
+	syscall.SYS_ACCESS,
+	syscall.SYS_READLINK,
+	syscall.SYS_UNLINK,
+	syscall.SYS_RENAME,
+	syscall.SYS_MKDIR,
+	syscall.SYS_RMDIR,
+	syscall.SYS_PIPE,
+	syscall.SYS_DUP2,
+	syscall.SYS_POLL,
+	syscall.SYS_SELECT,
+	syscall.SYS_EPOLL_CREATE,
+	syscall.SYS_EPOLL_WAIT,
+	syscall.SYS_ACCEPT,
+	syscall.SYS_SENDMMSG,
+	syscall.SYS_UGETRLIMIT,
+	syscall.SYS_SOCKETCALL,
+	syscall.SYS_VFORK,
+	357, // renameat2
+	359, // getrandom
+	365, // membarrier
+	379, // copy_file_range
+	383, // statx
+	387, // rseq
+	424, // pidfd_send_signal
+	434, // pidfd_open
+	435, // clone3
+	436, // close_range
+	439, // faccessat2
+	441, // epoll_pwait2
+}
@@ -0,0 +1,42 @@
+package adapter
+
+import "syscall"
+
+// x32SyscallBit is only set on amd64
+const x32SyscallBit = 0
+
+// archSyscalls are the allowed syscalls with a number of their own on
+// s390x, the numbers are missing from the syscall package for the newer ones
+var archSyscalls = []uint32{
+	syscall.SYS_OPEN,
+	syscall.SYS_STAT,
+	syscall.SYS_LSTAT,
+	syscall.SYS_NEWFSTATAT,
+	syscall.SYS_ACCESS,
+	syscall.SYS_READLINK,
+	syscall.SYS_UNLINK,
+	syscall.SYS_RENAME,
+	syscall.SYS_MKDIR,
+	syscall.SYS_RMDIR,
+	syscall.SYS_PIPE,
+	syscall.SYS_DUP2,
+	syscall.SYS_POLL,
+	syscall.SYS_SELECT,
+	syscall.SYS_EPOLL_CREATE,
+	syscall.SYS_EPOLL_WAIT,
+	syscall.SYS_SENDMMSG,
+	syscall.SYS_SOCKETCALL,
+	syscall.SYS_RENAMEAT2,
+	syscall.SYS_GETRANDOM,
+	syscall.SYS_MEMBARRIER,
+	syscall.SYS_VFORK,
+	375, // copy_file_range
+	379, // statx
+	383, // rseq
+	424, // pidfd_send_signal
+	434, // pidfd_open
+	435, // clone3
+	436, // close_range
+	439, // faccessat2
+	441, // epoll_pwait2
+}
@@ -0,0 +1,14 @@
+// +build !linux linux,!amd64,!arm64,!ppc64le,!s390x
+
+package adapter
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// sandbox is only implemented on linux, for the architectures whose
+// syscalls the seccomp filter knows
+func sandbox(writable []string, allowExec bool) error {
+	return fmt.Errorf("the sandbox is not supported on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
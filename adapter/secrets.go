@@ -0,0 +1,171 @@
+package adapter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+// Kinds of secrets the daemon can obtain on its own, if the client does not
+// send them
+const (
+	SecretUserPin       = "user_pin"
+	SecretManagementKey = "management_key"
+)
+
+// SecretsConfig configures where secrets come from, by kind
+type SecretsConfig map[string]SecretSource
+
+// SecretSource obtains a secret on demand, so it never has to rest on disk.
+// Exactly one of the fields has to be set
+type SecretSource struct {
+	// Askpass is a program which is run with a prompt as its only argument
+	// and prints the secret on the first line of its output
+	Askpass string `json:"askpass"`
+	// Agent is the path of a unix socket. The daemon sends the kind of the
+	// secret followed by a newline and reads the secret from the first line
+	// of the answer
+	Agent string `json:"agent"`
+	// Keyring is the service name under which the secret is stored in the
+	// keyring of the operating system, with the kind as account name
+	Keyring string `json:"keyring"`
+	// Vault reads the secret from HashiCorp Vault
+	Vault *VaultSource `json:"vault"`
+}
+
+const (
+	agentTimeout = 30 * time.Second
+	// maxSecretLen is the longest answer read from an agent
+	maxSecretLen = 256
+)
+
+func (cfg SecretsConfig) validate() error {
+	for kind, src := range cfg {
+		if kind != SecretUserPin && kind != SecretManagementKey {
+			return fmt.Errorf("secrets: unknown kind %s, expected %s or %s", kind, SecretUserPin, SecretManagementKey)
+		}
+		if err := src.validate(); err != nil {
+			return fmt.Errorf("secrets: %s: %v", kind, err)
+		}
+	}
+	return nil
+}
+
+func (src SecretSource) validate() error {
+	set := 0
+	for _, v := range []string{src.Askpass, src.Agent, src.Keyring} {
+		if v != "" {
+			set++
+		}
+	}
+	if src.Vault != nil {
+		set++
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one source has to be configured")
+	}
+	if src.Vault != nil {
+		return src.Vault.validate()
+	}
+	return nil
+}
+
+// needsExec returns whether a source runs a helper program
+func (cfg SecretsConfig) needsExec() bool {
+	for _, src := range cfg {
+		if src.Askpass != "" || src.Keyring != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// secret returns passwd if the client sent one, otherwise it asks the source
+// configured for kind. If there is none passwd is returned unchanged
+func (cfg SecretsConfig) secret(kind string, passwd yubikey.Secret) (yubikey.Secret, error) {
+	if passwd != "" {
+		return passwd, nil
+	}
+	src, ok := cfg[kind]
+	if !ok {
+		return passwd, nil
+	}
+	// the backend takes the secret as a string, it is only copied into
+	// one once it is needed
+	secret, err := src.fetch(kind)
+	defer secret.Wipe()
+	return yubikey.Secret(secret), err
+}
+
+// fetch returns the secret in a buffer of its own, the caller wipes it
+func (src SecretSource) fetch(kind string) (yubikey.SecureBytes, error) {
+	switch {
+	case src.Askpass != "":
+		prompt := fmt.Sprintf("Enter the %s for the yubikey:", strings.Replace(kind, "_", " ", -1))
+		out, err := exec.Command(src.Askpass, prompt).Output()
+		defer yubikey.SecureBytes(out).Wipe()
+		if err != nil {
+			return nil, fmt.Errorf("askpass for %s failed: %v", kind, err)
+		}
+		return firstLine(out), nil
+	case src.Agent != "":
+		conn, err := net.DialTimeout("unix", src.Agent, agentTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("could not reach agent for %s: %v", kind, err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(agentTimeout))
+		if _, err := fmt.Fprintf(conn, "%s\n", kind); err != nil {
+			return nil, fmt.Errorf("agent for %s failed: %v", kind, err)
+		}
+		// read into a buffer of our own, a bufio.Reader would keep a copy
+		buf := make(yubikey.SecureBytes, maxSecretLen)
+		defer buf.Wipe()
+		n, err := readLine(conn, buf)
+		if err != nil && n == 0 {
+			return nil, fmt.Errorf("agent for %s failed: %v", kind, err)
+		}
+		return firstLine(buf[:n]), nil
+	case src.Keyring != "":
+		secret, err := keyringLookup(src.Keyring, kind)
+		if err != nil {
+			return nil, fmt.Errorf("keyring lookup for %s failed: %v", kind, err)
+		}
+		return secret, nil
+	case src.Vault != nil:
+		return vaultSecret(kind)
+	}
+	return nil, fmt.Errorf("no source for %s", kind)
+}
+
+// readLine reads from r into buf until a newline is read, buf is full or
+// the reader fails
+func readLine(r io.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if bytes.IndexByte(buf[n-m:n], '\n') >= 0 {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// firstLine copies the first line of b without its line ending
+func firstLine(b []byte) yubikey.SecureBytes {
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		b = b[:i]
+	}
+	b = bytes.TrimRight(b, "\r")
+	return append(yubikey.SecureBytes(nil), b...)
+}
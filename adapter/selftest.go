@@ -0,0 +1,159 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+const selftestUsage = "selftest"
+
+// errSelfTestFailed makes the selftest command exit with a failure
+var errSelfTestFailed = errors.New("self-test failed")
+
+// CheckResult is the outcome of a single self-test check
+type CheckResult struct {
+	Name   string
+	OK     bool
+	Detail string
+}
+
+type SelfTestReq struct {
+}
+
+type SelfTestRes struct {
+	Token      *backend.TokenInfo
+	TokenAlias string
+	Checks     []CheckResult
+}
+
+// SelfTest checks that the daemon can reach the token and read its keys,
+// without signing anything
+func (s *AdminServer) SelfTest(req SelfTestReq, res *SelfTestRes) error {
+	res.Token, res.Checks = runSelfTest(time.Now())
+	if res.Token != nil {
+		res.TokenAlias = deviceAlias(res.Token.Serial)
+	}
+	return nil
+}
+
+// runSelfTest runs all checks, the ones depending on a failed check are
+// reported as skipped
+func runSelfTest(now time.Time) (*backend.TokenInfo, []CheckResult) {
+	var checks []CheckResult
+	add := func(name string, err error, detail string) {
+		if err != nil {
+			detail = err.Error()
+		}
+		checks = append(checks, CheckResult{Name: name, OK: err == nil, Detail: detail})
+	}
+
+	session, err := ks.SetupHSMEnv()
+	add("session", err, fmt.Sprintf("backend %s", ks.Name()))
+	if err != nil {
+		for _, name := range []string{"token", "keys", "certificates"} {
+			checks = append(checks, CheckResult{Name: name, Detail: "skipped, no session"})
+		}
+		return nil, checks
+	}
+	defer ks.CloseSession(session)
+
+	var token *backend.TokenInfo
+	if inspector, ok := ks.(backend.TokenInspector); ok {
+		ti, err := inspector.TokenInfo(session)
+		if err == nil {
+			token = &ti
+		}
+		add("token", err, fmt.Sprintf("serial %s, firmware %s, %d free slots", deviceName(ti.Serial), ti.Firmware, len(ti.FreeSlots)))
+	} else {
+		add("token", nil, "not supported by the backend")
+	}
+
+	keys, err := ks.HardwareListKeys(session)
+	if yubikey.ErrorCodeOf(err) == yubikey.ErrCodeKeyNotFound {
+		err = nil
+	}
+	add("keys", err, fmt.Sprintf("%d keys", len(keys)))
+
+	if expirer, ok := ks.(backend.CertExpirer); ok {
+		notAfter, err := expirer.CertExpiry(session)
+		if err == nil {
+			if expired := expiringKeys(notAfter, now, 0); len(expired) > 0 {
+				err = fmt.Errorf("certificates of %d keys expired: %v", len(expired), expired)
+			}
+		}
+		add("certificates", err, fmt.Sprintf("%d certificates valid", len(notAfter)))
+	} else {
+		add("certificates", nil, "not supported by the backend")
+	}
+	return token, checks
+}
+
+type checkJSON struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// selfTestJSON is the stable schema of selftest --json
+type selfTestJSON struct {
+	SchemaVersion int         `json:"schema_version"`
+	OK            bool        `json:"ok"`
+	Token         *tokenJSON  `json:"token"`
+	Checks        []checkJSON `json:"checks"`
+}
+
+func selftestCommand(args []string) error {
+	if len(args) != 0 {
+		return usageError(selftestUsage)
+	}
+	res := new(SelfTestRes)
+	if err := adminCall("SelfTest", SelfTestReq{}, res); err != nil {
+		return err
+	}
+	ok := true
+	for _, c := range res.Checks {
+		ok = ok && c.OK
+	}
+
+	var err error
+	if jsonOutput() {
+		err = printJSON(selfTestJSON{SchemaVersion: statusSchemaVersion, OK: ok, Token: newTokenJSON(res.Token, res.TokenAlias), Checks: newChecksJSON(res.Checks)})
+	} else {
+		err = printChecks(res.Checks)
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errSelfTestFailed
+	}
+	return nil
+}
+
+func newChecksJSON(checks []CheckResult) []checkJSON {
+	out := make([]checkJSON, 0, len(checks))
+	for _, c := range checks {
+		out = append(out, checkJSON{Name: c.Name, OK: c.OK, Detail: c.Detail})
+	}
+	return out
+}
+
+// printChecks prints the results of selftest and preflight as a table
+func printChecks(checks []CheckResult) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tRESULT\tDETAIL")
+	for _, c := range checks {
+		result := "ok"
+		if !c.OK {
+			result = "FAILED"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.Name, result, c.Detail)
+	}
+	return w.Flush()
+}
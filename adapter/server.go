@@ -0,0 +1,637 @@
+// Package adapter is the notary-yubikey-adapter daemon. Main runs it as
+// configured by the command line, which is all cmd/notary-yubikey-adapter
+// does. Programs embedding the externalstore server pick a backend with
+// SetBackend and hand their listener to Serve
+package adapter
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"sync"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/wire/upstream"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+// ESServer serves the externalstore RPCs of a single connection
+type ESServer struct {
+	peer *peerCred
+	// sessions are the sessions set up over the connection and not yet
+	// cleaned up, they are closed together with the connection
+	sessionsLock sync.Mutex
+	sessions     map[uint]bool
+}
+
+// ks is the backend selected with -backend
+var ks backend.Backend
+
+// SetBackend makes the server use b instead of the backend selected with
+// -backend, for programs embedding it
+func SetBackend(b backend.Backend) {
+	ks = b
+}
+
+// NewServer returns an ESServer for a connection from peer
+func NewServer(peer *peerCred) *ESServer {
+	return &ESServer{peer: peer, sessions: make(map[uint]bool)}
+}
+
+// sessionOwners is the server of the connection each session was set up
+// over. The module may hand out the handle of a closed session again, the
+// last server it was handed to owns it
+var sessionOwners = &sessionOwnerRegistry{owners: make(map[uint]*ESServer)}
+
+type sessionOwnerRegistry struct {
+	sync.Mutex
+	owners map[uint]*ESServer
+}
+
+// claim makes s the owner of session, a server which owned the handle
+// before no longer closes it
+func (r *sessionOwnerRegistry) claim(session uint, s *ESServer) {
+	r.Lock()
+	previous := r.owners[session]
+	r.owners[session] = s
+	r.Unlock()
+	if previous != nil && previous != s {
+		previous.sessionsLock.Lock()
+		delete(previous.sessions, session)
+		previous.sessionsLock.Unlock()
+	}
+}
+
+// release ends the ownership of s and tells whether s owned session
+func (r *sessionOwnerRegistry) release(session uint, s *ESServer) bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.owners[session] != s {
+		return false
+	}
+	delete(r.owners, session)
+	return true
+}
+
+// closeSessions closes the sessions the client left open when its
+// connection ended, once the RPCs still using them are done
+func (s *ESServer) closeSessions() {
+	s.sessionsLock.Lock()
+	sessions := s.sessions
+	s.sessions = make(map[uint]bool)
+	s.sessionsLock.Unlock()
+	for session := range sessions {
+		release := sessionQueues.acquire(session)
+		// the handle may have been handed to another connection since
+		if sessionOwners.release(session, s) {
+			logrus.Infof("Closing session %d left open by %s", session, s.peer)
+			ks.CloseSession(pkcs11.SessionHandle(session))
+			openSessions.close(session)
+		}
+		release()
+	}
+}
+
+// authorizeSign runs all checks which have to pass before the token is
+// asked to sign: maintenance mode, the policy, operator approval and dual
+// control. The returned release gives back the place the signature reserved
+// in the rate limit of the key, it has to be called if the token fails to sign
+func (s *ESServer) authorizeSign(keyID string, role string, payload []byte, passwd yubikey.Secret) (func(), error) {
+	if err := maintenance.check(); err != nil {
+		return nil, err
+	}
+	if err := signPolicy.checkKeyAge(keyID, role, keysCreated.get(keyID)); err != nil {
+		return nil, err
+	}
+	release, err := signPolicy.authorizeSign(s.peer, keyID, role)
+	if err != nil {
+		return nil, err
+	}
+	if approvalMode {
+		if err := approvals.wait(s.peer, keyID, role, payload, approvalTimeout); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	if err := confirmDualControl(s.peer, role, passwd); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// managementKey returns the management key the client sent. If it sent
+// none, the source configured in the secrets section is only asked for
+// peers the policy allows to manage keys
+func (s *ESServer) managementKey(passwd yubikey.Secret) (yubikey.Secret, error) {
+	if _, ok := config.Secrets[SecretManagementKey]; ok && passwd == "" {
+		if err := signPolicy.authorizeManage(s.peer); err != nil {
+			return passwd, err
+		}
+	}
+	return config.Secrets.secret(SecretManagementKey, passwd)
+}
+
+// checkWritable refuses requests which change the keys or certificates on
+// the token in read-only mode
+func checkWritable(op string) error {
+	if readOnly {
+		return yubikey.NewError(yubikey.ErrCodePolicyDenied, "the daemon is read-only, %s is not allowed", op)
+	}
+	return nil
+}
+
+// rpcError makes sure every error leaving the server carries an ErrorCode.
+// The codec logs it together with the request ID
+func rpcError(err error) error {
+	return yubikey.WrapError(yubikey.ErrCodeUnknown, err)
+}
+
+func (s *ESServer) Name(req wire.ESNameReq, res *wire.ESNameRes) error {
+	res.Name = ks.Name()
+	return nil
+}
+
+func (s *ESServer) AddECDSAKey(req AddECDSAKeyReq, res *wire.ESAddECDSAKeyRes) error {
+	defer sessionQueues.acquire(req.Session)()
+	session := pkcs11.SessionHandle(req.Session)
+	// privKey shares the bytes of the request
+	defer yubikey.SecureBytes(req.PrivateKey.Private).Wipe()
+	privKey, err := upstream.PrivateKey(req.PrivateKey)
+	if err != nil {
+		return yubikey.WrapError(yubikey.ErrCodeInvalidRequest, err)
+	}
+	if req.PIVSlot != "" {
+		if req.Slot.SlotID, err = yubikey.ParseSlot(req.PIVSlot); err != nil {
+			return rpcError(err)
+		}
+	}
+	pass, err := s.managementKey(req.Pass)
+	if err != nil {
+		return rpcError(yubikey.WrapError(yubikey.ErrCodeWrongPin, err))
+	}
+	opts := backend.AddKeyOptions{Overwrite: req.Overwrite}
+	if err = checkWritable("adding keys"); err == nil {
+		err = checkSessionDevice(session, string(req.Role))
+	}
+	if err == nil {
+		err = ks.AddECDSAKeyWithOptions(session, privKey, upstream.CommonSlot(req.Slot), pass.Reveal(), data.RoleName(req.Role), opts)
+	}
+	if err == nil {
+		// strict key age refuses keys of unknown age until the next check
+		keysCreated.add(privKey.ID(), time.Now())
+	}
+	audit("add_key", s.peer, req.logFields(logrus.Fields{"key_id": privKey.ID(), "role": req.Role, "slot": req.Slot.SlotID, "overwrite": req.Overwrite}), err)
+	return rpcError(err)
+}
+
+// generateKey generates a key for role on the token, in the next empty
+// slot. It serves the clients which have no key to import, the PIN and the
+// management key come from the secrets section
+func (s *ESServer) generateKey(sessionID uint, role data.RoleName) (*data.ECDSAPublicKey, error) {
+	defer sessionQueues.acquire(sessionID)()
+	session := pkcs11.SessionHandle(sessionID)
+	generator, ok := ks.(backend.KeyGenerator)
+	if !ok {
+		return nil, rpcError(yubikey.NewError(yubikey.ErrCodeInvalidRequest, "backend %s can not generate keys", ks.Name()))
+	}
+	fields := logrus.Fields{"role": role}
+	err := signPolicy.authorizeManage(s.peer)
+	if err == nil {
+		err = checkWritable("adding keys")
+	}
+	if err == nil {
+		err = checkSessionDevice(session, role.String())
+	}
+	if err != nil {
+		audit("generate_key", s.peer, fields, err)
+		return nil, rpcError(err)
+	}
+	pin, err := config.Secrets.secret(SecretUserPin, "")
+	if err != nil {
+		return nil, rpcError(yubikey.WrapError(yubikey.ErrCodeWrongPin, err))
+	}
+	managementKey, err := s.managementKey("")
+	if err != nil {
+		return nil, rpcError(yubikey.WrapError(yubikey.ErrCodeWrongPin, err))
+	}
+	slotID, err := ks.GetNextEmptySlot(session)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	fields["slot"] = slotID
+	pubKey, err := generator.GenerateECDSAKey(session, common.HardwareSlot{Role: role, SlotID: slotID}, role, pin.Reveal(), managementKey.Reveal())
+	if err == nil {
+		fields["key_id"] = pubKey.ID()
+		keysCreated.add(pubKey.ID(), time.Now())
+	}
+	audit("generate_key", s.peer, fields, err)
+	return pubKey, rpcError(err)
+}
+
+func (s *ESServer) GetECDSAKey(req wire.ESGetECDSAKeyReq, res *wire.ESGetECDSAKeyRes) error {
+	defer sessionQueues.acquire(req.Session)()
+	session := pkcs11.SessionHandle(req.Session)
+	pubKey, role, err := ks.GetECDSAKey(session, upstream.CommonSlot(req.Slot), req.Pass)
+	if err != nil {
+		return rpcError(err)
+	}
+	res.PublicKey = upstream.NewPublicKey(pubKey)
+	res.Role = role.String()
+	return nil
+}
+
+func (s *ESServer) Sign(req SignReq, res *wire.ESSignRes) error {
+	session := pkcs11.SessionHandle(req.Session)
+	slot := upstream.CommonSlot(req.Slot)
+	var (
+		targets []signTarget
+		err     error
+	)
+	release := sessionQueues.acquire(req.Session)
+	if req.URI != "" {
+		slot, targets, err = uriTargets(session, req.URI)
+	} else {
+		slot, err = resolveSignSlot(session, slot)
+	}
+	release()
+	if err != nil {
+		if yubikey.ErrorCodeOf(err) == yubikey.ErrCodePolicyDenied {
+			audit("sign_denied", s.peer, req.logFields(logrus.Fields{"key_id": req.Slot.KeyID, "role": req.Slot.Role, "slot": req.Slot.SlotID}), err)
+		}
+		return rpcError(err)
+	}
+	fields := req.logFields(logrus.Fields{"key_id": slot.KeyID, "role": slot.Role, "slot": slot.SlotID})
+	if req.URI != "" {
+		fields["uri"] = req.URI
+	}
+	pass, err := config.Secrets.secret(SecretUserPin, req.Pass)
+	if err != nil {
+		return rpcError(yubikey.WrapError(yubikey.ErrCodeWrongPin, err))
+	}
+	unreserve, err := s.authorizeSign(slot.KeyID, string(slot.Role), req.Payload, pass)
+	if err != nil {
+		audit("sign_denied", s.peer, fields, err)
+		signMetrics.recordSign(slot.KeyID, string(slot.Role), err)
+		return rpcError(err)
+	}
+	opts := backend.SignOptions{
+		DigestAlgorithm: req.DigestAlgorithm,
+		Prehashed:       req.Prehashed,
+		Encoding:        req.SignatureEncoding,
+		LowS:            req.LowS,
+	}
+	// approvals may take a while, the session is only held for signing
+	var result []byte
+	release = sessionQueues.acquire(req.Session)
+	if targets != nil {
+		result, err = signOnTargets(session, string(slot.Role), targets, pass.Reveal(), req.Payload, opts)
+	} else {
+		result, err = signOnDevices(session, slot, pass.Reveal(), req.Payload, opts)
+	}
+	release()
+	event := "sign"
+	if yubikey.ErrorCodeOf(err) == yubikey.ErrCodePolicyDenied {
+		event = "sign_denied"
+	}
+	audit(event, s.peer, fields, err)
+	signMetrics.recordSign(slot.KeyID, string(slot.Role), err)
+	if err != nil {
+		unreserve()
+		return rpcError(err)
+	}
+	res.Result = result
+	return nil
+}
+
+// resolveSignSlot looks up the key stored in the slot a sign request names.
+// The token signs with whatever is in the slot, so the checks before signing
+// go by the key ID and role found there. The ones the client sent only have
+// to agree with them. Keys of other attached devices are found in the last
+// listing of all devices
+func resolveSignSlot(session pkcs11.SessionHandle, slot common.HardwareSlot) (common.HardwareSlot, error) {
+	keys, err := ks.HardwareListKeys(session)
+	if err != nil && yubikey.ErrorCodeOf(err) != yubikey.ErrCodeKeyNotFound {
+		return slot, err
+	}
+	for keyID, stored := range keys {
+		if bytes.Equal(stored.SlotID, slot.SlotID) {
+			stored.KeyID = keyID
+			return stored, checkSignSlot(slot, stored)
+		}
+	}
+	if _, isMulti := ks.(backend.MultiToken); isMulti && slot.KeyID != "" {
+		for _, tk := range tokenKeys.lookup(slot.KeyID) {
+			if bytes.Equal(tk.Slot.SlotID, slot.SlotID) {
+				stored := tk.Slot
+				stored.KeyID = tk.KeyID
+				return stored, checkSignSlot(slot, stored)
+			}
+		}
+	}
+	return slot, yubikey.NewError(yubikey.ErrCodeKeyNotFound, "no key in slot %s", yubikey.SlotName(slot.SlotID))
+}
+
+// checkSignSlot refuses a sign request whose key ID or role do not match
+// the key stored in the slot
+func checkSignSlot(requested, stored common.HardwareSlot) error {
+	if (requested.KeyID != "" && requested.KeyID != stored.KeyID) || (requested.Role != "" && requested.Role != stored.Role) {
+		return yubikey.NewError(yubikey.ErrCodePolicyDenied, "slot %s holds the %s key %s, not the %s key %s",
+			yubikey.SlotName(stored.SlotID), stored.Role, stored.KeyID, requested.Role, requested.KeyID)
+	}
+	return nil
+}
+
+func (s *ESServer) HardwareRemoveKey(req HardwareRemoveKeyReq, res *wire.ESHardwareRemoveKeyRes) error {
+	defer sessionQueues.acquire(req.Session)()
+	session := pkcs11.SessionHandle(req.Session)
+	pass, err := s.managementKey(yubikey.Secret(req.Pass))
+	if err != nil {
+		return rpcError(yubikey.WrapError(yubikey.ErrCodeWrongPin, err))
+	}
+	if err = checkWritable("removing keys"); err == nil {
+		err = ks.HardwareRemoveKey(session, upstream.CommonSlot(req.Slot), pass.Reveal(), req.KeyID)
+	}
+	audit("remove_key", s.peer, req.logFields(logrus.Fields{"key_id": req.KeyID, "role": req.Slot.Role, "slot": req.Slot.SlotID}), err)
+	return rpcError(err)
+}
+
+// RemoveKey removes a key by its ID alone, the slot is resolved from the
+// keys currently stored on the token
+func (s *ESServer) RemoveKey(req RemoveKeyReq, res *RemoveKeyRes) error {
+	defer sessionQueues.acquire(req.Session)()
+	session := pkcs11.SessionHandle(req.Session)
+	if err := checkWritable("removing keys"); err != nil {
+		audit("remove_key", s.peer, req.logFields(logrus.Fields{"key_id": req.KeyID}), err)
+		return rpcError(err)
+	}
+	keys, err := ks.HardwareListKeys(session)
+	if err != nil {
+		return rpcError(err)
+	}
+	slot, ok := keys[req.KeyID]
+	if !ok {
+		err = yubikey.NewError(yubikey.ErrCodeKeyNotFound, "no key with ID %s on the token", req.KeyID)
+		audit("remove_key", s.peer, req.logFields(logrus.Fields{"key_id": req.KeyID}), err)
+		return rpcError(err)
+	}
+	pass, err := s.managementKey(req.Pass)
+	if err != nil {
+		return rpcError(yubikey.WrapError(yubikey.ErrCodeWrongPin, err))
+	}
+	err = ks.HardwareRemoveKey(session, slot, pass.Reveal(), req.KeyID)
+	audit("remove_key", s.peer, req.logFields(logrus.Fields{"key_id": req.KeyID, "role": slot.Role, "slot": slot.SlotID}), err)
+	if err != nil {
+		return rpcError(err)
+	}
+	res.Slot = upstream.Slot(slot)
+	return nil
+}
+
+// GetPublicKey returns the PEM encoded public key of the key with the given
+// ID, so it can be registered with systems other than notary
+func (s *ESServer) GetPublicKey(req GetPublicKeyReq, res *GetPublicKeyRes) error {
+	defer sessionQueues.acquire(req.Session)()
+	session := pkcs11.SessionHandle(req.Session)
+	keys, err := ks.HardwareListKeys(session)
+	if err != nil {
+		return rpcError(err)
+	}
+	slot, ok := keys[req.KeyID]
+	if !ok {
+		return rpcError(yubikey.NewError(yubikey.ErrCodeKeyNotFound, "no key with ID %s on the token", req.KeyID))
+	}
+	pubKey, role, err := ks.GetECDSAKey(session, slot, "")
+	if err != nil {
+		return rpcError(err)
+	}
+	res.Role = role.String()
+	res.Slot = upstream.Slot(slot)
+	res.PEM = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKey.Public()})
+	return nil
+}
+
+// RenewCert issues a new certificate for an existing key, see RenewCertReq
+func (s *ESServer) RenewCert(req RenewCertReq, res *RenewCertRes) error {
+	defer sessionQueues.acquire(req.Session)()
+	session := pkcs11.SessionHandle(req.Session)
+	renewer, ok := ks.(backend.CertRenewer)
+	if !ok {
+		return rpcError(yubikey.NewError(yubikey.ErrCodeInvalidRequest, "backend %s does not support certificate renewal", ks.Name()))
+	}
+	keys, err := ks.HardwareListKeys(session)
+	if err != nil {
+		return rpcError(err)
+	}
+	slot, ok := keys[req.KeyID]
+	if !ok {
+		return rpcError(yubikey.NewError(yubikey.ErrCodeKeyNotFound, "no key with ID %s on the token", req.KeyID))
+	}
+	fields := req.logFields(logrus.Fields{"key_id": req.KeyID, "role": slot.Role, "slot": slot.SlotID})
+
+	if req.CSR {
+		// the key signs the request, so it has to pass the checks of any
+		// other signature, and only peers managing keys may ask for one
+		if err := signPolicy.authorizeManage(s.peer); err != nil {
+			audit("sign_denied", s.peer, fields, err)
+			return rpcError(err)
+		}
+		pin, err := config.Secrets.secret(SecretUserPin, req.Pass)
+		if err != nil {
+			return rpcError(yubikey.WrapError(yubikey.ErrCodeWrongPin, err))
+		}
+		unreserve, err := s.authorizeSign(req.KeyID, string(slot.Role), nil, pin)
+		if err != nil {
+			audit("sign_denied", s.peer, fields, err)
+			return rpcError(err)
+		}
+		res.CSR, err = renewer.CertificateRequest(session, slot, pin.Reveal())
+		audit("cert_request", s.peer, fields, err)
+		if err != nil {
+			unreserve()
+		}
+		return rpcError(err)
+	}
+
+	if err := checkWritable("renewing certificates"); err != nil {
+		audit("renew_cert", s.peer, fields, err)
+		return rpcError(err)
+	}
+	managementKey, err := s.managementKey(req.ManagementKey)
+	if err != nil {
+		return rpcError(yubikey.WrapError(yubikey.ErrCodeWrongPin, err))
+	}
+	if req.Certificate != nil {
+		err = renewer.ReplaceCertificate(session, slot, managementKey.Reveal(), req.Certificate)
+		audit("renew_cert", s.peer, fields, err)
+		if err != nil {
+			return rpcError(err)
+		}
+		if cert, err := x509.ParseCertificate(req.Certificate); err == nil {
+			res.NotAfter = cert.NotAfter
+		}
+		return nil
+	}
+	if req.Validity <= 0 {
+		return rpcError(yubikey.NewError(yubikey.ErrCodeInvalidRequest, "validity has to be positive"))
+	}
+	pin, err := config.Secrets.secret(SecretUserPin, req.Pass)
+	if err != nil {
+		return rpcError(yubikey.WrapError(yubikey.ErrCodeWrongPin, err))
+	}
+	res.NotAfter, err = renewer.RenewCertificate(session, slot, pin.Reveal(), managementKey.Reveal(), req.Validity)
+	fields["not_after"] = res.NotAfter
+	audit("renew_cert", s.peer, fields, err)
+	return rpcError(err)
+}
+
+// AdoptKey makes a key provisioned outside of notary usable, see AdoptKeyReq
+func (s *ESServer) AdoptKey(req AdoptKeyReq, res *AdoptKeyRes) error {
+	defer sessionQueues.acquire(req.Session)()
+	session := pkcs11.SessionHandle(req.Session)
+	adopter, ok := ks.(backend.KeyAdopter)
+	if !ok {
+		return rpcError(yubikey.NewError(yubikey.ErrCodeInvalidRequest, "backend %s can not adopt keys", ks.Name()))
+	}
+	slotID, err := yubikey.ParseSlot(req.Slot)
+	if err != nil {
+		return rpcError(err)
+	}
+	if req.Validity <= 0 {
+		return rpcError(yubikey.NewError(yubikey.ErrCodeInvalidRequest, "validity has to be positive"))
+	}
+	fields := req.logFields(logrus.Fields{"role": req.Role, "slot": slotID})
+	if err := checkWritable("adopting keys"); err != nil {
+		audit("adopt_key", s.peer, fields, err)
+		return rpcError(err)
+	}
+	if err := checkSessionDevice(session, req.Role); err != nil {
+		audit("adopt_key", s.peer, fields, err)
+		return rpcError(err)
+	}
+	pin, err := config.Secrets.secret(SecretUserPin, req.Pass)
+	if err != nil {
+		return rpcError(yubikey.WrapError(yubikey.ErrCodeWrongPin, err))
+	}
+	managementKey, err := s.managementKey(req.ManagementKey)
+	if err != nil {
+		return rpcError(yubikey.WrapError(yubikey.ErrCodeWrongPin, err))
+	}
+	res.KeyID, res.OldCertificate, err = adopter.AdoptKey(session, slotID, data.RoleName(req.Role), pin.Reveal(), managementKey.Reveal(), req.Validity)
+	fields["key_id"] = res.KeyID
+	audit("adopt_key", s.peer, fields, err)
+	return rpcError(err)
+}
+
+func (s *ESServer) HardwareListKeys(req HardwareListKeysReq, res *HardwareListKeysRes) error {
+	defer sessionQueues.acquire(req.Session)()
+	defer latencies.since(latencyListKeys, time.Now())
+	session := pkcs11.SessionHandle(req.Session)
+	sessionKeys, err := ks.HardwareListKeys(session)
+	keys := sessionKeys
+	var all []backend.TokenKey
+	if multi, ok := ks.(backend.MultiToken); ok {
+		// list the keys of all attached devices, not only of the session's
+		var merr error
+		if all, merr = multi.ListAllTokenKeys(); merr == nil && len(all) > 0 {
+			tokenKeys.set(all)
+			keys, res.Devices = mergeTokenKeys(keys, all)
+			res.DeviceAliases = deviceAliases(res.Devices)
+			// a token without keys adds nothing to the listing, but the
+			// keys of a token which failed are only known if the listing
+			// of all devices found them
+			if yubikey.ErrorCodeOf(err) == yubikey.ErrCodeKeyNotFound || listsDevice(all, sessionDevice(session)) {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		return rpcError(err)
+	}
+	res.Keys = upstream.Slots(keys)
+	res.PublicKeySHA256 = keyFingerprints(session, keys, sessionKeys, all)
+	if expirer, ok := ks.(backend.CertExpirer); ok {
+		res.NotAfter, err = expirer.CertExpiry(session)
+		if err != nil {
+			return rpcError(err)
+		}
+		updateCertExpiry(res.NotAfter)
+	}
+	if req.Attestation {
+		attester, ok := ks.(backend.Attester)
+		if !ok {
+			return rpcError(yubikey.NewError(yubikey.ErrCodeInvalidRequest, "backend %s does not support attestation", ks.Name()))
+		}
+		keyIDs := make([]string, 0, len(keys))
+		for keyID := range keys {
+			keyIDs = append(keyIDs, keyID)
+		}
+		res.Attested, err = attester.AttestKeys(session, keyIDs)
+		if err != nil {
+			return rpcError(err)
+		}
+	}
+	return nil
+}
+
+func (s *ESServer) GetNextEmptySlot(req wire.ESGetNextEmptySlotReq, res *wire.ESGetNextEmptySlotRes) error {
+	defer sessionQueues.acquire(req.Session)()
+	session := pkcs11.SessionHandle(req.Session)
+	slot, err := ks.GetNextEmptySlot(session)
+	if err != nil {
+		return rpcError(err)
+	}
+	res.Slot = slot
+	return nil
+}
+
+func (s *ESServer) SetupHSMEnv(req wire.ESSetupHSMEnvReq, res *wire.ESSetupHSMEnvRes) error {
+	defer latencies.since(latencySetupHSMEnv, time.Now())
+	session, err := ks.SetupHSMEnv()
+	if err != nil {
+		return rpcError(err)
+	}
+	res.Session = uint(session)
+	openSessions.open(res.Session, s.peer)
+	sessionOwners.claim(res.Session, s)
+	s.sessionsLock.Lock()
+	s.sessions[res.Session] = true
+	s.sessionsLock.Unlock()
+	return nil
+}
+
+// Cleanup closes a session set up over the same connection, the sessions of
+// other connections are left alone
+func (s *ESServer) Cleanup(req wire.ESCleanupReq, _ *wire.ESCleanupReq) error {
+	defer sessionQueues.acquire(req.Session)()
+	if !sessionOwners.release(req.Session, s) {
+		return rpcError(yubikey.NewError(yubikey.ErrCodeInvalidRequest, "session %d was not set up over this connection", req.Session))
+	}
+	ks.CloseSession(pkcs11.SessionHandle(req.Session))
+	openSessions.close(req.Session)
+	s.sessionsLock.Lock()
+	delete(s.sessions, req.Session)
+	s.sessionsLock.Unlock()
+	return nil
+}
+
+func (s *ESServer) NeedLogin(req wire.ESNeedLoginReq, res *wire.ESNeedLoginRes) error {
+	if needed, userFlag, ok := config.NeedLogin.lookup(req.Function_ID); ok {
+		res.NeedLogin = needed
+		res.UserFlag = userFlag
+		return nil
+	}
+	needed, userFlag, err := ks.NeedLogin(req.Function_ID)
+	if err != nil {
+		return rpcError(err)
+	}
+	res.NeedLogin = needed
+	res.UserFlag = userFlag
+	return nil
+}
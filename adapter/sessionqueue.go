@@ -0,0 +1,70 @@
+package adapter
+
+import (
+	"sync"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/miekg/pkcs11"
+)
+
+// sessionQueue makes the RPCs sharing a session run one after another. A
+// pkcs11 session holds a single search or signature at a time, so a client
+// signing and listing keys concurrently on one session would have the
+// calls of both interleave and corrupt each other
+type sessionQueue struct {
+	sync.Mutex
+	sessions map[uint]*queuedSession
+}
+
+type queuedSession struct {
+	sync.Mutex
+	// waiting counts the RPCs using or waiting for the session
+	waiting int
+}
+
+var sessionQueues = &sessionQueue{sessions: make(map[uint]*queuedSession)}
+
+// acquire waits until no other RPC uses session, the returned function
+// hands it on to the next one. A signature still waiting for touch after
+// the touch timeout keeps the session until the pkcs11 module returned
+func (q *sessionQueue) acquire(session uint) func() {
+	q.Lock()
+	s, ok := q.sessions[session]
+	if !ok {
+		s = new(queuedSession)
+		q.sessions[session] = s
+	}
+	s.waiting++
+	q.Unlock()
+
+	s.Lock()
+	release := func() {
+		s.Unlock()
+		q.Lock()
+		defer q.Unlock()
+		s.waiting--
+		if s.waiting == 0 {
+			delete(q.sessions, session)
+		}
+	}
+	return func() {
+		if pending := yubikey.PendingSign(pkcs11.SessionHandle(session)); pending != nil {
+			go func() {
+				<-pending
+				release()
+			}()
+			return
+		}
+		release()
+	}
+}
+
+// queued returns how many RPCs wait for session, besides the one using it
+func (q *sessionQueue) queued(session uint) int {
+	q.Lock()
+	defer q.Unlock()
+	if s, ok := q.sessions[session]; ok && s.waiting > 1 {
+		return s.waiting - 1
+	}
+	return 0
+}
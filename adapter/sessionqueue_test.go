@@ -0,0 +1,152 @@
+package adapter
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+// sessionBackend counts the calls which used a session while another call
+// was still using it, like a search interleaved with a signature
+type sessionBackend struct {
+	backend.Backend
+	sync.Mutex
+	using    map[pkcs11.SessionHandle]int
+	overlaps int
+	// opened is the last session handed out
+	opened pkcs11.SessionHandle
+}
+
+func (b *sessionBackend) SetupHSMEnv() (pkcs11.SessionHandle, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.opened++
+	return b.opened, nil
+}
+
+func (b *sessionBackend) use(session pkcs11.SessionHandle) func() {
+	b.Lock()
+	b.using[session]++
+	if b.using[session] > 1 {
+		b.overlaps++
+	}
+	b.Unlock()
+	time.Sleep(time.Millisecond)
+	return func() {
+		b.Lock()
+		b.using[session]--
+		b.Unlock()
+	}
+}
+
+func (b *sessionBackend) SignWithOptions(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string, payload []byte, opts backend.SignOptions) ([]byte, error) {
+	defer b.use(session)()
+	return []byte("signature"), nil
+}
+
+func (b *sessionBackend) HardwareListKeys(session pkcs11.SessionHandle) (map[string]common.HardwareSlot, error) {
+	defer b.use(session)()
+	return map[string]common.HardwareSlot{
+		"abc": {Role: data.CanonicalRootRole, SlotID: []byte{2}},
+		"def": {Role: data.CanonicalTargetsRole, SlotID: []byte{3}},
+	}, nil
+}
+
+func (b *sessionBackend) GetECDSAKey(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string) (*data.ECDSAPublicKey, data.RoleName, error) {
+	defer b.use(session)()
+	return nil, "", yubikey.NewError(yubikey.ErrCodeKeyNotFound, "no public key")
+}
+
+func (b *sessionBackend) CloseSession(session pkcs11.SessionHandle) {
+	defer b.use(session)()
+}
+
+func TestParallelRPCsOnSession(t *testing.T) {
+	defer func(old backend.Backend) { ks = old }(ks)
+	fake := &sessionBackend{using: make(map[pkcs11.SessionHandle]int)}
+	ks = fake
+	s := NewServer(nil)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, s.SetupHSMEnv(wire.ESSetupHSMEnvReq{}, new(wire.ESSetupHSMEnvRes)))
+	}
+
+	var wg sync.WaitGroup
+	for session := uint(1); session <= 2; session++ {
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(session uint, i int) {
+				defer wg.Done()
+				if i%2 == 0 {
+					req := SignReq{Session: session, Slot: wire.HardwareSlot{KeyID: "abc", Role: data.CanonicalRootRole.String(), SlotID: []byte{2}}, Pass: "123456", Payload: []byte("payload")}
+					require.NoError(t, s.Sign(req, new(wire.ESSignRes)))
+				} else {
+					require.NoError(t, s.HardwareListKeys(HardwareListKeysReq{Session: session}, new(HardwareListKeysRes)))
+				}
+			}(session, i)
+		}
+	}
+	wg.Wait()
+	require.NoError(t, s.Cleanup(wire.ESCleanupReq{Session: 1}, nil))
+	require.NoError(t, s.Cleanup(wire.ESCleanupReq{Session: 2}, nil))
+
+	require.Zero(t, fake.overlaps)
+	require.Empty(t, sessionQueues.sessions)
+}
+
+func TestSignResolvesSlot(t *testing.T) {
+	defer func(old backend.Backend) { ks = old }(ks)
+	ks = &sessionBackend{using: make(map[pkcs11.SessionHandle]int)}
+	defer func(old *policy) { signPolicy = old }(signPolicy)
+	signPolicy = newPolicy(PolicyConfig{Roles: map[string]RolePolicy{"root": {UIDs: []uint32{0}}}})
+	s := NewServer(&peerCred{UID: 1000})
+	require.NoError(t, s.SetupHSMEnv(wire.ESSetupHSMEnvReq{}, new(wire.ESSetupHSMEnvRes)))
+
+	// the root key in slot 2 labelled as the targets key
+	req := SignReq{Session: 1, Slot: wire.HardwareSlot{KeyID: "def", Role: data.CanonicalTargetsRole.String(), SlotID: []byte{2}}, Pass: "123456", Payload: []byte("payload")}
+	err := s.Sign(req, new(wire.ESSignRes))
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(err))
+	req.Slot = wire.HardwareSlot{KeyID: "abc", Role: data.CanonicalTargetsRole.String(), SlotID: []byte{2}}
+	err = s.Sign(req, new(wire.ESSignRes))
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(err))
+	// the client's labels do not decide the role the policy checks
+	req.Slot = wire.HardwareSlot{SlotID: []byte{2}}
+	err = s.Sign(req, new(wire.ESSignRes))
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(err))
+	req.Slot = wire.HardwareSlot{SlotID: []byte{4}}
+	err = s.Sign(req, new(wire.ESSignRes))
+	require.Equal(t, yubikey.ErrCodeKeyNotFound, yubikey.ErrorCodeOf(err))
+
+	req.Slot = wire.HardwareSlot{KeyID: "def", Role: data.CanonicalTargetsRole.String(), SlotID: []byte{3}}
+	require.NoError(t, s.Sign(req, new(wire.ESSignRes)))
+	require.NoError(t, s.Cleanup(wire.ESCleanupReq{Session: 1}, nil))
+}
+
+func TestSessionsOfOtherConnections(t *testing.T) {
+	defer func(old backend.Backend) { ks = old }(ks)
+	fake := &sessionBackend{using: make(map[pkcs11.SessionHandle]int)}
+	ks = fake
+	first, second := NewServer(&peerCred{UID: 1000}), NewServer(&peerCred{UID: 1001})
+	res := new(wire.ESSetupHSMEnvRes)
+	require.NoError(t, first.SetupHSMEnv(wire.ESSetupHSMEnvReq{}, res))
+
+	err := second.Cleanup(wire.ESCleanupReq{Session: res.Session}, nil)
+	require.Equal(t, yubikey.ErrCodeInvalidRequest, yubikey.ErrorCodeOf(err))
+	require.Contains(t, openSessions.sessions, res.Session)
+
+	// the module hands the handle of a session it closed to the second
+	// connection, the first one must not close it when it ends
+	fake.opened--
+	require.NoError(t, second.SetupHSMEnv(wire.ESSetupHSMEnvReq{}, new(wire.ESSetupHSMEnvRes)))
+	first.closeSessions()
+	require.Contains(t, openSessions.sessions, res.Session)
+	require.NoError(t, second.Cleanup(wire.ESCleanupReq{Session: res.Session}, nil))
+	require.NotContains(t, openSessions.sessions, res.Session)
+}
@@ -0,0 +1,150 @@
+package adapter
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// envPrefix prefixes the environment variables which set flags, e.g.
+// NOTARY_YK_TOUCH_TIMEOUT for -touch-timeout
+const envPrefix = "NOTARY_YK_"
+
+// Sources of the value of a flag, flags take precedence over the
+// environment, the environment over the config file
+const (
+	sourceDefault = "default"
+	sourceConfig  = "config"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// actionFlags trigger an action instead of configuring the daemon, a stale
+// variable or option must not stop every daemon started afterwards
+var actionFlags = map[string]bool{
+	"stop": true,
+}
+
+// envName returns the environment variable of the flag name
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// applyLayer sets the flags of fs which are not in set yet from lookup and
+// records them in set and sources, so lower layers leave them alone
+func applyLayer(fs *flag.FlagSet, set map[string]bool, sources map[string]string, source string, lookup func(name string) (string, bool)) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] || actionFlags[f.Name] {
+			return
+		}
+		value, ok := lookup(f.Name)
+		if !ok {
+			return
+		}
+		if serr := fs.Set(f.Name, value); serr != nil {
+			err = fmt.Errorf("invalid value %q for -%s from %s: %v", value, f.Name, source, serr)
+			return
+		}
+		set[f.Name] = true
+		sources[f.Name] = source
+	})
+	return err
+}
+
+// loadSettings layers the environment and the config file below the flags
+// parsed into fs already and returns the config file, if one is set
+func loadSettings(fs *flag.FlagSet, set map[string]bool, sources map[string]string) (Config, error) {
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+		sources[f.Name] = sourceFlag
+	})
+	err := applyLayer(fs, set, sources, sourceEnv, func(name string) (string, bool) {
+		return os.LookupEnv(envName(name))
+	})
+	if err != nil || configFile == "" {
+		return Config{}, err
+	}
+
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid config file '%s': %v", configFile, err)
+	}
+	for name := range cfg.Options {
+		if fs.Lookup(name) == nil || name == "config" || actionFlags[name] {
+			return cfg, fmt.Errorf("invalid config file '%s': options: %s is no flag of the daemon", configFile, name)
+		}
+	}
+	options := cfg.Options
+	if cfg.Backend != "" {
+		if _, ok := options["backend"]; ok {
+			return cfg, fmt.Errorf("invalid config file '%s': backend is set twice, drop it from the options", configFile)
+		}
+		options = map[string]string{"backend": cfg.Backend}
+		for name, value := range cfg.Options {
+			options[name] = value
+		}
+	}
+	err = applyLayer(fs, set, sources, sourceConfig, func(name string) (string, bool) {
+		value, ok := options[name]
+		return value, ok
+	})
+	return cfg, err
+}
+
+// validateSettings checks the combination of the final flag values, set
+// holds the flags which were given in any layer
+func validateSettings(set map[string]bool) []error {
+	var problems []error
+	if _, err := parseKeymode(keymodePin, set["touch"] && keymodeTouch); err != nil {
+		problems = append(problems, fmt.Errorf("-pin: %v", err))
+	} else if keymodePin == "none" && !(set["touch"] && keymodeTouch) {
+		problems = append(problems, fmt.Errorf("-pin none requires -touch, imported keys could be used by anyone with access to the yubikey"))
+	}
+	if !validLogLevel(logLevel) {
+		problems = append(problems, fmt.Errorf("-log: invalid level %q", logLevel))
+	}
+	if auditExport == "auditd" && runUser != "" {
+		problems = append(problems, fmt.Errorf("-audit-export auditd can not be combined with -user, sending needs CAP_AUDIT_WRITE"))
+	}
+	if runGroup != "" && runUser == "" {
+		problems = append(problems, fmt.Errorf("-group requires -user"))
+	}
+	if signerAddr != "" && (signerCert == "" || signerKey == "") {
+		problems = append(problems, fmt.Errorf("-signer-addr requires -signer-tls-cert and -signer-tls-key, notary-server only talks to signers over TLS"))
+	}
+	if signerAddr != "" && signerClientCA == "" {
+		problems = append(problems, fmt.Errorf("-signer-addr requires -signer-client-ca, otherwise every client of the network could manage the keys"))
+	}
+	if signerAddr == "" && (signerCert != "" || signerKey != "" || signerClientCA != "") {
+		problems = append(problems, fmt.Errorf("the -signer-* flags require -signer-addr"))
+	}
+	if sshAgentSocket != "" {
+		if err := checkWritableDir(filepath.Dir(sshAgentSocket)); err != nil {
+			problems = append(problems, fmt.Errorf("-ssh-agent-socket %s can not be created: %v", sshAgentSocket, err))
+		}
+	}
+	if err := checkWritableDir(socketDir); err != nil {
+		problems = append(problems, fmt.Errorf("-socket-dir %s is not writable: %v", socketDir, err))
+	}
+	return problems
+}
+
+// joinProblems formats the problems found by validateSettings, one per line
+func joinProblems(problems []error) string {
+	lines := make([]string, len(problems))
+	for i, p := range problems {
+		lines[i] = p.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// setSocketDir places the sockets into dir
+func setSocketDir(dir string) {
+	socketDir = dir
+	Socket = filepath.Join(dir, SocketName)
+	AdminSocket = filepath.Join(dir, adminSocketName)
+	PprofSocket = filepath.Join(dir, pprofSocketName)
+}
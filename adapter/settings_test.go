@@ -0,0 +1,92 @@
+package adapter
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyLayer(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	log := fs.String("log", "error", "")
+	timeout := fs.Duration("touch-timeout", time.Second, "")
+	stop := fs.Bool("stop", false, "")
+	fs.Parse([]string{"-log", "info"})
+	set := map[string]bool{"log": true}
+	sources := map[string]string{"log": sourceFlag}
+
+	env := map[string]string{
+		"NOTARY_YK_LOG":           "debug",
+		"NOTARY_YK_TOUCH_TIMEOUT": "30s",
+		"NOTARY_YK_STOP":          "true",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[envName(name)]
+		return v, ok
+	}
+	require.NoError(t, applyLayer(fs, set, sources, sourceEnv, lookup))
+	require.Equal(t, "info", *log)
+	require.Equal(t, 30*time.Second, *timeout)
+	require.False(t, *stop)
+	require.Equal(t, map[string]string{"log": sourceFlag, "touch-timeout": sourceEnv}, sources)
+
+	env["NOTARY_YK_TOUCH_TIMEOUT"] = "soon"
+	require.Error(t, applyLayer(fs, map[string]bool{}, sources, sourceEnv, lookup))
+}
+
+func TestLoadSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"backend": "openpgp", "options": {"log": "warn", "retries": "5", "digest": "sha384"}}`), 0600))
+
+	defer func(file string) { configFile = file }(configFile)
+	os.Setenv("NOTARY_YK_RETRIES", "7")
+	defer os.Unsetenv("NOTARY_YK_RETRIES")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-config", path, "-digest", "sha512"}))
+	sources := make(map[string]string)
+	_, err = loadSettings(fs, make(map[string]bool), sources)
+	require.NoError(t, err)
+	require.Equal(t, "sha512", digest)
+	require.Equal(t, 7, retries)
+	require.Equal(t, "warn", logLevel)
+	require.Equal(t, "openpgp", backendName)
+	require.Equal(t, map[string]string{
+		"config":  sourceFlag,
+		"digest":  sourceFlag,
+		"retries": sourceEnv,
+		"log":     sourceConfig,
+		"backend": sourceConfig,
+	}, sources)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"options": {"stop": "true"}}`), 0600))
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-config", path}))
+	_, err = loadSettings(fs, make(map[string]bool), make(map[string]string))
+	require.Error(t, err)
+}
+
+func TestMaskSecrets(t *testing.T) {
+	doc := map[string]interface{}{
+		"secrets": map[string]interface{}{
+			"pin": map[string]interface{}{"vault": map[string]interface{}{"token": "s.abc", "secret_id": "42", "path": "secret/pin"}},
+		},
+		"options": map[string]interface{}{"log": "info"},
+	}
+	masked := maskSecrets(doc).(map[string]interface{})
+	vault := masked["secrets"].(map[string]interface{})["pin"].(map[string]interface{})["vault"].(map[string]interface{})
+	require.Equal(t, "[redacted]", vault["token"])
+	require.Equal(t, "[redacted]", vault["secret_id"])
+	require.Equal(t, "secret/pin", vault["path"])
+	require.Equal(t, "info", masked["options"].(map[string]interface{})["log"])
+}
@@ -0,0 +1,273 @@
+package adapter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/wire/upstream"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary"
+	pb "github.com/theupdateframework/notary/proto"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/tuf/data"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+)
+
+var (
+	signerAddr     string
+	signerCert     string
+	signerKey      string
+	signerClientCA string
+	// signerKeepAlive is the interval of the TCP keepalive probes of the
+	// connections of notary-server, see net.ListenConfig
+	signerKeepAlive time.Duration
+)
+
+// grpcCodes maps the error codes of the daemon onto the status codes
+// notary-server understands
+var grpcCodes = map[yubikey.ErrorCode]codes.Code{
+	yubikey.ErrCodeKeyNotFound:    codes.NotFound,
+	yubikey.ErrCodeInvalidRequest: codes.InvalidArgument,
+	yubikey.ErrCodePolicyDenied:   codes.PermissionDenied,
+	yubikey.ErrCodeNoToken:        codes.Unavailable,
+	yubikey.ErrCodeMaintenance:    codes.Unavailable,
+	yubikey.ErrCodeTouchTimeout:   codes.DeadlineExceeded,
+	yubikey.ErrCodeWrongPin:       codes.FailedPrecondition,
+	yubikey.ErrCodePinLocked:      codes.FailedPrecondition,
+	yubikey.ErrCodeNoSlot:         codes.ResourceExhausted,
+}
+
+// grpcError turns an error of the ESServer into a grpc status error
+func grpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	logrus.Errorf("notary-signer: request failed: %v", err)
+	code, ok := grpcCodes[yubikey.ErrorCodeOf(err)]
+	if !ok {
+		code = codes.Internal
+	}
+	return grpc.Errorf(code, "%v", err)
+}
+
+// signerService implements the KeyManagement and Signer services of
+// notary-signer on top of the ESServer, so its requests pass the same
+// policy, approval and audit checks as the ones from the socket. The
+// requests carry no PIN, it has to be configured in the secrets section.
+// Clients are identified by the common name of their certificate
+type signerService struct{}
+
+// server returns an ESServer for the client of a request
+func (s *signerService) server(ctx context.Context) *ESServer {
+	return NewServer(signerPeer(ctx))
+}
+
+// signerPeer returns the identity of the client of a request, nil if it
+// presented no verified certificate
+func signerPeer(ctx context.Context) *peerCred {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return &peerCred{Client: info.State.VerifiedChains[0][0].Subject.CommonName}
+}
+
+// withESSession runs fn on a session of the backend opened through es
+func withESSession(es *ESServer, fn func(session uint) error) error {
+	var res wire.ESSetupHSMEnvRes
+	if err := es.SetupHSMEnv(wire.ESSetupHSMEnvReq{}, &res); err != nil {
+		return err
+	}
+	defer es.Cleanup(wire.ESCleanupReq{Session: res.Session}, nil)
+	return fn(res.Session)
+}
+
+// lookupKey returns the slot and the public key of the key with keyID
+func lookupKey(session uint, keyID string) (common.HardwareSlot, *data.ECDSAPublicKey, error) {
+	keys, err := ks.HardwareListKeys(pkcs11.SessionHandle(session))
+	if err != nil {
+		return common.HardwareSlot{}, nil, err
+	}
+	slot, ok := keys[keyID]
+	if !ok {
+		return slot, nil, yubikey.NewError(yubikey.ErrCodeKeyNotFound, "no key with ID %s on the token", keyID)
+	}
+	pubKey, role, err := ks.GetECDSAKey(pkcs11.SessionHandle(session), slot, "")
+	if err != nil {
+		return slot, nil, err
+	}
+	slot.Role = role
+	return slot, pubKey, nil
+}
+
+func keyInfo(pubKey data.PublicKey) *pb.KeyInfo {
+	return &pb.KeyInfo{
+		KeyID:     &pb.KeyID{ID: pubKey.ID()},
+		Algorithm: &pb.Algorithm{Algorithm: pubKey.Algorithm()},
+	}
+}
+
+// CreateKey generates an ECDSA key on the token in the next empty slot
+func (s *signerService) CreateKey(ctx context.Context, req *pb.CreateKeyRequest) (*pb.PublicKey, error) {
+	if req.Algorithm != data.ECDSAKey {
+		return nil, grpc.Errorf(codes.InvalidArgument, "algorithm %s not supported for create key", req.Algorithm)
+	}
+	es := s.server(ctx)
+	role := data.RoleName(req.Role)
+	var pubKey *data.ECDSAPublicKey
+	err := withESSession(es, func(session uint) error {
+		var err error
+		pubKey, err = es.generateKey(session, role)
+		return err
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	logrus.Infof("notary-signer: created key %s for role %s of %s", pubKey.ID(), role, req.Gun)
+	return &pb.PublicKey{KeyInfo: keyInfo(pubKey), PublicKey: pubKey.Public()}, nil
+}
+
+// DeleteKey removes a key, a key which does not exist is no error
+func (s *signerService) DeleteKey(ctx context.Context, keyID *pb.KeyID) (*pb.Void, error) {
+	es := s.server(ctx)
+	if err := signPolicy.authorizeManage(es.peer); err != nil {
+		audit("remove_key", es.peer, logrus.Fields{"key_id": keyID.ID}, err)
+		return nil, grpcError(err)
+	}
+	err := withESSession(es, func(session uint) error {
+		return es.RemoveKey(RemoveKeyReq{Session: session, KeyID: keyID.ID}, &RemoveKeyRes{})
+	})
+	if err != nil && yubikey.ErrorCodeOf(err) != yubikey.ErrCodeKeyNotFound {
+		return nil, grpcError(err)
+	}
+	return &pb.Void{}, nil
+}
+
+// GetKeyInfo returns the public key and the role of a key
+func (s *signerService) GetKeyInfo(ctx context.Context, keyID *pb.KeyID) (*pb.GetKeyInfoResponse, error) {
+	var (
+		slot   common.HardwareSlot
+		pubKey *data.ECDSAPublicKey
+	)
+	err := withESSession(s.server(ctx), func(session uint) error {
+		var err error
+		slot, pubKey, err = lookupKey(session, keyID.ID)
+		return err
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.GetKeyInfoResponse{
+		KeyInfo:   keyInfo(pubKey),
+		PublicKey: pubKey.Public(),
+		Role:      slot.Role.String(),
+	}, nil
+}
+
+// Sign signs the content with the key, always as raw ECDSA over SHA-256
+// as notary verifies it
+func (s *signerService) Sign(ctx context.Context, req *pb.SignatureRequest) (*pb.Signature, error) {
+	if req.KeyID == nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "no key ID")
+	}
+	var (
+		pubKey *data.ECDSAPublicKey
+		res    wire.ESSignRes
+	)
+	es := s.server(ctx)
+	err := withESSession(es, func(session uint) error {
+		var (
+			slot common.HardwareSlot
+			err  error
+		)
+		if slot, pubKey, err = lookupKey(session, req.KeyID.ID); err != nil {
+			return err
+		}
+		return es.Sign(SignReq{
+			Session:           session,
+			Slot:              upstream.Slot(slot),
+			Payload:           req.Content,
+			DigestAlgorithm:   yubikey.DigestSHA256,
+			SignatureEncoding: yubikey.EncodingRaw,
+		}, &res)
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.Signature{
+		KeyInfo:   keyInfo(pubKey),
+		Algorithm: &pb.Algorithm{Algorithm: data.ECDSASignature.String()},
+		Content:   res.Result,
+	}, nil
+}
+
+// signerTLSConfig loads the certificate of the service and requires clients
+// to present a certificate issued by the client CA. Their common name is
+// what the policy knows them by
+func signerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if clientCAFile == "" {
+		return nil, fmt.Errorf("no client CA, every client of the network could manage the keys")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading the certificate: %v", err)
+	}
+	pemCerts, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading the client CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return nil, fmt.Errorf("no certificate found in %s", clientCAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// serveSigner serves the notary-signer gRPC API on addr, notary-server
+// only talks to signers over TLS
+func serveSigner(addr string) (*grpc.Server, error) {
+	tlsConfig, err := signerTLSConfig(signerCert, signerKey, signerClientCA)
+	if err != nil {
+		return nil, err
+	}
+	lc := net.ListenConfig{KeepAlive: signerKeepAlive}
+	listener, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+	service := &signerService{}
+	pb.RegisterKeyManagementServer(server, service)
+	pb.RegisterSignerServer(server, service)
+	hs := health.NewServer()
+	hs.SetServingStatus(notary.HealthCheckKeyManagement, healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus(notary.HealthCheckSigner, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, hs)
+	go func() {
+		err := server.Serve(listener)
+		logrus.Debugf("Stopped serving the notary-signer API: %v", err)
+	}()
+	return server, nil
+}
@@ -0,0 +1,29 @@
+package adapter
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestGRPCError(t *testing.T) {
+	require.NoError(t, grpcError(nil))
+	require.Equal(t, codes.NotFound, grpc.Code(grpcError(yubikey.NewError(yubikey.ErrCodeKeyNotFound, "gone"))))
+	require.Equal(t, codes.PermissionDenied, grpc.Code(grpcError(yubikey.NewError(yubikey.ErrCodePolicyDenied, "no"))))
+	require.Equal(t, codes.Unavailable, grpc.Code(grpcError(yubikey.NewError(yubikey.ErrCodeNoToken, "unplugged"))))
+	require.Equal(t, codes.Internal, grpc.Code(grpcError(errors.New("boom"))))
+}
+
+func TestSignerTLSConfigRequiresClientCA(t *testing.T) {
+	_, err := signerTLSConfig("signer.crt", "signer.key", "")
+	require.Error(t, err)
+}
+
+func TestSignerPeer(t *testing.T) {
+	require.Nil(t, signerPeer(context.Background()))
+}
@@ -0,0 +1,207 @@
+package adapter
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"net"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshAgentSocket is where the ssh-agent listener is created, it is off if empty
+var sshAgentSocket string
+
+// sshRole is the role SSH signatures are checked against by the policy,
+// e.g. to restrict the UIDs which may use the agent
+const sshRole = "ssh"
+
+// sshDigests maps the key types the agent offers onto the digest SSH signs with
+var sshDigests = map[string]string{
+	ssh.KeyAlgoECDSA256: yubikey.DigestSHA256,
+	ssh.KeyAlgoECDSA384: yubikey.DigestSHA384,
+}
+
+// errSSHReadOnly is returned for the requests which would change the keys
+// of the agent, they are managed on the yubikey
+var errSSHReadOnly = yubikey.NewError(yubikey.ErrCodeInvalidRequest, "the agent only offers the keys stored on the yubikey, manage them with yubico-piv-tool")
+
+// sshKey is a key of the token offered to SSH
+type sshKey struct {
+	slotID []byte
+	pub    ssh.PublicKey
+}
+
+// sshAgent is an ssh-agent offering the keys of the token which notary does
+// not use, e.g. a key in slot 9a generated for SSH. Signatures pass the
+// same policy, approval and audit checks as the ones from the socket, the
+// PIN is taken from the secrets section
+type sshAgent struct {
+	es *ESServer
+}
+
+// sshKeys returns the keys of the token which can be used for SSH
+func sshKeys(session uint) ([]sshKey, error) {
+	lister, ok := ks.(backend.ForeignKeyLister)
+	if !ok {
+		return nil, yubikey.NewError(yubikey.ErrCodeInvalidRequest, "backend %s offers no keys for SSH", ks.Name())
+	}
+	foreign, err := lister.ForeignKeys(pkcs11.SessionHandle(session))
+	if err != nil {
+		return nil, err
+	}
+	var keys []sshKey
+	for _, k := range foreign {
+		pub, err := ssh.NewPublicKey(k.PublicKey)
+		if err != nil {
+			logrus.Debugf("Not offering the key in slot %s for SSH: %v", yubikey.SlotName(k.SlotID), err)
+			continue
+		}
+		if _, ok := sshDigests[pub.Type()]; !ok {
+			logrus.Debugf("Not offering the key in slot %s for SSH, %s is not supported", yubikey.SlotName(k.SlotID), pub.Type())
+			continue
+		}
+		keys = append(keys, sshKey{slotID: k.SlotID, pub: pub})
+	}
+	return keys, nil
+}
+
+// List returns the keys of the token usable for SSH
+func (a *sshAgent) List() ([]*agent.Key, error) {
+	var list []*agent.Key
+	err := withESSession(a.es, func(session uint) error {
+		keys, err := sshKeys(session)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			list = append(list, &agent.Key{
+				Format:  k.pub.Type(),
+				Blob:    k.pub.Marshal(),
+				Comment: "yubikey slot " + yubikey.SlotName(k.slotID),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("SSH agent: listing the keys failed: %v", err)
+	}
+	return list, err
+}
+
+// Sign signs data with the key on the token matching key
+func (a *sshAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	fingerprint := ssh.FingerprintSHA256(key)
+	var sig *ssh.Signature
+	err := withESSession(a.es, func(session uint) error {
+		keys, err := sshKeys(session)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if bytes.Equal(k.pub.Marshal(), key.Marshal()) {
+				sig, err = a.sign(session, k, fingerprint, data)
+				return err
+			}
+		}
+		return yubikey.NewError(yubikey.ErrCodeKeyNotFound, "no key %s on the token", fingerprint)
+	})
+	if err != nil {
+		logrus.Errorf("SSH agent: signing with %s failed: %v", fingerprint, err)
+	}
+	return sig, err
+}
+
+func (a *sshAgent) sign(session uint, k sshKey, fingerprint string, data []byte) (*ssh.Signature, error) {
+	fields := logrus.Fields{"key_id": fingerprint, "role": sshRole, "slot": k.slotID}
+	pass, err := config.Secrets.secret(SecretUserPin, "")
+	if err != nil {
+		return nil, yubikey.WrapError(yubikey.ErrCodeWrongPin, err)
+	}
+	unreserve, err := a.es.authorizeSign(fingerprint, sshRole, data, pass)
+	if err != nil {
+		audit("sign_denied", a.es.peer, fields, err)
+		signMetrics.recordSign(fingerprint, sshRole, err)
+		return nil, err
+	}
+	logrus.Infof("SSH agent: signing with the key in slot %s for %s", yubikey.SlotName(k.slotID), a.es.peer)
+	hwslot := common.HardwareSlot{Role: sshRole, SlotID: k.slotID, KeyID: fingerprint}
+	opts := backend.SignOptions{DigestAlgorithm: sshDigests[k.pub.Type()], Encoding: yubikey.EncodingRaw}
+	raw, err := signOnDevices(pkcs11.SessionHandle(session), hwslot, pass.Reveal(), data, opts)
+	audit("sign", a.es.peer, fields, err)
+	signMetrics.recordSign(fingerprint, sshRole, err)
+	if err != nil {
+		unreserve()
+		return nil, err
+	}
+	return sshSignature(k.pub.Type(), raw)
+}
+
+// sshSignature turns a raw r||s ECDSA signature into the SSH wire format
+func sshSignature(format string, raw []byte) (*ssh.Signature, error) {
+	if len(raw) == 0 || len(raw)%2 != 0 {
+		return nil, fmt.Errorf("invalid raw signature of %d bytes", len(raw))
+	}
+	half := len(raw) / 2
+	blob := ssh.Marshal(struct {
+		R, S *big.Int
+	}{new(big.Int).SetBytes(raw[:half]), new(big.Int).SetBytes(raw[half:])})
+	return &ssh.Signature{Format: format, Blob: blob}, nil
+}
+
+func (a *sshAgent) Add(key agent.AddedKey) error {
+	return errSSHReadOnly
+}
+
+func (a *sshAgent) Remove(key ssh.PublicKey) error {
+	return errSSHReadOnly
+}
+
+func (a *sshAgent) RemoveAll() error {
+	return errSSHReadOnly
+}
+
+func (a *sshAgent) Lock(passphrase []byte) error {
+	return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "locking is not supported, remove the yubikey instead")
+}
+
+func (a *sshAgent) Unlock(passphrase []byte) error {
+	return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "locking is not supported")
+}
+
+// Signers is only used by agents running in the same process
+func (a *sshAgent) Signers() ([]ssh.Signer, error) {
+	return nil, yubikey.NewError(yubikey.ErrCodeInvalidRequest, "signers are not supported")
+}
+
+// serveSSHAgent creates the ssh-agent socket at path, only the user running
+// the daemon may connect, and serves it until the listener is closed
+func serveSSHAgent(path string) (net.Listener, error) {
+	listener, err := listenPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				logrus.Debugf("Stopped accepting ssh-agent connections: %v", err)
+				return
+			}
+			go func() {
+				defer conn.Close()
+				peer := peerCredentials(conn)
+				logrus.Infof("Accepted ssh-agent connection from %s", peer)
+				err := agent.ServeAgent(&sshAgent{es: NewServer(peer)}, conn)
+				logrus.Debugf("ssh-agent connection from %s closed: %v", peer, err)
+			}()
+		}
+	}()
+	return listener, nil
+}
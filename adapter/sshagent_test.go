@@ -0,0 +1,37 @@
+package adapter
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHSignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	data := []byte("session data")
+	digest := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+	raw := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(raw[32-len(rb):], rb)
+	copy(raw[64-len(sb):], sb)
+
+	sig, err := sshSignature(pub.Type(), raw)
+	require.NoError(t, err)
+	require.Equal(t, ssh.KeyAlgoECDSA256, sig.Format)
+	require.NoError(t, pub.Verify(data, sig))
+	require.Error(t, pub.Verify([]byte("other data"), sig))
+
+	_, err = sshSignature(pub.Type(), raw[:63])
+	require.Error(t, err)
+}
@@ -0,0 +1,232 @@
+package adapter
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+const statusUsage = "status"
+
+// started is the time the daemon started serving
+var started time.Time
+
+type StatusReq struct {
+}
+
+type StatusRes struct {
+	Backend          string
+	Keymode          int
+	FIPS             bool
+	ReadOnly         bool
+	Maintenance      bool
+	ApprovalMode     bool
+	PendingApprovals int
+	Started          time.Time
+	Keys             []KeyStats
+	// Token is nil if the backend can not describe its device, TokenError
+	// tells why it could not be read
+	Token      *backend.TokenInfo
+	TokenError string
+	// TokenAlias is the configured alias of the token
+	TokenAlias string
+	// PublicKeySHA256 maps key IDs to the fingerprint of their public key,
+	// as far as the daemon has seen the keys
+	PublicKeySHA256 map[string]string
+	// Latency are the quantiles of the operations performed so far
+	Latency []LatencyStats
+	// Faults are the injected faults which did not fail all their RPCs yet
+	Faults []PendingFault
+}
+
+// statusSchemaVersion is raised on incompatible changes of the JSON output
+// of status and selftest
+const statusSchemaVersion = 1
+
+// tokenJSON is the token as printed by status and selftest --json
+type tokenJSON struct {
+	Serial    string   `json:"serial"`
+	Alias     string   `json:"alias,omitempty"`
+	Model     string   `json:"model"`
+	Firmware  string   `json:"firmware"`
+	FreeSlots []string `json:"free_slots"`
+}
+
+func newTokenJSON(ti *backend.TokenInfo, alias string) *tokenJSON {
+	if ti == nil {
+		return nil
+	}
+	return &tokenJSON{Serial: ti.Serial, Alias: alias, Model: ti.Model, Firmware: ti.Firmware, FreeSlots: ti.FreeSlots}
+}
+
+type latencyJSON struct {
+	Operation string  `json:"operation"`
+	Count     uint64  `json:"count"`
+	P50       float64 `json:"p50_seconds"`
+	P95       float64 `json:"p95_seconds"`
+	P99       float64 `json:"p99_seconds"`
+}
+
+type keyStatsJSON struct {
+	keyFingerprint
+	Role       string     `json:"role"`
+	Signatures uint64     `json:"signatures"`
+	Failures   uint64     `json:"failures"`
+	LastSign   *time.Time `json:"last_sign"`
+}
+
+// statusJSON is the stable schema of status --json
+type statusJSON struct {
+	SchemaVersion    int            `json:"schema_version"`
+	Backend          string         `json:"backend"`
+	Keymode          string         `json:"keymode"`
+	FIPS             bool           `json:"fips"`
+	ReadOnly         bool           `json:"read_only"`
+	Maintenance      bool           `json:"maintenance"`
+	ApprovalMode     bool           `json:"approval_mode"`
+	PendingApprovals int            `json:"pending_approvals"`
+	Started          time.Time      `json:"started"`
+	Token            *tokenJSON     `json:"token"`
+	TokenError       string         `json:"token_error,omitempty"`
+	Keys             []keyStatsJSON `json:"keys"`
+	Latency          []latencyJSON  `json:"latency,omitempty"`
+	Faults           []PendingFault `json:"injected_faults,omitempty"`
+}
+
+func newStatusJSON(res *StatusRes) statusJSON {
+	out := statusJSON{
+		SchemaVersion:    statusSchemaVersion,
+		Backend:          res.Backend,
+		Keymode:          formatKeymode(res.Keymode),
+		FIPS:             res.FIPS,
+		ReadOnly:         res.ReadOnly,
+		Maintenance:      res.Maintenance,
+		ApprovalMode:     res.ApprovalMode,
+		PendingApprovals: res.PendingApprovals,
+		Started:          res.Started,
+		Token:            newTokenJSON(res.Token, res.TokenAlias),
+		TokenError:       res.TokenError,
+		Keys:             make([]keyStatsJSON, 0, len(res.Keys)),
+		Faults:           res.Faults,
+	}
+	for _, k := range res.Keys {
+		stats := keyStatsJSON{keyFingerprint: newKeyFingerprint(k.KeyID, res.PublicKeySHA256[k.KeyID]), Role: k.Role, Signatures: k.Signatures, Failures: k.Failures}
+		if !k.LastSign.IsZero() {
+			last := k.LastSign
+			stats.LastSign = &last
+		}
+		out.Keys = append(out.Keys, stats)
+	}
+	for _, l := range res.Latency {
+		out.Latency = append(out.Latency, latencyJSON{Operation: l.Operation, Count: l.Count, P50: l.P50.Seconds(), P95: l.P95.Seconds(), P99: l.P99.Seconds()})
+	}
+	return out
+}
+
+// tokenInfo reads the description of the device, if the backend offers one
+func tokenInfo() (*backend.TokenInfo, error) {
+	inspector, ok := ks.(backend.TokenInspector)
+	if !ok {
+		return nil, nil
+	}
+	session, err := ks.SetupHSMEnv()
+	if err != nil {
+		return nil, err
+	}
+	defer ks.CloseSession(session)
+	ti, err := inspector.TokenInfo(session)
+	if err != nil {
+		return nil, err
+	}
+	return &ti, nil
+}
+
+// Status reports the configuration and state of the running daemon
+func (s *AdminServer) Status(req StatusReq, res *StatusRes) error {
+	res.Backend = ks.Name()
+	res.Keymode = yubikey.YubikeyKeyMode()
+	res.FIPS = yubikey.FIPSMode()
+	res.ReadOnly = readOnly
+	res.Maintenance, _, _ = maintenance.get()
+	res.ApprovalMode = approvalMode
+	res.PendingApprovals = len(approvals.list())
+	res.Started = started
+	res.Keys = signMetrics.snapshot()
+	res.PublicKeySHA256 = publicKeyHashes.snapshot()
+	res.Latency = latencies.stats()
+	res.Faults = faults.list()
+	token, err := tokenInfo()
+	if err != nil {
+		res.TokenError = err.Error()
+	}
+	res.Token = token
+	if token != nil {
+		res.TokenAlias = deviceAlias(token.Serial)
+	}
+	return nil
+}
+
+func statusCommand(args []string) error {
+	if len(args) != 0 {
+		return usageError(statusUsage)
+	}
+	res := new(StatusRes)
+	if err := adminCall("Status", StatusReq{}, res); err != nil {
+		return err
+	}
+	if jsonOutput() {
+		return printJSON(newStatusJSON(res))
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Backend:\t%s\n", res.Backend)
+	fmt.Fprintf(w, "Keymode:\t%s\n", formatKeymode(res.Keymode))
+	fmt.Fprintf(w, "FIPS mode:\t%t\n", res.FIPS)
+	fmt.Fprintf(w, "Read-only:\t%t\n", res.ReadOnly)
+	fmt.Fprintf(w, "Maintenance:\t%t\n", res.Maintenance)
+	fmt.Fprintf(w, "Approval mode:\t%t\n", res.ApprovalMode)
+	fmt.Fprintf(w, "Pending approvals:\t%d\n", res.PendingApprovals)
+	fmt.Fprintf(w, "Uptime:\t%s\n", time.Since(res.Started).Round(time.Second))
+	switch {
+	case res.Token != nil:
+		name := res.Token.Serial
+		if res.TokenAlias != "" {
+			name = fmt.Sprintf("%s (%s)", res.TokenAlias, res.Token.Serial)
+		}
+		fmt.Fprintf(w, "Token:\t%s serial %s, firmware %s\n", res.Token.Model, name, res.Token.Firmware)
+		fmt.Fprintf(w, "Free slots:\t%s\n", strings.Join(res.Token.FreeSlots, " "))
+	case res.TokenError != "":
+		fmt.Fprintf(w, "Token:\t%s\n", res.TokenError)
+	}
+	if len(res.Keys) > 0 {
+		fmt.Fprintln(w, "\nKEY ID\tSHORT ID\tROLE\tSIGNATURES\tFAILURES\tLAST SIGNATURE")
+		for _, k := range res.Keys {
+			last := "never"
+			if !k.LastSign.IsZero() {
+				last = k.LastSign.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", k.KeyID, shortKeyID(k.KeyID), k.Role, k.Signatures, k.Failures, last)
+		}
+	}
+	if len(res.Faults) > 0 {
+		fmt.Fprintln(w, "\nINJECTED FAULT\tCODE\tREMAINING")
+		for _, f := range res.Faults {
+			method := f.Method
+			if method == "" {
+				method = "*"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\n", method, f.Code, f.Remaining)
+		}
+	}
+	if len(res.Latency) > 0 {
+		fmt.Fprintln(w, "\nOPERATION\tCOUNT\tP50\tP95\tP99")
+		for _, l := range res.Latency {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", l.Operation, l.Count, l.P50.Round(time.Millisecond), l.P95.Round(time.Millisecond), l.P99.Round(time.Millisecond))
+		}
+	}
+	return w.Flush()
+}
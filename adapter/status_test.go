@@ -0,0 +1,35 @@
+package adapter
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusJSONSchema(t *testing.T) {
+	started := time.Date(2019, 6, 18, 12, 0, 0, 0, time.UTC)
+	res := &StatusRes{
+		Backend: "yubikey",
+		Started: started,
+		Token:   &backend.TokenInfo{Serial: "123", Model: "YubiKey", Firmware: "5.2", FreeSlots: []string{"9c"}},
+		Keys:    []KeyStats{{KeyID: "abc", Role: "root", Signatures: 2}},
+	}
+	out, err := json.Marshal(newStatusJSON(res))
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"schema_version": 1,
+		"backend": "yubikey",
+		"keymode": "pin=none touch=false",
+		"fips": false,
+		"read_only": false,
+		"maintenance": false,
+		"approval_mode": false,
+		"pending_approvals": 0,
+		"started": "2019-06-18T12:00:00Z",
+		"token": {"serial": "123", "model": "YubiKey", "firmware": "5.2", "free_slots": ["9c"]},
+		"keys": [{"key_id": "abc", "short_id": "abc", "role": "root", "signatures": 2, "failures": 0, "last_sign": null}]
+	}`, string(out))
+}
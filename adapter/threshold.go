@@ -0,0 +1,125 @@
+package adapter
+
+import (
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/sirupsen/logrus"
+)
+
+// ThresholdKey names a key which may contribute to a threshold signature
+type ThresholdKey struct {
+	KeyID string
+	// Pass is the user PIN of the yubikey holding the key
+	Pass yubikey.Secret
+}
+
+// ThresholdSignReq asks for signatures over Payload by at least Threshold of Keys
+type ThresholdSignReq struct {
+	RequestMeta
+	wire.Version
+	Payload   []byte
+	Threshold int
+	Keys      []ThresholdKey
+	// DigestAlgorithm, Prehashed, SignatureEncoding and LowS behave as in SignReq
+	DigestAlgorithm   string
+	Prehashed         bool
+	SignatureEncoding string
+	LowS              bool
+}
+
+// ThresholdSignRes holds the signatures by key ID and why the other keys did not sign
+type ThresholdSignRes struct {
+	wire.Version
+	Signatures map[string][]byte
+	Errors     map[string]string
+}
+
+// ThresholdSign collects signatures from the keys of all attached yubikeys
+// until the threshold is met
+func (s *ESServer) ThresholdSign(req ThresholdSignReq, res *ThresholdSignRes) error {
+	if req.Threshold < 1 || req.Threshold > len(req.Keys) {
+		return rpcError(yubikey.NewError(yubikey.ErrCodeInvalidRequest, "threshold %d is not within 1 and %d", req.Threshold, len(req.Keys)))
+	}
+	if err := maintenance.check(); err != nil {
+		return rpcError(err)
+	}
+	multi, ok := ks.(backend.MultiToken)
+	if !ok {
+		return rpcError(yubikey.NewError(yubikey.ErrCodeInvalidRequest, "backend %s does not support multiple devices", ks.Name()))
+	}
+	tokenKeys, err := multi.ListAllTokenKeys()
+	if err != nil {
+		return rpcError(err)
+	}
+	byID := make(map[string][]backend.TokenKey)
+	for _, k := range tokenKeys {
+		byID[k.KeyID] = append(byID[k.KeyID], k)
+	}
+
+	opts := backend.SignOptions{
+		DigestAlgorithm: req.DigestAlgorithm,
+		Prehashed:       req.Prehashed,
+		Encoding:        req.SignatureEncoding,
+		LowS:            req.LowS,
+	}
+	res.Signatures = make(map[string][]byte)
+	res.Errors = make(map[string]string)
+	for _, key := range req.Keys {
+		if len(res.Signatures) >= req.Threshold {
+			break
+		}
+		candidates, ok := byID[key.KeyID]
+		if !ok {
+			res.Errors[key.KeyID] = yubikey.NewError(yubikey.ErrCodeKeyNotFound, "key is on none of the attached yubikeys").Error()
+			continue
+		}
+		// a key restored to several yubikeys may be used on each of them
+		var allowed []backend.TokenKey
+		var denied error
+		for _, tk := range candidates {
+			if err := signPolicy.checkDevice(string(tk.Slot.Role), tk.Serial); err != nil {
+				denied = err
+				continue
+			}
+			allowed = append(allowed, tk)
+		}
+		tk := candidates[0]
+		fields := req.logFields(logrus.Fields{"key_id": tk.KeyID, "role": tk.Slot.Role, "slot": tk.Slot.SlotID, "device": tk.Serial})
+		if len(allowed) == 0 {
+			audit("sign_denied", s.peer, fields, denied)
+			signMetrics.recordSign(tk.KeyID, string(tk.Slot.Role), denied)
+			res.Errors[key.KeyID] = denied.Error()
+			continue
+		}
+		unreserve, err := s.authorizeSign(tk.KeyID, string(tk.Slot.Role), req.Payload, key.Pass)
+		if err != nil {
+			audit("sign_denied", s.peer, fields, err)
+			signMetrics.recordSign(tk.KeyID, string(tk.Slot.Role), err)
+			res.Errors[key.KeyID] = err.Error()
+			continue
+		}
+		var sig []byte
+		for _, tk = range allowed {
+			fields["slot"], fields["device"] = tk.Slot.SlotID, tk.Serial
+			sig, err = multi.SignOnToken(tk.Serial, tk.Slot, key.Pass.Reveal(), req.Payload, opts)
+			audit("sign", s.peer, fields, err)
+			if err == nil || !failover(err) {
+				break
+			}
+		}
+		signMetrics.recordSign(tk.KeyID, string(tk.Slot.Role), err)
+		if err != nil {
+			unreserve()
+			res.Errors[key.KeyID] = yubikey.WrapError(yubikey.ErrCodeUnknown, err).Error()
+			continue
+		}
+		res.Signatures[key.KeyID] = sig
+	}
+
+	if len(res.Signatures) < req.Threshold {
+		return rpcError(yubikey.NewError(yubikey.ErrCodeKeyNotFound,
+			"only %d of %d required signatures could be created: %v", len(res.Signatures), req.Threshold, res.Errors))
+	}
+	return nil
+}
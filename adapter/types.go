@@ -0,0 +1,180 @@
+package adapter
+
+import (
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+// The request types below extend the ones of package wire, which mirror
+// externalstore, with adapter specific options. gob matches struct fields by
+// name, so clients sending the plain externalstore types are still
+// understood and simply get the defaults for the additional fields.
+// RequestMeta lets clients correlate their requests with the logs of the
+// daemon.
+
+// AddECDSAKeyReq extends wire.ESAddECDSAKeyReq
+type AddECDSAKeyReq struct {
+	RequestMeta
+	wire.Version
+	Session    uint
+	PrivateKey wire.ESPrivateKey
+	Slot       wire.HardwareSlot
+	Pass       yubikey.Secret
+	Role       string
+	// PIVSlot, e.g. "9c", places the key into that slot instead of the one
+	// in Slot, which is usually picked by GetNextEmptySlot
+	PIVSlot string
+	// Overwrite replaces a key already stored in the slot, without it
+	// adding the key fails with SLOT_OCCUPIED
+	Overwrite bool
+}
+
+// HardwareRemoveKeyReq extends wire.ESHardwareRemoveKeyReq
+type HardwareRemoveKeyReq struct {
+	RequestMeta
+	wire.Version
+	Session uint
+	Slot    wire.HardwareSlot
+	Pass    string
+	KeyID   string
+}
+
+// SignReq extends wire.ESSignReq
+type SignReq struct {
+	RequestMeta
+	wire.Version
+	Session uint
+	Slot    wire.HardwareSlot
+	// Pass is sent as a string, yubikey.Secret only keeps it out of logs
+	Pass    yubikey.Secret
+	Payload []byte
+	// DigestAlgorithm is one of sha256, sha384 or sha512. If it is empty
+	// the digest configured with -digest is used
+	DigestAlgorithm string
+	// Prehashed marks Payload as the digest of the data to sign, so large
+	// metadata does not have to be sent over the socket
+	Prehashed bool
+	// SignatureEncoding is either raw (r||s) or der. If it is empty the
+	// encoding configured with -signature-encoding is used
+	SignatureEncoding string
+	// LowS requests the signature in its low-S form, it is always
+	// normalized if the daemon runs with -low-s
+	LowS bool
+	// URI is a pkcs11: URI selecting the key instead of Slot, e.g.
+	// "pkcs11:serial=12345678;id=%82". Only the yubikeys it selects are
+	// signed on
+	URI string
+}
+
+// HardwareListKeysReq extends wire.ESHardwareListKeysReq
+type HardwareListKeysReq struct {
+	RequestMeta
+	wire.Version
+	Session uint
+	// Attestation requests to check which keys were generated on the token
+	Attestation bool
+}
+
+// HardwareListKeysRes extends wire.ESHardwareListKeysRes
+type HardwareListKeysRes struct {
+	wire.Version
+	Keys map[string]wire.HardwareSlot
+	// Attested maps key IDs to whether the key was generated on the token
+	// and never existed outside of it. It is only set if Attestation was requested
+	Attested map[string]bool
+	// NotAfter maps key IDs to the expiry of the certificate stored with
+	// the key, if the backend stores one
+	NotAfter map[string]time.Time
+	// Devices maps key IDs to the serial numbers of the devices holding the
+	// key, if the backend serves several devices
+	Devices map[string][]string
+	// DeviceAliases maps the serial numbers in Devices to their configured
+	// alias, if any
+	DeviceAliases map[string]string
+	// PublicKeySHA256 maps key IDs to the fingerprint of their public key,
+	// for the keys whose public key is known
+	PublicKeySHA256 map[string]string
+}
+
+// RemoveKeyReq asks to remove the key with KeyID. Unlike
+// wire.ESHardwareRemoveKeyReq it carries no slot, the daemon looks the key
+// up itself so a stale or wrong slot can not delete another key
+type RemoveKeyReq struct {
+	RequestMeta
+	wire.Version
+	Session uint
+	KeyID   string
+	Pass    yubikey.Secret
+}
+
+// RemoveKeyRes reports where the removed key was stored
+type RemoveKeyRes struct {
+	wire.Version
+	Slot wire.HardwareSlot
+}
+
+// GetPublicKeyReq asks for the public key with KeyID
+type GetPublicKeyReq struct {
+	RequestMeta
+	wire.Version
+	Session uint
+	KeyID   string
+}
+
+// GetPublicKeyRes holds the public key as PKIX "PUBLIC KEY" PEM block
+type GetPublicKeyRes struct {
+	wire.Version
+	Role string
+	Slot wire.HardwareSlot
+	PEM  []byte
+}
+
+// RenewCertReq asks for a new certificate for the key with KeyID. By default
+// a self-signed certificate valid for Validity is created. With CSR set only
+// a certificate request is returned, a certificate issued for it is then
+// installed by sending it in Certificate
+type RenewCertReq struct {
+	RequestMeta
+	wire.Version
+	Session uint
+	KeyID   string
+	// Pass is the PIN, it is needed to sign the certificate or request
+	Pass          yubikey.Secret
+	ManagementKey yubikey.Secret
+	Validity      time.Duration
+	CSR           bool
+	// Certificate is a DER encoded certificate to install
+	Certificate []byte
+}
+
+// AdoptKeyReq asks to make the key in a PIV slot, which was provisioned
+// outside of notary, usable for Role
+type AdoptKeyReq struct {
+	RequestMeta
+	wire.Version
+	Session uint
+	Slot    string
+	Role    string
+	// Pass is the PIN, it is needed to sign the new certificate
+	Pass          yubikey.Secret
+	ManagementKey yubikey.Secret
+	Validity      time.Duration
+}
+
+// AdoptKeyRes holds the notary key ID of the adopted key and the DER encoded
+// certificate the slot held before
+type AdoptKeyRes struct {
+	wire.Version
+	KeyID          string
+	OldCertificate []byte
+}
+
+// RenewCertRes holds the expiry of the new certificate or the DER encoded
+// certificate request
+type RenewCertRes struct {
+	wire.Version
+	NotAfter time.Time
+	CSR      []byte
+}
@@ -0,0 +1,196 @@
+package adapter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/sirupsen/logrus"
+)
+
+// VaultSource reads a secret from a key/value secrets engine of HashiCorp
+// Vault. The secret is fetched at startup and whenever the daemon receives
+// SIGHUP, requests are served from memory in between
+type VaultSource struct {
+	// Address of the Vault server, e.g. https://vault:8200
+	Address string `json:"address"`
+	// Path is the API path of the secret below /v1/, e.g.
+	// secret/data/notary/yubikey for the KV version 2 engine mounted at secret
+	Path string `json:"path"`
+	// Field of the secret holding the value, default: the kind of the secret
+	Field string `json:"field"`
+	// Token authenticates directly, TokenFile names a file holding it
+	Token     string `json:"token"`
+	TokenFile string `json:"token_file"`
+	// RoleID and SecretID (or SecretIDFile) authenticate with the AppRole
+	// auth method mounted at approle
+	RoleID       string `json:"role_id"`
+	SecretID     string `json:"secret_id"`
+	SecretIDFile string `json:"secret_id_file"`
+}
+
+const vaultTimeout = 30 * time.Second
+
+var (
+	vaultClient = &http.Client{Timeout: vaultTimeout}
+	// vaultSecrets holds the secrets fetched from Vault, by kind. A secret
+	// is wiped when it is replaced
+	vaultSecrets     = make(map[string]yubikey.SecureBytes)
+	vaultSecretsLock sync.RWMutex
+)
+
+func (v *VaultSource) validate() error {
+	if v.Address == "" || v.Path == "" {
+		return fmt.Errorf("vault: address and path are required")
+	}
+	token := v.Token != "" || v.TokenFile != ""
+	approle := v.RoleID != ""
+	if token == approle {
+		return fmt.Errorf("vault: configure either a token or a role_id")
+	}
+	if approle && (v.SecretID == "") == (v.SecretIDFile == "") {
+		return fmt.Errorf("vault: approle needs exactly one of secret_id and secret_id_file")
+	}
+	return nil
+}
+
+// loadVaultSecrets fetches all secrets which are configured to come from
+// Vault. It is called at startup and on SIGHUP, a secret that can not be
+// fetched keeps its previous value
+func (cfg SecretsConfig) loadVaultSecrets() error {
+	var failed []string
+	for kind, src := range cfg {
+		if src.Vault == nil {
+			continue
+		}
+		secret, err := src.Vault.read(kind)
+		if err != nil {
+			logrus.Errorf("Failed to fetch %s from vault: %v", kind, err)
+			failed = append(failed, kind)
+			continue
+		}
+		vaultSecretsLock.Lock()
+		vaultSecrets[kind].Wipe()
+		vaultSecrets[kind] = secret
+		vaultSecretsLock.Unlock()
+		logrus.Infof("Fetched %s from vault", kind)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not fetch %s from vault", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// vaultSecret returns a copy of the secret of kind fetched by
+// loadVaultSecrets, the caller wipes it
+func vaultSecret(kind string) (yubikey.SecureBytes, error) {
+	vaultSecretsLock.RLock()
+	defer vaultSecretsLock.RUnlock()
+	secret, ok := vaultSecrets[kind]
+	if !ok {
+		return nil, fmt.Errorf("%s was not fetched from vault", kind)
+	}
+	return append(yubikey.SecureBytes(nil), secret...), nil
+}
+
+// read logs in and reads the field of the secret, both KV version 1 and 2
+// responses are understood
+func (v *VaultSource) read(kind string) (yubikey.SecureBytes, error) {
+	token, err := v.login()
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := v.call("GET", v.Path, token, nil, &res); err != nil {
+		return nil, err
+	}
+	data := res.Data
+	// KV version 2 nests the secret in data.data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	field := v.Field
+	if field == "" {
+		field = kind
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s has no string field %s", v.Path, field)
+	}
+	return yubikey.SecureBytes(value), nil
+}
+
+// login returns the token to read the secret with
+func (v *VaultSource) login() (string, error) {
+	if v.Token != "" {
+		return v.Token, nil
+	}
+	if v.TokenFile != "" {
+		return readSecretFile(v.TokenFile)
+	}
+	secretID := v.SecretID
+	if v.SecretIDFile != "" {
+		var err error
+		if secretID, err = readSecretFile(v.SecretIDFile); err != nil {
+			return "", err
+		}
+	}
+	req := map[string]string{"role_id": v.RoleID, "secret_id": secretID}
+	var res struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := v.call("POST", "auth/approle/login", "", req, &res); err != nil {
+		return "", fmt.Errorf("approle login failed: %v", err)
+	}
+	if res.Auth.ClientToken == "" {
+		return "", fmt.Errorf("approle login returned no token")
+	}
+	return res.Auth.ClientToken, nil
+}
+
+// call sends a request to the Vault API and decodes the JSON answer into res.
+// Error messages never include the request body, it holds credentials
+func (v *VaultSource) call(method, path, token string, body interface{}, res interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	url := strings.TrimRight(v.Address, "/") + "/v1/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+func readSecretFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,62 @@
+package adapter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVaultApproleKV2(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			var req map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			if req["role_id"] != "role" || req["secret_id"] != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"auth": {"client_token": "tok"}}`))
+		case "/v1/secret/data/yubikey":
+			if r.Header.Get("X-Vault-Token") != "tok" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(`{"data": {"data": {"user_pin": "123456"}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := SecretsConfig{SecretUserPin: {Vault: &VaultSource{
+		Address:  srv.URL,
+		Path:     "secret/data/yubikey",
+		RoleID:   "role",
+		SecretID: "secret",
+	}}}
+	require.NoError(t, cfg.validate())
+	require.NoError(t, cfg.loadVaultSecrets())
+
+	pin, err := cfg.secret(SecretUserPin, "")
+	require.NoError(t, err)
+	require.Equal(t, "123456", pin.Reveal())
+
+	cfg[SecretUserPin].Vault.Field = "missing"
+	require.Error(t, cfg.loadVaultSecrets())
+	// the previously fetched secret is kept
+	pin, err = cfg.secret(SecretUserPin, "")
+	require.NoError(t, err)
+	require.Equal(t, "123456", pin.Reveal())
+}
+
+func TestVaultValidate(t *testing.T) {
+	require.Error(t, (&VaultSource{Address: "http://vault"}).validate())
+	require.Error(t, (&VaultSource{Address: "http://vault", Path: "p"}).validate())
+	require.Error(t, (&VaultSource{Address: "http://vault", Path: "p", Token: "t", RoleID: "r"}).validate())
+	require.Error(t, (&VaultSource{Address: "http://vault", Path: "p", RoleID: "r"}).validate())
+	require.NoError(t, (&VaultSource{Address: "http://vault", Path: "p", TokenFile: "/run/token"}).validate())
+}
@@ -0,0 +1,252 @@
+package adapter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/sirupsen/logrus"
+)
+
+// The events webhooks can subscribe to
+const (
+	webhookKeyCreated   = "key_created"
+	webhookKeyRemoved   = "key_removed"
+	webhookSignSuccess  = "sign_succeeded"
+	webhookSignFailure  = "sign_failed"
+	webhookAuthAlert    = "auth_alert"
+	webhookSignatureHdr = "X-Notary-Yubikey-Signature"
+)
+
+var webhookEvents = []string{webhookKeyCreated, webhookKeyRemoved, webhookSignSuccess, webhookSignFailure, webhookAuthAlert}
+
+// WebhookConfig is an endpoint the daemon posts events to. The JSON body is
+// signed with HMAC-SHA256, the hex encoded MAC is sent as
+// X-Notary-Yubikey-Signature: sha256=<mac>
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// Secret is the HMAC key, SecretFile names a file holding it
+	Secret     string `json:"secret"`
+	SecretFile string `json:"secret_file"`
+	// Events to post, default: all
+	Events []string `json:"events"`
+}
+
+// WebhooksConfig lists the webhooks of the daemon
+type WebhooksConfig []WebhookConfig
+
+func (cfg WebhooksConfig) validate() error {
+	for _, hook := range cfg {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("webhooks: %q is no http(s) URL", hook.URL)
+		}
+		if (hook.Secret == "") == (hook.SecretFile == "") {
+			return fmt.Errorf("webhooks: %s needs exactly one of secret and secret_file", u.Host)
+		}
+		for _, event := range hook.Events {
+			if !containsString(webhookEvents, event) {
+				return fmt.Errorf("webhooks: unknown event %q, expected one of %v", event, webhookEvents)
+			}
+		}
+	}
+	return nil
+}
+
+// WebhookPayload is the JSON body of a webhook request
+type WebhookPayload struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	KeyID     string    `json:"key_id,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	Slot      string    `json:"slot,omitempty"`
+	UID       *uint32   `json:"uid,omitempty"`
+	PID       int32     `json:"pid,omitempty"`
+	Exe       string    `json:"exe,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	ErrorCode string    `json:"error_code,omitempty"`
+	// Reason and Count describe what raised an auth_alert
+	Reason string `json:"reason,omitempty"`
+	Count  int    `json:"count,omitempty"`
+	// RequestID and CorrelationID identify the RPC of the event
+	RequestID     string `json:"request_id,omitempty"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+const (
+	webhookTimeout  = 10 * time.Second
+	webhookAttempts = 3
+	// webhookQueue is how many events may wait for a slow endpoint before
+	// further ones are dropped, signing never waits for a webhook
+	webhookQueue = 100
+)
+
+// webhook delivers the events of a single endpoint in order
+type webhook struct {
+	url    string
+	secret []byte
+	events map[string]bool
+	queue  chan []byte
+}
+
+var (
+	webhooks      []*webhook
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+	// webhookBackoff is the delay before the first retry, it doubles with every further one
+	webhookBackoff = time.Second
+)
+
+// startWebhooks sets up the configured webhooks, a webhook whose secret can
+// not be read is left out
+func startWebhooks(cfg WebhooksConfig) {
+	for _, hook := range cfg {
+		secret := hook.Secret
+		if hook.SecretFile != "" {
+			var err error
+			if secret, err = readSecretFile(hook.SecretFile); err != nil {
+				logrus.Errorf("Not posting events to %s: %v", hook.URL, err)
+				continue
+			}
+		}
+		events := hook.Events
+		if len(events) == 0 {
+			events = webhookEvents
+		}
+		w := &webhook{url: hook.URL, secret: []byte(secret), events: make(map[string]bool), queue: make(chan []byte, webhookQueue)}
+		for _, event := range events {
+			w.events[event] = true
+		}
+		webhooks = append(webhooks, w)
+		go w.deliver()
+	}
+}
+
+// webhookEvent maps an audit event onto the webhook event it fires, if any
+func webhookEvent(event string, err error) string {
+	switch {
+	case (event == "add_key" || event == "generate_key" || event == "adopt_key") && err == nil:
+		return webhookKeyCreated
+	case event == "remove_key" && err == nil:
+		return webhookKeyRemoved
+	case event == "sign" && err == nil:
+		return webhookSignSuccess
+	case event == "sign" || event == "sign_denied":
+		return webhookSignFailure
+	}
+	return ""
+}
+
+// newWebhookPayload describes an audit event for the webhooks
+func newWebhookPayload(event string, peer *peerCred, fields logrus.Fields, err error, now time.Time) WebhookPayload {
+	p := WebhookPayload{Event: event, Time: now.UTC()}
+	if keyID, ok := fields["key_id"]; ok {
+		p.KeyID = fmt.Sprint(keyID)
+	}
+	if role, ok := fields["role"]; ok {
+		p.Role = fmt.Sprint(role)
+	}
+	if requestID, ok := fields["request_id"].(string); ok {
+		p.RequestID = requestID
+	}
+	if correlationID, ok := fields["correlation_id"].(string); ok {
+		p.CorrelationID = correlationID
+	}
+	if slot, ok := fields["slot"].([]byte); ok && len(slot) > 0 {
+		p.Slot = yubikey.SlotName(slot)
+	}
+	if peer.local() {
+		uid := peer.UID
+		p.UID, p.PID, p.Exe = &uid, peer.PID, peer.Exe
+	} else if peer != nil {
+		p.Client = peer.Client
+	}
+	if err != nil {
+		p.Error = err.Error()
+		p.ErrorCode = string(yubikey.ErrorCodeOf(err))
+	}
+	return p
+}
+
+// notifyWebhooks queues an audit event for the webhooks subscribed to it
+func notifyWebhooks(event string, peer *peerCred, fields logrus.Fields, err error) {
+	if len(webhooks) == 0 {
+		return
+	}
+	hookEvent := webhookEvent(event, err)
+	if hookEvent == "" {
+		return
+	}
+	queueWebhooks(newWebhookPayload(hookEvent, peer, fields, err, time.Now()))
+}
+
+// queueWebhooks queues p for the webhooks subscribed to its event
+func queueWebhooks(p WebhookPayload) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		logrus.Errorf("Failed to encode the webhook payload: %v", err)
+		return
+	}
+	for _, w := range webhooks {
+		if !w.events[p.Event] {
+			continue
+		}
+		select {
+		case w.queue <- body:
+		default:
+			logrus.Warnf("Dropping %s event for webhook %s, %d events are waiting already", p.Event, w.url, webhookQueue)
+		}
+	}
+}
+
+// webhookSignature returns the value of the signature header for body
+func webhookSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver posts the queued events, retrying failed requests with backoff
+func (w *webhook) deliver() {
+	for body := range w.queue {
+		delay := webhookBackoff
+		for attempt := 1; ; attempt++ {
+			err := w.post(body)
+			if err == nil {
+				break
+			}
+			if attempt >= webhookAttempts {
+				logrus.Errorf("Giving up posting an event to webhook %s after %d attempts: %v", w.url, attempt, err)
+				break
+			}
+			logrus.Debugf("Posting an event to webhook %s failed, retrying in %s: %v", w.url, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+func (w *webhook) post(body []byte) error {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHdr, webhookSignature(w.secret, body))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package adapter
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookEvent(t *testing.T) {
+	denied := yubikey.NewError(yubikey.ErrCodePolicyDenied, "no")
+	require.Equal(t, webhookKeyCreated, webhookEvent("add_key", nil))
+	require.Equal(t, webhookKeyCreated, webhookEvent("adopt_key", nil))
+	require.Equal(t, "", webhookEvent("add_key", errors.New("slot occupied")))
+	require.Equal(t, webhookKeyRemoved, webhookEvent("remove_key", nil))
+	require.Equal(t, webhookSignSuccess, webhookEvent("sign", nil))
+	require.Equal(t, webhookSignFailure, webhookEvent("sign", errors.New("touch timeout")))
+	require.Equal(t, webhookSignFailure, webhookEvent("sign_denied", denied))
+	require.Equal(t, "", webhookEvent("startup", nil))
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+	defer func() { webhooks = nil }()
+
+	startWebhooks(WebhooksConfig{{URL: server.URL, Secret: "s3cret", Events: []string{webhookSignFailure}}})
+	notifyWebhooks("sign", nil, logrus.Fields{"key_id": "abc", "role": "targets", "slot": []byte{2}}, nil)
+	notifyWebhooks("sign_denied", &peerCred{UID: 1000, PID: 42}, logrus.Fields{"key_id": "abc", "role": "targets", "slot": []byte{2}}, yubikey.NewError(yubikey.ErrCodePolicyDenied, "no"))
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		require.Equal(t, webhookSignature([]byte("s3cret"), body), r.Header.Get(webhookSignatureHdr))
+		var p WebhookPayload
+		require.NoError(t, json.Unmarshal(body, &p))
+		require.Equal(t, webhookSignFailure, p.Event)
+		require.Equal(t, "abc", p.KeyID)
+		require.Equal(t, "targets", p.Role)
+		require.Equal(t, "9c", p.Slot)
+		require.Equal(t, uint32(1000), *p.UID)
+		require.Equal(t, string(yubikey.ErrCodePolicyDenied), p.ErrorCode)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook was not called")
+	}
+
+	require.Error(t, WebhooksConfig{{URL: "ftp://hooks", Secret: "s"}}.validate())
+	require.Error(t, WebhooksConfig{{URL: "https://hooks"}}.validate())
+	require.Error(t, WebhooksConfig{{URL: "https://hooks", Secret: "s", Events: []string{"sign"}}}.validate())
+}
@@ -0,0 +1,264 @@
+// Package backend defines the contract between the RPC server of the adapter
+// and the hardware stores it serves. Backends register themselves by name,
+// usually from an init function, and are selected with the -backend flag.
+package backend
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+// Backend is a hardware store serving the externalstore RPCs
+type Backend interface {
+	Name() string
+	AddECDSAKeyWithOptions(session pkcs11.SessionHandle, privKey data.PrivateKey, hwslot common.HardwareSlot, passwd string, role data.RoleName, opts AddKeyOptions) error
+	GetECDSAKey(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string) (*data.ECDSAPublicKey, data.RoleName, error)
+	SignWithOptions(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string, payload []byte, opts SignOptions) ([]byte, error)
+	HardwareRemoveKey(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string, keyID string) error
+	HardwareListKeys(session pkcs11.SessionHandle) (map[string]common.HardwareSlot, error)
+	GetNextEmptySlot(session pkcs11.SessionHandle) ([]byte, error)
+	SetupHSMEnv() (pkcs11.SessionHandle, error)
+	CloseSession(session pkcs11.SessionHandle)
+	NeedLogin(functionID uint) (bool, uint, error)
+	// Cleanup releases the hardware when the daemon terminates
+	Cleanup()
+}
+
+// AddKeyOptions control how a key is stored
+type AddKeyOptions struct {
+	// Overwrite removes a key or certificate which already occupies the
+	// slot, otherwise adding the key fails
+	Overwrite bool
+}
+
+// SignOptions control how a payload is turned into a signature
+type SignOptions struct {
+	// DigestAlgorithm is the hash applied to the payload, the default
+	// digest is used if it is empty
+	DigestAlgorithm string
+	// Prehashed means the payload already is the digest and must not be hashed again
+	Prehashed bool
+	// Encoding is the encoding of the returned signature, the default
+	// encoding is used if it is empty
+	Encoding string
+	// LowS normalizes the signature to the low-S form
+	LowS bool
+	// Timings, if set, is told where the backend spent its time
+	Timings *SignTimings
+}
+
+// SignTimings tells how long a signature waited for the user
+type SignTimings struct {
+	// Touch is the time the device took to sign with a key which requires
+	// touch, which is dominated by waiting for the user to touch it
+	Touch time.Duration
+}
+
+// TokenKey is a key together with the serial number of the device it is stored on
+type TokenKey struct {
+	KeyID  string
+	Serial string
+	Slot   common.HardwareSlot
+	// PublicKey is the DER encoded public key, nil if the backend did not
+	// read it while listing
+	PublicKey []byte
+}
+
+// Attester is implemented by backends which can prove that keys were
+// generated on the device
+type Attester interface {
+	AttestKeys(session pkcs11.SessionHandle, keyIDs []string) (map[string]bool, error)
+}
+
+// Attestation holds the DER encoded attestation certificates of a device
+type Attestation struct {
+	// Device is the certificate of the attestation key of the device, it
+	// is issued by the vendor
+	Device []byte
+	// Keys are the certificates the attestation key issued for the keys
+	// generated on the device
+	Keys [][]byte
+}
+
+// AttestationProvider is implemented by backends which can hand out the
+// attestation certificates of their device
+type AttestationProvider interface {
+	Attestation(session pkcs11.SessionHandle) (Attestation, error)
+}
+
+// MultiToken is implemented by backends which can serve several devices at
+// once. SessionSerial is the serial number of the device a session of
+// SetupHSMEnv is open on
+type MultiToken interface {
+	ListAllTokenKeys() ([]TokenKey, error)
+	SignOnToken(serial string, hwslot common.HardwareSlot, passwd string, payload []byte, opts SignOptions) ([]byte, error)
+	SessionSerial(session pkcs11.SessionHandle) (string, error)
+}
+
+// PresenceConfirmer is implemented by backends which can prove that a person
+// is present at a specific device
+type PresenceConfirmer interface {
+	ConfirmPresence(serial string, slotID []byte, passwd string) error
+}
+
+// CertExpirer is implemented by backends which store a certificate along
+// with every key. CertExpiry maps key IDs to the NotAfter of their certificate
+type CertExpirer interface {
+	CertExpiry(session pkcs11.SessionHandle) (map[string]time.Time, error)
+}
+
+// KeyAger is implemented by backends which know when a key was stored.
+// KeyCreated maps key IDs to that time
+type KeyAger interface {
+	KeyCreated(session pkcs11.SessionHandle) (map[string]time.Time, error)
+}
+
+// CertRenewer is implemented by backends which can issue a new certificate
+// for a key without touching the key itself, either self-signed or by
+// installing one a CA issued for a certificate request
+type CertRenewer interface {
+	RenewCertificate(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd, managementKey string, validity time.Duration) (time.Time, error)
+	CertificateRequest(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string) ([]byte, error)
+	ReplaceCertificate(session pkcs11.SessionHandle, hwslot common.HardwareSlot, managementKey string, certBytes []byte) error
+}
+
+// KeyAdopter is implemented by backends which can take over keys stored on
+// the device by other tools. AdoptKey returns the key ID and the DER encoded
+// certificate it replaced
+type KeyAdopter interface {
+	AdoptKey(session pkcs11.SessionHandle, slotID []byte, role data.RoleName, passwd, managementKey string, validity time.Duration) (string, []byte, error)
+}
+
+// KeyGenerator is implemented by backends which can generate keys on the
+// device, so the private key never exists outside of it. GenerateECDSAKey
+// returns the public key of the new key
+type KeyGenerator interface {
+	GenerateECDSAKey(session pkcs11.SessionHandle, hwslot common.HardwareSlot, role data.RoleName, passwd, managementKey string) (*data.ECDSAPublicKey, error)
+}
+
+// URIResolver is implemented by backends which can look up keys by a
+// PKCS#11 URI (RFC 7512). ResolveURI returns the matching keys and the
+// devices they are stored on
+type URIResolver interface {
+	ResolveURI(session pkcs11.SessionHandle, uri string) ([]TokenKey, error)
+}
+
+// ForeignKey is a key on the device which notary does not use, e.g. one
+// generated for SSH with yubico-piv-tool
+type ForeignKey struct {
+	SlotID    []byte
+	PublicKey crypto.PublicKey
+	// Subject is the common name of the certificate stored with the key
+	Subject string
+}
+
+// ForeignKeyLister is implemented by backends which can list the keys
+// stored on the device outside of the notary roles, so they can be used
+// for other purposes through the daemon
+type ForeignKeyLister interface {
+	ForeignKeys(session pkcs11.SessionHandle) ([]ForeignKey, error)
+}
+
+// SlotRepair is a slot found inconsistent, e.g. holding a certificate but
+// no private key after an interrupted import
+type SlotRepair struct {
+	SlotID  []byte
+	Problem string
+	// Repaired is set if the slot was cleared, otherwise it is quarantined
+	Repaired bool
+}
+
+// SlotRecoverer is implemented by backends which can find the slots an
+// interrupted operation left half provisioned, logged in with the PIN. They
+// are repaired if the management key is given and confirm agrees for the
+// slot, otherwise they are left out of the key listing
+type SlotRecoverer interface {
+	RecoverSlots(session pkcs11.SessionHandle, pin, managementKey string, confirm func(SlotRepair) bool) ([]SlotRepair, error)
+}
+
+// Reloader is implemented by backends which can apply a changed section of
+// the config file while they serve requests, e.g. on SIGHUP
+type Reloader interface {
+	Reload(config json.RawMessage) error
+}
+
+// TokenInfo describes the device a backend serves
+type TokenInfo struct {
+	Serial   string
+	Model    string
+	Firmware string
+	// FreeSlots are the names of the slots new keys can be stored in
+	FreeSlots []string
+}
+
+// TokenInspector is implemented by backends which can describe their device
+type TokenInspector interface {
+	TokenInfo(session pkcs11.SessionHandle) (TokenInfo, error)
+}
+
+// Preflighter is implemented by backends which can check their
+// prerequisites before the daemon is started. The credential checks must
+// not spend the last attempt of a PIN
+type Preflighter interface {
+	// LoadLibrary loads the library of the device and returns its path
+	LoadLibrary() (string, error)
+	CheckUserPin(session pkcs11.SessionHandle, pin string) error
+	CheckManagementKey(session pkcs11.SessionHandle, key string) error
+}
+
+// Diagnoser is implemented by backends which can describe their state for
+// the diagnostics dump, e.g. the loaded library and the attached devices
+type Diagnoser interface {
+	Diagnostics() []string
+}
+
+// Factory creates a backend from its section of the config file, which is
+// nil if the config file has no section for the backend
+type Factory func(config json.RawMessage) (Backend, error)
+
+var (
+	mu        sync.Mutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes a backend available under name. It panics if a backend
+// with that name is already registered
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("backend %s registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// New creates the backend registered under name
+func New(name string, config json.RawMessage) (Backend, error) {
+	mu.Lock()
+	factory, ok := factories[name]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q, available: %v", name, Names())
+	}
+	return factory(config)
+}
+
+// Names returns the names of all registered backends
+func Names() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
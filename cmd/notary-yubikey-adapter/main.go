@@ -0,0 +1,8 @@
+// Command notary-yubikey-adapter serves the keys of a yubikey to notary
+package main
+
+import "github.com/jschintag/notary-yubikey-adapter/adapter"
+
+func main() {
+	adapter.Main()
+}
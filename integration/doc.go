@@ -0,0 +1,14 @@
+// Package integration tests the daemon end to end. The notary flows run the
+// server in process on a backend holding the keys in memory and talk to it
+// over a temporary socket with the externalstore types of notary
+//
+//	go test -tags pkcs11 ./integration
+//
+// The other suites run the daemon on pkcs11 tokens which need no yubikey
+// plugged in. Each runs only with its build tag, the SoftHSM one with
+//
+//	go test -tags "pkcs11 softhsm" ./integration
+//
+// It needs softhsm2-util on the PATH and the SoftHSM module, which is looked
+// up at the usual locations unless SOFTHSM2_LIB names it
+package integration
@@ -0,0 +1,347 @@
+// +build pkcs11
+
+package integration
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jschintag/notary-yubikey-adapter/adapter"
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/externalstore"
+	"github.com/theupdateframework/notary/tuf/data"
+	"github.com/theupdateframework/notary/tuf/utils"
+)
+
+// memoryPIN is the PIN of the keys of memoryBackend
+const memoryPIN = "123456"
+
+// memoryBackend keeps the keys in memory, in the slots of a yubikey. It
+// stands in for the token, so the flows test the server and not a device
+type memoryBackend struct {
+	sync.Mutex
+	keys        map[byte]data.PrivateKey
+	roles       map[byte]data.RoleName
+	nextSession pkcs11.SessionHandle
+}
+
+var _ backend.Backend = (*memoryBackend)(nil)
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{keys: make(map[byte]data.PrivateKey), roles: make(map[byte]data.RoleName)}
+}
+
+func (b *memoryBackend) Name() string { return "memory" }
+
+func checkPIN(passwd string) error {
+	if passwd != memoryPIN {
+		return yubikey.NewError(yubikey.ErrCodeWrongPin, "wrong PIN")
+	}
+	return nil
+}
+
+func (b *memoryBackend) AddECDSAKeyWithOptions(session pkcs11.SessionHandle, privKey data.PrivateKey, hwslot common.HardwareSlot, passwd string, role data.RoleName, opts backend.AddKeyOptions) error {
+	b.Lock()
+	defer b.Unlock()
+	if err := checkPIN(passwd); err != nil {
+		return err
+	}
+	if len(hwslot.SlotID) != 1 {
+		return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "invalid slot %x", hwslot.SlotID)
+	}
+	if _, ok := b.keys[hwslot.SlotID[0]]; ok && !opts.Overwrite {
+		return yubikey.NewError(yubikey.ErrCodeSlotOccupied, "slot %x holds a key", hwslot.SlotID)
+	}
+	// the server wipes the private bytes once the call returns, the key
+	// signs with the one parsed from them
+	b.keys[hwslot.SlotID[0]] = privKey
+	b.roles[hwslot.SlotID[0]] = role
+	return nil
+}
+
+// key returns the key in hwslot, which must have the ID of the slot if it has one
+func (b *memoryBackend) key(hwslot common.HardwareSlot) (data.PrivateKey, error) {
+	if len(hwslot.SlotID) == 1 {
+		if key, ok := b.keys[hwslot.SlotID[0]]; ok && (hwslot.KeyID == "" || hwslot.KeyID == key.ID()) {
+			return key, nil
+		}
+	}
+	return nil, yubikey.NewError(yubikey.ErrCodeKeyNotFound, "no key in slot %x", hwslot.SlotID)
+}
+
+func (b *memoryBackend) GetECDSAKey(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string) (*data.ECDSAPublicKey, data.RoleName, error) {
+	b.Lock()
+	defer b.Unlock()
+	key, err := b.key(hwslot)
+	if err != nil {
+		return nil, "", err
+	}
+	return data.NewECDSAPublicKey(key.Public()), b.roles[hwslot.SlotID[0]], nil
+}
+
+func (b *memoryBackend) SignWithOptions(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string, payload []byte, opts backend.SignOptions) ([]byte, error) {
+	b.Lock()
+	defer b.Unlock()
+	if err := checkPIN(passwd); err != nil {
+		return nil, err
+	}
+	key, err := b.key(hwslot)
+	if err != nil {
+		return nil, err
+	}
+	return key.Sign(rand.Reader, payload, nil)
+}
+
+func (b *memoryBackend) HardwareRemoveKey(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string, keyID string) error {
+	b.Lock()
+	defer b.Unlock()
+	if err := checkPIN(passwd); err != nil {
+		return err
+	}
+	hwslot.KeyID = keyID
+	if _, err := b.key(hwslot); err != nil {
+		return err
+	}
+	delete(b.keys, hwslot.SlotID[0])
+	delete(b.roles, hwslot.SlotID[0])
+	return nil
+}
+
+func (b *memoryBackend) HardwareListKeys(session pkcs11.SessionHandle) (map[string]common.HardwareSlot, error) {
+	b.Lock()
+	defer b.Unlock()
+	keys := make(map[string]common.HardwareSlot, len(b.keys))
+	for slotID, key := range b.keys {
+		keys[key.ID()] = common.HardwareSlot{Role: b.roles[slotID], SlotID: []byte{slotID}}
+	}
+	return keys, nil
+}
+
+func (b *memoryBackend) GetNextEmptySlot(session pkcs11.SessionHandle) ([]byte, error) {
+	b.Lock()
+	defer b.Unlock()
+	for _, slotID := range []byte{0x9a, 0x9c, 0x9d, 0x9e} {
+		if _, ok := b.keys[slotID]; !ok {
+			return []byte{slotID}, nil
+		}
+	}
+	return nil, yubikey.NewError(yubikey.ErrCodeNoSlot, "all slots hold a key")
+}
+
+func (b *memoryBackend) SetupHSMEnv() (pkcs11.SessionHandle, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.nextSession++
+	return b.nextSession, nil
+}
+
+func (b *memoryBackend) CloseSession(session pkcs11.SessionHandle) {}
+
+func (b *memoryBackend) NeedLogin(functionID uint) (bool, uint, error) {
+	switch functionID {
+	case externalstore.FUNCTION_ADDECDSAKEY, externalstore.FUNCTION_SIGN, externalstore.FUNCTION_HARDWAREREMOVEKEY:
+		return true, pkcs11.CKU_USER, nil
+	}
+	return false, 0, nil
+}
+
+func (b *memoryBackend) Cleanup() {}
+
+// startServer serves the externalstore RPCs on a memoryBackend on a socket
+// in a temporary directory, until the returned function is called
+func startServer(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "notary-yubikey-adapter-e2e")
+	require.NoError(t, err)
+	socket := filepath.Join(dir, "hardwarestore.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to listen on %s: %v", socket, err)
+	}
+	adapter.SetBackend(newMemoryBackend())
+	go adapter.Serve(listener)
+	return socket, func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// notaryClient talks to the daemon like the externalstore client of notary
+// does, with its types and without a protocol version
+type notaryClient struct {
+	*rpc.Client
+	t       *testing.T
+	session pkcs11.SessionHandle
+}
+
+// openStore connects like notary does for every command and sets up a session
+func openStore(t *testing.T, socket string) *notaryClient {
+	client, err := rpc.Dial("unix", socket)
+	require.NoError(t, err)
+	c := &notaryClient{Client: client, t: t}
+	name := new(externalstore.ESNameRes)
+	require.NoError(t, c.Call("ESServer.Name", externalstore.ESNameReq{}, name))
+	require.Equal(t, "memory", name.Name)
+	res := new(externalstore.ESSetupHSMEnvRes)
+	require.NoError(t, c.Call("ESServer.SetupHSMEnv", externalstore.ESSetupHSMEnvReq{}, res))
+	c.session = pkcs11.SessionHandle(res.Session)
+	return c
+}
+
+func (c *notaryClient) close() {
+	require.NoError(c.t, c.Call("ESServer.Cleanup", externalstore.ESCleanupReq{Session: uint(c.session)}, new(externalstore.ESCleanupReq)))
+	c.Close()
+}
+
+// needLogin asks whether notary has to retrieve the PIN for a function
+func (c *notaryClient) needLogin(functionID uint) bool {
+	res := new(externalstore.ESNeedLoginRes)
+	require.NoError(c.t, c.Call("ESServer.NeedLogin", externalstore.ESNeedLoginReq{Function_ID: functionID}, res))
+	return res.NeedLogin
+}
+
+// generateKey generates a key for role and stores it in the next empty
+// slot, like notary does when it creates a key
+func (c *notaryClient) generateKey(role data.RoleName) (data.PrivateKey, common.HardwareSlot) {
+	require.True(c.t, c.needLogin(externalstore.FUNCTION_ADDECDSAKEY))
+	next := new(externalstore.ESGetNextEmptySlotRes)
+	require.NoError(c.t, c.Call("ESServer.GetNextEmptySlot", externalstore.ESGetNextEmptySlotReq{Session: uint(c.session)}, next))
+	key, err := utils.GenerateECDSAKey(rand.Reader)
+	require.NoError(c.t, err)
+	slot := common.HardwareSlot{Role: role, SlotID: next.Slot, KeyID: key.ID()}
+	req := externalstore.ESAddECDSAKeyReq{Session: uint(c.session), PrivateKey: externalstore.NewESPrivateKey(key), Slot: slot, Pass: memoryPIN, Role: role}
+	require.NoError(c.t, c.Call("ESServer.AddECDSAKey", req, new(externalstore.ESAddECDSAKeyRes)))
+	return key, slot
+}
+
+func (c *notaryClient) listKeys() map[string]common.HardwareSlot {
+	res := new(externalstore.ESHardwareListKeysRes)
+	require.NoError(c.t, c.Call("ESServer.HardwareListKeys", externalstore.ESHardwareListKeysReq{Session: uint(c.session)}, res))
+	return res.Keys
+}
+
+func (c *notaryClient) publicKey(slot common.HardwareSlot) (data.PublicKey, data.RoleName) {
+	res := new(externalstore.ESGetECDSAKeyRes)
+	require.NoError(c.t, c.Call("ESServer.GetECDSAKey", externalstore.ESGetECDSAKeyReq{Session: uint(c.session), Slot: slot}, res))
+	return externalstore.ESPublicKeyToPublicKey(res.PublicKey), res.Role
+}
+
+func (c *notaryClient) sign(slot common.HardwareSlot, pin string, payload []byte) ([]byte, error) {
+	res := new(externalstore.ESSignRes)
+	err := c.Call("ESServer.Sign", externalstore.ESSignReq{Session: uint(c.session), Slot: slot, Pass: pin, Payload: payload}, res)
+	return res.Result, err
+}
+
+func (c *notaryClient) remove(slot common.HardwareSlot) error {
+	req := externalstore.ESHardwareRemoveKeyReq{Session: uint(c.session), Slot: slot, Pass: memoryPIN, KeyID: slot.KeyID}
+	return c.Call("ESServer.HardwareRemoveKey", req, new(externalstore.ESHardwareRemoveKeyRes))
+}
+
+// checkSignature checks a raw ECDSA signature of payload made by pub
+func checkSignature(t *testing.T, pub data.PublicKey, payload, sig []byte) {
+	parsed, err := x509.ParsePKIXPublicKey(pub.Public())
+	require.NoError(t, err)
+	require.Len(t, sig, 64)
+	digest := sha256.Sum256(payload)
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	require.True(t, ecdsa.Verify(parsed.(*ecdsa.PublicKey), digest[:], r, s), "the signature does not verify")
+}
+
+// TestNotaryFlows replays what notary sends when a repository is
+// initialized, published to and has its targets key rotated. Every command
+// of notary opens a connection of its own
+func TestNotaryFlows(t *testing.T) {
+	socket, stop := startServer(t)
+	defer stop()
+
+	// notary init creates the root and targets keys and signs the root
+	c := openStore(t, socket)
+	rootKey, rootSlot := c.generateKey(data.CanonicalRootRole)
+	targetsKey, targetsSlot := c.generateKey(data.CanonicalTargetsRole)
+	require.NotEqual(t, rootSlot.SlotID, targetsSlot.SlotID)
+	require.Equal(t, map[string]common.HardwareSlot{
+		rootKey.ID():    {Role: data.CanonicalRootRole, SlotID: rootSlot.SlotID},
+		targetsKey.ID(): {Role: data.CanonicalTargetsRole, SlotID: targetsSlot.SlotID},
+	}, c.listKeys())
+	rootPub, role := c.publicKey(rootSlot)
+	require.Equal(t, data.CanonicalRootRole, role)
+	require.Equal(t, rootKey.ID(), rootPub.ID())
+	require.True(t, c.needLogin(externalstore.FUNCTION_SIGN))
+	root := []byte(`{"signed":{"_type":"root","version":1}}`)
+	sig, err := c.sign(rootSlot, memoryPIN, root)
+	require.NoError(t, err)
+	checkSignature(t, rootPub, root, sig)
+	// the root key can not be used by passing its slot off as another key
+	spoofed := rootSlot
+	spoofed.KeyID, spoofed.Role = targetsKey.ID(), data.CanonicalTargetsRole
+	_, err = c.sign(spoofed, memoryPIN, root)
+	require.Equal(t, yubikey.ErrCodePolicyDenied, yubikey.ErrorCodeOf(err))
+	c.close()
+
+	// notary publish finds the targets key by listing the keys and signs
+	// the targets with it
+	c = openStore(t, socket)
+	keys := c.listKeys()
+	require.Contains(t, keys, targetsKey.ID())
+	slot := keys[targetsKey.ID()]
+	slot.KeyID = targetsKey.ID()
+	targetsPub, _ := c.publicKey(slot)
+	targets := []byte(`{"signed":{"_type":"targets","version":2}}`)
+	_, err = c.sign(slot, "654321", targets)
+	require.Equal(t, yubikey.ErrCodeWrongPin, yubikey.ErrorCodeOf(err))
+	sig, err = c.sign(slot, memoryPIN, targets)
+	require.NoError(t, err)
+	checkSignature(t, targetsPub, targets, sig)
+	c.close()
+
+	// notary key rotate creates a new targets key, signs with it and
+	// removes the old one
+	c = openStore(t, socket)
+	newKey, newSlot := c.generateKey(data.CanonicalTargetsRole)
+	newPub, _ := c.publicKey(newSlot)
+	targets = []byte(`{"signed":{"_type":"targets","version":3}}`)
+	sig, err = c.sign(newSlot, memoryPIN, targets)
+	require.NoError(t, err)
+	checkSignature(t, newPub, targets, sig)
+	require.NoError(t, c.remove(targetsSlot))
+	keys = c.listKeys()
+	require.Len(t, keys, 2)
+	require.Contains(t, keys, rootKey.ID())
+	require.Contains(t, keys, newKey.ID())
+	_, err = c.sign(targetsSlot, memoryPIN, targets)
+	require.Equal(t, yubikey.ErrCodeKeyNotFound, yubikey.ErrorCodeOf(err))
+	c.close()
+}
+
+// TestAbandonedSession checks that a client which dies without cleaning up
+// leaves the daemon serving the next one
+func TestAbandonedSession(t *testing.T) {
+	socket, stop := startServer(t)
+	defer stop()
+
+	c := openStore(t, socket)
+	_, slot := c.generateKey(data.CanonicalSnapshotRole)
+	c.Close()
+
+	c = openStore(t, socket)
+	defer c.close()
+	pub, _ := c.publicKey(slot)
+	payload := []byte("signed after the last client vanished")
+	sig, err := c.sign(slot, memoryPIN, payload)
+	require.NoError(t, err)
+	checkSignature(t, pub, payload, sig)
+}
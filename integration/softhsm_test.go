@@ -0,0 +1,314 @@
+// +build pkcs11,softhsm
+
+package integration
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary-yubikey-adapter/wire/upstream"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/tuf/data"
+	"github.com/theupdateframework/notary/tuf/utils"
+)
+
+// Credentials of the SoftHSM token. The user manages the keys of tokens
+// other than yubikeys, so the user PIN is the management key as well
+const (
+	userPIN = "123456"
+	soPIN   = "12345678"
+)
+
+// softhsmLibraries are the usual locations of the SoftHSM module
+var softhsmLibraries = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/lib64/softhsm/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+}
+
+// softhsm is the daemon serving the token of the tests
+var softhsm *daemon
+
+// daemon is the daemon binary running in dir on a SoftHSM token of its own
+type daemon struct {
+	dir    string
+	bin    string
+	env    []string
+	socket string
+}
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "notary-yubikey-adapter-softhsm")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create the test directory: %v\n", err)
+		os.Exit(1)
+	}
+	softhsm, err = startDaemon(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start the daemon on SoftHSM: %v\n", err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	code := m.Run()
+	if err := softhsm.stop(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to stop the daemon: %v\n", err)
+	}
+	if code != 0 {
+		softhsm.dumpLog()
+	}
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// findSoftHSM returns the path of the SoftHSM module
+func findSoftHSM() (string, error) {
+	if lib := os.Getenv("SOFTHSM2_LIB"); lib != "" {
+		return lib, nil
+	}
+	for _, lib := range softhsmLibraries {
+		if _, err := os.Stat(lib); err == nil {
+			return lib, nil
+		}
+	}
+	return "", errors.New("the SoftHSM module was not found, set SOFTHSM2_LIB to its path")
+}
+
+// startDaemon initializes a SoftHSM token in dir, builds the daemon and
+// starts it on the token
+func startDaemon(dir string) (*daemon, error) {
+	lib, err := findSoftHSM()
+	if err != nil {
+		return nil, err
+	}
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.Mkdir(tokens, 0700); err != nil {
+		return nil, err
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err := ioutil.WriteFile(conf, []byte(fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\n", tokens)), 0600); err != nil {
+		return nil, err
+	}
+	d := &daemon{
+		dir:    dir,
+		bin:    filepath.Join(dir, "notary-yubikey-adapter"),
+		env:    append(os.Environ(), "SOFTHSM2_CONF="+conf),
+		socket: filepath.Join(dir, "run", "hardwarestore.sock"),
+	}
+
+	if err := d.run("", "softhsm2-util", "--init-token", "--free", "--label", "notary", "--pin", userPIN, "--so-pin", soPIN); err != nil {
+		return nil, err
+	}
+	if err := d.run("", "go", "build", "-tags", "pkcs11", "-o", d.bin, "github.com/jschintag/notary-yubikey-adapter/cmd/notary-yubikey-adapter"); err != nil {
+		return nil, err
+	}
+	// the daemon forks and the command returns once it runs
+	if err := d.run(dir, d.bin, "-socket-dir", filepath.Dir(d.socket), "-library", lib, "-no-harden", "-log", "debug", "-touch-timeout", "0"); err != nil {
+		return nil, err
+	}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		client, err := wire.Dial("unix", d.socket)
+		if err == nil {
+			client.Close()
+			return d, nil
+		}
+	}
+	d.dumpLog()
+	d.stop()
+	return nil, fmt.Errorf("the daemon did not create %s", d.socket)
+}
+
+// run runs a command in dir with the SoftHSM config of the daemon
+func (d *daemon) run(dir, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Env = d.env
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v\n%s", name, err, out)
+	}
+	return nil
+}
+
+func (d *daemon) stop() error {
+	if err := d.run(d.dir, d.bin, "-stop"); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if _, err := wire.Dial("unix", d.socket); err != nil {
+			return nil
+		}
+	}
+	return errors.New("the daemon still accepts connections")
+}
+
+// dumpLog prints the log of the daemon, which tells why a test failed
+func (d *daemon) dumpLog() {
+	log, err := ioutil.ReadFile(filepath.Join(d.dir, filepath.Base(d.bin)+".log"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the log of the daemon: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Log of the daemon:\n%s\n", log)
+}
+
+// client is a connection to the daemon with a session on its token
+type client struct {
+	*rpc.Client
+	t       *testing.T
+	session uint
+}
+
+func connect(t *testing.T) *client {
+	c, err := wire.Dial("unix", softhsm.socket)
+	require.NoError(t, err)
+	res := new(wire.ESSetupHSMEnvRes)
+	require.NoError(t, c.Call("ESServer.SetupHSMEnv", wire.ESSetupHSMEnvReq{}, res))
+	return &client{Client: c, t: t, session: res.Session}
+}
+
+func (c *client) close() {
+	require.NoError(c.t, c.Call("ESServer.Cleanup", wire.ESCleanupReq{Session: c.session}, new(wire.ESCleanupReq)))
+	c.Close()
+}
+
+// addKey stores a new key for role in the next empty slot
+func (c *client) addKey(role data.RoleName) (data.PrivateKey, wire.HardwareSlot) {
+	next := new(wire.ESGetNextEmptySlotRes)
+	require.NoError(c.t, c.Call("ESServer.GetNextEmptySlot", wire.ESGetNextEmptySlotReq{Session: c.session}, next))
+	key, err := utils.GenerateECDSAKey(rand.Reader)
+	require.NoError(c.t, err)
+	slot := wire.HardwareSlot{Role: role.String(), SlotID: next.Slot, KeyID: key.ID()}
+	require.NoError(c.t, c.add(key, slot, userPIN))
+	return key, slot
+}
+
+func (c *client) add(key data.PrivateKey, slot wire.HardwareSlot, pin string) error {
+	req := wire.ESAddECDSAKeyReq{Session: c.session, PrivateKey: upstream.NewPrivateKey(key), Slot: slot, Pass: pin, Role: slot.Role}
+	return c.Call("ESServer.AddECDSAKey", req, new(wire.ESAddECDSAKeyRes))
+}
+
+func (c *client) listKeys() (map[string]wire.HardwareSlot, error) {
+	res := new(wire.ESHardwareListKeysRes)
+	err := c.Call("ESServer.HardwareListKeys", wire.ESHardwareListKeysReq{Session: c.session}, res)
+	return res.Keys, err
+}
+
+func (c *client) publicKey(slot wire.HardwareSlot) (data.PublicKey, error) {
+	res := new(wire.ESGetECDSAKeyRes)
+	if err := c.Call("ESServer.GetECDSAKey", wire.ESGetECDSAKeyReq{Session: c.session, Slot: slot}, res); err != nil {
+		return nil, err
+	}
+	return upstream.PublicKey(res.PublicKey), nil
+}
+
+func (c *client) sign(slot wire.HardwareSlot, pin string, payload []byte) ([]byte, error) {
+	res := new(wire.ESSignRes)
+	err := c.Call("ESServer.Sign", wire.ESSignReq{Session: c.session, Slot: slot, Pass: pin, Payload: payload}, res)
+	return res.Result, err
+}
+
+func (c *client) remove(slot wire.HardwareSlot, pin string) error {
+	req := wire.ESHardwareRemoveKeyReq{Session: c.session, Slot: slot, Pass: pin, KeyID: slot.KeyID}
+	return c.Call("ESServer.HardwareRemoveKey", req, new(wire.ESHardwareRemoveKeyRes))
+}
+
+// verify checks a raw ECDSA signature of payload made by pub
+func verify(t *testing.T, pub data.PublicKey, payload, sig []byte) {
+	parsed, err := x509.ParsePKIXPublicKey(pub.Public())
+	require.NoError(t, err)
+	require.Len(t, sig, 64)
+	digest := sha256.Sum256(payload)
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	require.True(t, ecdsa.Verify(parsed.(*ecdsa.PublicKey), digest[:], r, s), "the signature does not verify")
+}
+
+func TestKeyLifecycle(t *testing.T) {
+	c := connect(t)
+	defer c.close()
+
+	name := new(wire.ESNameRes)
+	require.NoError(t, c.Call("ESServer.Name", wire.ESNameReq{}, name))
+	require.Equal(t, "yubikey", name.Name)
+	_, err := c.listKeys()
+	require.Equal(t, yubikey.ErrCodeKeyNotFound, yubikey.ErrorCodeOf(err))
+
+	// the SO PIN does not manage the keys of SoftHSM
+	key, err := utils.GenerateECDSAKey(rand.Reader)
+	require.NoError(t, err)
+	next := new(wire.ESGetNextEmptySlotRes)
+	require.NoError(t, c.Call("ESServer.GetNextEmptySlot", wire.ESGetNextEmptySlotReq{Session: c.session}, next))
+	err = c.add(key, wire.HardwareSlot{Role: data.CanonicalRootRole.String(), SlotID: next.Slot, KeyID: key.ID()}, soPIN)
+	require.Equal(t, yubikey.ErrCodeWrongPin, yubikey.ErrorCodeOf(err))
+
+	rootKey, rootSlot := c.addKey(data.CanonicalRootRole)
+	targetsKey, targetsSlot := c.addKey(data.CanonicalTargetsRole)
+	require.NotEqual(t, rootSlot.SlotID, targetsSlot.SlotID)
+	err = c.add(key, rootSlot, userPIN)
+	require.Equal(t, yubikey.ErrCodeSlotOccupied, yubikey.ErrorCodeOf(err))
+
+	keys, err := c.listKeys()
+	require.NoError(t, err)
+	require.Equal(t, map[string]wire.HardwareSlot{
+		rootKey.ID():    {Role: "root", SlotID: rootSlot.SlotID},
+		targetsKey.ID(): {Role: "targets", SlotID: targetsSlot.SlotID},
+	}, keys)
+
+	pub, err := c.publicKey(rootSlot)
+	require.NoError(t, err)
+	require.Equal(t, rootKey.ID(), pub.ID())
+	payload := []byte("signed by SoftHSM")
+	sig, err := c.sign(rootSlot, userPIN, payload)
+	require.NoError(t, err)
+	verify(t, pub, payload, sig)
+	_, err = c.sign(rootSlot, "654321", payload)
+	require.Equal(t, yubikey.ErrCodeWrongPin, yubikey.ErrorCodeOf(err))
+
+	require.NoError(t, c.remove(rootSlot, userPIN))
+	_, err = c.publicKey(rootSlot)
+	require.Equal(t, yubikey.ErrCodeKeyNotFound, yubikey.ErrorCodeOf(err))
+	_, err = c.sign(rootSlot, userPIN, payload)
+	require.Equal(t, yubikey.ErrCodeKeyNotFound, yubikey.ErrorCodeOf(err))
+	keys, err = c.listKeys()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.Contains(t, keys, targetsKey.ID())
+
+	require.NoError(t, c.remove(targetsSlot, userPIN))
+	_, err = c.listKeys()
+	require.Equal(t, yubikey.ErrCodeKeyNotFound, yubikey.ErrorCodeOf(err))
+}
+
+func TestKeysOutliveConnections(t *testing.T) {
+	c := connect(t)
+	key, slot := c.addKey(data.CanonicalSnapshotRole)
+	c.close()
+
+	// the key is a token object, a new connection finds and signs with it
+	c = connect(t)
+	defer c.close()
+	defer func() { require.NoError(t, c.remove(slot, userPIN)) }()
+	keys, err := c.listKeys()
+	require.NoError(t, err)
+	require.Contains(t, keys, key.ID())
+	pub, err := c.publicKey(slot)
+	require.NoError(t, err)
+	payload := []byte("signed after reconnecting")
+	sig, err := c.sign(slot, userPIN, payload)
+	require.NoError(t, err)
+	verify(t, pub, payload, sig)
+}
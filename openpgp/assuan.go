@@ -0,0 +1,210 @@
+package openpgp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+)
+
+// libgpg-error codes reported by gpg-agent and scdaemon, the upper bits of
+// an ERR line carry the error source and are ignored
+const (
+	gpgErrBadPassphrase  = 11
+	gpgErrNoSecretKey    = 17
+	gpgErrNotFound       = 27
+	gpgErrTimeout        = 62
+	gpgErrBadPin         = 87
+	gpgErrCanceled       = 99
+	gpgErrCardRemoved    = 110
+	gpgErrCardNotPresent = 112
+	gpgErrNoScdaemon     = 119
+	gpgErrPinBlocked     = 130
+)
+
+var gpgErrCodes = map[int]yubikey.ErrorCode{
+	gpgErrBadPassphrase:  yubikey.ErrCodeWrongPin,
+	gpgErrBadPin:         yubikey.ErrCodeWrongPin,
+	gpgErrPinBlocked:     yubikey.ErrCodePinLocked,
+	gpgErrNoSecretKey:    yubikey.ErrCodeKeyNotFound,
+	gpgErrNotFound:       yubikey.ErrCodeKeyNotFound,
+	gpgErrTimeout:        yubikey.ErrCodeTouchTimeout,
+	gpgErrCanceled:       yubikey.ErrCodeDevice,
+	gpgErrCardRemoved:    yubikey.ErrCodeNoToken,
+	gpgErrCardNotPresent: yubikey.ErrCodeNoToken,
+	gpgErrNoScdaemon:     yubikey.ErrCodeNoToken,
+}
+
+// assuanConn is a connection to gpg-agent speaking the Assuan protocol
+type assuanConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// response is the outcome of an Assuan command, the unescaped data of its
+// D lines and its status lines without the leading "S "
+type response struct {
+	data   []byte
+	status []string
+}
+
+// inquireFunc answers an INQUIRE of the agent, e.g. for the PIN. It returns
+// false to cancel the inquiry
+type inquireFunc func(keyword string) ([]byte, bool)
+
+// dialAgent connects to the gpg-agent socket at path and waits for its greeting
+func dialAgent(path string, timeout time.Duration) (*assuanConn, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, yubikey.NewError(yubikey.ErrCodeNoToken, "gpg-agent is not reachable at %s: %v", path, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	c := newAssuanConn(conn)
+	if _, err := c.readResponse(nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func newAssuanConn(conn net.Conn) *assuanConn {
+	return &assuanConn{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// Close says goodbye to the agent and closes the connection
+func (c *assuanConn) Close() error {
+	fmt.Fprint(c.conn, "BYE\n")
+	return c.conn.Close()
+}
+
+// transact sends a command and reads its response. inquire may be nil if
+// the command does not inquire anything
+func (c *assuanConn) transact(cmd string, inquire inquireFunc) (response, error) {
+	if _, err := fmt.Fprintf(c.conn, "%s\n", cmd); err != nil {
+		return response{}, yubikey.NewError(yubikey.ErrCodeDevice, "sending %s to gpg-agent: %v", commandName(cmd), err)
+	}
+	return c.readResponse(inquire)
+}
+
+func (c *assuanConn) readResponse(inquire inquireFunc) (response, error) {
+	var res response
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return res, yubikey.NewError(yubikey.ErrCodeDevice, "reading from gpg-agent: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return res, nil
+		case strings.HasPrefix(line, "ERR "):
+			return res, agentError(line[len("ERR "):])
+		case strings.HasPrefix(line, "D "):
+			res.data = append(res.data, unescape(line[len("D "):])...)
+		case strings.HasPrefix(line, "S "):
+			res.status = append(res.status, line[len("S "):])
+		case strings.HasPrefix(line, "INQUIRE "):
+			if err := c.answer(line[len("INQUIRE "):], inquire); err != nil {
+				return res, err
+			}
+		case line == "#" || strings.HasPrefix(line, "# "):
+			// comments carry no information
+		default:
+			return res, yubikey.NewError(yubikey.ErrCodeDevice, "unexpected line from gpg-agent: %q", line)
+		}
+	}
+}
+
+// answer responds to an inquiry with the data returned by inquire, or
+// cancels it. The agent finishes the command with an ERR in that case
+func (c *assuanConn) answer(inquiry string, inquire inquireFunc) error {
+	keyword := strings.Fields(inquiry)
+	var (
+		data []byte
+		ok   bool
+	)
+	if inquire != nil && len(keyword) > 0 {
+		data, ok = inquire(keyword[0])
+	}
+	var buf bytes.Buffer
+	if ok {
+		if len(data) > 0 {
+			buf.WriteString("D ")
+			buf.Write(escape(data))
+			buf.WriteString("\n")
+		}
+		buf.WriteString("END\n")
+	} else {
+		buf.WriteString("CAN\n")
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return yubikey.NewError(yubikey.ErrCodeDevice, "answering inquiry of gpg-agent: %v", err)
+	}
+	return nil
+}
+
+// agentError classifies the "<code> <description>" of an ERR line
+func agentError(msg string) error {
+	fields := strings.SplitN(msg, " ", 2)
+	desc := msg
+	if len(fields) == 2 {
+		desc = fields[1]
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return yubikey.NewError(yubikey.ErrCodeDevice, "gpg-agent: %s", msg)
+	}
+	code, ok := gpgErrCodes[n&0xffff]
+	if !ok {
+		code = yubikey.ErrCodeDevice
+	}
+	return yubikey.NewError(code, "gpg-agent: %s", desc)
+}
+
+// commandName is the first word of a command, commands are logged without
+// their arguments as these may be secret
+func commandName(cmd string) string {
+	if i := strings.IndexByte(cmd, ' '); i >= 0 {
+		return cmd[:i]
+	}
+	return cmd
+}
+
+// escape percent-escapes the bytes which must not appear on an Assuan line
+func escape(b []byte) []byte {
+	var buf bytes.Buffer
+	for _, c := range b {
+		if c == '%' || c == '\r' || c == '\n' {
+			fmt.Fprintf(&buf, "%%%02X", c)
+			continue
+		}
+		buf.WriteByte(c)
+	}
+	return buf.Bytes()
+}
+
+// unescape decodes the percent escapes of a D line
+func unescape(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b = append(b, byte(v))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
@@ -0,0 +1,102 @@
+package openpgp
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAgent answers the commands read from conn with the scripted lines and
+// returns the lines the client sent
+func fakeAgent(conn net.Conn, script map[string][]string) <-chan []string {
+	sent := make(chan []string, 1)
+	go func() {
+		var lines []string
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				sent <- lines
+				return
+			}
+			lines = append(lines, line[:len(line)-1])
+			for _, reply := range script[line[:len(line)-1]] {
+				conn.Write([]byte(reply + "\n"))
+			}
+		}
+	}()
+	return sent
+}
+
+func TestTransact(t *testing.T) {
+	client, server := net.Pipe()
+	sent := fakeAgent(server, map[string][]string{
+		"PKSIGN":    {"# comment", "S PROGRESS", "INQUIRE PASSPHRASE"},
+		"D 12%2534": {},
+		"END":       {"D (1:a%0A)", "OK"},
+		"SIGKEY X":  {"ERR 100663383 Bad PIN <SCD>"},
+	})
+	c := newAssuanConn(client)
+
+	res, err := c.transact("PKSIGN", func(keyword string) ([]byte, bool) {
+		require.Equal(t, "PASSPHRASE", keyword)
+		return []byte("12%34"), true
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("(1:a\n)"), res.data)
+	require.Equal(t, []string{"PROGRESS"}, res.status)
+
+	_, err = c.transact("SIGKEY X", nil)
+	require.Equal(t, yubikey.ErrCodeWrongPin, yubikey.ErrorCodeOf(err))
+
+	client.Close()
+	require.Equal(t, []string{"PKSIGN", "D 12%2534", "END", "SIGKEY X"}, <-sent)
+}
+
+func TestPksignChecksCachedPin(t *testing.T) {
+	ks := &KeyStore{pin: newCardPIN()}
+	sign := func(script map[string][]string, passwd string) ([]byte, error) {
+		client, server := net.Pipe()
+		defer client.Close()
+		fakeAgent(server, script)
+		return ks.pksign(newAssuanConn(client), passwd)
+	}
+	inquiring := map[string][]string{
+		"PKSIGN": {"INQUIRE PASSPHRASE"},
+		"D 1234": {},
+		"END":    {"D (1:a)", "OK"},
+	}
+	// scdaemon signs without asking once the card is verified
+	cached := map[string][]string{
+		"PKSIGN": {"D (1:b)", "OK"},
+	}
+
+	// the card was never verified through the adapter
+	_, err := sign(cached, "1234")
+	require.Equal(t, yubikey.ErrCodeWrongPin, yubikey.ErrorCodeOf(err))
+
+	sig, err := sign(inquiring, "1234")
+	require.NoError(t, err)
+	require.Equal(t, []byte("(1:a)"), sig)
+
+	sig, err = sign(cached, "1234")
+	require.NoError(t, err)
+	require.Equal(t, []byte("(1:b)"), sig)
+	for _, passwd := range []string{"4321", ""} {
+		_, err = sign(cached, passwd)
+		require.Equal(t, yubikey.ErrCodeWrongPin, yubikey.ErrorCodeOf(err))
+	}
+
+	// a PIN the card refused is not verified anymore
+	_, err = sign(map[string][]string{
+		"PKSIGN": {"INQUIRE PASSPHRASE"},
+		"D 4321": {},
+		"END":    {"ERR 100663383 Bad PIN <SCD>"},
+	}, "4321")
+	require.Equal(t, yubikey.ErrCodeWrongPin, yubikey.ErrorCodeOf(err))
+	_, err = sign(cached, "1234")
+	require.Equal(t, yubikey.ErrCodeWrongPin, yubikey.ErrorCodeOf(err))
+}
@@ -0,0 +1,501 @@
+// Package openpgp is a backend for keys on the OpenPGP applet of a yubikey,
+// or any other OpenPGP card. It signs through gpg-agent and scdaemon, so the
+// card can be shared with gpg. Keys are provisioned with gpg --card-edit and
+// mapped to notary roles in the config file
+package openpgp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/externalstore"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+const (
+	name = "openpgp"
+	// keyRefPrefix prefixes the number of an OpenPGP card key, 1 is the
+	// signature, 2 the encryption and 3 the authentication key
+	keyRefPrefix = "OPENPGP."
+	// agentTimeout bounds a whole conversation with gpg-agent, including
+	// the PIN entry and touching the card
+	agentTimeout = time.Minute
+)
+
+// names under which gpg reports the P-256 curve
+var p256Names = map[string]bool{
+	"NIST P-256":          true,
+	"nistp256":            true,
+	"prime256v1":          true,
+	"secp256r1":           true,
+	"1.2.840.10045.3.1.7": true,
+}
+
+// Config is the section of the config file for the openpgp backend
+type Config struct {
+	// AgentSocket is the path of the gpg-agent socket, by default it is
+	// asked from gpgconf
+	AgentSocket string `json:"agent_socket"`
+	// Roles maps card keys, e.g. "OPENPGP.1", to notary roles. Keys which
+	// are not mapped are not served
+	Roles map[string]string `json:"roles"`
+}
+
+// KeyStore serves the keys of an OpenPGP card
+type KeyStore struct {
+	socket   string
+	roles    map[byte]data.RoleName
+	sessions uint32
+	pin      *cardPIN
+}
+
+// cardPIN is a keyed hash of the PIN the card accepted last. scdaemon keeps
+// the card verified after a signature, so gpg-agent does not inquire the
+// PIN of later signatures and the adapter has to check it instead
+type cardPIN struct {
+	sync.Mutex
+	key []byte
+	mac []byte
+}
+
+func newCardPIN() *cardPIN {
+	p := &cardPIN{key: make([]byte, 32)}
+	if _, err := rand.Read(p.key); err != nil {
+		panic(fmt.Sprintf("failed to create the PIN key of the OpenPGP card: %v", err))
+	}
+	return p
+}
+
+// hash returns the keyed hash of a PIN
+func (p *cardPIN) hash(passwd string) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(passwd))
+	return mac.Sum(nil)
+}
+
+// accepted remembers that the card verified passwd
+func (p *cardPIN) accepted(passwd string) {
+	p.Lock()
+	defer p.Unlock()
+	p.mac = p.hash(passwd)
+}
+
+// forget is called once the card refused a PIN, it is not verified anymore
+func (p *cardPIN) forget() {
+	p.Lock()
+	defer p.Unlock()
+	p.mac = nil
+}
+
+// matches tells whether passwd is the PIN the card accepted last
+func (p *cardPIN) matches(passwd string) bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.mac != nil && hmac.Equal(p.mac, p.hash(passwd))
+}
+
+// cardKey is a key found on the card
+type cardKey struct {
+	ref     byte
+	keygrip string
+	role    data.RoleName
+	pub     *ecdsa.PublicKey
+	keyID   string
+}
+
+func init() {
+	backend.Register(name, func(raw json.RawMessage) (backend.Backend, error) {
+		cfg, err := parseConfig(raw)
+		if err != nil {
+			return nil, err
+		}
+		roles, err := cfg.keyRoles()
+		if err != nil {
+			return nil, err
+		}
+		if len(roles) == 0 {
+			logrus.Warn("No OpenPGP card keys are mapped to roles, set roles in the openpgp section of the config file")
+		}
+		return &KeyStore{socket: cfg.AgentSocket, roles: roles, pin: newCardPIN()}, nil
+	})
+}
+
+// parseConfig reads the backend section of the config file, which may be empty
+func parseConfig(raw json.RawMessage) (Config, error) {
+	var cfg Config
+	if len(raw) == 0 {
+		return cfg, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, yubikey.NewError(yubikey.ErrCodeInvalidRequest, "invalid openpgp config: %v", err)
+	}
+	return cfg, nil
+}
+
+// keyRoles resolves the card key references of the config
+func (cfg Config) keyRoles() (map[byte]data.RoleName, error) {
+	roles := make(map[byte]data.RoleName)
+	for keyRef, role := range cfg.Roles {
+		ref, err := parseKeyRef(keyRef)
+		if err != nil {
+			return nil, err
+		}
+		if !data.ValidRole(data.RoleName(role)) {
+			return nil, yubikey.NewError(yubikey.ErrCodeInvalidRequest, "card key %s: %q is no notary role", keyRef, role)
+		}
+		roles[ref] = data.RoleName(role)
+	}
+	return roles, nil
+}
+
+// parseKeyRef returns the number of a card key reference like OPENPGP.1
+func parseKeyRef(keyRef string) (byte, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(keyRef), keyRefPrefix))
+	if !strings.HasPrefix(strings.ToUpper(keyRef), keyRefPrefix) || err != nil || n < 1 || n > 3 {
+		return 0, yubikey.NewError(yubikey.ErrCodeInvalidRequest, "invalid card key %q, expected OPENPGP.1 to OPENPGP.3", keyRef)
+	}
+	return byte(n), nil
+}
+
+// Name returns the hardwarestores name
+func (ks *KeyStore) Name() string {
+	return name
+}
+
+// agentSocket returns the path of the gpg-agent socket
+func (ks *KeyStore) agentSocket() string {
+	if ks.socket != "" {
+		return ks.socket
+	}
+	if out, err := exec.Command("gpgconf", "--list-dirs", "agent-socket").Output(); err == nil {
+		if path := strings.TrimSpace(string(out)); path != "" {
+			return path
+		}
+	}
+	home := os.Getenv("GNUPGHOME")
+	if home == "" {
+		home = filepath.Join(os.Getenv("HOME"), ".gnupg")
+	}
+	return filepath.Join(home, "S.gpg-agent")
+}
+
+// dial connects to gpg-agent
+func (ks *KeyStore) dial() (*assuanConn, error) {
+	return dialAgent(ks.agentSocket(), agentTimeout)
+}
+
+// SetupHSMEnv checks that gpg-agent can reach a card. No state is kept per
+// session, every request talks to the agent anew
+func (ks *KeyStore) SetupHSMEnv() (pkcs11.SessionHandle, error) {
+	c, err := ks.dial()
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	if _, err := c.transact("SCD SERIALNO", nil); err != nil {
+		return 0, err
+	}
+	return pkcs11.SessionHandle(atomic.AddUint32(&ks.sessions, 1)), nil
+}
+
+// CloseSession does nothing, sessions hold no state
+func (ks *KeyStore) CloseSession(session pkcs11.SessionHandle) {}
+
+// Cleanup does nothing, the card stays with gpg-agent
+func (ks *KeyStore) Cleanup() {}
+
+// NeedLogin returns whether a function needs the PIN of the card
+func (ks *KeyStore) NeedLogin(functionID uint) (bool, uint, error) {
+	switch functionID {
+	case externalstore.FUNCTION_ADDECDSAKEY:
+		return true, pkcs11.CKU_SO, nil
+	case externalstore.FUNCTION_GETECDSAKEY:
+		return false, 0, nil
+	case externalstore.FUNCTION_SIGN:
+		return true, pkcs11.CKU_USER, nil
+	case externalstore.FUNCTION_HARDWAREREMOVEKEY:
+		return true, pkcs11.CKU_SO, nil
+	default:
+		return true, pkcs11.CKU_CONTEXT_SPECIFIC, yubikey.NewError(yubikey.ErrCodeInvalidRequest, "Unknown Function")
+	}
+}
+
+// AddECDSAKeyWithOptions is not supported, keys are generated or imported
+// with gpg --card-edit and mapped to roles in the config file
+func (ks *KeyStore) AddECDSAKeyWithOptions(session pkcs11.SessionHandle, privKey data.PrivateKey, hwslot common.HardwareSlot, passwd string, role data.RoleName, opts backend.AddKeyOptions) error {
+	return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "keys on OpenPGP cards are managed with gpg --card-edit")
+}
+
+// HardwareRemoveKey is not supported, see AddECDSAKeyWithOptions
+func (ks *KeyStore) HardwareRemoveKey(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string, keyID string) error {
+	return yubikey.NewError(yubikey.ErrCodeInvalidRequest, "keys on OpenPGP cards are managed with gpg --card-edit")
+}
+
+// GetNextEmptySlot always fails, keys cannot be added through the adapter
+func (ks *KeyStore) GetNextEmptySlot(session pkcs11.SessionHandle) ([]byte, error) {
+	return nil, yubikey.NewError(yubikey.ErrCodeNoSlot, "keys on OpenPGP cards are managed with gpg --card-edit")
+}
+
+// cardKeys returns the keys of the card which are mapped to a role. LEARN
+// also makes gpg-agent create the stubs it needs to sign with the keys
+func (ks *KeyStore) cardKeys(c *assuanConn) ([]cardKey, error) {
+	res, err := c.transact("LEARN --sendinfo", nil)
+	if err != nil {
+		return nil, err
+	}
+	keygrips := keypairInfo(res.status)
+
+	var keys []cardKey
+	for ref, role := range ks.roles {
+		keygrip, ok := keygrips[ref]
+		if !ok {
+			logrus.Warnf("Card key %s%d mapped to role %s is not on the card", keyRefPrefix, ref, role)
+			continue
+		}
+		res, err := c.transact(fmt.Sprintf("SCD READKEY %s%d", keyRefPrefix, ref), nil)
+		if err != nil {
+			return nil, err
+		}
+		pub, err := parsePublicKey(res.data)
+		if err != nil {
+			logrus.Warnf("Skipping card key %s%d: %v", keyRefPrefix, ref, err)
+			continue
+		}
+		pubBytes, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return nil, yubikey.NewError(yubikey.ErrCodeDevice, "encoding public key of %s%d: %v", keyRefPrefix, ref, err)
+		}
+		keys = append(keys, cardKey{
+			ref:     ref,
+			keygrip: keygrip,
+			role:    role,
+			pub:     pub,
+			keyID:   data.NewECDSAPublicKey(pubBytes).ID(),
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ref < keys[j].ref })
+	return keys, nil
+}
+
+// keypairInfo maps card key numbers to the keygrips listed by the
+// "KEYPAIRINFO <keygrip> OPENPGP.<n> ..." status lines
+func keypairInfo(status []string) map[byte]string {
+	keygrips := make(map[byte]string)
+	for _, line := range status {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "KEYPAIRINFO" {
+			continue
+		}
+		// keys which are not present are listed with the keygrip "X"
+		if _, err := hex.DecodeString(fields[1]); err != nil || len(fields[1]) != 40 {
+			continue
+		}
+		ref, err := parseKeyRef(fields[2])
+		if err != nil {
+			continue
+		}
+		keygrips[ref] = fields[1]
+	}
+	return keygrips
+}
+
+// parsePublicKey decodes a (public-key (ecc (curve ...) (q ...))) expression
+func parsePublicKey(b []byte) (*ecdsa.PublicKey, error) {
+	s, err := parseSexp(b)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := s.find("ecc"); !ok {
+		return nil, fmt.Errorf("only ECC keys are supported")
+	}
+	curve, ok := s.value("curve")
+	if !ok || !p256Names[string(curve)] {
+		return nil, fmt.Errorf("only P-256 keys are supported, key uses curve %q", curve)
+	}
+	q, ok := s.value("q")
+	if !ok {
+		return nil, fmt.Errorf("public key has no point")
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), q)
+	if x == nil {
+		return nil, fmt.Errorf("invalid P-256 point")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
+
+// parseSignature decodes a (sig-val (ecdsa (r ...) (s ...))) expression
+func parseSignature(b []byte) (*big.Int, *big.Int, error) {
+	s, err := parseSexp(b)
+	if err != nil {
+		return nil, nil, yubikey.NewError(yubikey.ErrCodeDevice, "invalid signature from gpg-agent: %v", err)
+	}
+	r, okR := s.value("r")
+	sVal, okS := s.value("s")
+	if _, ok := s.find("ecdsa"); !ok || !okR || !okS {
+		return nil, nil, yubikey.NewError(yubikey.ErrCodeDevice, "gpg-agent returned no ECDSA signature")
+	}
+	return new(big.Int).SetBytes(r), new(big.Int).SetBytes(sVal), nil
+}
+
+// findKey returns the card key in the given slot
+func (ks *KeyStore) findKey(c *assuanConn, slotID []byte) (cardKey, error) {
+	keys, err := ks.cardKeys(c)
+	if err != nil {
+		return cardKey{}, err
+	}
+	for _, key := range keys {
+		if len(slotID) == 1 && slotID[0] == key.ref {
+			return key, nil
+		}
+	}
+	return cardKey{}, yubikey.NewError(yubikey.ErrCodeKeyNotFound, "no key mapped to a role in slot %x", slotID)
+}
+
+// GetECDSAKey gets a key by slot from the card
+func (ks *KeyStore) GetECDSAKey(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string) (*data.ECDSAPublicKey, data.RoleName, error) {
+	c, err := ks.dial()
+	if err != nil {
+		return nil, "", err
+	}
+	defer c.Close()
+	key, err := ks.findKey(c, hwslot.SlotID)
+	if err != nil {
+		return nil, "", err
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(key.pub)
+	if err != nil {
+		return nil, "", yubikey.NewError(yubikey.ErrCodeDevice, "encoding public key: %v", err)
+	}
+	return data.NewECDSAPublicKey(pubBytes), key.role, nil
+}
+
+// HardwareListKeys lists the keys of the card which are mapped to a role
+func (ks *KeyStore) HardwareListKeys(session pkcs11.SessionHandle) (map[string]common.HardwareSlot, error) {
+	c, err := ks.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	keys, err := ks.cardKeys(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, yubikey.NewError(yubikey.ErrCodeKeyNotFound, "no keys found on the OpenPGP card")
+	}
+	list := make(map[string]common.HardwareSlot, len(keys))
+	for _, key := range keys {
+		list[key.keyID] = common.HardwareSlot{
+			Role:   key.role,
+			SlotID: []byte{key.ref},
+			KeyID:  key.keyID,
+		}
+	}
+	return list, nil
+}
+
+// SignWithOptions signs with the card key in the given slot. The payload
+// is hashed on the host, the card only signs the digest
+func (ks *KeyStore) SignWithOptions(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string, payload []byte, opts backend.SignOptions) ([]byte, error) {
+	curve := elliptic.P256()
+	digest, hash, err := yubikey.HostDigest(payload, curve, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := ks.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	key, err := ks.findKey(c, hwslot.SlotID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the PIN is handed over by the adapter instead of a pinentry
+	if _, err := c.transact("OPTION pinentry-mode=loopback", nil); err != nil {
+		return nil, err
+	}
+	if _, err := c.transact("SIGKEY "+key.keygrip, nil); err != nil {
+		return nil, err
+	}
+	cmd := fmt.Sprintf("SETHASH --hash=%s %X", strings.ToLower(strings.Replace(hash.String(), "-", "", 1)), digest)
+	if _, err := c.transact(cmd, nil); err != nil {
+		return nil, err
+	}
+	sig, err := ks.pksign(c, passwd)
+	if err != nil {
+		return nil, err
+	}
+	r, s, err := parseSignature(sig)
+	if err != nil {
+		return nil, err
+	}
+	return yubikey.EncodeSignature(r, s, curve, opts)
+}
+
+// pksign signs the hash set on c. gpg-agent only inquires the PIN while the
+// card is not verified, a signature it made without asking is refused unless
+// passwd is the PIN the card accepted last
+func (ks *KeyStore) pksign(c *assuanConn, passwd string) ([]byte, error) {
+	inquired := false
+	res, err := c.transact("PKSIGN", func(keyword string) ([]byte, bool) {
+		if keyword != "PASSPHRASE" && keyword != "NEW_PASSPHRASE" {
+			return nil, keyword == "PINENTRY_LAUNCHED"
+		}
+		inquired = true
+		return []byte(passwd), true
+	})
+	if err != nil {
+		if code := yubikey.ErrorCodeOf(err); inquired && (code == yubikey.ErrCodeWrongPin || code == yubikey.ErrCodePinLocked) {
+			ks.pin.forget()
+		}
+		return nil, err
+	}
+	if inquired {
+		ks.pin.accepted(passwd)
+	} else if !ks.pin.matches(passwd) {
+		return nil, yubikey.NewError(yubikey.ErrCodeWrongPin, "the card was verified with another PIN, if the PIN was changed restart scdaemon with gpgconf --kill scdaemon")
+	}
+	return res.data, nil
+}
+
+// Diagnostics describes the agent socket and the mapped keys
+func (ks *KeyStore) Diagnostics() []string {
+	lines := []string{fmt.Sprintf("agent socket: %s", ks.agentSocket())}
+	refs := make([]int, 0, len(ks.roles))
+	for ref := range ks.roles {
+		refs = append(refs, int(ref))
+	}
+	sort.Ints(refs)
+	for _, ref := range refs {
+		lines = append(lines, fmt.Sprintf("card key %s%d: %s", keyRefPrefix, ref, ks.roles[byte(ref)]))
+	}
+	return lines
+}
@@ -0,0 +1,104 @@
+package openpgp
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// sexp is a node of a canonical s-expression as exchanged with gpg-agent,
+// either an atom or a list
+type sexp struct {
+	atom []byte
+	list []sexp
+	// isList tells the empty list apart from the empty atom
+	isList bool
+}
+
+// parseSexp parses a canonical s-expression like (3:foo(3:bar1:x))
+func parseSexp(b []byte) (sexp, error) {
+	node, rest, err := parseSexpNode(b)
+	if err != nil {
+		return sexp{}, err
+	}
+	if len(rest) != 0 {
+		return sexp{}, fmt.Errorf("%d trailing bytes after s-expression", len(rest))
+	}
+	return node, nil
+}
+
+func parseSexpNode(b []byte) (sexp, []byte, error) {
+	if len(b) == 0 {
+		return sexp{}, nil, fmt.Errorf("unexpected end of s-expression")
+	}
+	if b[0] != '(' {
+		return parseSexpAtom(b)
+	}
+
+	node := sexp{isList: true}
+	b = b[1:]
+	for {
+		if len(b) == 0 {
+			return sexp{}, nil, fmt.Errorf("unterminated s-expression list")
+		}
+		if b[0] == ')' {
+			return node, b[1:], nil
+		}
+		child, rest, err := parseSexpNode(b)
+		if err != nil {
+			return sexp{}, nil, err
+		}
+		node.list = append(node.list, child)
+		b = rest
+	}
+}
+
+func parseSexpAtom(b []byte) (sexp, []byte, error) {
+	colon := bytes.IndexByte(b, ':')
+	if colon <= 0 {
+		return sexp{}, nil, fmt.Errorf("s-expression atom without length")
+	}
+	n, err := strconv.Atoi(string(b[:colon]))
+	if err != nil || n < 0 {
+		return sexp{}, nil, fmt.Errorf("invalid s-expression atom length %q", b[:colon])
+	}
+	b = b[colon+1:]
+	if len(b) < n {
+		return sexp{}, nil, fmt.Errorf("s-expression atom of %d bytes exceeds the data", n)
+	}
+	return sexp{atom: b[:n]}, b[n:], nil
+}
+
+// name is the first atom of a list, e.g. "sig-val" for (sig-val ...)
+func (s sexp) name() string {
+	if !s.isList || len(s.list) == 0 || s.list[0].isList {
+		return ""
+	}
+	return string(s.list[0].atom)
+}
+
+// find returns the first list named name, searching depth first
+func (s sexp) find(name string) (sexp, bool) {
+	if !s.isList {
+		return sexp{}, false
+	}
+	if s.name() == name {
+		return s, true
+	}
+	for _, child := range s.list {
+		if found, ok := child.find(name); ok {
+			return found, true
+		}
+	}
+	return sexp{}, false
+}
+
+// value returns the atom following the name of the list named name, e.g.
+// the bytes of r in (r 32:...)
+func (s sexp) value(name string) ([]byte, bool) {
+	found, ok := s.find(name)
+	if !ok || len(found.list) < 2 || found.list[1].isList {
+		return nil, false
+	}
+	return found.list[1].atom, true
+}
@@ -0,0 +1,54 @@
+package openpgp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSexp(t *testing.T) {
+	s, err := parseSexp([]byte("(7:sig-val(5:ecdsa(1:r2:\x01\x02)(1:s1:\x03)))"))
+	require.NoError(t, err)
+	require.Equal(t, "sig-val", s.name())
+	r, ok := s.value("r")
+	require.True(t, ok)
+	require.Equal(t, []byte{1, 2}, r)
+	_, ok = s.value("q")
+	require.False(t, ok)
+
+	for _, invalid := range []string{"", "(3:foo", "(5:foo)", "(x:foo)", "(3:foo))"} {
+		_, err := parseSexp([]byte(invalid))
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	q := elliptic.Marshal(elliptic.P256(), priv.X, priv.Y)
+
+	pub, err := parsePublicKey([]byte(fmt.Sprintf("(10:public-key(3:ecc(5:curve10:NIST P-256)(1:q%d:%s)))", len(q), q)))
+	require.NoError(t, err)
+	require.Equal(t, 0, pub.X.Cmp(priv.X))
+	require.Equal(t, 0, pub.Y.Cmp(priv.Y))
+
+	_, err = parsePublicKey([]byte(fmt.Sprintf("(10:public-key(3:ecc(5:curve10:NIST P-384)(1:q%d:%s)))", len(q), q)))
+	require.Error(t, err)
+	_, err = parsePublicKey([]byte("(10:public-key(3:rsa(1:n1:\x01)(1:e1:\x03)))"))
+	require.Error(t, err)
+}
+
+func TestKeypairInfo(t *testing.T) {
+	grip := "0123456789ABCDEF0123456789ABCDEF01234567"
+	keygrips := keypairInfo([]string{
+		"SERIALNO D2760001240103040006123456780000",
+		"KEYPAIRINFO " + grip + " OPENPGP.1 sc 1700000000 nistp256",
+		"KEYPAIRINFO X OPENPGP.2",
+		"KEYPAIRINFO " + grip + " PIV.9A",
+	})
+	require.Equal(t, map[byte]string{1: grip}, keygrips)
+}
@@ -0,0 +1,487 @@
+package main
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../vendor/github.com/miekg/pkcs11
+#include <stdlib.h>
+#include <string.h>
+#include "pkcs11go.h"
+*/
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+)
+
+const (
+	slotID              = 0
+	unavailable         = ^C.CK_ULONG(0)
+	signatureLen        = 64
+	manufacturer        = "notary-yubikey-adapter"
+	libraryDescription  = "notary yubikey adapter provider"
+	tokenLabel          = "notary-yubikey-adapter"
+	slotDescription     = "daemon of the notary yubikey adapter"
+	maxTemplateLen      = 1 << 16
+	maxObjectHandlesLen = 1 << 20
+)
+
+// padded copies s into a blank padded CK_UTF8CHAR array
+func padded(dst []C.CK_UTF8CHAR, s string) {
+	for i := range dst {
+		dst[i] = ' '
+		if i < len(s) {
+			dst[i] = C.CK_UTF8CHAR(s[i])
+		}
+	}
+}
+
+// lockSession locks the module and returns the session with handle. The
+// caller has to unlock the module if rv is CKR_OK
+func lockSession(handle C.CK_SESSION_HANDLE) (*session, C.CK_RV) {
+	if module == nil {
+		return nil, pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED
+	}
+	module.Lock()
+	s, ok := module.sessions[uint(handle)]
+	if !ok {
+		module.Unlock()
+		return nil, pkcs11.CKR_SESSION_HANDLE_INVALID
+	}
+	return s, pkcs11.CKR_OK
+}
+
+//export C_Initialize
+func C_Initialize(pInitArgs C.CK_VOID_PTR) C.CK_RV {
+	if module != nil {
+		return pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED
+	}
+	module = &provider{sessions: make(map[uint]*session)}
+	return pkcs11.CKR_OK
+}
+
+//export C_Finalize
+func C_Finalize(pReserved C.CK_VOID_PTR) C.CK_RV {
+	if module == nil {
+		return pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED
+	}
+	module.Lock()
+	for _, s := range module.sessions {
+		module.closeSession(s)
+	}
+	if module.client != nil {
+		module.client.Close()
+	}
+	module.Unlock()
+	module = nil
+	return pkcs11.CKR_OK
+}
+
+//export C_GetInfo
+func C_GetInfo(pInfo C.CK_INFO_PTR) C.CK_RV {
+	if module == nil {
+		return pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED
+	}
+	pInfo.cryptokiVersion = C.CK_VERSION{major: 2, minor: 40}
+	padded(pInfo.manufacturerID[:], manufacturer)
+	pInfo.flags = 0
+	padded(pInfo.libraryDescription[:], libraryDescription)
+	pInfo.libraryVersion = C.CK_VERSION{major: 1, minor: 0}
+	return pkcs11.CKR_OK
+}
+
+//export C_GetSlotList
+func C_GetSlotList(tokenPresent C.CK_BBOOL, pSlotList C.CK_SLOT_ID_PTR, pulCount C.CK_ULONG_PTR) C.CK_RV {
+	if module == nil {
+		return pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED
+	}
+	if pSlotList != nil {
+		if *pulCount < 1 {
+			*pulCount = 1
+			return pkcs11.CKR_BUFFER_TOO_SMALL
+		}
+		*pSlotList = slotID
+	}
+	*pulCount = 1
+	return pkcs11.CKR_OK
+}
+
+//export C_GetSlotInfo
+func C_GetSlotInfo(slot C.CK_SLOT_ID, pInfo C.CK_SLOT_INFO_PTR) C.CK_RV {
+	if module == nil {
+		return pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED
+	}
+	if slot != slotID {
+		return pkcs11.CKR_SLOT_ID_INVALID
+	}
+	padded(pInfo.slotDescription[:], slotDescription)
+	padded(pInfo.manufacturerID[:], manufacturer)
+	pInfo.flags = pkcs11.CKF_TOKEN_PRESENT | pkcs11.CKF_HW_SLOT
+	pInfo.hardwareVersion = C.CK_VERSION{major: 1}
+	pInfo.firmwareVersion = C.CK_VERSION{major: 1}
+	return pkcs11.CKR_OK
+}
+
+//export C_GetTokenInfo
+func C_GetTokenInfo(slot C.CK_SLOT_ID, pInfo C.CK_TOKEN_INFO_PTR) C.CK_RV {
+	if module == nil {
+		return pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED
+	}
+	if slot != slotID {
+		return pkcs11.CKR_SLOT_ID_INVALID
+	}
+	padded(pInfo.label[:], tokenLabel)
+	padded(pInfo.manufacturerID[:], manufacturer)
+	padded(pInfo.model[:], "daemon")
+	padded(pInfo.serialNumber[:], "0")
+	// the daemon may supply the PIN itself, so logging in is optional
+	pInfo.flags = pkcs11.CKF_TOKEN_INITIALIZED | pkcs11.CKF_USER_PIN_INITIALIZED | pkcs11.CKF_WRITE_PROTECTED
+	pInfo.ulMaxSessionCount = 0
+	pInfo.ulSessionCount = unavailable
+	pInfo.ulMaxRwSessionCount = 0
+	pInfo.ulRwSessionCount = unavailable
+	pInfo.ulMaxPinLen = 8
+	pInfo.ulMinPinLen = 6
+	pInfo.ulTotalPublicMemory = unavailable
+	pInfo.ulFreePublicMemory = unavailable
+	pInfo.ulTotalPrivateMemory = unavailable
+	pInfo.ulFreePrivateMemory = unavailable
+	pInfo.hardwareVersion = C.CK_VERSION{major: 1}
+	pInfo.firmwareVersion = C.CK_VERSION{major: 1}
+	for i := range pInfo.utcTime {
+		pInfo.utcTime[i] = ' '
+	}
+	return pkcs11.CKR_OK
+}
+
+//export C_GetMechanismList
+func C_GetMechanismList(slot C.CK_SLOT_ID, pMechanismList C.CK_MECHANISM_TYPE_PTR, pulCount C.CK_ULONG_PTR) C.CK_RV {
+	if module == nil {
+		return pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED
+	}
+	if slot != slotID {
+		return pkcs11.CKR_SLOT_ID_INVALID
+	}
+	mechs := []C.CK_MECHANISM_TYPE{pkcs11.CKM_ECDSA, pkcs11.CKM_ECDSA_SHA256, pkcs11.CKM_ECDSA_SHA384, pkcs11.CKM_ECDSA_SHA512}
+	if pMechanismList != nil {
+		if *pulCount < C.CK_ULONG(len(mechs)) {
+			*pulCount = C.CK_ULONG(len(mechs))
+			return pkcs11.CKR_BUFFER_TOO_SMALL
+		}
+		list := (*[8]C.CK_MECHANISM_TYPE)(unsafe.Pointer(pMechanismList))
+		copy(list[:], mechs)
+	}
+	*pulCount = C.CK_ULONG(len(mechs))
+	return pkcs11.CKR_OK
+}
+
+//export C_GetMechanismInfo
+func C_GetMechanismInfo(slot C.CK_SLOT_ID, mech C.CK_MECHANISM_TYPE, pInfo C.CK_MECHANISM_INFO_PTR) C.CK_RV {
+	if module == nil {
+		return pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED
+	}
+	if slot != slotID {
+		return pkcs11.CKR_SLOT_ID_INVALID
+	}
+	if _, ok := signMechanisms[uint(mech)]; !ok {
+		return pkcs11.CKR_MECHANISM_INVALID
+	}
+	pInfo.ulMinKeySize = 256
+	pInfo.ulMaxKeySize = 256
+	pInfo.flags = pkcs11.CKF_HW | pkcs11.CKF_SIGN | pkcs11.CKF_EC_F_P | pkcs11.CKF_EC_NAMEDCURVE | pkcs11.CKF_EC_UNCOMPRESS
+	return pkcs11.CKR_OK
+}
+
+//export C_OpenSession
+func C_OpenSession(slot C.CK_SLOT_ID, flags C.CK_FLAGS, pApplication C.CK_VOID_PTR, notify C.CK_NOTIFY, phSession C.CK_SESSION_HANDLE_PTR) C.CK_RV {
+	if module == nil {
+		return pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED
+	}
+	if slot != slotID {
+		return pkcs11.CKR_SLOT_ID_INVALID
+	}
+	if flags&pkcs11.CKF_SERIAL_SESSION == 0 {
+		return pkcs11.CKR_SESSION_PARALLEL_NOT_SUPPORTED
+	}
+	if flags&pkcs11.CKF_RW_SESSION != 0 {
+		return pkcs11.CKR_TOKEN_WRITE_PROTECTED
+	}
+	module.Lock()
+	defer module.Unlock()
+	handle, rv := module.openSession()
+	if rv == pkcs11.CKR_OK {
+		*phSession = C.CK_SESSION_HANDLE(handle)
+	}
+	return C.CK_RV(rv)
+}
+
+//export C_CloseSession
+func C_CloseSession(hSession C.CK_SESSION_HANDLE) C.CK_RV {
+	s, rv := lockSession(hSession)
+	if rv != pkcs11.CKR_OK {
+		return rv
+	}
+	defer module.Unlock()
+	module.closeSession(s)
+	delete(module.sessions, uint(hSession))
+	return pkcs11.CKR_OK
+}
+
+//export C_CloseAllSessions
+func C_CloseAllSessions(slot C.CK_SLOT_ID) C.CK_RV {
+	if module == nil {
+		return pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED
+	}
+	module.Lock()
+	defer module.Unlock()
+	for handle, s := range module.sessions {
+		module.closeSession(s)
+		delete(module.sessions, handle)
+	}
+	return pkcs11.CKR_OK
+}
+
+//export C_GetSessionInfo
+func C_GetSessionInfo(hSession C.CK_SESSION_HANDLE, pInfo C.CK_SESSION_INFO_PTR) C.CK_RV {
+	s, rv := lockSession(hSession)
+	if rv != pkcs11.CKR_OK {
+		return rv
+	}
+	defer module.Unlock()
+	pInfo.slotID = slotID
+	pInfo.state = C.CKS_RO_PUBLIC_SESSION
+	if s.pin != "" {
+		pInfo.state = C.CKS_RO_USER_FUNCTIONS
+	}
+	pInfo.flags = pkcs11.CKF_SERIAL_SESSION
+	pInfo.ulDeviceError = 0
+	return pkcs11.CKR_OK
+}
+
+//export C_Login
+func C_Login(hSession C.CK_SESSION_HANDLE, userType C.CK_USER_TYPE, pPin C.CK_UTF8CHAR_PTR, ulPinLen C.CK_ULONG) C.CK_RV {
+	s, rv := lockSession(hSession)
+	if rv != pkcs11.CKR_OK {
+		return rv
+	}
+	defer module.Unlock()
+	if userType != C.CKU_USER {
+		return pkcs11.CKR_USER_TYPE_INVALID
+	}
+	if s.pin != "" {
+		return pkcs11.CKR_USER_ALREADY_LOGGED_IN
+	}
+	// the PIN is checked by the daemon with the first signature
+	s.pin = C.GoStringN((*C.char)(unsafe.Pointer(pPin)), C.int(ulPinLen))
+	return pkcs11.CKR_OK
+}
+
+//export C_Logout
+func C_Logout(hSession C.CK_SESSION_HANDLE) C.CK_RV {
+	s, rv := lockSession(hSession)
+	if rv != pkcs11.CKR_OK {
+		return rv
+	}
+	defer module.Unlock()
+	if s.pin == "" {
+		return pkcs11.CKR_USER_NOT_LOGGED_IN
+	}
+	s.pin = ""
+	return pkcs11.CKR_OK
+}
+
+//export C_GetAttributeValue
+func C_GetAttributeValue(hSession C.CK_SESSION_HANDLE, hObject C.CK_OBJECT_HANDLE, pTemplate C.CK_ATTRIBUTE_PTR, ulCount C.CK_ULONG) C.CK_RV {
+	s, rv := lockSession(hSession)
+	if rv != pkcs11.CKR_OK {
+		return rv
+	}
+	defer module.Unlock()
+	o, ok := s.object(uint(hObject))
+	if !ok {
+		return pkcs11.CKR_OBJECT_HANDLE_INVALID
+	}
+	if ulCount > maxTemplateLen {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+	template := (*[maxTemplateLen]C.CK_ATTRIBUTE)(unsafe.Pointer(pTemplate))[:ulCount:ulCount]
+	rv = pkcs11.CKR_OK
+	for i := range template {
+		attr := &template[i]
+		value, ok := o.attribute(uint(attr._type))
+		switch {
+		case !ok:
+			attr.ulValueLen = unavailable
+			rv = pkcs11.CKR_ATTRIBUTE_TYPE_INVALID
+		case attr.pValue == nil:
+			attr.ulValueLen = C.CK_ULONG(len(value))
+		case attr.ulValueLen < C.CK_ULONG(len(value)):
+			attr.ulValueLen = unavailable
+			rv = pkcs11.CKR_BUFFER_TOO_SMALL
+		default:
+			if len(value) > 0 {
+				C.memcpy(unsafe.Pointer(attr.pValue), unsafe.Pointer(&value[0]), C.size_t(len(value)))
+			}
+			attr.ulValueLen = C.CK_ULONG(len(value))
+		}
+	}
+	return rv
+}
+
+//export C_FindObjectsInit
+func C_FindObjectsInit(hSession C.CK_SESSION_HANDLE, pTemplate C.CK_ATTRIBUTE_PTR, ulCount C.CK_ULONG) C.CK_RV {
+	s, rv := lockSession(hSession)
+	if rv != pkcs11.CKR_OK {
+		return rv
+	}
+	defer module.Unlock()
+	if s.found != nil {
+		return pkcs11.CKR_OPERATION_ACTIVE
+	}
+	if ulCount > maxTemplateLen {
+		return pkcs11.CKR_ARGUMENTS_BAD
+	}
+	var template []attribute
+	if ulCount > 0 {
+		attrs := (*[maxTemplateLen]C.CK_ATTRIBUTE)(unsafe.Pointer(pTemplate))[:ulCount:ulCount]
+		for _, attr := range attrs {
+			template = append(template, attribute{
+				Type:  uint(attr._type),
+				Value: C.GoBytes(unsafe.Pointer(attr.pValue), C.int(attr.ulValueLen)),
+			})
+		}
+	}
+	s.found = []uint{}
+	s.findObjects(template)
+	return pkcs11.CKR_OK
+}
+
+//export C_FindObjects
+func C_FindObjects(hSession C.CK_SESSION_HANDLE, phObject C.CK_OBJECT_HANDLE_PTR, ulMaxObjectCount C.CK_ULONG, pulObjectCount C.CK_ULONG_PTR) C.CK_RV {
+	s, rv := lockSession(hSession)
+	if rv != pkcs11.CKR_OK {
+		return rv
+	}
+	defer module.Unlock()
+	if s.found == nil {
+		return pkcs11.CKR_OPERATION_NOT_INITIALIZED
+	}
+	if ulMaxObjectCount > maxObjectHandlesLen {
+		ulMaxObjectCount = maxObjectHandlesLen
+	}
+	n := len(s.found)
+	if C.CK_ULONG(n) > ulMaxObjectCount {
+		n = int(ulMaxObjectCount)
+	}
+	if n > 0 {
+		handles := (*[maxObjectHandlesLen]C.CK_OBJECT_HANDLE)(unsafe.Pointer(phObject))[:n:n]
+		for i := range handles {
+			handles[i] = C.CK_OBJECT_HANDLE(s.found[i])
+		}
+	}
+	s.found = s.found[n:]
+	*pulObjectCount = C.CK_ULONG(n)
+	return pkcs11.CKR_OK
+}
+
+//export C_FindObjectsFinal
+func C_FindObjectsFinal(hSession C.CK_SESSION_HANDLE) C.CK_RV {
+	s, rv := lockSession(hSession)
+	if rv != pkcs11.CKR_OK {
+		return rv
+	}
+	defer module.Unlock()
+	if s.found == nil {
+		return pkcs11.CKR_OPERATION_NOT_INITIALIZED
+	}
+	s.found = nil
+	return pkcs11.CKR_OK
+}
+
+//export C_SignInit
+func C_SignInit(hSession C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_PTR, hKey C.CK_OBJECT_HANDLE) C.CK_RV {
+	s, rv := lockSession(hSession)
+	if rv != pkcs11.CKR_OK {
+		return rv
+	}
+	defer module.Unlock()
+	if s.signKey != nil {
+		return pkcs11.CKR_OPERATION_ACTIVE
+	}
+	if _, ok := signMechanisms[uint(pMechanism.mechanism)]; !ok {
+		return pkcs11.CKR_MECHANISM_INVALID
+	}
+	o, ok := s.object(uint(hKey))
+	if !ok {
+		return pkcs11.CKR_KEY_HANDLE_INVALID
+	}
+	if o.class != pkcs11.CKO_PRIVATE_KEY {
+		return pkcs11.CKR_KEY_FUNCTION_NOT_PERMITTED
+	}
+	s.signKey, s.signMech, s.signData = o, uint(pMechanism.mechanism), nil
+	return pkcs11.CKR_OK
+}
+
+// finishSign signs the data collected by C_Sign or C_SignUpdate. Asking for
+// the length only keeps the operation active, as PKCS#11 requires
+func finishSign(s *session, data []byte, pSignature C.CK_BYTE_PTR, pulSignatureLen C.CK_ULONG_PTR) C.CK_RV {
+	if pSignature == nil {
+		*pulSignatureLen = signatureLen
+		return pkcs11.CKR_OK
+	}
+	if *pulSignatureLen < signatureLen {
+		*pulSignatureLen = signatureLen
+		return pkcs11.CKR_BUFFER_TOO_SMALL
+	}
+	sig, rv := module.sign(s, data)
+	s.signKey, s.signData = nil, nil
+	if rv != pkcs11.CKR_OK {
+		return C.CK_RV(rv)
+	}
+	if len(sig) == 0 || C.CK_ULONG(len(sig)) > *pulSignatureLen {
+		return pkcs11.CKR_DEVICE_ERROR
+	}
+	C.memcpy(unsafe.Pointer(pSignature), unsafe.Pointer(&sig[0]), C.size_t(len(sig)))
+	*pulSignatureLen = C.CK_ULONG(len(sig))
+	return pkcs11.CKR_OK
+}
+
+//export C_Sign
+func C_Sign(hSession C.CK_SESSION_HANDLE, pData C.CK_BYTE_PTR, ulDataLen C.CK_ULONG, pSignature C.CK_BYTE_PTR, pulSignatureLen C.CK_ULONG_PTR) C.CK_RV {
+	s, rv := lockSession(hSession)
+	if rv != pkcs11.CKR_OK {
+		return rv
+	}
+	defer module.Unlock()
+	if s.signKey == nil {
+		return pkcs11.CKR_OPERATION_NOT_INITIALIZED
+	}
+	return finishSign(s, C.GoBytes(unsafe.Pointer(pData), C.int(ulDataLen)), pSignature, pulSignatureLen)
+}
+
+//export C_SignUpdate
+func C_SignUpdate(hSession C.CK_SESSION_HANDLE, pPart C.CK_BYTE_PTR, ulPartLen C.CK_ULONG) C.CK_RV {
+	s, rv := lockSession(hSession)
+	if rv != pkcs11.CKR_OK {
+		return rv
+	}
+	defer module.Unlock()
+	if s.signKey == nil {
+		return pkcs11.CKR_OPERATION_NOT_INITIALIZED
+	}
+	s.signData = append(s.signData, C.GoBytes(unsafe.Pointer(pPart), C.int(ulPartLen))...)
+	return pkcs11.CKR_OK
+}
+
+//export C_SignFinal
+func C_SignFinal(hSession C.CK_SESSION_HANDLE, pSignature C.CK_BYTE_PTR, pulSignatureLen C.CK_ULONG_PTR) C.CK_RV {
+	s, rv := lockSession(hSession)
+	if rv != pkcs11.CKR_OK {
+		return rv
+	}
+	defer module.Unlock()
+	if s.signKey == nil {
+		return pkcs11.CKR_OPERATION_NOT_INITIALIZED
+	}
+	return finishSign(s, s.signData, pSignature, pulSignatureLen)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"strconv"
+	"unsafe"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/miekg/pkcs11"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// oidP256 is the DER encoded CKA_EC_PARAMS of the keys, the namedCurve prime256v1
+var oidP256 = []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+
+// nativeEndian is the byte order CK_ULONG attribute values are stored in
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// ulongValue encodes v as CK_ULONG, which is assumed to be as wide as uint
+func ulongValue(v uint) []byte {
+	b := make([]byte, strconv.IntSize/8)
+	if strconv.IntSize == 64 {
+		nativeEndian.PutUint64(b, uint64(v))
+	} else {
+		nativeEndian.PutUint32(b, uint32(v))
+	}
+	return b
+}
+
+func boolValue(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// attribute is an attribute of a search template
+type attribute struct {
+	Type  uint
+	Value []byte
+}
+
+// object is a key as seen by PKCS#11 applications. Every key of the daemon
+// is offered as private key, which signs through the daemon, and public key
+type object struct {
+	handle uint
+	class  uint
+	keyID  string
+	slot   common.HardwareSlot
+	// ecPoint is the DER encoded uncompressed point of the public key
+	ecPoint []byte
+}
+
+// keyObjects returns the private and the public key object of a key, the
+// handles are first and first+1
+func keyObjects(first uint, keyID string, slot common.HardwareSlot, pemBytes []byte) ([]object, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded public key for %s", keyID)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok || ecPub.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("key %s is no P-256 key", keyID)
+	}
+	point, err := asn1.Marshal(elliptic.Marshal(ecPub.Curve, ecPub.X, ecPub.Y))
+	if err != nil {
+		return nil, err
+	}
+	return []object{
+		{handle: first, class: pkcs11.CKO_PRIVATE_KEY, keyID: keyID, slot: slot, ecPoint: point},
+		{handle: first + 1, class: pkcs11.CKO_PUBLIC_KEY, keyID: keyID, slot: slot, ecPoint: point},
+	}, nil
+}
+
+// attribute returns the value of an attribute of o. Private keys are not
+// marked CKA_PRIVATE, they can be found without C_Login as the daemon may
+// supply the PIN itself
+func (o object) attribute(typ uint) ([]byte, bool) {
+	private := o.class == pkcs11.CKO_PRIVATE_KEY
+	switch typ {
+	case pkcs11.CKA_CLASS:
+		return ulongValue(o.class), true
+	case pkcs11.CKA_KEY_TYPE:
+		return ulongValue(pkcs11.CKK_EC), true
+	case pkcs11.CKA_TOKEN:
+		return boolValue(true), true
+	case pkcs11.CKA_PRIVATE, pkcs11.CKA_MODIFIABLE, pkcs11.CKA_EXTRACTABLE, pkcs11.CKA_ALWAYS_AUTHENTICATE:
+		return boolValue(false), true
+	case pkcs11.CKA_ID:
+		return o.slot.SlotID, true
+	case pkcs11.CKA_LABEL:
+		return []byte(o.slot.Role.String() + " " + o.keyID), true
+	case pkcs11.CKA_EC_PARAMS:
+		return oidP256, true
+	case pkcs11.CKA_EC_POINT:
+		return o.ecPoint, true
+	case pkcs11.CKA_SIGN, pkcs11.CKA_SENSITIVE, pkcs11.CKA_NEVER_EXTRACTABLE:
+		return boolValue(private), true
+	case pkcs11.CKA_VERIFY:
+		return boolValue(!private), true
+	case pkcs11.CKA_DECRYPT, pkcs11.CKA_ENCRYPT, pkcs11.CKA_WRAP, pkcs11.CKA_UNWRAP, pkcs11.CKA_DERIVE:
+		return boolValue(false), true
+	}
+	return nil, false
+}
+
+// matches returns whether o has all attributes of template
+func (o object) matches(template []attribute) bool {
+	for _, attr := range template {
+		value, ok := o.attribute(attr.Type)
+		if !ok || !bytes.Equal(value, attr.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// signMechanisms maps the supported mechanisms onto the digest the daemon
+// applies, CKM_ECDSA signs a digest computed by the application
+var signMechanisms = map[uint]string{
+	pkcs11.CKM_ECDSA:        "",
+	pkcs11.CKM_ECDSA_SHA256: yubikey.DigestSHA256,
+	pkcs11.CKM_ECDSA_SHA384: yubikey.DigestSHA384,
+	pkcs11.CKM_ECDSA_SHA512: yubikey.DigestSHA512,
+}
+
+// prehashedDigest returns the digest algorithm of a digest passed to CKM_ECDSA
+func prehashedDigest(digest []byte) (string, bool) {
+	switch len(digest) {
+	case 32:
+		return yubikey.DigestSHA256, true
+	case 48:
+		return yubikey.DigestSHA384, true
+	case 64:
+		return yubikey.DigestSHA512, true
+	}
+	return "", false
+}
+
+// returnValues maps the error codes of the daemon onto CK_RV
+var returnValues = map[yubikey.ErrorCode]uint{
+	yubikey.ErrCodeNoToken:        pkcs11.CKR_TOKEN_NOT_PRESENT,
+	yubikey.ErrCodeWrongPin:       pkcs11.CKR_PIN_INCORRECT,
+	yubikey.ErrCodePinLocked:      pkcs11.CKR_PIN_LOCKED,
+	yubikey.ErrCodeTouchTimeout:   pkcs11.CKR_FUNCTION_CANCELED,
+	yubikey.ErrCodeKeyNotFound:    pkcs11.CKR_KEY_HANDLE_INVALID,
+	yubikey.ErrCodeInvalidRequest: pkcs11.CKR_ARGUMENTS_BAD,
+	yubikey.ErrCodePolicyDenied:   pkcs11.CKR_FUNCTION_REJECTED,
+	yubikey.ErrCodeMaintenance:    pkcs11.CKR_FUNCTION_REJECTED,
+}
+
+// returnValue classifies an error of the daemon
+func returnValue(err error) uint {
+	if err == nil {
+		return pkcs11.CKR_OK
+	}
+	if rv, ok := returnValues[yubikey.ErrorCodeOf(err)]; ok {
+		return rv
+	}
+	return pkcs11.CKR_DEVICE_ERROR
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"github.com/jschintag/notary-yubikey-adapter/yubikey"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+func TestKeyObjects(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	slot := common.HardwareSlot{Role: "targets", SlotID: []byte{0x9c}}
+	objects, err := keyObjects(3, "abc", slot, pemBytes)
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	require.Equal(t, uint(3), objects[0].handle)
+	require.Equal(t, uint(4), objects[1].handle)
+
+	private := []attribute{
+		{pkcs11.CKA_CLASS, ulongValue(pkcs11.CKO_PRIVATE_KEY)},
+		{pkcs11.CKA_ID, []byte{0x9c}},
+	}
+	require.True(t, objects[0].matches(private))
+	require.False(t, objects[1].matches(private))
+	require.True(t, objects[1].matches([]attribute{{pkcs11.CKA_VERIFY, boolValue(true)}}))
+	require.False(t, objects[0].matches([]attribute{{pkcs11.CKA_VALUE, nil}}))
+
+	point, ok := objects[1].attribute(pkcs11.CKA_EC_POINT)
+	require.True(t, ok)
+	// DER OCTET STRING holding the uncompressed point
+	require.Equal(t, []byte{0x04, 65, 0x04}, point[:3])
+	label, _ := objects[0].attribute(pkcs11.CKA_LABEL)
+	require.Equal(t, "targets abc", string(label))
+}
+
+func TestPrehashedDigest(t *testing.T) {
+	alg, ok := prehashedDigest(make([]byte, 32))
+	require.True(t, ok)
+	require.Equal(t, yubikey.DigestSHA256, alg)
+	_, ok = prehashedDigest(make([]byte, 20))
+	require.False(t, ok)
+}
+
+func TestReturnValue(t *testing.T) {
+	require.Equal(t, uint(pkcs11.CKR_OK), returnValue(nil))
+	// the daemon's errors arrive as plain rpc errors
+	require.Equal(t, uint(pkcs11.CKR_PIN_INCORRECT), returnValue(errors.New("[WRONG_PIN] wrong PIN")))
+	require.Equal(t, uint(pkcs11.CKR_FUNCTION_REJECTED), returnValue(errors.New("[POLICY_DENIED] no")))
+	require.Equal(t, uint(pkcs11.CKR_DEVICE_ERROR), returnValue(errors.New("boom")))
+}
@@ -0,0 +1,195 @@
+// Command pkcs11provider is a PKCS#11 module forwarding to the daemon of
+// the adapter, so tools which only speak PKCS#11, e.g. openssl or java
+// keytool, sign with the policy, audit and PIN handling of the daemon
+// instead of talking to ykcs11 directly. It is built as shared library:
+//
+//	go build -tags pkcs11 -buildmode=c-shared -o libnotary-yubikey.so ./pkcs11provider
+//
+// The module offers a single slot, its token holds the keys the daemon
+// lists. The PIN given to C_Login is sent along with every signature,
+// without it the daemon uses its configured secret source.
+package main
+
+import (
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/miekg/pkcs11"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// socketPath is where the daemon listens, NOTARY_YK_SOCKET_DIR moves it
+// just like for the daemon
+func socketPath() string {
+	dir := "/var/run/notary"
+	if d, ok := os.LookupEnv("NOTARY_YK_SOCKET_DIR"); ok {
+		dir = d
+	}
+	return filepath.Join(dir, "hardwarestore.sock")
+}
+
+// The requests below mirror the extended ones of the daemon, gob matches
+// the fields by name
+
+type signReq struct {
+	Session           uint
+	Slot              common.HardwareSlot
+	Pass              string
+	Payload           []byte
+	DigestAlgorithm   string
+	Prehashed         bool
+	SignatureEncoding string
+}
+
+type listKeysReq struct {
+	Session uint
+}
+
+type listKeysRes struct {
+	Keys map[string]common.HardwareSlot
+}
+
+type publicKeyReq struct {
+	Session uint
+	KeyID   string
+}
+
+type publicKeyRes struct {
+	Slot common.HardwareSlot
+	PEM  []byte
+}
+
+// session is a PKCS#11 session, backed by a session of the daemon
+type session struct {
+	daemon  uint
+	pin     string
+	objects []object
+	// found are the handles of the running C_FindObjects search
+	found []uint
+	// signKey, signMech and signData belong to the running signature
+	signKey  *object
+	signMech uint
+	signData []byte
+}
+
+// provider is the state of the module between C_Initialize and C_Finalize
+type provider struct {
+	sync.Mutex
+	client   *rpc.Client
+	sessions map[uint]*session
+	next     uint
+}
+
+var module *provider
+
+// call sends a request to the daemon, connecting again if the connection
+// was lost, e.g. because the daemon restarted
+func (p *provider) call(method string, req, res interface{}) error {
+	if p.client == nil {
+		client, err := wire.Dial("unix", socketPath())
+		if err != nil {
+			return err
+		}
+		p.client = client
+	}
+	err := p.client.Call(method, req, res)
+	if err == rpc.ErrShutdown {
+		p.client.Close()
+		p.client = nil
+	}
+	return err
+}
+
+// openSession opens a session of the daemon and loads the keys it lists
+func (p *provider) openSession() (uint, uint) {
+	setup := new(wire.ESSetupHSMEnvRes)
+	if err := p.call("ESServer.SetupHSMEnv", wire.ESSetupHSMEnvReq{}, setup); err != nil {
+		return 0, returnValue(err)
+	}
+	s := &session{daemon: setup.Session}
+	if err := p.loadObjects(s); err != nil {
+		p.closeSession(s)
+		return 0, returnValue(err)
+	}
+	p.next++
+	p.sessions[p.next] = s
+	return p.next, pkcs11.CKR_OK
+}
+
+func (p *provider) loadObjects(s *session) error {
+	keys := new(listKeysRes)
+	if err := p.call("ESServer.HardwareListKeys", listKeysReq{Session: s.daemon}, keys); err != nil {
+		return err
+	}
+	keyIDs := make([]string, 0, len(keys.Keys))
+	for keyID := range keys.Keys {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Strings(keyIDs)
+	for _, keyID := range keyIDs {
+		pub := new(publicKeyRes)
+		if err := p.call("ESServer.GetPublicKey", publicKeyReq{Session: s.daemon, KeyID: keyID}, pub); err != nil {
+			return err
+		}
+		objects, err := keyObjects(uint(len(s.objects)+1), keyID, pub.Slot, pub.PEM)
+		if err != nil {
+			// keys of other curves can not be offered, the others still can
+			continue
+		}
+		s.objects = append(s.objects, objects...)
+	}
+	return nil
+}
+
+func (p *provider) closeSession(s *session) {
+	p.call("ESServer.Cleanup", wire.ESCleanupReq{Session: s.daemon}, new(wire.ESCleanupReq))
+}
+
+// object returns the object of s with handle
+func (s *session) object(handle uint) (*object, bool) {
+	if handle == 0 || handle > uint(len(s.objects)) {
+		return nil, false
+	}
+	return &s.objects[handle-1], true
+}
+
+// findObjects starts a search for the objects matching template
+func (s *session) findObjects(template []attribute) {
+	s.found = s.found[:0]
+	for _, o := range s.objects {
+		if o.matches(template) {
+			s.found = append(s.found, o.handle)
+		}
+	}
+}
+
+// sign asks the daemon to sign data with the key and mechanism of the
+// running signature, the signature is raw r||s as PKCS#11 defines it
+func (p *provider) sign(s *session, data []byte) ([]byte, uint) {
+	req := signReq{
+		Session:           s.daemon,
+		Slot:              s.signKey.slot,
+		Pass:              s.pin,
+		Payload:           data,
+		DigestAlgorithm:   signMechanisms[s.signMech],
+		SignatureEncoding: "raw",
+	}
+	if s.signMech == pkcs11.CKM_ECDSA {
+		var ok bool
+		if req.DigestAlgorithm, ok = prehashedDigest(data); !ok {
+			return nil, pkcs11.CKR_DATA_LEN_RANGE
+		}
+		req.Prehashed = true
+	}
+	res := new(wire.ESSignRes)
+	if err := p.call("ESServer.Sign", req, res); err != nil {
+		return nil, returnValue(err)
+	}
+	return res.Result, pkcs11.CKR_OK
+}
+
+func main() {}
@@ -0,0 +1,75 @@
+package wire
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"net"
+	"net/rpc"
+	"reflect"
+)
+
+// clientCodec is the gob codec of net/rpc, which stamps the requests with
+// ProtocolVersion
+type clientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+// NewClient returns a client for the daemon on conn whose requests carry
+// ProtocolVersion
+func NewClient(conn io.ReadWriteCloser) *rpc.Client {
+	buf := bufio.NewWriter(conn)
+	return rpc.NewClientWithCodec(&clientCodec{rwc: conn, dec: gob.NewDecoder(conn), enc: gob.NewEncoder(buf), encBuf: buf})
+}
+
+// Dial connects to the daemon listening on address
+func Dial(network, address string) (*rpc.Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// versioned returns body with its version set. Requests are usually passed
+// by value, those are copied
+func versioned(body interface{}) interface{} {
+	if body == nil {
+		return nil
+	}
+	v, ok := body.(Versioned)
+	if !ok {
+		ptr := reflect.New(reflect.TypeOf(body))
+		ptr.Elem().Set(reflect.ValueOf(body))
+		if v, ok = ptr.Interface().(Versioned); !ok {
+			return body
+		}
+	}
+	v.SetProtocol(ProtocolVersion)
+	return v
+}
+
+func (c *clientCodec) WriteRequest(r *rpc.Request, body interface{}) (err error) {
+	if err = c.enc.Encode(r); err != nil {
+		return
+	}
+	if err = c.enc.Encode(versioned(body)); err != nil {
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *clientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *clientCodec) Close() error {
+	return c.rwc.Close()
+}
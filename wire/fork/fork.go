@@ -0,0 +1,66 @@
+// Package fork translates the types of package wire to and from the ones of
+// the jschintag/notary fork, for clients built against it. Its functions
+// match the ones of wire/upstream
+package fork
+
+import (
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/jschintag/notary/trustmanager/pkcs11/common"
+	"github.com/jschintag/notary/tuf/data"
+)
+
+// Slot converts a notary slot to its wire form
+func Slot(slot common.HardwareSlot) wire.HardwareSlot {
+	return wire.HardwareSlot{Role: slot.Role.String(), SlotID: slot.SlotID, KeyID: slot.KeyID}
+}
+
+// CommonSlot converts a slot received over the wire
+func CommonSlot(slot wire.HardwareSlot) common.HardwareSlot {
+	return common.HardwareSlot{Role: data.RoleName(slot.Role), SlotID: slot.SlotID, KeyID: slot.KeyID}
+}
+
+// Slots converts the slots of a key listing to their wire form
+func Slots(slots map[string]common.HardwareSlot) map[string]wire.HardwareSlot {
+	if slots == nil {
+		return nil
+	}
+	res := make(map[string]wire.HardwareSlot, len(slots))
+	for keyID, slot := range slots {
+		res[keyID] = Slot(slot)
+	}
+	return res
+}
+
+// CommonSlots converts the slots of a key listing received over the wire
+func CommonSlots(slots map[string]wire.HardwareSlot) map[string]common.HardwareSlot {
+	if slots == nil {
+		return nil
+	}
+	res := make(map[string]common.HardwareSlot, len(slots))
+	for keyID, slot := range slots {
+		res[keyID] = CommonSlot(slot)
+	}
+	return res
+}
+
+// NewPublicKey converts a public key to its wire form
+func NewPublicKey(pubKey data.PublicKey) wire.ESPublicKey {
+	return wire.ESPublicKey{Public: pubKey.Public(), Algorithm: pubKey.Algorithm()}
+}
+
+// PublicKey converts a public key received over the wire
+func PublicKey(pubKey wire.ESPublicKey) data.PublicKey {
+	return data.NewPublicKey(pubKey.Algorithm, pubKey.Public)
+}
+
+// NewPrivateKey converts a private key to its wire form, which shares the
+// bytes of privKey
+func NewPrivateKey(privKey data.PrivateKey) wire.ESPrivateKey {
+	return wire.ESPrivateKey{Public: privKey.Public(), Algorithm: privKey.Algorithm(), Private: privKey.Private()}
+}
+
+// PrivateKey converts a private key received over the wire, the result shares
+// the bytes of privKey
+func PrivateKey(privKey wire.ESPrivateKey) (data.PrivateKey, error) {
+	return data.NewPrivateKey(PublicKey(wire.ESPublicKey{Public: privKey.Public, Algorithm: privKey.Algorithm}), privKey.Private)
+}
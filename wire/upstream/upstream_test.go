@@ -0,0 +1,56 @@
+// +build pkcs11
+
+package upstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"testing"
+
+	"github.com/jschintag/notary-yubikey-adapter/wire"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/externalstore"
+	"github.com/theupdateframework/notary/tuf/data"
+	"github.com/theupdateframework/notary/tuf/utils"
+)
+
+// recode sends in through gob and decodes it into out, like net/rpc does
+// between a client and the daemon
+func recode(t *testing.T, in, out interface{}) {
+	var buf bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&buf).Encode(in))
+	require.NoError(t, gob.NewDecoder(&buf).Decode(out))
+}
+
+func TestExternalstoreCompatibility(t *testing.T) {
+	privKey, err := utils.GenerateECDSAKey(rand.Reader)
+	require.NoError(t, err)
+	slot := common.HardwareSlot{Role: data.CanonicalRootRole, SlotID: []byte{2}, KeyID: privKey.ID()}
+
+	var add wire.ESAddECDSAKeyReq
+	recode(t, externalstore.ESAddECDSAKeyReq{Session: 3, PrivateKey: externalstore.NewESPrivateKey(privKey), Slot: slot, Pass: "pin", Role: data.CanonicalRootRole}, &add)
+	require.Equal(t, uint(3), add.Session)
+	require.Equal(t, Slot(slot), add.Slot)
+	require.Equal(t, "root", add.Role)
+	require.Equal(t, slot, CommonSlot(add.Slot))
+	received, err := PrivateKey(add.PrivateKey)
+	require.NoError(t, err)
+	require.Equal(t, privKey.ID(), received.ID())
+	require.Equal(t, privKey.Private(), received.Private())
+
+	var list externalstore.ESHardwareListKeysRes
+	recode(t, wire.ESHardwareListKeysRes{Keys: Slots(map[string]common.HardwareSlot{privKey.ID(): slot})}, &list)
+	require.Equal(t, map[string]common.HardwareSlot{privKey.ID(): slot}, list.Keys)
+	require.Equal(t, list.Keys, CommonSlots(Slots(list.Keys)))
+
+	var get externalstore.ESGetECDSAKeyRes
+	recode(t, wire.ESGetECDSAKeyRes{PublicKey: NewPublicKey(data.PublicKeyFromPrivate(privKey)), Role: "root"}, &get)
+	require.Equal(t, data.CanonicalRootRole, get.Role)
+	require.Equal(t, privKey.ID(), externalstore.ESPublicKeyToPublicKey(get.PublicKey).ID())
+
+	var needLogin wire.ESNeedLoginReq
+	recode(t, externalstore.ESNeedLoginReq{Function_ID: externalstore.FUNCTION_SIGN}, &needLogin)
+	require.Equal(t, uint(wire.FunctionSign), needLogin.Function_ID)
+}
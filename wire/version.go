@@ -0,0 +1,32 @@
+package wire
+
+// ProtocolVersion is the version of the protocol described by this package.
+// Version 0 is plain externalstore, whose clients send no version. Version 1
+// adds the version itself and the fields and RPCs of the adapter. New
+// versions only add fields, a daemon serves requests of older versions and
+// ignores the fields of newer ones, which clients guard with a feature of
+// ESServer.Negotiate
+const ProtocolVersion = 1
+
+// Version is embedded into every request and response. Requests carry the
+// version of the client and responses the one of the daemon, so either side
+// knows which fields the other one understood
+type Version struct {
+	ProtocolVersion uint
+}
+
+// Protocol returns the version of the sender, 0 if it predates versioning
+func (v Version) Protocol() uint {
+	return v.ProtocolVersion
+}
+
+// SetProtocol sets the version of the sender
+func (v *Version) SetProtocol(version uint) {
+	v.ProtocolVersion = version
+}
+
+// Versioned is implemented by the pointers to the types embedding Version
+type Versioned interface {
+	Protocol() uint
+	SetProtocol(version uint)
+}
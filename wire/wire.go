@@ -0,0 +1,148 @@
+// Package wire defines the requests and responses the daemon exchanges with
+// notary over net/rpc. They mirror the types of notary's externalstore
+// package field by field, gob matches struct fields by name and encodes
+// named strings as plain strings, so clients built against either
+// theupdateframework/notary or a fork carrying externalstore are understood.
+// The package depends on no notary variant, wire/upstream and wire/fork
+// translate between its types and the ones of the respective variant.
+package wire
+
+// The function IDs of ESNeedLoginReq
+const (
+	FunctionAddECDSAKey       = 1
+	FunctionGetECDSAKey       = 2
+	FunctionSign              = 3
+	FunctionHardwareRemoveKey = 4
+)
+
+// HardwareSlot mirrors common.HardwareSlot, it identifies where a key is
+// stored on the token
+type HardwareSlot struct {
+	Role   string
+	SlotID []byte
+	KeyID  string
+}
+
+// ESPublicKey holds a public key as data.PublicKey stores it
+type ESPublicKey struct {
+	Public    []byte
+	Algorithm string
+}
+
+// ESPrivateKey holds a private key as data.PrivateKey stores it
+type ESPrivateKey struct {
+	Public    []byte
+	Algorithm string
+	Private   []byte
+}
+
+type ESNameReq struct {
+	Version
+}
+
+type ESNameRes struct {
+	Version
+	Name string
+}
+
+type ESAddECDSAKeyReq struct {
+	Version
+	Session    uint
+	PrivateKey ESPrivateKey
+	Slot       HardwareSlot
+	Pass       string
+	Role       string
+}
+
+type ESAddECDSAKeyRes struct {
+	Version
+}
+
+type ESGetECDSAKeyReq struct {
+	Version
+	Session uint
+	Slot    HardwareSlot
+	Pass    string
+}
+
+type ESGetECDSAKeyRes struct {
+	Version
+	PublicKey ESPublicKey
+	Role      string
+}
+
+type ESSignReq struct {
+	Version
+	Session uint
+	Slot    HardwareSlot
+	Pass    string
+	Payload []byte
+}
+
+type ESSignRes struct {
+	Version
+	Result []byte
+}
+
+type ESHardwareRemoveKeyReq struct {
+	Version
+	Session uint
+	Slot    HardwareSlot
+	Pass    string
+	KeyID   string
+}
+
+type ESHardwareRemoveKeyRes struct {
+	Version
+}
+
+type ESHardwareListKeysReq struct {
+	Version
+	Session uint
+}
+
+type ESHardwareListKeysRes struct {
+	Version
+	Keys map[string]HardwareSlot
+}
+
+type ESGetNextEmptySlotReq struct {
+	Version
+	Session uint
+}
+
+type ESGetNextEmptySlotRes struct {
+	Version
+	Slot []byte
+}
+
+type ESSetupHSMEnvReq struct {
+	Version
+}
+
+type ESSetupHSMEnvRes struct {
+	Version
+	Session uint
+}
+
+type ESCleanupReq struct {
+	Version
+	Session uint
+}
+
+type ESCleanupRes struct {
+	Version
+}
+
+type ESNeedLoginReq struct {
+	Version
+	// Function_ID is one of the Function constants, it keeps the name of
+	// externalstore since gob matches fields by name
+	Function_ID uint
+}
+
+type ESNeedLoginRes struct {
+	Version
+	NeedLogin bool
+	UserFlag  uint
+}
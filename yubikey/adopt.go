@@ -0,0 +1,64 @@
+package yubikey
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/tuf/data"
+	"github.com/theupdateframework/notary/tuf/utils"
+)
+
+// AdoptKey makes a key which was generated or imported outside of notary,
+// e.g. with yubico-piv-tool, usable for role. The role is stored in the
+// certificate of the slot, so the certificate is replaced by a self-signed
+// one for role, valid for validity. The key itself is not touched. It
+// returns the notary key ID and the DER encoded certificate it replaced
+func (ks *KeyStore) AdoptKey(session pkcs11.SessionHandle, slotID []byte, role data.RoleName, passwd, managementKey string, validity time.Duration) (string, []byte, error) {
+	if err := ks.checkNotReserved(slotID); err != nil {
+		return "", nil, err
+	}
+	if !data.ValidRole(role) {
+		return "", nil, NewError(ErrCodeInvalidRequest, "%q is no notary role", role)
+	}
+	if len(slotID) == 1 && ks.mapped[slotID[0]].Role != "" {
+		return "", nil, NewError(ErrCodePolicyDenied, "slot %s is mapped to role %s in the config, its certificate is managed outside of notary", SlotName(slotID), ks.mapped[slotID[0]].Role)
+	}
+	oldCert, oldObj, err := slotCertificate(session, slotID)
+	if err != nil {
+		return "", nil, WrapError(ErrCodeKeyNotFound, err)
+	}
+	if current := data.RoleName(oldCert.Subject.CommonName); data.ValidRole(current) {
+		return "", nil, NewError(ErrCodeSlotOccupied, "slot %s already holds a notary key for role %s", SlotName(slotID), current)
+	}
+	pub, ok := oldCert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || pub.Curve != elliptic.P256() {
+		return "", nil, NewError(ErrCodeInvalidRequest, "the key in slot %s is no ECDSA P-256 key, notary can not use it", SlotName(slotID))
+	}
+
+	template, err := utils.NewCertificate(role.String(), oldCert.NotBefore, time.Now().Add(validity))
+	if err != nil {
+		return "", nil, NewError(ErrCodeInvalidRequest, "failed to create the certificate template: %v", err)
+	}
+	hwslot := common.HardwareSlot{Role: role, SlotID: slotID}
+	signer := &tokenSigner{ks: ks, session: session, hwslot: hwslot, passwd: passwd, pub: pub}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, pub, signer)
+	if err != nil {
+		return "", nil, WrapError(ErrCodeUnknown, err)
+	}
+	if err := storeCertificate(session, slotID, managementKey, oldCert, oldObj, certBytes); err != nil {
+		return "", nil, err
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", nil, WrapError(ErrCodeUnknown, err)
+	}
+	keyID := data.NewECDSAPublicKey(pubBytes).ID()
+	logrus.Infof("Adopted key %s in slot %s for role %s, its former certificate was issued to %q", keyID, SlotName(slotID), role, oldCert.Subject.CommonName)
+	return keyID, oldCert.Raw, nil
+}
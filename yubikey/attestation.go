@@ -0,0 +1,151 @@
+package yubikey
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/asn1"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+// Yubico marks attestation certificates with extensions below this arc,
+// e.g. 1.3.6.1.4.1.41482.3.3 holds the firmware version
+var oidYubicoAttestation = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3}
+
+// AttestKeys checks which of the given keys were generated on the yubikey.
+// A key counts as attested if the token holds a Yubico attestation
+// certificate for its public key, which is signed by the attestation
+// certificate of the token, whose chain ends in a Yubico CA or the
+// configured attestation roots. Keys that were imported have no attestation.
+// The result maps key IDs to whether they are attested.
+func (ks *KeyStore) AttestKeys(session pkcs11.SessionHandle, keyIDs []string) (map[string]bool, error) {
+	attested := make(map[string]bool)
+	for _, keyID := range keyIDs {
+		attested[keyID] = false
+	}
+
+	certs, err := ks.listCertificates(session)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range ks.attestations(certs) {
+		pub, ok := a.cert.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			continue
+		}
+		pubBytes, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			continue
+		}
+		keyID := data.NewECDSAPublicKey(pubBytes).ID()
+		if _, ok := attested[keyID]; !ok {
+			continue
+		}
+		attested[keyID] = a.issuer != nil
+		if !attested[keyID] {
+			logrus.Warnf("Attestation certificate for key %s does not verify", keyID)
+		}
+	}
+	return attested, nil
+}
+
+// Attestation returns the attestation certificates of the keys generated on
+// the yubikey and the certificate of its attestation key, which issued them.
+// Only certificates which verify against the attestation key and its chain
+// are returned
+func (ks *KeyStore) Attestation(session pkcs11.SessionHandle) (backend.Attestation, error) {
+	var result backend.Attestation
+	certs, err := ks.listCertificates(session)
+	if err != nil {
+		return result, err
+	}
+	for _, a := range ks.attestations(certs) {
+		if a.issuer == nil {
+			continue
+		}
+		if result.Device == nil {
+			result.Device = a.issuer.Raw
+		} else if !bytes.Equal(result.Device, a.issuer.Raw) {
+			logrus.Warnf("Ignoring the attestation of %s, it is issued by %s instead of the attestation key", a.cert.Subject.CommonName, a.issuer.Subject.CommonName)
+			continue
+		}
+		result.Keys = append(result.Keys, a.cert.Raw)
+	}
+	return result, nil
+}
+
+// attestation is an attestation certificate, issuer is the certificate of
+// the attestation key on the token which signed it, if its chain verifies
+type attestation struct {
+	cert, issuer *x509.Certificate
+}
+
+// attestations returns the attestation certificates among certs. The
+// certificate of the attestation key can be overwritten, so it only counts
+// as issuer if it is issued by one of the attestation roots
+func (ks *KeyStore) attestations(certs []*x509.Certificate) []attestation {
+	roots := ks.attestationRoots
+	if roots == nil {
+		roots = YubicoRoots()
+	}
+	var found []attestation
+	for _, cert := range certs {
+		if !isAttestationCert(cert) {
+			continue
+		}
+		a := attestation{cert: cert}
+		for _, issuer := range certs {
+			if !bytes.Equal(cert.RawIssuer, issuer.RawSubject) || cert.CheckSignatureFrom(attestationCA(issuer)) != nil {
+				continue
+			}
+			if err := VerifyAttestation(issuer, cert, roots); err != nil {
+				logrus.Warnf("The attestation key %s is not issued by an attestation root: %v", issuer.Subject.CommonName, err)
+				break
+			}
+			a.issuer = issuer
+			break
+		}
+		found = append(found, a)
+	}
+	return found
+}
+
+// isAttestationCert reports whether cert carries Yubico attestation extensions
+func isAttestationCert(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if len(ext.Id) > len(oidYubicoAttestation) && ext.Id[:len(oidYubicoAttestation)].Equal(oidYubicoAttestation) {
+			return true
+		}
+	}
+	return false
+}
+
+// listCertificates returns all parseable certificates on the token
+func (ks *KeyStore) listCertificates(session pkcs11.SessionHandle) ([]*x509.Certificate, error) {
+	objs, err := ks.listObjects(session)
+	if err != nil {
+		return nil, err
+	}
+	attrTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, []byte{0}),
+	}
+	var certs []*x509.Certificate
+	for _, obj := range objs {
+		attr, err := pkcs11Ctx.GetAttributeValue(session, obj, attrTemplate)
+		if err != nil || len(attr) != 1 {
+			logrus.Debugf("Failed to get Attribute for: %v", obj)
+			continue
+		}
+		cert, err := x509.ParseCertificate(attr[0].Value)
+		if err != nil {
+			continue
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
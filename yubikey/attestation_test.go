@@ -0,0 +1,67 @@
+package yubikey
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newAttestationCert(t *testing.T, cn string, key, signer *ecdsa.PrivateKey, issuer *x509.Certificate, ca bool) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: ca,
+		IsCA:                  ca,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtraExtensions:       []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 3}, Value: []byte{5, 2, 7}}},
+	}
+	if issuer == nil {
+		issuer = tmpl
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &key.PublicKey, signer)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestAttestationChain(t *testing.T) {
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		return key
+	}
+	rootKey, deviceKey, slotKey := newKey(), newKey(), newKey()
+	root := newAttestationCert(t, "Test PIV Root CA", rootKey, rootKey, nil, true)
+	// like on older firmwares the device certificate has no basic constraints
+	device := newAttestationCert(t, "Yubico PIV Attestation", deviceKey, rootKey, root, false)
+	attested := newAttestationCert(t, "YubiKey PIV Attestation 9c", slotKey, deviceKey, device, false)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	ks := &KeyStore{attestationRoots: roots}
+	found := ks.attestations([]*x509.Certificate{device, attested})
+	require.Len(t, found, 2)
+	require.Equal(t, device, found[1].issuer)
+
+	// a device certificate written to slot f9 by anyone but Yubico
+	forged := newAttestationCert(t, "Yubico PIV Attestation", deviceKey, deviceKey, nil, true)
+	found = ks.attestations([]*x509.Certificate{forged, attested})
+	require.Nil(t, found[1].issuer)
+
+	ks.attestationRoots = nil
+	found = ks.attestations([]*x509.Certificate{device, attested})
+	require.Nil(t, found[1].issuer)
+	require.Error(t, VerifyAttestation(device, attested, YubicoRoots()))
+	require.NoError(t, VerifyAttestation(device, attested, roots))
+}
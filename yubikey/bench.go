@@ -0,0 +1,208 @@
+package yubikey
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/tuf/data"
+	"github.com/theupdateframework/notary/tuf/utils"
+)
+
+// BenchOptions chooses the token the benchmarks run against
+type BenchOptions struct {
+	// Library is a pkcs11 module such as SoftHSM, whose first token is
+	// used. The mock token is used if it is empty
+	Library string
+	PIN     string
+	// ManagementKey is the SO PIN of a yubikey and the user PIN of any
+	// other token
+	ManagementKey string
+	// Parallelism is the size of the session pool of SignParallel
+	Parallelism int
+}
+
+// BenchResult is the outcome of a benchmark, Err is set if it failed
+type BenchResult struct {
+	Name string
+	testing.BenchmarkResult
+	Err error
+}
+
+// benchPayload is what the benchmarks sign, about the size of a small
+// targets.json
+var benchPayload = make([]byte, 2048)
+
+// benchmarks are the hot paths measured by RunBenchmarks and go test -bench
+var benchmarks = []struct {
+	name string
+	run  func(e *benchEnv, b *testing.B) error
+}{
+	{"Sign", benchSign},
+	{"SignParallel", benchSignParallel},
+	{"ListKeys", benchListKeys},
+	{"AddECDSAKey", benchAddECDSAKey},
+}
+
+// benchEnv is a key store with a session on the benchmarked token, which
+// holds a key in slot
+type benchEnv struct {
+	ks      *KeyStore
+	session pkcs11.SessionHandle
+	slot    common.HardwareSlot
+	opts    BenchOptions
+	// keys are imported in turn by AddECDSAKey, generating them would be
+	// measured as well otherwise
+	keys    []data.PrivateKey
+	restore func()
+}
+
+// newBenchEnv loads the token of opts in place of the library of the
+// daemon and stores a key on it. close restores the library
+func newBenchEnv(opts BenchOptions) (*benchEnv, error) {
+	ctx, lib, override, level := pkcs11Ctx, pkcs11Lib, libraryOverride, logrus.GetLevel()
+	e := &benchEnv{opts: opts, slot: common.HardwareSlot{SlotID: []byte{byte(slotIDs[0])}, Role: data.CanonicalRootRole}}
+	e.restore = func() {
+		Cleanup()
+		pkcs11Ctx, pkcs11Lib, libraryOverride = ctx, lib, override
+		logrus.SetLevel(level)
+	}
+	// every import of AddECDSAKey would be logged
+	if level > logrus.WarnLevel {
+		logrus.SetLevel(logrus.WarnLevel)
+	}
+
+	pkcs11Ctx = nil
+	if opts.Library == "" {
+		pkcs11Ctx, pkcs11Lib = newMockToken(), "mock"
+		e.opts.PIN, e.opts.ManagementKey = mockPIN, mockManagementKey
+		e.ks = &KeyStore{reserved: make(map[byte]bool)}
+	} else {
+		if err := SetLibrary(opts.Library); err != nil {
+			e.restore()
+			return nil, err
+		}
+		e.ks = NewKeyStore()
+	}
+	if e.opts.Parallelism <= 0 {
+		e.opts.Parallelism = 4
+	}
+
+	var err error
+	if e.session, err = e.ks.SetupHSMEnv(); err != nil {
+		e.restore()
+		return nil, err
+	}
+	for i := 0; i < 4; i++ {
+		key, err := utils.GenerateECDSAKey(rand.Reader)
+		if err != nil {
+			e.close()
+			return nil, err
+		}
+		e.keys = append(e.keys, key)
+	}
+	if err := e.ks.AddECDSAKeyWithOptions(e.session, e.keys[0], e.slot, e.opts.ManagementKey, e.slot.Role, backend.AddKeyOptions{Overwrite: true}); err != nil {
+		e.close()
+		return nil, fmt.Errorf("failed to store the key to sign with: %v", err)
+	}
+	return e, nil
+}
+
+func (e *benchEnv) close() {
+	e.ks.CloseSession(e.session)
+	e.restore()
+}
+
+func benchSign(e *benchEnv, b *testing.B) error {
+	for i := 0; i < b.N; i++ {
+		if _, err := e.ks.Sign(e.session, e.slot, e.opts.PIN, benchPayload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// benchSignParallel signs from several goroutines on the session pool
+func benchSignParallel(e *benchEnv, b *testing.B) error {
+	signPool.Lock()
+	size := signPool.size
+	signPool.Unlock()
+	defer func() {
+		// a disabled pool no longer logs itself out for the others
+		FlushLogin()
+		SetSessionPool(size)
+	}()
+	if err := SetSessionPool(e.opts.Parallelism); err != nil {
+		return err
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+	)
+	b.SetParallelism(e.opts.Parallelism)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := e.ks.Sign(e.session, e.slot, e.opts.PIN, benchPayload); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+		}
+	})
+	return firstErr
+}
+
+func benchListKeys(e *benchEnv, b *testing.B) error {
+	for i := 0; i < b.N; i++ {
+		keys, err := e.ks.HardwareListKeys(e.session)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("the stored key is not listed")
+		}
+	}
+	return nil
+}
+
+func benchAddECDSAKey(e *benchEnv, b *testing.B) error {
+	for i := 0; i < b.N; i++ {
+		key := e.keys[i%len(e.keys)]
+		if err := e.ks.AddECDSAKeyWithOptions(e.session, key, e.slot, e.opts.ManagementKey, e.slot.Role, backend.AddKeyOptions{Overwrite: true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunBenchmarks measures Sign, ListKeys and AddECDSAKey against the token
+// chosen by opts, the mock token unless a library is given. Each benchmark
+// runs for about a second. A daemon must not run them, they replace its
+// library while they run
+func RunBenchmarks(opts BenchOptions) ([]BenchResult, error) {
+	e, err := newBenchEnv(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer e.close()
+
+	results := make([]BenchResult, 0, len(benchmarks))
+	for _, bm := range benchmarks {
+		var err error
+		res := testing.Benchmark(func(b *testing.B) {
+			b.ReportAllocs()
+			err = bm.run(e, b)
+		})
+		results = append(results, BenchResult{Name: bm.name, BenchmarkResult: res, Err: err})
+	}
+	return results, nil
+}
@@ -0,0 +1,63 @@
+package yubikey
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+// benchOptions runs the benchmarks against the pkcs11 module named by
+// BENCH_PKCS11_LIBRARY, e.g. SoftHSM, instead of the mock token
+func benchOptions() BenchOptions {
+	return BenchOptions{
+		Library:       os.Getenv("BENCH_PKCS11_LIBRARY"),
+		PIN:           os.Getenv("BENCH_PKCS11_PIN"),
+		ManagementKey: os.Getenv("BENCH_PKCS11_SO_PIN"),
+	}
+}
+
+func runBenchmark(b *testing.B, run func(*benchEnv, *testing.B) error) {
+	e, err := newBenchEnv(benchOptions())
+	require.NoError(b, err)
+	defer e.close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	require.NoError(b, run(e, b))
+}
+
+func BenchmarkSign(b *testing.B)         { runBenchmark(b, benchSign) }
+func BenchmarkSignParallel(b *testing.B) { runBenchmark(b, benchSignParallel) }
+func BenchmarkListKeys(b *testing.B)     { runBenchmark(b, benchListKeys) }
+func BenchmarkAddECDSAKey(b *testing.B)  { runBenchmark(b, benchAddECDSAKey) }
+
+func TestMockToken(t *testing.T) {
+	e, err := newBenchEnv(BenchOptions{})
+	require.NoError(t, err)
+	defer e.close()
+
+	keys, err := e.ks.HardwareListKeys(e.session)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	pub, role, err := e.ks.GetECDSAKey(e.session, e.slot, "")
+	require.NoError(t, err)
+	require.Equal(t, data.CanonicalRootRole, role)
+	require.Contains(t, keys, pub.ID())
+
+	sig, err := e.ks.Sign(e.session, e.slot, mockPIN, benchPayload)
+	require.NoError(t, err)
+	parsed, err := x509.ParsePKIXPublicKey(pub.Public())
+	require.NoError(t, err)
+	digest := sha256.Sum256(benchPayload)
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	require.True(t, ecdsa.Verify(parsed.(*ecdsa.PublicKey), digest[:], r, s))
+
+	_, err = e.ks.Sign(e.session, e.slot, "654321", benchPayload)
+	require.Error(t, err)
+	require.NoError(t, e.ks.CheckUserPin(e.session, mockPIN))
+}
@@ -0,0 +1,56 @@
+package yubikey
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+)
+
+// A YubiKey Bio verifies the user by fingerprint rather than by PIN: a login
+// without PIN has the yubikey wait for an enrolled finger on its sensor.
+// After too many mismatches the fingerprints are blocked until the PIN is
+// entered again
+
+// bioToken tells whether the token in slot is a YubiKey Bio
+func bioToken(slot uint) bool {
+	info, ok := tokenModel(slot)
+	return ok && isBio(info)
+}
+
+// isBio tells whether a token is a YubiKey Bio
+func isBio(info pkcs11.TokenInfo) bool {
+	return isYubikey(info) && strings.Contains(strings.ToLower(info.Model), "bio")
+}
+
+// userLogin logs the user in to session of the token in slot. On a YubiKey
+// Bio an empty passwd has the user place a finger on the sensor instead of
+// entering the PIN. The touch policy of the keys is left as it is
+func userLogin(slot uint, session pkcs11.SessionHandle, passwd string) error {
+	bio := passwd == "" && bioToken(slot)
+	if bio {
+		logrus.Infof("Place an enrolled finger on the sensor of the YubiKey Bio")
+	}
+	err := pkcs11Ctx.Login(session, pkcs11.CKU_USER, passwd)
+	switch {
+	case err == nil:
+		return nil
+	case bio:
+		return bioLoginError(err)
+	default:
+		return newPKCS11Error(err, "error logging in")
+	}
+}
+
+// bioLoginError describes a failed fingerprint verification
+func bioLoginError(err error) *Error {
+	e := newPKCS11Error(err, "error logging in")
+	switch e.Code {
+	case ErrCodeWrongPin:
+		e.Err = fmt.Errorf("the fingerprint was not recognized, try again with an enrolled finger")
+	case ErrCodePinLocked:
+		e.Err = fmt.Errorf("fingerprint verification is blocked after too many mismatches, sign with the PIN to unblock it")
+	}
+	return e
+}
@@ -0,0 +1,71 @@
+package yubikey
+
+import (
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsBio(t *testing.T) {
+	require.True(t, isBio(pkcs11.TokenInfo{ManufacturerID: "Yubico (www.yubico.com)", Model: "YubiKey Bio"}))
+	require.False(t, isBio(pkcs11.TokenInfo{ManufacturerID: "Yubico (www.yubico.com)", Model: "YubiKey YK5"}))
+	require.False(t, isBio(pkcs11.TokenInfo{ManufacturerID: "Biometrics Inc.", Model: "Bio Token"}))
+}
+
+func TestBioSign(t *testing.T) {
+	defer SetYubikeyKeyMode(YubikeyKeyMode())
+	require.NoError(t, SetYubikeyKeyMode(KEYMODE_TOUCH|KEYMODE_PIN_ONCE))
+	e, restore := newMockEnv(t)
+	defer restore()
+	e.token.bio = true
+	slotID := byte(slotIDs[0])
+	e.addKey(t, slotID)
+
+	// the fingerprint replaces the PIN, the touch policy is kept
+	keys := e.objects(slotID, pkcs11.CKO_PRIVATE_KEY)
+	require.Len(t, keys, 1)
+	require.Equal(t, pkcs11.NewAttribute(pkcs11.CKA_VENDOR_DEFINED, KEYMODE_TOUCH|KEYMODE_PIN_ONCE).Value, keys[0].attrs[pkcs11.CKA_VENDOR_DEFINED])
+
+	e.token.finger = true
+	sig, err := e.ks.Sign(e.session, e.slot, "", []byte("payload"))
+	require.NoError(t, err)
+	require.NotEmpty(t, sig)
+	require.True(t, e.loggedOut())
+	// the PIN still works
+	_, err = e.ks.Sign(e.session, e.slot, mockPIN, []byte("payload"))
+	require.NoError(t, err)
+
+	e.token.finger = false
+	for i := 0; i < mockBioRetries; i++ {
+		_, err = e.ks.Sign(e.session, e.slot, "", []byte("payload"))
+		require.Equal(t, ErrCodeWrongPin, ErrorCodeOf(err))
+		require.Contains(t, err.Error(), "fingerprint was not recognized")
+	}
+	_, err = e.ks.Sign(e.session, e.slot, "", []byte("payload"))
+	require.Equal(t, ErrCodePinLocked, ErrorCodeOf(err))
+	require.Contains(t, err.Error(), "sign with the PIN to unblock it")
+
+	// the PIN unblocks the fingerprints
+	_, err = e.ks.Sign(e.session, e.slot, mockPIN, []byte("payload"))
+	require.NoError(t, err)
+	e.token.finger = true
+	_, err = e.ks.Sign(e.session, e.slot, "", []byte("payload"))
+	require.NoError(t, err)
+}
+
+func TestBioTokenCached(t *testing.T) {
+	token, restore := useMockToken()
+	defer restore()
+	token.bio = true
+
+	require.True(t, bioToken(tokenSlot))
+	calls := token.callCount("GetTokenInfo")
+	require.True(t, bioToken(tokenSlot))
+	require.Equal(t, calls, token.callCount("GetTokenInfo"))
+
+	// another device is read on its own
+	token.failNext("GetTokenInfo", ckr(pkcs11.CKR_SLOT_ID_INVALID))
+	require.False(t, bioToken(tokenSlot+1))
+	require.True(t, bioToken(tokenSlot))
+}
@@ -0,0 +1,136 @@
+package yubikey
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+// Config is the section of the config file for the yubikey backend
+type Config struct {
+	// ReservedSlots are PIV slots, e.g. "9a", which are used for something
+	// else like SSH login. The adapter never allocates, imports into or
+	// deletes from them
+	ReservedSlots []string `json:"reserved_slots"`
+	// Slots maps PIV slots, e.g. "9c", whose certificates do not name a
+	// notary role, e.g. because a CA issued them, to the role and key ID of
+	// their key. The certificates are left untouched
+	Slots map[string]SlotMapping `json:"slots"`
+	// URI is a pkcs11: URI selecting the library by module-path or
+	// module-name and the yubikey by its token attributes, e.g.
+	// "pkcs11:serial=12345678". Sessions are opened on the first matching
+	// yubikey instead of the first attached one
+	URI string `json:"uri"`
+	// LibraryPaths are paths or glob patterns of pkcs11 libraries, e.g.
+	// "/opt/yubico/lib/libykcs11.so*", searched after the usual locations.
+	// They are searched again on SIGHUP
+	LibraryPaths []string `json:"library_paths"`
+	// AttestationRoots is a PEM file with the CAs the attestation key of
+	// the yubikey has to be issued by, instead of the Yubico CAs
+	AttestationRoots string `json:"attestation_roots"`
+}
+
+// SlotMapping is the notary role of an externally managed key. KeyID has
+// to match the key in the slot, so a key provisioned anew is not taken for
+// the mapped one
+type SlotMapping struct {
+	Role  string `json:"role"`
+	KeyID string `json:"key_id"`
+}
+
+// parseConfig reads the backend section of the config file, which may be empty
+func parseConfig(raw json.RawMessage) (Config, error) {
+	var cfg Config
+	if len(raw) == 0 {
+		return cfg, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, NewError(ErrCodeInvalidRequest, "invalid yubikey config: %v", err)
+	}
+	return cfg, nil
+}
+
+// reservedSlots resolves the names of the reserved slots to slot IDs
+func (cfg Config) reservedSlots() (map[byte]bool, error) {
+	reserved := make(map[byte]bool)
+	for _, name := range cfg.ReservedSlots {
+		id, err := ParseSlot(name)
+		if err != nil {
+			return nil, err
+		}
+		reserved[id[0]] = true
+	}
+	return reserved, nil
+}
+
+// slotMappings resolves the names of the mapped slots to slot IDs
+func (cfg Config) slotMappings() (map[byte]SlotMapping, error) {
+	mapped := make(map[byte]SlotMapping)
+	for name, m := range cfg.Slots {
+		id, err := ParseSlot(name)
+		if err != nil {
+			return nil, err
+		}
+		if !data.ValidRole(data.RoleName(m.Role)) {
+			return nil, NewError(ErrCodeInvalidRequest, "slot %s: %q is no notary role", name, m.Role)
+		}
+		if len(m.KeyID) != 64 {
+			return nil, NewError(ErrCodeInvalidRequest, "slot %s: key_id has to be the 64 hex digits of the notary key ID", name)
+		}
+		mapped[id[0]] = m
+	}
+	return mapped, nil
+}
+
+// tokenURI parses the URI of the config, it must not select a key
+func (cfg Config) tokenURI() (*URI, error) {
+	if cfg.URI == "" {
+		return nil, nil
+	}
+	u, err := ParseURI(cfg.URI)
+	if err != nil {
+		return nil, err
+	}
+	if u.selectsObject() {
+		return nil, NewError(ErrCodeInvalidRequest, "uri %s: only the module and token can be selected in the config", cfg.URI)
+	}
+	return &u, nil
+}
+
+// mappedRole returns the role the config maps the key keyID in slotID to
+func (ks *KeyStore) mappedRole(slotID []byte, keyID string) (data.RoleName, bool) {
+	if len(slotID) != 1 {
+		return "", false
+	}
+	m, ok := ks.mapped[slotID[0]]
+	if !ok {
+		return "", false
+	}
+	if m.KeyID != keyID {
+		logrus.Warnf("Slot %s holds key %s, but the config maps key %s to role %s, ignoring it", SlotName(slotID), keyID, m.KeyID, m.Role)
+		return "", false
+	}
+	return data.RoleName(m.Role), true
+}
+
+// isMappedKey tells whether the config maps keyID to a role
+func (ks *KeyStore) isMappedKey(keyID string) bool {
+	for _, m := range ks.mapped {
+		if m.KeyID == keyID {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotReserved refuses to touch a reserved slot
+func (ks *KeyStore) checkNotReserved(slotID []byte) error {
+	if len(slotID) == 1 && ks.reserved[slotID[0]] {
+		return NewError(ErrCodePolicyDenied, "slot %s is reserved", SlotName(slotID))
+	}
+	return nil
+}
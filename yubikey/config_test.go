@@ -0,0 +1,58 @@
+package yubikey
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReservedSlots(t *testing.T) {
+	cfg, err := parseConfig(json.RawMessage(`{"reserved_slots": ["9a", "9E"]}`))
+	require.NoError(t, err)
+	reserved, err := cfg.reservedSlots()
+	require.NoError(t, err)
+	ks := &KeyStore{reserved: reserved}
+
+	require.Equal(t, ErrCodePolicyDenied, ErrorCodeOf(ks.checkNotReserved([]byte{0})))
+	require.Equal(t, ErrCodePolicyDenied, ErrorCodeOf(ks.checkNotReserved([]byte{1})))
+	require.NoError(t, ks.checkNotReserved([]byte{2}))
+
+	cfg, err = parseConfig(json.RawMessage(`{"reserved_slots": ["9f"]}`))
+	require.NoError(t, err)
+	_, err = cfg.reservedSlots()
+	require.Error(t, err)
+
+	cfg, err = parseConfig(nil)
+	require.NoError(t, err)
+	require.Empty(t, cfg.ReservedSlots)
+}
+
+func TestSlotMappings(t *testing.T) {
+	keyID := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	cfg, err := parseConfig(json.RawMessage(`{"slots": {"9c": {"role": "root", "key_id": "` + keyID + `"}}}`))
+	require.NoError(t, err)
+	mapped, err := cfg.slotMappings()
+	require.NoError(t, err)
+	ks := &KeyStore{mapped: mapped}
+
+	role, ok := ks.mappedRole([]byte{2}, keyID)
+	require.True(t, ok)
+	require.Equal(t, "root", role.String())
+	_, ok = ks.mappedRole([]byte{2}, "another key")
+	require.False(t, ok)
+	_, ok = ks.mappedRole([]byte{1}, keyID)
+	require.False(t, ok)
+	require.True(t, ks.isMappedKey(keyID))
+
+	for _, invalid := range []string{
+		`{"slots": {"9c": {"role": "nobody", "key_id": "` + keyID + `"}}}`,
+		`{"slots": {"9c": {"role": "root"}}}`,
+		`{"slots": {"9f": {"role": "root", "key_id": "` + keyID + `"}}}`,
+	} {
+		cfg, err := parseConfig(json.RawMessage(invalid))
+		require.NoError(t, err)
+		_, err = cfg.slotMappings()
+		require.Error(t, err, invalid)
+	}
+}
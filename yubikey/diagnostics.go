@@ -0,0 +1,47 @@
+package yubikey
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Diagnostics describes the loaded library, the token and the cached
+// mechanism lists, one line per fact
+func (ks *KeyStore) Diagnostics() []string {
+	lines := []string{
+		fmt.Sprintf("library: %s", pkcs11Lib),
+		fmt.Sprintf("fips mode: %t, key mode: %d, touch timeout: %s", fipsMode, YubikeyKeyMode(), touchTimeout),
+	}
+	if pkcs11Ctx == nil {
+		return append(lines, "library not initialized")
+	}
+	lines = append(lines, fmt.Sprintf("token slot: %d", tokenSlot))
+	lines = append(lines, fmt.Sprintf("cached key handles: %d", keyHandles.len()))
+	if idle, busy, size := signPool.stats(); size > 0 {
+		lines = append(lines, fmt.Sprintf("session pool: %d idle, %d busy of %d", idle, busy, size))
+		loggedIn, ttl := signPool.loginState()
+		lines = append(lines, fmt.Sprintf("logged in: %t, login ttl: %s", loggedIn, ttl))
+	}
+	// the token may be blocked by a pending signature, only its cached info
+	// is described
+	if info, read := cachedTokenInfo(); read.IsZero() {
+		lines = append(lines, "token info: not read yet")
+	} else {
+		lines = append(lines, fmt.Sprintf("token: %s %s serial %s, firmware %d.%d, sessions %d (rw %d), read at %s",
+			info.ManufacturerID, info.Model, info.SerialNumber, info.FirmwareVersion.Major, info.FirmwareVersion.Minor,
+			info.SessionCount, info.RwSessionCount, read.Format(time.RFC3339)))
+	}
+
+	mechanismsLock.Lock()
+	defer mechanismsLock.Unlock()
+	slots := make([]int, 0, len(mechanisms))
+	for slot := range mechanisms {
+		slots = append(slots, int(slot))
+	}
+	sort.Ints(slots)
+	for _, slot := range slots {
+		lines = append(lines, fmt.Sprintf("cached mechanisms of slot %d: %d", slot, len(mechanisms[uint(slot)])))
+	}
+	return lines
+}
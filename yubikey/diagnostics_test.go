@@ -0,0 +1,21 @@
+package yubikey
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnosticsUseCachedTokenInfo(t *testing.T) {
+	e, restore := newMockEnv(t)
+	defer restore()
+	_, err := e.ks.TokenInfo(e.session)
+	require.NoError(t, err)
+
+	calls := e.token.callCount("GetTokenInfo")
+	lines := e.ks.Diagnostics()
+	// a SIGUSR1 dump must not wait for a token blocked by a signature
+	require.Equal(t, calls, e.token.callCount("GetTokenInfo"))
+	require.Contains(t, strings.Join(lines, "\n"), "token: ")
+}
@@ -0,0 +1,168 @@
+package yubikey
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/elliptic"
+	// register the hash functions used by crypto.Hash.New
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"strings"
+	"sync"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+)
+
+// Digest algorithms supported for signing
+const (
+	DigestSHA256 = "sha256"
+	DigestSHA384 = "sha384"
+	DigestSHA512 = "sha512"
+)
+
+var (
+	defaultDigest = DigestSHA256
+
+	digestHashes = map[string]crypto.Hash{
+		DigestSHA256: crypto.SHA256,
+		DigestSHA384: crypto.SHA384,
+		DigestSHA512: crypto.SHA512,
+	}
+
+	// mechanisms which hash the payload on the token, by digest
+	hashingMechanisms = map[crypto.Hash]uint{
+		crypto.SHA256: pkcs11.CKM_ECDSA_SHA256,
+		crypto.SHA384: pkcs11.CKM_ECDSA_SHA384,
+		crypto.SHA512: pkcs11.CKM_ECDSA_SHA512,
+	}
+	tokenHashing = false
+	// mechanisms supported by the token, queried once per token slot
+	mechanisms     = make(map[uint]map[uint]bool)
+	mechanismsLock sync.Mutex
+
+	// DER encoded OIDs as found in CKA_EC_PARAMS
+	oidP256 = []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+	oidP384 = []byte{0x06, 0x05, 0x2b, 0x81, 0x04, 0x00, 0x22}
+	oidP521 = []byte{0x06, 0x05, 0x2b, 0x81, 0x04, 0x00, 0x23}
+)
+
+// SetDefaultDigest sets the digest algorithm used by Sign if a request does
+// not specify one
+func SetDefaultDigest(alg string) error {
+	if _, err := digestHash(alg); err != nil {
+		return err
+	}
+	defaultDigest = strings.ToLower(alg)
+	return nil
+}
+
+// SetTokenHashing sets whether the payload may be hashed by the token
+// itself, if it offers a combined hash and sign mechanism
+func SetTokenHashing(enabled bool) {
+	tokenHashing = enabled
+}
+
+// signingMechanism returns the mechanism used to sign with the given digest
+// and whether that mechanism hashes the payload itself
+func signingMechanism(slot uint, hash crypto.Hash, prehashed bool) (uint, bool) {
+	mech, ok := hashingMechanisms[hash]
+	if !tokenHashing || prehashed || !ok {
+		return pkcs11.CKM_ECDSA, false
+	}
+
+	mechanismsLock.Lock()
+	defer mechanismsLock.Unlock()
+	supported, ok := mechanisms[slot]
+	if !ok {
+		list, err := pkcs11Ctx.GetMechanismList(slot)
+		if err != nil {
+			// not cached, the next signature asks again
+			logrus.Debugf("Failed to query mechanisms, hashing on the host: %v", err)
+			return pkcs11.CKM_ECDSA, false
+		}
+		supported = make(map[uint]bool)
+		for _, m := range list {
+			supported[m.Mechanism] = true
+		}
+		mechanisms[slot] = supported
+	}
+	if supported[mech] {
+		return mech, true
+	}
+	return pkcs11.CKM_ECDSA, false
+}
+
+// forgetMechanisms drops the cached mechanism lists, they are queried again
+// after the library was initialized anew
+func forgetMechanisms() {
+	mechanismsLock.Lock()
+	defer mechanismsLock.Unlock()
+	mechanisms = make(map[uint]map[uint]bool)
+}
+
+// digestHash resolves the name of a digest algorithm, the empty name
+// resolves to the default digest
+func digestHash(alg string) (crypto.Hash, error) {
+	if alg == "" {
+		alg = defaultDigest
+	}
+	hash, ok := digestHashes[strings.ToLower(alg)]
+	if !ok {
+		return 0, NewError(ErrCodeInvalidRequest, "unsupported digest algorithm %q", alg)
+	}
+	return hash, nil
+}
+
+// curveFromParams returns the curve described by the CKA_EC_PARAMS value of a key
+func curveFromParams(params []byte) (elliptic.Curve, bool) {
+	switch {
+	case bytes.Equal(params, oidP256):
+		return elliptic.P256(), true
+	case bytes.Equal(params, oidP384):
+		return elliptic.P384(), true
+	case bytes.Equal(params, oidP521):
+		return elliptic.P521(), true
+	}
+	return nil, false
+}
+
+// checkDigestForCurve rejects digests which are weaker than the key they are
+// signed with, e.g. SHA-256 with a P-384 key
+func checkDigestForCurve(hash crypto.Hash, curve elliptic.Curve) error {
+	curveBytes := (curve.Params().BitSize + 7) / 8
+	// P-521 keys are matched by SHA-512
+	if curveBytes > 64 {
+		curveBytes = 64
+	}
+	if hash.Size() < curveBytes {
+		return NewError(ErrCodeInvalidRequest, "digest %s is too weak for curve %s", hash, curve.Params().Name)
+	}
+	return nil
+}
+
+// HostDigest hashes payload on the host as described by opts, for a key on
+// the given curve. Backends which cannot hash on the device use it to sign
+// the same digests as the yubikey backend
+func HostDigest(payload []byte, curve elliptic.Curve, opts backend.SignOptions) ([]byte, crypto.Hash, error) {
+	hash, err := digestHash(opts.DigestAlgorithm)
+	if err != nil {
+		return nil, 0, err
+	}
+	if opts.Prehashed && len(payload) != hash.Size() {
+		return nil, 0, NewError(ErrCodeInvalidRequest, "digest has %d bytes, but %s needs %d", len(payload), hash, hash.Size())
+	}
+	if err := checkDigestForCurve(hash, curve); err != nil {
+		return nil, 0, err
+	}
+	if err := checkFIPS(hash, curve); err != nil {
+		return nil, 0, err
+	}
+	if opts.Prehashed {
+		return payload, hash, nil
+	}
+	h := hash.New()
+	h.Write(payload)
+	return h.Sum(nil), hash, nil
+}
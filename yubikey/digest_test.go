@@ -0,0 +1,55 @@
+package yubikey
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigestHash(t *testing.T) {
+	hash, err := digestHash("")
+	require.NoError(t, err)
+	require.Equal(t, crypto.SHA256, hash)
+
+	hash, err = digestHash("SHA384")
+	require.NoError(t, err)
+	require.Equal(t, crypto.SHA384, hash)
+
+	_, err = digestHash("md5")
+	require.Equal(t, ErrCodeInvalidRequest, ErrorCodeOf(err))
+}
+
+func TestCheckDigestForCurve(t *testing.T) {
+	require.NoError(t, checkDigestForCurve(crypto.SHA256, elliptic.P256()))
+	require.NoError(t, checkDigestForCurve(crypto.SHA512, elliptic.P256()))
+	require.NoError(t, checkDigestForCurve(crypto.SHA384, elliptic.P384()))
+	require.NoError(t, checkDigestForCurve(crypto.SHA512, elliptic.P521()))
+	require.Error(t, checkDigestForCurve(crypto.SHA256, elliptic.P384()))
+	require.Error(t, checkDigestForCurve(crypto.SHA384, elliptic.P521()))
+}
+
+func TestSigningMechanism(t *testing.T) {
+	token, restore := useMockToken()
+	defer restore()
+	defer SetTokenHashing(false)
+	forgetMechanisms()
+
+	mech, hashing := signingMechanism(0, crypto.SHA256, false)
+	require.Equal(t, uint(pkcs11.CKM_ECDSA), mech, "the host hashes by default")
+	require.False(t, hashing)
+
+	SetTokenHashing(true)
+	// a failed query is not cached
+	token.failNext("GetMechanismList", pkcs11.Error(pkcs11.CKR_DEVICE_ERROR))
+	mech, _ = signingMechanism(0, crypto.SHA256, false)
+	require.Equal(t, uint(pkcs11.CKM_ECDSA), mech)
+	mech, hashing = signingMechanism(0, crypto.SHA256, false)
+	require.Equal(t, uint(pkcs11.CKM_ECDSA_SHA256), mech)
+	require.True(t, hashing)
+	mech, _ = signingMechanism(0, crypto.SHA384, false)
+	require.Equal(t, uint(pkcs11.CKM_ECDSA), mech)
+	require.Equal(t, 2, token.callCount("GetMechanismList"))
+}
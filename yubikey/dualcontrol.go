@@ -0,0 +1,107 @@
+package yubikey
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// ConfirmPresence asks the yubikey with the given serial number to sign a
+// random challenge with the key in slotID and verifies the signature against
+// the certificate of that slot. If the key requires touch, this proves that
+// somebody is present at that device.
+func (ks *KeyStore) ConfirmPresence(serial string, slotID []byte, passwd string) error {
+	p, err := initializeLib()
+	if err != nil {
+		return err
+	}
+	slot, err := findTokenSlot(p, serial)
+	if err != nil {
+		return err
+	}
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return newPKCS11Error(err, "failed to open session with yubikey %s", serial)
+	}
+	defer p.CloseSession(session)
+
+	defer exclusiveLogin(slot, session)()
+	if err := p.Login(session, pkcs11.CKU_USER, passwd); err != nil {
+		return newPKCS11Error(err, "error logging in to yubikey %s", serial)
+	}
+	defer p.Logout(session)
+
+	certObj, err := findObject(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, slotID),
+	})
+	if err != nil {
+		return err
+	}
+	attr, err := p.GetAttributeValue(session, certObj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	})
+	if err != nil || len(attr) != 1 {
+		return NewError(ErrCodeKeyNotFound, "failed to read certificate of slot %s on yubikey %s", SlotName(slotID), serial)
+	}
+	cert, err := x509.ParseCertificate(attr[0].Value)
+	if err != nil {
+		return NewError(ErrCodeKeyNotFound, "invalid certificate in slot %s on yubikey %s: %v", SlotName(slotID), serial, err)
+	}
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return NewError(ErrCodeInvalidRequest, "slot %s on yubikey %s does not hold an ECDSA key", SlotName(slotID), serial)
+	}
+
+	keyObj, err := findObject(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, slotID),
+	})
+	if err != nil {
+		return err
+	}
+
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	logrus.Infof("Waiting for confirmation on yubikey %s", serial)
+	if err := p.SignInit(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, keyObj); err != nil {
+		return newPKCS11Error(err, "failed to confirm on yubikey %s", serial)
+	}
+	sig, err := p.Sign(session, challenge)
+	if err != nil {
+		return newPKCS11Error(err, "failed to confirm on yubikey %s", serial)
+	}
+	r, s, err := parseSignature(sig, pub.Curve)
+	if err != nil {
+		return err
+	}
+	if !ecdsa.Verify(pub, challenge, r, s) {
+		return NewError(ErrCodeDevice, "confirmation of yubikey %s does not match its certificate", serial)
+	}
+	return nil
+}
+
+// findTokenSlot returns the pkcs11 slot holding the token with the given serial number
+func findTokenSlot(p common.IPKCS11Ctx, serial string) (uint, error) {
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		return 0, newPKCS11Error(err, "failed to list HSM slots")
+	}
+	for _, slot := range slots {
+		info, err := p.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(info.SerialNumber) == serial {
+			return slot, nil
+		}
+	}
+	return 0, NewError(ErrCodeNoToken, "yubikey %s is not attached", serial)
+}
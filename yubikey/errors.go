@@ -0,0 +1,187 @@
+package yubikey
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// ErrorCode classifies a failure so it can be told apart on the client side
+// of the RPC boundary
+type ErrorCode string
+
+const (
+	// ErrCodeUnknown is used for all errors that could not be classified
+	ErrCodeUnknown ErrorCode = "UNKNOWN"
+	// ErrCodeNoToken means no yubikey (or no pkcs11 library) was found
+	ErrCodeNoToken ErrorCode = "NO_TOKEN"
+	// ErrCodeWrongPin means the given PIN or management key was rejected
+	ErrCodeWrongPin ErrorCode = "WRONG_PIN"
+	// ErrCodePinLocked means the PIN is blocked after too many wrong attempts
+	ErrCodePinLocked ErrorCode = "PIN_LOCKED"
+	// ErrCodeTouchTimeout means the yubikey was not touched in time
+	ErrCodeTouchTimeout ErrorCode = "TOUCH_TIMEOUT"
+	// ErrCodeKeyNotFound means there is no key in the requested slot
+	ErrCodeKeyNotFound ErrorCode = "KEY_NOT_FOUND"
+	// ErrCodeNoSlot means all slots of the yubikey are occupied
+	ErrCodeNoSlot ErrorCode = "NO_SLOT"
+	// ErrCodeSlotOccupied means the requested slot already holds a key
+	ErrCodeSlotOccupied ErrorCode = "SLOT_OCCUPIED"
+	// ErrCodeInvalidRequest means the request itself was malformed
+	ErrCodeInvalidRequest ErrorCode = "INVALID_REQUEST"
+	// ErrCodeDevice means the token reported a failure while executing the request
+	ErrCodeDevice ErrorCode = "DEVICE_ERROR"
+	// ErrCodePolicyDenied means the request was refused by the signing policy
+	ErrCodePolicyDenied ErrorCode = "POLICY_DENIED"
+	// ErrCodeMaintenance means the daemon refuses to sign while operators
+	// work on the tokens
+	ErrCodeMaintenance ErrorCode = "MAINTENANCE"
+)
+
+// retriableCodes are the codes of failures which may go away if the request
+// is simply sent again, e.g. after touching the yubikey. All other codes are
+// fatal for the request
+var retriableCodes = map[ErrorCode]bool{
+	ErrCodeTouchTimeout: true,
+	ErrCodeDevice:       true,
+}
+
+// Retriable returns whether a request failing with this code may succeed
+// when it is sent again
+func (c ErrorCode) Retriable() bool {
+	return retriableCodes[c]
+}
+
+// net/rpc only transports the error string, so the code is carried as a
+// "[CODE] " prefix of the message and the pkcs11 return value, if any, as a
+// "(CKR_NAME, 0xVALUE)" suffix
+var (
+	errorCodePrefix = regexp.MustCompile(`^\[([A-Z_]+)\] `)
+	ckrSuffix       = regexp.MustCompile(`\((CKR_[A-Z_]+), 0x([0-9A-F]+)\)$`)
+)
+
+// Error is an error with an ErrorCode attached. CKR holds the pkcs11 return
+// value that caused the error, it is 0 (CKR_OK) if pkcs11 was not involved
+type Error struct {
+	Code ErrorCode
+	CKR  uint
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.CKR != pkcs11.CKR_OK {
+		return fmt.Sprintf("[%s] %v (%s, 0x%X)", e.Code, e.Err, CKRName(e.CKR), e.CKR)
+	}
+	return fmt.Sprintf("[%s] %v", e.Code, e.Err)
+}
+
+// NewError returns an Error with the given code and a formatted message
+func NewError(code ErrorCode, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Err: fmt.Errorf(format, a...)}
+}
+
+// WrapError attaches an ErrorCode to err. If err already is an Error it is
+// returned unchanged, if code is ErrCodeUnknown the code is derived from err
+func WrapError(code ErrorCode, err error) error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	if code == ErrCodeUnknown {
+		code = classify(err)
+	}
+	ckr, _ := err.(pkcs11.Error)
+	return &Error{Code: code, CKR: uint(ckr), Err: err}
+}
+
+// newPKCS11Error returns an Error for a failed pkcs11 call, classified by and
+// carrying the return value of err. The message is not to repeat err, it is
+// appended by Error as the return value or, if err is none, by newPKCS11Error
+func newPKCS11Error(err error, format string, a ...interface{}) *Error {
+	ckr, ok := err.(pkcs11.Error)
+	msg := fmt.Sprintf(format, a...)
+	if !ok && err != nil {
+		msg = fmt.Sprintf("%s: %v", msg, err)
+	}
+	return &Error{Code: classify(err), CKR: uint(ckr), Err: errors.New(msg)}
+}
+
+// CKRName returns the symbolic name of a pkcs11 return value, e.g.
+// CKR_PIN_INCORRECT for 0xA0
+func CKRName(ckr uint) string {
+	// pkcs11.Error formats as "pkcs11: 0x%X: NAME", the table itself is not exported
+	msg := pkcs11.Error(ckr).Error()
+	if i := strings.LastIndex(msg, ": "); i >= 0 && len(msg) > i+2 {
+		return msg[i+2:]
+	}
+	return "CKR_VENDOR_DEFINED"
+}
+
+// ErrorCodeOf returns the ErrorCode of err. It works on errors created by
+// this package as well as on the flattened errors returned by an rpc client
+func ErrorCodeOf(err error) ErrorCode {
+	if err == nil {
+		return ""
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	if m := errorCodePrefix.FindStringSubmatch(err.Error()); m != nil {
+		return ErrorCode(m[1])
+	}
+	return ErrCodeUnknown
+}
+
+// IsRetriable returns whether the request that failed with err may succeed
+// when it is sent again. Like ErrorCodeOf it works on flattened rpc errors,
+// whether a code is retriable is known on both sides of the RPC boundary
+func IsRetriable(err error) bool {
+	return ErrorCodeOf(err).Retriable()
+}
+
+// CKROf returns the pkcs11 return value carried by err, either directly or
+// parsed from the flattened error of an rpc client
+func CKROf(err error) (uint, bool) {
+	if err == nil {
+		return pkcs11.CKR_OK, false
+	}
+	if e, ok := err.(*Error); ok {
+		return e.CKR, e.CKR != pkcs11.CKR_OK
+	}
+	if m := ckrSuffix.FindStringSubmatch(err.Error()); m != nil {
+		ckr, perr := strconv.ParseUint(m[2], 16, 32)
+		if perr == nil {
+			return uint(ckr), true
+		}
+	}
+	return pkcs11.CKR_OK, false
+}
+
+// classify maps well known errors onto an ErrorCode
+func classify(err error) ErrorCode {
+	switch e := err.(type) {
+	case common.ErrHSMNotPresent:
+		return ErrCodeNoToken
+	case pkcs11.Error:
+		switch uint(e) {
+		case pkcs11.CKR_PIN_INCORRECT, pkcs11.CKR_PIN_INVALID, pkcs11.CKR_PIN_LEN_RANGE:
+			return ErrCodeWrongPin
+		case pkcs11.CKR_PIN_LOCKED:
+			return ErrCodePinLocked
+		case pkcs11.CKR_TOKEN_NOT_PRESENT, pkcs11.CKR_DEVICE_REMOVED, pkcs11.CKR_TOKEN_NOT_RECOGNIZED:
+			return ErrCodeNoToken
+		case pkcs11.CKR_ARGUMENTS_BAD, pkcs11.CKR_ATTRIBUTE_VALUE_INVALID, pkcs11.CKR_TEMPLATE_INCONSISTENT:
+			return ErrCodeInvalidRequest
+		default:
+			return ErrCodeDevice
+		}
+	}
+	return ErrCodeUnknown
+}
@@ -0,0 +1,63 @@
+package yubikey
+
+import (
+	"errors"
+	"net/rpc"
+	"strings"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorCodeSurvivesRPC(t *testing.T) {
+	err := WrapError(ErrCodeUnknown, pkcs11.Error(pkcs11.CKR_PIN_INCORRECT))
+	require.Equal(t, ErrCodeWrongPin, ErrorCodeOf(err))
+
+	// net/rpc flattens errors into a rpc.ServerError string
+	flattened := rpc.ServerError(err.Error())
+	require.Equal(t, ErrCodeWrongPin, ErrorCodeOf(flattened))
+}
+
+func TestErrorCodeOfUnclassified(t *testing.T) {
+	require.Equal(t, ErrCodeUnknown, ErrorCodeOf(errors.New("something broke")))
+	require.Equal(t, ErrCodeUnknown, ErrorCodeOf(WrapError(ErrCodeUnknown, errors.New("something broke"))))
+	require.Equal(t, ErrorCode(""), ErrorCodeOf(nil))
+}
+
+func TestCKRSurvivesRPC(t *testing.T) {
+	err := newPKCS11Error(pkcs11.Error(pkcs11.CKR_PIN_INCORRECT), "error logging in")
+	require.Equal(t, "[WRONG_PIN] error logging in (CKR_PIN_INCORRECT, 0xA0)", err.Error())
+
+	ckr, ok := CKROf(rpc.ServerError(err.Error()))
+	require.True(t, ok)
+	require.Equal(t, uint(pkcs11.CKR_PIN_INCORRECT), ckr)
+
+	_, ok = CKROf(rpc.ServerError(NewError(ErrCodeNoSlot, "no slots").Error()))
+	require.False(t, ok)
+}
+
+func TestRetriableSurvivesRPC(t *testing.T) {
+	err := newPKCS11Error(pkcs11.Error(pkcs11.CKR_DEVICE_ERROR), "error signing")
+	require.Equal(t, "[DEVICE_ERROR] error signing (CKR_DEVICE_ERROR, 0x30)", err.Error())
+	flattened := rpc.ServerError(err.Error())
+	require.True(t, IsRetriable(flattened))
+	require.Equal(t, ErrCodeDevice, ErrorCodeOf(flattened))
+	ckr, ok := CKROf(flattened)
+	require.True(t, ok)
+	require.Equal(t, uint(pkcs11.CKR_DEVICE_ERROR), ckr)
+
+	require.True(t, IsRetriable(rpc.ServerError(NewError(ErrCodeTouchTimeout, "not touched").Error())))
+	require.False(t, IsRetriable(rpc.ServerError(NewError(ErrCodeWrongPin, "wrong pin").Error())))
+	require.False(t, IsRetriable(rpc.ServerError(NewError(ErrCodeKeyNotFound, "no key").Error())))
+	require.False(t, IsRetriable(errors.New("something broke")))
+}
+
+func TestPKCS11ErrorNamesCKROnce(t *testing.T) {
+	err := newPKCS11Error(pkcs11.Error(pkcs11.CKR_DEVICE_REMOVED), "failed to open a pooled session")
+	require.Equal(t, 1, strings.Count(err.Error(), "CKR_DEVICE_REMOVED"))
+
+	// an error without return value is kept in the message
+	err = newPKCS11Error(errors.New("module crashed"), "failed to list HSM slots")
+	require.Equal(t, "[UNKNOWN] failed to list HSM slots: module crashed", err.Error())
+}
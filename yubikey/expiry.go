@@ -0,0 +1,68 @@
+package yubikey
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+// CertExpiry returns the NotAfter of the certificate stored with each key.
+// The role of a key is read from its certificate, so once it expired the
+// key can no longer be told apart reliably
+func (ks *KeyStore) CertExpiry(session pkcs11.SessionHandle) (map[string]time.Time, error) {
+	certs, err := ks.keyCertificates(session)
+	if err != nil {
+		return nil, err
+	}
+	notAfter := make(map[string]time.Time, len(certs))
+	for keyID, cert := range certs {
+		notAfter[keyID] = cert.NotAfter
+	}
+	return notAfter, nil
+}
+
+// KeyCreated returns when each key was stored on the token, which is the
+// NotBefore of its certificate. Renewing the certificate keeps it
+func (ks *KeyStore) KeyCreated(session pkcs11.SessionHandle) (map[string]time.Time, error) {
+	certs, err := ks.keyCertificates(session)
+	if err != nil {
+		return nil, err
+	}
+	created := make(map[string]time.Time, len(certs))
+	for keyID, cert := range certs {
+		created[keyID] = cert.NotBefore
+	}
+	return created, nil
+}
+
+// keyCertificates returns the certificates stored with the keys on the
+// token, by key ID
+func (ks *KeyStore) keyCertificates(session pkcs11.SessionHandle) (map[string]*x509.Certificate, error) {
+	certs, err := ks.listCertificates(session)
+	if err != nil {
+		return nil, err
+	}
+	keyCerts := make(map[string]*x509.Certificate)
+	for _, cert := range certs {
+		if isAttestationCert(cert) {
+			continue
+		}
+		pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			continue
+		}
+		pubBytes, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			continue
+		}
+		keyID := data.NewECDSAPublicKey(pubBytes).ID()
+		if !data.ValidRole(data.RoleName(cert.Subject.CommonName)) && !ks.isMappedKey(keyID) {
+			continue
+		}
+		keyCerts[keyID] = cert
+	}
+	return keyCerts, nil
+}
@@ -0,0 +1,48 @@
+package yubikey
+
+import (
+	"crypto"
+	"crypto/elliptic"
+)
+
+var (
+	fipsMode bool
+
+	// curves and digests approved by FIPS 186-4 and FIPS 180-4
+	fipsCurves = map[string]bool{
+		"P-256": true,
+		"P-384": true,
+		"P-521": true,
+	}
+	fipsDigests = map[crypto.Hash]bool{
+		crypto.SHA256: true,
+		crypto.SHA384: true,
+		crypto.SHA512: true,
+	}
+)
+
+// SetFIPSMode restricts signing to FIPS approved curves and digests and
+// refuses to import keys, they have to be generated on the token
+func SetFIPSMode(enabled bool) {
+	fipsMode = enabled
+}
+
+// FIPSMode returns whether the FIPS compliance mode is enabled
+func FIPSMode() bool {
+	return fipsMode
+}
+
+// checkFIPS rejects curves and digests that are not FIPS approved, if the
+// compliance mode is enabled
+func checkFIPS(hash crypto.Hash, curve elliptic.Curve) error {
+	if !fipsMode {
+		return nil
+	}
+	if !fipsDigests[hash] {
+		return NewError(ErrCodePolicyDenied, "digest %s is not allowed in FIPS mode", hash)
+	}
+	if !fipsCurves[curve.Params().Name] {
+		return NewError(ErrCodePolicyDenied, "curve %s is not allowed in FIPS mode", curve.Params().Name)
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package yubikey
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFIPS(t *testing.T) {
+	defer SetFIPSMode(false)
+
+	require.NoError(t, checkFIPS(crypto.SHA1, elliptic.P224()))
+
+	SetFIPSMode(true)
+	require.NoError(t, checkFIPS(crypto.SHA384, elliptic.P384()))
+	require.Equal(t, ErrCodePolicyDenied, ErrorCodeOf(checkFIPS(crypto.SHA1, elliptic.P256())))
+	require.Equal(t, ErrCodePolicyDenied, ErrorCodeOf(checkFIPS(crypto.SHA256, elliptic.P224())))
+}
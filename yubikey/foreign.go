@@ -0,0 +1,57 @@
+package yubikey
+
+import (
+	"crypto/x509"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/miekg/pkcs11"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+// ForeignKeys returns the keys in the PIV slots whose certificate names no
+// notary role and which are not mapped to one in the config, e.g. keys
+// generated for SSH. Empty slots are skipped
+func (ks *KeyStore) ForeignKeys(session pkcs11.SessionHandle) (keys []backend.ForeignKey, err error) {
+	err = withRetry("ForeignKeys", func() error {
+		keys, err = ks.foreignKeys(session)
+		return err
+	})
+	return keys, err
+}
+
+func (ks *KeyStore) foreignKeys(session pkcs11.SessionHandle) ([]backend.ForeignKey, error) {
+	var keys []backend.ForeignKey
+	for _, id := range slotIDs {
+		slotID := []byte{byte(id)}
+		cert, _, err := slotCertificate(session, slotID)
+		if ErrorCodeOf(err) == ErrCodeKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ks.isNotaryCert(slotID, cert) {
+			continue
+		}
+		keys = append(keys, backend.ForeignKey{
+			SlotID:    slotID,
+			PublicKey: cert.PublicKey,
+			Subject:   cert.Subject.CommonName,
+		})
+	}
+	return keys, nil
+}
+
+// isNotaryCert tells whether the certificate in a slot belongs to a key
+// notary uses, either by naming its role or by the mapping of the config
+func (ks *KeyStore) isNotaryCert(slotID []byte, cert *x509.Certificate) bool {
+	if data.ValidRole(data.RoleName(cert.Subject.CommonName)) {
+		return true
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return false
+	}
+	_, mapped := ks.mappedRole(slotID, data.NewECDSAPublicKey(pubBytes).ID())
+	return mapped
+}
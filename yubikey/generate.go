@@ -0,0 +1,145 @@
+package yubikey
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/tuf/data"
+	"github.com/theupdateframework/notary/tuf/utils"
+)
+
+// keyPairGenerator is the part of pkcs11.Ctx which generates keys, it is
+// not in common.IPKCS11Ctx
+type keyPairGenerator interface {
+	GenerateKeyPair(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, public, private []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error)
+}
+
+// GenerateECDSAKey generates a P-256 key in an empty slot, so the private
+// key never exists outside of the token. Like an imported key it gets a
+// self-signed certificate for role, valid for 10 years, which is signed on
+// the token with the PIN passwd. managementKey is needed to write the key
+// and the certificate
+func (ks *KeyStore) GenerateECDSAKey(session pkcs11.SessionHandle, hwslot common.HardwareSlot, role data.RoleName, passwd, managementKey string) (*data.ECDSAPublicKey, error) {
+	defer keyMapCache.forget()
+	defer keyHandles.forgetSlot(hwslot.SlotID)
+	if err := ks.checkNotReserved(hwslot.SlotID); err != nil {
+		return nil, err
+	}
+	if !data.ValidRole(role) {
+		return nil, NewError(ErrCodeInvalidRequest, "%q is no notary role", role)
+	}
+	generator, ok := pkcs11Ctx.(keyPairGenerator)
+	if !ok {
+		return nil, NewError(ErrCodeInvalidRequest, "the pkcs11 module can not generate keys")
+	}
+	if err := generateKeyPair(generator, session, hwslot.SlotID, managementKey); err != nil {
+		return nil, err
+	}
+	pubKey, err := ks.createCertificate(session, hwslot, role, passwd, managementKey)
+	if err != nil {
+		// a key without certificate is never listed, leave the slot empty
+		unlock := exclusiveLogin(tokenSlot, session)
+		if lerr := pkcs11Ctx.Login(session, managementUser(), managementKey); lerr == nil {
+			rollbackSlot(session, hwslot.SlotID)
+			pkcs11Ctx.Logout(session)
+		}
+		unlock()
+		return nil, err
+	}
+	quarantine.release(hwslot.SlotID)
+	logrus.Infof("Generated key %s in slot %s for role %s", pubKey.ID(), SlotName(hwslot.SlotID), role)
+	return pubKey, nil
+}
+
+// generateKeyPair generates the key pair of a slot as the management user
+func generateKeyPair(generator keyPairGenerator, session pkcs11.SessionHandle, slotID []byte, managementKey string) error {
+	defer exclusiveLogin(tokenSlot, session)()
+	if err := pkcs11Ctx.Login(session, managementUser(), managementKey); err != nil {
+		return WrapError(ErrCodeUnknown, err)
+	}
+	defer pkcs11Ctx.Logout(session)
+
+	existing, err := slotObjects(session, slotID)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return NewError(ErrCodeSlotOccupied, "slot %s already holds a key", SlotName(slotID))
+	}
+	publicKeyTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, slotID),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, oidP256),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+	}
+	privateKeyTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, slotID),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+	}
+	if genericToken() {
+		privateKeyTemplate = append(privateKeyTemplate,
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		)
+	} else {
+		privateKeyTemplate = append(privateKeyTemplate, pkcs11.NewAttribute(pkcs11.CKA_VENDOR_DEFINED, YubikeyKeyMode()))
+	}
+	mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)}
+	if _, _, err := generator.GenerateKeyPair(session, mechanism, publicKeyTemplate, privateKeyTemplate); err != nil {
+		return newPKCS11Error(err, "failed to generate the key in slot %s", SlotName(slotID))
+	}
+	return nil
+}
+
+// createCertificate stores a self-signed certificate for role with the key
+// generated in a slot and returns the public key
+func (ks *KeyStore) createCertificate(session pkcs11.SessionHandle, hwslot common.HardwareSlot, role data.RoleName, passwd, managementKey string) (*data.ECDSAPublicKey, error) {
+	pubKey, _, err := ks.getECDSAKey(session, hwslot)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(pubKey.Public())
+	if err != nil {
+		return nil, WrapError(ErrCodeDevice, err)
+	}
+	startTime := time.Now()
+	template, err := utils.NewCertificate(role.String(), startTime, startTime.AddDate(10, 0, 0))
+	if err != nil {
+		return nil, NewError(ErrCodeInvalidRequest, "failed to create the certificate template: %v", err)
+	}
+	signer := &tokenSigner{ks: ks, session: session, hwslot: hwslot, passwd: passwd, pub: pub}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, pub, signer)
+	if err != nil {
+		return nil, WrapError(ErrCodeUnknown, err)
+	}
+
+	defer exclusiveLogin(tokenSlot, session)()
+	if err := pkcs11Ctx.Login(session, managementUser(), managementKey); err != nil {
+		return nil, WrapError(ErrCodeUnknown, err)
+	}
+	defer pkcs11Ctx.Logout(session)
+	certTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, certBytes),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, hwslot.SlotID),
+	}
+	if genericToken() {
+		if certTemplate, err = genericCertTemplate(certTemplate, certBytes); err != nil {
+			return nil, WrapError(ErrCodeUnknown, err)
+		}
+	}
+	if _, err := pkcs11Ctx.CreateObject(session, certTemplate); err != nil {
+		return nil, newPKCS11Error(err, "failed to store the certificate")
+	}
+	return pubKey, nil
+}
@@ -0,0 +1,60 @@
+package yubikey
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"math/big"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+func TestGenerateECDSAKey(t *testing.T) {
+	e, restore := newMockEnv(t)
+	defer restore()
+	slot := common.HardwareSlot{SlotID: []byte{byte(slotIDs[0])}}
+
+	pubKey, err := e.ks.GenerateECDSAKey(e.session, slot, data.CanonicalTargetsRole, mockPIN, mockManagementKey)
+	require.NoError(t, err)
+	require.True(t, e.loggedOut())
+	keys, err := e.ks.HardwareListKeys(e.session)
+	require.NoError(t, err)
+	require.Equal(t, map[string]common.HardwareSlot{pubKey.ID(): {Role: data.CanonicalTargetsRole, SlotID: slot.SlotID}}, keys)
+
+	payload := []byte("signed by a key generated on the token")
+	sig, err := e.ks.Sign(e.session, slot, mockPIN, payload)
+	require.NoError(t, err)
+	parsed, err := x509.ParsePKIXPublicKey(pubKey.Public())
+	require.NoError(t, err)
+	digest := sha256.Sum256(payload)
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	require.True(t, ecdsa.Verify(parsed.(*ecdsa.PublicKey), digest[:], r, s))
+
+	_, err = e.ks.GenerateECDSAKey(e.session, slot, data.CanonicalTargetsRole, mockPIN, mockManagementKey)
+	require.Equal(t, ErrCodeSlotOccupied, ErrorCodeOf(err))
+}
+
+func TestGenerateECDSAKeyFailures(t *testing.T) {
+	e, restore := newMockEnv(t)
+	defer restore()
+	slotID := byte(slotIDs[0])
+	slot := common.HardwareSlot{SlotID: []byte{slotID}}
+
+	_, err := e.ks.GenerateECDSAKey(e.session, slot, data.CanonicalTargetsRole, mockPIN, "wrong")
+	require.Equal(t, ErrCodeWrongPin, codeOf(err))
+	require.Empty(t, e.objects(slotID))
+
+	// without its certificate the key would be stuck in the slot unseen
+	e.token.failNext("CreateObject", ckr(pkcs11.CKR_DEVICE_MEMORY))
+	_, err = e.ks.GenerateECDSAKey(e.session, slot, data.CanonicalTargetsRole, mockPIN, mockManagementKey)
+	require.Error(t, err)
+	require.Empty(t, e.objects(slotID))
+	require.True(t, e.loggedOut())
+
+	_, err = e.ks.GenerateECDSAKey(e.session, slot, "admin", mockPIN, mockManagementKey)
+	require.Equal(t, ErrCodeInvalidRequest, ErrorCodeOf(err))
+}
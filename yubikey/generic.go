@@ -0,0 +1,80 @@
+package yubikey
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Tokens other than yubikeys, e.g. SoftHSM, follow PKCS#11 closer than
+// ykcs11 does: only the user may manage private objects, certificates need
+// their type and subject, the public key of an imported private key is not
+// derived by the token and the key mode attribute of ykcs11 is unknown
+
+// genericToken tells whether the token in use is not a yubikey. A token
+// whose info can not be read is taken for a yubikey
+func genericToken() bool {
+	info, ok := tokenModel(tokenSlot)
+	return ok && !isYubikey(info)
+}
+
+// managementUser returns the user who adds and removes keys, the SO whose
+// PIN is the management key on a yubikey and the user on other tokens
+func managementUser() uint {
+	if genericToken() {
+		return pkcs11.CKU_USER
+	}
+	return pkcs11.CKU_SO
+}
+
+// genericTemplates turns the templates of an import into a yubikey into the
+// ones of a generic token, which stores the public key as an object as well
+func genericTemplates(slotID []byte, certTemplate, privateKeyTemplate []*pkcs11.Attribute, certBytes []byte, pub *ecdsa.PublicKey) ([][]*pkcs11.Attribute, error) {
+	certTemplate, err := genericCertTemplate(certTemplate, certBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyTemplate []*pkcs11.Attribute
+	for _, a := range privateKeyTemplate {
+		if a.Type != pkcs11.CKA_VENDOR_DEFINED {
+			keyTemplate = append(keyTemplate, a)
+		}
+	}
+	keyTemplate = append(keyTemplate,
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+	)
+
+	// the point is DER encoded like ykcs11 returns it
+	point := append([]byte{0x04, 0x41}, elliptic.Marshal(pub.Curve, pub.X, pub.Y)...)
+	publicKeyTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, slotID),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, oidP256),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, point),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+	}
+	return [][]*pkcs11.Attribute{certTemplate, keyTemplate, publicKeyTemplate}, nil
+}
+
+// genericCertTemplate adds what a generic token needs to store the
+// certificate certBytes to the template of a yubikey
+func genericCertTemplate(certTemplate []*pkcs11.Attribute, certBytes []byte) ([]*pkcs11.Attribute, error) {
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return nil, err
+	}
+	return append(certTemplate,
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_CERTIFICATE_TYPE, pkcs11.CKC_X_509),
+		pkcs11.NewAttribute(pkcs11.CKA_SUBJECT, cert.RawSubject),
+	), nil
+}
@@ -0,0 +1,106 @@
+package yubikey
+
+import (
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// handleKey identifies the private key of a slot as seen by a session
+type handleKey struct {
+	session pkcs11.SessionHandle
+	slotID  string
+}
+
+// handleCache remembers the object handle of the private key in each slot
+// per session, so signing does not search the token for it every time. The
+// handles of a session are forgotten when it is closed, as its handle may be
+// reused for the next session, and those of a slot when its key changes
+type handleCache struct {
+	sync.Mutex
+	handles map[handleKey]pkcs11.ObjectHandle
+}
+
+var keyHandles = &handleCache{handles: make(map[handleKey]pkcs11.ObjectHandle)}
+
+func (c *handleCache) lookup(session pkcs11.SessionHandle, slotID []byte) (pkcs11.ObjectHandle, bool) {
+	c.Lock()
+	defer c.Unlock()
+	obj, ok := c.handles[handleKey{session, string(slotID)}]
+	return obj, ok
+}
+
+func (c *handleCache) store(session pkcs11.SessionHandle, slotID []byte, obj pkcs11.ObjectHandle) {
+	c.Lock()
+	defer c.Unlock()
+	c.handles[handleKey{session, string(slotID)}] = obj
+}
+
+// forget drops the handle of a slot which turned out to be stale
+func (c *handleCache) forget(session pkcs11.SessionHandle, slotID []byte) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.handles, handleKey{session, string(slotID)})
+}
+
+// forgetSession drops the handles of a session which is closed
+func (c *handleCache) forgetSession(session pkcs11.SessionHandle) {
+	c.Lock()
+	defer c.Unlock()
+	for k := range c.handles {
+		if k.session == session {
+			delete(c.handles, k)
+		}
+	}
+}
+
+// forgetSlot drops the handles of a slot whose key is replaced or removed
+func (c *handleCache) forgetSlot(slotID []byte) {
+	c.Lock()
+	defer c.Unlock()
+	for k := range c.handles {
+		if k.slotID == string(slotID) {
+			delete(c.handles, k)
+		}
+	}
+}
+
+// clear drops all handles once the library is unloaded
+func (c *handleCache) clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.handles = make(map[handleKey]pkcs11.ObjectHandle)
+}
+
+func (c *handleCache) len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.handles)
+}
+
+// privateKeyHandle returns the private key in a slot, from the cache if the
+// session looked it up before
+func privateKeyHandle(session pkcs11.SessionHandle, slotID []byte) (pkcs11.ObjectHandle, bool, error) {
+	if obj, ok := keyHandles.lookup(session, slotID); ok {
+		return obj, true, nil
+	}
+	objs, err := findObjects(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, slotID),
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	if len(objs) != 1 {
+		return 0, false, NewError(ErrCodeKeyNotFound, "length of objects found not 1")
+	}
+	keyHandles.store(session, slotID, objs[0])
+	return objs[0], false, nil
+}
+
+// staleHandle tells whether err means that an object handle is no longer valid
+func staleHandle(err error) bool {
+	ckr, ok := ckrOf(err)
+	return ok && (ckr == pkcs11.CKR_OBJECT_HANDLE_INVALID || ckr == pkcs11.CKR_KEY_HANDLE_INVALID)
+}
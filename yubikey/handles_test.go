@@ -0,0 +1,69 @@
+package yubikey
+
+import (
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// findCtx finds a single object and counts the searches
+type findCtx struct {
+	common.IPKCS11Ctx
+	searches int
+	found    bool
+}
+
+func (c *findCtx) FindObjectsInit(pkcs11.SessionHandle, []*pkcs11.Attribute) error {
+	c.searches++
+	c.found = false
+	return nil
+}
+
+func (c *findCtx) FindObjects(pkcs11.SessionHandle, int) ([]pkcs11.ObjectHandle, bool, error) {
+	if c.found {
+		return nil, false, nil
+	}
+	c.found = true
+	return []pkcs11.ObjectHandle{pkcs11.ObjectHandle(c.searches)}, false, nil
+}
+
+func (c *findCtx) FindObjectsFinal(pkcs11.SessionHandle) error {
+	return nil
+}
+
+func TestPrivateKeyHandle(t *testing.T) {
+	defer func(ctx common.IPKCS11Ctx) { pkcs11Ctx = ctx }(pkcs11Ctx)
+	defer keyHandles.clear()
+	ctx := &findCtx{}
+	pkcs11Ctx = ctx
+
+	obj, cached, err := privateKeyHandle(1, []byte{2})
+	require.NoError(t, err)
+	require.False(t, cached)
+	again, cached, err := privateKeyHandle(1, []byte{2})
+	require.NoError(t, err)
+	require.True(t, cached)
+	require.Equal(t, obj, again)
+	require.Equal(t, 1, ctx.searches)
+
+	// another session or slot searches by itself
+	_, cached, _ = privateKeyHandle(2, []byte{2})
+	require.False(t, cached)
+	_, cached, _ = privateKeyHandle(1, []byte{3})
+	require.False(t, cached)
+
+	keyHandles.forgetSession(1)
+	_, cached, _ = privateKeyHandle(1, []byte{2})
+	require.False(t, cached, "a reopened session gets new handles")
+	_, cached, _ = privateKeyHandle(2, []byte{2})
+	require.True(t, cached)
+
+	keyHandles.forgetSlot([]byte{2})
+	_, cached, _ = privateKeyHandle(2, []byte{2})
+	require.False(t, cached, "a new key gets a new handle")
+
+	require.True(t, staleHandle(pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID)))
+	require.False(t, staleHandle(pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)))
+}
@@ -0,0 +1,61 @@
+package yubikey
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+// ValidateImportKey checks that privKey can be stored in a PIV slot before
+// anything is written to the token and returns the parsed key. The caller
+// has to wipe its D when done
+func ValidateImportKey(privKey data.PrivateKey) (*ecdsa.PrivateKey, error) {
+	if privKey == nil {
+		return nil, NewError(ErrCodeInvalidRequest, "no private key given")
+	}
+	switch algo := privKey.Algorithm(); algo {
+	case data.ECDSAKey, data.ECDSAx509Key:
+	default:
+		return nil, NewError(ErrCodeInvalidRequest, "unsupported key type %q, only ECDSA P-256 keys can be imported", algo)
+	}
+	ecdsaPrivKey, err := parseECPrivateKey(privKey.Private())
+	if err != nil {
+		return nil, err
+	}
+	if ecdsaPrivKey.Curve != elliptic.P256() {
+		wipeBigInt(ecdsaPrivKey.D)
+		return nil, NewError(ErrCodeInvalidRequest, "unsupported curve %s, only P-256 keys can be imported", ecdsaPrivKey.Curve.Params().Name)
+	}
+	return ecdsaPrivKey, nil
+}
+
+// encryptedPrivateKeyInfo is the PKCS#8 EncryptedPrivateKeyInfo, it is only
+// parsed to tell encrypted keys apart from corrupted ones
+type encryptedPrivateKeyInfo struct {
+	Algo          pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// parseECPrivateKey parses a DER encoded EC private key, either in SEC 1 or
+// in unencrypted PKCS#8 form
+func parseECPrivateKey(der []byte) (*ecdsa.PrivateKey, error) {
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err == nil {
+		if ecKey, ok := key.(*ecdsa.PrivateKey); ok {
+			return ecKey, nil
+		}
+		return nil, NewError(ErrCodeInvalidRequest, "unsupported PKCS#8 key type %T, only ECDSA P-256 keys can be imported", key)
+	}
+	var encrypted encryptedPrivateKeyInfo
+	if rest, aerr := asn1.Unmarshal(der, &encrypted); aerr == nil && len(rest) == 0 {
+		return nil, NewError(ErrCodeInvalidRequest, "encrypted PKCS#8 keys are not supported, the key has to be decrypted before it is imported")
+	}
+	return nil, NewError(ErrCodeInvalidRequest, "invalid private key encoding, expected a DER encoded SEC 1 or PKCS#8 EC key: %v", err)
+}
@@ -0,0 +1,76 @@
+package yubikey
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/tuf/data"
+	"github.com/theupdateframework/notary/tuf/utils"
+)
+
+// corruptKey claims to be an ECDSA key but holds garbage
+type corruptKey struct {
+	data.PrivateKey
+}
+
+func (corruptKey) Private() []byte {
+	return []byte("not a key")
+}
+
+func TestValidateImportKey(t *testing.T) {
+	p256, err := utils.GenerateECDSAKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := ValidateImportKey(p256)
+	require.NoError(t, err)
+	require.Equal(t, elliptic.P256(), key.Curve)
+
+	ed25519, err := utils.GenerateED25519Key(rand.Reader)
+	require.NoError(t, err)
+	_, err = ValidateImportKey(ed25519)
+	require.Equal(t, ErrCodeInvalidRequest, ErrorCodeOf(err))
+	require.Contains(t, err.Error(), "unsupported key type")
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	p384, err := utils.ECDSAToPrivateKey(ecKey)
+	require.NoError(t, err)
+	_, err = ValidateImportKey(p384)
+	require.Equal(t, ErrCodeInvalidRequest, ErrorCodeOf(err))
+	require.Contains(t, err.Error(), "unsupported curve P-384")
+
+	_, err = ValidateImportKey(corruptKey{p256})
+	require.Equal(t, ErrCodeInvalidRequest, ErrorCodeOf(err))
+	require.Contains(t, err.Error(), "invalid private key encoding")
+}
+
+func TestParseECPrivateKeyPKCS8(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	require.NoError(t, err)
+	key, err := parseECPrivateKey(der)
+	require.NoError(t, err)
+	require.Equal(t, ecKey.D, key.D)
+
+	der, err = x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	key, err = parseECPrivateKey(der)
+	require.NoError(t, err)
+	require.Equal(t, ecKey.D, key.D)
+
+	encrypted, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algo:          pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}},
+		EncryptedData: []byte("ciphertext"),
+	})
+	require.NoError(t, err)
+	_, err = parseECPrivateKey(encrypted)
+	require.Equal(t, ErrCodeInvalidRequest, ErrorCodeOf(err))
+	require.Contains(t, err.Error(), "encrypted PKCS#8")
+}
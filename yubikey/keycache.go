@@ -0,0 +1,215 @@
+package yubikey
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+// keyCacheVersion is raised on incompatible changes of the cache file, files
+// of other versions are ignored
+const keyCacheVersion = 1
+
+// keyCacheFile is the content of the cache file
+type keyCacheFile struct {
+	Version int `json:"version"`
+	// Tokens maps the serial numbers of the yubikeys to their keys
+	Tokens map[string]cachedKeys `json:"tokens"`
+}
+
+// cachedKeys are the keys found on a yubikey. They are valid as long as the
+// objects on the yubikey and the slot mappings yield the same Generation
+type cachedKeys struct {
+	Generation string               `json:"generation"`
+	Keys       map[string]cachedKey `json:"keys"`
+}
+
+// cachedKey is a common.HardwareSlot, the slot ID is the hex encoded CKA_ID.
+// PublicKey is the hex encoded DER of the public key
+type cachedKey struct {
+	SlotID    string `json:"slot_id"`
+	Role      string `json:"role"`
+	KeyID     string `json:"key_id,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+}
+
+// keyCache keeps the keys of the yubikeys in a file, so a restarted daemon
+// does not have to read and parse every certificate before it can sign
+type keyCache struct {
+	sync.Mutex
+	path   string
+	tokens map[string]cachedKeys
+}
+
+var keyMapCache = &keyCache{tokens: make(map[string]cachedKeys)}
+
+// SetKeyCache keeps the keys found on the yubikeys in the file at path. An
+// empty path disables the cache, a file which can not be parsed is ignored
+func SetKeyCache(path string) error {
+	keyMapCache.Lock()
+	defer keyMapCache.Unlock()
+	keyMapCache.path = path
+	keyMapCache.tokens = make(map[string]cachedKeys)
+	if path == "" {
+		return nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return NewError(ErrCodeInvalidRequest, "failed to read the key cache: %v", err)
+	}
+	var f keyCacheFile
+	if err := json.Unmarshal(raw, &f); err != nil || f.Version != keyCacheVersion {
+		logrus.Warnf("Ignoring the key cache %s, it is invalid or of another version", path)
+		return nil
+	}
+	for serial, cached := range f.Tokens {
+		keyMapCache.tokens[serial] = cached
+	}
+	return nil
+}
+
+func (c *keyCache) enabled() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.path != ""
+}
+
+// lookup returns the keys of the yubikey with serial, if they were cached
+// for the same generation
+func (c *keyCache) lookup(serial, generation string) (map[string]common.HardwareSlot, bool) {
+	c.Lock()
+	defer c.Unlock()
+	cached, ok := c.tokens[serial]
+	if !ok || cached.Generation != generation {
+		return nil, false
+	}
+	found := make(map[string]common.HardwareSlot, len(cached.Keys))
+	for keyID, key := range cached.Keys {
+		slotID, err := hex.DecodeString(key.SlotID)
+		if err != nil {
+			return nil, false
+		}
+		found[keyID] = common.HardwareSlot{Role: data.RoleName(key.Role), SlotID: slotID, KeyID: key.KeyID}
+		if der, err := hex.DecodeString(key.PublicKey); err == nil && len(der) > 0 {
+			listedKeys.set(keyID, der)
+		}
+	}
+	return found, true
+}
+
+// store caches the keys of the yubikey with serial
+func (c *keyCache) store(serial, generation string, found map[string]common.HardwareSlot) {
+	c.Lock()
+	defer c.Unlock()
+	cached := cachedKeys{Generation: generation, Keys: make(map[string]cachedKey, len(found))}
+	for keyID, slot := range found {
+		cached.Keys[keyID] = cachedKey{SlotID: hex.EncodeToString(slot.SlotID), Role: slot.Role.String(), KeyID: slot.KeyID, PublicKey: hex.EncodeToString(listedKeys.get(keyID))}
+	}
+	c.tokens[serial] = cached
+	c.save()
+}
+
+// forget drops the cached keys of all yubikeys. The daemon calls it whenever
+// it changes keys or certificates, even if the change failed halfway
+func (c *keyCache) forget() {
+	c.Lock()
+	defer c.Unlock()
+	if c.path == "" || len(c.tokens) == 0 {
+		return
+	}
+	c.tokens = make(map[string]cachedKeys)
+	c.save()
+}
+
+// save replaces the cache file, the lock has to be held
+func (c *keyCache) save() {
+	raw, err := json.Marshal(keyCacheFile{Version: keyCacheVersion, Tokens: c.tokens})
+	if err != nil {
+		logrus.Warnf("Failed to encode the key cache: %v", err)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		logrus.Warnf("Failed to write the key cache: %v", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(raw)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		logrus.Warnf("Failed to write the key cache: %v", err)
+	}
+}
+
+// cacheKey returns the serial number of the token in slot and the generation
+// of its objects. The generation is empty if the token can not be cached
+func (ks *KeyStore) cacheKey(slot uint, session pkcs11.SessionHandle, objs []pkcs11.ObjectHandle) (string, string) {
+	info, err := pkcs11Ctx.GetTokenInfo(slot)
+	if err != nil {
+		logrus.Debugf("Not using the key cache, the token info is unknown: %v", err)
+		return "", ""
+	}
+	generation, err := ks.keyGeneration(session, objs)
+	if err != nil {
+		logrus.Debugf("Not using the key cache, the objects can not be identified: %v", err)
+		return "", ""
+	}
+	return strings.TrimSpace(info.SerialNumber), generation
+}
+
+// keyGeneration fingerprints the certificate objects of a yubikey by their
+// IDs and values together with the slot mappings of the config, so a
+// certificate replaced in the same slot by another tool invalidates the
+// cached keys. Hashing the values is still cheaper than parsing them
+func (ks *KeyStore) keyGeneration(session pkcs11.SessionHandle, objs []pkcs11.ObjectHandle) (string, error) {
+	ids := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		attr, err := pkcs11Ctx.GetAttributeValue(session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_ID, []byte{0}),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, []byte{0}),
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(attr) != 2 {
+			return "", fmt.Errorf("no ID or value for object %d", obj)
+		}
+		value := sha256.Sum256(attr[1].Value)
+		ids = append(ids, hex.EncodeToString(attr[0].Value)+" "+hex.EncodeToString(value[:]))
+	}
+	sort.Strings(ids)
+	h := sha256.New()
+	for _, id := range ids {
+		fmt.Fprintf(h, "object %s\n", id)
+	}
+	mapped := make([]int, 0, len(ks.mapped))
+	for slot := range ks.mapped {
+		mapped = append(mapped, int(slot))
+	}
+	sort.Ints(mapped)
+	for _, slot := range mapped {
+		m := ks.mapped[byte(slot)]
+		fmt.Fprintf(h, "mapping %02x %s %s\n", slot, m.Role, m.KeyID)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
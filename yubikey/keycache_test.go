@@ -0,0 +1,75 @@
+package yubikey
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+func TestKeyCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keycache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer SetKeyCache("")
+
+	path := filepath.Join(dir, "keys.json")
+	require.NoError(t, SetKeyCache(path))
+	require.True(t, keyMapCache.enabled())
+
+	found := map[string]common.HardwareSlot{
+		"abc": {Role: data.CanonicalRootRole, SlotID: []byte{2}, KeyID: "abc"},
+	}
+	listedKeys.set("abc", []byte{0x30, 0x59})
+	keyMapCache.store("123", "gen1", found)
+	cached, ok := keyMapCache.lookup("123", "gen1")
+	require.True(t, ok)
+	require.Equal(t, found, cached)
+
+	_, ok = keyMapCache.lookup("123", "gen2")
+	require.False(t, ok, "a new generation invalidates the keys")
+	_, ok = keyMapCache.lookup("456", "gen1")
+	require.False(t, ok, "the keys of another token are not cached")
+
+	// a restarted daemon finds the keys and their public keys in the file
+	listedKeys = &publicKeys{byID: make(map[string][]byte)}
+	require.NoError(t, SetKeyCache(path))
+	cached, ok = keyMapCache.lookup("123", "gen1")
+	require.True(t, ok)
+	require.Equal(t, found, cached)
+	require.Equal(t, []byte{0x30, 0x59}, listedKeys.get("abc"))
+
+	keyMapCache.forget()
+	require.NoError(t, SetKeyCache(path))
+	_, ok = keyMapCache.lookup("123", "gen1")
+	require.False(t, ok)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("garbage"), 0600))
+	require.NoError(t, SetKeyCache(path), "an invalid cache is ignored")
+}
+
+func TestKeyGeneration(t *testing.T) {
+	e, restore := newMockEnv(t)
+	defer restore()
+	slotID := byte(slotIDs[0])
+	e.addKey(t, slotID)
+
+	generation := func() string {
+		objs, err := e.ks.listObjects(e.session)
+		require.NoError(t, err)
+		gen, err := e.ks.keyGeneration(e.session, objs)
+		require.NoError(t, err)
+		return gen
+	}
+	before := generation()
+	require.Equal(t, before, generation())
+
+	// another tool replaces the certificate, keeping the slot
+	e.setAttribute(t, slotID, pkcs11.CKO_CERTIFICATE, pkcs11.CKA_VALUE, []byte("another certificate"))
+	require.NotEqual(t, before, generation())
+}
@@ -0,0 +1,727 @@
+package yubikey
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/externalstore"
+	"github.com/theupdateframework/notary/tuf/data"
+	"github.com/theupdateframework/notary/tuf/utils"
+)
+
+// mockEnv is a KeyStore with a session on a fresh mock token
+type mockEnv struct {
+	ks      *KeyStore
+	token   *mockToken
+	session pkcs11.SessionHandle
+	slot    common.HardwareSlot
+}
+
+// useMockToken makes the package use a fresh mock token which does not wait
+// between retries, until the returned function is called
+func useMockToken() (*mockToken, func()) {
+	ctx, lib := pkcs11Ctx, pkcs11Lib
+	token := newMockToken()
+	pkcs11Ctx, pkcs11Lib = token, "mock"
+	sleep = func(time.Duration) {}
+	return token, func() {
+		Cleanup()
+		pkcs11Ctx, pkcs11Lib = ctx, lib
+		sleep = time.Sleep
+	}
+}
+
+func newMockEnv(t *testing.T) (*mockEnv, func()) {
+	token, restore := useMockToken()
+	e := &mockEnv{
+		ks:    &KeyStore{reserved: make(map[byte]bool)},
+		token: token,
+		slot:  common.HardwareSlot{SlotID: []byte{byte(slotIDs[0])}, Role: data.CanonicalRootRole},
+	}
+	var err error
+	e.session, err = e.ks.SetupHSMEnv()
+	if err != nil {
+		restore()
+		t.Fatalf("failed to open a session on the mock token: %v", err)
+	}
+	return e, restore
+}
+
+// addKey stores a new key in slotID
+func (e *mockEnv) addKey(t *testing.T, slotID byte) data.PrivateKey {
+	key, err := utils.GenerateECDSAKey(rand.Reader)
+	require.NoError(t, err)
+	slot := common.HardwareSlot{SlotID: []byte{slotID}, Role: data.CanonicalRootRole}
+	require.NoError(t, e.ks.AddECDSAKeyWithOptions(e.session, key, slot, mockManagementKey, slot.Role, backend.AddKeyOptions{Overwrite: true}))
+	return key
+}
+
+// objects returns the objects in slotID, of the given class if it is set
+func (e *mockEnv) objects(slotID byte, class ...uint) []*mockObject {
+	e.token.Lock()
+	defer e.token.Unlock()
+	var objs []*mockObject
+	for _, obj := range e.token.objects {
+		if !bytes.Equal(obj.attrs[pkcs11.CKA_ID], []byte{slotID}) {
+			continue
+		}
+		if len(class) > 0 && !bytes.Equal(obj.attrs[pkcs11.CKA_CLASS], pkcs11.NewAttribute(pkcs11.CKA_CLASS, class[0]).Value) {
+			continue
+		}
+		objs = append(objs, obj)
+	}
+	return objs
+}
+
+// setAttribute changes an attribute of the object of class in slotID, a nil
+// value removes it
+func (e *mockEnv) setAttribute(t *testing.T, slotID byte, class, attr uint, value []byte) {
+	objs := e.objects(slotID, class)
+	require.Len(t, objs, 1)
+	e.token.Lock()
+	defer e.token.Unlock()
+	if value == nil {
+		delete(objs[0].attrs, attr)
+		return
+	}
+	objs[0].attrs[attr] = value
+}
+
+// loggedOut tells whether nobody is logged in to the token anymore
+func (e *mockEnv) loggedOut() bool {
+	e.token.Lock()
+	defer e.token.Unlock()
+	return e.token.user == ^uint(0)
+}
+
+// codeOf returns the code a client sees for err, the server classifies the
+// plain pkcs11 errors
+func codeOf(err error) ErrorCode {
+	if err == nil {
+		return ""
+	}
+	return ErrorCodeOf(WrapError(ErrCodeUnknown, err))
+}
+
+func ckr(code uint) error {
+	return pkcs11.Error(code)
+}
+
+func TestAddECDSAKeyFailures(t *testing.T) {
+	slotID := byte(slotIDs[0])
+	cases := []struct {
+		name          string
+		prepare       func(t *testing.T, e *mockEnv)
+		managementKey string
+		overwrite     bool
+		code          ErrorCode
+		// objects is how many objects the slot holds afterwards
+		objects int
+	}{
+		{name: "empty slot", objects: 3},
+		{name: "wrong management key", managementKey: "000000", code: ErrCodeWrongPin},
+		{
+			name:    "management key locked",
+			prepare: func(t *testing.T, e *mockEnv) { e.token.soRetries = 0 },
+			code:    ErrCodePinLocked,
+		},
+		{
+			name:    "reserved slot",
+			prepare: func(t *testing.T, e *mockEnv) { e.ks.reserved[slotID] = true },
+			code:    ErrCodePolicyDenied,
+		},
+		{
+			name:    "occupied slot",
+			prepare: func(t *testing.T, e *mockEnv) { e.addKey(t, slotID) },
+			code:    ErrCodeSlotOccupied,
+			objects: 3,
+		},
+		{
+			name:      "overwrite",
+			prepare:   func(t *testing.T, e *mockEnv) { e.addKey(t, slotID) },
+			overwrite: true,
+			objects:   3,
+		},
+		{
+			name: "overwritten key not destroyed",
+			prepare: func(t *testing.T, e *mockEnv) {
+				e.addKey(t, slotID)
+				e.token.failNext("DestroyObject", ckr(pkcs11.CKR_DEVICE_ERROR))
+			},
+			overwrite: true,
+			code:      ErrCodeDevice,
+			objects:   3,
+		},
+		{
+			name:    "token removed while searching the slot",
+			prepare: func(t *testing.T, e *mockEnv) { e.token.failNext("FindObjectsInit", ckr(pkcs11.CKR_DEVICE_REMOVED)) },
+			code:    ErrCodeNoToken,
+		},
+		{
+			name:    "certificate not stored",
+			prepare: func(t *testing.T, e *mockEnv) { e.token.failNext("CreateObject", ckr(pkcs11.CKR_DEVICE_MEMORY)) },
+			code:    ErrCodeDevice,
+		},
+		{
+			name: "key rejected",
+			prepare: func(t *testing.T, e *mockEnv) {
+				e.token.failNext("CreateObject", nil, ckr(pkcs11.CKR_TEMPLATE_INCONSISTENT))
+			},
+			code: ErrCodeInvalidRequest,
+		},
+		{
+			name: "key rejected after overwriting",
+			prepare: func(t *testing.T, e *mockEnv) {
+				e.addKey(t, slotID)
+				e.token.failNext("CreateObject", nil, ckr(pkcs11.CKR_DEVICE_MEMORY))
+			},
+			overwrite: true,
+			code:      ErrCodeDevice,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e, restore := newMockEnv(t)
+			defer restore()
+			if c.prepare != nil {
+				c.prepare(t, e)
+			}
+			managementKey := c.managementKey
+			if managementKey == "" {
+				managementKey = mockManagementKey
+			}
+			key, err := utils.GenerateECDSAKey(rand.Reader)
+			require.NoError(t, err)
+
+			err = e.ks.AddECDSAKeyWithOptions(e.session, key, e.slot, managementKey, e.slot.Role, backend.AddKeyOptions{Overwrite: c.overwrite})
+			require.Equal(t, c.code, codeOf(err), "%v", err)
+			require.Len(t, e.objects(slotID), c.objects)
+			require.True(t, e.loggedOut())
+			if c.code == "" {
+				pub, _, err := e.ks.GetECDSAKey(e.session, e.slot, "")
+				require.NoError(t, err)
+				require.Equal(t, key.ID(), pub.ID())
+			}
+		})
+	}
+}
+
+func TestGetECDSAKeyFailures(t *testing.T) {
+	slotID := byte(slotIDs[0])
+	cases := []struct {
+		name    string
+		prepare func(t *testing.T, e *mockEnv)
+		code    ErrorCode
+		// attrCalls is how often the public key was read
+		attrCalls int
+	}{
+		{name: "stored key", attrCalls: 1},
+		{
+			name: "empty slot",
+			prepare: func(t *testing.T, e *mockEnv) {
+				e.setAttribute(t, slotID, pkcs11.CKO_PUBLIC_KEY, pkcs11.CKA_ID, []byte{slotID + 1})
+			},
+			code: ErrCodeKeyNotFound,
+		},
+		{
+			name: "truncated point",
+			prepare: func(t *testing.T, e *mockEnv) {
+				e.setAttribute(t, slotID, pkcs11.CKO_PUBLIC_KEY, pkcs11.CKA_EC_POINT, []byte{0x04, 0x41, 0x04, 0x01})
+			},
+			code:      ErrCodeDevice,
+			attrCalls: 1,
+		},
+		{
+			name: "empty point",
+			prepare: func(t *testing.T, e *mockEnv) {
+				e.setAttribute(t, slotID, pkcs11.CKO_PUBLIC_KEY, pkcs11.CKA_EC_POINT, []byte{})
+			},
+			code:      ErrCodeDevice,
+			attrCalls: 1,
+		},
+		{
+			name: "point not on the curve",
+			prepare: func(t *testing.T, e *mockEnv) {
+				point := append([]byte{0x04, 0x41, 0x04}, bytes.Repeat([]byte{0x01}, 64)...)
+				e.setAttribute(t, slotID, pkcs11.CKO_PUBLIC_KEY, pkcs11.CKA_EC_POINT, point)
+			},
+			code:      ErrCodeDevice,
+			attrCalls: 1,
+		},
+		{
+			name: "point missing",
+			prepare: func(t *testing.T, e *mockEnv) {
+				e.setAttribute(t, slotID, pkcs11.CKO_PUBLIC_KEY, pkcs11.CKA_EC_POINT, nil)
+			},
+			code:      ErrCodeDevice,
+			attrCalls: 1,
+		},
+		{
+			name:      "transient error",
+			prepare:   func(t *testing.T, e *mockEnv) { e.token.failNext("GetAttributeValue", ckr(pkcs11.CKR_DEVICE_ERROR)) },
+			attrCalls: 2,
+		},
+		{
+			name: "persistent error",
+			prepare: func(t *testing.T, e *mockEnv) {
+				e.token.failNext("GetAttributeValue", ckr(pkcs11.CKR_FUNCTION_FAILED), ckr(pkcs11.CKR_FUNCTION_FAILED), ckr(pkcs11.CKR_FUNCTION_FAILED))
+			},
+			code:      ErrCodeDevice,
+			attrCalls: retryAttempts,
+		},
+		{
+			name:    "token removed",
+			prepare: func(t *testing.T, e *mockEnv) { e.token.failNext("FindObjectsInit", ckr(pkcs11.CKR_DEVICE_REMOVED)) },
+			code:    ErrCodeNoToken,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e, restore := newMockEnv(t)
+			defer restore()
+			key := e.addKey(t, slotID)
+			if c.prepare != nil {
+				c.prepare(t, e)
+			}
+			before := e.token.callCount("GetAttributeValue")
+
+			pub, role, err := e.ks.GetECDSAKey(e.session, e.slot, "")
+			require.Equal(t, c.code, codeOf(err), "%v", err)
+			require.Equal(t, c.attrCalls, e.token.callCount("GetAttributeValue")-before)
+			if c.code == "" {
+				require.Equal(t, key.ID(), pub.ID())
+				require.Equal(t, data.CanonicalRootRole, role)
+			}
+		})
+	}
+}
+
+func TestSignFailures(t *testing.T) {
+	slotID := byte(slotIDs[0])
+	cases := []struct {
+		name    string
+		prepare func(t *testing.T, e *mockEnv)
+		pin     string
+		code    ErrorCode
+		// signCalls is how often the token was asked for a signature
+		signCalls int
+	}{
+		{name: "stored key", signCalls: 1},
+		{name: "wrong PIN", pin: "000000", code: ErrCodeWrongPin},
+		{
+			name:    "PIN locked",
+			prepare: func(t *testing.T, e *mockEnv) { e.token.pinRetries = 0 },
+			code:    ErrCodePinLocked,
+		},
+		{
+			name: "no key",
+			prepare: func(t *testing.T, e *mockEnv) {
+				e.setAttribute(t, slotID, pkcs11.CKO_PRIVATE_KEY, pkcs11.CKA_ID, []byte{slotID + 1})
+			},
+			code: ErrCodeKeyNotFound,
+		},
+		{
+			name: "unsupported curve",
+			prepare: func(t *testing.T, e *mockEnv) {
+				e.setAttribute(t, slotID, pkcs11.CKO_PRIVATE_KEY, pkcs11.CKA_EC_PARAMS, []byte{0x06, 0x01, 0x00})
+			},
+			code: ErrCodeInvalidRequest,
+		},
+		{
+			name: "curve unknown",
+			prepare: func(t *testing.T, e *mockEnv) {
+				e.setAttribute(t, slotID, pkcs11.CKO_PRIVATE_KEY, pkcs11.CKA_EC_PARAMS, nil)
+			},
+			code: ErrCodeDevice,
+		},
+		{
+			name:      "transient error on init",
+			prepare:   func(t *testing.T, e *mockEnv) { e.token.failNext("SignInit", ckr(pkcs11.CKR_DEVICE_ERROR)) },
+			signCalls: 1,
+		},
+		{
+			name:    "mechanism rejected",
+			prepare: func(t *testing.T, e *mockEnv) { e.token.failNext("SignInit", ckr(pkcs11.CKR_MECHANISM_INVALID)) },
+			code:    ErrCodeDevice,
+		},
+		{
+			name:      "transient error on sign",
+			prepare:   func(t *testing.T, e *mockEnv) { e.token.failNext("Sign", ckr(pkcs11.CKR_FUNCTION_FAILED)) },
+			signCalls: 2,
+		},
+		{
+			name: "persistent error on sign",
+			prepare: func(t *testing.T, e *mockEnv) {
+				e.token.failNext("Sign", ckr(pkcs11.CKR_DEVICE_ERROR), ckr(pkcs11.CKR_DEVICE_ERROR), ckr(pkcs11.CKR_DEVICE_ERROR))
+			},
+			code:      ErrCodeDevice,
+			signCalls: retryAttempts,
+		},
+		{
+			name:    "token removed",
+			prepare: func(t *testing.T, e *mockEnv) { e.token.failNext("Login", ckr(pkcs11.CKR_DEVICE_REMOVED)) },
+			code:    ErrCodeNoToken,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e, restore := newMockEnv(t)
+			defer restore()
+			e.addKey(t, slotID)
+			if c.prepare != nil {
+				c.prepare(t, e)
+			}
+			pin := c.pin
+			if pin == "" {
+				pin = mockPIN
+			}
+			before := e.token.callCount("Sign")
+
+			sig, err := e.ks.Sign(e.session, e.slot, pin, []byte("payload"))
+			require.Equal(t, c.code, codeOf(err), "%v", err)
+			require.Equal(t, c.signCalls, e.token.callCount("Sign")-before)
+			require.True(t, e.loggedOut())
+			if c.code == "" {
+				require.NotEmpty(t, sig)
+			}
+		})
+	}
+}
+
+func TestSignLocksPIN(t *testing.T) {
+	e, restore := newMockEnv(t)
+	defer restore()
+	e.addKey(t, byte(slotIDs[0]))
+
+	for i := 0; i < mockPinRetries; i++ {
+		_, err := e.ks.Sign(e.session, e.slot, "000000", []byte("payload"))
+		require.Equal(t, ErrCodeWrongPin, codeOf(err))
+	}
+	// only the wrong PINs were tried, none of them twice
+	require.Equal(t, mockPinRetries, e.token.callCount("Login")-1)
+	_, err := e.ks.Sign(e.session, e.slot, mockPIN, []byte("payload"))
+	require.Equal(t, ErrCodePinLocked, codeOf(err))
+}
+
+func TestHardwareRemoveKeyFailures(t *testing.T) {
+	slotID := byte(slotIDs[0])
+	cases := []struct {
+		name          string
+		prepare       func(t *testing.T, e *mockEnv)
+		managementKey string
+		code          ErrorCode
+		objects       int
+	}{
+		{name: "stored key"},
+		{name: "wrong management key", managementKey: "000000", code: ErrCodeWrongPin, objects: 3},
+		{
+			name:    "reserved slot",
+			prepare: func(t *testing.T, e *mockEnv) { e.ks.reserved[slotID] = true },
+			code:    ErrCodePolicyDenied,
+			objects: 3,
+		},
+		{
+			name: "no certificate",
+			prepare: func(t *testing.T, e *mockEnv) {
+				e.setAttribute(t, slotID, pkcs11.CKO_CERTIFICATE, pkcs11.CKA_ID, []byte{slotID + 1})
+			},
+			code:    ErrCodeKeyNotFound,
+			objects: 2,
+		},
+		{
+			name:    "certificate not destroyed",
+			prepare: func(t *testing.T, e *mockEnv) { e.token.failNext("DestroyObject", ckr(pkcs11.CKR_DEVICE_ERROR)) },
+			code:    ErrCodeDevice,
+			objects: 3,
+		},
+		{
+			name:    "key not destroyed",
+			prepare: func(t *testing.T, e *mockEnv) { e.token.failNext("DestroyObject", nil, ckr(pkcs11.CKR_DEVICE_ERROR)) },
+			code:    ErrCodeDevice,
+			objects: 2,
+		},
+		{
+			name:    "token removed",
+			prepare: func(t *testing.T, e *mockEnv) { e.token.failNext("FindObjectsInit", ckr(pkcs11.CKR_TOKEN_NOT_PRESENT)) },
+			code:    ErrCodeNoToken,
+			objects: 3,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e, restore := newMockEnv(t)
+			defer restore()
+			key := e.addKey(t, slotID)
+			if c.prepare != nil {
+				c.prepare(t, e)
+			}
+			managementKey := c.managementKey
+			if managementKey == "" {
+				managementKey = mockManagementKey
+			}
+
+			err := e.ks.HardwareRemoveKey(e.session, e.slot, managementKey, key.ID())
+			require.Equal(t, c.code, codeOf(err), "%v", err)
+			require.Len(t, e.objects(slotID), c.objects)
+			require.True(t, e.loggedOut())
+		})
+	}
+}
+
+func TestHardwareListKeysFailures(t *testing.T) {
+	first, second := byte(slotIDs[0]), byte(slotIDs[1])
+	cases := []struct {
+		name    string
+		prepare func(t *testing.T, e *mockEnv)
+		code    ErrorCode
+		// slots are the slots of the keys listed
+		slots []byte
+	}{
+		{name: "stored keys", slots: []byte{first, second}},
+		{
+			name: "empty token",
+			prepare: func(t *testing.T, e *mockEnv) {
+				require.NoError(t, e.ks.HardwareRemoveKey(e.session, common.HardwareSlot{SlotID: []byte{first}}, mockManagementKey, ""))
+				require.NoError(t, e.ks.HardwareRemoveKey(e.session, common.HardwareSlot{SlotID: []byte{second}}, mockManagementKey, ""))
+			},
+			code: ErrCodeKeyNotFound,
+		},
+		{
+			name: "malformed certificate",
+			prepare: func(t *testing.T, e *mockEnv) {
+				e.setAttribute(t, first, pkcs11.CKO_CERTIFICATE, pkcs11.CKA_VALUE, []byte("not a certificate"))
+			},
+			slots: []byte{second},
+		},
+		{
+			name: "certificate without value",
+			prepare: func(t *testing.T, e *mockEnv) {
+				e.setAttribute(t, second, pkcs11.CKO_CERTIFICATE, pkcs11.CKA_VALUE, nil)
+			},
+			slots: []byte{first},
+		},
+		{
+			name:    "transient error",
+			prepare: func(t *testing.T, e *mockEnv) { e.token.failNext("FindObjects", ckr(pkcs11.CKR_DEVICE_ERROR)) },
+			slots:   []byte{first, second},
+		},
+		{
+			name: "persistent error",
+			prepare: func(t *testing.T, e *mockEnv) {
+				e.token.failNext("FindObjectsInit", ckr(pkcs11.CKR_DEVICE_ERROR), ckr(pkcs11.CKR_DEVICE_ERROR), ckr(pkcs11.CKR_DEVICE_ERROR))
+			},
+			code: ErrCodeDevice,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e, restore := newMockEnv(t)
+			defer restore()
+			e.addKey(t, first)
+			e.addKey(t, second)
+			if c.prepare != nil {
+				c.prepare(t, e)
+			}
+
+			keys, err := e.ks.HardwareListKeys(e.session)
+			require.Equal(t, c.code, codeOf(err), "%v", err)
+			var slots []byte
+			for _, slot := range keys {
+				require.Equal(t, data.CanonicalRootRole, slot.Role)
+				slots = append(slots, slot.SlotID...)
+			}
+			require.ElementsMatch(t, c.slots, slots)
+		})
+	}
+}
+
+func TestGetNextEmptySlotFailures(t *testing.T) {
+	cases := []struct {
+		name    string
+		prepare func(t *testing.T, e *mockEnv)
+		code    ErrorCode
+		slot    []byte
+	}{
+		{name: "empty token", slot: []byte{byte(slotIDs[0])}},
+		{
+			name:    "first slot taken",
+			prepare: func(t *testing.T, e *mockEnv) { e.addKey(t, byte(slotIDs[0])) },
+			slot:    []byte{byte(slotIDs[1])},
+		},
+		{
+			name: "all slots taken",
+			prepare: func(t *testing.T, e *mockEnv) {
+				for _, slot := range slotIDs {
+					e.addKey(t, byte(slot))
+				}
+			},
+			code: ErrCodeNoSlot,
+		},
+		{
+			name: "remaining slot reserved",
+			prepare: func(t *testing.T, e *mockEnv) {
+				for _, slot := range slotIDs[:len(slotIDs)-1] {
+					e.addKey(t, byte(slot))
+				}
+				e.ks.reserved[byte(slotIDs[len(slotIDs)-1])] = true
+			},
+			code: ErrCodeNoSlot,
+		},
+		{
+			name: "malformed slot ids",
+			prepare: func(t *testing.T, e *mockEnv) {
+				e.addKey(t, byte(slotIDs[0]))
+				e.setAttribute(t, byte(slotIDs[0]), pkcs11.CKO_PUBLIC_KEY, pkcs11.CKA_ID, []byte{})
+				e.setAttribute(t, byte(slotIDs[0]), pkcs11.CKO_CERTIFICATE, pkcs11.CKA_ID, []byte{numSlots})
+			},
+			// the private key still takes the first slot
+			slot: []byte{byte(slotIDs[1])},
+		},
+		{
+			name:    "transient error",
+			prepare: func(t *testing.T, e *mockEnv) { e.token.failNext("FindObjects", ckr(pkcs11.CKR_FUNCTION_FAILED)) },
+			slot:    []byte{byte(slotIDs[0])},
+		},
+		{
+			name:    "token removed",
+			prepare: func(t *testing.T, e *mockEnv) { e.token.failNext("FindObjectsInit", ckr(pkcs11.CKR_DEVICE_REMOVED)) },
+			code:    ErrCodeNoToken,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e, restore := newMockEnv(t)
+			defer restore()
+			if c.prepare != nil {
+				c.prepare(t, e)
+			}
+
+			slot, err := e.ks.GetNextEmptySlot(e.session)
+			require.Equal(t, c.code, codeOf(err), "%v", err)
+			require.Equal(t, c.slot, slot)
+		})
+	}
+}
+
+func TestSetupHSMEnvFailures(t *testing.T) {
+	cases := []struct {
+		name    string
+		prepare func(token *mockToken)
+		code    ErrorCode
+	}{
+		{name: "token present"},
+		{
+			name:    "slots not listed",
+			prepare: func(token *mockToken) { token.failNext("GetSlotList", ckr(pkcs11.CKR_FUNCTION_FAILED)) },
+			code:    ErrCodeDevice,
+		},
+		{
+			name:    "too many sessions",
+			prepare: func(token *mockToken) { token.failNext("OpenSession", ckr(pkcs11.CKR_SESSION_COUNT)) },
+			code:    ErrCodeDevice,
+		},
+		{
+			name:    "token removed",
+			prepare: func(token *mockToken) { token.failNext("OpenSession", ckr(pkcs11.CKR_TOKEN_NOT_PRESENT)) },
+			code:    ErrCodeNoToken,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			token, restore := useMockToken()
+			defer restore()
+			if c.prepare != nil {
+				c.prepare(token)
+			}
+
+			ks := &KeyStore{reserved: make(map[byte]bool)}
+			session, err := ks.SetupHSMEnv()
+			require.Equal(t, c.code, codeOf(err), "%v", err)
+			if c.code == "" {
+				ks.CloseSession(session)
+				require.Empty(t, token.sessions)
+			}
+		})
+	}
+}
+
+func TestSetupHSMEnvSessionExhaustion(t *testing.T) {
+	_, restore := useMockToken()
+	defer restore()
+	ks := &KeyStore{reserved: make(map[byte]bool)}
+
+	for i := 0; i < mockMaxSessions; i++ {
+		_, err := ks.SetupHSMEnv()
+		require.NoError(t, err)
+	}
+	_, err := ks.SetupHSMEnv()
+	require.Equal(t, ErrCodeDevice, codeOf(err))
+	ckr, ok := CKROf(err)
+	require.True(t, ok)
+	require.Equal(t, uint(pkcs11.CKR_SESSION_COUNT), ckr)
+}
+
+func TestNeedLogin(t *testing.T) {
+	cases := []struct {
+		function uint
+		login    bool
+		userType uint
+		code     ErrorCode
+	}{
+		{function: externalstore.FUNCTION_ADDECDSAKEY, login: true, userType: pkcs11.CKU_SO},
+		{function: externalstore.FUNCTION_GETECDSAKEY},
+		{function: externalstore.FUNCTION_SIGN, login: true, userType: pkcs11.CKU_USER},
+		{function: externalstore.FUNCTION_HARDWAREREMOVEKEY, login: true, userType: pkcs11.CKU_SO},
+		{function: 1 << 10, login: true, userType: pkcs11.CKU_CONTEXT_SPECIFIC, code: ErrCodeInvalidRequest},
+	}
+	ks := &KeyStore{}
+	for _, c := range cases {
+		login, userType, err := ks.NeedLogin(c.function)
+		require.Equal(t, c.code, ErrorCodeOf(err), "function %d", c.function)
+		require.Equal(t, c.login, login, "function %d", c.function)
+		require.Equal(t, c.userType, userType, "function %d", c.function)
+	}
+}
+
+func TestGenericToken(t *testing.T) {
+	token, restore := useMockToken()
+	defer restore()
+	token.generic = true
+	ks := &KeyStore{reserved: make(map[byte]bool)}
+	session, err := ks.SetupHSMEnv()
+	require.NoError(t, err)
+	slot := common.HardwareSlot{SlotID: []byte{byte(slotIDs[0])}, Role: data.CanonicalRootRole}
+	key, err := utils.GenerateECDSAKey(rand.Reader)
+	require.NoError(t, err)
+
+	// the user manages the keys of a generic token, not the SO
+	require.Equal(t, ErrCodeWrongPin, codeOf(ks.AddECDSAKey(session, key, slot, mockManagementKey, slot.Role)))
+	require.NoError(t, ks.AddECDSAKey(session, key, slot, mockPIN, slot.Role))
+
+	pub, _, err := ks.GetECDSAKey(session, slot, "")
+	require.NoError(t, err)
+	require.Equal(t, key.ID(), pub.ID())
+	keys, err := ks.HardwareListKeys(session)
+	require.NoError(t, err)
+	require.Equal(t, map[string]common.HardwareSlot{key.ID(): {Role: data.CanonicalRootRole, SlotID: slot.SlotID}}, keys)
+	next, err := ks.GetNextEmptySlot(session)
+	require.NoError(t, err)
+	require.Equal(t, []byte{byte(slotIDs[1])}, next)
+	// the hidden private key does not make the slot look interrupted
+	repairs, err := ks.RecoverSlots(session, mockPIN, "", func(backend.SlotRepair) bool { return false })
+	require.NoError(t, err)
+	require.Empty(t, repairs)
+
+	sig, err := ks.Sign(session, slot, mockPIN, []byte("payload"))
+	require.NoError(t, err)
+	require.Len(t, sig, 64)
+
+	require.NoError(t, ks.HardwareRemoveKey(session, slot, mockPIN, key.ID()))
+	require.Empty(t, token.objects)
+}
@@ -0,0 +1,190 @@
+package yubikey
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// libraryPaths are paths and glob patterns of the config, searched
+	// before possiblePkcs11Libs
+	libraryPaths []string
+	// librarySelector is the URI of the config, its module attributes
+	// restrict the candidates and its token attributes the tokens a
+	// library has to find
+	librarySelector *URI
+	librariesLock   sync.Mutex
+)
+
+// setLibrarySearch sets the paths, glob patterns and URI of the config the
+// library is searched with
+func setLibrarySearch(paths []string, selector *URI) error {
+	for _, pattern := range paths {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return NewError(ErrCodeInvalidRequest, "library_paths: invalid pattern %q", pattern)
+		}
+	}
+	librariesLock.Lock()
+	defer librariesLock.Unlock()
+	libraryPaths = append([]string(nil), paths...)
+	librarySelector = selector
+	return nil
+}
+
+// libraryCandidates returns what the paths of the config expand to followed
+// by the built-in locations. Paths without a match are kept, so they show
+// up as missing
+func libraryCandidates() []string {
+	librariesLock.Lock()
+	paths, selector := libraryPaths, librarySelector
+	librariesLock.Unlock()
+
+	if selector != nil && selector.ModulePath != "" {
+		return []string{selector.ModulePath}
+	}
+	var candidates []string
+	for _, pattern := range paths {
+		matches, _ := filepath.Glob(pattern)
+		if len(matches) == 0 {
+			matches = []string{pattern}
+		}
+		candidates = append(candidates, matches...)
+	}
+	candidates = append(candidates, possiblePkcs11Libs...)
+	if selector == nil || selector.ModuleName == "" {
+		return candidates
+	}
+	var selected []string
+	for _, loc := range candidates {
+		if selector.matchesModule(loc) {
+			selected = append(selected, loc)
+		}
+	}
+	return selected
+}
+
+// details of probeLibrary for libraries which can not be used at all
+const (
+	probeNotFound   = "not found"
+	probeLoadFailed = "failed to load"
+)
+
+// isYubikey tells whether a token is a yubikey served by ykcs11, other
+// modules like OpenSC present the same device under their own name
+func isYubikey(info pkcs11.TokenInfo) bool {
+	return strings.Contains(strings.ToLower(info.ManufacturerID), "yubico") ||
+		strings.Contains(strings.ToLower(info.Model), "yubikey")
+}
+
+// probeLibrary loads the library at loc and tells whether it finds a
+// token accepted by match, along with a description for the log
+func probeLibrary(loc string, match func(pkcs11.TokenInfo) bool) (bool, string) {
+	if _, err := os.Stat(loc); err != nil {
+		return false, probeNotFound
+	}
+	p := pkcs11.New(loc)
+	if p == nil {
+		return false, probeLoadFailed
+	}
+	defer p.Destroy()
+	// a library which is initialized already is in use and must not be
+	// finalized here
+	switch err := p.Initialize(); {
+	case err == pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED):
+	case err != nil:
+		return false, fmt.Sprintf("failed to initialize: %v", err)
+	default:
+		defer p.Finalize()
+	}
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		return false, fmt.Sprintf("failed to list slots: %v", err)
+	}
+	var tokens []string
+	for _, slot := range slots {
+		info, err := p.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if match(info) {
+			return true, fmt.Sprintf("found %s %s serial %s", strings.TrimSpace(info.ManufacturerID), strings.TrimSpace(info.Model), strings.TrimSpace(info.SerialNumber))
+		}
+		tokens = append(tokens, strings.TrimSpace(info.Model))
+	}
+	if len(tokens) == 0 {
+		return false, "loaded, but no token attached"
+	}
+	return false, fmt.Sprintf("loaded, but no matching token among %s", strings.Join(tokens, ", "))
+}
+
+// findLibrary returns the library to load, the one set with SetLibrary or
+// the first candidate which finds a yubikey, or the token selected by the
+// URI of the config. If none does, the first candidate which can be loaded
+// is used, so the yubikey can still be plugged in later. It is empty if
+// there is none
+func findLibrary() string {
+	if libraryOverride != "" {
+		return libraryOverride
+	}
+	librariesLock.Lock()
+	selector := librarySelector
+	librariesLock.Unlock()
+	match := isYubikey
+	if selector != nil && selector.selectsToken() {
+		match = selector.matchesToken
+	}
+
+	var (
+		fallback string
+		tried    []string
+	)
+	for _, loc := range libraryCandidates() {
+		found, detail := probeLibrary(loc, match)
+		logrus.Debugf("Tried pkcs11 library %s: %s", loc, detail)
+		if found {
+			logrus.Infof("Using pkcs11 library %s, it %s", loc, detail)
+			return loc
+		}
+		tried = append(tried, fmt.Sprintf("%s (%s)", loc, detail))
+		// the library loads, the token may just not be attached yet
+		if fallback == "" && detail != probeNotFound && detail != probeLoadFailed {
+			fallback = loc
+		}
+	}
+	logrus.Warnf("No pkcs11 library found a yubikey, tried %s", strings.Join(tried, ", "))
+	if fallback != "" {
+		logrus.Warnf("Using pkcs11 library %s until a yubikey is attached", fallback)
+	}
+	return fallback
+}
+
+// Reload applies the library search of a changed config. The library is
+// searched again right away if none is loaded, otherwise the next time it
+// is loaded
+func (ks *KeyStore) Reload(raw json.RawMessage) error {
+	cfg, err := parseConfig(raw)
+	if err != nil {
+		return err
+	}
+	token, err := cfg.tokenURI()
+	if err != nil {
+		return err
+	}
+	if err := setLibrarySearch(cfg.LibraryPaths, token); err != nil {
+		return err
+	}
+	if pkcs11Ctx == nil {
+		pkcs11Lib = findLibrary()
+		logrus.Infof("Searched the pkcs11 library again, found %q", pkcs11Lib)
+	} else {
+		logrus.Infof("Updated the pkcs11 library search, it applies once %s is unloaded", pkcs11Lib)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package yubikey
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLibraryCandidates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"libykcs11.so.2", "libykcs11.so.2.1", "opensc-pkcs11.so"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+	defer setLibrarySearch(nil, nil)
+
+	missing := filepath.Join(dir, "missing.so")
+	require.NoError(t, setLibrarySearch([]string{filepath.Join(dir, "libykcs11.so*"), missing}, nil))
+	candidates := libraryCandidates()
+	require.Equal(t, []string{filepath.Join(dir, "libykcs11.so.2"), filepath.Join(dir, "libykcs11.so.2.1"), missing}, candidates[:3])
+	require.Equal(t, possiblePkcs11Libs, candidates[3:])
+
+	require.NoError(t, setLibrarySearch([]string{filepath.Join(dir, "*")}, &URI{ModuleName: "opensc-pkcs11"}))
+	require.Equal(t, []string{filepath.Join(dir, "opensc-pkcs11.so")}, libraryCandidates())
+
+	require.Equal(t, ErrCodeInvalidRequest, ErrorCodeOf(setLibrarySearch([]string{"/usr/lib/[lib"}, nil)))
+}
+
+func TestIsYubikey(t *testing.T) {
+	require.True(t, isYubikey(pkcs11.TokenInfo{ManufacturerID: "Yubico (www.yubico.com)", Model: "YubiKey YK5"}))
+	require.False(t, isYubikey(pkcs11.TokenInfo{ManufacturerID: "piv_II", Model: "PKCS#15 emulated"}))
+
+	found, detail := probeLibrary("/nonexistent/libykcs11.so", isYubikey)
+	require.False(t, found)
+	require.Equal(t, "not found", detail)
+}
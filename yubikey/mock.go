@@ -0,0 +1,616 @@
+package yubikey
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"math/big"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// Credentials of the mock token, the yubikey defaults
+const (
+	mockPIN           = "123456"
+	mockManagementKey = "010203040506070801020304050607080102030405060708"
+	mockSerial        = "10000001"
+	// mockMaxSessions is how many sessions the mock token opens at once
+	mockMaxSessions = 16
+	// mockPinRetries is how many wrong PINs or management keys lock them
+	mockPinRetries = 3
+	// mockBioRetries is how many unrecognized fingerprints block them
+	mockBioRetries = 3
+)
+
+// mockObject is an object on the mock token. The value of a private key is
+// kept apart from its attributes, so it can not be read
+type mockObject struct {
+	attrs map[uint][]byte
+	key   *ecdsa.PrivateKey
+}
+
+// mockSession is the state of a search or signature in progress
+type mockSession struct {
+	found    []pkcs11.ObjectHandle
+	finding  bool
+	signKey  *ecdsa.PrivateKey
+	signMech uint
+	signing  bool
+}
+
+// mockToken is an in-memory pkcs11 module with a single yubikey, holding
+// certificates and P-256 keys like its PIV slots do. Logins are shared by
+// all sessions like on the real token. It backs the benchmarks and the
+// KeyStore tests, which must not depend on a yubikey being plugged in. The
+// tests script failures of single calls with failNext
+type mockToken struct {
+	sync.Mutex
+	objects    map[pkcs11.ObjectHandle]*mockObject
+	sessions   map[pkcs11.SessionHandle]*mockSession
+	nextObject pkcs11.ObjectHandle
+	nextSess   pkcs11.SessionHandle
+	// user is the user type logged in, ^0 if nobody is
+	user       uint
+	pinRetries int
+	soRetries  int
+	// faults are the errors the next calls of a pkcs11 function fail
+	// with, by function name
+	faults map[string][]error
+	// calls counts the calls of each pkcs11 function
+	calls map[string]int
+	// generic makes the token behave like SoftHSM rather than a yubikey:
+	// the user manages the objects, private keys are hidden until the
+	// user logged in and public keys are not derived from private ones
+	generic bool
+	// bio makes the token a YubiKey Bio, which verifies the user by
+	// fingerprint on a login without PIN. finger is whether the finger on
+	// the sensor is an enrolled one
+	bio        bool
+	finger     bool
+	bioRetries int
+}
+
+var _ common.IPKCS11Ctx = (*mockToken)(nil)
+
+func newMockToken() *mockToken {
+	return &mockToken{
+		objects:    make(map[pkcs11.ObjectHandle]*mockObject),
+		sessions:   make(map[pkcs11.SessionHandle]*mockSession),
+		user:       ^uint(0),
+		pinRetries: mockPinRetries,
+		soRetries:  mockPinRetries,
+		bioRetries: mockBioRetries,
+		faults:     make(map[string][]error),
+		calls:      make(map[string]int),
+	}
+}
+
+// failNext scripts the next calls of the pkcs11 function fn to fail with
+// errs in turn, a nil error lets its call through
+func (m *mockToken) failNext(fn string, errs ...error) {
+	m.Lock()
+	defer m.Unlock()
+	m.faults[fn] = append(m.faults[fn], errs...)
+}
+
+// callCount returns how often the pkcs11 function fn was called
+func (m *mockToken) callCount(fn string) int {
+	m.Lock()
+	defer m.Unlock()
+	return m.calls[fn]
+}
+
+// enter counts a call of fn and returns the error scripted for it
+func (m *mockToken) enter(fn string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.calls[fn]++
+	if len(m.faults[fn]) == 0 {
+		return nil
+	}
+	err := m.faults[fn][0]
+	m.faults[fn] = m.faults[fn][1:]
+	return err
+}
+
+func (m *mockToken) Destroy()          {}
+func (m *mockToken) Initialize() error { return nil }
+func (m *mockToken) Finalize() error   { return nil }
+
+func (m *mockToken) GetSlotList(tokenPresent bool) ([]uint, error) {
+	if err := m.enter("GetSlotList"); err != nil {
+		return nil, err
+	}
+	return []uint{0}, nil
+}
+
+func (m *mockToken) GetInfo() (pkcs11.Info, error) {
+	if err := m.enter("GetInfo"); err != nil {
+		return pkcs11.Info{}, err
+	}
+	return pkcs11.Info{ManufacturerID: m.manufacturer(), LibraryDescription: "mock PKCS#11 library"}, nil
+}
+
+func (m *mockToken) manufacturer() string {
+	if m.generic {
+		return "SoftHSM project"
+	}
+	return "Yubico (www.yubico.com)"
+}
+
+// manager returns the user type allowed to create and destroy objects
+func (m *mockToken) manager() uint {
+	if m.generic {
+		return pkcs11.CKU_USER
+	}
+	return pkcs11.CKU_SO
+}
+
+func (m *mockToken) GetTokenInfo(slotID uint) (pkcs11.TokenInfo, error) {
+	if err := m.enter("GetTokenInfo"); err != nil {
+		return pkcs11.TokenInfo{}, err
+	}
+	if slotID != 0 {
+		return pkcs11.TokenInfo{}, pkcs11.Error(pkcs11.CKR_SLOT_ID_INVALID)
+	}
+	m.Lock()
+	defer m.Unlock()
+	flags := uint(pkcs11.CKF_TOKEN_INITIALIZED | pkcs11.CKF_USER_PIN_INITIALIZED | pkcs11.CKF_LOGIN_REQUIRED)
+	flags |= retryFlags(m.pinRetries, pkcs11.CKF_USER_PIN_COUNT_LOW, pkcs11.CKF_USER_PIN_FINAL_TRY, pkcs11.CKF_USER_PIN_LOCKED)
+	flags |= retryFlags(m.soRetries, pkcs11.CKF_SO_PIN_COUNT_LOW, pkcs11.CKF_SO_PIN_FINAL_TRY, pkcs11.CKF_SO_PIN_LOCKED)
+	model := "YubiKey YK5"
+	switch {
+	case m.generic:
+		model = "SoftHSM v2"
+	case m.bio:
+		model = "YubiKey Bio"
+	}
+	return pkcs11.TokenInfo{
+		Label:           "YubiKey PIV #" + mockSerial,
+		ManufacturerID:  m.manufacturer(),
+		Model:           model,
+		SerialNumber:    mockSerial,
+		Flags:           flags,
+		MaxSessionCount: mockMaxSessions,
+		SessionCount:    uint(len(m.sessions)),
+		FirmwareVersion: pkcs11.Version{Major: 5, Minor: 4},
+	}, nil
+}
+
+// retryFlags returns the token flags telling how many attempts are left
+func retryFlags(retries int, low, final, locked uint) uint {
+	switch {
+	case retries == 0:
+		return locked
+	case retries == 1:
+		return low | final
+	case retries < mockPinRetries:
+		return low
+	}
+	return 0
+}
+
+func (m *mockToken) GetMechanismList(slotID uint) ([]*pkcs11.Mechanism, error) {
+	if err := m.enter("GetMechanismList"); err != nil {
+		return nil, err
+	}
+	return []*pkcs11.Mechanism{
+		pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil),
+		pkcs11.NewMechanism(pkcs11.CKM_ECDSA_SHA256, nil),
+	}, nil
+}
+
+func (m *mockToken) OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error) {
+	if err := m.enter("OpenSession"); err != nil {
+		return 0, err
+	}
+	if slotID != 0 {
+		return 0, pkcs11.Error(pkcs11.CKR_SLOT_ID_INVALID)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if len(m.sessions) >= mockMaxSessions {
+		return 0, pkcs11.Error(pkcs11.CKR_SESSION_COUNT)
+	}
+	m.nextSess++
+	m.sessions[m.nextSess] = &mockSession{}
+	return m.nextSess, nil
+}
+
+func (m *mockToken) CloseSession(sh pkcs11.SessionHandle) error {
+	if err := m.enter("CloseSession"); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.sessions[sh]; !ok {
+		return pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)
+	}
+	delete(m.sessions, sh)
+	if len(m.sessions) == 0 {
+		// the login ends with the last session
+		m.user = ^uint(0)
+	}
+	return nil
+}
+
+// session returns the state of session sh, the lock has to be held
+func (m *mockToken) session(sh pkcs11.SessionHandle) (*mockSession, error) {
+	s, ok := m.sessions[sh]
+	if !ok {
+		return nil, pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)
+	}
+	return s, nil
+}
+
+func (m *mockToken) Login(sh pkcs11.SessionHandle, userType uint, pin string) error {
+	if err := m.enter("Login"); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, err := m.session(sh); err != nil {
+		return err
+	}
+	switch {
+	case m.user == userType:
+		return pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)
+	case m.user != ^uint(0):
+		return pkcs11.Error(pkcs11.CKR_USER_ANOTHER_ALREADY_LOGGED_IN)
+	}
+	retries, want := &m.pinRetries, mockPIN
+	if userType == pkcs11.CKU_SO {
+		retries, want = &m.soRetries, mockManagementKey
+	}
+	if *retries == 0 {
+		return pkcs11.Error(pkcs11.CKR_PIN_LOCKED)
+	}
+	if m.bio && userType == pkcs11.CKU_USER && pin == "" {
+		return m.verifyFinger()
+	}
+	if pin != want {
+		*retries--
+		return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	}
+	*retries = mockPinRetries
+	if userType == pkcs11.CKU_USER {
+		m.bioRetries = mockBioRetries
+	}
+	m.user = userType
+	return nil
+}
+
+// verifyFinger logs the user in by the finger on the sensor, the lock has
+// to be held
+func (m *mockToken) verifyFinger() error {
+	if m.bioRetries == 0 {
+		return pkcs11.Error(pkcs11.CKR_PIN_LOCKED)
+	}
+	if !m.finger {
+		m.bioRetries--
+		return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	}
+	m.bioRetries = mockBioRetries
+	m.user = pkcs11.CKU_USER
+	return nil
+}
+
+func (m *mockToken) Logout(sh pkcs11.SessionHandle) error {
+	if err := m.enter("Logout"); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, err := m.session(sh); err != nil {
+		return err
+	}
+	if m.user == ^uint(0) {
+		return pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN)
+	}
+	m.user = ^uint(0)
+	return nil
+}
+
+// CreateObject stores a certificate or imports a P-256 private key, whose
+// public key is then found as an object of its own unless the token is
+// generic
+func (m *mockToken) CreateObject(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	if err := m.enter("CreateObject"); err != nil {
+		return 0, err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, err := m.session(sh); err != nil {
+		return 0, err
+	}
+	if m.user != m.manager() {
+		return 0, pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN)
+	}
+	obj := &mockObject{attrs: map[uint][]byte{pkcs11.CKA_TOKEN: {1}}}
+	for _, a := range temp {
+		obj.attrs[a.Type] = append([]byte(nil), a.Value...)
+	}
+	if m.generic {
+		if _, ok := obj.attrs[pkcs11.CKA_VENDOR_DEFINED]; ok {
+			return 0, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)
+		}
+		_, typed := obj.attrs[pkcs11.CKA_CERTIFICATE_TYPE]
+		_, subject := obj.attrs[pkcs11.CKA_SUBJECT]
+		if obj.is(pkcs11.CKO_CERTIFICATE) && (!typed || !subject) {
+			return 0, pkcs11.Error(pkcs11.CKR_TEMPLATE_INCOMPLETE)
+		}
+	}
+	if !obj.is(pkcs11.CKO_PRIVATE_KEY) {
+		return m.store(obj), nil
+	}
+
+	if !bytes.Equal(obj.attrs[pkcs11.CKA_EC_PARAMS], oidP256) || len(obj.attrs[pkcs11.CKA_VALUE]) == 0 {
+		return 0, pkcs11.Error(pkcs11.CKR_TEMPLATE_INCONSISTENT)
+	}
+	key := new(ecdsa.PrivateKey)
+	key.Curve = elliptic.P256()
+	key.D = new(big.Int).SetBytes(obj.attrs[pkcs11.CKA_VALUE])
+	key.X, key.Y = key.Curve.ScalarBaseMult(obj.attrs[pkcs11.CKA_VALUE])
+	obj.key = key
+	delete(obj.attrs, pkcs11.CKA_VALUE)
+	if m.generic {
+		return m.store(obj), nil
+	}
+
+	point := append([]byte{0x04, 0x41}, elliptic.Marshal(key.Curve, key.X, key.Y)...)
+	m.store(&mockObject{attrs: map[uint][]byte{
+		pkcs11.CKA_TOKEN:     {1},
+		pkcs11.CKA_CLASS:     pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY).Value,
+		pkcs11.CKA_KEY_TYPE:  obj.attrs[pkcs11.CKA_KEY_TYPE],
+		pkcs11.CKA_ID:        obj.attrs[pkcs11.CKA_ID],
+		pkcs11.CKA_EC_PARAMS: oidP256,
+		pkcs11.CKA_EC_POINT:  point,
+	}})
+	return m.store(obj), nil
+}
+
+// store adds an object to the token, the lock has to be held
+func (m *mockToken) store(obj *mockObject) pkcs11.ObjectHandle {
+	m.nextObject++
+	m.objects[m.nextObject] = obj
+	return m.nextObject
+}
+
+// GenerateKeyPair generates a P-256 key, the public key is stored as an
+// object of its own like on the token
+func (m *mockToken) GenerateKeyPair(sh pkcs11.SessionHandle, mechs []*pkcs11.Mechanism, public, private []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	if err := m.enter("GenerateKeyPair"); err != nil {
+		return 0, 0, err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, err := m.session(sh); err != nil {
+		return 0, 0, err
+	}
+	if m.user != m.manager() {
+		return 0, 0, pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN)
+	}
+	if len(mechs) != 1 || mechs[0].Mechanism != pkcs11.CKM_EC_KEY_PAIR_GEN {
+		return 0, 0, pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+	}
+	pub := &mockObject{attrs: map[uint][]byte{pkcs11.CKA_TOKEN: {1}}}
+	for _, a := range public {
+		pub.attrs[a.Type] = append([]byte(nil), a.Value...)
+	}
+	priv := &mockObject{attrs: map[uint][]byte{pkcs11.CKA_TOKEN: {1}}}
+	for _, a := range private {
+		priv.attrs[a.Type] = append([]byte(nil), a.Value...)
+	}
+	if _, ok := priv.attrs[pkcs11.CKA_VENDOR_DEFINED]; ok && m.generic {
+		return 0, 0, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)
+	}
+	if !bytes.Equal(pub.attrs[pkcs11.CKA_EC_PARAMS], oidP256) {
+		return 0, 0, pkcs11.Error(pkcs11.CKR_TEMPLATE_INCONSISTENT)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return 0, 0, pkcs11.Error(pkcs11.CKR_DEVICE_ERROR)
+	}
+	// like on the token the private key knows its curve as well
+	priv.key, priv.attrs[pkcs11.CKA_EC_PARAMS] = key, oidP256
+	pub.attrs[pkcs11.CKA_EC_POINT] = append([]byte{0x04, 0x41}, elliptic.Marshal(key.Curve, key.X, key.Y)...)
+	return m.store(pub), m.store(priv), nil
+}
+
+func (m *mockToken) DestroyObject(sh pkcs11.SessionHandle, oh pkcs11.ObjectHandle) error {
+	if err := m.enter("DestroyObject"); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, err := m.session(sh); err != nil {
+		return err
+	}
+	if m.user != m.manager() {
+		return pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN)
+	}
+	if _, ok := m.objects[oh]; !ok {
+		return pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID)
+	}
+	delete(m.objects, oh)
+	return nil
+}
+
+func (m *mockToken) GetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, a []*pkcs11.Attribute) ([]*pkcs11.Attribute, error) {
+	if err := m.enter("GetAttributeValue"); err != nil {
+		return nil, err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, err := m.session(sh); err != nil {
+		return nil, err
+	}
+	obj, ok := m.objects[o]
+	if !ok {
+		return nil, pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID)
+	}
+	attrs := make([]*pkcs11.Attribute, 0, len(a))
+	for _, want := range a {
+		if want.Type == pkcs11.CKA_VALUE && obj.key != nil {
+			return nil, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_SENSITIVE)
+		}
+		value, ok := obj.attrs[want.Type]
+		if !ok {
+			return nil, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)
+		}
+		attrs = append(attrs, pkcs11.NewAttribute(want.Type, append([]byte(nil), value...)))
+	}
+	return attrs, nil
+}
+
+func (m *mockToken) FindObjectsInit(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) error {
+	if err := m.enter("FindObjectsInit"); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	s, err := m.session(sh)
+	if err != nil {
+		return err
+	}
+	if s.finding {
+		return pkcs11.Error(pkcs11.CKR_OPERATION_ACTIVE)
+	}
+	s.finding = true
+	s.found = s.found[:0]
+	for handle, obj := range m.objects {
+		if m.generic && m.user != pkcs11.CKU_USER && obj.is(pkcs11.CKO_PRIVATE_KEY) {
+			continue
+		}
+		if obj.matches(temp) {
+			s.found = append(s.found, handle)
+		}
+	}
+	return nil
+}
+
+// is tells whether the object is of class
+func (o *mockObject) is(class uint) bool {
+	return bytes.Equal(o.attrs[pkcs11.CKA_CLASS], pkcs11.NewAttribute(pkcs11.CKA_CLASS, class).Value)
+}
+
+// matches tells whether the object has all attributes of the template
+func (o *mockObject) matches(temp []*pkcs11.Attribute) bool {
+	for _, a := range temp {
+		value, ok := o.attrs[a.Type]
+		if !ok || !bytes.Equal(value, a.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *mockToken) FindObjects(sh pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error) {
+	if err := m.enter("FindObjects"); err != nil {
+		return nil, false, err
+	}
+	m.Lock()
+	defer m.Unlock()
+	s, err := m.session(sh)
+	if err != nil {
+		return nil, false, err
+	}
+	if !s.finding {
+		return nil, false, pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+	if max > len(s.found) {
+		max = len(s.found)
+	}
+	objs := append([]pkcs11.ObjectHandle(nil), s.found[:max]...)
+	s.found = s.found[max:]
+	return objs, false, nil
+}
+
+func (m *mockToken) FindObjectsFinal(sh pkcs11.SessionHandle) error {
+	if err := m.enter("FindObjectsFinal"); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	s, err := m.session(sh)
+	if err != nil {
+		return err
+	}
+	if !s.finding {
+		return pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+	s.finding = false
+	s.found = nil
+	return nil
+}
+
+func (m *mockToken) SignInit(sh pkcs11.SessionHandle, mechs []*pkcs11.Mechanism, o pkcs11.ObjectHandle) error {
+	if err := m.enter("SignInit"); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	s, err := m.session(sh)
+	if err != nil {
+		return err
+	}
+	if s.signing {
+		return pkcs11.Error(pkcs11.CKR_OPERATION_ACTIVE)
+	}
+	if len(mechs) != 1 || (mechs[0].Mechanism != pkcs11.CKM_ECDSA && mechs[0].Mechanism != pkcs11.CKM_ECDSA_SHA256) {
+		return pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+	}
+	obj, ok := m.objects[o]
+	if !ok || obj.key == nil {
+		return pkcs11.Error(pkcs11.CKR_KEY_HANDLE_INVALID)
+	}
+	if m.user != pkcs11.CKU_USER {
+		return pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN)
+	}
+	s.signing = true
+	s.signKey = obj.key
+	s.signMech = mechs[0].Mechanism
+	return nil
+}
+
+// Sign returns the raw r||s signature of message, which is hashed first if
+// SignInit chose CKM_ECDSA_SHA256
+func (m *mockToken) Sign(sh pkcs11.SessionHandle, message []byte) ([]byte, error) {
+	fault := m.enter("Sign")
+	m.Lock()
+	s, err := m.session(sh)
+	if err != nil {
+		m.Unlock()
+		return nil, err
+	}
+	if !s.signing {
+		m.Unlock()
+		return nil, pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+	// the operation ends even if the signature fails
+	key, mech := s.signKey, s.signMech
+	s.signing, s.signKey = false, nil
+	m.Unlock()
+	if fault != nil {
+		return nil, fault
+	}
+
+	digest := message
+	if mech == pkcs11.CKM_ECDSA_SHA256 {
+		h := crypto.SHA256.New()
+		h.Write(message)
+		digest = h.Sum(nil)
+	}
+	r, sVal, err := ecdsa.Sign(rand.Reader, key, digest)
+	if err != nil {
+		return nil, pkcs11.Error(pkcs11.CKR_FUNCTION_FAILED)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	sVal.FillBytes(sig[32:])
+	return sig, nil
+}
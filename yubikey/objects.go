@@ -0,0 +1,91 @@
+package yubikey
+
+import (
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+)
+
+// maxObjects bounds a search, a module returning objects without end would
+// otherwise keep it going forever. A yubikey holds far fewer
+const maxObjects = 1024
+
+// findObjects returns all objects matching template. The search is always
+// finalized once it was started, so the session can search again
+func findObjects(session pkcs11.SessionHandle, template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+	if err := pkcs11Ctx.FindObjectsInit(session, template); err != nil {
+		return nil, newPKCS11Error(err, "failed to init find objects")
+	}
+	var objs []pkcs11.ObjectHandle
+	var err error
+	for {
+		var o []pkcs11.ObjectHandle
+		o, _, err = pkcs11Ctx.FindObjects(session, numSlots)
+		if err != nil || len(o) == 0 {
+			break
+		}
+		objs = append(objs, o...)
+		if len(objs) > maxObjects {
+			pkcs11Ctx.FindObjectsFinal(session)
+			return nil, NewError(ErrCodeDevice, "the search found more than %d objects, the pkcs11 module seems to repeat them", maxObjects)
+		}
+	}
+	if finalErr := pkcs11Ctx.FindObjectsFinal(session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return nil, newPKCS11Error(err, "failed to find objects")
+	}
+	return objs, nil
+}
+
+// findObject returns the single object matching template, the first one if
+// a broken token holds several
+func findObject(session pkcs11.SessionHandle, template []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	objs, err := findObjects(session, template)
+	if err != nil {
+		return 0, err
+	}
+	if len(objs) == 0 {
+		return 0, NewError(ErrCodeKeyNotFound, "no matching object found inside of yubikey")
+	}
+	return objs[0], nil
+}
+
+// slotObjects returns all objects stored with the given slot ID
+func slotObjects(session pkcs11.SessionHandle, slotID []byte) ([]pkcs11.ObjectHandle, error) {
+	return findObjects(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, slotID),
+	})
+}
+
+// destroyObjects destroys all given objects, the session has to be logged in.
+// Objects which are already gone, e.g. a key removed together with its
+// certificate, are skipped
+func destroyObjects(session pkcs11.SessionHandle, objs []pkcs11.ObjectHandle) error {
+	for _, obj := range objs {
+		err := pkcs11Ctx.DestroyObject(session, obj)
+		if err == pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID) {
+			continue
+		}
+		if err != nil {
+			return newPKCS11Error(err, "failed to destroy object %d", obj)
+		}
+		logrus.Debugf("Destroyed object %d", obj)
+	}
+	return nil
+}
+
+// rollbackSlot destroys whatever a failed import left in a slot. Failures
+// are only logged, the error of the import is what the caller reports
+func rollbackSlot(session pkcs11.SessionHandle, slotID []byte) {
+	objs, err := slotObjects(session, slotID)
+	if err == nil {
+		err = destroyObjects(session, objs)
+	}
+	if err != nil {
+		logrus.Errorf("Failed to roll back slot %s, it may hold a partial key: %v", SlotName(slotID), err)
+		return
+	}
+	logrus.Infof("Rolled back %d objects in slot %s", len(objs), SlotName(slotID))
+}
@@ -0,0 +1,93 @@
+package yubikey
+
+import (
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// pagingCtx returns objects in pages of at most max, fails the search after
+// failAfter pages if set and can repeat the last page forever
+type pagingCtx struct {
+	common.IPKCS11Ctx
+	objects   []pkcs11.ObjectHandle
+	pos       int
+	pages     int
+	failAfter int
+	repeat    bool
+	initErr   error
+	finalized int
+}
+
+func (c *pagingCtx) FindObjectsInit(pkcs11.SessionHandle, []*pkcs11.Attribute) error {
+	c.pos, c.pages = 0, 0
+	return c.initErr
+}
+
+func (c *pagingCtx) FindObjects(_ pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error) {
+	c.pages++
+	if c.failAfter > 0 && c.pages > c.failAfter {
+		return nil, false, pkcs11.Error(pkcs11.CKR_DEVICE_ERROR)
+	}
+	if c.repeat {
+		return []pkcs11.ObjectHandle{1}, false, nil
+	}
+	end := c.pos + max
+	if end > len(c.objects) {
+		end = len(c.objects)
+	}
+	page := c.objects[c.pos:end]
+	c.pos = end
+	return page, false, nil
+}
+
+func (c *pagingCtx) FindObjectsFinal(pkcs11.SessionHandle) error {
+	c.finalized++
+	return nil
+}
+
+func TestFindObjects(t *testing.T) {
+	defer func(ctx common.IPKCS11Ctx) { pkcs11Ctx = ctx }(pkcs11Ctx)
+
+	var many []pkcs11.ObjectHandle
+	for i := 1; i <= 3*numSlots+1; i++ {
+		many = append(many, pkcs11.ObjectHandle(i))
+	}
+	ctx := &pagingCtx{objects: many}
+	pkcs11Ctx = ctx
+	objs, err := findObjects(0, nil)
+	require.NoError(t, err)
+	require.Equal(t, many, objs, "all pages are collected")
+	require.Equal(t, 1, ctx.finalized)
+
+	ctx = &pagingCtx{}
+	pkcs11Ctx = ctx
+	objs, err = findObjects(0, nil)
+	require.NoError(t, err)
+	require.Empty(t, objs)
+	_, err = findObject(0, nil)
+	require.Equal(t, ErrCodeKeyNotFound, ErrorCodeOf(err))
+
+	// a failing page fails the search, which is finalized nonetheless
+	ctx = &pagingCtx{objects: many, failAfter: 1}
+	pkcs11Ctx = ctx
+	_, err = findObjects(0, nil)
+	require.True(t, isTransient(err))
+	require.Equal(t, 1, ctx.finalized)
+
+	// a search that failed to start is not finalized
+	ctx = &pagingCtx{initErr: pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)}
+	pkcs11Ctx = ctx
+	_, err = findObjects(0, nil)
+	require.Error(t, err)
+	require.Equal(t, 0, ctx.finalized)
+
+	// a module repeating objects does not keep the search going
+	ctx = &pagingCtx{repeat: true}
+	pkcs11Ctx = ctx
+	_, err = findObjects(0, nil)
+	require.Equal(t, ErrCodeDevice, ErrorCodeOf(err))
+	require.Equal(t, 1, ctx.finalized)
+}
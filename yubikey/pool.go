@@ -0,0 +1,415 @@
+package yubikey
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// loginLock guards the login state of the token while the session pool is
+// used. A pkcs11 login is shared by all sessions of the daemon, so pooled
+// signatures hold it for reading while the token stays logged in, and
+// everything logging in and out by itself holds it for writing
+var loginLock sync.RWMutex
+
+// pooledSession is a session of the pool, it belongs to the pool of the
+// library and token it was opened for
+type pooledSession struct {
+	handle     pkcs11.SessionHandle
+	slot       uint
+	generation int
+}
+
+// sessionPool keeps sessions on the token of SetupHSMEnv, which are logged
+// in with the PIN of the first signature. Signatures use them instead of the
+// session of the client, so signatures with different keys do not have to
+// wait for each other
+type sessionPool struct {
+	sync.Mutex
+	cond *sync.Cond
+	// size is the most sessions the pool opens, 0 disables it unless
+	// the login is cached
+	size int
+	// ttl is how long the token stays logged in without a signature, 0
+	// keeps it logged in while the pool is used
+	ttl      time.Duration
+	lastUsed time.Time
+	expiry   *time.Timer
+	busy     int
+	idle     []pooledSession
+	slot     uint
+	// generation changes whenever the library is unloaded, which
+	// invalidates all sessions
+	generation int
+	loggedIn   bool
+	// pin is a keyed hash of the PIN the token is logged in with, so a
+	// signature with another PIN has the yubikey check it
+	pin    []byte
+	pinKey []byte
+}
+
+var signPool = newSessionPool()
+
+func newSessionPool() *sessionPool {
+	p := &sessionPool{pinKey: make([]byte, 32)}
+	p.cond = sync.NewCond(&p.Mutex)
+	if _, err := rand.Read(p.pinKey); err != nil {
+		panic(fmt.Sprintf("failed to create the PIN key of the session pool: %v", err))
+	}
+	return p
+}
+
+// SetSessionPool makes signatures use up to size sessions of their own,
+// which stay logged in. 0 signs with the session of the client
+func SetSessionPool(size int) error {
+	if size < 0 {
+		return NewError(ErrCodeInvalidRequest, "invalid session pool size %d", size)
+	}
+	signPool.Lock()
+	defer signPool.Unlock()
+	signPool.size = size
+	return nil
+}
+
+// SetLoginTTL keeps the token logged in for pin-once keys until no
+// signature was made for ttl. Signatures then use the session pool, with a
+// single session unless SetSessionPool allows more. 0 disables the expiry
+func SetLoginTTL(ttl time.Duration) error {
+	if ttl < 0 {
+		return NewError(ErrCodeInvalidRequest, "invalid login TTL %s", ttl)
+	}
+	signPool.Lock()
+	defer signPool.Unlock()
+	signPool.ttl = ttl
+	return nil
+}
+
+// capacity is the most sessions the pool opens, the lock has to be held
+func (p *sessionPool) capacity() int {
+	if p.size == 0 && p.ttl > 0 {
+		return 1
+	}
+	return p.size
+}
+
+// usable tells whether signatures use the pool. Keys requiring the PIN for
+// every signature can not share a login
+func (p *sessionPool) usable() bool {
+	p.Lock()
+	capacity := p.capacity()
+	p.Unlock()
+	return capacity > 0 && YubikeyKeyMode()&KEYMODE_PIN_ALWAYS == 0
+}
+
+// enabled tells whether logins have to be coordinated with the pool
+func (p *sessionPool) enabled() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.capacity() > 0
+}
+
+// acquire returns an idle session or opens a new one. If all sessions are
+// busy, or the module allows no more, it waits for one to be released
+func (p *sessionPool) acquire() (pooledSession, error) {
+	p.Lock()
+	defer p.Unlock()
+	for {
+		if pkcs11Ctx == nil {
+			return pooledSession{}, NewError(ErrCodeNoToken, "the pkcs11 library is not loaded")
+		}
+		if p.slot != tokenSlot {
+			// SetupHSMEnv selected another token
+			p.drain()
+			p.slot = tokenSlot
+		}
+		if n := len(p.idle); n > 0 {
+			s := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.busy++
+			return s, nil
+		}
+		if p.busy < p.capacity() {
+			handle, err := pkcs11Ctx.OpenSession(p.slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+			if err == nil {
+				p.busy++
+				logrus.Debugf("Opened pooled session %d, %d are busy", handle, p.busy)
+				return pooledSession{handle: handle, slot: p.slot, generation: p.generation}, nil
+			}
+			if err != pkcs11.Error(pkcs11.CKR_SESSION_COUNT) || p.busy == 0 {
+				return pooledSession{}, newPKCS11Error(err, "failed to open a pooled session")
+			}
+			logrus.Debugf("The pkcs11 module allows no more sessions, waiting for one of the %d busy ones", p.busy)
+		}
+		p.cond.Wait()
+	}
+}
+
+// release returns a session to the pool
+func (p *sessionPool) release(s pooledSession) {
+	p.Lock()
+	defer p.Unlock()
+	p.busy--
+	p.cond.Signal()
+	p.used()
+	switch {
+	case s.generation != p.generation:
+		// the library was unloaded, the session is gone
+	case s.slot != p.slot || len(p.idle) >= p.capacity():
+		closeSession(s.handle)
+	default:
+		p.idle = append(p.idle, s)
+	}
+}
+
+// discard closes a session which failed, unless it was taken again
+func (p *sessionPool) discard(s pooledSession) {
+	p.Lock()
+	defer p.Unlock()
+	for i, idle := range p.idle {
+		if idle == s {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			if s.generation == p.generation {
+				closeSession(s.handle)
+			}
+			return
+		}
+	}
+}
+
+// closeSession closes a session of the pool together with its cached handles
+func closeSession(session pkcs11.SessionHandle) {
+	keyHandles.forgetSession(session)
+	pkcs11Ctx.CloseSession(session)
+}
+
+// drain closes the idle sessions, the lock has to be held
+func (p *sessionPool) drain() {
+	for _, s := range p.idle {
+		if s.generation == p.generation {
+			closeSession(s.handle)
+		}
+	}
+	p.idle = nil
+	p.loggedIn = false
+}
+
+// reset forgets all sessions once the library is unloaded
+func (p *sessionPool) reset() {
+	p.Lock()
+	defer p.Unlock()
+	p.idle = nil
+	p.loggedIn = false
+	p.generation++
+	p.cond.Broadcast()
+}
+
+// pinMAC returns the keyed hash of a PIN
+func (p *sessionPool) pinMAC(passwd string) []byte {
+	mac := hmac.New(sha256.New, p.pinKey)
+	mac.Write([]byte(passwd))
+	return mac.Sum(nil)
+}
+
+// loggedInWith tells whether the token is logged in with passwd
+func (p *sessionPool) loggedInWith(passwd string) bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.loggedIn && hmac.Equal(p.pin, p.pinMAC(passwd))
+}
+
+// login logs the token in with passwd, which has the yubikey check it. The
+// write lock of loginLock has to be held
+func (p *sessionPool) login(session pkcs11.SessionHandle, passwd string) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.loggedIn {
+		pkcs11Ctx.Logout(session)
+		p.loggedIn = false
+	}
+	if err := userLogin(p.slot, session, passwd); err != nil {
+		return err
+	}
+	p.loggedIn = true
+	p.pin = p.pinMAC(passwd)
+	p.used()
+	return nil
+}
+
+// used restarts the idle time of the login, the lock has to be held
+func (p *sessionPool) used() {
+	p.lastUsed = time.Now()
+	if p.ttl <= 0 || !p.loggedIn {
+		return
+	}
+	if p.expiry == nil {
+		p.expiry = time.AfterFunc(p.ttl, p.expire)
+	} else {
+		p.expiry.Reset(p.ttl)
+	}
+}
+
+// expire logs out once the login was idle for the TTL
+func (p *sessionPool) expire() {
+	loginLock.Lock()
+	defer loginLock.Unlock()
+	p.Lock()
+	defer p.Unlock()
+	if !p.loggedIn || p.ttl <= 0 {
+		return
+	}
+	if idle := time.Since(p.lastUsed); p.busy > 0 || idle < p.ttl {
+		p.expiry.Reset(p.ttl - idle)
+		return
+	}
+	logrus.Debugf("Logging out of the yubikey, no signature for %s", p.ttl)
+	p.logoutIdle()
+}
+
+// logoutIdle logs the token out with an idle session, or with one opened for
+// that. Both locks have to be held
+func (p *sessionPool) logoutIdle() {
+	if !p.loggedIn {
+		return
+	}
+	p.loggedIn = false
+	if pkcs11Ctx == nil {
+		return
+	}
+	if len(p.idle) > 0 {
+		pkcs11Ctx.Logout(p.idle[0].handle)
+		return
+	}
+	session, err := pkcs11Ctx.OpenSession(p.slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		logrus.Debugf("Failed to open a session to log out: %v", err)
+		return
+	}
+	defer pkcs11Ctx.CloseSession(session)
+	pkcs11Ctx.Logout(session)
+}
+
+// FlushLogin logs the daemon out of the yubikey, so the next signature has
+// the yubikey check the PIN again. It tells whether the daemon was logged in
+func FlushLogin() bool {
+	loginLock.Lock()
+	defer loginLock.Unlock()
+	signPool.Lock()
+	defer signPool.Unlock()
+	wasLoggedIn := signPool.loggedIn
+	signPool.logoutIdle()
+	return wasLoggedIn
+}
+
+// logout logs the pool out of the token in slot, using the session of the
+// caller. The write lock of loginLock has to be held
+func (p *sessionPool) logout(slot uint, session pkcs11.SessionHandle) {
+	p.Lock()
+	defer p.Unlock()
+	if p.loggedIn && p.slot == slot {
+		pkcs11Ctx.Logout(session)
+		p.loggedIn = false
+	}
+}
+
+// forgetLogin is called when the token reports that it is not logged in,
+// e.g. after it was reset
+func (p *sessionPool) forgetLogin() {
+	p.Lock()
+	defer p.Unlock()
+	p.loggedIn = false
+}
+
+// removed drops the login and the idle sessions once the yubikey is gone
+func (p *sessionPool) removed() {
+	p.Lock()
+	defer p.Unlock()
+	if p.loggedIn {
+		logrus.Infof("The yubikey was removed, dropping its login")
+	}
+	p.drain()
+}
+
+// stats returns the number of idle and busy sessions and the size of the pool
+func (p *sessionPool) stats() (int, int, int) {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.idle), p.busy, p.capacity()
+}
+
+// loginState tells whether the token is logged in and for how long it stays
+// logged in without a signature
+func (p *sessionPool) loginState() (bool, time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	return p.loggedIn, p.ttl
+}
+
+// exclusiveLogin waits for the pooled signatures to finish and logs the pool
+// out, so the caller can log in and out with session by itself. The returned
+// function ends that
+func exclusiveLogin(slot uint, session pkcs11.SessionHandle) func() {
+	if !signPool.enabled() {
+		return func() {}
+	}
+	loginLock.Lock()
+	signPool.logout(slot, session)
+	return loginLock.Unlock
+}
+
+// signPooled signs with a session of the pool. The token stays logged in
+// after the first signature, a signature with another PIN logs in again
+func (ks *KeyStore) signPooled(hwslot common.HardwareSlot, passwd string, payload []byte, opts backend.SignOptions) ([]byte, error) {
+	hash, err := payloadHash(payload, opts)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 1; ; attempt++ {
+		s, err := signPool.acquire()
+		if err != nil {
+			return nil, err
+		}
+		loginLock.RLock()
+		if !signPool.loggedInWith(passwd) {
+			loginLock.RUnlock()
+			loginLock.Lock()
+			err = signPool.login(s.handle, passwd)
+			loginLock.Unlock()
+			if err != nil {
+				signPool.release(s)
+				return nil, err
+			}
+			// another PIN may have been logged in meanwhile, but this one
+			// was checked by the yubikey
+			loginLock.RLock()
+		}
+		sig, err := ks.signLoggedIn(s.slot, s.handle, hwslot, hash, payload, opts, func() {
+			signPool.release(s)
+			loginLock.RUnlock()
+		})
+		if err == nil {
+			return sig, nil
+		}
+		ckr, _ := ckrOf(err)
+		switch ckr {
+		case pkcs11.CKR_SESSION_HANDLE_INVALID, pkcs11.CKR_SESSION_CLOSED:
+			signPool.discard(s)
+		case pkcs11.CKR_DEVICE_REMOVED, pkcs11.CKR_TOKEN_NOT_PRESENT:
+			signPool.removed()
+		case pkcs11.CKR_USER_NOT_LOGGED_IN:
+			// the yubikey was reset or replugged
+			signPool.forgetLogin()
+			if attempt == 1 {
+				continue
+			}
+		}
+		return nil, err
+	}
+}
@@ -0,0 +1,121 @@
+package yubikey
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// sessionCtx opens up to max sessions and accepts the PIN "123456"
+type sessionCtx struct {
+	common.IPKCS11Ctx
+	max     int
+	open    map[pkcs11.SessionHandle]bool
+	next    pkcs11.SessionHandle
+	logins  int
+	logouts int
+}
+
+func (c *sessionCtx) OpenSession(uint, uint) (pkcs11.SessionHandle, error) {
+	if len(c.open) >= c.max {
+		return 0, pkcs11.Error(pkcs11.CKR_SESSION_COUNT)
+	}
+	c.next++
+	c.open[c.next] = true
+	return c.next, nil
+}
+
+func (c *sessionCtx) CloseSession(sh pkcs11.SessionHandle) error {
+	delete(c.open, sh)
+	return nil
+}
+
+func (c *sessionCtx) Login(_ pkcs11.SessionHandle, _ uint, pin string) error {
+	c.logins++
+	if pin != "123456" {
+		return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	}
+	return nil
+}
+
+func (c *sessionCtx) Logout(pkcs11.SessionHandle) error {
+	c.logouts++
+	return nil
+}
+
+func TestSessionPool(t *testing.T) {
+	defer func(ctx common.IPKCS11Ctx) { pkcs11Ctx = ctx }(pkcs11Ctx)
+	ctx := &sessionCtx{max: 2, open: make(map[pkcs11.SessionHandle]bool)}
+	pkcs11Ctx = ctx
+	p := newSessionPool()
+	p.size = 3
+
+	a, err := p.acquire()
+	require.NoError(t, err)
+	b, err := p.acquire()
+	require.NoError(t, err)
+	require.NotEqual(t, a, b)
+
+	// the module allows no third session, so it waits for a released one
+	acquired := make(chan pooledSession)
+	go func() {
+		s, err := p.acquire()
+		require.NoError(t, err)
+		acquired <- s
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired a session beyond the limit of the module")
+	case <-time.After(20 * time.Millisecond):
+	}
+	p.release(a)
+	require.Equal(t, a, <-acquired)
+
+	// the PIN is only checked by the yubikey if it changes
+	require.Error(t, p.login(b.handle, "000000"))
+	require.False(t, p.loggedInWith("000000"))
+	require.NoError(t, p.login(b.handle, "123456"))
+	require.True(t, p.loggedInWith("123456"))
+	require.False(t, p.loggedInWith("654321"))
+	require.Equal(t, 2, ctx.logins)
+
+	p.release(a)
+	p.release(b)
+	idle, busy, _ := p.stats()
+	require.Equal(t, 2, idle)
+	require.Equal(t, 0, busy)
+
+	// unloading the library drops the sessions and the login
+	p.reset()
+	require.False(t, p.loggedInWith("123456"))
+	idle, _, _ = p.stats()
+	require.Equal(t, 0, idle)
+}
+
+func TestLoginTTL(t *testing.T) {
+	defer func(ctx common.IPKCS11Ctx) { pkcs11Ctx = ctx }(pkcs11Ctx)
+	ctx := &sessionCtx{max: 2, open: make(map[pkcs11.SessionHandle]bool)}
+	pkcs11Ctx = ctx
+	p := newSessionPool()
+	p.ttl = 20 * time.Millisecond
+	require.Equal(t, 1, p.capacity(), "a cached login needs a session")
+
+	s, err := p.acquire()
+	require.NoError(t, err)
+	p.Lock()
+	p.loggedIn, p.pin = true, p.pinMAC("123456")
+	p.used()
+	p.Unlock()
+	p.release(s)
+	require.True(t, p.loggedInWith("123456"))
+
+	deadline := time.Now().Add(time.Second)
+	for p.loggedInWith("123456") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.False(t, p.loggedInWith("123456"), "the login expired")
+	require.Equal(t, 1, ctx.logouts)
+}
@@ -0,0 +1,48 @@
+package yubikey
+
+import (
+	"github.com/miekg/pkcs11"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// LoadLibrary loads and initializes the ykcs11 library and returns its path
+func (ks *KeyStore) LoadLibrary() (string, error) {
+	_, err := initializeLib()
+	return pkcs11Lib, err
+}
+
+// CheckUserPin logs in with pin and out again. It does not try the PIN if
+// a wrong PIN would lock it
+func (ks *KeyStore) CheckUserPin(session pkcs11.SessionHandle, pin string) error {
+	return checkLogin(pkcs11Ctx, tokenSlot, session, pkcs11.CKU_USER, pin)
+}
+
+// CheckManagementKey logs in as the user managing the keys with key and out
+// again. It does not try the key if a wrong key would lock it
+func (ks *KeyStore) CheckManagementKey(session pkcs11.SessionHandle, key string) error {
+	return checkLogin(pkcs11Ctx, tokenSlot, session, managementUser(), key)
+}
+
+// checkLogin tries the login only if the token reports more than one
+// attempt left for userType
+func checkLogin(p common.IPKCS11Ctx, slot uint, session pkcs11.SessionHandle, userType uint, passwd string) error {
+	info, err := p.GetTokenInfo(slot)
+	if err != nil {
+		return newPKCS11Error(err, "failed to read token info")
+	}
+	what, locked, finalTry := "PIN", uint(pkcs11.CKF_USER_PIN_LOCKED), uint(pkcs11.CKF_USER_PIN_FINAL_TRY)
+	if userType == pkcs11.CKU_SO {
+		what, locked, finalTry = "management key", pkcs11.CKF_SO_PIN_LOCKED, pkcs11.CKF_SO_PIN_FINAL_TRY
+	}
+	switch {
+	case info.Flags&locked != 0:
+		return NewError(ErrCodePinLocked, "the %s is locked", what)
+	case info.Flags&finalTry != 0:
+		return NewError(ErrCodePinLocked, "only one attempt left for the %s, not risking to lock it", what)
+	}
+	defer exclusiveLogin(slot, session)()
+	if err := p.Login(session, userType, passwd); err != nil {
+		return WrapError(ErrCodeUnknown, newPKCS11Error(err, "the %s was rejected", what))
+	}
+	return p.Logout(session)
+}
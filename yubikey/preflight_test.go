@@ -0,0 +1,49 @@
+package yubikey
+
+import (
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// loginCtx reports flags as token info and counts the logins
+type loginCtx struct {
+	common.IPKCS11Ctx
+	flags  uint
+	pin    string
+	logins *int
+}
+
+func (c loginCtx) GetTokenInfo(uint) (pkcs11.TokenInfo, error) {
+	return pkcs11.TokenInfo{Flags: c.flags}, nil
+}
+
+func (c loginCtx) Login(_ pkcs11.SessionHandle, _ uint, pin string) error {
+	*c.logins++
+	if pin != c.pin {
+		return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	}
+	return nil
+}
+
+func (c loginCtx) Logout(pkcs11.SessionHandle) error {
+	return nil
+}
+
+func TestCheckLogin(t *testing.T) {
+	logins := 0
+	ctx := loginCtx{pin: "123456", logins: &logins}
+	require.NoError(t, checkLogin(ctx, 0, 0, pkcs11.CKU_USER, "123456"))
+	require.Equal(t, ErrCodeWrongPin, ErrorCodeOf(checkLogin(ctx, 0, 0, pkcs11.CKU_USER, "000000")))
+	require.Equal(t, 2, logins)
+
+	// the last attempt is never spent
+	ctx.flags = pkcs11.CKF_USER_PIN_FINAL_TRY
+	require.Equal(t, ErrCodePinLocked, ErrorCodeOf(checkLogin(ctx, 0, 0, pkcs11.CKU_USER, "123456")))
+	require.NoError(t, checkLogin(ctx, 0, 0, pkcs11.CKU_SO, "123456"))
+	ctx.flags = pkcs11.CKF_SO_PIN_LOCKED
+	require.Equal(t, ErrCodePinLocked, ErrorCodeOf(checkLogin(ctx, 0, 0, pkcs11.CKU_SO, "123456")))
+	require.Equal(t, 3, logins)
+}
@@ -0,0 +1,219 @@
+package yubikey
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+// Problems of a slot found by RecoverSlots
+const (
+	problemCertWithoutKey = "certificate without private key"
+	problemKeyWithoutCert = "private key without certificate"
+)
+
+// slotQuarantine holds the slots of each yubikey, by serial number, which
+// RecoverSlots found inconsistent but could not repair. They are left out of
+// the key listing until a key is stored in or removed from them
+type slotQuarantine struct {
+	sync.Mutex
+	slots map[string]map[byte]string
+}
+
+var quarantine = &slotQuarantine{slots: make(map[string]map[byte]string)}
+
+func (q *slotQuarantine) add(serial string, slotID byte, problem string) {
+	q.Lock()
+	defer q.Unlock()
+	if q.slots[serial] == nil {
+		q.slots[serial] = make(map[byte]string)
+	}
+	q.slots[serial][slotID] = problem
+}
+
+// release lifts the quarantine of a slot on every yubikey, a new key or the
+// removal of the old one leaves it consistent
+func (q *slotQuarantine) release(slotID []byte) {
+	if len(slotID) != 1 {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	for serial, slots := range q.slots {
+		delete(slots, slotID[0])
+		if len(slots) == 0 {
+			delete(q.slots, serial)
+		}
+	}
+}
+
+// empty tells whether no slot is quarantined, so listing can skip looking up
+// the serial number of the token
+func (q *slotQuarantine) empty() bool {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.slots) == 0
+}
+
+func (q *slotQuarantine) contains(serial string, slotID []byte) bool {
+	if len(slotID) != 1 {
+		return false
+	}
+	q.Lock()
+	defer q.Unlock()
+	_, ok := q.slots[serial][slotID[0]]
+	return ok
+}
+
+// quarantinedSlots returns the quarantined slots of the yubikey in slot
+func quarantinedSlots(slot uint) map[byte]bool {
+	if quarantine.empty() {
+		return nil
+	}
+	info, err := pkcs11Ctx.GetTokenInfo(slot)
+	if err != nil {
+		return nil
+	}
+	serial := strings.TrimSpace(info.SerialNumber)
+	found := make(map[byte]bool)
+	for _, id := range slotIDs {
+		if quarantine.contains(serial, []byte{byte(id)}) {
+			found[byte(id)] = true
+		}
+	}
+	return found
+}
+
+// RecoverSlots looks for slots left inconsistent, e.g. by an import that was
+// interrupted between storing the certificate and the private key. The slots
+// are classified logged in with the PIN, as private keys may be hidden until
+// then. With the management key the certificate notary left without its key
+// is destroyed if confirm agrees for its slot, any other inconsistent slot is
+// quarantined. Reserved and mapped slots are managed outside of notary and
+// skipped
+func (ks *KeyStore) RecoverSlots(session pkcs11.SessionHandle, pin, managementKey string, confirm func(backend.SlotRepair) bool) ([]backend.SlotRepair, error) {
+	info, err := readTokenInfo()
+	if err != nil {
+		return nil, newPKCS11Error(err, "failed to read the token info")
+	}
+	serial := strings.TrimSpace(info.SerialNumber)
+
+	repairs, leftovers, err := ks.classifySlots(session, pin)
+	if err != nil {
+		return nil, err
+	}
+	for i, repair := range repairs {
+		slotID := repair.SlotID
+		if managementKey != "" && leftovers[slotID[0]] && confirm(repair) {
+			if err := ks.clearSlot(session, slotID, managementKey); err != nil {
+				logrus.Warnf("Failed to repair slot %s: %v", SlotName(slotID), err)
+			} else {
+				repairs[i].Repaired = true
+			}
+		}
+		if repairs[i].Repaired {
+			logrus.Warnf("Slot %s held a %s, destroyed it", SlotName(slotID), repair.Problem)
+		} else {
+			quarantine.add(serial, slotID[0], repair.Problem)
+			logrus.Warnf("Slot %s holds a %s, quarantined it. Store a key in it with overwrite or clear it with yubico-piv-tool", SlotName(slotID), repair.Problem)
+		}
+	}
+	if len(repairs) > 0 {
+		keyMapCache.forget()
+	}
+	return repairs, nil
+}
+
+// classifySlots logs in with the PIN and returns the inconsistent slots, and
+// which of them hold a certificate notary left without its key
+func (ks *KeyStore) classifySlots(session pkcs11.SessionHandle, pin string) ([]backend.SlotRepair, map[byte]bool, error) {
+	if pin == "" {
+		return nil, nil, NewError(ErrCodeWrongPin, "the slots can only be checked logged in, the PIN is unavailable")
+	}
+	defer exclusiveLogin(tokenSlot, session)()
+	if err := pkcs11Ctx.Login(session, pkcs11.CKU_USER, pin); err != nil {
+		return nil, nil, WrapError(ErrCodeWrongPin, err)
+	}
+	defer pkcs11Ctx.Logout(session)
+
+	var repairs []backend.SlotRepair
+	leftovers := make(map[byte]bool)
+	for _, id := range slotIDs {
+		slotID := []byte{byte(id)}
+		if ks.reserved[slotID[0]] {
+			continue
+		}
+		if _, ok := ks.mapped[slotID[0]]; ok {
+			continue
+		}
+		problem, err := slotProblem(session, slotID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if problem == "" {
+			continue
+		}
+		if problem == problemCertWithoutKey && ks.isLeftover(session, slotID) {
+			leftovers[slotID[0]] = true
+		}
+		repairs = append(repairs, backend.SlotRepair{SlotID: slotID, Problem: problem})
+	}
+	return repairs, leftovers, nil
+}
+
+// slotProblem tells what is wrong with a slot, it is empty if the slot is
+// either empty or holds both a certificate and a private key
+func slotProblem(session pkcs11.SessionHandle, slotID []byte) (string, error) {
+	certs, err := findObjects(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, slotID),
+	})
+	if err != nil {
+		return "", err
+	}
+	privKeys, err := findObjects(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, slotID),
+	})
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case len(certs) > 0 && len(privKeys) == 0:
+		return problemCertWithoutKey, nil
+	case len(certs) == 0 && len(privKeys) > 0:
+		return problemKeyWithoutCert, nil
+	}
+	return "", nil
+}
+
+// isLeftover tells whether the certificate in a slot was written by notary,
+// only then it is safe to destroy
+func (ks *KeyStore) isLeftover(session pkcs11.SessionHandle, slotID []byte) bool {
+	cert, _, err := slotCertificate(session, slotID)
+	if err != nil {
+		return false
+	}
+	return data.ValidRole(data.RoleName(cert.Subject.CommonName))
+}
+
+// clearSlot destroys all objects in a slot
+func (ks *KeyStore) clearSlot(session pkcs11.SessionHandle, slotID []byte, managementKey string) error {
+	defer exclusiveLogin(tokenSlot, session)()
+	defer keyHandles.forgetSlot(slotID)
+	if err := pkcs11Ctx.Login(session, managementUser(), managementKey); err != nil {
+		return WrapError(ErrCodeUnknown, err)
+	}
+	defer pkcs11Ctx.Logout(session)
+	objs, err := slotObjects(session, slotID)
+	if err != nil {
+		return err
+	}
+	return destroyObjects(session, objs)
+}
@@ -0,0 +1,76 @@
+package yubikey
+
+import (
+	"testing"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlotQuarantine(t *testing.T) {
+	q := &slotQuarantine{slots: make(map[string]map[byte]string)}
+	require.True(t, q.empty())
+
+	q.add("123", 2, problemCertWithoutKey)
+	q.add("456", 1, problemKeyWithoutCert)
+	require.False(t, q.empty())
+	require.True(t, q.contains("123", []byte{2}))
+	require.False(t, q.contains("123", []byte{1}))
+	require.False(t, q.contains("456", []byte{2}))
+
+	// storing a key in or removing one from a slot lifts its quarantine
+	q.release([]byte{2})
+	require.False(t, q.contains("123", []byte{2}))
+	require.True(t, q.contains("456", []byte{1}))
+	q.release([]byte{1})
+	require.True(t, q.empty())
+}
+
+func TestRecoverSlots(t *testing.T) {
+	e, restore := newMockEnv(t)
+	defer restore()
+	defer func() { quarantine = &slotQuarantine{slots: make(map[string]map[byte]string)} }()
+	healthy, broken := byte(slotIDs[0]), byte(slotIDs[1])
+	e.addKey(t, healthy)
+	e.addKey(t, broken)
+	objects := len(e.objects(healthy))
+	e.token.Lock()
+	for handle, obj := range e.token.objects {
+		if obj.is(pkcs11.CKO_PRIVATE_KEY) && obj.attrs[pkcs11.CKA_ID][0] == broken {
+			delete(e.token.objects, handle)
+		}
+	}
+	// the private keys are hidden until the user logged in
+	e.token.generic = true
+	e.token.Unlock()
+
+	_, err := e.ks.RecoverSlots(e.session, "", mockManagementKey, func(backend.SlotRepair) bool { return true })
+	require.Equal(t, ErrCodeWrongPin, ErrorCodeOf(err))
+	require.Len(t, e.objects(healthy), objects)
+
+	var asked []string
+	confirm := func(r backend.SlotRepair) bool {
+		asked = append(asked, SlotName(r.SlotID))
+		return false
+	}
+	repairs, err := e.ks.RecoverSlots(e.session, mockPIN, mockManagementKey, confirm)
+	require.NoError(t, err)
+	require.Equal(t, []backend.SlotRepair{{SlotID: []byte{broken}, Problem: problemCertWithoutKey}}, repairs)
+	require.Equal(t, []string{SlotName([]byte{broken})}, asked)
+	require.NotEmpty(t, e.objects(broken))
+	require.True(t, e.loggedOut())
+
+	// the token stays a yubikey managed by the SO, only the hiding of the
+	// private keys is taken back
+	e.token.Lock()
+	e.token.generic = false
+	e.token.Unlock()
+	repairs, err = e.ks.RecoverSlots(e.session, mockPIN, mockManagementKey, func(backend.SlotRepair) bool { return true })
+	require.NoError(t, err)
+	require.Len(t, repairs, 1)
+	require.True(t, repairs[0].Repaired)
+	require.Empty(t, e.objects(broken))
+	require.Len(t, e.objects(healthy), objects)
+	require.True(t, e.loggedOut())
+}
@@ -0,0 +1,174 @@
+package yubikey
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+	"github.com/theupdateframework/notary/tuf/data"
+	"github.com/theupdateframework/notary/tuf/utils"
+)
+
+// tokenSigner is a crypto.Signer for the key in a slot, so certificates and
+// requests for that key can be created with the x509 package
+type tokenSigner struct {
+	ks      *KeyStore
+	session pkcs11.SessionHandle
+	hwslot  common.HardwareSlot
+	passwd  string
+	pub     crypto.PublicKey
+}
+
+func (s *tokenSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *tokenSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	for name, hash := range digestHashes {
+		if hash == opts.HashFunc() {
+			return s.ks.signOnSlot(tokenSlot, s.session, s.hwslot, s.passwd, digest, backend.SignOptions{
+				DigestAlgorithm: name,
+				Prehashed:       true,
+				Encoding:        EncodingDER,
+			})
+		}
+	}
+	return nil, NewError(ErrCodeInvalidRequest, "unsupported digest %s", opts.HashFunc())
+}
+
+// slotCertificate returns the certificate stored in a slot and its object
+func slotCertificate(session pkcs11.SessionHandle, slotID []byte) (*x509.Certificate, pkcs11.ObjectHandle, error) {
+	obj, err := findObject(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, slotID),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	attr, err := pkcs11Ctx.GetAttributeValue(session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	})
+	if err != nil || len(attr) != 1 {
+		return nil, 0, NewError(ErrCodeKeyNotFound, "failed to read certificate of slot %s", SlotName(slotID))
+	}
+	cert, err := x509.ParseCertificate(attr[0].Value)
+	if err != nil {
+		return nil, 0, NewError(ErrCodeKeyNotFound, "invalid certificate in slot %s: %v", SlotName(slotID), err)
+	}
+	return cert, obj, nil
+}
+
+// CertificateRequest returns a DER encoded certificate request for the key
+// in a slot, signed on the token, so a CA can issue its next certificate
+func (ks *KeyStore) CertificateRequest(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string) ([]byte, error) {
+	cert, _, err := slotCertificate(session, hwslot.SlotID)
+	if err != nil {
+		return nil, err
+	}
+	signer := &tokenSigner{ks: ks, session: session, hwslot: hwslot, passwd: passwd, pub: cert.PublicKey}
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: cert.Subject.CommonName},
+	}
+	return x509.CreateCertificateRequest(rand.Reader, template, signer)
+}
+
+// RenewCertificate replaces the certificate in a slot by a fresh self-signed
+// one, valid for validity from now on. The private key is not touched, it
+// signs the new certificate on the token. passwd is the PIN, managementKey
+// is needed to write the certificate. The NotBefore of the old certificate
+// is kept, it tells when the key was stored
+func (ks *KeyStore) RenewCertificate(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd, managementKey string, validity time.Duration) (time.Time, error) {
+	cert, _, err := slotCertificate(session, hwslot.SlotID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	template, err := utils.NewCertificate(cert.Subject.CommonName, cert.NotBefore, time.Now().Add(validity))
+	if err != nil {
+		return time.Time{}, NewError(ErrCodeInvalidRequest, "failed to create the certificate template: %v", err)
+	}
+	signer := &tokenSigner{ks: ks, session: session, hwslot: hwslot, passwd: passwd, pub: cert.PublicKey}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, cert.PublicKey, signer)
+	if err != nil {
+		return time.Time{}, WrapError(ErrCodeUnknown, err)
+	}
+	if err := ks.ReplaceCertificate(session, hwslot, managementKey, certBytes); err != nil {
+		return time.Time{}, err
+	}
+	return template.NotAfter, nil
+}
+
+// ReplaceCertificate stores certBytes, a DER encoded certificate, in place of
+// the certificate in a slot. The new certificate has to be for the same key
+// and role, otherwise the key would no longer be found
+func (ks *KeyStore) ReplaceCertificate(session pkcs11.SessionHandle, hwslot common.HardwareSlot, managementKey string, certBytes []byte) error {
+	if err := ks.checkNotReserved(hwslot.SlotID); err != nil {
+		return err
+	}
+	if len(hwslot.SlotID) == 1 && ks.mapped[hwslot.SlotID[0]].Role != "" {
+		return NewError(ErrCodePolicyDenied, "the certificate of slot %s is managed outside of notary", SlotName(hwslot.SlotID))
+	}
+	newCert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return NewError(ErrCodeInvalidRequest, "invalid certificate: %v", err)
+	}
+	oldCert, oldObj, err := slotCertificate(session, hwslot.SlotID)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(newCert.RawSubjectPublicKeyInfo, oldCert.RawSubjectPublicKeyInfo) {
+		return NewError(ErrCodeInvalidRequest, "the certificate is not for the key in slot %s", SlotName(hwslot.SlotID))
+	}
+	if role := newCert.Subject.CommonName; role != oldCert.Subject.CommonName || !data.ValidRole(data.RoleName(role)) {
+		return NewError(ErrCodeInvalidRequest, "the certificate has to be issued for role %s, not %q", oldCert.Subject.CommonName, role)
+	}
+	if err := storeCertificate(session, hwslot.SlotID, managementKey, oldCert, oldObj, certBytes); err != nil {
+		return err
+	}
+	logrus.Infof("Replaced the certificate of slot %s, it expires at %s", SlotName(hwslot.SlotID), newCert.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// storeCertificate logs in as the management user and replaces oldCert,
+// stored as oldObj, by certBytes. If the new certificate can not be stored,
+// the old one is put back
+func storeCertificate(session pkcs11.SessionHandle, slotID []byte, managementKey string, oldCert *x509.Certificate, oldObj pkcs11.ObjectHandle, certBytes []byte) error {
+	defer keyMapCache.forget()
+	defer exclusiveLogin(tokenSlot, session)()
+	if err := pkcs11Ctx.Login(session, managementUser(), managementKey); err != nil {
+		return WrapError(ErrCodeUnknown, err)
+	}
+	defer pkcs11Ctx.Logout(session)
+
+	generic := genericToken()
+	certTemplate := func(value []byte) []*pkcs11.Attribute {
+		template := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, value),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, slotID),
+		}
+		if generic {
+			// both certificates were parsed already
+			template, _ = genericCertTemplate(template, value)
+		}
+		return template
+	}
+	if err := pkcs11Ctx.DestroyObject(session, oldObj); err != nil {
+		return newPKCS11Error(err, "failed to remove the old certificate")
+	}
+	if _, err := pkcs11Ctx.CreateObject(session, certTemplate(certBytes)); err != nil {
+		// without a certificate the key can not be listed, put the old one back
+		if _, rerr := pkcs11Ctx.CreateObject(session, certTemplate(oldCert.Raw)); rerr != nil {
+			logrus.Errorf("Failed to restore the certificate of slot %s: %v", SlotName(slotID), rerr)
+		}
+		return newPKCS11Error(err, "failed to store the certificate")
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package yubikey
+
+import (
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// retryAttempts is how often an operation is tried in total
+	retryAttempts = 3
+	// retryBackoff is the delay before the first retry, it doubles with
+	// every further attempt
+	retryBackoff = 100 * time.Millisecond
+	// sleep is replaced by tests
+	sleep = time.Sleep
+
+	// return values which are seen during USB glitches or right after the
+	// yubikey was inserted, and go away by themselves
+	transientCKRs = map[uint]bool{
+		pkcs11.CKR_DEVICE_ERROR:    true,
+		pkcs11.CKR_FUNCTION_FAILED: true,
+	}
+)
+
+// SetRetryPolicy sets how often operations failing with a transient error
+// are tried and the delay before the first retry
+func SetRetryPolicy(attempts int, backoff time.Duration) error {
+	if attempts < 1 || backoff < 0 {
+		return NewError(ErrCodeInvalidRequest, "invalid retry policy: %d attempts, backoff %s", attempts, backoff)
+	}
+	retryAttempts = attempts
+	retryBackoff = backoff
+	return nil
+}
+
+// isTransient returns whether err was caused by a pkcs11 return value that
+// is worth retrying
+func isTransient(err error) bool {
+	ckr, ok := ckrOf(err)
+	return ok && transientCKRs[ckr]
+}
+
+// ckrOf returns the pkcs11 return value of a plain pkcs11 error as well as of
+// an error of this package
+func ckrOf(err error) (uint, bool) {
+	if ckr, ok := err.(pkcs11.Error); ok {
+		return uint(ckr), true
+	}
+	return CKROf(err)
+}
+
+// withRetry runs fn until it succeeds, fails with an error that is not
+// transient or all attempts are used up. fn has to be safe to repeat
+func withRetry(op string, fn func() error) error {
+	delay := retryBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || !isTransient(err) || attempt >= retryAttempts {
+			return err
+		}
+		logrus.Infof("%s failed with a transient error, retrying in %s (attempt %d of %d): %v", op, delay, attempt, retryAttempts, err)
+		sleep(delay)
+		delay *= 2
+	}
+}
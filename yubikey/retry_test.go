@@ -0,0 +1,47 @@
+package yubikey
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithRetry(t *testing.T) {
+	var delays []time.Duration
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+	defer func() { sleep = time.Sleep }()
+	require.NoError(t, SetRetryPolicy(3, 10*time.Millisecond))
+	defer SetRetryPolicy(3, 100*time.Millisecond)
+
+	calls := 0
+	err := withRetry("sign", func() error {
+		calls++
+		if calls < 3 {
+			return pkcs11.Error(pkcs11.CKR_DEVICE_ERROR)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+	require.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}, delays)
+
+	// all attempts used up
+	calls = 0
+	err = withRetry("sign", func() error {
+		calls++
+		return newPKCS11Error(pkcs11.Error(pkcs11.CKR_FUNCTION_FAILED), "failed")
+	})
+	require.Error(t, err)
+	require.Equal(t, 3, calls)
+
+	// a wrong PIN is not retried
+	calls = 0
+	err = withRetry("sign", func() error {
+		calls++
+		return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, calls)
+}
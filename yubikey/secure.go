@@ -0,0 +1,68 @@
+package yubikey
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"runtime"
+)
+
+// redacted replaces secrets wherever they are formatted
+const redacted = "[redacted]"
+
+// Secret is a PIN or a management key. It formats as [redacted] with every
+// verb and in JSON, so it can not end up in a log line or an error message
+// by accident. gob still transports the value itself
+type Secret string
+
+func (s Secret) String() string                { return redacted }
+func (s Secret) GoString() string              { return redacted }
+func (s Secret) Format(f fmt.State, verb rune) { io.WriteString(f, redacted) }
+
+// MarshalJSON keeps secrets out of JSON formatted logs
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + redacted + `"`), nil
+}
+
+// Reveal returns the secret itself, to hand it to the pkcs11 library
+func (s Secret) Reveal() string {
+	return string(s)
+}
+
+// SecureBytes holds a secret or key material. Wipe overwrites it with zeros
+// so it does not linger on the heap once the pkcs11 call that needed it is
+// done. Go strings can not be wiped, secrets should be kept in SecureBytes
+// for as long as possible
+type SecureBytes []byte
+
+func (b SecureBytes) String() string                { return redacted }
+func (b SecureBytes) GoString() string              { return redacted }
+func (b SecureBytes) Format(f fmt.State, verb rune) { io.WriteString(f, redacted) }
+
+// MarshalJSON keeps key material out of JSON formatted logs
+func (b SecureBytes) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + redacted + `"`), nil
+}
+
+// Wipe overwrites b with zeros
+func (b SecureBytes) Wipe() {
+	for i := range b {
+		b[i] = 0
+	}
+	// keep the writes from being optimized away
+	runtime.KeepAlive(b)
+}
+
+// wipeBigInt overwrites the words of n with zeros, e.g. the private scalar
+// of a parsed key
+func wipeBigInt(n *big.Int) {
+	if n == nil {
+		return
+	}
+	words := n.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	runtime.KeepAlive(words)
+	n.SetInt64(0)
+}
@@ -0,0 +1,25 @@
+package yubikey
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecureBytesWipe(t *testing.T) {
+	b := SecureBytes("123456")
+	b.Wipe()
+	require.Equal(t, SecureBytes{0, 0, 0, 0, 0, 0}, b)
+}
+
+func TestWipeBigInt(t *testing.T) {
+	n, ok := new(big.Int).SetString("deadbeefdeadbeefdeadbeefdeadbeef", 16)
+	require.True(t, ok)
+	words := n.Bits()
+	wipeBigInt(n)
+	require.Equal(t, 0, n.Sign())
+	for _, w := range words {
+		require.Zero(t, w)
+	}
+}
@@ -0,0 +1,105 @@
+package yubikey
+
+import (
+	"crypto/elliptic"
+	"encoding/asn1"
+	"math/big"
+	"strings"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+)
+
+// Signature encodings
+const (
+	// EncodingRaw is the fixed width concatenation r||s as returned by pkcs11
+	EncodingRaw = "raw"
+	// EncodingDER is the ASN.1 DER encoded ECDSA-Sig-Value sequence
+	EncodingDER = "der"
+)
+
+var (
+	defaultEncoding = EncodingRaw
+	defaultLowS     = false
+)
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// SetDefaultEncoding sets the signature encoding used by Sign if a request
+// does not specify one
+func SetDefaultEncoding(encoding string) error {
+	encoding = strings.ToLower(encoding)
+	if encoding != EncodingRaw && encoding != EncodingDER {
+		return NewError(ErrCodeInvalidRequest, "unsupported signature encoding %q", encoding)
+	}
+	defaultEncoding = encoding
+	return nil
+}
+
+// SetDefaultLowS sets whether Sign normalizes signatures to the low-S form
+// if a request does not ask for it
+func SetDefaultLowS(lowS bool) {
+	defaultLowS = lowS
+}
+
+// normalizeLowS returns n-s if s is in the upper half of the curve order, so
+// that the signature is the canonical one of the pair (r, s) and (r, n-s)
+func normalizeLowS(s *big.Int, curve elliptic.Curve) *big.Int {
+	n := curve.Params().N
+	halfN := new(big.Int).Rsh(n, 1)
+	if s.Cmp(halfN) > 0 {
+		return new(big.Int).Sub(n, s)
+	}
+	return s
+}
+
+// parseSignature splits the signature returned by the token into r and s.
+// Tokens return raw r||s, but DER is accepted as well
+func parseSignature(sig []byte, curve elliptic.Curve) (*big.Int, *big.Int, error) {
+	size := (curve.Params().BitSize + 7) / 8
+	if len(sig) == 2*size {
+		return new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:]), nil
+	}
+
+	var esig ecdsaSignature
+	rest, err := asn1.Unmarshal(sig, &esig)
+	if err != nil || len(rest) != 0 || esig.R == nil || esig.S == nil {
+		return nil, nil, NewError(ErrCodeDevice, "token returned a signature of %d bytes, expected %d", len(sig), 2*size)
+	}
+	return esig.R, esig.S, nil
+}
+
+// encodeSignature encodes r and s with the given encoding, the default
+// encoding is used if it is empty
+func encodeSignature(r, s *big.Int, curve elliptic.Curve, encoding string) ([]byte, error) {
+	if encoding == "" {
+		encoding = defaultEncoding
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	if r.Sign() <= 0 || s.Sign() <= 0 || len(r.Bytes()) > size || len(s.Bytes()) > size {
+		return nil, NewError(ErrCodeDevice, "signature components exceed %d bytes", size)
+	}
+
+	switch strings.ToLower(encoding) {
+	case EncodingRaw:
+		sig := make([]byte, 2*size)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(sig[size-len(rBytes):size], rBytes)
+		copy(sig[2*size-len(sBytes):], sBytes)
+		return sig, nil
+	case EncodingDER:
+		return asn1.Marshal(ecdsaSignature{R: r, S: s})
+	default:
+		return nil, NewError(ErrCodeInvalidRequest, "unsupported signature encoding %q", encoding)
+	}
+}
+
+// EncodeSignature encodes r and s as described by opts, normalized to the
+// low-S form if requested or enabled by default
+func EncodeSignature(r, s *big.Int, curve elliptic.Curve, opts backend.SignOptions) ([]byte, error) {
+	if opts.LowS || defaultLowS {
+		s = normalizeLowS(s, curve)
+	}
+	return encodeSignature(r, s, curve, opts.Encoding)
+}
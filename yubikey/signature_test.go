@@ -0,0 +1,48 @@
+package yubikey
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignatureEncodingRoundTrip(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte("payload"))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+
+	raw, err := encodeSignature(r, s, elliptic.P256(), EncodingRaw)
+	require.NoError(t, err)
+	require.Len(t, raw, 64)
+
+	der, err := encodeSignature(r, s, elliptic.P256(), EncodingDER)
+	require.NoError(t, err)
+
+	for _, sig := range [][]byte{raw, der} {
+		pr, ps, err := parseSignature(sig, elliptic.P256())
+		require.NoError(t, err)
+		require.True(t, ecdsa.Verify(&key.PublicKey, digest[:], pr, ps))
+	}
+}
+
+func TestParseSignatureRejectsWrongLength(t *testing.T) {
+	_, _, err := parseSignature(make([]byte, 63), elliptic.P256())
+	require.Error(t, err)
+}
+
+func TestNormalizeLowS(t *testing.T) {
+	curve := elliptic.P256()
+	n := curve.Params().N
+	low := big.NewInt(42)
+	require.Equal(t, low, normalizeLowS(low, curve))
+
+	high := new(big.Int).Sub(n, low)
+	require.Equal(t, 0, low.Cmp(normalizeLowS(high, curve)))
+}
@@ -0,0 +1,35 @@
+package yubikey
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PIV slot names and the slot IDs (CKA_ID) they are stored with
+var pivSlots = map[string]byte{
+	"9a": 0,
+	"9e": 1,
+	"9c": 2,
+	"9d": 3,
+}
+
+// ParseSlot returns the slot ID for a PIV slot name like "9c"
+func ParseSlot(name string) ([]byte, error) {
+	id, ok := pivSlots[strings.ToLower(name)]
+	if !ok {
+		return nil, NewError(ErrCodeInvalidRequest, "unknown PIV slot %q, expected one of 9a, 9c, 9d, 9e", name)
+	}
+	return []byte{id}, nil
+}
+
+// SlotName returns the PIV slot name for a slot ID
+func SlotName(slotID []byte) string {
+	if len(slotID) == 1 {
+		for name, id := range pivSlots {
+			if id == slotID[0] {
+				return name
+			}
+		}
+	}
+	return fmt.Sprintf("%x", slotID)
+}
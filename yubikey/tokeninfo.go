@@ -0,0 +1,96 @@
+package yubikey
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/miekg/pkcs11"
+)
+
+// TokenInfo returns the serial number, model and firmware of the yubikey
+// and its free slots
+func (ks *KeyStore) TokenInfo(session pkcs11.SessionHandle) (backend.TokenInfo, error) {
+	var ti backend.TokenInfo
+	info, err := readTokenInfo()
+	if err != nil {
+		return ti, newPKCS11Error(err, "failed to read token info")
+	}
+	ti.Serial = strings.TrimSpace(info.SerialNumber)
+	ti.Model = strings.TrimSpace(info.Model)
+	ti.Firmware = fmt.Sprintf("%d.%d", info.FirmwareVersion.Major, info.FirmwareVersion.Minor)
+	free, err := ks.freeSlots(session)
+	if err != nil {
+		return ti, WrapError(ErrCodeUnknown, err)
+	}
+	ti.FreeSlots = make([]string, 0, len(free))
+	for _, slot := range free {
+		ti.FreeSlots = append(ti.FreeSlots, SlotName([]byte{slot}))
+	}
+	return ti, nil
+}
+
+// lastTokenInfo is the token info read last, so the diagnostics can describe
+// the token without waiting for a token which may be busy or stuck
+var lastTokenInfo struct {
+	sync.Mutex
+	info pkcs11.TokenInfo
+	read time.Time
+}
+
+// readTokenInfo reads the info of the token in use and remembers it
+func readTokenInfo() (pkcs11.TokenInfo, error) {
+	info, err := pkcs11Ctx.GetTokenInfo(tokenSlot)
+	if err == nil {
+		rememberTokenInfo(info)
+	}
+	return info, err
+}
+
+func rememberTokenInfo(info pkcs11.TokenInfo) {
+	lastTokenInfo.Lock()
+	defer lastTokenInfo.Unlock()
+	lastTokenInfo.info, lastTokenInfo.read = info, time.Now()
+}
+
+// cachedTokenInfo returns the token info read last and when it was read,
+// which is the zero time if it never was
+func cachedTokenInfo() (pkcs11.TokenInfo, time.Time) {
+	lastTokenInfo.Lock()
+	defer lastTokenInfo.Unlock()
+	return lastTokenInfo.info, lastTokenInfo.read
+}
+
+// tokenModels caches the info of the token in each pkcs11 slot, so its model
+// is known without asking the token on every login. Only the fields which
+// never change, like the model, may be used
+var tokenModels = struct {
+	sync.Mutex
+	infos map[uint]pkcs11.TokenInfo
+}{infos: make(map[uint]pkcs11.TokenInfo)}
+
+// tokenModel returns the info of the token in slot, read once per slot until
+// the library is cleaned up. ok is false if it can not be read
+func tokenModel(slot uint) (pkcs11.TokenInfo, bool) {
+	tokenModels.Lock()
+	defer tokenModels.Unlock()
+	info, ok := tokenModels.infos[slot]
+	if !ok {
+		var err error
+		if info, err = pkcs11Ctx.GetTokenInfo(slot); err != nil {
+			return info, false
+		}
+		tokenModels.infos[slot] = info
+	}
+	return info, true
+}
+
+// forgetTokenModels forgets the token infos read, the slots may hold other
+// tokens once the library is loaded again
+func forgetTokenModels() {
+	tokenModels.Lock()
+	defer tokenModels.Unlock()
+	tokenModels.infos = make(map[uint]pkcs11.TokenInfo)
+}
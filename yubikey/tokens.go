@@ -0,0 +1,107 @@
+package yubikey
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// ListAllTokenKeys lists the keys of every attached yubikey. The yubikeys
+// are read in parallel, each with its own session
+func (ks *KeyStore) ListAllTokenKeys() ([]backend.TokenKey, error) {
+	p, err := initializeLib()
+	if err != nil {
+		return nil, err
+	}
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		return nil, newPKCS11Error(err, "failed to list HSM slots")
+	}
+
+	var (
+		keys []backend.TokenKey
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+	)
+	for _, slot := range slots {
+		info, err := p.GetTokenInfo(slot)
+		if err != nil {
+			logrus.Debugf("Failed to get token info of slot %d: %v", slot, err)
+			continue
+		}
+		serial := strings.TrimSpace(info.SerialNumber)
+		wg.Add(1)
+		go func(slot uint) {
+			defer wg.Done()
+			err := ks.withTokenSession(slot, func(session pkcs11.SessionHandle) error {
+				tokenKeys, err := ks.listKeysOnSlot(slot, session)
+				if err != nil {
+					return err
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				for keyID, hwslot := range tokenKeys {
+					hwslot.KeyID = keyID
+					keys = append(keys, backend.TokenKey{KeyID: keyID, Serial: serial, Slot: hwslot, PublicKey: listedKeys.get(keyID)})
+				}
+				return nil
+			})
+			if err != nil && ErrorCodeOf(err) != ErrCodeKeyNotFound {
+				logrus.Warnf("Failed to list keys of yubikey %s: %v", serial, err)
+			}
+		}(slot)
+	}
+	wg.Wait()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Serial != keys[j].Serial {
+			return keys[i].Serial < keys[j].Serial
+		}
+		return keys[i].KeyID < keys[j].KeyID
+	})
+	return keys, nil
+}
+
+// SignOnToken signs payload with the key in hwslot of the yubikey with the given serial number
+func (ks *KeyStore) SignOnToken(serial string, hwslot common.HardwareSlot, passwd string, payload []byte, opts backend.SignOptions) ([]byte, error) {
+	p, err := initializeLib()
+	if err != nil {
+		return nil, err
+	}
+	slot, err := findTokenSlot(p, serial)
+	if err != nil {
+		return nil, err
+	}
+	var sig []byte
+	err = withRetry("SignOnToken", func() error {
+		return ks.withTokenSession(slot, func(session pkcs11.SessionHandle) error {
+			sig, err = ks.signOnSlot(slot, session, hwslot, passwd, payload, opts)
+			return err
+		})
+	})
+	return sig, err
+}
+
+// SessionSerial returns the serial number of the yubikey the sessions of
+// SetupHSMEnv are open on
+func (ks *KeyStore) SessionSerial(session pkcs11.SessionHandle) (string, error) {
+	info, err := readTokenInfo()
+	if err != nil {
+		return "", newPKCS11Error(err, "failed to read token info")
+	}
+	return strings.TrimSpace(info.SerialNumber), nil
+}
+
+// withTokenSession runs fn with a new session on the given pkcs11 slot
+func (ks *KeyStore) withTokenSession(slot uint, fn func(pkcs11.SessionHandle) error) error {
+	session, err := pkcs11Ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return newPKCS11Error(err, "failed to start session with HSM")
+	}
+	defer ks.CloseSession(session)
+	return fn(session)
+}
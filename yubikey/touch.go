@@ -0,0 +1,96 @@
+package yubikey
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// touchTimeout is how long a signature may wait for the yubikey to be
+// touched, 0 waits as long as the pkcs11 module does
+var touchTimeout = 15 * time.Second
+
+// SetTouchTimeout sets how long a signature waits for the yubikey to be
+// touched before it fails with TOUCH_TIMEOUT, 0 disables the timeout
+func SetTouchTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return NewError(ErrCodeInvalidRequest, "invalid touch timeout %s", timeout)
+	}
+	touchTimeout = timeout
+	return nil
+}
+
+// signWithTimeout signs like p.Sign, but gives up once the touch timeout
+// passed. The pkcs11 call itself can not be cancelled, so it is left running
+// and release is called once it returned, whether in time or not. The
+// session must not be used until then, release usually logs out
+func signWithTimeout(p common.IPKCS11Ctx, session pkcs11.SessionHandle, digest []byte, release func()) ([]byte, error) {
+	if touchTimeout <= 0 {
+		defer release()
+		return p.Sign(session, digest)
+	}
+	type result struct {
+		sig []byte
+		err error
+	}
+	done := make(chan result, 1)
+	released := make(chan struct{})
+	go func() {
+		sig, err := p.Sign(session, digest)
+		release()
+		close(released)
+		pendingSigns.remove(session, released)
+		done <- result{sig, err}
+	}()
+	timer := time.NewTimer(touchTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.sig, r.err
+	case <-timer.C:
+		pendingSigns.add(session, released)
+		return nil, NewError(ErrCodeTouchTimeout, "the yubikey was not touched within %s", touchTimeout)
+	}
+}
+
+// pendingSignatures are the sessions whose signature is still running after
+// the touch timeout, by the channel closed once the session is released
+type pendingSignatures struct {
+	sync.Mutex
+	sessions map[pkcs11.SessionHandle]chan struct{}
+}
+
+var pendingSigns = &pendingSignatures{sessions: make(map[pkcs11.SessionHandle]chan struct{})}
+
+func (p *pendingSignatures) add(session pkcs11.SessionHandle, released chan struct{}) {
+	p.Lock()
+	defer p.Unlock()
+	select {
+	case <-released:
+		// the module returned right after the timeout
+	default:
+		p.sessions[session] = released
+	}
+}
+
+func (p *pendingSignatures) remove(session pkcs11.SessionHandle, released chan struct{}) {
+	p.Lock()
+	defer p.Unlock()
+	if p.sessions[session] == released {
+		delete(p.sessions, session)
+	}
+}
+
+// PendingSign returns a channel which is closed once the signature left
+// running on session after the touch timeout returned, or nil if there is
+// none. Until then the session is logged in and must not be used
+func PendingSign(session pkcs11.SessionHandle) <-chan struct{} {
+	pendingSigns.Lock()
+	defer pendingSigns.Unlock()
+	if released, ok := pendingSigns.sessions[session]; ok {
+		return released
+	}
+	return nil
+}
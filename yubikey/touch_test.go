@@ -0,0 +1,51 @@
+package yubikey
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// untouchedCtx blocks in Sign until touched is closed
+type untouchedCtx struct {
+	common.IPKCS11Ctx
+	touched chan struct{}
+}
+
+func (c untouchedCtx) Sign(pkcs11.SessionHandle, []byte) ([]byte, error) {
+	<-c.touched
+	return []byte("sig"), nil
+}
+
+func TestSignWithTimeout(t *testing.T) {
+	defer SetTouchTimeout(touchTimeout)
+	require.NoError(t, SetTouchTimeout(10*time.Millisecond))
+
+	ctx := untouchedCtx{touched: make(chan struct{})}
+	released := make(chan struct{})
+	_, err := signWithTimeout(ctx, 0, nil, func() { close(released) })
+	require.Equal(t, ErrCodeTouchTimeout, ErrorCodeOf(err))
+	require.True(t, IsRetriable(err))
+
+	// the session is only released once the module returned
+	select {
+	case <-released:
+		t.Fatal("session released while the module still waits for touch")
+	default:
+	}
+	pending := PendingSign(0)
+	require.NotNil(t, pending)
+	close(ctx.touched)
+	<-released
+	<-pending
+	require.Nil(t, PendingSign(0))
+
+	sig, err := signWithTimeout(ctx, 0, nil, func() {})
+	require.NoError(t, err)
+	require.Equal(t, []byte("sig"), sig)
+
+	require.Error(t, SetTouchTimeout(-time.Second))
+}
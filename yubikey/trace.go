@@ -0,0 +1,163 @@
+package yubikey
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
+)
+
+// tracingCtx logs every call into the pkcs11 library at trace level, with
+// its duration, the handles and the types of the attributes involved.
+// Attribute values, PINs and messages are never logged
+type tracingCtx struct {
+	ctx common.IPKCS11Ctx
+}
+
+// traced wraps ctx so its calls are logged at trace level
+func traced(ctx common.IPKCS11Ctx) common.IPKCS11Ctx {
+	return &tracingCtx{ctx: ctx}
+}
+
+// trace logs a finished call, started at start, if trace logging is enabled
+func trace(start time.Time, call string, err error, format string, a ...interface{}) {
+	if !logrus.IsLevelEnabled(logrus.TraceLevel) {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	logrus.Tracef("pkcs11 %s(%s) = %s in %s", call, fmt.Sprintf(format, a...), result, time.Since(start))
+}
+
+// attrTypes describes a template by the types and lengths of its attributes
+func attrTypes(attrs []*pkcs11.Attribute) string {
+	types := make([]string, 0, len(attrs))
+	for _, a := range attrs {
+		types = append(types, fmt.Sprintf("0x%X[%d]", a.Type, len(a.Value)))
+	}
+	return "{" + strings.Join(types, " ") + "}"
+}
+
+func mechTypes(mechs []*pkcs11.Mechanism) string {
+	types := make([]string, 0, len(mechs))
+	for _, m := range mechs {
+		types = append(types, fmt.Sprintf("0x%X", m.Mechanism))
+	}
+	return "{" + strings.Join(types, " ") + "}"
+}
+
+func (t *tracingCtx) Destroy() {
+	defer trace(time.Now(), "Destroy", nil, "")
+	t.ctx.Destroy()
+}
+
+func (t *tracingCtx) Initialize() (err error) {
+	defer func(start time.Time) { trace(start, "Initialize", err, "") }(time.Now())
+	return t.ctx.Initialize()
+}
+
+func (t *tracingCtx) Finalize() (err error) {
+	defer func(start time.Time) { trace(start, "Finalize", err, "") }(time.Now())
+	return t.ctx.Finalize()
+}
+
+func (t *tracingCtx) GetSlotList(tokenPresent bool) (slots []uint, err error) {
+	defer func(start time.Time) { trace(start, "GetSlotList", err, "%t -> %v", tokenPresent, slots) }(time.Now())
+	return t.ctx.GetSlotList(tokenPresent)
+}
+
+func (t *tracingCtx) GetInfo() (info pkcs11.Info, err error) {
+	defer func(start time.Time) { trace(start, "GetInfo", err, "") }(time.Now())
+	return t.ctx.GetInfo()
+}
+
+func (t *tracingCtx) OpenSession(slotID uint, flags uint) (sh pkcs11.SessionHandle, err error) {
+	defer func(start time.Time) {
+		trace(start, "OpenSession", err, "slot=%d flags=0x%X -> session=%d", slotID, flags, sh)
+	}(time.Now())
+	return t.ctx.OpenSession(slotID, flags)
+}
+
+func (t *tracingCtx) CloseSession(sh pkcs11.SessionHandle) (err error) {
+	defer func(start time.Time) { trace(start, "CloseSession", err, "session=%d", sh) }(time.Now())
+	return t.ctx.CloseSession(sh)
+}
+
+func (t *tracingCtx) Login(sh pkcs11.SessionHandle, userType uint, pin string) (err error) {
+	defer func(start time.Time) { trace(start, "Login", err, "session=%d user=%d pin=[redacted]", sh, userType) }(time.Now())
+	return t.ctx.Login(sh, userType, pin)
+}
+
+func (t *tracingCtx) Logout(sh pkcs11.SessionHandle) (err error) {
+	defer func(start time.Time) { trace(start, "Logout", err, "session=%d", sh) }(time.Now())
+	return t.ctx.Logout(sh)
+}
+
+func (t *tracingCtx) CreateObject(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) (oh pkcs11.ObjectHandle, err error) {
+	defer func(start time.Time) {
+		trace(start, "CreateObject", err, "session=%d template=%s -> object=%d", sh, attrTypes(temp), oh)
+	}(time.Now())
+	return t.ctx.CreateObject(sh, temp)
+}
+
+func (t *tracingCtx) DestroyObject(sh pkcs11.SessionHandle, oh pkcs11.ObjectHandle) (err error) {
+	defer func(start time.Time) { trace(start, "DestroyObject", err, "session=%d object=%d", sh, oh) }(time.Now())
+	return t.ctx.DestroyObject(sh, oh)
+}
+
+func (t *tracingCtx) GetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, a []*pkcs11.Attribute) (attrs []*pkcs11.Attribute, err error) {
+	defer func(start time.Time) {
+		trace(start, "GetAttributeValue", err, "session=%d object=%d template=%s -> %s", sh, o, attrTypes(a), attrTypes(attrs))
+	}(time.Now())
+	return t.ctx.GetAttributeValue(sh, o, a)
+}
+
+func (t *tracingCtx) FindObjectsInit(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) (err error) {
+	defer func(start time.Time) {
+		trace(start, "FindObjectsInit", err, "session=%d template=%s", sh, attrTypes(temp))
+	}(time.Now())
+	return t.ctx.FindObjectsInit(sh, temp)
+}
+
+func (t *tracingCtx) FindObjects(sh pkcs11.SessionHandle, max int) (objs []pkcs11.ObjectHandle, more bool, err error) {
+	defer func(start time.Time) { trace(start, "FindObjects", err, "session=%d max=%d -> %v", sh, max, objs) }(time.Now())
+	return t.ctx.FindObjects(sh, max)
+}
+
+func (t *tracingCtx) FindObjectsFinal(sh pkcs11.SessionHandle) (err error) {
+	defer func(start time.Time) { trace(start, "FindObjectsFinal", err, "session=%d", sh) }(time.Now())
+	return t.ctx.FindObjectsFinal(sh)
+}
+
+func (t *tracingCtx) SignInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, o pkcs11.ObjectHandle) (err error) {
+	defer func(start time.Time) {
+		trace(start, "SignInit", err, "session=%d mechanisms=%s object=%d", sh, mechTypes(m), o)
+	}(time.Now())
+	return t.ctx.SignInit(sh, m, o)
+}
+
+func (t *tracingCtx) Sign(sh pkcs11.SessionHandle, message []byte) (sig []byte, err error) {
+	defer func(start time.Time) {
+		trace(start, "Sign", err, "session=%d message=[%d bytes] -> [%d bytes]", sh, len(message), len(sig))
+	}(time.Now())
+	return t.ctx.Sign(sh, message)
+}
+
+func (t *tracingCtx) GetMechanismList(slotID uint) (mechs []*pkcs11.Mechanism, err error) {
+	defer func(start time.Time) {
+		trace(start, "GetMechanismList", err, "slot=%d -> %s", slotID, mechTypes(mechs))
+	}(time.Now())
+	return t.ctx.GetMechanismList(slotID)
+}
+
+func (t *tracingCtx) GetTokenInfo(slotID uint) (info pkcs11.TokenInfo, err error) {
+	defer func(start time.Time) {
+		trace(start, "GetTokenInfo", err, "slot=%d -> serial=%s", slotID, info.SerialNumber)
+	}(time.Now())
+	return t.ctx.GetTokenInfo(slotID)
+}
@@ -0,0 +1,18 @@
+package yubikey
+
+import (
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttrTypesRedactsValues(t *testing.T) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, []byte("secret key bytes")),
+	}
+	desc := attrTypes(template)
+	require.Equal(t, "{0x0[8] 0x11[16]}", desc)
+	require.NotContains(t, desc, "secret")
+}
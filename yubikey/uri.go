@@ -0,0 +1,285 @@
+package yubikey
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/jschintag/notary-yubikey-adapter/backend"
+	"github.com/miekg/pkcs11"
+)
+
+const uriScheme = "pkcs11:"
+
+// URI is a PKCS#11 URI as defined by RFC 7512, limited to the attributes
+// which select a module, a token and a key
+type URI struct {
+	// ModulePath and ModuleName select the pkcs11 library, the name is
+	// the file name without the lib prefix and the extension
+	ModulePath string
+	ModuleName string
+	// Token is the label of the token
+	Token        string
+	Manufacturer string
+	Model        string
+	Serial       string
+	// Object is the label of the key
+	Object string
+	// ID is the CKA_ID of the key, for yubikeys the byte of the slot
+	ID []byte
+	// Type is the object class, only private keys are selected
+	Type string
+}
+
+// ParseURI parses a pkcs11: URI. The PIN can not be given by pin-value,
+// other query attributes unknown to the adapter are ignored
+func ParseURI(s string) (URI, error) {
+	var u URI
+	if len(s) < len(uriScheme) || !strings.EqualFold(s[:len(uriScheme)], uriScheme) {
+		return u, NewError(ErrCodeInvalidRequest, "%q is no pkcs11: URI", s)
+	}
+	path, query := s[len(uriScheme):], ""
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+
+	seen := make(map[string]bool)
+	attrs := func(part, sep string, set func(name, value string) error) error {
+		for _, attr := range strings.Split(part, sep) {
+			if attr == "" {
+				continue
+			}
+			kv := strings.SplitN(attr, "=", 2)
+			if len(kv) != 2 {
+				return NewError(ErrCodeInvalidRequest, "pkcs11 URI attribute %q has no value", attr)
+			}
+			value, err := url.PathUnescape(kv[1])
+			if err != nil {
+				return NewError(ErrCodeInvalidRequest, "pkcs11 URI attribute %s: %v", kv[0], err)
+			}
+			if seen[kv[0]] {
+				return NewError(ErrCodeInvalidRequest, "pkcs11 URI attribute %s is repeated", kv[0])
+			}
+			seen[kv[0]] = true
+			if err := set(kv[0], value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := attrs(path, ";", func(name, value string) error {
+		switch name {
+		case "token":
+			u.Token = value
+		case "manufacturer":
+			u.Manufacturer = value
+		case "model":
+			u.Model = value
+		case "serial":
+			u.Serial = value
+		case "object":
+			u.Object = value
+		case "id":
+			u.ID = []byte(value)
+		case "type":
+			u.Type = value
+		default:
+			if !strings.HasPrefix(name, "x-") {
+				return NewError(ErrCodeInvalidRequest, "pkcs11 URI attribute %s is not supported", name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return u, err
+	}
+	err = attrs(query, "&", func(name, value string) error {
+		switch name {
+		case "module-path":
+			u.ModulePath = value
+		case "module-name":
+			u.ModuleName = value
+		case "pin-value":
+			return NewError(ErrCodeInvalidRequest, "pkcs11 URIs must not carry the PIN")
+		}
+		return nil
+	})
+	return u, err
+}
+
+// String formats u as pkcs11: URI
+func (u URI) String() string {
+	var path, query []string
+	add := func(attrs *[]string, name, value string) {
+		if value != "" {
+			*attrs = append(*attrs, name+"="+escapeURIValue(value))
+		}
+	}
+	add(&path, "token", u.Token)
+	add(&path, "manufacturer", u.Manufacturer)
+	add(&path, "model", u.Model)
+	add(&path, "serial", u.Serial)
+	add(&path, "object", u.Object)
+	add(&path, "id", string(u.ID))
+	add(&path, "type", u.Type)
+	add(&query, "module-path", u.ModulePath)
+	add(&query, "module-name", u.ModuleName)
+
+	s := uriScheme + strings.Join(path, ";")
+	if len(query) > 0 {
+		s += "?" + strings.Join(query, "&")
+	}
+	return s
+}
+
+// escapeURIValue percent-encodes all bytes but the unreserved ones of RFC 3986
+func escapeURIValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// selectsToken returns whether u names token attributes
+func (u URI) selectsToken() bool {
+	return u.Token != "" || u.Manufacturer != "" || u.Model != "" || u.Serial != ""
+}
+
+// selectsObject returns whether u names key attributes
+func (u URI) selectsObject() bool {
+	return u.Object != "" || u.ID != nil || u.Type != ""
+}
+
+// matchesToken returns whether the token attributes of u match info. The
+// fields of CK_TOKEN_INFO are padded with blanks
+func (u URI) matchesToken(info pkcs11.TokenInfo) bool {
+	match := func(want, got string) bool {
+		return want == "" || want == strings.TrimSpace(got)
+	}
+	return match(u.Token, info.Label) && match(u.Manufacturer, info.ManufacturerID) &&
+		match(u.Model, info.Model) && match(u.Serial, info.SerialNumber)
+}
+
+// matchesModule returns whether the module attributes of u select the library at path
+func (u URI) matchesModule(path string) bool {
+	if u.ModulePath != "" && filepath.Clean(u.ModulePath) != filepath.Clean(path) {
+		return false
+	}
+	return u.ModuleName == "" || u.ModuleName == moduleName(path)
+}
+
+// moduleName is the module-name of the library at path, e.g. ykcs11 for
+// /usr/lib/libykcs11.so.2
+func moduleName(path string) string {
+	name := filepath.Base(path)
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		name = name[:i]
+	}
+	return strings.TrimPrefix(name, "lib")
+}
+
+// ResolveURI returns the keys selected by a pkcs11 URI. Without token
+// attributes only the yubikey of the session is searched, otherwise all
+// attached yubikeys matching them
+func (ks *KeyStore) ResolveURI(session pkcs11.SessionHandle, raw string) ([]backend.TokenKey, error) {
+	u, err := ParseURI(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !u.matchesModule(pkcs11Lib) {
+		return nil, NewError(ErrCodeInvalidRequest, "%s selects another module than %s", raw, pkcs11Lib)
+	}
+	if u.Type != "" && u.Type != "private" {
+		return nil, NewError(ErrCodeInvalidRequest, "%s selects %s objects, only private keys can be used", raw, u.Type)
+	}
+
+	var keys []backend.TokenKey
+	if !u.selectsToken() {
+		serial, err := ks.SessionSerial(session)
+		if err != nil {
+			return nil, err
+		}
+		if keys, err = ks.uriKeys(session, serial, u); err != nil {
+			return nil, err
+		}
+	} else {
+		slots, err := pkcs11Ctx.GetSlotList(true)
+		if err != nil {
+			return nil, newPKCS11Error(err, "failed to list HSM slots")
+		}
+		for _, slot := range slots {
+			info, err := pkcs11Ctx.GetTokenInfo(slot)
+			if err != nil || !u.matchesToken(info) {
+				continue
+			}
+			err = ks.withTokenSession(slot, func(s pkcs11.SessionHandle) error {
+				tokenKeys, err := ks.uriKeys(s, strings.TrimSpace(info.SerialNumber), u)
+				keys = append(keys, tokenKeys...)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, NewError(ErrCodeKeyNotFound, "no key matches %s", raw)
+	}
+	return keys, nil
+}
+
+// uriKeys lists the keys of a session matching the key attributes of u
+func (ks *KeyStore) uriKeys(session pkcs11.SessionHandle, serial string, u URI) ([]backend.TokenKey, error) {
+	list, err := ks.HardwareListKeys(session)
+	if ErrorCodeOf(err) == ErrCodeKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []backend.TokenKey
+	for keyID, hwslot := range list {
+		if u.ID != nil && !bytes.Equal(u.ID, hwslot.SlotID) {
+			continue
+		}
+		if u.Object != "" {
+			label, err := objectLabel(session, hwslot.SlotID)
+			if err != nil {
+				return nil, err
+			}
+			if label != u.Object {
+				continue
+			}
+		}
+		hwslot.KeyID = keyID
+		keys = append(keys, backend.TokenKey{KeyID: keyID, Serial: serial, Slot: hwslot, PublicKey: listedKeys.get(keyID)})
+	}
+	return keys, nil
+}
+
+// objectLabel returns the CKA_LABEL of the private key in slotID
+func objectLabel(session pkcs11.SessionHandle, slotID []byte) (string, error) {
+	obj, err := findObject(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, slotID),
+	})
+	if err != nil {
+		return "", err
+	}
+	attr, err := pkcs11Ctx.GetAttributeValue(session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+	})
+	if err != nil || len(attr) != 1 {
+		return "", newPKCS11Error(err, "failed to read the label of the key in slot %s", SlotName(slotID))
+	}
+	return string(attr[0].Value), nil
+}
@@ -0,0 +1,39 @@
+package yubikey
+
+import (
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseURI(t *testing.T) {
+	u, err := ParseURI("pkcs11:token=YubiKey%20PIV%20%2312345678;serial=12345678;id=%82;x-vendor=1?module-name=ykcs11&pin-source=file:/pin")
+	require.NoError(t, err)
+	require.Equal(t, URI{Token: "YubiKey PIV #12345678", Serial: "12345678", ID: []byte{0x82}, ModuleName: "ykcs11"}, u)
+	require.Equal(t, "pkcs11:token=YubiKey%20PIV%20%2312345678;serial=12345678;id=%82?module-name=ykcs11", u.String())
+
+	for _, invalid := range []string{
+		"serial=1",
+		"pkcs11:serial",
+		"pkcs11:serial=1;serial=2",
+		"pkcs11:slot-id=0",
+		"pkcs11:id=%8",
+		"pkcs11:serial=1?pin-value=123456",
+	} {
+		_, err := ParseURI(invalid)
+		require.Equal(t, ErrCodeInvalidRequest, ErrorCodeOf(err), invalid)
+	}
+}
+
+func TestURIMatches(t *testing.T) {
+	u := URI{Serial: "12345678", Model: "YubiKey YK5"}
+	require.True(t, u.matchesToken(pkcs11.TokenInfo{SerialNumber: "12345678        ", Model: "YubiKey YK5     "}))
+	require.False(t, u.matchesToken(pkcs11.TokenInfo{SerialNumber: "87654321", Model: "YubiKey YK5"}))
+	require.True(t, URI{}.matchesToken(pkcs11.TokenInfo{SerialNumber: "87654321"}))
+
+	require.Equal(t, "ykcs11", moduleName("/usr/lib/x86_64-linux-gnu/libykcs11.so.2"))
+	require.True(t, URI{ModuleName: "ykcs11"}.matchesModule("/usr/local/lib/libykcs11.dylib"))
+	require.True(t, URI{ModulePath: "/usr/lib//libykcs11.so"}.matchesModule("/usr/lib/libykcs11.so"))
+	require.False(t, URI{ModulePath: "/usr/lib/libsofthsm2.so"}.matchesModule("/usr/lib/libykcs11.so"))
+}
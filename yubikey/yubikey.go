@@ -1,17 +1,20 @@
 package yubikey
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/sha256"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/big"
 	"os"
+	"sync"
 	"time"
 
+	"github.com/jschintag/notary-yubikey-adapter/backend"
 	"github.com/miekg/pkcs11"
 	"github.com/sirupsen/logrus"
 	"github.com/theupdateframework/notary/trustmanager/pkcs11/common"
@@ -43,6 +46,7 @@ const (
 // what key mode to use when generating keys
 var (
 	yubikeyKeymode = KEYMODE_TOUCH | KEYMODE_PIN_ONCE
+	keymodeLock    sync.RWMutex
 	// order in which to prefer token locations on the yubikey.
 	// corresponds to: 9c, 9e, 9d, 9a
 	slotIDs                     = []int{2, 1, 3, 0}
@@ -56,32 +60,65 @@ func SetYubikeyKeyMode(keyMode int) error {
 	// technically 7 (1 | 2 | 4) is valid, but KEYMODE_PIN_ONCE +
 	// KEYMODE_PIN_ALWAYS don't really make sense together
 	if keyMode < 0 || keyMode > 5 {
-		return errors.New("Invalid key mode")
+		return NewError(ErrCodeInvalidRequest, "Invalid key mode")
 	}
+	keymodeLock.Lock()
+	defer keymodeLock.Unlock()
 	yubikeyKeymode = keyMode
 	return nil
 }
 
-var pkcs11Lib string
+// YubikeyKeyMode returns the mode used when generating yubikey keys
+func YubikeyKeyMode() int {
+	keymodeLock.RLock()
+	defer keymodeLock.RUnlock()
+	return yubikeyKeymode
+}
+
+var (
+	pkcs11Lib string
+	// libraryOverride is the library set by SetLibrary, it replaces the search
+	libraryOverride string
+	// the token slot sessions are opened on
+	tokenSlot uint
+)
 
 // KeyStore is the hardwarespecific keystore implementing all functions
 type KeyStore struct {
+	// reserved slot IDs are never allocated, imported into or deleted from
+	reserved map[byte]bool
+	// mapped slot IDs hold keys whose role is configured, not stored in
+	// their certificate
+	mapped map[byte]SlotMapping
+	// token selects the yubikey sessions are opened on, the first attached
+	// one is used if it is nil
+	token *URI
+	// attestationRoots issue the attestation key of the token, the Yubico
+	// CAs are used if it is nil
+	attestationRoots *x509.CertPool
 }
 
 // NewKeyStore looks up all possible filepaths for the yubikey library and if it finds one, sets it up for further usage
 func NewKeyStore() *KeyStore {
-	if possiblePkcs11Libs != nil {
-		for _, loc := range possiblePkcs11Libs {
-			_, err := os.Stat(loc)
-			if err == nil {
-				p := pkcs11.New(loc)
-				if p != nil {
-					pkcs11Lib = loc
-				}
-			}
-		}
+	if lib := findLibrary(); lib != "" {
+		pkcs11Lib = lib
 	}
-	return &KeyStore{}
+	return &KeyStore{reserved: make(map[byte]bool)}
+}
+
+// SetLibrary makes the keystores load the pkcs11 library at path instead
+// of searching the usual locations
+func SetLibrary(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return NewError(ErrCodeNoToken, "pkcs11 library %s: %v", path, err)
+	}
+	libraryOverride = path
+	return nil
+}
+
+// LibraryCandidates returns the paths the ykcs11 library is looked up at
+func LibraryCandidates() []string {
+	return libraryCandidates()
 }
 
 //Name returns the hardwarestores name
@@ -89,12 +126,60 @@ func (ks *KeyStore) Name() string {
 	return name
 }
 
+func init() {
+	backend.Register(name, func(raw json.RawMessage) (backend.Backend, error) {
+		cfg, err := parseConfig(raw)
+		if err != nil {
+			return nil, err
+		}
+		reserved, err := cfg.reservedSlots()
+		if err != nil {
+			return nil, err
+		}
+		mapped, err := cfg.slotMappings()
+		if err != nil {
+			return nil, err
+		}
+		token, err := cfg.tokenURI()
+		if err != nil {
+			return nil, err
+		}
+		if err := setLibrarySearch(cfg.LibraryPaths, token); err != nil {
+			return nil, err
+		}
+		var roots *x509.CertPool
+		if cfg.AttestationRoots != "" {
+			if roots, err = LoadAttestationRoots(cfg.AttestationRoots); err != nil {
+				return nil, err
+			}
+		}
+		ks := NewKeyStore()
+		if token != nil && (token.ModulePath != "" || token.ModuleName != "") && pkcs11Lib == "" {
+			return nil, NewError(ErrCodeNoToken, "no library matches %s", token)
+		}
+		ks.reserved = reserved
+		ks.mapped = mapped
+		ks.token = token
+		ks.attestationRoots = roots
+		return ks, nil
+	})
+}
+
+// Cleanup finalizes and destroys the context, as the package level Cleanup does
+func (ks *KeyStore) Cleanup() {
+	Cleanup()
+}
+
 // Finalizes and Destroys the Context
 func Cleanup() {
 	if pkcs11Ctx != nil {
 		common.FinalizeAndDestroy(pkcs11Ctx)
 		pkcs11Ctx = nil
 	}
+	signPool.reset()
+	keyHandles.clear()
+	forgetMechanisms()
+	forgetTokenModels()
 }
 
 // AddECDSAKey adds a key to the yubikey
@@ -105,21 +190,42 @@ func (ks *KeyStore) AddECDSAKey(
 	passwd string,
 	role data.RoleName,
 ) error {
-	logrus.Debugf("Attempting to add key to yubikey with ID: %s", privKey.ID())
+	return ks.AddECDSAKeyWithOptions(session, privKey, hwslot, passwd, role, backend.AddKeyOptions{})
+}
 
-	err := pkcs11Ctx.Login(session, pkcs11.CKU_SO, passwd)
+// AddECDSAKeyWithOptions adds a key to the yubikey, stored as described by opts
+func (ks *KeyStore) AddECDSAKeyWithOptions(
+	session pkcs11.SessionHandle,
+	privKey data.PrivateKey,
+	hwslot common.HardwareSlot,
+	passwd string,
+	role data.RoleName,
+	opts backend.AddKeyOptions,
+) error {
+	logrus.Debugf("Attempting to add key to yubikey with ID: %s", privKey.ID())
+	defer keyMapCache.forget()
+	defer keyHandles.forgetSlot(hwslot.SlotID)
+	if err := ks.checkNotReserved(hwslot.SlotID); err != nil {
+		return err
+	}
+	if fipsMode {
+		return NewError(ErrCodePolicyDenied, "key import is not allowed in FIPS mode, keys have to be generated on the token")
+	}
+	ecdsaPrivKey, err := ValidateImportKey(privKey)
 	if err != nil {
 		return err
 	}
-	defer pkcs11Ctx.Logout(session)
+	defer wipeBigInt(ecdsaPrivKey.D)
 
-	// Create an ecdsa.PrivateKey out of the private key bytes
-	ecdsaPrivKey, err := x509.ParseECPrivateKey(privKey.Private())
+	defer exclusiveLogin(tokenSlot, session)()
+	err = pkcs11Ctx.Login(session, managementUser(), passwd)
 	if err != nil {
-		return err
+		return WrapError(ErrCodeUnknown, err)
 	}
+	defer pkcs11Ctx.Logout(session)
 
-	ecdsaPrivKeyD := common.EnsurePrivateKeySize(ecdsaPrivKey.D.Bytes())
+	ecdsaPrivKeyD := SecureBytes(common.EnsurePrivateKeySize(ecdsaPrivKey.D.Bytes()))
+	defer ecdsaPrivKeyD.Wipe()
 
 	// Hard-coded policy: the generated certificate expires in 10 years.
 	startTime := time.Now()
@@ -143,26 +249,57 @@ func (ks *KeyStore) AddECDSAKey(
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
 		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
 		pkcs11.NewAttribute(pkcs11.CKA_ID, hwslot.SlotID),
-		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}),
-		pkcs11.NewAttribute(pkcs11.CKA_VALUE, ecdsaPrivKeyD),
-		pkcs11.NewAttribute(pkcs11.CKA_VENDOR_DEFINED, yubikeyKeymode),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, oidP256),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, []byte(ecdsaPrivKeyD)),
+		pkcs11.NewAttribute(pkcs11.CKA_VENDOR_DEFINED, YubikeyKeyMode()),
+	}
+	templates := [][]*pkcs11.Attribute{certTemplate, privateKeyTemplate}
+	if genericToken() {
+		if templates, err = genericTemplates(hwslot.SlotID, certTemplate, privateKeyTemplate, certBytes, &ecdsaPrivKey.PublicKey); err != nil {
+			return fmt.Errorf("failed to read the certificate back: %v", err)
+		}
 	}
 
-	_, err = pkcs11Ctx.CreateObject(session, certTemplate)
+	// only touch the slot once everything is prepared
+	existing, err := slotObjects(session, hwslot.SlotID)
 	if err != nil {
-		return fmt.Errorf("error importing: %v", err)
+		return err
+	}
+	if len(existing) > 0 {
+		if !opts.Overwrite {
+			return NewError(ErrCodeSlotOccupied, "slot %s already holds a key, pass overwrite to replace it", SlotName(hwslot.SlotID))
+		}
+		logrus.Infof("Overwriting the %d objects in slot %s", len(existing), SlotName(hwslot.SlotID))
+		if err := destroyObjects(session, existing); err != nil {
+			return err
+		}
 	}
 
-	_, err = pkcs11Ctx.CreateObject(session, privateKeyTemplate)
-	if err != nil {
-		return fmt.Errorf("error importing: %v", err)
+	for i, template := range templates {
+		if _, err = pkcs11Ctx.CreateObject(session, template); err != nil {
+			if i > 0 {
+				// a certificate without its key would still be listed, so
+				// leave the slot empty rather than half written
+				rollbackSlot(session, hwslot.SlotID)
+			}
+			return newPKCS11Error(err, "error importing")
+		}
 	}
+	quarantine.release(hwslot.SlotID)
 
 	return nil
 }
 
 //GetECDSAKey gets a key by id from the yubikey store
-func (ks *KeyStore) GetECDSAKey(session pkcs11.SessionHandle, hwslot common.HardwareSlot, _ string) (*data.ECDSAPublicKey, data.RoleName, error) {
+func (ks *KeyStore) GetECDSAKey(session pkcs11.SessionHandle, hwslot common.HardwareSlot, _ string) (pubKey *data.ECDSAPublicKey, role data.RoleName, err error) {
+	err = withRetry("GetECDSAKey", func() error {
+		pubKey, role, err = ks.getECDSAKey(session, hwslot)
+		return err
+	})
+	return pubKey, role, err
+}
+
+func (ks *KeyStore) getECDSAKey(session pkcs11.SessionHandle, hwslot common.HardwareSlot) (*data.ECDSAPublicKey, data.RoleName, error) {
 	findTemplate := []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
 		pkcs11.NewAttribute(pkcs11.CKA_ID, hwslot.SlotID),
@@ -175,22 +312,13 @@ func (ks *KeyStore) GetECDSAKey(session pkcs11.SessionHandle, hwslot common.Hard
 		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, []byte{0}),
 	}
 
-	if err := pkcs11Ctx.FindObjectsInit(session, findTemplate); err != nil {
-		logrus.Debugf("Failed to init: %s", err.Error())
-		return nil, "", err
-	}
-	obj, _, err := pkcs11Ctx.FindObjects(session, 1)
+	obj, err := findObjects(session, findTemplate)
 	if err != nil {
-		logrus.Debugf("Failed to find objects: %v", err)
-		return nil, "", err
-	}
-	if err := pkcs11Ctx.FindObjectsFinal(session); err != nil {
-		logrus.Debugf("Failed to finalize: %s", err.Error())
+		logrus.Debugf("Failed to find the public key: %v", err)
 		return nil, "", err
 	}
-	if len(obj) != 1 {
-		logrus.Debugf("should have found one object")
-		return nil, "", errors.New("no matching keys found inside of yubikey")
+	if len(obj) == 0 {
+		return nil, "", NewError(ErrCodeKeyNotFound, "no matching keys found inside of yubikey")
 	}
 
 	// Retrieve the public-key material to be able to create a new ECSAKey
@@ -209,7 +337,15 @@ func (ks *KeyStore) GetECDSAKey(session pkcs11.SessionHandle, hwslot common.Hard
 
 	}
 
-	ecdsaPubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(rawPubKey[3:35]), Y: new(big.Int).SetBytes(rawPubKey[35:])}
+	// the point is DER encoded, an octet string holding the uncompressed point
+	var x, y *big.Int
+	if len(rawPubKey) > 2 {
+		x, y = elliptic.Unmarshal(elliptic.P256(), rawPubKey[2:])
+	}
+	if x == nil {
+		return nil, "", NewError(ErrCodeDevice, "the public key in slot %s is not a P-256 point", SlotName(hwslot.SlotID))
+	}
+	ecdsaPubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
 	pubBytes, err := x509.MarshalPKIXPublicKey(&ecdsaPubKey)
 	if err != nil {
 		logrus.Debugf("Failed to Marshal public key")
@@ -221,49 +357,126 @@ func (ks *KeyStore) GetECDSAKey(session pkcs11.SessionHandle, hwslot common.Hard
 
 // Sign returns a signature for a given signature request
 func (ks *KeyStore) Sign(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string, payload []byte) ([]byte, error) {
-	err := pkcs11Ctx.Login(session, pkcs11.CKU_USER, passwd)
+	return ks.SignWithOptions(session, hwslot, passwd, payload, backend.SignOptions{})
+}
+
+// SignWithOptions returns a signature for a given signature request, signed as described by opts
+func (ks *KeyStore) SignWithOptions(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string, payload []byte, opts backend.SignOptions) ([]byte, error) {
+	var sig []byte
+	err := withRetry("Sign", func() error {
+		var err error
+		if signPool.usable() {
+			sig, err = ks.signPooled(hwslot, passwd, payload, opts)
+		} else {
+			sig, err = ks.signOnSlot(tokenSlot, session, hwslot, passwd, payload, opts)
+		}
+		return err
+	})
+	return sig, err
+}
+
+// signOnSlot signs with a session of the token in the given pkcs11 slot
+func (ks *KeyStore) signOnSlot(slot uint, session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string, payload []byte, opts backend.SignOptions) ([]byte, error) {
+	hash, err := payloadHash(payload, opts)
 	if err != nil {
-		return nil, fmt.Errorf("error logging in: %v", err)
+		return nil, err
 	}
-	defer pkcs11Ctx.Logout(session)
 
-	// Define the ECDSA Private key template
-	class := pkcs11.CKO_PRIVATE_KEY
-	privateKeyTemplate := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
-		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
-		pkcs11.NewAttribute(pkcs11.CKA_ID, hwslot.SlotID),
+	unlock := exclusiveLogin(slot, session)
+	if err := userLogin(slot, session, passwd); err != nil {
+		unlock()
+		return nil, err
 	}
+	return ks.signLoggedIn(slot, session, hwslot, hash, payload, opts, func() {
+		pkcs11Ctx.Logout(session)
+		unlock()
+	})
+}
 
-	if err := pkcs11Ctx.FindObjectsInit(session, privateKeyTemplate); err != nil {
-		logrus.Debugf("Failed to init find objects: %s", err.Error())
-		return nil, err
+// payloadHash returns the hash the payload is signed with
+func payloadHash(payload []byte, opts backend.SignOptions) (crypto.Hash, error) {
+	hash, err := digestHash(opts.DigestAlgorithm)
+	if err != nil {
+		return 0, err
+	}
+	if opts.Prehashed && len(payload) != hash.Size() {
+		return 0, NewError(ErrCodeInvalidRequest, "digest has %d bytes, but %s needs %d", len(payload), hash, hash.Size())
 	}
-	obj, _, err := pkcs11Ctx.FindObjects(session, 1)
+	return hash, nil
+}
+
+// signLoggedIn signs with a session which is logged in. release is called
+// once the session is no longer used, which is after signWithTimeout gave up
+// waiting if the yubikey is not touched
+func (ks *KeyStore) signLoggedIn(slot uint, session pkcs11.SessionHandle, hwslot common.HardwareSlot, hash crypto.Hash, payload []byte, opts backend.SignOptions, release func()) ([]byte, error) {
+	// once signing started, signWithTimeout releases the session
+	signing := false
+	defer func() {
+		if !signing {
+			release()
+		}
+	}()
+
+	obj, cached, err := privateKeyHandle(session, hwslot.SlotID)
 	if err != nil {
-		logrus.Debugf("Failed to find objects: %v", err)
+		logrus.Debugf("Failed to find the private key: %v", err)
 		return nil, err
 	}
-	if err = pkcs11Ctx.FindObjectsFinal(session); err != nil {
-		logrus.Debugf("Failed to finalize find objects: %s", err.Error())
+
+	// Make sure the digest is at least as strong as the key
+	curveTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+	}
+	attr, err := pkcs11Ctx.GetAttributeValue(session, obj, curveTemplate)
+	if cached && staleHandle(err) {
+		// the key was replaced by another application
+		keyHandles.forget(session, hwslot.SlotID)
+		if obj, _, err = privateKeyHandle(session, hwslot.SlotID); err != nil {
+			return nil, err
+		}
+		attr, err = pkcs11Ctx.GetAttributeValue(session, obj, curveTemplate)
+	}
+	if (err != nil || len(attr) != 1) && fipsMode {
+		return nil, NewError(ErrCodePolicyDenied, "curve of key in slot %x is unknown, refusing to sign in FIPS mode", hwslot.SlotID)
+	}
+	if err != nil || len(attr) != 1 {
+		// the digest can not be checked against a curve assumed
+		return nil, NewError(ErrCodeDevice, "curve of key in slot %x is unknown, refusing to sign: %v", hwslot.SlotID, err)
+	}
+	curve, ok := curveFromParams(attr[0].Value)
+	if !ok {
+		return nil, NewError(ErrCodeInvalidRequest, "key in slot %x uses an unsupported curve", hwslot.SlotID)
+	}
+	if err := checkDigestForCurve(hash, curve); err != nil {
 		return nil, err
 	}
-	if len(obj) != 1 {
-		return nil, errors.New("length of objects found not 1")
+	if err := checkFIPS(hash, curve); err != nil {
+		return nil, err
 	}
 
 	var sig []byte
+	mech, hashing := signingMechanism(slot, hash, opts.Prehashed)
 	err = pkcs11Ctx.SignInit(
-		session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, obj[0])
+		session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mech, nil)}, obj)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get the SHA256 of the payload
-	digest := sha256.Sum256(payload)
+	// Get the digest of the payload, unless the mechanism hashes on the token
+	digest := payload
+	if !opts.Prehashed && !hashing {
+		h := hash.New()
+		h.Write(payload)
+		digest = h.Sum(nil)
+	}
 
 	// a call to Sign, whether or not Sign fails, will clear the SignInit
-	sig, err = pkcs11Ctx.Sign(session, digest[:])
+	signing = true
+	start := time.Now()
+	sig, err = signWithTimeout(pkcs11Ctx, session, digest, release)
+	if opts.Timings != nil && YubikeyKeyMode()&KEYMODE_TOUCH != 0 {
+		opts.Timings.Touch += time.Since(start)
+	}
 	if err != nil {
 		logrus.Debugf("Error while signing: %s", err)
 		return nil, err
@@ -272,40 +485,45 @@ func (ks *KeyStore) Sign(session pkcs11.SessionHandle, hwslot common.HardwareSlo
 	if sig == nil {
 		return nil, errors.New("Failed to create signature")
 	}
-	return sig[:], nil
+
+	r, sVal, err := parseSignature(sig, curve)
+	if err != nil {
+		return nil, err
+	}
+	if opts.LowS || defaultLowS {
+		sVal = normalizeLowS(sVal, curve)
+	}
+	return encodeSignature(r, sVal, curve, opts.Encoding)
 }
 
 // HardwareRemoveKey removes the Key with a specified ID from the yubikey store
 func (ks *KeyStore) HardwareRemoveKey(session pkcs11.SessionHandle, hwslot common.HardwareSlot, passwd string, keyID string) error {
-	err := pkcs11Ctx.Login(session, pkcs11.CKU_SO, passwd)
-	if err != nil {
+	defer keyMapCache.forget()
+	defer keyHandles.forgetSlot(hwslot.SlotID)
+	if err := ks.checkNotReserved(hwslot.SlotID); err != nil {
 		return err
 	}
+	defer exclusiveLogin(tokenSlot, session)()
+	err := pkcs11Ctx.Login(session, managementUser(), passwd)
+	if err != nil {
+		return WrapError(ErrCodeUnknown, err)
+	}
 	defer pkcs11Ctx.Logout(session)
 
 	template := []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
 		pkcs11.NewAttribute(pkcs11.CKA_ID, hwslot.SlotID),
-		//pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
 	}
 
-	if err := pkcs11Ctx.FindObjectsInit(session, template); err != nil {
-		logrus.Debugf("Failed to init find objects: %s", err.Error())
-		return err
-	}
-	obj, b, err := pkcs11Ctx.FindObjects(session, 1)
+	obj, err := findObjects(session, template)
 	if err != nil {
-		logrus.Debugf("Failed to find objects: %s %v", err.Error(), b)
-		return err
-	}
-	if err := pkcs11Ctx.FindObjectsFinal(session); err != nil {
-		logrus.Debugf("Failed to finalize find objects: %s", err.Error())
+		logrus.Debugf("Failed to find the certificate: %v", err)
 		return err
 	}
 	if len(obj) != 1 {
 		logrus.Debugf("should have found exactly one object")
-		return err
+		return NewError(ErrCodeKeyNotFound, "no certificate found in slot %x", hwslot.SlotID)
 	}
 
 	// Delete the certificate
@@ -314,11 +532,41 @@ func (ks *KeyStore) HardwareRemoveKey(session pkcs11.SessionHandle, hwslot commo
 		logrus.Debugf("Failed to delete cert")
 		return err
 	}
+
+	// Delete the private and public key, then make sure the slot is free
+	remaining, err := slotObjects(session, hwslot.SlotID)
+	if err != nil {
+		return err
+	}
+	if err := destroyObjects(session, remaining); err != nil {
+		return err
+	}
+	remaining, err = slotObjects(session, hwslot.SlotID)
+	if err != nil {
+		return err
+	}
+	if len(remaining) > 0 {
+		return NewError(ErrCodeDevice, "slot %s still holds %d objects after removing the key", SlotName(hwslot.SlotID), len(remaining))
+	}
+	quarantine.release(hwslot.SlotID)
 	return nil
 }
 
 //HardwareListKeys lists all available Keys stored by yubikey
 func (ks *KeyStore) HardwareListKeys(session pkcs11.SessionHandle) (keys map[string]common.HardwareSlot, err error) {
+	return ks.listKeysOnSlot(tokenSlot, session)
+}
+
+// listKeysOnSlot lists the keys of the token in the given pkcs11 slot
+func (ks *KeyStore) listKeysOnSlot(slot uint, session pkcs11.SessionHandle) (keys map[string]common.HardwareSlot, err error) {
+	err = withRetry("HardwareListKeys", func() error {
+		keys, err = ks.hardwareListKeys(slot, session)
+		return err
+	})
+	return keys, err
+}
+
+func (ks *KeyStore) hardwareListKeys(slot uint, session pkcs11.SessionHandle) (keys map[string]common.HardwareSlot, err error) {
 	keys = make(map[string]common.HardwareSlot)
 
 	attrTemplate := []*pkcs11.Attribute{
@@ -332,9 +580,28 @@ func (ks *KeyStore) HardwareListKeys(session pkcs11.SessionHandle) (keys map[str
 	}
 
 	if len(objs) == 0 {
-		return nil, errors.New("no keys found in yubikey")
+		return nil, NewError(ErrCodeKeyNotFound, "no keys found in yubikey")
+	}
+
+	// with the key cache, the certificates are only read if the objects
+	// on the token changed since the keys were cached
+	var serial, generation string
+	if keyMapCache.enabled() {
+		serial, generation = ks.cacheKey(slot, session, objs)
+		if cached, ok := keyMapCache.lookup(serial, generation); ok {
+			logrus.Debugf("Using the cached keys of yubikey %s", serial)
+			return cached, nil
+		}
+		if generation != "" {
+			defer func() {
+				if err == nil {
+					keyMapCache.store(serial, generation, keys)
+				}
+			}()
+		}
 	}
 	logrus.Debugf("Found %d objects matching list filters", len(objs))
+	quarantined := quarantinedSlots(slot)
 	for _, obj := range objs {
 		var (
 			cert *x509.Certificate
@@ -357,9 +624,6 @@ func (ks *KeyStore) HardwareListKeys(session pkcs11.SessionHandle) (keys map[str
 				if err != nil {
 					continue
 				}
-				if !data.ValidRole(data.RoleName(cert.Subject.CommonName)) {
-					continue
-				}
 			}
 		}
 
@@ -367,6 +631,10 @@ func (ks *KeyStore) HardwareListKeys(session pkcs11.SessionHandle) (keys map[str
 		if cert == nil {
 			continue
 		}
+		if len(slot) == 1 && quarantined[slot[0]] {
+			logrus.Debugf("Skipping the certificate in the quarantined slot %s", SlotName(slot))
+			continue
+		}
 
 		var ecdsaPubKey *ecdsa.PublicKey
 		switch cert.PublicKeyAlgorithm {
@@ -383,86 +651,90 @@ func (ks *KeyStore) HardwareListKeys(session pkcs11.SessionHandle) (keys map[str
 			continue
 		}
 
-		keys[data.NewECDSAPublicKey(pubBytes).ID()] = common.HardwareSlot{
-			Role:   data.RoleName(cert.Subject.CommonName),
+		keyID := data.NewECDSAPublicKey(pubBytes).ID()
+		listedKeys.set(keyID, pubBytes)
+		role := data.RoleName(cert.Subject.CommonName)
+		if !data.ValidRole(role) {
+			// certificates not issued by notary, e.g. by a CA
+			mapped, ok := ks.mappedRole(slot, keyID)
+			if !ok {
+				continue
+			}
+			role = mapped
+		}
+		keys[keyID] = common.HardwareSlot{
+			Role:   role,
 			SlotID: slot,
 		}
 	}
 	return
 }
 
+// publicKeys maps key IDs to the DER encoded public keys the listings
+// parsed. A key ID is derived from the public key, so entries never change
+type publicKeys struct {
+	sync.Mutex
+	byID map[string][]byte
+}
+
+var listedKeys = &publicKeys{byID: make(map[string][]byte)}
+
+func (k *publicKeys) set(keyID string, der []byte) {
+	k.Lock()
+	defer k.Unlock()
+	k.byID[keyID] = der
+}
+
+// get returns the public key of keyID, nil if no listing found it yet
+func (k *publicKeys) get(keyID string) []byte {
+	k.Lock()
+	defer k.Unlock()
+	return k.byID[keyID]
+}
+
+// listObjects returns the certificates on the token
 func (ks *KeyStore) listObjects(session pkcs11.SessionHandle) ([]pkcs11.ObjectHandle, error) {
-	findTemplate := []*pkcs11.Attribute{
+	return findObjects(session, []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
-	}
+	})
+}
 
-	if err := pkcs11Ctx.FindObjectsInit(session, findTemplate); err != nil {
-		logrus.Debugf("Failed to init: %s", err.Error())
-		return nil, err
-	}
+//GetNextEmptySlot returns the first empty slot found by yubikey to store a key
+func (ks *KeyStore) GetNextEmptySlot(session pkcs11.SessionHandle) (slot []byte, err error) {
+	err = withRetry("GetNextEmptySlot", func() error {
+		slot, err = ks.getNextEmptySlot(session)
+		return err
+	})
+	return slot, err
+}
 
-	objs, b, err := pkcs11Ctx.FindObjects(session, numSlots)
-	for err == nil {
-		var o []pkcs11.ObjectHandle
-		o, b, err = pkcs11Ctx.FindObjects(session, numSlots)
-		if err != nil {
-			continue
-		}
-		if len(o) == 0 {
-			break
-		}
-		objs = append(objs, o...)
-	}
+func (ks *KeyStore) getNextEmptySlot(session pkcs11.SessionHandle) ([]byte, error) {
+	free, err := ks.freeSlots(session)
 	if err != nil {
-		logrus.Debugf("Failed to find: %s %v", err.Error(), b)
-		if len(objs) == 0 {
-			return nil, err
-		}
-	}
-	if err := pkcs11Ctx.FindObjectsFinal(session); err != nil {
-		logrus.Debugf("Failed to finalize: %s", err.Error())
 		return nil, err
 	}
-	return objs, nil
+	if len(free) == 0 {
+		return nil, NewError(ErrCodeNoSlot, "yubikey has no available slots")
+	}
+	return []byte{free[0]}, nil
 }
 
-//GetNextEmptySlot returns the first empty slot found by yubikey to store a key
-func (ks *KeyStore) GetNextEmptySlot(session pkcs11.SessionHandle) ([]byte, error) {
-	findTemplate := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
-	}
+// freeSlots returns the slots which neither hold an object nor are reserved,
+// in the order they are handed out
+func (ks *KeyStore) freeSlots(session pkcs11.SessionHandle) ([]byte, error) {
 	attrTemplate := []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte{0}),
 	}
 
-	if err := pkcs11Ctx.FindObjectsInit(session, findTemplate); err != nil {
-		logrus.Debugf("Failed to init: %s", err.Error())
-		return nil, err
-	}
-	objs, b, err := pkcs11Ctx.FindObjects(session, numSlots)
-	// if there are more objects than `numSlots`, get all of them until
-	// there are no more to get
-	for err == nil {
-		var o []pkcs11.ObjectHandle
-		o, b, err = pkcs11Ctx.FindObjects(session, numSlots)
-		if err != nil {
-			continue
-		}
-		if len(o) == 0 {
-			break
-		}
-		objs = append(objs, o...)
-	}
-	taken := make(map[int]bool)
+	objs, err := findObjects(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+	})
 	if err != nil {
-		logrus.Debugf("Failed to find: %s %v", err.Error(), b)
-		return nil, err
-	}
-	if err = pkcs11Ctx.FindObjectsFinal(session); err != nil {
-		logrus.Debugf("Failed to finalize: %s\n", err.Error())
+		logrus.Debugf("Failed to find the objects on the token: %v", err)
 		return nil, err
 	}
+	taken := make(map[int]bool)
 	for _, obj := range objs {
 		// Retrieve the slot ID
 		attr, err := pkcs11Ctx.GetAttributeValue(session, obj, attrTemplate)
@@ -487,14 +759,14 @@ func (ks *KeyStore) GetNextEmptySlot(session pkcs11.SessionHandle) ([]byte, erro
 			}
 		}
 	}
-	// iterate the token locations in our preferred order and use the first
-	// available one. Otherwise exit the loop and return an error.
+	// iterate the token locations in our preferred order
+	var free []byte
 	for _, loc := range slotIDs {
-		if !taken[loc] {
-			return []byte{byte(loc)}, nil
+		if !taken[loc] && !ks.reserved[byte(loc)] {
+			free = append(free, byte(loc))
 		}
 	}
-	return nil, errors.New("yubikey has no available slots")
+	return free, nil
 }
 
 // SetupHSMEnv is a method that depends on the existences
@@ -508,32 +780,61 @@ func (ks *KeyStore) SetupHSMEnv() (pkcs11.SessionHandle, error) {
 	slots, err := p.GetSlotList(true)
 	if err != nil {
 		defer common.FinalizeAndDestroy(p)
-		return 0, fmt.Errorf(
-			"loaded library %s, but failed to list HSM slots %s", pkcs11Lib, err)
+		return 0, newPKCS11Error(err,
+			"loaded library %s, but failed to list HSM slots", pkcs11Lib)
 	}
 	// Check to see if we got any slots from the HSM.
 	if len(slots) < 1 {
 		defer common.FinalizeAndDestroy(p)
-		return 0, fmt.Errorf(
+		return 0, NewError(ErrCodeNoToken,
 			"loaded library %s, but no HSM slots found", pkcs11Lib)
 	}
 
 	// CKF_SERIAL_SESSION: TRUE if cryptographic functions are performed in serial with the application; FALSE if the functions may be performed in parallel with the application.
 	// CKF_RW_SESSION: TRUE if the session is read/write; FALSE if the session is read-only
-	session, err := p.OpenSession(slots[0], pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	slot, err := ks.selectTokenSlot(p, slots)
+	if err != nil {
+		defer common.FinalizeAndDestroy(p)
+		return 0, err
+	}
+	tokenSlot = slot
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
 	if err != nil {
 		defer common.Cleanup(p, session)
-		return 0, fmt.Errorf(
-			"loaded library %s, but failed to start session with HSM %s",
-			pkcs11Lib, err)
+		return 0, newPKCS11Error(err,
+			"loaded library %s, but failed to start session with HSM",
+			pkcs11Lib)
+	}
+	if info, err := p.GetTokenInfo(slot); err == nil {
+		rememberTokenInfo(info)
 	}
 
 	logrus.Debugf("Initialized PKCS11 library %s and started HSM session", pkcs11Lib)
 	return session, nil
 }
 
+// selectTokenSlot returns the first slot whose token matches the URI of
+// the config, or the first slot if none is configured
+func (ks *KeyStore) selectTokenSlot(p common.IPKCS11Ctx, slots []uint) (uint, error) {
+	if ks.token == nil || !ks.token.selectsToken() {
+		return slots[0], nil
+	}
+	for _, slot := range slots {
+		info, err := p.GetTokenInfo(slot)
+		if err != nil {
+			logrus.Debugf("Failed to get token info of slot %d: %v", slot, err)
+			continue
+		}
+		if ks.token.matchesToken(info) {
+			return slot, nil
+		}
+	}
+	return 0, NewError(ErrCodeNoToken, "loaded library %s, but no token matches %s", pkcs11Lib, ks.token)
+}
+
 // closes the pkcs11 Session
 func (ks *KeyStore) CloseSession(session pkcs11.SessionHandle) {
+	keyHandles.forgetSession(session)
 	err := pkcs11Ctx.CloseSession(session)
 	if err != nil {
 		logrus.Debugf("Error closing session: %s", err.Error())
@@ -552,27 +853,33 @@ func (ks *KeyStore) NeedLogin(function_id uint) (bool, uint, error) {
 	case externalstore.FUNCTION_HARDWAREREMOVEKEY:
 		return true, pkcs11.CKU_SO, nil
 	default:
-		return true, pkcs11.CKU_CONTEXT_SPECIFIC, fmt.Errorf("Unknown Function")
+		return true, pkcs11.CKU_CONTEXT_SPECIFIC, NewError(ErrCodeInvalidRequest, "Unknown Function")
 	}
 }
 
 // Initializes the library if needed, returns initialized Context
 func initializeLib() (common.IPKCS11Ctx, error) {
 	if pkcs11Ctx == nil {
+		// the library may have been installed or the search changed
+		// since it was last loaded
+		if lib := findLibrary(); lib != "" {
+			pkcs11Lib = lib
+		}
 		if pkcs11Lib == "" {
-			return nil, common.ErrHSMNotPresent{Err: "no library found"}
+			return nil, WrapError(ErrCodeNoToken, common.ErrHSMNotPresent{Err: "no library found"})
 		}
 		p := pkcs11.New(pkcs11Lib)
 
 		if p == nil {
-			return nil, fmt.Errorf("failed to load library %s", pkcs11Lib)
+			return nil, NewError(ErrCodeNoToken, "failed to load library %s", pkcs11Lib)
 		}
 
-		if err := p.Initialize(); err != nil {
-			defer common.FinalizeAndDestroy(p)
-			return nil, fmt.Errorf("found library %s, but initialize error %s", pkcs11Lib, err.Error())
+		ctx := traced(p)
+		if err := ctx.Initialize(); err != nil {
+			defer common.FinalizeAndDestroy(ctx)
+			return nil, NewError(ErrCodeNoToken, "found library %s, but initialize error %s", pkcs11Lib, err.Error())
 		}
-		pkcs11Ctx = p
+		pkcs11Ctx = ctx
 	}
 	return pkcs11Ctx, nil
 }